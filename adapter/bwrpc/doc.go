@@ -0,0 +1,7 @@
+//Package bwrpc holds the gRPC service definition for the agent protocol in
+//bw2.proto. It mirrors the out of band commands in doc/oob.md, so bindings
+//for other languages can be generated with protoc rather than implementing
+//the OOB frame format by hand
+package bwrpc
+
+//go:generate protoc --go_out=plugins=grpc:. bw2.proto
@@ -1,15 +1,20 @@
 package oob
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util/bwe"
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 func (bf *boundFrame) cmdPublishPersist() {
@@ -20,6 +25,19 @@ func (bf *boundFrame) cmdPublishPersist() {
 	el := bf.loadCommonElaborate()
 	verify := bf.loadBoolParam("doverify")
 	ros, pos := loadCommonXOs(bf.f)
+	consumers, _, emsg := bf.f.ParseFirstHeaderAsInt("consumers", 0)
+	if emsg != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *emsg))
+	}
+	var acktimeout time.Duration
+	if sat, ok := bf.f.GetFirstHeader("ack_timeout"); ok {
+		d, err := time.ParseDuration(sat)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "could not parse ack_timeout kv"))
+		}
+		acktimeout = d
+	}
+	ikey, _ := bf.f.GetFirstHeader("idempotency_key")
 	p := &api.PublishParams{
 		MVK:                mvk,
 		URISuffix:          suffix,
@@ -32,8 +50,124 @@ func (bf *boundFrame) cmdPublishPersist() {
 		Persist:            bf.f.Cmd == objects.CmdPersist,
 		DoVerify:           verify,
 		AutoChain:          autochain,
+		ValidatePayloads:   bf.loadBoolParam("validate"),
+		Trace:              bf.loadBoolParam("trace"),
+		Timestamp:          bf.loadBoolParam("timestamp"),
+		Consumers:          consumers,
+		AckTimeout:         acktimeout,
+		IdempotencyKey:     ikey,
+	}
+	if !bf.loadBoolParam("report") {
+		bf.bwcl.Publish(p, bf.mkFinalGenericActionCB())
+		return
+	}
+	bf.bwcl.PublishReport(p, func(err error, consumers int) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := objects.CreateFrame(objects.CmdResponse, bf.replyto)
+		r.AddHeader("status", "okay")
+		r.AddHeader("finished", "true")
+		if consumers >= 0 {
+			r.AddHeader("consumers", strconv.Itoa(consumers))
+		}
+		bf.send(r)
+	})
+}
+
+func (bf *boundFrame) cmdNack() {
+	handle, ok := bf.f.GetFirstHeader("handle")
+	if !ok || handle == "" {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(handle)"))
+	}
+	smsgid, ok := bf.f.GetFirstHeader("msgid")
+	if !ok || smsgid == "" {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(msgid)"))
+	}
+	subid := core.UniqueMessageIDFromString(handle)
+	msgid := core.UniqueMessageIDFromString(smsgid)
+	if subid == nil || msgid == nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "could not parse kv(handle) or kv(msgid)"))
 	}
-	bf.bwcl.Publish(p, bf.mkFinalGenericActionCB())
+	bf.bwcl.Nack(*msgid, *subid, func(redelivered bool, err error) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := objects.CreateFrame(objects.CmdResponse, bf.replyto)
+		r.AddHeader("status", "okay")
+		r.AddHeader("finished", "true")
+		r.AddHeader("redelivered", strconv.FormatBool(redelivered))
+		bf.send(r)
+	})
+}
+
+//cmdCall publishes a request on a slot and responds with the reply on the
+//signal that has its correlation ID
+func (bf *boundFrame) cmdCall() {
+	p := &api.CallParams{
+		Request:      make(map[string]interface{}),
+		ElaboratePAC: bf.loadCommonElaborate(),
+	}
+	var ok bool
+	if p.InterfaceURI, ok = bf.f.GetFirstHeader("uri"); !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(uri)"))
+	}
+	if p.Slot, ok = bf.f.GetFirstHeader("slot"); !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(slot)"))
+	}
+	p.ReplySignal, _ = bf.f.GetFirstHeader("replysignal")
+	if s, ok := bf.f.GetFirstHeader("timeout"); ok {
+		var err error
+		if p.Timeout, err = time.ParseDuration(s); err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(timeout)"))
+		}
+	}
+	retries, _, emsg := bf.f.ParseFirstHeaderAsInt("retries", 0)
+	if emsg != nil || retries < 0 {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(retries)"))
+	}
+	p.Retries = retries
+	for _, pe := range bf.f.POs {
+		if pe.PO.GetPONum() != objects.PONumMsgPack {
+			continue
+		}
+		if err := msgpack.Unmarshal(pe.PO.GetContent(), &p.Request); err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "the request must be a msgpack map", err))
+		}
+	}
+	bf.bwcl.Call(p, func(reply *core.Message, err error) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		commonUnpackMsg(reply, r)
+		bf.send(r)
+	})
+}
+
+func (bf *boundFrame) cmdDelete() {
+	mvk, suffix := bf.loadCommonURI()
+	autochain := bf.loadBoolParam("autochain")
+	pac := bf.loadCommonPAC(autochain, "PL")
+	expd, expt := bf.loadCommonExpiry()
+	el := bf.loadCommonElaborate()
+	verify := bf.loadBoolParam("doverify")
+	ros, _ := loadCommonXOs(bf.f)
+	p := &api.DeleteParams{
+		MVK:                mvk,
+		URISuffix:          suffix,
+		PrimaryAccessChain: pac,
+		ExpiryDelta:        expd,
+		Expiry:             expt,
+		ElaboratePAC:       el,
+		RoutingObjects:     ros,
+		DoVerify:           verify,
+		AutoChain:          autochain,
+	}
+	bf.bwcl.Delete(p, bf.mkFinalGenericActionCB())
 }
 
 func (bf *boundFrame) cmdList() {
@@ -43,6 +177,10 @@ func (bf *boundFrame) cmdList() {
 	el := bf.loadCommonElaborate()
 	expd, expt := bf.loadCommonExpiry()
 	ros, _ := loadCommonXOs(bf.f)
+	depth, hasdepth, emsg := bf.f.ParseFirstHeaderAsInt("depth", 1)
+	if emsg != nil || depth < 0 || depth > api.MaxListDepth {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(depth)"))
+	}
 	p := &api.ListParams{
 		MVK:                mvk,
 		URISuffix:          suffix,
@@ -52,6 +190,38 @@ func (bf *boundFrame) cmdList() {
 		ElaboratePAC:       el,
 		RoutingObjects:     ros,
 		AutoChain:          autochain,
+		Depth:              depth,
+	}
+	page, paged := bf.loadPageParams()
+	if paged {
+		if hasdepth || bf.loadBoolParam("counts") {
+			panic(bwe.M(bwe.InvalidOOBCommand, "kv(limit) and kv(cursor) cannot be used with kv(depth) or kv(counts)"))
+		}
+		bf.bwcl.ListPage(p, page,
+			bf.mkGenericActionCB(),
+			func(s string, ok bool) {
+				r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+				r.AddHeader("finished", "false")
+				r.AddHeader("child", s)
+				bf.send(r)
+			}, bf.mkPageEndCB())
+		return
+	}
+	if hasdepth || bf.loadBoolParam("counts") {
+		bf.bwcl.ListTree(p,
+			bf.mkGenericActionCB(),
+			func(e *store.ListEntry) {
+				r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+				r.AddHeader("finished", strconv.FormatBool(e == nil))
+				if e != nil {
+					r.AddHeader("child", e.URI)
+					r.AddHeader("depth", strconv.Itoa(e.Depth))
+					r.AddHeader("children", strconv.Itoa(e.Children))
+					r.AddHeader("hasdata", strconv.FormatBool(e.HasData))
+				}
+				bf.send(r)
+			})
+		return
 	}
 	bf.bwcl.List(p,
 		bf.mkGenericActionCB(),
@@ -67,8 +237,13 @@ func (bf *boundFrame) cmdList() {
 func (bf *boundFrame) cmdQuery() {
 	unpack := bf.loadBoolParam("unpack")
 	autochain := bf.loadBoolParam("autochain")
+	tap := bf.f.Cmd == objects.CmdTapQuery
+	perms := "C"
+	if tap {
+		perms = "T"
+	}
 	mvk, suffix := bf.loadCommonURI()
-	pac := bf.loadCommonPAC(autochain, "C")
+	pac := bf.loadCommonPAC(autochain, perms)
 	el := bf.loadCommonElaborate()
 	expd, expt := bf.loadCommonExpiry()
 	ros, _ := loadCommonXOs(bf.f)
@@ -82,24 +257,60 @@ func (bf *boundFrame) cmdQuery() {
 		RoutingObjects:     ros,
 		AutoChain:          autochain,
 	}
-	bf.bwcl.Query(p,
-		bf.mkGenericActionCB(),
-		func(m *core.Message) {
-			r := objects.CreateFrame(objects.CmdResult, bf.replyto)
-			r.AddHeader("finished", strconv.FormatBool(m == nil))
-			if m != nil {
-				if unpack {
-					commonUnpackMsg(m, r)
-				} else {
-					po, err := objects.CreateOpaquePayloadObjectDF("1.0.1.1", m.Encoded)
-					if err != nil {
-						panic("Not expecting this")
-					}
-					r.AddPayloadObject(po)
+	resultCB := func(m *core.Message) {
+		r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+		r.AddHeader("finished", strconv.FormatBool(m == nil))
+		if m != nil {
+			addPersistSeq(m, r)
+			if unpack {
+				commonUnpackMsg(m, r)
+			} else {
+				po, err := objects.CreateOpaquePayloadObjectDF("1.0.1.1", m.Encoded)
+				if err != nil {
+					panic("Not expecting this")
 				}
+				r.AddPayloadObject(po)
 			}
-			bf.send(r)
-		})
+		}
+		bf.send(r)
+	}
+	if page, paged := bf.loadPageParams(); paged {
+		queryPage := bf.bwcl.QueryPage
+		if tap {
+			queryPage = bf.bwcl.TapQueryPage
+		}
+		queryPage(p, page, bf.mkGenericActionCB(), resultCB, bf.mkPageEndCB())
+		return
+	}
+	query := bf.bwcl.Query
+	if tap {
+		query = bf.bwcl.TapQuery
+	}
+	query(p, bf.mkGenericActionCB(), resultCB)
+}
+
+//loadPageParams reads kv(limit) and kv(cursor), returning false if neither
+//was given and all the results are wanted
+func (bf *boundFrame) loadPageParams() (api.PageParams, bool) {
+	limit, haslimit, emsg := bf.f.ParseFirstHeaderAsInt("limit", 0)
+	if emsg != nil || limit < 0 || limit > api.MaxPageLimit {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(limit)"))
+	}
+	cursor, hascursor := bf.f.GetFirstHeader("cursor")
+	return api.PageParams{Limit: limit, Cursor: cursor}, haslimit || hascursor
+}
+
+//mkPageEndCB sends the finished result, with kv(cursor) if there are more
+//results
+func (bf *boundFrame) mkPageEndCB() api.PageEndCallback {
+	return func(next string) {
+		r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+		r.AddHeader("finished", "true")
+		if next != "" {
+			r.AddHeader("cursor", next)
+		}
+		bf.send(r)
+	}
 }
 
 //TODO fix the finished logic and stuff. When subscriptions end you should get
@@ -109,11 +320,20 @@ func (bf *boundFrame) cmdQuery() {
 func (bf *boundFrame) cmdSubscribe() {
 	unpack := bf.loadBoolParam("unpack")
 	autochain := bf.loadBoolParam("autochain")
+	tap := bf.f.Cmd == objects.CmdTapSubscribe
+	perms := "C"
+	if tap {
+		perms = "T"
+	}
 	mvk, suffix := bf.loadCommonURI()
-	pac := bf.loadCommonPAC(autochain, "C")
+	pac := bf.loadCommonPAC(autochain, perms)
 	el := bf.loadCommonElaborate()
 	expd, expt := bf.loadCommonExpiry()
 	ros, _ := loadCommonXOs(bf.f)
+	validate, _ := bf.f.GetFirstHeader("validate")
+	if validate != "" && validate != "drop" && validate != "flag" {
+		panic(bwe.M(bwe.InvalidOOBCommand, "kv(validate) must be drop or flag"))
+	}
 	p := &api.SubscribeParams{
 		MVK:                mvk,
 		URISuffix:          suffix,
@@ -123,8 +343,14 @@ func (bf *boundFrame) cmdSubscribe() {
 		ElaboratePAC:       el,
 		RoutingObjects:     ros,
 		AutoChain:          autochain,
+		DropInvalid:        validate == "drop",
+		Filter:             bf.loadSubscriptionFilter(),
+	}
+	subscribe := bf.bwcl.Subscribe
+	if tap {
+		subscribe = bf.bwcl.Tap
 	}
-	bf.bwcl.Subscribe(p,
+	subscribe(p,
 		func(err error, id core.UniqueMessageID) {
 			if err == nil {
 				r := objects.CreateFrame(objects.CmdResponse, bf.replyto)
@@ -140,6 +366,12 @@ func (bf *boundFrame) cmdSubscribe() {
 			r := objects.CreateFrame(objects.CmdResult, bf.replyto)
 			r.AddHeader("finished", strconv.FormatBool(m == nil))
 			if m != nil {
+				if validate == "flag" {
+					if err := api.ValidatePayloads(m); err != nil {
+						r.AddHeader("invalid", err.Error())
+					}
+				}
+				addPersistSeq(m, r)
 				if unpack {
 					commonUnpackMsg(m, r)
 				} else {
@@ -153,6 +385,55 @@ func (bf *boundFrame) cmdSubscribe() {
 			bf.send(r)
 		})
 }
+//loadSubscriptionFilter builds the filter in the filter_ponum (repeatable
+//dot forms with an optional /mask), filter_minsize, filter_maxsize and
+//filter_field (repeatable path=value, the value as JSON or else a string)
+//kvs, or nil if there are none
+func (bf *boundFrame) loadSubscriptionFilter() *objects.SubscriptionFilter {
+	dfs := bf.f.GetAllHeaders("filter_ponum")
+	fieldkvs := bf.f.GetAllHeaders("filter_field")
+	minsize, gotmin, emsg := bf.f.ParseFirstHeaderAsInt("filter_minsize", 0)
+	if emsg != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *emsg))
+	}
+	maxsize, gotmax, emsg := bf.f.ParseFirstHeaderAsInt("filter_maxsize", 0)
+	if emsg != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *emsg))
+	}
+	if len(dfs) == 0 && len(fieldkvs) == 0 && !gotmin && !gotmax {
+		return nil
+	}
+	var ponums []objects.PONumMatch
+	for _, df := range dfs {
+		pm, err := objects.ParsePONumMatch(df)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "kv(filter_ponum): "+err.Error()))
+		}
+		ponums = append(ponums, pm)
+	}
+	var fields []objects.FieldMatch
+	for _, kv := range fieldkvs {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			panic(bwe.M(bwe.MalformedOOBCommand, "kv(filter_field) must be path=value"))
+		}
+		var v interface{}
+		if json.Unmarshal([]byte(parts[1]), &v) != nil {
+			v = parts[1]
+		}
+		enc, err := msgpack.Marshal(v)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "kv(filter_field) value cannot be encoded"))
+		}
+		fields = append(fields, objects.FieldMatch{Field: parts[0], Value: enc})
+	}
+	sf, err := objects.CreateSubscriptionFilter(ponums, minsize, maxsize, fields)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, err.Error()))
+	}
+	return sf
+}
+
 func (bf *boundFrame) cmdMakeEntity() {
 	expd, expt := bf.loadCommonExpiry()
 	contact, _ := bf.f.GetFirstHeader("contact")
@@ -240,6 +521,10 @@ func (bf *boundFrame) cmdMakeDot() {
 		p.MVK = mvk
 		p.URISuffix = suffix
 		p.AccessPermissions = perms
+		if bf.loadBoolParam("retain") {
+			p.PublishLimits = &objects.PublishLimits{Retain: 1}
+		}
+		p.NoDelegate, _ = bf.f.GetFirstHeader("nodelegate")
 	} else {
 		panic(bwe.M(bwe.InvalidOOBCommand, "Application DOTs are not implemented"))
 	}
@@ -323,6 +608,35 @@ func (bf *boundFrame) cmdMakeChain() {
 	r.AddPayloadObject(po)
 	bf.send(r)
 }
+//loadChainPolicy reads the optional minexpiry, prefer and shortest kvs,
+//starting from the client's policy
+func (bf *boundFrame) loadChainPolicy() *api.ChainPolicy {
+	policy := *bf.bwcl.GetChainPolicy()
+	//The intermediaries are appended to, so copy them rather than write
+	//into the backing array of the client's policy
+	policy.PreferredIntermediaries = append([][]byte{}, policy.PreferredIntermediaries...)
+	if sme, ok := bf.f.GetFirstHeader("minexpiry"); ok {
+		d, err := time.ParseDuration(sme)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "could not parse minexpiry kv"))
+		}
+		policy.MinTimeToExpiry = d
+	}
+	for _, spref := range bf.f.GetAllHeaders("prefer") {
+		vk, err := crypto.UnFmtKey(spref)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "could not parse prefer kv"))
+		}
+		policy.PreferredIntermediaries = append(policy.PreferredIntermediaries, vk)
+	}
+	shortest, _, invalid := bf.f.ParseFirstHeaderAsBool("shortest", policy.PreferShortest)
+	if invalid != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *invalid))
+	}
+	policy.PreferShortest = shortest
+	return &policy
+}
+
 func (bf *boundFrame) cmdBuildChain() {
 	bf.checkChainAge()
 	var to []byte
@@ -345,6 +659,7 @@ func (bf *boundFrame) cmdBuildChain() {
 			log.Infof("OOB BC S: %s", s)
 		}
 	}()
+	policy := bf.loadChainPolicy()
 	cb := api.NewChainBuilder(bf.bwcl, crypto.FmtKey(mvk)+"/"+suffix, perms, to, status)
 	go func() {
 		//We are going to change the chain builder to emit results on a channel later
@@ -355,6 +670,7 @@ func (bf *boundFrame) cmdBuildChain() {
 			log.Criticalf("CB fail: %v", e.Error())
 			panic(e)
 		}
+		chains = policy.Order(bf.bwcl.BW(), chains)
 		rs := objects.CreateFrame(objects.CmdResponse, bf.replyto)
 		rs.AddHeader("status", "okay")
 		bf.send(rs)
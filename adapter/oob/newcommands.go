@@ -2,17 +2,21 @@ package oob
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
+	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
 	"github.com/immesys/bw2bc/common"
 )
@@ -47,12 +51,13 @@ func (bf *boundFrame) cmdPutDot() {
 		panic(bwe.WrapM(bwe.MalformedOOBCommand, "Could not load DOT: ", err))
 	}
 	dt := dti.(*objects.DOT)
-	bf.bwcl.BCC().PublishDOT(context.TODO(), acc, dt, func(err error) {
+	bf.loadBCC().PublishDOT(context.TODO(), acc, dt, func(res *bc.TxResult, err error) {
 		if err != nil {
 			bf.Err(err)
 		} else {
 			r := bf.mkFinalResponseOkayFrame()
 			r.AddHeader("hash", crypto.FmtHash(dt.GetHash()))
+			addTxResultHeaders(r, res)
 			bf.send(r)
 		}
 	})
@@ -69,12 +74,13 @@ func (bf *boundFrame) cmdPutEntity() {
 		panic(bwe.WrapM(bwe.MalformedOOBCommand, "Could not load Entity", err))
 	}
 	ent := enti.(*objects.Entity)
-	bf.bwcl.BCC().PublishEntity(context.TODO(), acc, ent, func(err error) {
+	bf.loadBCC().PublishEntity(context.TODO(), acc, ent, func(res *bc.TxResult, err error) {
 		if err != nil {
 			bf.Err(err)
 		} else {
 			r := bf.mkFinalResponseOkayFrame()
 			r.AddHeader("vk", crypto.FmtKey(ent.GetVK()))
+			addTxResultHeaders(r, res)
 			bf.send(r)
 		}
 	})
@@ -91,12 +97,25 @@ func (bf *boundFrame) cmdPutChain() {
 		panic(bwe.WrapM(bwe.MalformedOOBCommand, "Could not load DChain: ", err))
 	}
 	dc := dci.(*objects.DChain)
-	bf.bwcl.BCC().PublishAccessDChain(context.TODO(), acc, dc, func(err error) {
+	if est, _ := bf.f.GetFirstHeader("estimate"); est == "true" {
+		cost, err := bf.loadBCC().EstimateAccessDChain(context.TODO(), acc, dc)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("hash", crypto.FmtHash(dc.GetChainHash()))
+		addTxCostHeaders(r, cost)
+		bf.send(r)
+		return
+	}
+	bf.loadBCC().PublishAccessDChain(context.TODO(), acc, dc, func(res *bc.TxResult, err error) {
 		if err != nil {
 			bf.Err(err)
 		} else {
 			r := bf.mkFinalResponseOkayFrame()
 			r.AddHeader("hash", crypto.FmtHash(dc.GetChainHash()))
+			addTxResultHeaders(r, res)
 			bf.send(r)
 		}
 	})
@@ -141,25 +160,54 @@ func (bf *boundFrame) cmdAddressBalance() {
 	r.AddPayloadObject(po)
 	bf.send(r)
 }
-func (bf *boundFrame) cmdBCInteractionParams() {
-	bf.checkHaveChain()
-	conf, hasconf, emsg := bf.f.ParseFirstHeaderAsInt("confirmations", 0)
-	if emsg != nil {
-		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(confirmations)"))
+func (bf *boundFrame) cmdContractCode() {
+	address, ok := bf.f.GetFirstHeader("address")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "Missing kv(address)"))
 	}
-	timo, hastimo, emsg := bf.f.ParseFirstHeaderAsInt("timeout", 0)
-	if emsg != nil || timo < 0 {
-		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(timeout)"))
+	code, err := bf.bwcl.BC().GetCode(context.TODO(), address)
+	if err != nil {
+		panic(err)
 	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeaderB("code", code)
+	bf.send(r)
+}
+func (bf *boundFrame) cmdContracts() {
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("chainid", bf.bwcl.BC().ChainID().Text(10))
+	for _, st := range bf.bwcl.VerifyContracts() {
+		errs := ""
+		if st.Err != nil {
+			errs = st.Err.Error()
+		}
+		r.AddHeader("contract", fmt.Sprintf("%s,0x%s,%s,%s,%s", st.Name, st.Address.Hex(), st.CodeHash.Hex(), st.ExpectedHash.Hex(), errs))
+	}
+	bf.send(r)
+}
+func (bf *boundFrame) cmdBCInteractionParams() {
+	bf.checkHaveChain()
+	ip := bf.loadInteractionParams()
 	maxa, hasmaxa, emsg := bf.f.ParseFirstHeaderAsInt("maxage", 0)
 	if emsg != nil || maxa < 0 {
 		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(maxage)"))
 	}
-	if hasconf {
-		bf.bwcl.BCC().SetDefaultConfirmations(uint64(conf))
-	}
-	if hastimo {
-		bf.bwcl.BCC().SetDefaultTimeout(uint64(timo))
+	if ip.Confirmations != nil || ip.TimeoutBlocks != nil || ip.MaxGasPrice != nil || ip.Retry != nil {
+		if bf.bwcl.BCC() == nil {
+			panic(bwe.M(bwe.NoEntity, "set an entity before changing chain interaction params"))
+		}
+		if ip.Confirmations != nil {
+			bf.bwcl.BCC().SetDefaultConfirmations(*ip.Confirmations)
+		}
+		if ip.TimeoutBlocks != nil {
+			bf.bwcl.BCC().SetDefaultTimeout(*ip.TimeoutBlocks)
+		}
+		if ip.MaxGasPrice != nil {
+			bf.bwcl.BCC().SetMaxGasPrice(ip.MaxGasPrice)
+		}
+		if ip.Retry != nil {
+			bf.bwcl.BCC().SetRetryPolicy(*ip.Retry)
+		}
 	}
 	if hasmaxa {
 		bf.bwcl.SetMaxChainAge(uint64(maxa))
@@ -168,9 +216,15 @@ func (bf *boundFrame) cmdBCInteractionParams() {
 	if bf.bwcl.BCC() != nil {
 		r.AddHeader("confirmations", strconv.FormatUint(bf.bwcl.BCC().GetDefaultConfirmations(), 10))
 		r.AddHeader("timeout", strconv.FormatUint(bf.bwcl.BCC().GetDefaultTimeout(), 10))
+		if mgp := bf.bwcl.BCC().GetMaxGasPrice(); mgp != nil {
+			r.AddHeader("maxgasprice", mgp.Text(10))
+		}
+		r.AddHeader("attempts", strconv.Itoa(bf.bwcl.BCC().GetRetryPolicy().MaxAttempts))
 	} else {
 		r.AddHeader("confirmations", strconv.FormatUint(bc.DefaultConfirmations, 10))
 		r.AddHeader("timeout", strconv.FormatUint(bc.DefaultTimeout, 10))
+		r.AddHeader("maxgasprice", bc.DefaultMaxGasPrice)
+		r.AddHeader("attempts", strconv.Itoa(bc.DefaultRetryPolicy.MaxAttempts))
 	}
 
 	r.AddHeader("maxage", strconv.FormatUint(bf.bwcl.GetMaxChainAge(), 10))
@@ -226,7 +280,20 @@ func (bf *boundFrame) cmdTransfer() {
 	gas, _ := bf.f.GetFirstHeader("gas")
 	gasprice, _ := bf.f.GetFirstHeader("gasprice")
 	data, _ := bf.f.GetFirstHeader("data")
-	bf.bwcl.BCC().TransactAndCheck(context.TODO(), acc, addr, bigValue.Text(10), gas, gasprice, common.FromHex(data),
+	if gas == "" && gasprice == "" && data == "" {
+		bf.loadBCC()
+		bf.bwcl.TransferWei(context.TODO(), bf.loadInteractionParams(), acc, addr, bigValue, func(res *bc.TxResult, err error) {
+			if err != nil {
+				bf.Err(err)
+			} else {
+				r := bf.mkFinalResponseOkayFrame()
+				addTxResultHeaders(r, res)
+				bf.send(r)
+			}
+		})
+		return
+	}
+	bf.loadBCC().TransactAndCheck(context.TODO(), acc, addr, bigValue.Text(10), gas, gasprice, common.FromHex(data),
 		bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdMakeShortAlias() {
@@ -239,7 +306,7 @@ func (bf *boundFrame) cmdMakeShortAlias() {
 	if len(content) > 32 {
 		content = content[:32]
 	}
-	bf.bwcl.BCC().CreateShortAlias(context.TODO(), acc, bc.SliceToBytes32(content), func(alias uint64, err error) {
+	bf.loadBCC().CreateShortAlias(context.TODO(), acc, bc.SliceToBytes32(content), func(alias uint64, err error) {
 		if err != nil {
 			bf.Err(err)
 		} else {
@@ -269,7 +336,7 @@ func (bf *boundFrame) cmdMakeLongAlias() {
 	if len(key) > 32 {
 		key = key[:32]
 	}
-	bf.bwcl.BCC().SetAlias(context.TODO(), acc, bc.SliceToBytes32(key), bc.SliceToBytes32(content),
+	bf.loadBCC().SetAlias(context.TODO(), acc, bc.SliceToBytes32(key), bc.SliceToBytes32(content),
 		bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdResolveAlias() {
@@ -337,7 +404,7 @@ func (bf *boundFrame) cmdNewDesignatedRouterOffer() {
 	if err != nil {
 		panic(err)
 	}
-	bf.bwcl.BCC().CreateRoutingOffer(context.TODO(), acc, ent, nsvk, bf.mkFinalGenericActionCB())
+	bf.loadBCC().CreateRoutingOffer(context.TODO(), acc, ent, nsvk, bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdRevokeRoutingObject() {
 	bf.checkChainAge()
@@ -399,12 +466,13 @@ func (bf *boundFrame) cmdPutRevocation() {
 		panic(bwe.WrapM(bwe.MalformedOOBCommand, "Could not load Revocation: ", err))
 	}
 	rvk := rvki.(*objects.Revocation)
-	bf.bwcl.BCC().PublishRevocation(context.TODO(), acc, rvk, func(err error) {
+	bf.loadBCC().PublishRevocation(context.TODO(), acc, rvk, func(res *bc.TxResult, err error) {
 		if err != nil {
 			bf.Err(err)
 		} else {
 			r := bf.mkFinalResponseOkayFrame()
 			r.AddHeader("hash", crypto.FmtHash(rvk.GetHash()))
+			addTxResultHeaders(r, res)
 			bf.send(r)
 		}
 	})
@@ -418,7 +486,7 @@ func (bf *boundFrame) cmdUpdateSRVRecord() {
 	if !srvok {
 		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(srv)"))
 	}
-	bf.bwcl.BCC().CreateSRVRecord(context.TODO(), acc, ent, srv, bf.mkFinalGenericActionCB())
+	bf.loadBCC().CreateSRVRecord(context.TODO(), acc, ent, srv, bf.mkFinalGenericActionCB())
 }
 
 func (bf *boundFrame) cmdListDesignatedRouterOffers() {
@@ -472,7 +540,7 @@ func (bf *boundFrame) cmdAcceptDesignatedRouterOffer() {
 	if err != nil {
 		panic(err)
 	}
-	bf.bwcl.BCC().AcceptRoutingOffer(context.TODO(), acc, ent, drvk, bf.mkFinalGenericActionCB())
+	bf.loadBCC().AcceptRoutingOffer(context.TODO(), acc, ent, drvk, bf.mkFinalGenericActionCB())
 }
 
 func (bf *boundFrame) cmdResolveRegistryObject() {
@@ -504,10 +572,59 @@ func (bf *boundFrame) cmdResolveRegistryObject() {
 	bf.send(r)
 }
 
+//loadViewExpression parses the expression in kv(msgpack) or kv(json)
+func (bf *boundFrame) loadViewExpression() api.Expression {
+	var ex api.Expression
+	var err error
+	if blob, ok := bf.f.GetFirstHeaderB("msgpack"); ok {
+		ex, err = api.ExpressionFromMsgPack(blob)
+	} else if blob, ok := bf.f.GetFirstHeaderB("json"); ok {
+		ex, err = api.ExpressionFromJSON(blob)
+	} else {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(msgpack) or kv(json)"))
+	}
+	if err != nil {
+		panic(bwe.WrapM(bwe.BadView, "Could not parse view expression", err))
+	}
+	return ex
+}
+
+//streamViewChanges sends a result for each change to the view
+func (bf *boundFrame) streamViewChanges(v *api.View) {
+	v.OnChangeDiff(func(changes []api.ViewChange) {
+		nr := objects.CreateFrame(objects.CmdResult, bf.replyto)
+		nr.AddHeader("finished", strconv.FormatBool(false))
+		addViewChangePOs(nr, changes)
+		bf.send(nr)
+	})
+}
+
 func (bf *boundFrame) cmdMakeView() {
-	expression, ok := bf.f.GetFirstHeaderB("msgpack")
-	if !ok {
-		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(msgpack)"))
+	ex := bf.loadViewExpression()
+	journal, _, emsg := bf.f.ParseFirstHeaderAsInt("journal", 0)
+	if emsg != nil || journal < 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(journal)"))
+	}
+	lingerS, hosted := bf.f.GetFirstHeader("linger")
+	if hosted {
+		linger, err := time.ParseDuration(lingerS)
+		if err != nil || linger < 0 {
+			panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(linger)"))
+		}
+		bf.bwcl.NewHostedView(linger, func(err error, vid int, handle string) {
+			if err != nil {
+				bf.Err(bwe.WrapM(bwe.BadView, "Could not create view", err))
+				return
+			}
+			r := bf.mkNonfinalResponseOkayFrame()
+			r.AddHeader("id", strconv.Itoa(vid))
+			r.AddHeader("handle", handle)
+			bf.send(r)
+			v := bf.bwcl.LookupView(vid)
+			v.EnableJournal(journal)
+			bf.streamViewChanges(v)
+		}, ex)
+		return
 	}
 	ondone := func(err error, vid int) {
 		if err != nil {
@@ -517,15 +634,83 @@ func (bf *boundFrame) cmdMakeView() {
 		r := bf.mkNonfinalResponseOkayFrame()
 		r.AddHeader("id", strconv.Itoa(vid))
 		bf.send(r)
-		bf.bwcl.LookupView(vid).OnChange(func() {
-			//	nr := bf.mkResult
-			nr := objects.CreateFrame(objects.CmdResult, bf.replyto)
-			nr.AddHeader("finished", strconv.FormatBool(false))
-			//Maybe add extra content here
-			bf.send(nr)
-		})
+		v := bf.bwcl.LookupView(vid)
+		v.EnableJournal(journal)
+		bf.streamViewChanges(v)
+	}
+	bf.bwcl.NewView(ondone, ex)
+}
+
+func (bf *boundFrame) cmdBindView() {
+	handle, ok := bf.f.GetFirstHeader("handle")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(handle)"))
+	}
+	vid, v, err := bf.bwcl.BindView(handle)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkNonfinalResponseOkayFrame()
+	r.AddHeader("id", strconv.Itoa(vid))
+	bf.send(r)
+	bf.streamViewChanges(v)
+}
+
+func (bf *boundFrame) cmdTearDownView() {
+	vid, _, _ := bf.f.ParseFirstHeaderAsInt("id", -1)
+	if err := bf.bwcl.TearDownView(vid); err != nil {
+		panic(err)
+	}
+	bf.send(bf.mkFinalResponseOkayFrame())
+}
+
+func (bf *boundFrame) cmdViewInfo() {
+	vid, _, _ := bf.f.ParseFirstHeaderAsInt("id", -1)
+	v := bf.bwcl.LookupView(vid)
+	if v == nil {
+		panic(bwe.M(bwe.BadView, "Cannot find view"))
+	}
+	mp, err := api.ExpressionToMsgPack(v.Expression())
+	if err != nil {
+		panic(bwe.WrapM(bwe.BadView, "Could not serialize view expression", err))
+	}
+	js, err := api.ExpressionToJSON(v.Expression())
+	if err != nil {
+		panic(bwe.WrapM(bwe.BadView, "Could not serialize view expression", err))
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	if v.Handle() != "" {
+		r.AddHeader("handle", v.Handle())
+	}
+	r.AddHeaderB("msgpack", mp)
+	r.AddHeaderB("json", js)
+	r.AddHeader("interfaces", strconv.Itoa(len(v.Interfaces())))
+	bf.send(r)
+}
+
+func addViewChangePOs(r *objects.Frame, changes []api.ViewChange) {
+	for i := range changes {
+		po, err := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, &changes[i])
+		if err != nil {
+			panic(err)
+		}
+		r.AddPayloadObject(po)
+	}
+}
+
+func (bf *boundFrame) cmdViewJournal() {
+	vid, _, _ := bf.f.ParseFirstHeaderAsInt("id", -1)
+	v := bf.bwcl.LookupView(vid)
+	if v == nil {
+		panic(bwe.M(bwe.BadView, "Cannot find view"))
+	}
+	since, _, emsg := bf.f.ParseFirstHeaderAsInt("since", 0)
+	if emsg != nil || since < 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(since)"))
 	}
-	bf.bwcl.NewViewFromBlob(ondone, expression)
+	r := bf.mkFinalResponseOkayFrame()
+	addViewChangePOs(r, v.Journal(uint64(since)))
+	bf.send(r)
 }
 
 func (bf *boundFrame) cmdSubView() {
@@ -616,7 +801,7 @@ func (bf *boundFrame) cmdRevokeDROffer() {
 	if err != nil {
 		panic(err)
 	}
-	bf.bwcl.BCC().RetractRoutingOffer(context.TODO(), acc, ent, nsvk, bf.mkFinalGenericActionCB())
+	bf.loadBCC().RetractRoutingOffer(context.TODO(), acc, ent, nsvk, bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdRevokeDRAccept() {
 	bf.checkChainAge()
@@ -630,7 +815,7 @@ func (bf *boundFrame) cmdRevokeDRAccept() {
 	if err != nil {
 		panic(err)
 	}
-	bf.bwcl.BCC().RetractRoutingAcceptance(context.TODO(), acc, ent, drvk, bf.mkFinalGenericActionCB())
+	bf.loadBCC().RetractRoutingAcceptance(context.TODO(), acc, ent, drvk, bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdFindDOTs() {
 	bf.checkChainAge()
@@ -658,6 +843,70 @@ func (bf *boundFrame) cmdFindDOTs() {
 	}
 	bf.send(r)
 }
+func (bf *boundFrame) cmdTxParams() {
+	bf.checkChainAge()
+	addr, addrok := bf.f.GetFirstHeader("address")
+	if !addrok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(address)"))
+	}
+	otx, err := bf.bwcl.BC().GetTxParams(context.TODO(), bc.HexToAddress(addr))
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("nonce", strconv.FormatUint(otx.Nonce, 10))
+	r.AddHeader("gasprice", otx.GasPrice.Text(10))
+	if otx.ChainID != nil {
+		r.AddHeader("chainid", otx.ChainID.Text(10))
+	}
+	nsvkS, nsvkok := bf.f.GetFirstHeader("nsvk")
+	if nsvkok {
+		nsvk, err := bf.bwcl.BW().ResolveKey(nsvkS)
+		if err != nil {
+			panic(err)
+		}
+		nsnonce, err := bf.bwcl.BC().GetAffinityNSNonce(context.TODO(), nsvk)
+		if err != nil {
+			panic(bwe.WrapM(bwe.BlockChainGenericError, "Could not get namespace nonce", err))
+		}
+		r.AddHeader("nsnonce", nsnonce.Text(10))
+	}
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdSendRawTx() {
+	bf.checkChainAge()
+	raw, rawok := bf.f.GetFirstHeaderB("rawtx")
+	if !rawok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(rawtx)"))
+	}
+	ip := bf.loadInteractionParams()
+	var conf, timo uint64 = bc.DefaultConfirmations, bc.DefaultTimeout
+	if bf.bwcl.BCC() != nil {
+		conf = bf.bwcl.BCC().GetDefaultConfirmations()
+		timo = bf.bwcl.BCC().GetDefaultTimeout()
+	}
+	if ip.Confirmations != nil {
+		conf = *ip.Confirmations
+	}
+	if ip.TimeoutBlocks != nil {
+		timo = *ip.TimeoutBlocks
+	}
+	txhash, err := bf.bwcl.BC().SendRawTransaction(context.TODO(), raw)
+	if err != nil {
+		panic(err)
+	}
+	bf.bwcl.BC().WaitForTransaction(context.TODO(), txhash, timo, conf, func(res *bc.TxResult, err error) {
+		if err != nil {
+			bf.Err(err)
+		} else {
+			r := bf.mkFinalResponseOkayFrame()
+			addTxResultHeaders(r, res)
+			bf.send(r)
+		}
+	})
+}
+
 func (bf *boundFrame) cmdDevelop() {
 	// bf.checkChainAge()
 	// fmt.Println("\n\n\nDEVELOP CALL")
@@ -672,3 +921,977 @@ func (bf *boundFrame) cmdDevelop() {
 	// v = bf.bwcl.NewView(ondone, []string{"410.dev"})
 	// fmt.Println("view created: ", v)
 }
+
+//loadAliasKey gets the alias an alias management command is about, from
+//kv(key) for a long alias or kv(shortkey) for a short one
+func (bf *boundFrame) loadAliasKey() bc.Bytes32 {
+	key, keyok := bf.f.GetFirstHeaderB("key")
+	shortkey, shortkeyok := bf.f.GetFirstHeader("shortkey")
+	if keyok == shortkeyok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "must specify kv(key) OR kv(shortkey)"))
+	}
+	if keyok {
+		if len(key) > 32 {
+			key = key[:32]
+		}
+		return bc.SliceToBytes32(key)
+	}
+	short, err := strconv.ParseUint(shortkey, 16, 64)
+	if err != nil {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad hex for kv(shortkey)"))
+	}
+	return bc.ShortAliasKey(short)
+}
+
+func (bf *boundFrame) cmdUpdateAlias() {
+	bf.checkChainAge()
+	acc := bf.loadAccount()
+	key := bf.loadAliasKey()
+	content, contentok := bf.f.GetFirstHeaderB("content")
+	if !contentok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing content kv"))
+	}
+	if len(content) > 32 {
+		content = content[:32]
+	}
+	bf.loadBCC().UpdateAlias(context.TODO(), acc, key, bc.SliceToBytes32(content),
+		bf.mkFinalGenericActionCB())
+}
+
+func (bf *boundFrame) cmdTransferAlias() {
+	bf.checkChainAge()
+	acc := bf.loadAccount()
+	key := bf.loadAliasKey()
+	to, took := bf.f.GetFirstHeader("to")
+	if !took {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(to)"))
+	}
+	bf.loadBCC().TransferAlias(context.TODO(), acc, key, bc.HexToAddress(to),
+		bf.mkFinalGenericActionCB())
+}
+
+func (bf *boundFrame) cmdDeleteAlias() {
+	bf.checkChainAge()
+	acc := bf.loadAccount()
+	key := bf.loadAliasKey()
+	bf.loadBCC().DeleteAlias(context.TODO(), acc, key, bf.mkFinalGenericActionCB())
+}
+
+//cmdListAliases finds aliases either by value (a reverse lookup) or by the
+//accounts that own them. With neither kv, the accounts of the bound
+//entity are used. If the alias contract has no owners yet, the aliases the
+//accounts paid for are listed instead
+func (bf *boundFrame) cmdListAliases() {
+	bf.checkChainAge()
+	value, valueok := bf.f.GetFirstHeaderB("value")
+	addrs := bf.f.GetAllHeaders("address")
+	var recs []*bc.AliasRecord
+	var err error
+	switch {
+	case valueok && len(addrs) != 0:
+		panic(bwe.M(bwe.InvalidOOBCommand, "specify kv(value) or kv(address), not both"))
+	case valueok:
+		recs, err = bf.bwcl.BW().FindAliasesFor(value)
+	default:
+		baddrs := []bc.Address{}
+		for _, a := range addrs {
+			baddrs = append(baddrs, bc.HexToAddress(a))
+		}
+		if len(baddrs) == 0 {
+			if bf.bwcl.BCC() == nil {
+				panic(bwe.M(bwe.NoEntity, "no kv(value) or kv(address) and no entity set"))
+			}
+			for i := 0; i < bc.MaxEntityAccounts; i++ {
+				addr, err := bf.bwcl.BCC().GetAddress(i)
+				if err != nil {
+					panic(err)
+				}
+				baddrs = append(baddrs, addr)
+			}
+		}
+		recs, err = bf.bwcl.BW().FindAliasesOwnedBy(baddrs)
+		if err == bc.ErrNoAliasOwners {
+			recs, err = bf.bwcl.BW().FindAliasesCreatedBy(baddrs)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, rec := range recs {
+		creator, owner := "", ""
+		if rec.Creator != (bc.Address{}) {
+			creator = "0x" + rec.Creator.Hex()
+		}
+		if rec.Owner != (bc.Address{}) {
+			owner = "0x" + rec.Owner.Hex()
+		}
+		line := fmt.Sprintf("0x%x,0x%x,%d,%s,%s,%s", rec.Key[:], rec.Value[:], rec.BlockNumber, rec.TxHash.Hex(), creator, owner)
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumString, []byte(line))
+		if err != nil {
+			panic(err)
+		}
+		r.AddPayloadObject(po)
+	}
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdSearchRegistry() {
+	bf.checkChainAge()
+	pattern, patternok := bf.f.GetFirstHeader("pattern")
+	if !patternok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(pattern)"))
+	}
+	q := &api.RegistrySearch{Pattern: pattern}
+	q.Regex, _, _ = bf.f.ParseFirstHeaderAsBool("regex", false)
+	if typ, ok := bf.f.GetFirstHeader("type"); ok {
+		switch typ {
+		case "entity":
+			q.Entities = true
+		case "dot":
+			q.DOTs = true
+		default:
+			panic(bwe.M(bwe.InvalidOOBCommand, "kv(type) must be entity or dot"))
+		}
+	}
+	res, err := bf.bwcl.BW().SearchRegistry(q)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, m := range res {
+		po, err := objects.CreateOpaquePayloadObject(m.RO.GetRONum(), m.RO.GetContent())
+		if err != nil {
+			panic(err)
+		}
+		r.AddPayloadObject(po)
+		pos := advpo.CreateStringPayloadObject(bf.bwcl.BW().StateToString(m.State))
+		r.AddPayloadObject(pos)
+	}
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdExportNamespace() {
+	bf.checkChainAge()
+	nsvkS, nsvkok := bf.f.GetFirstHeader("nsvk")
+	if !nsvkok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(nsvk)"))
+	}
+	nsvk, err := bf.bwcl.BW().ResolveKey(nsvkS)
+	if err != nil {
+		panic(err)
+	}
+	snap, err := bf.bwcl.BW().ExportNamespace(nsvk)
+	if err != nil {
+		panic(err)
+	}
+	contents, err := json.Marshal(snap)
+	if err != nil {
+		panic(bwe.WrapM(bwe.BadOperation, "Could not encode snapshot", err))
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddPayloadObject(advpo.CreateBasePayloadObject(objects.PONumJSON, contents))
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdImportNamespace() {
+	if len(bf.f.POs) != 1 || bf.f.POs[0].PO.GetPONum() != objects.PONumJSON {
+		panic(bwe.M(bwe.InvalidOOBCommand, "expected one JSON PO"))
+	}
+	snap := &api.NamespaceSnapshot{}
+	if err := json.Unmarshal(bf.f.POs[0].PO.GetContent(), snap); err != nil {
+		panic(bwe.WrapM(bwe.MalformedOOBCommand, "Could not decode snapshot", err))
+	}
+	loaded, skipped, err := bf.bwcl.BW().ImportNamespace(snap)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("loaded", strconv.Itoa(loaded))
+	r.AddHeader("skipped", strconv.Itoa(skipped))
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdDRHealth() {
+	check, _, _ := bf.f.ParseFirstHeaderAsBool("check", false)
+	bw := bf.bwcl.BW()
+	h := bw.DRHealth()
+	if h == nil || check {
+		h = bw.CheckDRHealth()
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("vk", crypto.FmtKey(bw.Entity.GetVK()))
+	r.AddHeader("monitor", strconv.FormatBool(bw.DRMonitorRunning()))
+	r.AddHeader("checked", h.Checked.Format(time.RFC3339))
+	r.AddHeader("srv", h.SRV)
+	r.AddHeader("publicip", h.PublicIP)
+	r.AddHeader("reachable", strconv.FormatBool(h.Reachable))
+	if h.Reachable {
+		r.AddHeader("latency", h.Latency.String())
+	}
+	for _, p := range h.Problems {
+		r.AddHeader("problem", p)
+	}
+	if h.UpdatedSRV != "" {
+		r.AddHeader("updatedsrv", h.UpdatedSRV)
+		r.AddHeader("updatepending", strconv.FormatBool(h.UpdatePending))
+		if !h.UpdatePending {
+			r.AddHeader("updated", h.Updated.Format(time.RFC3339))
+		}
+		if h.UpdateErr != "" {
+			r.AddHeader("updateerr", h.UpdateErr)
+		}
+	}
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdListDesignatedRouters() {
+	bf.checkChainAge()
+	nsvkS, nsvkok := bf.f.GetFirstHeader("nsvk")
+	if !nsvkok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(nsvk)"))
+	}
+	nsvk, err := bf.bwcl.BW().ResolveKey(nsvkS)
+	if err != nil {
+		panic(err)
+	}
+	drvks, err := bf.bwcl.BW().LookupDesignatedRouters(nsvk)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, drvk := range drvks {
+		//Missing SRV records are returned as empty so that the headers
+		//line up
+		srv, _ := bf.bwcl.BW().LookupDesignatedRouterSRV(drvk)
+		r.AddHeader("drvk", crypto.FmtKey(drvk))
+		r.AddHeader("srv", srv)
+	}
+	bf.send(r)
+}
+
+//cmdListClients lists the clients of the agent. Only the router entity
+//and the [clients] Admins may do this, as it shows every client's VK
+func (bf *boundFrame) cmdListClients() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may list clients"))
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, c := range bw.Clients() {
+		//Clients without an entity get an empty VK so the headers line up
+		vk := ""
+		if c.VK != nil {
+			vk = crypto.FmtKey(c.VK)
+		}
+		r.AddHeader("id", strconv.FormatUint(c.ID, 10))
+		r.AddHeader("name", c.Name)
+		r.AddHeader("vk", vk)
+		r.AddHeader("connected", c.Connected.Format(time.RFC3339))
+		r.AddHeader("subscriptions", strconv.Itoa(c.Subscriptions))
+		r.AddHeader("published", strconv.FormatUint(c.Published, 10))
+		r.AddHeader("chains", strconv.Itoa(c.Chains.Size))
+	}
+	bf.send(r)
+}
+
+//cmdListSubscriptions lists the subscriptions on the router, those on the
+//namespace kv(ns) if it is given. Like listing clients, only the router
+//entity and the [clients] Admins may do this
+func (bf *boundFrame) cmdListSubscriptions() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may list subscriptions"))
+	}
+	var nsvk []byte
+	if ns, ok := bf.f.GetFirstHeader("ns"); ok {
+		var err error
+		nsvk, err = bw.ResolveKey(ns)
+		if err != nil {
+			panic(err)
+		}
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, s := range bw.Subscriptions(nsvk) {
+		//Subscriptions without a known origin get an empty VK so the
+		//headers line up
+		vk := ""
+		if s.OriginVK != nil {
+			vk = crypto.FmtKey(s.OriginVK)
+		}
+		r.AddHeader("uri", s.URI)
+		r.AddHeader("client", s.Client)
+		r.AddHeader("vk", vk)
+		r.AddHeader("created", s.Created.Format(time.RFC3339))
+		r.AddHeader("messages", strconv.FormatUint(s.Messages, 10))
+		r.AddHeader("tap", strconv.FormatBool(s.Tap))
+	}
+	bf.send(r)
+}
+
+//cmdDropPeer closes the connection of a peer. Like listing clients, only
+//the router entity and the [clients] Admins may do this
+func (bf *boundFrame) cmdDropPeer() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may drop peers"))
+	}
+	idS, ok := bf.f.GetFirstHeader("id")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(id)"))
+	}
+	id, err := strconv.ParseUint(idS, 10, 64)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad client id"))
+	}
+	if err := bw.DropPeer(id); err != nil {
+		panic(err)
+	}
+	bf.send(bf.mkFinalResponseOkayFrame())
+}
+
+//cmdDrain stops the router taking new work, ahead of stopping it. Only
+//the router entity and the [clients] Admins may do this
+func (bf *boundFrame) cmdDrain() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may drain the router"))
+	}
+	bw.Drain()
+	bf.send(bf.mkFinalResponseOkayFrame())
+}
+
+func (bf *boundFrame) cmdStandbyStatus() {
+	st := bf.bwcl.BW().StandbyStatus()
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("followers", strconv.Itoa(st.Followers))
+	if st.Primary != "" {
+		r.AddHeader("primary", st.Primary)
+		r.AddHeader("connected", strconv.FormatBool(st.Connected))
+		r.AddHeader("synced", strconv.FormatBool(st.Synced))
+		r.AddHeader("applied", strconv.FormatUint(st.Applied, 10))
+		if !st.LastApplied.IsZero() {
+			r.AddHeader("lastapplied", st.LastApplied.Format(time.RFC3339))
+		}
+		if st.LastError != "" {
+			r.AddHeader("lasterror", st.LastError)
+		}
+		if !st.Promoted.IsZero() {
+			r.AddHeader("promoted", st.Promoted.Format(time.RFC3339))
+		}
+	}
+	bf.send(r)
+}
+
+//cmdPromote makes a standby stop following its primary. Only the router
+//entity and the [clients] Admins may do this
+func (bf *boundFrame) cmdPromote() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may promote a standby"))
+	}
+	srv, _ := bf.f.GetFirstHeader("srv")
+	srv, err := bw.PromoteStandby(srv)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	if srv != "" {
+		r.AddHeader("srv", srv)
+	}
+	bf.send(r)
+}
+
+//cmdRotateEntity replaces the entity in the first PO with a new one. The
+//other POs are entities that may grant the new one the DOTs they granted
+//the old one. It can take several transactions, so the response is sent
+//when they are done
+func (bf *boundFrame) cmdRotateEntity() {
+	bf.checkChainAge()
+	var ents []*objects.Entity
+	for _, pe := range bf.f.POs {
+		if pe.PO.GetPONum() != objects.PONumROEntityWKey {
+			panic(bwe.M(bwe.MalformedOOBCommand, "expected ROEntityWKey"))
+		}
+		enti, err := objects.NewEntity(objects.PONumROEntityWKey, pe.PO.GetContent())
+		if err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "could not load entity", err))
+		}
+		ents = append(ents, enti.(*objects.Entity))
+	}
+	if len(ents) == 0 {
+		panic(bwe.M(bwe.MalformedOOBCommand, "expected the entity to rotate"))
+	}
+	expd, expt := bf.loadCommonExpiry()
+	p := &api.RotateEntityParams{
+		Old:         ents[0],
+		Expiry:      expt,
+		ExpiryDelta: expd,
+		Granters:    ents[1:],
+		KeepOld:     bf.loadBoolParam("keepold"),
+		NoPublish:   bf.loadBoolParam("nopublish"),
+		Account:     bf.loadAccount(),
+		Interaction: bf.loadInteractionParams(),
+	}
+	if contact, ok := bf.f.GetFirstHeader("contact"); ok {
+		p.Contact = &contact
+	}
+	if comment, ok := bf.f.GetFirstHeader("comment"); ok {
+		p.Comment = &comment
+	}
+	for _, rhash := range bf.f.GetAllHeaders("revoker") {
+		rvk, e := crypto.UnFmtKey(rhash)
+		if e != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "invalid revoker"))
+		}
+		p.Revokers = append(p.Revokers, rvk)
+	}
+	go func() {
+		rep, err := bf.bwcl.RotateEntity(context.TODO(), p)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("vk", crypto.FmtKey(rep.New.GetVK()))
+		r.AddHeader("published", strconv.FormatBool(rep.Published))
+		r.AddHeader("revoked", strconv.FormatBool(rep.Revoked))
+		if rep.Error != "" {
+			r.AddHeader("error", rep.Error)
+		}
+		po, _ := objects.CreateOpaquePayloadObject(objects.PONumROEntityWKey, rep.New.GetSigningBlob())
+		r.AddPayloadObject(po)
+		if rep.Revocation != nil {
+			r.AddHeader("revocation", crypto.FmtHash(rep.Revocation.GetHash()))
+			po, _ := objects.CreateOpaquePayloadObject(objects.RORevocation, rep.Revocation.GetContent())
+			r.AddPayloadObject(po)
+		}
+		//The DOT headers line up, with an empty newdot or doterror if there
+		//is none
+		for _, rd := range rep.DOTs {
+			newdot := ""
+			if rd.New != nil {
+				newdot = crypto.FmtHash(rd.New.GetHash())
+				po, _ := objects.CreateOpaquePayloadObject(objects.ROAccessDOT, rd.New.GetContent())
+				r.AddPayloadObject(po)
+			}
+			r.AddHeader("dot", crypto.FmtHash(rd.Old.GetHash()))
+			r.AddHeader("held", strconv.FormatBool(rd.Held))
+			r.AddHeader("newdot", newdot)
+			r.AddHeader("doterror", rd.Error)
+		}
+		bf.send(r)
+	}()
+}
+
+//cmdRotateDR moves namespaces to a new designated router entity. The POs
+//are the old router entity, the new one and then the namespaces, all with
+//their signing keys. The response is sent once the rotation is done
+func (bf *boundFrame) cmdRotateDR() {
+	bf.checkChainAge()
+	var ents []*objects.Entity
+	for _, pe := range bf.f.POs {
+		if pe.PO.GetPONum() != objects.PONumROEntityWKey {
+			panic(bwe.M(bwe.MalformedOOBCommand, "expected ROEntityWKey"))
+		}
+		enti, err := objects.NewEntity(objects.PONumROEntityWKey, pe.PO.GetContent())
+		if err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "could not load entity", err))
+		}
+		ents = append(ents, enti.(*objects.Entity))
+	}
+	if len(ents) < 3 {
+		panic(bwe.M(bwe.MalformedOOBCommand, "expected the old router, the new router and the namespaces"))
+	}
+	srv, ok := bf.f.GetFirstHeader("srv")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(srv)"))
+	}
+	var wait time.Duration
+	if ws, ok := bf.f.GetFirstHeader("wait"); ok {
+		var err error
+		wait, err = time.ParseDuration(ws)
+		if err != nil || wait < 0 {
+			panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(wait)"))
+		}
+	}
+	p := &api.RotateDRParams{
+		OldDR:       ents[0],
+		NewDR:       ents[1],
+		Namespaces:  ents[2:],
+		SRV:         srv,
+		Wait:        wait,
+		KeepOld:     bf.loadBoolParam("keepold"),
+		Account:     bf.loadAccount(),
+		Interaction: bf.loadInteractionParams(),
+		Progress: func(step string) {
+			log.Infof("DR rotation to %s: %s", crypto.FmtKey(ents[1].GetVK()), step)
+		},
+	}
+	go func() {
+		rot, err := bf.bwcl.RotateDR(context.TODO(), p)
+		if err != nil {
+			if len(rot.Moved) != 0 {
+				code := bwe.BadOperation
+				if bwerr, ok := err.(*bwe.BWStatus); ok {
+					code = bwerr.Code
+				}
+				err = bwe.WrapM(code, fmt.Sprintf("rotation stopped after moving %d namespaces", len(rot.Moved)), err)
+			}
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("drvk", crypto.FmtKey(ents[1].GetVK()))
+		for _, nsvk := range rot.Moved {
+			r.AddHeader("moved", crypto.FmtKey(nsvk))
+		}
+		for _, nsvk := range rot.Retracted {
+			r.AddHeader("retracted", crypto.FmtKey(nsvk))
+		}
+		bf.send(r)
+	}()
+}
+
+func (bf *boundFrame) cmdDiscoverNamespace() {
+	domain, ok := bf.f.GetFirstHeader("domain")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(domain)"))
+	}
+	ns, err := bf.bwcl.BW().DiscoverNamespace(domain)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddHeader("domain", ns.Domain)
+	r.AddHeader("nsvk", crypto.FmtKey(ns.NSVK))
+	r.AddHeader("drvk", crypto.FmtKey(ns.DRVK))
+	r.AddHeader("srv", ns.SRV)
+	r.AddHeader("verified", strconv.FormatBool(ns.Verified))
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdResolutionCache() {
+	flush, _, invalid := bf.f.ParseFirstHeaderAsBool("flush", false)
+	if invalid != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *invalid))
+	}
+	bw := bf.bwcl.BW()
+	if flush {
+		bw.FlushResolutionCaches()
+	}
+	st := bw.ResolutionCacheStats()
+	r := bf.mkFinalResponseOkayFrame()
+	for _, c := range []struct {
+		name string
+		s    api.CacheStats
+	}{{"entity", st.Entities}, {"dot", st.DOTs}, {"chain", st.Chains}} {
+		r.AddHeader(c.name+"size", strconv.Itoa(c.s.Size))
+		r.AddHeader(c.name+"max", strconv.Itoa(c.s.Max))
+		r.AddHeader(c.name+"hits", strconv.FormatUint(c.s.Hits, 10))
+		r.AddHeader(c.name+"misses", strconv.FormatUint(c.s.Misses, 10))
+		r.AddHeader(c.name+"evictions", strconv.FormatUint(c.s.Evictions, 10))
+	}
+	bf.send(r)
+}
+
+//cmdListServices sends the inventory of the services in the namespaces
+//and, if kv(watch) is set, the changes to it as they happen
+func (bf *boundFrame) cmdListServices() {
+	p := &api.ServiceRegistryParams{Namespaces: bf.f.GetAllHeaders("namespace")}
+	for _, d := range []struct {
+		key string
+		to  *time.Duration
+	}{{"staleafter", &p.StaleAfter}, {"goneafter", &p.GoneAfter}} {
+		if s, ok := bf.f.GetFirstHeader(d.key); ok {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				panic(bwe.M(bwe.MalformedOOBCommand, "bad kv("+d.key+")"))
+			}
+			*d.to = v
+		}
+	}
+	watch := bf.loadBoolParam("watch")
+	inventoryPO := func(inv *api.ServiceInventory) objects.PayloadObject {
+		po, err := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, inv)
+		if err != nil {
+			panic(err)
+		}
+		return po
+	}
+	bf.bwcl.NewServiceRegistry(p, func(reg *api.ServiceRegistry, err error) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		if !watch {
+			r := bf.mkFinalResponseOkayFrame()
+			r.AddPayloadObject(inventoryPO(reg.Inventory()))
+			bf.send(r)
+			reg.TearDown()
+			return
+		}
+		result := func(changes []api.ServiceChange) {
+			nr := objects.CreateFrame(objects.CmdResult, bf.replyto)
+			nr.AddHeader("finished", strconv.FormatBool(false))
+			nr.AddHeader("changes", strconv.Itoa(len(changes)))
+			for i := range changes {
+				po, err := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, &changes[i])
+				if err != nil {
+					panic(err)
+				}
+				nr.AddPayloadObject(po)
+			}
+			nr.AddPayloadObject(inventoryPO(reg.Inventory()))
+			bf.send(nr)
+		}
+		bf.send(bf.mkNonfinalResponseOkayFrame())
+		result(nil)
+		reg.OnChange(result)
+	})
+}
+
+//checkStoreAdmin panics unless the bound entity may export and import the
+//router's persisted messages, which bypasses their permissions
+func (bf *boundFrame) checkStoreAdmin(what string) {
+	us := bf.bwcl.GetUs()
+	if us == nil || !bf.bwcl.BW().IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may "+what+" persisted messages"))
+	}
+}
+
+func (bf *boundFrame) cmdStoreExport() {
+	bf.checkStoreAdmin("export")
+	mvk, suffix := bf.loadCommonURI()
+	page, _ := bf.loadPageParams()
+	sms, next, err := bf.bwcl.BW().ExportStore(crypto.FmtKey(mvk)+"/"+suffix, page)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	for _, sm := range sms {
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumBWMessage, sm.Body)
+		if err != nil {
+			panic(err)
+		}
+		r.AddHeader("topic", sm.URI)
+		r.AddHeader("persistseq", strconv.FormatUint(sm.Seq, 10))
+		r.AddPayloadObject(po)
+	}
+	if next != "" {
+		r.AddHeader("cursor", next)
+	}
+	bf.send(r)
+}
+
+func (bf *boundFrame) cmdStoreImport() {
+	bf.checkStoreAdmin("import")
+	checkChain := bf.loadBoolParam("verify_chain")
+	seqs := bf.f.GetAllHeaders("persistseq")
+	if len(seqs) != 0 && len(seqs) != len(bf.f.POs) {
+		panic(bwe.M(bwe.InvalidOOBCommand, "expected a kv(persistseq) for each message"))
+	}
+	loaded := 0
+	r := bf.mkFinalResponseOkayFrame()
+	for i, pe := range bf.f.POs {
+		if pe.PO.GetPONum() != objects.PONumBWMessage {
+			panic(bwe.M(bwe.InvalidOOBCommand, "expected only message POs"))
+		}
+		var seq uint64
+		if len(seqs) != 0 {
+			var err error
+			seq, err = strconv.ParseUint(seqs[i], 10, 64)
+			if err != nil {
+				panic(bwe.M(bwe.InvalidOOBCommand, "kv(persistseq) is not a number"))
+			}
+		}
+		topic, err := bf.bwcl.BW().ImportMessage(pe.PO.GetContent(), seq, checkChain)
+		if err != nil {
+			r.AddHeader("skipped", topic+": "+err.Error())
+			continue
+		}
+		loaded++
+	}
+	r.AddHeader("loaded", strconv.Itoa(loaded))
+	bf.send(r)
+}
+
+//loadKeyParam resolves the required kv(name), a VK or an alias
+func (bf *boundFrame) loadKeyParam(name string) []byte {
+	s, ok := bf.f.GetFirstHeader(name)
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv("+name+")"))
+	}
+	vk, err := bf.bwcl.BW().ResolveKey(s)
+	if err != nil {
+		panic(err)
+	}
+	return vk
+}
+
+func (bf *boundFrame) cmdRequestDOT() {
+	mvk, suffix := bf.loadCommonURI()
+	granter := bf.loadKeyParam("granter")
+	perms, ok := bf.f.GetFirstHeader("accesspermissions")
+	if !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(accesspermissions)"))
+	}
+	ttl, _, emsg := bf.f.ParseFirstHeaderAsInt("ttl", 0)
+	if emsg != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad ttl param:"+*emsg))
+	}
+	req := &api.DOTRequest{URI: suffix, Perms: perms, TTL: ttl}
+	req.Comment, _ = bf.f.GetFirstHeader("comment")
+	expd, expt := bf.loadCommonExpiry()
+	if expd != nil {
+		req.Expiry = time.Now().Add(*expd).UnixNano()
+	} else if expt != nil {
+		req.Expiry = expt.UnixNano()
+	}
+	bf.bwcl.RequestDOT(mvk, granter, req, func(err error) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		bf.send(bf.mkFinalResponseOkayFrame())
+	})
+}
+
+func (bf *boundFrame) cmdListDOTRequests() {
+	mvk := bf.loadKeyParam("namespace")
+	go func() {
+		reqs, err := bf.bwcl.ListDOTRequests(mvk)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		for _, req := range reqs {
+			expiry := ""
+			if req.Expiry != 0 {
+				expiry = time.Unix(0, req.Expiry).Format(time.RFC3339)
+			}
+			r.AddHeader("requester", crypto.FmtKey(req.Requester))
+			r.AddHeader("uri", crypto.FmtKey(req.MVK)+"/"+req.URI)
+			r.AddHeader("accesspermissions", req.Perms)
+			r.AddHeader("ttl", strconv.Itoa(req.TTL))
+			r.AddHeader("expiry", expiry)
+			r.AddHeader("comment", req.Comment)
+			r.AddHeader("created", time.Unix(0, req.Created).Format(time.RFC3339))
+		}
+		bf.send(r)
+	}()
+}
+
+func (bf *boundFrame) cmdApproveDOTRequest() {
+	bf.checkChainAge()
+	expd, expt := bf.loadCommonExpiry()
+	p := &api.ApproveDOTRequestParams{
+		MVK:         bf.loadKeyParam("namespace"),
+		Requester:   bf.loadKeyParam("requester"),
+		Expiry:      expt,
+		ExpiryDelta: expd,
+		Account:     bf.loadAccount(),
+		Interaction: bf.loadInteractionParams(),
+	}
+	if perms, ok := bf.f.GetFirstHeader("accesspermissions"); ok {
+		p.AccessPermissions = &perms
+	}
+	ttl, hasttl, emsg := bf.f.ParseFirstHeaderAsInt("ttl", 0)
+	if emsg != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad ttl param:"+*emsg))
+	}
+	if hasttl {
+		p.TTL = &ttl
+	}
+	if comment, ok := bf.f.GetFirstHeader("comment"); ok {
+		p.Comment = &comment
+	}
+	p.Contact, _ = bf.f.GetFirstHeader("contact")
+	for _, rs := range bf.f.GetAllHeaders("revoker") {
+		rvk, err := bf.bwcl.BW().ResolveKey(rs)
+		if err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "invalid revoker", err))
+		}
+		p.Revokers = append(p.Revokers, rvk)
+	}
+	go func() {
+		dot, res, err := bf.bwcl.ApproveDOTRequest(context.TODO(), p)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("hash", crypto.FmtHash(dot.GetHash()))
+		addTxResultHeaders(r, res)
+		po, _ := objects.CreateOpaquePayloadObject(objects.ROAccessDOT, dot.GetContent())
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}()
+}
+
+func (bf *boundFrame) cmdRejectDOTRequest() {
+	mvk := bf.loadKeyParam("namespace")
+	requester := bf.loadKeyParam("requester")
+	go func() {
+		if err := bf.bwcl.RemoveDOTRequest(mvk, requester); err != nil {
+			bf.Err(err)
+			return
+		}
+		bf.send(bf.mkFinalResponseOkayFrame())
+	}()
+}
+
+func (bf *boundFrame) cmdMintTempCredential() {
+	bf.checkChainAge()
+	mvk, suffix := bf.loadCommonURI()
+	p := &api.TempCredentialParams{
+		URI:         crypto.FmtKey(mvk) + "/" + suffix,
+		Account:     bf.loadAccount(),
+		Interaction: bf.loadInteractionParams(),
+	}
+	var ok bool
+	if p.Permissions, ok = bf.f.GetFirstHeader("accesspermissions"); !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(accesspermissions)"))
+	}
+	life, ok := bf.f.GetFirstHeader("life")
+	if !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(life)"))
+	}
+	dur, err := util.ParseDuration(life)
+	if err != nil || dur == nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(life)"))
+	}
+	p.Life = *dur
+	if ra, ok := bf.f.GetFirstHeader("revokeafter"); ok {
+		if ra == "never" {
+			p.RevokeAfter = -1
+		} else if dur, err := util.ParseDuration(ra); err == nil && dur != nil {
+			p.RevokeAfter = *dur
+		} else {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(revokeafter)"))
+		}
+	}
+	p.Contact, _ = bf.f.GetFirstHeader("contact")
+	p.Comment, _ = bf.f.GetFirstHeader("comment")
+	go func() {
+		tc, err := bf.bwcl.MintTempCredential(context.TODO(), p)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("vk", crypto.FmtKey(tc.Entity.GetVK()))
+		r.AddHeader("hash", crypto.FmtHash(tc.DOT.GetHash()))
+		r.AddHeader("expires", tc.Expires.Format(time.RFC3339))
+		if !tc.RevokeAt.IsZero() {
+			r.AddHeader("revokeat", tc.RevokeAt.Format(time.RFC3339))
+		}
+		epo, _ := objects.CreateOpaquePayloadObject(objects.ROEntityWKey, tc.Entity.GetSigningBlob())
+		dpo, _ := objects.CreateOpaquePayloadObject(objects.ROAccessDOT, tc.DOT.GetContent())
+		cpo, _ := objects.CreateOpaquePayloadObject(objects.ROAccessDChain, tc.Chain.GetContent())
+		r.AddPayloadObject(epo)
+		r.AddPayloadObject(dpo)
+		r.AddPayloadObject(cpo)
+		bf.send(r)
+	}()
+}
+
+func addScheduleHeaders(r *objects.Frame, s *api.ScheduledPublish) {
+	r.AddHeader("id", s.ID)
+	r.AddHeader("cron", s.Cron)
+	r.AddHeader("uri", s.URI)
+	r.AddHeader("ponum", objects.PONumDotForm(s.PONum))
+	r.AddHeader("owner", s.Owner)
+	r.AddHeader("next", s.Next.Format(time.RFC3339))
+	r.AddHeader("runs", strconv.FormatUint(s.Runs, 10))
+	r.AddHeader("lasterror", s.LastError)
+}
+
+func (bf *boundFrame) cmdAddSchedule() {
+	mvk, suffix := bf.loadCommonURI()
+	p := &api.ScheduleParams{
+		MVK:       mvk,
+		URISuffix: suffix,
+		Persist:   bf.loadBoolParam("persist"),
+	}
+	var ok bool
+	if p.Cron, ok = bf.f.GetFirstHeader("cron"); !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(cron)"))
+	}
+	ponum, ok := bf.f.GetFirstHeader("ponum")
+	if !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(ponum)"))
+	}
+	var err error
+	if p.PONum, err = objects.PONumFromDotForm(ponum); err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(ponum)"))
+	}
+	p.Template, _ = bf.f.GetFirstHeader("template")
+	go func() {
+		s, err := bf.bwcl.AddSchedule(p)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		addScheduleHeaders(r, s)
+		bf.send(r)
+	}()
+}
+
+func (bf *boundFrame) cmdListSchedules() {
+	go func() {
+		scheds, err := bf.bwcl.ListSchedules()
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		for _, s := range scheds {
+			addScheduleHeaders(r, s)
+		}
+		bf.send(r)
+	}()
+}
+
+func (bf *boundFrame) cmdCancelSchedule() {
+	id, ok := bf.f.GetFirstHeader("id")
+	if !ok {
+		panic(bwe.M(bwe.MalformedOOBCommand, "missing kv(id)"))
+	}
+	go func() {
+		if err := bf.bwcl.CancelSchedule(id); err != nil {
+			bf.Err(err)
+			return
+		}
+		bf.send(bf.mkFinalResponseOkayFrame())
+	}()
+}
+
+//cmdRouterStats returns a snapshot of the router's counters, for bw2 top.
+//Like listing clients, only the router entity and the [clients] Admins may
+//do this
+func (bf *boundFrame) cmdRouterStats() {
+	bw := bf.bwcl.BW()
+	us := bf.bwcl.GetUs()
+	if us == nil || !bw.IsClientAdmin(us.GetVK()) {
+		panic(bwe.M(bwe.BadPermissions, "only the router entity and [clients] Admins may get router stats"))
+	}
+	topics, _, emsg := bf.f.ParseFirstHeaderAsInt("topics", 10)
+	if emsg != nil || topics < 0 {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad kv(topics)"))
+	}
+	po, err := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, bw.Stats(topics))
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddPayloadObject(po)
+	bf.send(r)
+}
@@ -20,6 +20,7 @@ package oob
 import (
 	"bufio"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
@@ -42,31 +43,93 @@ import (
 
 type Adapter struct {
 	bw *api.BW
+
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]bool
+	stopped bool
 }
 
+//Start listens on the configured OOB address and serves agent clients.
+//It does not return, and exits the process if it cannot listen
 func (a *Adapter) Start(bw *api.BW) {
 	log.Infof("OOB starting")
-	a.bw = bw
 	if len(bw.Config.OOB.ListenOn) == 0 {
 		log.Warnf("No specified OOB listening port, listening on 127.0.0.1:28589")
 	}
-	ln, err := net.Listen("tcp", bw.Config.OOB.ListenOn)
+	_, err := a.Listen(bw, bw.Config.OOB.ListenOn)
 	if err != nil {
 		log.Errorf("Could not listen on '%s' for OOBAdapter: %v\n",
 			bw.Config.OOB.ListenOn, err)
 		log.Flush()
 		os.Exit(1)
 	}
-	log.Infof("OOB listening on %s", bw.Config.OOB.ListenOn)
+	select {}
+}
+
+//Listen serves agent clients on the given address in the background until
+//Stop is called. Use port 0 to pick a free port, the address actually
+//listened on is returned
+func (a *Adapter) Listen(bw *api.BW, addr string) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.bw = bw
+	a.ln = ln
+	a.conns = make(map[net.Conn]bool)
+	a.stopped = false
+	a.mu.Unlock()
+	log.Infof("OOB listening on %s", ln.Addr())
+	go a.serve(ln)
+	return ln.Addr(), nil
+}
+
+func (a *Adapter) serve(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			a.mu.Lock()
+			stopped := a.stopped
+			a.mu.Unlock()
+			if stopped {
+				return
+			}
 			log.Warnf("OOB socket error: %v", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
 		}
+		a.mu.Lock()
+		if a.stopped {
+			a.mu.Unlock()
+			conn.Close()
+			return
+		}
+		a.conns[conn] = true
+		a.mu.Unlock()
 		go a.handleClient(conn)
 	}
 }
 
+//Stop closes the listener and disconnects every client
+func (a *Adapter) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ln == nil || a.stopped {
+		return nil
+	}
+	a.stopped = true
+	err := a.ln.Close()
+	for conn := range a.conns {
+		conn.Close()
+	}
+	return err
+}
+
 //Sequence numbers are 31 bit positive integers
 func mkSeqNo() int {
 	return int(rand.Uint32() >> 1)
@@ -76,6 +139,10 @@ func (a *Adapter) handleClient(conn net.Conn) {
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	defer func() {
 		ctxCancel()
+		conn.Close()
+		a.mu.Lock()
+		delete(a.conns, conn)
+		a.mu.Unlock()
 	}()
 	bwcl := a.bw.CreateClient(ctx, "OOB:"+conn.RemoteAddr().String())
 	out := bufio.NewWriter(conn)
@@ -96,7 +163,7 @@ func (a *Adapter) handleClient(conn net.Conn) {
 	send(helo)
 
 	for {
-		f, err := objects.LoadFrameFromStream(in)
+		f, err := objects.LoadFrameFromStreamLimit(in, bwcl.BW().MaxMessageSize())
 		if err != nil {
 			log.Info("OOB stream error:", err)
 			abort = true
@@ -121,6 +188,58 @@ func (bf *boundFrame) loadAccount() int {
 	return int(acci)
 }
 
+//loadInteractionParams reads the optional kv(confirmations), kv(timeout),
+//kv(maxgasprice) and kv(attempts) chain interaction params from the frame
+func (bf *boundFrame) loadInteractionParams() *bc.InteractionParams {
+	rv := &bc.InteractionParams{}
+	conf, hasconf, emsg := bf.f.ParseFirstHeaderAsInt("confirmations", 0)
+	if emsg != nil || conf < 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(confirmations)"))
+	}
+	if hasconf {
+		c := uint64(conf)
+		rv.Confirmations = &c
+	}
+	timo, hastimo, emsg := bf.f.ParseFirstHeaderAsInt("timeout", 0)
+	if emsg != nil || timo < 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(timeout)"))
+	}
+	if hastimo {
+		t := uint64(timo)
+		rv.TimeoutBlocks = &t
+	}
+	mgp, hasmgp := bf.f.GetFirstHeader("maxgasprice")
+	if hasmgp {
+		v, ok := new(big.Int).SetString(mgp, 10)
+		if !ok || v.Sign() < 0 {
+			panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(maxgasprice)"))
+		}
+		rv.MaxGasPrice = v
+	}
+	att, hasatt, emsg := bf.f.ParseFirstHeaderAsInt("attempts", 0)
+	if emsg != nil || att < 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "bad kv(attempts)"))
+	}
+	if hasatt {
+		p := bc.DefaultRetryPolicy
+		if bf.bwcl.BCC() != nil {
+			p = bf.bwcl.BCC().GetRetryPolicy()
+		}
+		p.MaxAttempts = int(att)
+		rv.Retry = &p
+	}
+	return rv
+}
+
+//loadBCC returns the chain client to use for an on-chain operation. Any
+//interaction params in the frame apply to this operation only
+func (bf *boundFrame) loadBCC() bc.BlockChainClient {
+	if bf.bwcl.BCC() == nil {
+		panic(bwe.M(bwe.NoEntity, "no entity set"))
+	}
+	return bf.bwcl.BCC().WithInteractionParams(bf.loadInteractionParams())
+}
+
 func (bf *boundFrame) loadCommonURI() ([]byte, string) {
 	//XTAG new resolver
 	mvk, mvkOk := bf.f.GetFirstHeader("mvk")
@@ -149,9 +268,8 @@ func (bf *boundFrame) loadCommonURI() ([]byte, string) {
 			}
 			rmvk = nsvk
 		}
-		valid, _, _, _ := util.AnalyzeSuffix(suffix)
-		if !valid {
-			panic(bwe.M(bwe.MalformedOOBCommand, "Suffix is malformed"))
+		if err := util.ValidateSuffix(suffix); err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "Suffix is malformed", err))
 		}
 	}
 	return rmvk, suffix
@@ -283,11 +401,19 @@ func loadCommonXOs(f *objects.Frame) ([]objects.RoutingObject, []objects.Payload
 	}
 	return ros, pos
 }
+//addPersistSeq adds kv(persistseq) to a result for a message that has a
+//persist sequence number
+func addPersistSeq(m *core.Message, r *objects.Frame) {
+	if m.PersistSeq != 0 {
+		r.AddHeader("persistseq", strconv.FormatUint(m.PersistSeq, 10))
+	}
+}
 func commonUnpackMsg(m *core.Message, r *objects.Frame) {
 	if m.OriginVK == nil {
 		panic("Why no origin VK")
 	}
 	r.AddHeader("umid", fmt.Sprintf("%x", m.UMid))
+	r.AddHeader("msgid", m.UMid.ToString())
 	r.AddHeader("signature", crypto.FmtSig(m.Signature))
 	r.AddHeader("from", crypto.FmtKey(*m.OriginVK))
 	r.AddHeader("uri", crypto.FmtKey(m.MVK)+"/"+m.TopicSuffix)
@@ -297,6 +423,11 @@ func commonUnpackMsg(m *core.Message, r *objects.Frame) {
 	for _, po := range m.PayloadObjects {
 		r.AddPayloadObject(po)
 	}
+	for _, h := range m.TraceHops() {
+		if h.Valid(m) {
+			r.AddHeader("trace_hop", fmt.Sprintf("%s,%d,%d", crypto.FmtKey(h.RouterVK), h.Time.UnixNano(), int64(h.Queued)))
+		}
+	}
 }
 
 func (bf *boundFrame) mkGenericActionCB() func(err error) {
@@ -313,6 +444,7 @@ func (bf *boundFrame) mkGenericActionCB() func(err error) {
 			r.AddHeader("finished", "true")
 			r.AddHeader("reason", bws.Msg)
 			r.AddHeader("code", strconv.Itoa(bws.Code))
+			r.AddHeader("class", bwe.ClassOf(bws.Code).String())
 			bf.send(r)
 		}
 	}
@@ -332,11 +464,38 @@ func (bf *boundFrame) mkFinalGenericActionCB() func(err error) {
 			r.AddHeader("finished", "true")
 			r.AddHeader("reason", bws.Msg)
 			r.AddHeader("code", strconv.Itoa(bws.Code))
+			r.AddHeader("class", bwe.ClassOf(bws.Code).String())
 			bf.send(r)
 		}
 	}
 }
 
+//addTxResultHeaders describes the transaction that carried out an on-chain
+//operation. A nil result means no transaction was needed
+func addTxResultHeaders(r *objects.Frame, res *bc.TxResult) {
+	if res == nil {
+		r.AddHeader("existing", "true")
+		return
+	}
+	r.AddHeader("txhash", res.TxHash.Hex())
+	r.AddHeader("blocknumber", strconv.FormatUint(res.BlockNumber, 10))
+	if res.GasUsed != nil {
+		r.AddHeader("gasused", res.GasUsed.Text(10))
+	}
+}
+
+//addTxCostHeaders describes an estimate. A nil cost means nothing needs to
+//be sent, as with addTxResultHeaders
+func addTxCostHeaders(r *objects.Frame, cost *bc.TxCost) {
+	if cost == nil {
+		r.AddHeader("existing", "true")
+		return
+	}
+	r.AddHeader("gas", cost.Gas.Text(10))
+	r.AddHeader("gasprice", cost.GasPrice.Text(10))
+	r.AddHeader("cost", cost.Total().Text(10))
+}
+
 func (bf *boundFrame) mkNonfinalResponseOkayFrame() *objects.Frame {
 	r := objects.CreateFrame(objects.CmdResponse, bf.replyto)
 	r.AddHeader("status", "okay")
@@ -365,6 +524,7 @@ func (bf *boundFrame) Err(err error) {
 	r.AddHeader("status", "error")
 	r.AddHeader("reason", bws.Msg)
 	r.AddHeader("code", strconv.Itoa(bws.Code))
+	r.AddHeader("class", bwe.ClassOf(bws.Code).String())
 	r.AddHeader("finished", "true")
 	bf.send(r)
 }
@@ -391,13 +551,16 @@ func (bf *boundFrame) Handle() {
 	case objects.CmdPublish, objects.CmdPersist:
 		bf.cmdPublishPersist()
 
+	case objects.CmdDelete:
+		bf.cmdDelete()
+
 	case objects.CmdList:
 		bf.cmdList()
 
-	case objects.CmdQuery:
+	case objects.CmdQuery, objects.CmdTapQuery:
 		bf.cmdQuery()
 
-	case objects.CmdSubscribe:
+	case objects.CmdSubscribe, objects.CmdTapSubscribe:
 		bf.cmdSubscribe()
 
 	case objects.CmdMakeEntity:
@@ -425,6 +588,10 @@ func (bf *boundFrame) Handle() {
 		bf.cmdEntityBalances()
 	case objects.CmdAddressBalance:
 		bf.cmdAddressBalance()
+	case objects.CmdContractCode:
+		bf.cmdContractCode()
+	case objects.CmdContracts:
+		bf.cmdContracts()
 	case objects.CmdBCInteractionParams:
 		bf.cmdBCInteractionParams()
 	case objects.CmdTransfer:
@@ -449,6 +616,14 @@ func (bf *boundFrame) Handle() {
 		bf.cmdMakeView()
 	case objects.CmdListView:
 		bf.cmdListView()
+	case objects.CmdViewJournal:
+		bf.cmdViewJournal()
+	case objects.CmdBindView:
+		bf.cmdBindView()
+	case objects.CmdTearDownView:
+		bf.cmdTearDownView()
+	case objects.CmdViewInfo:
+		bf.cmdViewInfo()
 	case objects.CmdPublishView:
 		bf.cmdPubView()
 	case objects.CmdSubscribeView:
@@ -465,6 +640,76 @@ func (bf *boundFrame) Handle() {
 		bf.cmdPutRevocation()
 	case objects.CmdFindDots:
 		bf.cmdFindDOTs()
+	case objects.CmdTxParams:
+		bf.cmdTxParams()
+	case objects.CmdSendRawTx:
+		bf.cmdSendRawTx()
+	case objects.CmdListAliases:
+		bf.cmdListAliases()
+	case objects.CmdUpdateAlias:
+		bf.cmdUpdateAlias()
+	case objects.CmdTransferAlias:
+		bf.cmdTransferAlias()
+	case objects.CmdDeleteAlias:
+		bf.cmdDeleteAlias()
+	case objects.CmdSearchRegistry:
+		bf.cmdSearchRegistry()
+	case objects.CmdExportNamespace:
+		bf.cmdExportNamespace()
+	case objects.CmdImportNamespace:
+		bf.cmdImportNamespace()
+	case objects.CmdDRHealth:
+		bf.cmdDRHealth()
+	case objects.CmdListDesignatedRouters:
+		bf.cmdListDesignatedRouters()
+	case objects.CmdResolutionCache:
+		bf.cmdResolutionCache()
+	case objects.CmdListClients:
+		bf.cmdListClients()
+	case objects.CmdListSubscriptions:
+		bf.cmdListSubscriptions()
+	case objects.CmdDiscoverNamespace:
+		bf.cmdDiscoverNamespace()
+	case objects.CmdDropPeer:
+		bf.cmdDropPeer()
+	case objects.CmdDrain:
+		bf.cmdDrain()
+	case objects.CmdStandbyStatus:
+		bf.cmdStandbyStatus()
+	case objects.CmdPromote:
+		bf.cmdPromote()
+	case objects.CmdRotateEntity:
+		bf.cmdRotateEntity()
+	case objects.CmdRotateDR:
+		bf.cmdRotateDR()
+	case objects.CmdListServices:
+		bf.cmdListServices()
+	case objects.CmdCall:
+		bf.cmdCall()
+	case objects.CmdStoreExport:
+		bf.cmdStoreExport()
+	case objects.CmdStoreImport:
+		bf.cmdStoreImport()
+	case objects.CmdRequestDOT:
+		bf.cmdRequestDOT()
+	case objects.CmdListDOTRequests:
+		bf.cmdListDOTRequests()
+	case objects.CmdApproveDOTRequest:
+		bf.cmdApproveDOTRequest()
+	case objects.CmdRejectDOTRequest:
+		bf.cmdRejectDOTRequest()
+	case objects.CmdMintTempCredential:
+		bf.cmdMintTempCredential()
+	case objects.CmdAddSchedule:
+		bf.cmdAddSchedule()
+	case objects.CmdListSchedules:
+		bf.cmdListSchedules()
+	case objects.CmdCancelSchedule:
+		bf.cmdCancelSchedule()
+	case objects.CmdRouterStats:
+		bf.cmdRouterStats()
+	case objects.CmdNack:
+		bf.cmdNack()
 	case "devl":
 		bf.cmdDevelop()
 	default:
@@ -486,5 +731,8 @@ func dispatchFrame(bwcl *api.BosswaveClient, f *objects.Frame, send func(f *obje
 			bf.Err(r.(error))
 		}
 	}()
+	if f.Oversize {
+		panic(bwe.M(bwe.MessageTooLarge, fmt.Sprintf("frame objects are larger than the limit of %d bytes. Split large payloads into chunk POs", bwcl.BW().MaxMessageSize())))
+	}
 	bf.Handle()
 }
@@ -0,0 +1,144 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package agent runs a router and its out of band agent inside another
+//process, so that an application (or its tests) can use bw2bind without a
+//separate bw2 daemon:
+//
+//	a, err := agent.Start(&agent.Options{ConfigFile: "bw2.ini", AgentListenOn: "127.0.0.1:0"})
+//	if err != nil {
+//		...
+//	}
+//	defer a.Stop()
+//	cl := bw2bind.ConnectOrExit(a.Address())
+//
+//The store and the block chain are per process, so there can only be one
+//agent in a process, and it cannot be started again once stopped
+package agent
+
+import (
+	"net"
+	"sync"
+
+	"github.com/immesys/bw2/adapter/oob"
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//Options configures an embedded agent
+type Options struct {
+	//The router config file, as made by bw2 makeconf. Defaults to bw2.ini
+	//in the current directory
+	ConfigFile string
+	//Overrides the OOB ListenOn address in the config. Use port 0 to pick a
+	//free port
+	AgentListenOn string
+	//Overrides the Native ListenOn address in the config. If there is no
+	//address, the router does not accept peers
+	NativeListenOn string
+}
+
+//Agent is a router and out of band agent running in this process
+type Agent struct {
+	bw       *api.BW
+	shutdown chan bool
+	oob      *oob.Adapter
+	addr     net.Addr
+	native   net.Listener
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+var startmu sync.Mutex
+var started bool
+
+//Start opens the router and starts the agent. It returns once the agent is
+//accepting connections, though the chain may still be syncing. The
+//designated router monitor and replica gossip are not started
+func Start(opts *Options) (*Agent, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	startmu.Lock()
+	defer startmu.Unlock()
+	if started {
+		return nil, bwe.M(bwe.BadOperation, "an agent has already been started in this process")
+	}
+	config, err := core.ReadConfig(opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if opts.AgentListenOn != "" {
+		config.OOB.ListenOn = opts.AgentListenOn
+	}
+	if opts.NativeListenOn != "" {
+		config.Native.ListenOn = opts.NativeListenOn
+	}
+	if config.OOB.ListenOn == "" {
+		return nil, bwe.M(bwe.BadOperation, "no agent listen address")
+	}
+	bw, shutdown, err := api.NewBWContext(config)
+	if err != nil {
+		return nil, err
+	}
+	started = true
+	rv := &Agent{bw: bw, shutdown: shutdown, oob: new(oob.Adapter)}
+	if config.Native.ListenOn != "" {
+		rv.native, err = api.Listen(bw, config.Native.ListenOn)
+		if err != nil {
+			bw.BC().Shutdown()
+			return nil, err
+		}
+	}
+	rv.addr, err = rv.oob.Listen(bw, config.OOB.ListenOn)
+	if err != nil {
+		if rv.native != nil {
+			rv.native.Close()
+		}
+		bw.BC().Shutdown()
+		return nil, err
+	}
+	return rv, nil
+}
+
+//Address is the host:port that bw2bind should connect to
+func (a *Agent) Address() string {
+	return a.addr.String()
+}
+
+//BW returns the router, for applications that also want to use it directly
+func (a *Agent) BW() *api.BW {
+	return a.bw
+}
+
+//Stop disconnects the agent clients, stops the router gracefully (see
+//api.BW.Stop) and stops the chain. It returns once the chain has stopped
+func (a *Agent) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return nil
+	}
+	a.stopped = true
+	err := a.oob.Stop()
+	//This also closes the native listener
+	a.bw.Stop()
+	<-a.shutdown
+	return err
+}
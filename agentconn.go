@@ -0,0 +1,1733 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/urfave/cli"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//agentConn is the out of band client the CLI commands use. It is the only
+//client a command opens: on-chain operations carry the per operation
+//interaction params, which bw2bind does not know how to send, so commands
+//that make them do their lookups here too
+type agentConn struct {
+	conn    net.Conn
+	out     *bufio.Writer
+	outmu   sync.Mutex
+	repmu   sync.Mutex
+	replies map[int]chan *objects.Frame
+	params  chainParams
+	//From the agent's helo frame
+	version string
+}
+
+//chainParams are the per operation chain interaction params given on the
+//command line. Empty values leave the agent's defaults in place
+type chainParams struct {
+	confirmations string
+	timeout       string
+	maxgasprice   string
+	attempts      string
+}
+
+func (p chainParams) String() string {
+	rv := []string{}
+	if p.confirmations != "" {
+		rv = append(rv, p.confirmations+" confirmation blocks")
+	}
+	if p.timeout != "" {
+		rv = append(rv, p.timeout+" block timeout")
+	}
+	if p.maxgasprice != "" {
+		rv = append(rv, "max gas price "+p.maxgasprice+" wei")
+	}
+	if p.attempts != "" {
+		rv = append(rv, p.attempts+" attempts")
+	}
+	return strings.Join(rv, ", ")
+}
+
+//agentBCIP is the agent's current block chain interaction params
+type agentBCIP struct {
+	Confirmations uint64
+	Timeout       uint64
+	MaxGasPrice   *big.Int
+	CurrentBlock  uint64
+	CurrentAge    time.Duration
+}
+
+func connectAgent(addr string) (*agentConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(conn)
+	helo, err := objects.LoadFrameFromStream(in)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if helo.Cmd != objects.CmdHello {
+		conn.Close()
+		return nil, fmt.Errorf("expected helo frame, got %q", helo.Cmd)
+	}
+	ac := &agentConn{
+		conn:    conn,
+		out:     bufio.NewWriter(conn),
+		replies: make(map[int]chan *objects.Frame),
+	}
+	ac.version, _ = helo.GetFirstHeader("version")
+	go ac.readLoop(in)
+	return ac, nil
+}
+
+func connectAgentOrExit(c *cli.Context) *agentConn {
+	ac, err := connectAgent(c.GlobalString("agent"))
+	if err != nil {
+		fmt.Println("Could not connect to agent:", err)
+		os.Exit(1)
+	}
+	ac.params = chainParams{
+		confirmations: c.String("confirmations"),
+		timeout:       c.String("timeout"),
+		maxgasprice:   c.String("maxgasprice"),
+		attempts:      c.String("attempts"),
+	}
+	return ac
+}
+
+func (ac *agentConn) readLoop(in *bufio.Reader) {
+	for {
+		f, err := objects.LoadFrameFromStream(in)
+		if err != nil {
+			ac.repmu.Lock()
+			for seqno, ch := range ac.replies {
+				close(ch)
+				delete(ac.replies, seqno)
+			}
+			ac.repmu.Unlock()
+			return
+		}
+		ac.repmu.Lock()
+		ch, ok := ac.replies[f.SeqNo]
+		ac.repmu.Unlock()
+		if ok {
+			ch <- f
+		}
+	}
+}
+
+//Sequence numbers are 31 bit positive integers
+func (ac *agentConn) newFrame(cmd string) *objects.Frame {
+	return objects.CreateFrame(cmd, int(rand.Uint32()>>1))
+}
+
+//transact sends the frame and waits for its response, converting an error
+//response into a *bwe.BWStatus
+func (ac *agentConn) transact(f *objects.Frame) (*objects.Frame, error) {
+	ch := make(chan *objects.Frame, 4)
+	ac.repmu.Lock()
+	ac.replies[f.SeqNo] = ch
+	ac.repmu.Unlock()
+	defer func() {
+		ac.repmu.Lock()
+		delete(ac.replies, f.SeqNo)
+		ac.repmu.Unlock()
+	}()
+	ac.outmu.Lock()
+	f.WriteToStream(ac.out)
+	ac.outmu.Unlock()
+	r, ok := <-ch
+	if !ok {
+		return nil, errors.New("agent connection closed")
+	}
+	if status, _ := r.GetFirstHeader("status"); status != "okay" {
+		reason, _ := r.GetFirstHeader("reason")
+		code, _, _ := r.ParseFirstHeaderAsInt("code", bwe.Unchecked)
+		return nil, bwe.M(code, reason)
+	}
+	return r, nil
+}
+
+//chainFrame creates a frame for an on-chain operation paid for by the
+//given account, carrying the chain params from the command line
+func (ac *agentConn) chainFrame(cmd string, account int) *objects.Frame {
+	f := ac.newFrame(cmd)
+	f.AddHeader("account", strconv.Itoa(account))
+	if ac.params.confirmations != "" {
+		f.AddHeader("confirmations", ac.params.confirmations)
+	}
+	if ac.params.timeout != "" {
+		f.AddHeader("timeout", ac.params.timeout)
+	}
+	if ac.params.maxgasprice != "" {
+		f.AddHeader("maxgasprice", ac.params.maxgasprice)
+	}
+	if ac.params.attempts != "" {
+		f.AddHeader("attempts", ac.params.attempts)
+	}
+	return f
+}
+
+func addPO(f *objects.Frame, ponum int, content []byte) {
+	po, err := objects.CreateOpaquePayloadObject(ponum, content)
+	if err != nil {
+		panic(err)
+	}
+	f.AddPayloadObject(po)
+}
+
+func (ac *agentConn) setEntity(blob []byte) error {
+	f := ac.newFrame(objects.CmdSetEntity)
+	addPO(f, objects.PONumROEntityWKey, blob)
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) setEntityOrExit(blob []byte) {
+	if err := ac.setEntity(blob); err != nil {
+		fmt.Println("Could not set entity:", err)
+		os.Exit(1)
+	}
+}
+
+//bcip returns the agent's current interaction params without changing them
+func (ac *agentConn) bcip() (*agentBCIP, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdBCInteractionParams))
+	if err != nil {
+		return nil, err
+	}
+	rv := &agentBCIP{MaxGasPrice: big.NewInt(0)}
+	conf, _ := r.GetFirstHeader("confirmations")
+	rv.Confirmations, _ = strconv.ParseUint(conf, 10, 64)
+	timo, _ := r.GetFirstHeader("timeout")
+	rv.Timeout, _ = strconv.ParseUint(timo, 10, 64)
+	mgp, _ := r.GetFirstHeader("maxgasprice")
+	rv.MaxGasPrice.SetString(mgp, 10)
+	cb, _ := r.GetFirstHeader("currentblock")
+	rv.CurrentBlock, _ = strconv.ParseUint(cb, 10, 64)
+	age, _, _ := r.ParseFirstHeaderAsInt("currentage", 0)
+	rv.CurrentAge = time.Duration(age) * time.Second
+	return rv, nil
+}
+
+//statLine prints the agent's version and how current its chain is
+func (ac *agentConn) statLine() {
+	cip, err := ac.bcip()
+	if err != nil {
+		fmt.Printf("Could not get BCIP: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\u2533 Connected to BOSSWAVE router version %s\n", ac.version)
+	fmt.Printf("\u2517 Block: %d Age: %s\n", cip.CurrentBlock, cip.CurrentAge)
+}
+
+//txResult is what the agent reports about the transaction that carried
+//out an on-chain operation
+type txResult struct {
+	//False if no transaction was needed (e.g. the object was already in
+	//the registry), in which case there are no transaction details
+	Transacted  bool
+	TxHash      string
+	BlockNumber string
+	//Empty if the agent could not get the receipt
+	GasUsed string
+}
+
+func readTxResult(r *objects.Frame) txResult {
+	rv := txResult{}
+	rv.TxHash, rv.Transacted = r.GetFirstHeader("txhash")
+	rv.BlockNumber, _ = r.GetFirstHeader("blocknumber")
+	rv.GasUsed, _ = r.GetFirstHeader("gasused")
+	return rv
+}
+
+func (r txResult) String() string {
+	if !r.Transacted {
+		return "no transaction needed"
+	}
+	rv := fmt.Sprintf("tx %s in block %s", r.TxHash, r.BlockNumber)
+	if r.GasUsed != "" {
+		rv += ", gas used " + r.GasUsed
+	}
+	return rv
+}
+
+//publishResult is what the agent reports about a publish
+type publishResult struct {
+	//The hash or VK of the published object
+	ID string
+	txResult
+}
+
+func (r *publishResult) String() string {
+	if !r.Transacted {
+		return r.ID + " (already in registry)"
+	}
+	return r.ID + "\n  " + r.txResult.String()
+}
+
+//publish puts the routing object in the registry
+func (ac *agentConn) publish(ro objects.RoutingObject) (*publishResult, error) {
+	var f *objects.Frame
+	key := "hash"
+	switch t := ro.(type) {
+	case *objects.Entity:
+		f = ac.chainFrame(objects.CmdPutEntity, 0)
+		addPO(f, objects.PONumROEntity, t.GetContent())
+		key = "vk"
+	case *objects.DOT:
+		f = ac.chainFrame(objects.CmdPutDot, 0)
+		addPO(f, objects.PONumROAccessDOT, t.GetContent())
+	case *objects.DChain:
+		f = ac.chainFrame(objects.CmdPutChain, 0)
+		addPO(f, objects.PONumROAccessDChain, t.GetContent())
+	case *objects.Revocation:
+		f = ac.chainFrame(objects.CmdPutRevocation, 0)
+		addPO(f, objects.PONumRORevocation, t.GetContent())
+	default:
+		return nil, fmt.Errorf("cannot publish object of type %T", ro)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	rv := &publishResult{txResult: readTxResult(r)}
+	rv.ID, _ = r.GetFirstHeader(key)
+	return rv, nil
+}
+
+//chainCost is what the agent estimates publishing a chain would cost
+type chainCost struct {
+	Hash string
+	//True if the chain is in the registry already, and would cost nothing
+	Existing bool
+	Gas      string
+	GasPrice string
+	//The most the publish could cost in wei, nil if Existing
+	Cost *big.Int
+}
+
+//estimateChain asks what publishing the chain from the given account would
+//cost, without publishing it
+func (ac *agentConn) estimateChain(dc *objects.DChain, account int) (*chainCost, error) {
+	f := ac.chainFrame(objects.CmdPutChain, account)
+	f.AddHeader("estimate", "true")
+	addPO(f, objects.PONumROAccessDChain, dc.GetContent())
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	rv := &chainCost{}
+	rv.Hash, _ = r.GetFirstHeader("hash")
+	if ex, _ := r.GetFirstHeader("existing"); ex == "true" {
+		rv.Existing = true
+		return rv, nil
+	}
+	rv.Gas, _ = r.GetFirstHeader("gas")
+	rv.GasPrice, _ = r.GetFirstHeader("gasprice")
+	cost, _ := r.GetFirstHeader("cost")
+	rv.Cost = new(big.Int)
+	if _, ok := rv.Cost.SetString(cost, 10); !ok {
+		return nil, fmt.Errorf("the agent gave a bad cost %q", cost)
+	}
+	return rv, nil
+}
+
+//txParams gets what is needed to sign a transaction from the given address
+//offline. If nsvk is not empty, the namespace's affinity nonce is returned
+//as well
+func (ac *agentConn) txParams(addr string, nsvk string) (*bc.OfflineTx, *big.Int, error) {
+	f := ac.newFrame(objects.CmdTxParams)
+	f.AddHeader("address", addr)
+	if nsvk != "" {
+		f.AddHeader("nsvk", nsvk)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	rv := &bc.OfflineTx{GasPrice: big.NewInt(0)}
+	nonce, _ := r.GetFirstHeader("nonce")
+	rv.Nonce, _ = strconv.ParseUint(nonce, 10, 64)
+	gasp, _ := r.GetFirstHeader("gasprice")
+	rv.GasPrice.SetString(gasp, 10)
+	if chainid, ok := r.GetFirstHeader("chainid"); ok {
+		rv.ChainID, _ = new(big.Int).SetString(chainid, 10)
+	}
+	var nsnonce *big.Int
+	if nsn, ok := r.GetFirstHeader("nsnonce"); ok {
+		nsnonce, _ = new(big.Int).SetString(nsn, 10)
+	}
+	return rv, nsnonce, nil
+}
+
+//sendRawTx broadcasts a signed transaction and waits for it to confirm
+func (ac *agentConn) sendRawTx(raw []byte) (txResult, error) {
+	f := ac.newFrame(objects.CmdSendRawTx)
+	f.AddHeaderB("rawtx", raw)
+	if ac.params.confirmations != "" {
+		f.AddHeader("confirmations", ac.params.confirmations)
+	}
+	if ac.params.timeout != "" {
+		f.AddHeader("timeout", ac.params.timeout)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return txResult{}, err
+	}
+	return readTxResult(r), nil
+}
+
+//chainErrString explains an error to the user, with a hint for the codes
+//they can do something about
+func chainErrString(err error) string {
+	return bwe.Explain(err)
+}
+
+func (ac *agentConn) transferWei(account int, to string, wei *big.Int) (txResult, error) {
+	f := ac.chainFrame(objects.CmdTransfer, account)
+	f.AddHeader("address", to)
+	f.AddHeader("valuewei", wei.Text(10))
+	r, err := ac.transact(f)
+	if err != nil {
+		return txResult{}, err
+	}
+	return readTxResult(r), nil
+}
+
+//accountBalance is the balance in wei of an address
+type accountBalance struct {
+	Addr string
+	Int  *big.Int
+}
+
+//readBalances gets the account balance POs from a response, in order
+func readBalances(r *objects.Frame) []accountBalance {
+	rv := []accountBalance{}
+	for _, po := range r.GetAllPOs() {
+		parts := strings.Split(string(po.GetContent()), ",")
+		if po.GetPONum() != objects.PONumAccountBalance || len(parts) != 3 {
+			continue
+		}
+		wei, ok := new(big.Int).SetString(parts[1], 10)
+		if ok {
+			rv = append(rv, accountBalance{Addr: parts[0], Int: wei})
+		}
+	}
+	return rv
+}
+
+//addressBalance returns the balance in wei of any address (in hex)
+func (ac *agentConn) addressBalance(addr string) (*big.Int, error) {
+	f := ac.newFrame(objects.CmdAddressBalance)
+	f.AddHeader("address", strings.TrimPrefix(addr, "0x"))
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	bals := readBalances(r)
+	if len(bals) == 0 {
+		return nil, errors.New("the agent did not return a balance")
+	}
+	return bals[0].Int, nil
+}
+
+//entityBalances returns the balances of the accounts of the agent's entity
+func (ac *agentConn) entityBalances() ([]accountBalance, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdEntityBalances))
+	if err != nil {
+		return nil, err
+	}
+	return readBalances(r), nil
+}
+
+//contractCode returns the code of the contract at the address (in hex)
+func (ac *agentConn) contractCode(addr string) ([]byte, error) {
+	f := ac.newFrame(objects.CmdContractCode)
+	f.AddHeader("address", strings.TrimPrefix(addr, "0x"))
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	code, _ := r.GetFirstHeaderB("code")
+	return code, nil
+}
+
+//agentContract is one of the builtin contracts reported by the agent
+type agentContract struct {
+	Name         string
+	Address      string
+	CodeHash     string
+	ExpectedHash string
+	//Empty if the contract is fine
+	Err string
+}
+
+//contracts returns the chain ID and the builtin contracts the agent uses
+func (ac *agentConn) contracts() (string, []agentContract, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdContracts))
+	if err != nil {
+		return "", nil, err
+	}
+	chainid, _ := r.GetFirstHeader("chainid")
+	rv := []agentContract{}
+	for _, h := range r.GetAllHeaders("contract") {
+		parts := strings.SplitN(h, ",", 5)
+		if len(parts) != 5 {
+			continue
+		}
+		rv = append(rv, agentContract{Name: parts[0], Address: parts[1], CodeHash: parts[2], ExpectedHash: parts[3], Err: parts[4]})
+	}
+	return chainid, rv, nil
+}
+
+//createShortAlias returns the created alias in hex
+func (ac *agentConn) createShortAlias(account int, val []byte) (string, error) {
+	f := ac.chainFrame(objects.CmdMakeShortAlias, account)
+	f.AddHeaderB("content", val)
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", err
+	}
+	rv, _ := r.GetFirstHeader("hexkey")
+	return rv, nil
+}
+
+func (ac *agentConn) createLongAlias(account int, key []byte, val []byte) error {
+	f := ac.chainFrame(objects.CmdMakeLongAlias, account)
+	f.AddHeaderB("key", key)
+	f.AddHeaderB("content", val)
+	_, err := ac.transact(f)
+	return err
+}
+
+//aliasFrame is a frame about an existing alias, which is a short alias if
+//short is true (key is then in hex), otherwise a long one
+func (ac *agentConn) aliasFrame(cmd string, account int, key string, short bool) *objects.Frame {
+	f := ac.chainFrame(cmd, account)
+	if short {
+		f.AddHeader("shortkey", key)
+	} else {
+		f.AddHeaderB("key", []byte(key))
+	}
+	return f
+}
+
+func (ac *agentConn) updateAlias(account int, key string, short bool, val []byte) error {
+	f := ac.aliasFrame(objects.CmdUpdateAlias, account, key, short)
+	f.AddHeaderB("content", val)
+	_, err := ac.transact(f)
+	return err
+}
+
+//transferAlias gives an alias to the given address, in hex
+func (ac *agentConn) transferAlias(account int, key string, short bool, to string) error {
+	f := ac.aliasFrame(objects.CmdTransferAlias, account, key, short)
+	f.AddHeader("to", strings.TrimPrefix(to, "0x"))
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) deleteAlias(account int, key string, short bool) error {
+	_, err := ac.transact(ac.aliasFrame(objects.CmdDeleteAlias, account, key, short))
+	return err
+}
+
+//resolveShortAlias returns the full 32 byte value of a short alias, given
+//in hex
+func (ac *agentConn) resolveShortAlias(hexkey string) ([]byte, error) {
+	f := ac.newFrame(objects.CmdResolveAlias)
+	f.AddHeader("shortkey", hexkey)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	rv, _ := r.GetFirstHeaderB("value")
+	return rv, nil
+}
+
+//resolveLongAlias returns the 32 byte value of a long alias, and whether
+//it is all zero, i.e. the alias is not set
+func (ac *agentConn) resolveLongAlias(key string) ([]byte, bool, error) {
+	f := ac.newFrame(objects.CmdResolveAlias)
+	f.AddHeader("longkey", key)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, false, err
+	}
+	rv, _ := r.GetFirstHeaderB("value")
+	return rv, len(bytes.Trim(rv, "\x00")) == 0, nil
+}
+
+//resolveEmbeddedAlias expands the aliases embedded in s
+func (ac *agentConn) resolveEmbeddedAlias(s string) (string, error) {
+	f := ac.newFrame(objects.CmdResolveAlias)
+	f.AddHeader("embedded", s)
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", err
+	}
+	rv, _ := r.GetFirstHeader("value")
+	return rv, nil
+}
+
+//resolveRegistry looks up a VK, hash or alias in the registry. It returns
+//the object, if there is one, and its validity: unknown, valid, expired or
+//revoked
+func (ac *agentConn) resolveRegistry(key string) (objects.RoutingObject, string, error) {
+	f := ac.newFrame(objects.CmdResolveRegistryObject)
+	f.AddHeader("key", key)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, "", err
+	}
+	validity, _ := r.GetFirstHeader("validity")
+	if ros := r.GetAllROs(); len(ros) != 0 {
+		return ros[0], validity, nil
+	}
+	return nil, validity, nil
+}
+
+//aliasRecord is an alias as listed by the agent
+type aliasRecord struct {
+	Key         []byte
+	Value       []byte
+	BlockNumber string
+	TxHash      string
+	//Empty if the agent does not know
+	Creator string
+	//Empty if the alias contract has no owners
+	Owner string
+}
+
+//listAliases lists the aliases for value if it is not nil, otherwise
+//those owned by the given addresses or, if there are none, by the accounts
+//of the agent's entity
+func (ac *agentConn) listAliases(value []byte, addrs []string) ([]aliasRecord, error) {
+	f := ac.newFrame(objects.CmdListAliases)
+	if value != nil {
+		f.AddHeaderB("value", value)
+	}
+	for _, a := range addrs {
+		f.AddHeader("address", strings.TrimPrefix(a, "0x"))
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	rv := []aliasRecord{}
+	for _, po := range r.GetAllPOs() {
+		parts := strings.Split(string(po.GetContent()), ",")
+		//Agents from before aliases had owners send five fields
+		if len(parts) != 5 && len(parts) != 6 {
+			return nil, fmt.Errorf("malformed alias record %q", string(po.GetContent()))
+		}
+		rec := aliasRecord{BlockNumber: parts[2], TxHash: parts[3], Creator: parts[4]}
+		if len(parts) == 6 {
+			rec.Owner = parts[5]
+		}
+		rec.Key, err = hex.DecodeString(strings.TrimPrefix(parts[0], "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("malformed alias key: %v", err)
+		}
+		rec.Value, err = hex.DecodeString(strings.TrimPrefix(parts[1], "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("malformed alias value: %v", err)
+		}
+		rv = append(rv, rec)
+	}
+	return rv, nil
+}
+
+//registryMatch is an object found by searchRegistry
+type registryMatch struct {
+	RO    objects.RoutingObject
+	State string
+}
+
+//searchRegistry finds published objects by contact or comment. typ can be
+//"entity", "dot" or empty for both
+func (ac *agentConn) searchRegistry(pattern string, regex bool, typ string) ([]registryMatch, error) {
+	f := ac.newFrame(objects.CmdSearchRegistry)
+	f.AddHeader("pattern", pattern)
+	if regex {
+		f.AddHeader("regex", "true")
+	}
+	if typ != "" {
+		f.AddHeader("type", typ)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	pos := r.GetAllPOs()
+	rv := []registryMatch{}
+	for i := 0; i+1 < len(pos); i += 2 {
+		ro, err := objects.LoadRoutingObject(pos[i].GetPONum(), pos[i].GetContent())
+		if err != nil {
+			return nil, fmt.Errorf("malformed search result: %v", err)
+		}
+		rv = append(rv, registryMatch{RO: ro, State: string(pos[i+1].GetContent())})
+	}
+	return rv, nil
+}
+
+//exportNamespace gets a JSON snapshot of the registry objects needed to
+//resolve the namespace
+func (ac *agentConn) exportNamespace(nsvk string) ([]byte, error) {
+	f := ac.newFrame(objects.CmdExportNamespace)
+	f.AddHeader("nsvk", nsvk)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	pos := r.GetAllPOs()
+	if len(pos) != 1 {
+		return nil, fmt.Errorf("malformed export response")
+	}
+	return pos[0].GetContent(), nil
+}
+
+//importNamespace loads a snapshot from exportNamespace into the agent
+func (ac *agentConn) importNamespace(snap []byte) (loaded int, skipped int, err error) {
+	f := ac.newFrame(objects.CmdImportNamespace)
+	addPO(f, objects.PONumJSON, snap)
+	r, err := ac.transact(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	ls, _ := r.GetFirstHeader("loaded")
+	ss, _ := r.GetFirstHeader("skipped")
+	loaded, _ = strconv.Atoi(ls)
+	skipped, _ = strconv.Atoi(ss)
+	return loaded, skipped, nil
+}
+
+//exportStore gets a page of the messages persisted on the agent's router
+//that match uri, returning their topics, encoded messages and sequence
+//numbers and the cursor for the next page, which is empty after the last
+func (ac *agentConn) exportStore(uri string, cursor string) ([]string, [][]byte, []uint64, string, error) {
+	f := ac.newFrame(objects.CmdStoreExport)
+	f.AddHeader("uri", uri)
+	f.AddHeader("limit", strconv.Itoa(storePageSize))
+	if cursor != "" {
+		f.AddHeader("cursor", cursor)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	topics := r.GetAllHeaders("topic")
+	if len(topics) != len(r.POs) {
+		return nil, nil, nil, "", fmt.Errorf("malformed export page")
+	}
+	bodies := make([][]byte, len(r.POs))
+	for i, pe := range r.POs {
+		bodies[i] = pe.PO.GetContent()
+	}
+	//Routers that do not number persisted messages send no sequences
+	seqs := make([]uint64, len(r.POs))
+	if ss := r.GetAllHeaders("persistseq"); len(ss) == len(seqs) {
+		for i, s := range ss {
+			seqs[i], _ = strconv.ParseUint(s, 10, 64)
+		}
+	}
+	next, _ := r.GetFirstHeader("cursor")
+	return topics, bodies, seqs, next, nil
+}
+
+//importStore persists exported messages on the agent's router with their
+//sequence numbers, returning how many were persisted and the reasons the
+//others were skipped
+func (ac *agentConn) importStore(bodies [][]byte, seqs []uint64, verifyChain bool) (int, []string, error) {
+	f := ac.newFrame(objects.CmdStoreImport)
+	f.AddHeader("verify_chain", strconv.FormatBool(verifyChain))
+	for i, b := range bodies {
+		f.AddHeader("persistseq", strconv.FormatUint(seqs[i], 10))
+		addPO(f, objects.PONumBWMessage, b)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	ls, _ := r.GetFirstHeader("loaded")
+	loaded, _ := strconv.Atoi(ls)
+	return loaded, r.GetAllHeaders("skipped"), nil
+}
+
+//mkdotParams are the fields of an access DOT made by the agent. A nil
+//expiry leaves it to the agent's default
+type mkdotParams struct {
+	uri          string
+	to           string
+	ttl          int
+	expiry       *time.Duration
+	contact      string
+	comment      string
+	revokers     []string
+	omitCreation bool
+	perms        string
+	noDelegate   string
+}
+
+//makeDOT has the agent make an access DOT from its entity. It returns the
+//DOT's content
+func (ac *agentConn) makeDOT(p *mkdotParams) ([]byte, error) {
+	f := ac.newFrame(objects.CmdMakeDot)
+	f.AddHeader("uri", p.uri)
+	f.AddHeader("to", p.to)
+	f.AddHeader("ttl", strconv.Itoa(p.ttl))
+	if p.expiry != nil {
+		f.AddHeader("expirydelta", p.expiry.String())
+	}
+	if p.contact != "" {
+		f.AddHeader("contact", p.contact)
+	}
+	if p.comment != "" {
+		f.AddHeader("comment", p.comment)
+	}
+	for _, r := range p.revokers {
+		f.AddHeader("revoker", r)
+	}
+	f.AddHeader("omitcreationdate", strconv.FormatBool(p.omitCreation))
+	f.AddHeader("accesspermissions", p.perms)
+	if p.noDelegate != "" {
+		f.AddHeader("nodelegate", p.noDelegate)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.POs) != 1 {
+		return nil, fmt.Errorf("expected the DOT from the agent")
+	}
+	return r.POs[0].PO.GetContent(), nil
+}
+
+//makeRevocation has the agent's entity revoke a DOT or entity. kind is
+//"dot" or "entity". It returns the revocation's hash and content
+func (ac *agentConn) makeRevocation(kind string, target string, comment string) (string, []byte, error) {
+	f := ac.newFrame(objects.CmdRevokeRO)
+	f.AddHeader(kind, target)
+	f.AddHeader("comment", comment)
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(r.POs) != 1 {
+		return "", nil, fmt.Errorf("expected the revocation from the agent")
+	}
+	hash, _ := r.GetFirstHeader("hash")
+	return hash, r.POs[0].PO.GetContent(), nil
+}
+
+//buildChain has the agent build the chains granting perms on uri to the
+//VK, in the order of its chain policy
+func (ac *agentConn) buildChain(uri string, perms string, to string) ([]*objects.DChain, error) {
+	f := ac.newFrame(objects.CmdBuildChain)
+	f.AddHeader("uri", uri)
+	f.AddHeader("accesspermissions", perms)
+	f.AddHeader("to", to)
+	res, err := ac.stream(f)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*objects.DChain{}
+	for r := range res {
+		for _, po := range r.GetAllPOs() {
+			dci, err := objects.LoadRoutingObject(objects.ROAccessDChain, po.GetContent())
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, dci.(*objects.DChain))
+		}
+	}
+	return rv, nil
+}
+
+//dotRequest is a pending request for a DOT, as `lsrq` lists it
+type dotRequest struct {
+	Requester string
+	URI       string
+	Perms     string
+	TTL       string
+	Expiry    string
+	Comment   string
+	Created   string
+}
+
+//requestDOT asks granter for a DOT on uri from the agent's entity. An
+//empty expiry leaves the DOT's expiry to the granter
+func (ac *agentConn) requestDOT(uri string, granter string, perms string, ttl int, expiry string, comment string) error {
+	f := ac.newFrame(objects.CmdRequestDOT)
+	f.AddHeader("uri", uri)
+	f.AddHeader("granter", granter)
+	f.AddHeader("accesspermissions", perms)
+	f.AddHeader("ttl", strconv.Itoa(ttl))
+	if expiry != "" {
+		f.AddHeader("expirydelta", expiry)
+	}
+	if comment != "" {
+		f.AddHeader("comment", comment)
+	}
+	_, err := ac.transact(f)
+	return err
+}
+
+//listDOTRequests gets the pending requests for DOTs from the agent's
+//entity in the namespace ns
+func (ac *agentConn) listDOTRequests(ns string) ([]dotRequest, error) {
+	f := ac.newFrame(objects.CmdListDOTRequests)
+	f.AddHeader("namespace", ns)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	cols := [][]string{
+		r.GetAllHeaders("requester"),
+		r.GetAllHeaders("uri"),
+		r.GetAllHeaders("accesspermissions"),
+		r.GetAllHeaders("ttl"),
+		r.GetAllHeaders("expiry"),
+		r.GetAllHeaders("comment"),
+		r.GetAllHeaders("created"),
+	}
+	for _, col := range cols {
+		if len(col) != len(cols[0]) {
+			return nil, fmt.Errorf("malformed request list from agent")
+		}
+	}
+	rv := make([]dotRequest, len(cols[0]))
+	for i := range rv {
+		rv[i] = dotRequest{cols[0][i], cols[1][i], cols[2][i], cols[3][i], cols[4][i], cols[5][i], cols[6][i]}
+	}
+	return rv, nil
+}
+
+//approveParams override the fields of a requested DOT. Empty strings and
+//a nil ttl keep what was asked for
+type approveParams struct {
+	perms    string
+	ttl      *int
+	expiry   string
+	comment  string
+	contact  string
+	revokers []string
+}
+
+//approveDOTRequest has the agent grant the DOT requester asked the agent's
+//entity for, publish it and delete the request. The agent's entity pays
+func (ac *agentConn) approveDOTRequest(ns string, requester string, p *approveParams) (*objects.DOT, error) {
+	f := ac.chainFrame(objects.CmdApproveDOTRequest, 0)
+	f.AddHeader("namespace", ns)
+	f.AddHeader("requester", requester)
+	if p.perms != "" {
+		f.AddHeader("accesspermissions", p.perms)
+	}
+	if p.ttl != nil {
+		f.AddHeader("ttl", strconv.Itoa(*p.ttl))
+	}
+	if p.expiry != "" {
+		f.AddHeader("expirydelta", p.expiry)
+	}
+	if p.comment != "" {
+		f.AddHeader("comment", p.comment)
+	}
+	if p.contact != "" {
+		f.AddHeader("contact", p.contact)
+	}
+	for _, r := range p.revokers {
+		f.AddHeader("revoker", r)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.POs) != 1 {
+		return nil, fmt.Errorf("expected the DOT from the agent")
+	}
+	ro, err := objects.NewDOT(objects.ROAccessDOT, r.POs[0].PO.GetContent())
+	if err != nil {
+		return nil, fmt.Errorf("bad DOT from agent: %v", err)
+	}
+	return ro.(*objects.DOT), nil
+}
+
+//rejectDOTRequest deletes the request requester made to the agent's entity
+func (ac *agentConn) rejectDOTRequest(ns string, requester string) error {
+	f := ac.newFrame(objects.CmdRejectDOTRequest)
+	f.AddHeader("namespace", ns)
+	f.AddHeader("requester", requester)
+	_, err := ac.transact(f)
+	return err
+}
+
+//tempCredential is a temporary credential as `mktp` returns it
+type tempCredential struct {
+	entity   *objects.Entity
+	dot      *objects.DOT
+	chain    *objects.DChain
+	expires  string
+	revokeAt string
+}
+
+//mintTempCredential has the agent mint a temporary credential on uri from
+//the agent's entity, which pays. revokeAfter is a duration, never, or empty
+//to revoke the DOT when it expires
+func (ac *agentConn) mintTempCredential(uri string, perms string, life string, revokeAfter string, comment string) (*tempCredential, error) {
+	f := ac.chainFrame(objects.CmdMintTempCredential, 0)
+	f.AddHeader("uri", uri)
+	f.AddHeader("accesspermissions", perms)
+	f.AddHeader("life", life)
+	if revokeAfter != "" {
+		f.AddHeader("revokeafter", revokeAfter)
+	}
+	if comment != "" {
+		f.AddHeader("comment", comment)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.POs) != 3 {
+		return nil, fmt.Errorf("expected the entity, DOT and chain from the agent")
+	}
+	rv := &tempCredential{}
+	rv.expires, _ = r.GetFirstHeader("expires")
+	rv.revokeAt, _ = r.GetFirstHeader("revokeat")
+	ent, err := objects.NewEntity(objects.ROEntityWKey, r.POs[0].PO.GetContent())
+	if err != nil {
+		return nil, fmt.Errorf("bad entity from agent: %v", err)
+	}
+	rv.entity = ent.(*objects.Entity)
+	dot, err := objects.NewDOT(objects.ROAccessDOT, r.POs[1].PO.GetContent())
+	if err != nil {
+		return nil, fmt.Errorf("bad DOT from agent: %v", err)
+	}
+	rv.dot = dot.(*objects.DOT)
+	chain, err := objects.NewDChain(objects.ROAccessDChain, r.POs[2].PO.GetContent())
+	if err != nil {
+		return nil, fmt.Errorf("bad chain from agent: %v", err)
+	}
+	rv.chain = chain.(*objects.DChain)
+	return rv, nil
+}
+
+//schedule is a scheduled publish as `lssc` returns it
+type schedule struct {
+	ID        string
+	Cron      string
+	URI       string
+	PONum     string
+	Owner     string
+	Next      string
+	Runs      string
+	LastError string
+}
+
+func schedulesFromFrame(r *objects.Frame) ([]schedule, error) {
+	cols := [][]string{
+		r.GetAllHeaders("id"),
+		r.GetAllHeaders("cron"),
+		r.GetAllHeaders("uri"),
+		r.GetAllHeaders("ponum"),
+		r.GetAllHeaders("owner"),
+		r.GetAllHeaders("next"),
+		r.GetAllHeaders("runs"),
+		r.GetAllHeaders("lasterror"),
+	}
+	for _, col := range cols {
+		if len(col) != len(cols[0]) {
+			return nil, fmt.Errorf("malformed schedule list from agent")
+		}
+	}
+	rv := make([]schedule, len(cols[0]))
+	for i := range rv {
+		rv[i] = schedule{cols[0][i], cols[1][i], cols[2][i], cols[3][i], cols[4][i], cols[5][i], cols[6][i], cols[7][i]}
+	}
+	return rv, nil
+}
+
+//addSchedule has the agent publish on uri as the agent's entity whenever
+//cron fires, until the schedule is cancelled
+func (ac *agentConn) addSchedule(uri string, cron string, ponum string, template string, persist bool) (*schedule, error) {
+	f := ac.newFrame(objects.CmdAddSchedule)
+	f.AddHeader("uri", uri)
+	f.AddHeader("cron", cron)
+	f.AddHeader("ponum", ponum)
+	f.AddHeader("template", template)
+	if persist {
+		f.AddHeader("persist", "true")
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	scheds, err := schedulesFromFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(scheds) != 1 {
+		return nil, fmt.Errorf("expected the schedule from the agent")
+	}
+	return &scheds[0], nil
+}
+
+//listSchedules lists the schedules of the agent's entity
+func (ac *agentConn) listSchedules() ([]schedule, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdListSchedules))
+	if err != nil {
+		return nil, err
+	}
+	return schedulesFromFrame(r)
+}
+
+//cancelSchedule stops the schedule with the given ID
+func (ac *agentConn) cancelSchedule(id string) error {
+	f := ac.newFrame(objects.CmdCancelSchedule)
+	f.AddHeader("id", id)
+	_, err := ac.transact(f)
+	return err
+}
+
+//drHealth is the agent's designated router health, as `drhs` returns it
+type drHealth struct {
+	VK            string
+	Monitor       bool
+	Checked       string
+	SRV           string
+	PublicIP      string
+	Reachable     bool
+	Latency       string
+	Problems      []string
+	UpdatedSRV    string
+	UpdatePending bool
+	Updated       string
+	UpdateErr     string
+}
+
+//drHealth gets the last health check of the agent as a designated
+//router. If check is set, or it has not been checked, a check is done now
+func (ac *agentConn) drHealth(check bool) (*drHealth, error) {
+	f := ac.newFrame(objects.CmdDRHealth)
+	if check {
+		f.AddHeader("check", "true")
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	h := &drHealth{}
+	h.VK, _ = r.GetFirstHeader("vk")
+	mon, _ := r.GetFirstHeader("monitor")
+	h.Monitor = mon == "true"
+	h.Checked, _ = r.GetFirstHeader("checked")
+	h.SRV, _ = r.GetFirstHeader("srv")
+	h.PublicIP, _ = r.GetFirstHeader("publicip")
+	reach, _ := r.GetFirstHeader("reachable")
+	h.Reachable = reach == "true"
+	h.Latency, _ = r.GetFirstHeader("latency")
+	h.Problems = r.GetAllHeaders("problem")
+	h.UpdatedSRV, _ = r.GetFirstHeader("updatedsrv")
+	pending, _ := r.GetFirstHeader("updatepending")
+	h.UpdatePending = pending == "true"
+	h.Updated, _ = r.GetFirstHeader("updated")
+	h.UpdateErr, _ = r.GetFirstHeader("updateerr")
+	return h, nil
+}
+
+//agentClient is a client of the agent
+type agentClient struct {
+	ID            string
+	Name          string
+	VK            string
+	Connected     string
+	Subscriptions string
+	Published     string
+	Chains        string
+}
+
+//listClients gets the clients of the agent. The entity set on the
+//connection must be the router's or one of its client admins
+func (ac *agentConn) listClients() ([]agentClient, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdListClients))
+	if err != nil {
+		return nil, err
+	}
+	cols := [][]string{
+		r.GetAllHeaders("id"),
+		r.GetAllHeaders("name"),
+		r.GetAllHeaders("vk"),
+		r.GetAllHeaders("connected"),
+		r.GetAllHeaders("subscriptions"),
+		r.GetAllHeaders("published"),
+		r.GetAllHeaders("chains"),
+	}
+	for _, col := range cols[1:] {
+		if len(col) != len(cols[0]) {
+			return nil, fmt.Errorf("malformed client list")
+		}
+	}
+	rv := []agentClient{}
+	for i := range cols[0] {
+		rv = append(rv, agentClient{
+			ID:            cols[0][i],
+			Name:          cols[1][i],
+			VK:            cols[2][i],
+			Connected:     cols[3][i],
+			Subscriptions: cols[4][i],
+			Published:     cols[5][i],
+			Chains:        cols[6][i],
+		})
+	}
+	return rv, nil
+}
+
+//agentSubscription is a subscription on the agent's router
+type agentSubscription struct {
+	URI      string
+	Client   string
+	VK       string
+	Created  string
+	Messages string
+	Tap      bool
+}
+
+//listSubscriptions gets the subscriptions on the agent's router, those on
+//ns if it is not empty. The entity set on the connection must be the
+//router's or one of its client admins
+func (ac *agentConn) listSubscriptions(ns string) ([]agentSubscription, error) {
+	f := ac.newFrame(objects.CmdListSubscriptions)
+	if ns != "" {
+		f.AddHeader("ns", ns)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	cols := [][]string{
+		r.GetAllHeaders("uri"),
+		r.GetAllHeaders("client"),
+		r.GetAllHeaders("vk"),
+		r.GetAllHeaders("created"),
+		r.GetAllHeaders("messages"),
+		r.GetAllHeaders("tap"),
+	}
+	for _, col := range cols[1:] {
+		if len(col) != len(cols[0]) {
+			return nil, fmt.Errorf("malformed subscription list")
+		}
+	}
+	rv := []agentSubscription{}
+	for i := range cols[0] {
+		rv = append(rv, agentSubscription{
+			URI:      cols[0][i],
+			Client:   cols[1][i],
+			VK:       cols[2][i],
+			Created:  cols[3][i],
+			Messages: cols[4][i],
+			Tap:      cols[5][i] == "true",
+		})
+	}
+	return rv, nil
+}
+
+//drain stops the agent's router taking new work
+func (ac *agentConn) drain() error {
+	_, err := ac.transact(ac.newFrame(objects.CmdDrain))
+	return err
+}
+
+//dropPeer closes the connection of a peer of the agent, by its client ID
+func (ac *agentConn) dropPeer(id string) error {
+	f := ac.newFrame(objects.CmdDropPeer)
+	f.AddHeader("id", id)
+	_, err := ac.transact(f)
+	return err
+}
+
+//standbyStatus is the state of hot standby replication on the agent
+type standbyStatus struct {
+	Primary     string `json:",omitempty"`
+	Connected   bool
+	Synced      bool
+	Applied     string `json:",omitempty"`
+	LastApplied string `json:",omitempty"`
+	LastError   string `json:",omitempty"`
+	Promoted    string `json:",omitempty"`
+	Followers   string
+}
+
+func (ac *agentConn) standbyStatus() (*standbyStatus, error) {
+	r, err := ac.transact(ac.newFrame(objects.CmdStandbyStatus))
+	if err != nil {
+		return nil, err
+	}
+	st := &standbyStatus{}
+	st.Primary, _ = r.GetFirstHeader("primary")
+	connected, _ := r.GetFirstHeader("connected")
+	st.Connected = connected == "true"
+	synced, _ := r.GetFirstHeader("synced")
+	st.Synced = synced == "true"
+	st.Applied, _ = r.GetFirstHeader("applied")
+	st.LastApplied, _ = r.GetFirstHeader("lastapplied")
+	st.LastError, _ = r.GetFirstHeader("lasterror")
+	st.Promoted, _ = r.GetFirstHeader("promoted")
+	st.Followers, _ = r.GetFirstHeader("followers")
+	return st, nil
+}
+
+//promote makes the agent, a standby, stop following its primary. It
+//returns the SRV record being published, if there is one
+func (ac *agentConn) promote(srv string) (string, error) {
+	f := ac.newFrame(objects.CmdPromote)
+	if srv != "" {
+		f.AddHeader("srv", srv)
+	}
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", err
+	}
+	rv, _ := r.GetFirstHeader("srv")
+	return rv, nil
+}
+
+//dnsNamespace is a namespace discovered through DNS
+type dnsNamespace struct {
+	Domain   string
+	NSVK     string
+	DRVK     string
+	SRV      string
+	Verified bool
+}
+
+//discoverNamespace looks up the namespace a domain publishes in DNS
+func (ac *agentConn) discoverNamespace(domain string) (*dnsNamespace, error) {
+	f := ac.newFrame(objects.CmdDiscoverNamespace)
+	f.AddHeader("domain", domain)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	ns := &dnsNamespace{}
+	ns.Domain, _ = r.GetFirstHeader("domain")
+	ns.NSVK, _ = r.GetFirstHeader("nsvk")
+	ns.DRVK, _ = r.GetFirstHeader("drvk")
+	ns.SRV, _ = r.GetFirstHeader("srv")
+	verified, _ := r.GetFirstHeader("verified")
+	ns.Verified = verified == "true"
+	return ns, nil
+}
+
+//designatedRouter is a member of a namespace's replica set
+type designatedRouter struct {
+	VK  string
+	SRV string
+}
+
+//listDesignatedRouters gets the replica set of a namespace, primary first
+func (ac *agentConn) listDesignatedRouters(nsvk string) ([]designatedRouter, error) {
+	f := ac.newFrame(objects.CmdListDesignatedRouters)
+	f.AddHeader("nsvk", nsvk)
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	vks := r.GetAllHeaders("drvk")
+	srvs := r.GetAllHeaders("srv")
+	if len(vks) != len(srvs) {
+		return nil, fmt.Errorf("malformed designated router list")
+	}
+	rv := []designatedRouter{}
+	for i := range vks {
+		rv = append(rv, designatedRouter{VK: vks[i], SRV: srvs[i]})
+	}
+	return rv, nil
+}
+
+//designatedRouterOffers gets the routers offering to route a namespace,
+//and the one it accepted with its SRV record, if any
+func (ac *agentConn) designatedRouterOffers(nsvk string) (active string, srv string, all []string, err error) {
+	f := ac.newFrame(objects.CmdListDROffers)
+	f.AddHeader("nsvk", nsvk)
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", "", nil, err
+	}
+	active, _ = r.GetFirstHeader("active")
+	srv, _ = r.GetFirstHeader("srv")
+	for _, po := range r.GetAllPOs() {
+		if po.GetPONum() == objects.RODesignatedRouterVK {
+			all = append(all, crypto.FmtKey(po.GetContent()))
+		}
+	}
+	return active, srv, all, nil
+}
+
+func (ac *agentConn) newDesignatedRouterOffer(account int, nsvk string, dr *objects.Entity) error {
+	f := ac.chainFrame(objects.CmdNewDROffer, account)
+	f.AddHeader("nsvk", nsvk)
+	addPO(f, objects.PONumROEntityWKey, dr.GetSigningBlob())
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) revokeDesignatedRouterOffer(account int, nsvk string, dr *objects.Entity) error {
+	f := ac.chainFrame(objects.CmdRevokeDROffer, account)
+	f.AddHeader("nsvk", nsvk)
+	addPO(f, objects.PONumROEntityWKey, dr.GetSigningBlob())
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) acceptDesignatedRouterOffer(account int, drvk string, ns *objects.Entity) error {
+	f := ac.chainFrame(objects.CmdAcceptDROffer, account)
+	f.AddHeader("drvk", drvk)
+	addPO(f, objects.PONumROEntityWKey, ns.GetSigningBlob())
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) revokeAcceptanceOfDesignatedRouterOffer(account int, drvk string, ns *objects.Entity) error {
+	f := ac.chainFrame(objects.CmdRevokeDRAccept, account)
+	f.AddHeader("drvk", drvk)
+	addPO(f, objects.PONumROEntityWKey, ns.GetSigningBlob())
+	_, err := ac.transact(f)
+	return err
+}
+
+func (ac *agentConn) setDesignatedRouterSRVRecord(account int, srv string, dr *objects.Entity) error {
+	f := ac.chainFrame(objects.CmdUpdateSRVRecord, account)
+	f.AddHeader("srv", srv)
+	addPO(f, objects.PONumROEntityWKey, dr.GetSigningBlob())
+	_, err := ac.transact(f)
+	return err
+}
+
+//deleteURI removes the message persisted on the URI, building the chain
+//on the agent
+func (ac *agentConn) deleteURI(uri string) error {
+	f := ac.newFrame(objects.CmdDelete)
+	f.AddHeader("uri", uri)
+	f.AddHeader("autochain", "true")
+	_, err := ac.transact(f)
+	return err
+}
+
+//stream sends the frame and, once the response is okay, returns the result
+//frames. The channel is closed after the last result or if the connection
+//closes
+func (ac *agentConn) stream(f *objects.Frame) (chan *objects.Frame, error) {
+	ch := make(chan *objects.Frame, 16)
+	ac.repmu.Lock()
+	ac.replies[f.SeqNo] = ch
+	ac.repmu.Unlock()
+	ac.outmu.Lock()
+	f.WriteToStream(ac.out)
+	ac.outmu.Unlock()
+	r, ok := <-ch
+	if !ok {
+		return nil, errors.New("agent connection closed")
+	}
+	if status, _ := r.GetFirstHeader("status"); status != "okay" {
+		ac.repmu.Lock()
+		delete(ac.replies, f.SeqNo)
+		ac.repmu.Unlock()
+		reason, _ := r.GetFirstHeader("reason")
+		code, _, _ := r.ParseFirstHeaderAsInt("code", bwe.Unchecked)
+		return nil, bwe.M(code, reason)
+	}
+	rv := make(chan *objects.Frame, 16)
+	go func() {
+		defer close(rv)
+		for r := range ch {
+			if r.Cmd != objects.CmdResult {
+				continue
+			}
+			finished, _ := r.GetFirstHeader("finished")
+			if finished == "true" {
+				ac.repmu.Lock()
+				delete(ac.replies, f.SeqNo)
+				ac.repmu.Unlock()
+				if _, ok := r.GetFirstHeader("uri"); ok {
+					rv <- r
+				}
+				return
+			}
+			rv <- r
+		}
+	}()
+	return rv, nil
+}
+
+//unresolveAlias returns the alias for a value, or "" if there is none
+func (ac *agentConn) unresolveAlias(value []byte) (string, error) {
+	f := ac.newFrame(objects.CmdResolveAlias)
+	f.AddHeaderB("unresolve", value)
+	r, err := ac.transact(f)
+	if err != nil {
+		return "", err
+	}
+	rv, _ := r.GetFirstHeader("value")
+	return rv, nil
+}
+
+//publishMessage publishes (or persists) the payload objects on the URI,
+//building the chain on the agent
+func (ac *agentConn) publishMessage(uri string, persist bool, pos []objects.PayloadObject) error {
+	cmd := objects.CmdPublish
+	if persist {
+		cmd = objects.CmdPersist
+	}
+	f := ac.newFrame(cmd)
+	f.AddHeader("uri", uri)
+	f.AddHeader("autochain", "true")
+	for _, po := range pos {
+		f.AddPayloadObject(po)
+	}
+	_, err := ac.transact(f)
+	return err
+}
+
+//rotateParams are the fields of rotate-entity. Nil strings and revokers
+//keep the old entity's
+type rotateParams struct {
+	old      *objects.Entity
+	granters []*objects.Entity
+	contact  *string
+	comment  *string
+	revokers []string
+	expiry   string
+	keepOld  bool
+	noPub    bool
+}
+
+//rotatedDOT is one of the old entity's DOTs in a rotation report
+type rotatedDOT struct {
+	Old   string
+	New   string `json:",omitempty"`
+	Held  bool
+	Error string `json:",omitempty"`
+}
+
+//rotation is the report of rotate-entity
+type rotation struct {
+	OldVK      string
+	NewVK      string
+	Revocation string `json:",omitempty"`
+	Published  bool
+	Revoked    bool
+	Error      string `json:",omitempty"`
+	DOTs       []rotatedDOT
+	//The new objects, so that they can be saved
+	entity *objects.Entity
+	dots   []*objects.DOT
+	rvk    *objects.Revocation
+}
+
+//rotateEntity has the agent replace an entity, granting the new one its
+//DOTs and revoking the old one. The agent's entity pays
+func (ac *agentConn) rotateEntity(p *rotateParams) (*rotation, error) {
+	f := ac.chainFrame(objects.CmdRotateEntity, 0)
+	addPO(f, objects.PONumROEntityWKey, p.old.GetSigningBlob())
+	for _, g := range p.granters {
+		addPO(f, objects.PONumROEntityWKey, g.GetSigningBlob())
+	}
+	if p.contact != nil {
+		f.AddHeader("contact", *p.contact)
+	}
+	if p.comment != nil {
+		f.AddHeader("comment", *p.comment)
+	}
+	for _, r := range p.revokers {
+		f.AddHeader("revoker", r)
+	}
+	if p.expiry != "" {
+		f.AddHeader("expirydelta", p.expiry)
+	}
+	f.AddHeader("keepold", strconv.FormatBool(p.keepOld))
+	f.AddHeader("nopublish", strconv.FormatBool(p.noPub))
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	rv := &rotation{OldVK: crypto.FmtKey(p.old.GetVK())}
+	rv.NewVK, _ = r.GetFirstHeader("vk")
+	rv.Revocation, _ = r.GetFirstHeader("revocation")
+	rv.Error, _ = r.GetFirstHeader("error")
+	pub, _ := r.GetFirstHeader("published")
+	rv.Published = pub == "true"
+	rvkd, _ := r.GetFirstHeader("revoked")
+	rv.Revoked = rvkd == "true"
+	olds := r.GetAllHeaders("dot")
+	held := r.GetAllHeaders("held")
+	news := r.GetAllHeaders("newdot")
+	errs := r.GetAllHeaders("doterror")
+	if len(held) != len(olds) || len(news) != len(olds) || len(errs) != len(olds) {
+		return nil, fmt.Errorf("bad rotation report from agent")
+	}
+	for i := range olds {
+		rv.DOTs = append(rv.DOTs, rotatedDOT{Old: olds[i], New: news[i], Held: held[i] == "true", Error: errs[i]})
+	}
+	for _, pe := range r.POs {
+		ro, err := objects.LoadRoutingObject(pe.PO.GetPONum(), pe.PO.GetContent())
+		if err != nil {
+			return nil, fmt.Errorf("bad object from agent: %v", err)
+		}
+		switch t := ro.(type) {
+		case *objects.Entity:
+			rv.entity = t
+		case *objects.DOT:
+			rv.dots = append(rv.dots, t)
+		case *objects.Revocation:
+			rv.rvk = t
+		}
+	}
+	if rv.entity == nil {
+		return nil, fmt.Errorf("agent did not return the new entity")
+	}
+	return rv, nil
+}
+
+//rotateDR moves namespaces from the old designated router entity to the new
+//one, returning the namespaces moved and those the old one stopped offering
+//to route
+func (ac *agentConn) rotateDR(account int, old, nw *objects.Entity, nss []*objects.Entity, srv string, wait string, keepOld bool) (moved []string, retracted []string, err error) {
+	f := ac.chainFrame(objects.CmdRotateDR, account)
+	addPO(f, objects.PONumROEntityWKey, old.GetSigningBlob())
+	addPO(f, objects.PONumROEntityWKey, nw.GetSigningBlob())
+	for _, ns := range nss {
+		addPO(f, objects.PONumROEntityWKey, ns.GetSigningBlob())
+	}
+	f.AddHeader("srv", srv)
+	if wait != "" {
+		f.AddHeader("wait", wait)
+	}
+	f.AddHeader("keepold", strconv.FormatBool(keepOld))
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.GetAllHeaders("moved"), r.GetAllHeaders("retracted"), nil
+}
+
+//routerStats gets a snapshot of the router with its busiest topics. The
+//entity set on the connection must be the router's or one of its client
+//admins
+func (ac *agentConn) routerStats(topics int) (*api.RouterStats, error) {
+	f := ac.newFrame(objects.CmdRouterStats)
+	f.AddHeader("topics", strconv.Itoa(topics))
+	r, err := ac.transact(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.POs) != 1 {
+		return nil, fmt.Errorf("malformed router stats")
+	}
+	st := &api.RouterStats{}
+	if err := msgpack.Unmarshal(r.POs[0].PO.GetContent(), st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+//servicesFrame is a svcs frame for the namespaces
+func (ac *agentConn) servicesFrame(nss []string, staleAfter, goneAfter time.Duration, watch bool) *objects.Frame {
+	f := ac.newFrame(objects.CmdListServices)
+	for _, ns := range nss {
+		f.AddHeader("namespace", ns)
+	}
+	if staleAfter > 0 {
+		f.AddHeader("staleafter", staleAfter.String())
+	}
+	if goneAfter > 0 {
+		f.AddHeader("goneafter", goneAfter.String())
+	}
+	if watch {
+		f.AddHeader("watch", "true")
+	}
+	return f
+}
+
+//listServices gets the inventory of the services in the namespaces
+func (ac *agentConn) listServices(nss []string, staleAfter, goneAfter time.Duration) (*api.ServiceInventory, error) {
+	r, err := ac.transact(ac.servicesFrame(nss, staleAfter, goneAfter, false))
+	if err != nil {
+		return nil, err
+	}
+	if len(r.POs) != 1 {
+		return nil, fmt.Errorf("malformed service inventory")
+	}
+	inv := &api.ServiceInventory{}
+	if err := msgpack.Unmarshal(r.POs[0].PO.GetContent(), inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+//watchServices calls cb with the inventory of the services in the
+//namespaces, and then with the changes and the new inventory each time
+//services appear, disappear or change health. It returns when the
+//connection closes
+func (ac *agentConn) watchServices(nss []string, staleAfter, goneAfter time.Duration, cb func([]api.ServiceChange, *api.ServiceInventory)) error {
+	results, err := ac.stream(ac.servicesFrame(nss, staleAfter, goneAfter, true))
+	if err != nil {
+		return err
+	}
+	for r := range results {
+		n, _, _ := r.ParseFirstHeaderAsInt("changes", 0)
+		if n < 0 || len(r.POs) != n+1 {
+			return fmt.Errorf("malformed service changes")
+		}
+		changes := make([]api.ServiceChange, n)
+		for i := range changes {
+			if err := msgpack.Unmarshal(r.POs[i].PO.GetContent(), &changes[i]); err != nil {
+				return err
+			}
+		}
+		inv := &api.ServiceInventory{}
+		if err := msgpack.Unmarshal(r.POs[n].PO.GetContent(), inv); err != nil {
+			return err
+		}
+		cb(changes, inv)
+	}
+	return errors.New("agent connection closed")
+}
+
+//call has the agent publish request on the slot of the interface and
+//returns the reply on its signal, unpacked like a subscription result
+func (ac *agentConn) call(iface, slot, replySignal string, request []byte, timeout time.Duration, retries int) (*objects.Frame, error) {
+	f := ac.newFrame(objects.CmdCall)
+	f.AddHeader("uri", iface)
+	f.AddHeader("slot", slot)
+	if replySignal != "" {
+		f.AddHeader("replysignal", replySignal)
+	}
+	if timeout > 0 {
+		f.AddHeader("timeout", timeout.String())
+	}
+	f.AddHeader("retries", strconv.Itoa(retries))
+	if request != nil {
+		addPO(f, objects.PONumMsgPack, request)
+	}
+	return ac.transact(f)
+}
@@ -18,18 +18,20 @@
 package api
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"math/big"
 	"os"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
@@ -75,9 +77,33 @@ type PublishParams struct {
 	DoVerify           bool
 	Persist            bool
 	AutoChain          bool
+	//Fail the publish if a payload object is malformed, whatever the
+	//router's ValidatePayloads setting
+	ValidatePayloads bool
+	//Add a trace RO so that each router that handles the message appends
+	//a hop to it
+	Trace bool
+	//Add a timestamp signed by the router. It is always added if [router]
+	//TimestampMessages is set
+	Timestamp bool
+	//If not empty, the designated router delivers the message once however
+	//many times it is retried with this key on the same URI within its
+	//IdempotencyWindow, so that a publish or persist that timed out can be
+	//sent again safely. At most 64 bytes
+	IdempotencyKey string
+	//Deliver the message to at most this many subscribers (taps excepted),
+	//chosen at random. Zero delivers it to all of them
+	Consumers int
+	//With Consumers, a consumer that NACKs the message within this time
+	//has it delivered to another consumer instead
+	AckTimeout time.Duration
 }
 type PublishCallback func(err error)
 
+//PublishReportCallback is given the number of consumers the designated
+//router delivered the message to, or -1 if it did not say
+type PublishReportCallback func(err error, consumers int)
+
 func (c *BosswaveClient) checkAddOriginVK(m *core.Message) {
 	//Although the PAC may not be elaborated, we might be able to
 	//elaborate it some more here for our decision support
@@ -111,10 +137,35 @@ func (c *BosswaveClient) checkAddOriginVK(m *core.Message) {
 }
 func (c *BosswaveClient) Publish(params *PublishParams,
 	cb PublishCallback) {
+	c.PublishReport(params, func(err error, consumers int) {
+		cb(err)
+	})
+}
+
+//PublishReport is like Publish, but reports how many consumers the message
+//was delivered to
+func (c *BosswaveClient) PublishReport(params *PublishParams,
+	rcb PublishReportCallback) {
+	cb := func(err error) {
+		rcb(err, -1)
+	}
 	t := core.TypePublish
 	if params.Persist {
 		t = core.TypePersist
 	}
+	if err := c.bw.beginWork(); err != nil {
+		cb(err)
+		return
+	}
+	defer c.bw.endWork()
+	if err := c.checkPublishQuota(); err != nil {
+		cb(err)
+		return
+	}
+	if util.IsFreePath(params.URISuffix) && !c.mayWriteFreePath(params.MVK, params.URISuffix, params.Persist) {
+		cb(bwe.M(bwe.BadPermissions, "free paths are read-only"))
+		return
+	}
 	if err := c.doAutoChain(params.MVK, params.URISuffix, "P", params.AutoChain, &params.PrimaryAccessChain); err != nil {
 		cb(err)
 		return
@@ -124,9 +175,20 @@ func (c *BosswaveClient) Publish(params *PublishParams,
 		cb(err)
 		return
 	}
+	if params.Consumers < 0 || params.Consumers > 255 {
+		cb(bwe.M(bwe.BadOperation, "consumers must be between 0 and 255"))
+		return
+	}
+	m.Consumers = params.Consumers
 	m.PrimaryAccessChain = params.PrimaryAccessChain
 	m.RoutingObjects = params.RoutingObjects
 	m.PayloadObjects = params.PayloadObjects
+	if params.ValidatePayloads {
+		if err := ValidatePayloads(m); err != nil {
+			cb(err)
+			return
+		}
+	}
 	if err := c.doPAC(m, params.ElaboratePAC); err != nil {
 		cb(err)
 		return
@@ -141,8 +203,30 @@ func (c *BosswaveClient) Publish(params *PublishParams,
 	} else if params.Expiry != nil {
 		m.RoutingObjects = append(m.RoutingObjects, objects.CreateNewExpiry(*params.Expiry))
 	}
+	if params.Trace && !m.IsTraced() {
+		m.RoutingObjects = append(m.RoutingObjects, objects.CreateTrace())
+	}
+	if params.Consumers != 0 && params.AckTimeout > 0 {
+		m.RoutingObjects = append(m.RoutingObjects, objects.CreateConsumerAck(params.AckTimeout))
+	}
+	if params.IdempotencyKey != "" {
+		ik, err := objects.CreateIdempotencyKey(params.IdempotencyKey)
+		if err != nil {
+			cb(bwe.WrapM(bwe.BadOperation, "bad idempotency key", err))
+			return
+		}
+		m.RoutingObjects = append(m.RoutingObjects, ik)
+	}
+	if params.Timestamp || c.bw.Config.Router.TimestampMessages {
+		m.RoutingObjects = append(m.RoutingObjects, objects.CreateTimestamp(time.Now(), c.bw.Entity.GetSK(), c.bw.Entity.GetVK()))
+	}
 
 	c.finishMessage(m)
+	if err := c.bw.checkMessageSize(m); err != nil {
+		cb(err)
+		return
+	}
+	m = c.bw.traceHop(m, time.Time{})
 
 	if params.DoVerify {
 		//log.Info("verifying")
@@ -164,11 +248,139 @@ func (c *BosswaveClient) Publish(params *PublishParams,
 
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
-		if params.Persist {
-			c.cl.Persist(m)
-		} else {
-			c.cl.Publish(m)
+		if err := c.bw.checkPayloads(m); err != nil {
+			cb(err)
+			return
+		}
+		if err := c.bw.checkRateLimit(m, c.GetUs().GetVK()); err != nil {
+			cb(err)
+			return
 		}
+		if err := c.bw.checkNamespaceQuota(m, c.GetUs().GetVK()); err != nil {
+			cb(err)
+			return
+		}
+		consumers, fresh := c.bw.deliverOnce(c.cl, m)
+		if fresh {
+			c.bw.replicate(m)
+		}
+		rcb(nil, consumers)
+	} else { //Remote delivery
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			cb(bwe.WrapC(bwe.PeerError, err))
+			return
+		}
+		peer.PublishPipelined(m, rcb)
+	}
+}
+
+//mayWriteFreePath is true if the client may publish, or persist, on the
+//free path suffix: anyone may publish a chain build request, a requester
+//may persist its DOT request, and designated routers may write anything
+func (c *BosswaveClient) mayWriteFreePath(mvk []byte, suffix string, persist bool) bool {
+	if !persist && util.IsChainBuildRequest(suffix) {
+		return true
+	}
+	us := c.GetUs()
+	if us == nil {
+		return false
+	}
+	if persist && core.MayWriteDOTRequest(suffix, us.GetVK(), false) {
+		return true
+	}
+	return c.BW().CanWriteFreePath(mvk, us.GetVK())
+}
+
+//Nack tells the designated router that the message msgid, delivered on the
+//subscription subid, could not be processed. If it was published with an
+//AckTimeout that has not passed, it is delivered to another consumer, and
+//the callback is told if there was one
+func (c *BosswaveClient) Nack(msgid core.UniqueMessageID, subid core.UniqueMessageID,
+	cb func(redelivered bool, err error)) {
+	c.subsmu.Lock()
+	sub, ok := c.subs[subid]
+	var sm *core.Message
+	if ok {
+		sm, subid = sub.Msg, sub.UMid
+	}
+	c.subsmu.Unlock()
+	if !ok {
+		cb(false, bwe.M(bwe.BadOperation, "Subscription does not exist"))
+		return
+	}
+	if c.VerifyAffinity(sm) == nil { //Local delivery
+		cb(c.cl.Nack(msgid, subid))
+		return
+	}
+	peer, err := c.GetPeer(sm.MVK)
+	if err != nil {
+		cb(false, bwe.WrapC(bwe.PeerError, err))
+		return
+	}
+	peer.Nack(msgid, subid, cb)
+}
+
+type DeleteParams struct {
+	MVK                []byte
+	URISuffix          string
+	PrimaryAccessChain *objects.DChain
+	RoutingObjects     []objects.RoutingObject
+	Expiry             *time.Time
+	ExpiryDelta        *time.Duration
+	ElaboratePAC       int
+	DoVerify           bool
+	AutoChain          bool
+}
+
+//Delete removes the message persisted on a URI. The designated router
+//keeps a tombstone so that replicas do not bring the message back
+func (c *BosswaveClient) Delete(params *DeleteParams,
+	cb PublishCallback) {
+	if util.IsFreePath(params.URISuffix) &&
+		(c.GetUs() == nil || !core.MayWriteDOTRequest(params.URISuffix, c.GetUs().GetVK(), true)) {
+		cb(bwe.M(bwe.BadOperation, "free paths are read-only"))
+		return
+	}
+	if err := c.doAutoChain(params.MVK, params.URISuffix, "PL", params.AutoChain, &params.PrimaryAccessChain); err != nil {
+		cb(err)
+		return
+	}
+	m, err := c.newMessage(core.TypeDelete, params.MVK, params.URISuffix)
+	if err != nil {
+		cb(err)
+		return
+	}
+	m.PrimaryAccessChain = params.PrimaryAccessChain
+	m.RoutingObjects = params.RoutingObjects
+	if err := c.doPAC(m, params.ElaboratePAC); err != nil {
+		cb(err)
+		return
+	}
+	c.checkAddOriginVK(m)
+	if params.ExpiryDelta != nil {
+		m.RoutingObjects = append(m.RoutingObjects, objects.CreateNewExpiryFromNow(*params.ExpiryDelta))
+	} else if params.Expiry != nil {
+		m.RoutingObjects = append(m.RoutingObjects, objects.CreateNewExpiry(*params.Expiry))
+	}
+	c.finishMessage(m)
+
+	if params.DoVerify {
+		realm, err := core.LoadMessage(m.Encoded)
+		if err != nil {
+			cb(err)
+			return
+		}
+		if err = realm.Verify(c.BW()); err != nil {
+			cb(err)
+			return
+		}
+	}
+	err = c.VerifyAffinity(m)
+	if err == nil { //Local delivery
+		c.cl.Delete(m)
+		c.bw.replicate(m)
 		cb(nil)
 	} else { //Remote delivery
 		peer, err := c.GetPeer(m.MVK)
@@ -182,11 +394,11 @@ func (c *BosswaveClient) Publish(params *PublishParams,
 }
 
 func (c *BosswaveClient) VerifyAffinity(m *core.Message) error {
-	drvk, err := c.BW().LookupDesignatedRouter(m.MVK)
+	ok, err := c.BW().IsDesignatedRouterFor(m.MVK)
 	if err != nil {
 		return bwe.WrapM(bwe.AffinityMismatch, "error verifying affinity", err)
 	}
-	if bytes.Equal(c.BW().Entity.GetVK(), drvk) {
+	if ok {
 		return nil
 	} else {
 		return bwe.M(bwe.AffinityMismatch, "we are not the DR for this namespace")
@@ -203,6 +415,12 @@ type SubscribeParams struct {
 	ElaboratePAC       int
 	DoVerify           bool
 	AutoChain          bool
+	//Drop messages with malformed payload objects instead of delivering
+	//them
+	DropInvalid bool
+	//Have the designated router only deliver the messages that pass the
+	//filter, see objects.SubscriptionFilter
+	Filter *objects.SubscriptionFilter
 }
 type SubscribeInitialCallback func(err error, id core.UniqueMessageID)
 type SubscribeMessageCallback func(m *core.Message)
@@ -210,31 +428,101 @@ type SubscribeMessageCallback func(m *core.Message)
 func (c *BosswaveClient) Subscribe(params *SubscribeParams,
 	actionCB SubscribeInitialCallback,
 	messageCB SubscribeMessageCallback) {
+	c.subscribe(params, core.TypeSubscribe, actionCB, messageCB)
+}
+
+//Tap is like Subscribe, but requires T permissions instead of C. A tap
+//receives every message on the URI, including those published for a
+//limited number of consumers, without counting as one of them
+func (c *BosswaveClient) Tap(params *SubscribeParams,
+	actionCB SubscribeInitialCallback,
+	messageCB SubscribeMessageCallback) {
+	c.subscribe(params, core.TypeTap, actionCB, messageCB)
+}
+
+//consumePerms is the permission string a chain must grant to subscribe,
+//tap or query the suffix
+func consumePerms(mtype int, suffix string) string {
+	perms := "C"
+	if mtype == core.TypeTap || mtype == core.TypeTapQuery {
+		perms = "T"
+	}
+	if strings.Contains(suffix, "*") {
+		return perms + "*"
+	}
+	if strings.Contains(suffix, "+") {
+		return perms + "+"
+	}
+	return perms
+}
+
+func (c *BosswaveClient) subscribe(params *SubscribeParams, mtype int,
+	actionCB SubscribeInitialCallback,
+	messageCB SubscribeMessageCallback) {
+	c.doSubscribe(params, mtype, nil, actionCB, messageCB)
+}
+
+//doSubscribe subscribes, and registers the subscription under the ID the
+//router gives it. If replacing is not nil the new subscription takes its
+//place instead, keeping its ID, which is how a subscription's chain is
+//renewed. The caller then unsubscribes the old one from the router
+func (c *BosswaveClient) doSubscribe(params *SubscribeParams, mtype int, replacing *Subscription,
+	actionCB SubscribeInitialCallback,
+	messageCB SubscribeMessageCallback) {
+	if err := c.bw.checkAccepting(); err != nil {
+		actionCB(err, core.UniqueMessageID{})
+		return
+	}
+	if replacing == nil {
+		if err := c.checkSubscriptionQuota(); err != nil {
+			actionCB(err, core.UniqueMessageID{})
+			return
+		}
+	}
 	var m *core.Message
+	deliver := messageCB
+	autochained := params.AutoChain && params.PrimaryAccessChain == nil
 	regActionCB := func(err error, id core.UniqueMessageID) {
 		if err == nil {
 			c.subsmu.Lock()
-			c.subs[id] = &Subscription{
-				Msg:  m,
-				UMid: id,
+			if replacing == nil {
+				c.subs[id] = &Subscription{
+					Msg:         m,
+					UMid:        id,
+					key:         id,
+					params:      params,
+					mtype:       mtype,
+					deliver:     deliver,
+					autochained: autochained,
+				}
+			} else {
+				replacing.Msg = m
+				replacing.UMid = id
 			}
 			c.subsmu.Unlock()
 		}
 		actionCB(err, id)
 	}
-	var err error
-	perms := "C"
-	if strings.Contains(params.URISuffix, "+") {
-		perms = "C+"
+	if params.DropInvalid {
+		deliver := messageCB
+		messageCB = func(m *core.Message) {
+			if m != nil && ValidatePayloads(m) != nil {
+				return
+			}
+			deliver(m)
+		}
 	}
-	if strings.Contains(params.URISuffix, "*") {
-		perms = "C*"
+	deliverTraced := messageCB
+	messageCB = func(m *core.Message) {
+		deliverTraced(c.bw.traceHop(m, time.Time{}))
 	}
+	var err error
+	perms := consumePerms(mtype, params.URISuffix)
 	if err = c.doAutoChain(params.MVK, params.URISuffix, perms, params.AutoChain, &params.PrimaryAccessChain); err != nil {
 		actionCB(err, core.UniqueMessageID{})
 		return
 	}
-	m, err = c.newMessage(core.TypeSubscribe, params.MVK, params.URISuffix)
+	m, err = c.newMessage(mtype, params.MVK, params.URISuffix)
 	if err != nil {
 		actionCB(err, core.UniqueMessageID{})
 		return
@@ -251,6 +539,9 @@ func (c *BosswaveClient) Subscribe(params *SubscribeParams,
 	} else if params.Expiry != nil {
 		m.RoutingObjects = append(m.RoutingObjects, objects.CreateNewExpiry(*params.Expiry))
 	}
+	if params.Filter != nil {
+		m.RoutingObjects = append(m.RoutingObjects, params.Filter)
+	}
 	//Check if we need to add an origin VK header
 	c.checkAddOriginVK(m)
 	c.finishMessage(m)
@@ -272,6 +563,7 @@ func (c *BosswaveClient) Subscribe(params *SubscribeParams,
 
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
+		messageCB = c.bw.transformFor(m, messageCB)
 		subid := c.cl.Subscribe(c.ctx, m, func(m *core.Message) {
 			messageCB(m)
 		})
@@ -288,7 +580,6 @@ func (c *BosswaveClient) Subscribe(params *SubscribeParams,
 }
 
 func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(error)) {
-	var err error
 	c.subsmu.Lock()
 	sub, ok := c.subs[id]
 	c.subsmu.Unlock()
@@ -306,8 +597,16 @@ func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(erro
 		c.subsmu.Unlock()
 		actioncb(err)
 	}
+	c.subsmu.Lock()
+	m := sub.Msg
+	umid := sub.UMid
+	c.subsmu.Unlock()
+	c.sendUnsubscribe(m.MVK, m.TopicSuffix, umid, regActionCB)
+}
 
-	m, err := c.newMessage(core.TypeUnsubscribe, sub.Msg.MVK, sub.Msg.TopicSuffix)
+//sendUnsubscribe ends the subscription the router knows as umid
+func (c *BosswaveClient) sendUnsubscribe(mvk []byte, suffix string, umid core.UniqueMessageID, regActionCB func(error)) {
+	m, err := c.newMessage(core.TypeUnsubscribe, mvk, suffix)
 	if err != nil {
 		//So even though we fail, we deregister locally, so that
 		//messages coming from this subscription are ignored in future
@@ -319,7 +618,7 @@ func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(erro
 	m.RoutingObjects = append(m.RoutingObjects, ovk)
 	vk := c.GetUs().GetVK()
 	m.OriginVK = &vk
-	m.UnsubUMid = id
+	m.UnsubUMid = umid
 	c.finishMessage(m)
 	//Just for dev, no reason to do this
 	// err = m.Verify(c.BW())
@@ -354,6 +653,52 @@ type BuildChainParams struct {
 	URI         string
 	Status      *chan string
 	Permissions string
+	//The order the chains are emitted in. If nil, the client's policy is
+	//used
+	Policy *ChainPolicy
+	//If Publish is set, each chain is added to the registry from Account
+	//before it is emitted, so that others can reference it by hash. A chain
+	//that would cost more than MaxCost wei, if MaxCost is not nil, is
+	//emitted without being published. OnPublish, if not nil, is told what
+	//happened to each chain
+	Publish   bool
+	Account   int
+	MaxCost   *big.Int
+	OnPublish func(*ChainPublication)
+}
+
+//ChainPublication is what happened when a built chain was published
+type ChainPublication struct {
+	Chain *objects.DChain
+	//The estimated cost. Nil if the chain was in the registry already
+	Cost *bc.TxCost
+	//True if the cost was over the limit, so nothing was sent
+	TooExpensive bool
+	//The transaction, nil if none was sent
+	Result *bc.TxResult
+	Err    error
+}
+
+//publishChain estimates the cost of adding the chain to the registry and
+//adds it if that is no more than maxCost
+func (c *BosswaveClient) publishChain(ch *objects.DChain, acc int, maxCost *big.Int) *ChainPublication {
+	rv := &ChainPublication{Chain: ch}
+	bcc := c.BCC()
+	rv.Cost, rv.Err = bcc.EstimateAccessDChain(c.ctx, acc, ch)
+	if rv.Err != nil || rv.Cost == nil {
+		return rv
+	}
+	if maxCost != nil && rv.Cost.Total().Cmp(maxCost) > 0 {
+		rv.TooExpensive = true
+		return rv
+	}
+	done := make(chan struct{})
+	bcc.PublishAccessDChain(c.ctx, acc, ch, func(res *bc.TxResult, err error) {
+		rv.Result, rv.Err = res, err
+		close(done)
+	})
+	<-done
+	return rv
 }
 
 func (c *BosswaveClient) BuildChain(p *BuildChainParams) (chan *objects.DChain, error) {
@@ -372,21 +717,25 @@ func (c *BosswaveClient) BuildChain(p *BuildChainParams) (chan *objects.DChain,
 	} else {
 		status = *p.Status
 	}
-	parts := strings.SplitN(p.URI, "/", 2)
-	if len(parts) != 2 {
+	ns, suffix, err := util.SplitURI(p.URI)
+	if err != nil {
 		close(status)
-		return nil, bwe.M(bwe.BadURI, "Bad URI")
+		return nil, bwe.WrapC(bwe.BadURI, err)
 	}
-	rnsvk, err := c.BW().ResolveKey(parts[0])
+	rnsvk, err := c.BW().ResolveKey(ns)
 	if err != nil {
 		close(status)
 		return nil, err
 	}
-	cb := NewChainBuilder(c, crypto.FmtKey(rnsvk)+"/"+parts[1], p.Permissions, p.To, status)
+	cb := NewChainBuilder(c, util.FullURI(rnsvk, suffix), p.Permissions, p.To, status)
 	if cb == nil {
 		close(status)
 		return nil, bwe.M(bwe.BadChainBuildParams, "Could not construct CB: bad params")
 	}
+	policy := p.Policy
+	if policy == nil {
+		policy = c.GetChainPolicy()
+	}
 	rv := make(chan *objects.DChain)
 	go func() {
 		//We are going to change the chain builder to emit results on a channel later
@@ -397,7 +746,14 @@ func (c *BosswaveClient) BuildChain(p *BuildChainParams) (chan *objects.DChain,
 			close(rv)
 			return
 		}
+		chains = policy.Order(c.BW(), chains)
 		for _, ch := range chains {
+			if p.Publish {
+				pub := c.publishChain(ch, p.Account, p.MaxCost)
+				if p.OnPublish != nil {
+					p.OnPublish(pub)
+				}
+			}
 			rv <- ch
 		}
 		close(rv)
@@ -433,7 +789,15 @@ func (c *BosswaveClient) SetEntityObj(e *objects.Entity) error {
 		return bwe.M(bwe.InvalidSig, "Entity signature invalid")
 	}
 	c.ourvk = e
+	old := c.bcc
 	c.bcc = c.bchain.GetClient(e)
+	if old != nil {
+		//Keep the interaction params the client has already set
+		c.bcc.SetDefaultConfirmations(old.GetDefaultConfirmations())
+		c.bcc.SetDefaultTimeout(old.GetDefaultTimeout())
+		c.bcc.SetMaxGasPrice(old.GetMaxGasPrice())
+		c.bcc.SetRetryPolicy(old.GetRetryPolicy())
+	}
 	return nil
 }
 
@@ -447,27 +811,33 @@ type ListParams struct {
 	ElaboratePAC       int
 	DoVerify           bool
 	AutoChain          bool
+	//Depth is how many levels below the URI ListTree goes. Zero is
+	//unlimited. List ignores it
+	Depth int
 }
+
+//MaxListDepth is the largest depth ListTree accepts
+const MaxListDepth = 0xFFFF
+
 type ListInitialCallback func(err error)
 type ListResultCallback func(s string, ok bool)
 
-func (c *BosswaveClient) List(params *ListParams,
-	actionCB ListInitialCallback,
-	resultCB ListResultCallback) {
+//ListTreeResultCallback is called with nil after the last node
+type ListTreeResultCallback func(e *store.ListEntry)
+
+//newListMessage creates and checks the message for a List or ListTree
+func (c *BosswaveClient) newListMessage(params *ListParams) (*core.Message, error) {
 	if err := c.doAutoChain(params.MVK, params.URISuffix, "C", params.AutoChain, &params.PrimaryAccessChain); err != nil {
-		actionCB(err)
-		return
+		return nil, err
 	}
 	m, err := c.newMessage(core.TypeLS, params.MVK, params.URISuffix)
 	if err != nil {
-		actionCB(err)
-		return
+		return nil, err
 	}
 	m.PrimaryAccessChain = params.PrimaryAccessChain
 	m.RoutingObjects = params.RoutingObjects
 	if err := c.doPAC(m, params.ElaboratePAC); err != nil {
-		actionCB(err)
-		return
+		return nil, err
 	}
 	//Add expiry
 	if params.ExpiryDelta != nil {
@@ -487,16 +857,25 @@ func (c *BosswaveClient) List(params *ListParams,
 		realm, err := core.LoadMessage(enc)
 		if err != nil {
 			log.Info("verification (phase 1) failed")
-			actionCB(err)
-			return
+			return nil, err
 		}
 		err = realm.Verify(c.BW())
 		if err != nil {
 			log.Info("verification (phase 2) failed")
-			actionCB(err)
-			return
+			return nil, err
 		}
 	}
+	return m, nil
+}
+
+func (c *BosswaveClient) List(params *ListParams,
+	actionCB ListInitialCallback,
+	resultCB ListResultCallback) {
+	m, err := c.newListMessage(params)
+	if err != nil {
+		actionCB(err)
+		return
+	}
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
 		actionCB(nil)
@@ -512,6 +891,35 @@ func (c *BosswaveClient) List(params *ListParams,
 	}
 }
 
+//ListTree lists the nodes below the URI down to params.Depth levels, with
+//the number of children each has and whether it has a persisted message
+func (c *BosswaveClient) ListTree(params *ListParams,
+	actionCB ListInitialCallback,
+	resultCB ListTreeResultCallback) {
+	if params.Depth < 0 || params.Depth > MaxListDepth {
+		actionCB(bwe.M(bwe.BadOperation, "list depth out of range"))
+		return
+	}
+	m, err := c.newListMessage(params)
+	if err != nil {
+		actionCB(err)
+		return
+	}
+	err = c.VerifyAffinity(m)
+	if err == nil { //Local delivery
+		actionCB(nil)
+		c.cl.ListTree(m, params.Depth, resultCB)
+	} else { //Remote delivery
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			actionCB(bwe.WrapM(bwe.PeerError, "could not peer", err))
+			return
+		}
+		peer.ListTree(m, params.Depth, actionCB, resultCB)
+	}
+}
+
 type QueryParams struct {
 	MVK                []byte
 	URISuffix          string
@@ -529,20 +937,29 @@ type QueryResultCallback func(m *core.Message)
 func (c *BosswaveClient) Query(params *QueryParams,
 	actionCB QueryInitialCallback,
 	resultCB QueryResultCallback) {
-	if err := c.doAutoChain(params.MVK, params.URISuffix, "C", params.AutoChain, &params.PrimaryAccessChain); err != nil {
-		actionCB(err)
-		return
+	c.query(params, core.TypeQuery, actionCB, resultCB)
+}
+
+//TapQuery is like Query, but requires T permissions instead of C
+func (c *BosswaveClient) TapQuery(params *QueryParams,
+	actionCB QueryInitialCallback,
+	resultCB QueryResultCallback) {
+	c.query(params, core.TypeTapQuery, actionCB, resultCB)
+}
+
+//newQueryMessage creates and checks the message for a Query or TapQuery
+func (c *BosswaveClient) newQueryMessage(params *QueryParams, mtype int) (*core.Message, error) {
+	if err := c.doAutoChain(params.MVK, params.URISuffix, consumePerms(mtype, params.URISuffix), params.AutoChain, &params.PrimaryAccessChain); err != nil {
+		return nil, err
 	}
-	m, err := c.newMessage(core.TypeQuery, params.MVK, params.URISuffix)
+	m, err := c.newMessage(mtype, params.MVK, params.URISuffix)
 	if err != nil {
-		actionCB(err)
-		return
+		return nil, err
 	}
 	m.PrimaryAccessChain = params.PrimaryAccessChain
 	m.RoutingObjects = params.RoutingObjects
 	if err := c.doPAC(m, params.ElaboratePAC); err != nil {
-		actionCB(err)
-		return
+		return nil, err
 	}
 	//Add expiry
 	if params.ExpiryDelta != nil {
@@ -561,17 +978,25 @@ func (c *BosswaveClient) Query(params *QueryParams,
 		realm, err := core.LoadMessage(enc)
 		if err != nil {
 			log.Info("verification (phase 1) failed")
-			actionCB(err)
-			return
+			return nil, err
 		}
 		err = realm.Verify(c.BW())
 		if err != nil {
 			log.Info("verification (phase 2) failed")
-			actionCB(err)
-			return
+			return nil, err
 		}
 	}
+	return m, nil
+}
 
+func (c *BosswaveClient) query(params *QueryParams, mtype int,
+	actionCB QueryInitialCallback,
+	resultCB QueryResultCallback) {
+	m, err := c.newQueryMessage(params, mtype)
+	if err != nil {
+		actionCB(err)
+		return
+	}
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
 		actionCB(nil)
@@ -613,6 +1038,10 @@ type CreateDOTParams struct {
 	URISuffix         string
 	MVK               []byte
 	AccessPermissions string
+	PublishLimits     *objects.PublishLimits
+	//The permissions, as a permission string, that the receiver may not
+	//delegate further. Empty for none
+	NoDelegate string
 
 	//For Permissions
 	Permissions map[string]string
@@ -629,14 +1058,19 @@ func (c *BosswaveClient) CreateDOT(p *CreateDOTParams) (*objects.DOT, error) {
 	if state != StateValid {
 		return nil, bwe.M(bwe.InvalidEntity, "Cannot grant dot, source VK state: "+c.BW().StateToString(state))
 	}
-	_, state, err = c.BW().ResolveEntity(p.To)
-	if err != nil {
-		return nil, err
-	}
-	if state != StateValid {
-		return nil, bwe.M(bwe.InvalidEntity, "Cannot grant dot, destination VK state: "+c.BW().StateToString(state))
+	//Nobody holds the key of the everybody VK, so there is no entity to
+	//check
+	if !objects.IsEveryoneVK(p.To) {
+		_, state, err = c.BW().ResolveEntity(p.To)
+		if err != nil {
+			return nil, err
+		}
+		if state != StateValid {
+			return nil, bwe.M(bwe.InvalidEntity, "Cannot grant dot, destination VK state: "+c.BW().StateToString(state))
+		}
 	}
 	d := objects.CreateDOT(!p.IsPermission, c.GetUs().GetVK(), p.To)
+	d.SetSigAlgorithm(c.GetUs().GetSigAlgorithm())
 	d.SetTTL(int(p.TTL))
 	d.SetContact(p.Contact)
 	d.SetComment(p.Comment)
@@ -663,11 +1097,74 @@ func (c *BosswaveClient) CreateDOT(p *CreateDOTParams) (*objects.DOT, error) {
 		if !d.SetPermString(p.AccessPermissions) {
 			return nil, bwe.M(bwe.BadPermissions, "Permission string is invalid")
 		}
+		d.SetPublishLimits(p.PublishLimits)
+		if p.NoDelegate != "" {
+			nd := objects.GetADPSFromPermString(p.NoDelegate)
+			if nd == nil {
+				return nil, bwe.M(bwe.BadPermissions, "Delegation permission string is invalid")
+			}
+			d.SetNoDelegate(nd)
+		}
 	}
 	d.Encode(c.GetUs().GetSK())
 	return d, nil
 }
 
+//CreatePublicDOTParams describes a DOT that lets everybody read a URI
+type CreatePublicDOTParams struct {
+	//The URI, which may have wildcards. Its namespace may be an alias
+	URI         string
+	Expiry      *time.Time
+	ExpiryDelta *time.Duration
+	Contact     string
+	Comment     string
+	Revokers    [][]byte
+	//Also let everybody tap the URI
+	Tap bool
+}
+
+//CreatePublicDOT creates an access DOT from the client's entity to the
+//everybody VK, granting consume (and optionally tap) on the URI. The
+//client needs those permissions on the URI itself for the DOT to be useful.
+//Chains that end in it are used by BuildChain and AutoChain when there is
+//no direct grant. Messages sent with such a chain must carry an origin VK
+//RO, which this client adds
+func (c *BosswaveClient) CreatePublicDOT(p *CreatePublicDOTParams) (*objects.DOT, error) {
+	if c.GetUs() == nil {
+		return nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	ns, suffix, err := util.SplitURI(p.URI)
+	if err != nil {
+		return nil, bwe.WrapC(bwe.BadURI, err)
+	}
+	mvk, err := c.BW().ResolveKey(ns)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err)
+	}
+	return c.CreateDOT(&CreateDOTParams{
+		To:                util.EverybodySlice,
+		Expiry:            p.Expiry,
+		ExpiryDelta:       p.ExpiryDelta,
+		Contact:           p.Contact,
+		Comment:           p.Comment,
+		Revokers:          p.Revokers,
+		URISuffix:         suffix,
+		MVK:               mvk,
+		AccessPermissions: PublicPermissions(suffix, p.Tap),
+	})
+}
+
+//PublicPermissions is the permission string of a DOT that lets everybody
+//read the URI suffix, with the wildcards it needs
+func PublicPermissions(suffix string, tap bool) string {
+	perms := consumePerms(core.TypeSubscribe, suffix)
+	if tap {
+		wildcard := strings.TrimPrefix(perms, "C")
+		perms = "C" + wildcard + "T" + wildcard
+	}
+	return perms
+}
+
 type CreateDotChainParams struct {
 	DOTs         []*objects.DOT
 	IsPermission bool
@@ -695,10 +1192,41 @@ type CreateEntityParams struct {
 	Comment          string
 	Revokers         [][]byte
 	OmitCreationDate bool
+	//If set, the entity uses this keypair instead of a new random one
+	SK []byte
+	VK []byte
+	//A long alias to point at the entity's VK once it is published. It is
+	//only checked here: whoever publishes the entity creates the alias,
+	//as bw2 mkentity --alias does
+	Alias string
+}
+
+//CheckLongAliasKey returns an error if key cannot be a long alias
+func CheckLongAliasKey(key string) error {
+	if key == "" || len(key) > 32 {
+		return bwe.M(bwe.BadOperation, "a long alias must be 1 to 32 bytes")
+	}
+	if strings.Contains(key, "@") {
+		return bwe.M(bwe.BadOperation, "a long alias cannot contain '@'")
+	}
+	return nil
 }
 
 func CreateEntity(p *CreateEntityParams) (*objects.Entity, error) {
-	e := objects.CreateNewEntity(p.Contact, p.Comment, p.Revokers)
+	if p.Alias != "" {
+		if err := CheckLongAliasKey(p.Alias); err != nil {
+			return nil, err
+		}
+	}
+	var e *objects.Entity
+	if len(p.SK) != 0 {
+		if len(p.SK) != 32 || len(p.VK) != 32 {
+			return nil, bwe.M(bwe.BadOperation, "bad keypair for entity")
+		}
+		e = objects.CreateNewEntityWithKeypair(p.Contact, p.Comment, p.Revokers, p.SK, p.VK)
+	} else {
+		e = objects.CreateNewEntity(p.Contact, p.Comment, p.Revokers)
+	}
 	if p.ExpiryDelta != nil {
 		e.SetExpiry(time.Now().Add(*p.ExpiryDelta))
 	} else if p.Expiry != nil {
@@ -718,26 +1246,27 @@ func (c *BosswaveClient) doPAC(m *core.Message, elaboratePAC int) error {
 		if m.PrimaryAccessChain == nil {
 			return bwe.M(bwe.Unresolvable, "No primary access chain found, cannot elaborate")
 		}
-		if !m.PrimaryAccessChain.IsElaborated() {
-			dc := core.ElaborateDChain(m.PrimaryAccessChain, c.BW())
+		dc := m.PrimaryAccessChain
+		if !dc.IsElaborated() {
+			dc = core.ElaborateDChain(m.PrimaryAccessChain, c.BW())
 			if dc == nil {
 				return bwe.M(bwe.Unresolvable, "Could not resolve PAC")
 			}
 			m.RoutingObjects = append(m.RoutingObjects, dc)
 		}
 		if elaboratePAC > PartialElaboration {
-			return bwe.M(bwe.BadOperation, "We don't support full elaboration anymore")
-			//
-			// ok := core.ResolveDotsInDChain(m.PrimaryAccessChain, m.RoutingObjects, c.BW())
-			// if !ok {
-			// 	return bwe.M(bwe.Unresolvable, "dot in PAC unresolvable")
-			// }
-			// for i := 0; i < m.PrimaryAccessChain.NumHashes(); i++ {
-			// 	d := m.PrimaryAccessChain.GetDOT(i)
-			// 	if d != nil {
-			// 		m.RoutingObjects = append(m.RoutingObjects, d)
-			// 	}
-			// }
+			//Carry the DOTs too, so the router need not resolve them to
+			//check the chain (see core.ResolveDotsInDChain)
+			for i := 0; i < dc.NumHashes(); i++ {
+				d := dc.GetDOT(i)
+				if d == nil {
+					d, _, _ = c.BW().ResolveDOT(dc.GetDotHash(i))
+				}
+				if d == nil {
+					return bwe.M(bwe.Unresolvable, "dot in PAC unresolvable")
+				}
+				m.RoutingObjects = append(m.RoutingObjects, d)
+			}
 		}
 	} else if m.PrimaryAccessChain != nil {
 		m.PrimaryAccessChain.UnElaborate()
@@ -746,10 +1275,33 @@ func (c *BosswaveClient) doPAC(m *core.Message, elaboratePAC int) error {
 	if m.PrimaryAccessChain != nil {
 		m.RoutingObjects = append(m.RoutingObjects, m.PrimaryAccessChain)
 	}
-	//TODO remove duplicates in the routing objects, but preserve order.
+	m.RoutingObjects = dedupRoutingObjects(m.RoutingObjects)
 	return nil
 }
 
+//dedupRoutingObjects drops the routing objects that have the same number
+//and content as an earlier one, keeping the order of the rest. The primary
+//access chain of a message is its first access chain, so whichever copy of
+//it is kept, the same chain stays primary. The slice is not modified, as
+//it may be the caller's
+func dedupRoutingObjects(ros []objects.RoutingObject) []objects.RoutingObject {
+	type roKey struct {
+		ronum   int
+		content string
+	}
+	seen := make(map[roKey]bool, len(ros))
+	rv := make([]objects.RoutingObject, 0, len(ros))
+	for _, ro := range ros {
+		k := roKey{ro.GetRONum(), string(ro.GetContent())}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rv = append(rv, ro)
+	}
+	return rv
+}
+
 func (c *BosswaveClient) getMid() uint64 {
 	mid := atomic.AddUint64(&c.mid, 1)
 	return mid
@@ -767,12 +1319,12 @@ func (c *BosswaveClient) newMessage(mtype int, mvk []byte, urisuffix string) (*c
 		PayloadObjects: []objects.PayloadObject{},
 		OriginVK:       &ovk,
 		MessageID:      c.getMid()}
-	valid, star, plus, _ := util.AnalyzeSuffix(urisuffix)
-	if !valid {
-		return nil, bwe.M(bwe.BadURI, "invalid URI")
+	star, plus, _, uerr := util.AnalyzeSuffixDetailed(urisuffix)
+	if uerr != nil {
+		return nil, bwe.WrapC(bwe.BadURI, uerr)
 	} else if len(mvk) != 32 {
 		return nil, bwe.M(bwe.BadURI, "bad MVK")
-	} else if (star || plus) && (mtype == core.TypePublish || mtype == core.TypePersist) {
+	} else if (star || plus) && (mtype == core.TypePublish || mtype == core.TypePersist || mtype == core.TypeDelete) {
 		return nil, bwe.M(bwe.BadOperation, "bad OP with wildcard")
 	}
 	return &m, nil
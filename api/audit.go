@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//AuditURIPrefix is the subtree denied operations are persisted under when
+//[audit] Persist is set. The last denial of each origin VK on a namespace
+//is at ns/!audit/<hex origin vk>
+const AuditURIPrefix = "!audit"
+
+//DefaultAuditMaxPerMinute is used if [audit] MaxPerMinute is not set
+const DefaultAuditMaxPerMinute = 600
+
+//Decisions in audit records
+const (
+	AuditDenied    = "denied"
+	AuditDelivered = "delivered"
+)
+
+//AuditRecord describes a message that failed verification
+type AuditRecord struct {
+	//In nanoseconds since the epoch
+	Time int64 `msgpack:"time"`
+	//AuditDenied, or AuditDelivered if the [verify] policy let the
+	//failure through
+	Decision  string `msgpack:"decision"`
+	Code      int    `msgpack:"code"`
+	Reason    string `msgpack:"reason"`
+	Type      string `msgpack:"type"`
+	URI       string `msgpack:"uri"`
+	OriginVK  string `msgpack:"originvk"`
+	ChainHash string `msgpack:"chainhash"`
+}
+
+var messageTypeNames = map[uint8]string{
+	core.TypePublish:     "publish",
+	core.TypePersist:     "persist",
+	core.TypeSubscribe:   "subscribe",
+	core.TypeTap:         "tap",
+	core.TypeQuery:       "query",
+	core.TypeTapQuery:    "tapquery",
+	core.TypeLS:          "list",
+	core.TypeUnsubscribe: "unsubscribe",
+	core.TypeDelete:      "delete",
+}
+
+//auditor samples and records denied operations
+type auditor struct {
+	mu     sync.Mutex
+	seen   uint64
+	window time.Time
+	count  int
+	cl     *BosswaveClient
+}
+
+//sample decides if the nth denial is recorded: one in every sample, and no
+//more than max in a minute. A max of zero or less means no cap
+func (a *auditor) sample(sample int, max int, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seen++
+	if sample > 1 && a.seen%uint64(sample) != 1 {
+		return false
+	}
+	if now.Sub(a.window) >= time.Minute {
+		a.window = now
+		a.count = 0
+	}
+	if max > 0 && a.count >= max {
+		return false
+	}
+	a.count++
+	return true
+}
+
+//auditDenied records a message that failed verification, subject to the
+//[audit] sampling settings
+func (bw *BW) auditDenied(m *core.Message, err error) {
+	bw.auditMessage(m, err, AuditDenied)
+}
+
+//auditWaived records a message that was delivered although it failed a
+//check that the [verify] policy waived
+func (bw *BW) auditWaived(m *core.Message) {
+	if m.Waived != nil {
+		bw.auditMessage(m, m.Waived, AuditDelivered)
+	}
+}
+
+func (bw *BW) auditMessage(m *core.Message, err error, decision string) {
+	cfg := bw.Config.Audit
+	max := cfg.MaxPerMinute
+	if max == 0 {
+		max = DefaultAuditMaxPerMinute
+	}
+	now := time.Now()
+	if !bw.audit.sample(cfg.Sample, max, now) {
+		return
+	}
+	bws := bwe.AsBW(err)
+	rec := &AuditRecord{
+		Time:     now.UnixNano(),
+		Decision: decision,
+		Code:     bws.Code,
+		Reason:   bws.Msg,
+		Type:     messageTypeNames[m.Type],
+		URI:      crypto.FmtKey(m.MVK) + "/" + m.TopicSuffix,
+	}
+	if m.OriginVK != nil {
+		rec.OriginVK = crypto.FmtKey(*m.OriginVK)
+	}
+	if m.PrimaryAccessChain != nil {
+		rec.ChainHash = crypto.FmtHash(m.PrimaryAccessChain.GetChainHash())
+	}
+	log.Warnf("audit: %s code=%d type=%s uri=%s origin=%s chain=%s reason=%q",
+		rec.Decision, rec.Code, rec.Type, rec.URI, rec.OriginVK, rec.ChainHash, rec.Reason)
+	if cfg.Persist && m.OriginVK != nil {
+		bw.persistAudit(m.MVK, *m.OriginVK, rec)
+	}
+}
+
+//VerifyPolicy is the [verify] section of the config, which relaxes the
+//checks messages verified against the router get
+func (bw *BW) VerifyPolicy() core.VerifyPolicy {
+	return bw.Config.Verify
+}
+
+//persistAudit persists a record with the router entity, which needs P on
+//ns/!audit/*
+func (bw *BW) persistAudit(mvk []byte, ovk []byte, rec *AuditRecord) {
+	bw.audit.mu.Lock()
+	if bw.audit.cl == nil {
+		bw.audit.cl = bw.CreateClient(context.Background(), "AUDIT")
+		if err := bw.audit.cl.SetEntityObj(bw.Entity); err != nil {
+			log.Errorf("audit: could not use router entity: %v", err)
+		}
+	}
+	cl := bw.audit.cl
+	bw.audit.mu.Unlock()
+	blob, err := msgpack.Marshal(rec)
+	if err != nil {
+		log.Errorf("audit: could not encode record: %v", err)
+		return
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	suffix := AuditURIPrefix + "/" + hex.EncodeToString(ovk)
+	go cl.Publish(&PublishParams{
+		MVK:            mvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+		Persist:        true,
+		AutoChain:      true,
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("audit: could not persist %s: %v", suffix, err)
+		}
+	})
+}
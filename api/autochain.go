@@ -5,10 +5,20 @@ import (
 
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
 )
 
+//doAutoChain builds the primary access chain for a message if autochain is
+//set and the caller did not give a chain. The chain builder consults the
+//resolution cache, so repeated messages on a URI do not rebuild the chain.
+//Of the chains found, the best under the client's ChainPolicy is used, and
+//it is rebuilt before it expires (see refreshChains). Free paths need no
+//chain
 func (c *BosswaveClient) doAutoChain(mvk []byte, suffix string, perms string, autochain bool, ppac **objects.DChain) error {
+	if !autochain || *ppac != nil || util.IsFreePath(suffix) {
+		return nil
+	}
 	if c.GetUs() == nil {
 		return bwe.M(bwe.NoEntity, "No entity set")
 	}
@@ -18,9 +28,7 @@ func (c *BosswaveClient) doAutoChain(mvk []byte, suffix string, perms string, au
 		Status:      nil,
 		Permissions: perms,
 	})
-
 	if err != nil {
-		fmt.Println("hit err1")
 		return err
 	}
 	realpac := <-ch
@@ -30,11 +38,12 @@ func (c *BosswaveClient) doAutoChain(mvk []byte, suffix string, perms string, au
 		}
 	}()
 
-	//even if nil
+	if realpac == nil {
+		return bwe.M(bwe.ChainBuildFailed, fmt.Sprintf("No chain grants %s on %s/%s", perms, crypto.FmtKey(mvk), suffix))
+	}
+	c.noteUsedChain(chainKey(mvk, suffix, perms, c.GetUs().GetVK()), realpac)
 	*ppac = realpac
 	return nil
-
-	//TODO real all the chains and choose the 'best' one (include checking for stars)
 }
 
 // 	panic(bwe.C(bwe.NoEntity))
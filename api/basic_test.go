@@ -0,0 +1,211 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//The end to end tests run on the in-memory router of bw2test, which
+//imports api, so they live in the external test package
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/bw2test"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+)
+
+func TestBasicX(t *testing.T) {
+	r, err := bw2test.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	//Create the three entities in this test. E1 is publishing to namespace
+	//E2 is subscribing to namespace
+	e1, err := r.NewEntity("contact1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := r.NewEntity("contact2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespace, err := r.NewEntity("contact3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client1, err := r.Client(e1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := r.Client(e2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mvk := namespace.GetVK()
+
+	dToE1, err := r.Grant(namespace, e1.GetVK(), r.URI(namespace, "a/*"), "P")
+	if err != nil {
+		t.Fatalf("dot1: %v", err)
+	}
+	dToE2, err := r.Grant(namespace, e2.GetVK(), r.URI(namespace, "a/*"), "C*")
+	if err != nil {
+		t.Fatalf("dot2: %v", err)
+	}
+	dcE1, err := client1.BosswaveClient.CreateDOTChain(&api.CreateDotChainParams{
+		DOTs: []*objects.DOT{dToE1},
+	})
+	if err != nil {
+		t.Fatalf("chain1: %v", err)
+	}
+	dcE2, err := client1.BosswaveClient.CreateDOTChain(&api.CreateDotChainParams{
+		DOTs: []*objects.DOT{dToE2},
+	})
+	if err != nil {
+		t.Fatalf("chain2: %v", err)
+	}
+
+	gm := make(chan bool, 2)
+	client2.BosswaveClient.Subscribe(&api.SubscribeParams{
+		MVK:                mvk,
+		URISuffix:          "a/b/c",
+		PrimaryAccessChain: dcE2,
+		ElaboratePAC:       api.FullElaboration,
+		DoVerify:           true,
+	},
+		func(err error, subid core.UniqueMessageID) {
+			if err != nil {
+				t.Logf("subscribe: %v", err)
+				gm <- false
+				return
+			}
+			client1.BosswaveClient.Publish(&api.PublishParams{
+				MVK:                mvk,
+				URISuffix:          "a/b/c",
+				PrimaryAccessChain: dcE1,
+				ElaboratePAC:       api.FullElaboration,
+				DoVerify:           true,
+			},
+				func(err error) {
+					if err != nil {
+						t.Logf("publish: %v", err)
+						gm <- false
+					}
+				})
+		},
+		func(m *core.Message) {
+			gm <- true
+		})
+
+	//Check if the test passed or we timed out
+	select {
+	case direct := <-gm:
+		if !direct {
+			t.FailNow()
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestAliasManagement(t *testing.T) {
+	r, err := bw2test.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	owner, err := r.NewEntity("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := r.NewEntity("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocl, err := r.Client(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xcl, err := r.Client(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obcc, xbcc := ocl.BosswaveClient.BCC(), xcl.BosswaveClient.BCC()
+	ownerAddr, _ := obcc.GetAddress(0)
+	otherAddr, _ := xbcc.GetAddress(0)
+	v1 := bc.SliceToBytes32([]byte("first"))
+	v2 := bc.SliceToBytes32([]byte("second"))
+	key := bc.SliceToBytes32([]byte("managed.alias"))
+	op := func(f func(confirmed func(err error))) error {
+		done := make(chan error, 1)
+		f(func(err error) { done <- err })
+		return <-done
+	}
+	resolves := func(want bc.Bytes32) {
+		t.Helper()
+		v, err := r.BW.ResolveLongAlias("managed.alias")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if !bytes.Equal(v, want[:]) {
+			t.Fatalf("alias resolves to %q, want %q", v, want[:])
+		}
+	}
+
+	if err := op(func(cb func(error)) { obcc.SetAlias(context.Background(), 0, key, v1, cb) }); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	resolves(v1)
+	if err := op(func(cb func(error)) { xbcc.UpdateAlias(context.Background(), 0, key, v2, cb) }); err == nil {
+		t.Fatal("an account that does not own the alias updated it")
+	}
+	if err := op(func(cb func(error)) { obcc.UpdateAlias(context.Background(), 0, key, v2, cb) }); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	//The cached value and reverse lookups must follow the update
+	resolves(v2)
+	if recs, _ := r.BW.FindAliasesFor(v1[:]); len(recs) != 0 {
+		t.Fatalf("the old value still has %d aliases", len(recs))
+	}
+	if recs, _ := r.BW.FindAliasesFor(v2[:]); len(recs) != 1 || recs[0].Key != key {
+		t.Fatalf("the new value has aliases %v", recs)
+	}
+
+	recs, err := r.BW.FindAliasesOwnedBy([]bc.Address{ownerAddr})
+	if err != nil || len(recs) != 1 || recs[0].Owner != ownerAddr || recs[0].Value != v2 {
+		t.Fatalf("owned aliases: %v %v", recs, err)
+	}
+	if err := op(func(cb func(error)) { obcc.TransferAlias(context.Background(), 0, key, otherAddr, cb) }); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if recs, _ := r.BW.FindAliasesOwnedBy([]bc.Address{ownerAddr}); len(recs) != 0 {
+		t.Fatal("the old owner still owns the alias")
+	}
+	if err := op(func(cb func(error)) { obcc.DeleteAlias(context.Background(), 0, key, cb) }); err == nil {
+		t.Fatal("the old owner deleted the alias")
+	}
+	if err := op(func(cb func(error)) { xbcc.DeleteAlias(context.Background(), 0, key, cb) }); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := r.BW.ResolveLongAlias("managed.alias"); err == nil {
+		t.Fatal("the deleted alias still resolves")
+	}
+}
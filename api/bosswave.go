@@ -21,18 +21,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
+	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
 	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
 	"github.com/immesys/bw2bc/common"
 )
 
@@ -47,6 +52,34 @@ type BW struct {
 	Entity *objects.Entity
 	bchain bc.BlockChainProvider
 	rdata  *ResolutionData
+	drmon  *drMonitor
+	repl   *replicator
+	vhost  *viewHost
+	//per origin VK and per DOT message rates
+	ratelim *rateLimiter
+	audit   auditor
+	//signalled when DOTs or entities are revoked or expire
+	recheck     chan struct{}
+	chainEvents chainEventHub
+	clients     clientRegistry
+	//namespaces discovered through DNS
+	dns *dnsCache
+	//routers found on the local network with mDNS
+	local *localRouters
+	//draining and stopping
+	life *lifecycle
+	//hot standby replication of the store
+	standby *standby
+	//revocations of temporary credentials waiting to be published
+	temprevs *tempRevocations
+	//[transform] rules for subscribers lacking a permission
+	transforms *transforms
+	//in-router services
+	drivers *driverHost
+	//recurring publishes
+	schedules *schedules
+	//idempotency keys of recent publishes
+	idempotency idempotency
 }
 
 func (bw *BW) BC() bc.BlockChainProvider {
@@ -57,42 +90,75 @@ func (bw *BW) BC() bc.BlockChainProvider {
 const defaultMaxAge = 120
 
 // OpenBWContext will create a new Bosswave context and initialise the
-// daemons specified in the configuration file
+// daemons specified in the configuration file. It exits the process if the
+// router cannot be started
 func OpenBWContext(config *core.BWConfig) (*BW, chan bool) {
 	if config == nil {
 		config = core.LoadConfig("")
 	}
-	rv := &BW{Config: config,
-		tm: core.CreateTerminus(),
-		//dotcache:   make(map[bc.Bytes32]map[bc.Bytes32][]bc.Bytes32),
-		rdata: newResolutionData(),
+	rv, bcShutdown, err := NewBWContext(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	return rv, bcShutdown
+}
+
+// NewBWContext is like OpenBWContext but returns an error if the router
+// entity or configuration is bad. The store and the chain are per process,
+// so only one context can be created
+func NewBWContext(config *core.BWConfig) (*BW, chan bool, error) {
+	rv := newBW(config)
 	entcontents, err := ioutil.ReadFile(config.Router.Entity)
 	if err != nil {
-		fmt.Println("Could not load router entity:", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("Could not load router entity: %v", err)
+	}
+	if len(entcontents) == 0 {
+		return nil, nil, fmt.Errorf("Could not load router entity: empty file")
 	}
-	enti, err := objects.NewEntity(int(entcontents[0]), entcontents[1:])
+	kf, err := objects.DecodeKeyFile(entcontents, []byte(os.Getenv(objects.KeyFilePassphraseEnv)))
 	if err != nil {
-		fmt.Println("Could not load router entity:", err)
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("Could not load router entity: %v", err)
+	}
+	enti, err := objects.NewEntity(kf.RONum, kf.Content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not load router entity: %v", err)
 	}
 	ent, ok := enti.(*objects.Entity)
 	if !ok {
-		fmt.Println("Could not load router entity: bad file")
-		os.Exit(1)
+		return nil, nil, fmt.Errorf("Could not load router entity: bad file")
+	}
+	if config.IsThin() {
+		return newThinBWContext(rv, ent)
 	}
 	ben := common.HexToAddress(config.Mining.Benificiary)
 	if (ben == common.Address{}) {
-		panic("Invalid mining benificiary")
+		return nil, nil, fmt.Errorf("Invalid mining benificiary")
 	}
-	store.Initialize(config.Router.DB)
+	store.InitializeBackend(config.Router.DBBackend, config.Router.DB)
 	rv.Entity = ent
 	//In future we can add our own on-shutdown logic here. For now
 	//only the BC has shutdown tasks
 	var bcShutdown chan bool
+	datadir := path.Join(config.Router.DB, "bw2bc")
+	var private *bc.PrivateChain
+	if config.PrivateChain.Genesis != "" {
+		//Keep the private chain apart from any public chain in the same DB
+		datadir = path.Join(config.Router.DB, "bw2privatebc")
+		private = &bc.PrivateChain{
+			GenesisFile: config.PrivateChain.Genesis,
+			ChainID:     uint64(config.PrivateChain.ChainID),
+			NetworkID:   uint64(config.PrivateChain.NetworkID),
+			DevMiner:    config.PrivateChain.DevMiner,
+		}
+		for _, bn := range strings.Split(config.PrivateChain.BootNodes, ",") {
+			if bn = strings.TrimSpace(bn); bn != "" {
+				private.BootNodes = append(private.BootNodes, bn)
+			}
+		}
+	}
 	rv.bchain, bcShutdown = bc.NewBlockChain(bc.NBCParams{
-		Datadir:           path.Join(config.Router.DB, "bw2bc"),
+		Datadir:           datadir,
 		MaxLightPeers:     config.Altruism.MaxLightPeers,
 		MaxLightResources: config.Altruism.MaxLightResourcePercentage,
 		IsLight:           config.P2P.IAmLight,
@@ -102,9 +168,81 @@ func OpenBWContext(config *core.BWConfig) (*BW, chan bool) {
 		MinerThreads:      config.Mining.Threads,
 		ExternalAddr:      config.P2P.ExternalIP,
 		ListenPort:        config.P2P.Port,
+		Private:           private,
+		StallTimeout:      time.Duration(config.P2P.SyncStallTimeout) * time.Second,
+		OnStall:           rv.chainStalled,
 	})
-	rv.startResolutionServices()
-	return rv, bcShutdown
+	if err := rv.configureContracts(); err != nil {
+		rv.bchain.Shutdown()
+		return nil, nil, err
+	}
+	go rv.checkContractsWhenSynced()
+	rv.loadCacheCheckpoint()
+	rv.start()
+	return rv, bcShutdown, nil
+}
+
+// NewBWContextWithChain creates a context on a chain provided by the caller,
+// such as the in-memory chain of the bw2test package, with ent as the router
+// entity. The contracts are not configured or checked. Like NewBWContext, the
+// store is opened from the config and is shared by the whole process
+func NewBWContextWithChain(config *core.BWConfig, ent *objects.Entity, bchain bc.BlockChainProvider) *BW {
+	rv := newBW(config)
+	store.InitializeBackend(config.Router.DBBackend, config.Router.DB)
+	rv.Entity = ent
+	rv.bchain = bchain
+	rv.start()
+	return rv
+}
+
+//newThinBWContext starts a router with the thin profile, which has no
+//chain node and so no contracts to configure or check
+func newThinBWContext(rv *BW, ent *objects.Entity) (*BW, chan bool, error) {
+	bchain, bcShutdown, err := newThinChain(rv.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	store.InitializeBackend(rv.Config.Router.DBBackend, rv.Config.Router.DB)
+	rv.Entity = ent
+	rv.bchain = bchain
+	log.Infof("thin profile: resolving through the registry at %s", rv.Config.Thin.Registry)
+	rv.loadCacheCheckpoint()
+	rv.start()
+	return rv, bcShutdown, nil
+}
+
+func newBW(config *core.BWConfig) *BW {
+	objects.ClockSkew = time.Duration(config.Router.ClockSkew) * time.Second
+	return &BW{Config: config,
+		tm: core.CreateTerminus(),
+		//dotcache:   make(map[bc.Bytes32]map[bc.Bytes32][]bc.Bytes32),
+		rdata:     newResolutionData(),
+		drmon:     &drMonitor{},
+		repl:      &replicator{},
+		vhost:     newViewHost(),
+		ratelim:   newRateLimiter(),
+		recheck:   make(chan struct{}, 1),
+		dns:       newDNSCache(),
+		local:     &localRouters{routers: make(map[bc.Bytes32]LocalRouter)},
+		life:      newLifecycle(),
+		standby:   &standby{},
+		temprevs:  &tempRevocations{},
+		drivers:   &driverHost{},
+		schedules: &schedules{entries: make(map[string]*scheduleEntry), clients: make(map[string]*BosswaveClient)},
+	}
+}
+
+//start starts the resolution services once the chain is up
+func (bw *BW) start() {
+	bw.setCacheLimits()
+	bw.startTransforms()
+	bw.startResolutionServices()
+	go bw.recheckSubscriptionsLoop()
+	go bw.tm.ScanPersisted()
+	go bw.discoverConfiguredDomains()
+	bw.startMDNS()
+	go bw.runTempRevocations()
+	go bw.runSchedules()
 }
 
 func (cl *BosswaveClient) BW() *BW {
@@ -114,6 +252,8 @@ func (cl *BosswaveClient) BW() *BW {
 // BosswaveClient represents an individual client. It contains the
 // handle to the terminus client that contains the message queue
 type BosswaveClient struct {
+	//Messages published, first for 64 bit alignment
+	published uint64
 	//MessageFactory stuff
 	mid   uint64
 	ourvk *objects.Entity
@@ -138,11 +278,40 @@ type BosswaveClient struct {
 
 	subs   map[core.UniqueMessageID]*Subscription
 	subsmu sync.Mutex
+
+	policy   *ChainPolicy
+	policymu sync.Mutex
+
+	//The chains autochained messages used, to be rebuilt before they expire
+	usedchains   map[CacheKey]*usedChain
+	usedchainsmu sync.Mutex
+
+	id        uint64
+	name      string
+	connected time.Time
+	quota     ClientQuota
+	//The client's share of the built chain cache. It only holds keys
+	chainLRU *cacheLRU
+	quotamu  sync.Mutex
+
+	//The connection of a peer session, nil for other clients
+	peerConn net.Conn
+	//The run of the in-router service the client was made for, nil for
+	//other clients
+	driver *driverRun
 }
 
 type Subscription struct {
-	Msg  *core.Message
+	Msg *core.Message
+	//The ID the router knows the subscription by. It changes when the
+	//subscription is renewed with a new chain, the key in subs does not
 	UMid core.UniqueMessageID
+
+	key         core.UniqueMessageID
+	params      *SubscribeParams
+	mtype       int
+	deliver     SubscribeMessageCallback
+	autochained bool
 }
 
 func (cl *BosswaveClient) registerView(v *View) int {
@@ -187,9 +356,18 @@ func (bw *BW) CreateClient(pctx context.Context, name string) *BosswaveClient {
 		maxage: defaultMaxAge,
 		views:  make(map[int]*View),
 		subs:   make(map[core.UniqueMessageID]*Subscription),
+
+		usedchains: make(map[CacheKey]*usedChain),
+
+		name:      name,
+		connected: time.Now(),
+		quota:     bw.defaultClientQuota(),
 	}
+	rv.chainLRU = newCacheLRU(rv.quota.MaxCachedChains)
 	rv.ctx, rv.ctxCancel = context.WithCancel(pctx)
 	rv.cl = bw.tm.CreateClient(rv.ctx, name)
+	bw.registerClient(rv)
+	go rv.refreshChainsLoop()
 	return rv
 }
 
@@ -203,24 +381,52 @@ func (bw *BW) CreateClient(pctx context.Context, name string) *BosswaveClient {
 
 //Resolve URI will convert the namespace into an nsvk if it is symbolic
 func (bw *BW) ResolveURI(uri string) (string, error) {
-	parts := strings.SplitN(uri, "/", 2)
-	nsvk, err := bw.ResolveKey(parts[0])
+	ns, suffix, err := util.SplitURI(uri)
+	if err != nil {
+		return "", bwe.WrapC(bwe.BadURI, err)
+	}
+	nsvk, err := bw.ResolveKey(ns)
 	if err != nil {
 		return "", err
 	}
-	return crypto.FmtKey(nsvk) + "/" + parts[1], nil
+	return util.FullURI(nsvk, suffix), nil
 }
 
 func (c *BosswaveClient) CL() *core.Client {
 	return c.cl
 }
 
-//GetPeer gets the peer for the given NSVK, NOT THE PEER VK
+//GetPeer gets the peer for the given NSVK, NOT THE PEER VK. If the
+//namespace has replicas, the first designated router that is connected
+//(or can be connected to) is used, in replica set order
 func (c *BosswaveClient) GetPeer(nsvk []byte) (*PeerClient, error) {
-	drvk, err := c.bw.LookupDesignatedRouter(nsvk)
+	drvks, err := c.bw.LookupDesignatedRouters(nsvk)
 	if err != nil {
 		return nil, err
 	}
+	//A peer that is reconnecting, to use if no other is up
+	var fallback *PeerClient
+	for _, drvk := range drvks {
+		peer, err := c.peerFor(drvk)
+		if err != nil {
+			log.Infof("designated router %s unavailable: %v", crypto.FmtKey(drvk), err)
+			continue
+		}
+		if peer.Connected() {
+			return peer, nil
+		}
+		if fallback == nil {
+			fallback = peer
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, bwe.M(bwe.PeerError, "no designated router for the namespace is reachable")
+}
+
+//peerFor gets the peer for the given designated router VK
+func (c *BosswaveClient) peerFor(drvk []byte) (*PeerClient, error) {
 	key := crypto.FmtKey(drvk)
 	c.peerlock.Lock()
 	defer c.peerlock.Unlock()
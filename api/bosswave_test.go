@@ -18,7 +18,9 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -26,97 +28,10 @@ import (
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
 	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
 	"github.com/immesys/bw2/util"
 )
 
-func TestBasicX(t *testing.T) {
-	//Create the three entities in this test. E1 is publishing to namespace
-	//E2 is subscribing to namespace
-	e1 := objects.CreateNewEntity("contact1", "comment1", nil, 30*time.Hour)
-	e2 := objects.CreateNewEntity("contact2", "comment2", nil, 30*time.Hour)
-	namespace := objects.CreateNewEntity("contact3", "comment3", nil, 30*time.Hour)
-
-	fmt.Printf("Created the three entities\ne1: %v\ne2: %v\nns: %v\n",
-		crypto.FmtKey(e1.GetVK()), crypto.FmtKey(e2.GetVK()), crypto.FmtKey(namespace.GetVK()))
-	bw := OpenBWContext(nil)
-	client1 := bw.CreateClient(e1)
-	client2 := bw.CreateClient(e2)
-	clientN := bw.CreateClient(namespace)
-
-	mvk := namespace.GetVK()
-
-	cdp := CreateDotParams{
-		To:                e1.GetVK(),
-		MVK:               mvk,
-		URISuffix:         "a/*",
-		AccessPermissions: "p",
-	}
-	dToE1 := clientN.CreateDOT(&cdp)
-	if dToE1 == nil {
-		t.Fatalf("dot1 is nil")
-	}
-	fmt.Printf("dToE1 %+v\n", dToE1)
-	cdp.To = e2.GetVK()
-	cdp.AccessPermissions = "c*"
-	dToE2 := clientN.CreateDOT(&cdp)
-	if dToE2 == nil {
-		t.Fatalf("dot2 is nil")
-	}
-	fmt.Printf("dToE2 %+v\n", dToE2)
-	dcE1 := client1.CreateDotChain(&CreateDotChainParams{
-		DOTs: []*objects.DOT{dToE1},
-	})
-	dcE2 := client1.CreateDotChain(&CreateDotChainParams{
-		DOTs: []*objects.DOT{dToE2},
-	})
-	if dcE1 == nil || dcE2 == nil {
-		t.FailNow()
-	}
-
-	gm := make(chan bool)
-	client2.Subscribe(&SubscribeParams{
-		MVK:                mvk,
-		URISuffix:          "a/b/c",
-		PrimaryAccessChain: dcE2,
-		ElaboratePAC:       FullElaboration,
-		DoVerify:           true,
-	},
-		func(code int, isnew bool, subid core.UniqueMessageID) {
-			fmt.Println("Got Scode", code)
-			if code != util.BWStatusOkay {
-				fmt.Println("FAIL")
-				gm <- false
-			}
-			client1.Publish(&PublishParams{
-				MVK:                mvk,
-				URISuffix:          "a/b/c",
-				PrimaryAccessChain: dcE1,
-				ElaboratePAC:       FullElaboration,
-				DoVerify:           true,
-			},
-				func(code int) {
-					fmt.Println("Got Pcode", code)
-				})
-		},
-		func(m *core.Message) {
-			fmt.Println("Got message")
-			gm <- true
-		})
-
-	//Check if the test passed or we timed out
-	select {
-	case direct := <-gm:
-		if !direct {
-			t.FailNow()
-			return
-		}
-	case <-time.After(3 * time.Second):
-		fmt.Println("Timed out")
-		t.FailNow()
-		return
-	}
-}
-
 func TestMatchTopic(t *testing.T) {
 	TV := []struct {
 		T string
@@ -190,3 +105,433 @@ func TestRestrict(t *testing.T) {
 		}
 	}
 }
+func TestMinimalSuffixes(t *testing.T) {
+	TV := []struct {
+		In  []string
+		Out []string
+	}{
+		{[]string{"a/b/c"}, []string{"a/b/c"}},
+		{[]string{"a/b/c", "a/b/c"}, []string{"a/b/c"}},
+		{[]string{"a/b/c", "a/*"}, []string{"a/*"}},
+		{[]string{"a/+/c", "a/b/c", "x/y"}, []string{"a/+/c", "x/y"}},
+		{[]string{"a/+/c", "a/b/+"}, []string{"a/+/c", "a/b/+"}},
+	}
+	for _, v := range TV {
+		res := minimalSuffixes(v.In)
+		if strings.Join(res, ",") != strings.Join(v.Out, ",") {
+			fmt.Printf("Fail %+v, got %v\n", v, res)
+			t.Fail()
+		}
+	}
+}
+
+//benchView makes a view over n interfaces, each with metadata on the
+//interface and on one of its signals
+func benchView(n int, ex Expression) *View {
+	ns := crypto.FmtKey(make([]byte, 32))
+	v := &View{
+		c:         &BosswaveClient{bw: &BW{}},
+		ex:        ex,
+		metastore: make(map[string]map[string]*advpo.MetadataTuple),
+	}
+	for i := 0; i < n; i++ {
+		iface := ns + "/building/s.lighting/light" + strconv.Itoa(i) + "/i.xbos.light"
+		v.metastore[iface] = map[string]*advpo.MetadataTuple{
+			"lastalive": {Value: "now"},
+			"room":      {Value: strconv.Itoa(i % 10)},
+		}
+		v.metastore[iface+"/signal/info"] = map[string]*advpo.MetadataTuple{
+			"unit": {Value: "lux"},
+		}
+	}
+	return v
+}
+
+func BenchmarkInterfacesRegexURI(b *testing.B) {
+	v := benchView(5000, RegexURI(`^.*/s\.lighting/.*$`))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(v.interfacesImpl()) != 5000 {
+			b.Fatal("wrong number of interfaces")
+		}
+	}
+}
+
+func BenchmarkInterfacesEqMeta(b *testing.B) {
+	v := benchView(5000, EqMeta("room", "3"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(v.interfacesImpl()) != 500 {
+			b.Fatal("wrong number of interfaces")
+		}
+	}
+}
+
+func BenchmarkRegexURIMatches(b *testing.B) {
+	uri := crypto.FmtKey(make([]byte, 32)) + "/building/s.lighting/light1/i.xbos.light"
+	for i := 0; i < b.N; i++ {
+		if !RegexURI(`^.*/s\.lighting/.*$`).Matches(uri, nil) {
+			b.Fatal("pattern did not match")
+		}
+	}
+}
+
+func TestNotAndMetaCmp(t *testing.T) {
+	TV := []struct {
+		Ex  string
+		Out int
+	}{
+		{`{"$not":{"meta":{"room":"3"}}}`, 18},
+		{`{"meta":{"room":{"$gt":6}}}`, 6},
+		{`{"meta":{"room":{"$prefix":"1"}}}`, 2},
+		{`{"meta":{"room":{"$re":"^[0-2]$"}}}`, 6},
+		{`{"$and":[{"meta":{"room":{"$gt":2,"$lt":5}}},{"$not":{"meta":{"room":"3"}}}]}`, 2},
+		{`{"$not":{"meta":{"unit":{"$lt":1}}}}`, 20},
+	}
+	for _, v := range TV {
+		ex, err := ExpressionFromJSON([]byte(v.Ex))
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", v.Ex, err)
+		}
+		//The serialized form must give the same view
+		blob, err := ExpressionToJSON(ex)
+		if err != nil {
+			t.Fatalf("could not serialize %s: %v", v.Ex, err)
+		}
+		rex, err := ExpressionFromJSON(blob)
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", blob, err)
+		}
+		for _, e := range []Expression{ex, rex} {
+			if res := len(benchView(20, e).interfacesImpl()); res != v.Out {
+				fmt.Printf("Fail %+v, got %v\n", v, res)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestNumericValues(t *testing.T) {
+	text := advpo.CreateStringPayloadObject(" 21.5\n")
+	mp, _ := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, map[string]interface{}{
+		"temp": 19, "hum": 0.4, "name": "x",
+	})
+	md := advpo.CreateMetadataPayloadObject(&advpo.MetadataTuple{Value: "5", Timestamp: 1})
+	m := &core.Message{PayloadObjects: []objects.PayloadObject{text, mp, md}}
+	vals := numericValues(m)
+	if len(vals) != 3 || vals[""] != 21.5 || vals["temp"] != 19 || vals["hum"] != 0.4 {
+		fmt.Printf("Fail, got %v\n", vals)
+		t.Fail()
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newCacheLRU(2)
+	c.add("a")
+	c.add("b")
+	c.touch("a")
+	if ev := c.add("c"); len(ev) != 1 || ev[0] != "b" {
+		fmt.Printf("Fail, evicted %v\n", ev)
+		t.Fail()
+	}
+	c.remove("a")
+	if ev := c.add("d"); len(ev) != 0 {
+		fmt.Printf("Fail, evicted %v\n", ev)
+		t.Fail()
+	}
+	if st := c.stats(); st.Size != 2 || st.Max != 2 || st.Evictions != 1 {
+		fmt.Printf("Fail, got %+v\n", st)
+		t.Fail()
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter()
+	for i := 0; i < 3; i++ {
+		if !rl.allow("a", 2, 3, now) {
+			t.Fatalf("message %d within burst was limited", i)
+		}
+	}
+	if rl.allow("a", 2, 3, now) {
+		t.Fatalf("message over burst was allowed")
+	}
+	if !rl.allow("b", 2, 3, now) {
+		t.Fatalf("buckets are not separate")
+	}
+	if !rl.allow("a", 2, 3, now.Add(500*time.Millisecond)) || rl.allow("a", 2, 3, now.Add(500*time.Millisecond)) {
+		t.Fatalf("bucket did not refill at the rate")
+	}
+}
+
+func TestAuditSample(t *testing.T) {
+	now := time.Now()
+	a := &auditor{}
+	recorded := 0
+	for i := 0; i < 10; i++ {
+		if a.sample(3, 3, now) {
+			recorded++
+		}
+	}
+	if recorded != 3 {
+		t.Fatalf("expected 3 sampled denials, got %d", recorded)
+	}
+	if !a.sample(1, 3, now.Add(time.Minute)) {
+		t.Fatalf("cap did not reset after a minute")
+	}
+}
+
+func TestMountedSuffix(t *testing.T) {
+	mt := &mount{fromsuffix: "a/b", tosuffix: "x"}
+	cases := map[string]string{
+		"a/b":       "x",
+		"a/b/c":     "x/c",
+		"a/b/c/d":   "x/c/d",
+		"a/bc":      "",
+		"a/b/$r/c":  "",
+		"other/a/b": "",
+	}
+	for from, expected := range cases {
+		got, ok := mt.mountedSuffix(from)
+		if got != expected || ok != (expected != "") {
+			t.Errorf("%s mounted at %q (%v), expected %q", from, got, ok, expected)
+		}
+	}
+	whole := &mount{tosuffix: "old"}
+	if got, _ := whole.mountedSuffix("a/b"); got != "old/a/b" {
+		t.Errorf("whole namespace mount gave %q", got)
+	}
+}
+
+func TestServiceInventory(t *testing.T) {
+	now := time.Now()
+	ns := crypto.FmtKey(make([]byte, 32))
+	v := &View{
+		c:         &BosswaveClient{bw: &BW{}},
+		metastore: make(map[string]map[string]*advpo.MetadataTuple),
+	}
+	alive := now.Add(-time.Second).UnixNano()
+	old := now.Add(-time.Minute).UnixNano()
+	v.metastore[ns+"/b/s.light/l1/i.light"] = map[string]*advpo.MetadataTuple{"lastalive": {Timestamp: alive}}
+	v.metastore[ns+"/b/s.light/l1/i.meter"] = map[string]*advpo.MetadataTuple{"lastalive": {Timestamp: alive}}
+	v.metastore[ns+"/b/s.light/l2/i.light"] = map[string]*advpo.MetadataTuple{"lastalive": {Timestamp: alive}}
+	v.metastore[ns+"/b/s.light/l2/i.meter"] = map[string]*advpo.MetadataTuple{"lastalive": {Timestamp: old}}
+	v.metastore[ns+"/b/s.hvac/h1/i.tstat/signal/info"] = map[string]*advpo.MetadataTuple{"unit": {Value: "C"}}
+	p := &ServiceRegistryParams{StaleAfter: 30 * time.Second, GoneAfter: 5 * time.Minute}
+	inv := serviceInventory(v, now, p)
+	want := map[string]string{
+		ns + "/b/s.light/l1": HealthAlive,
+		ns + "/b/s.light/l2": HealthStale,
+		ns + "/b/s.hvac/h1":  HealthGone,
+	}
+	if len(inv.Services) != len(want) {
+		t.Fatalf("got %d services, expected %d", len(inv.Services), len(want))
+	}
+	for _, s := range inv.Services {
+		if want[s.URI] != s.Health {
+			t.Errorf("%s is %s, expected %s", s.URI, s.Health, want[s.URI])
+		}
+	}
+	if c := inv.Counts["s.light"]; c == nil || c.Alive != 1 || c.Stale != 1 {
+		t.Errorf("bad counts for s.light: %+v", c)
+	}
+	changes := diffInventories(inv, serviceInventory(v, now.Add(10*time.Minute), p))
+	if len(changes) != 2 || changes[0].New != HealthGone || changes[1].Old != HealthStale {
+		t.Errorf("bad changes after ten minutes: %+v", changes)
+	}
+}
+
+func TestDoPACDedup(t *testing.T) {
+	nsSK, nsVK := crypto.GenerateKeypair()
+	sk, vk := crypto.GenerateKeypair()
+	d := objects.CreateDOT(true, nsVK, vk)
+	d.SetAccessURI(nsVK, "a/*")
+	d.SetCanPublish(true)
+	d.Encode(nsSK)
+	pac, _ := objects.CreateDChain(true, d)
+	mkmsg := func() *core.Message {
+		return &core.Message{
+			Type:               core.TypePublish,
+			MVK:                nsVK,
+			TopicSuffix:        "a/b",
+			PrimaryAccessChain: pac,
+			//The sender already attached the DOT and the chain
+			RoutingObjects: []objects.RoutingObject{d, objects.CreateOriginVK(vk), pac},
+		}
+	}
+	c := &BosswaveClient{bw: &BW{}}
+	m := mkmsg()
+	if err := c.doPAC(m, FullElaboration); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.RoutingObjects) != 3 || m.RoutingObjects[0] != d || m.RoutingObjects[2] != pac {
+		t.Fatalf("expected the DOT, origin and chain once each in order, got %d ROs", len(m.RoutingObjects))
+	}
+	m.Encode(sk, vk)
+	dup := mkmsg()
+	dup.RoutingObjects = append(dup.RoutingObjects, d, pac)
+	dup.Encode(sk, vk)
+	if len(m.Encoded) >= len(dup.Encoded) {
+		t.Fatalf("dedup did not shrink the message: %d >= %d", len(m.Encoded), len(dup.Encoded))
+	}
+}
+
+func TestChainRefresh(t *testing.T) {
+	nsSK, nsVK := crypto.GenerateKeypair()
+	sk, vk := crypto.GenerateKeypair()
+	_, vk2 := crypto.GenerateKeypair()
+	now := time.Now()
+	d1 := objects.CreateDOT(true, nsVK, vk)
+	d1.SetAccessURI(nsVK, "a/*")
+	d1.SetCanPublish(true)
+	d1.SetExpiry(now.Add(48 * time.Hour))
+	d1.Encode(nsSK)
+	d2 := objects.CreateDOT(true, vk, vk2)
+	d2.SetAccessURI(nsVK, "a/*")
+	d2.SetCanPublish(true)
+	d2.SetExpiry(now.Add(2 * time.Hour))
+	d2.Encode(sk)
+	pac, _ := objects.CreateDChain(true, d1, d2)
+	c := &BosswaveClient{bw: &BW{Config: &core.BWConfig{}}}
+	if exp, ok := c.bw.chainExpiry(pac); !ok || !exp.Equal(*d2.GetExpiry()) {
+		t.Fatalf("chain expiry is %v, expected the second DOT's", exp)
+	}
+	if w := c.chainRefreshWindow(); w != DefaultChainRefresh || !c.expiresWithin(pac, w, now) {
+		t.Fatalf("a chain expiring in 2 hours is not refreshed with window %v", w)
+	}
+	c.bw.Config.Clients.ChainRefresh = 1
+	if c.expiresWithin(pac, c.chainRefreshWindow(), now) {
+		t.Fatalf("a chain expiring in 2 hours is refreshed an hour before expiry")
+	}
+	c.SetChainPolicy(&ChainPolicy{RefreshBefore: -1})
+	if w := c.chainRefreshWindow(); w != 0 {
+		t.Fatalf("a negative RefreshBefore did not disable refresh, window %v", w)
+	}
+}
+
+func TestPublishPipeline(t *testing.T) {
+	p := newPublishPipeline(2)
+	var order []int
+	var pending []*pendingPublish
+	for i := 0; i < 2; i++ {
+		i := i
+		pp, err := p.begin(context.Background(), func(err error, consumers int) {
+			order = append(order, i)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, pp)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err := p.begin(ctx, nil); err == nil {
+		t.Fatalf("a publish was sent with the window full")
+	}
+	cancel()
+	p.ack(pending[1], nil, 1)
+	if len(order) != 0 {
+		t.Fatalf("the second publish was reported before the first was acked")
+	}
+	done := make(chan error)
+	go func() { done <- p.flush(context.Background()) }()
+	p.ack(pending[0], nil, 1)
+	if err := <-done; err != nil || len(order) != 2 || order[0] != 0 || order[1] != 1 {
+		t.Fatalf("callbacks ran in order %v, flush gave %v", order, err)
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	pc := &PeerClient{target: "peer", sent: make(map[uint64]time.Time)}
+	pc.noteSent(1, 100)
+	pc.noteSent(2, 10)
+	pc.noteReceived(1, 2)
+	st := pc.Stats()
+	if st.FramesOut != 2 || st.BytesOut != 2*17+110 || st.FramesIn != 1 || st.BytesIn != 19 {
+		t.Fatalf("bad counts: %+v", st)
+	}
+	if st.Outstanding != 1 || st.RTT <= 0 {
+		t.Fatalf("expected one outstanding transaction and an RTT: %+v", st)
+	}
+	pc.noteReceived(1, 2)
+	pc.noteDisconnect()
+	if st = pc.Stats(); st.Outstanding != 0 || st.RTT != 0 || st.Reconnects != 1 || st.FramesIn != 2 {
+		t.Fatalf("bad stats after a disconnect: %+v", st)
+	}
+}
+
+func TestPageFrame(t *testing.T) {
+	m := &core.Message{Encoded: []byte("message")}
+	page, body, err := decodePage(encodePage(m, PageParams{Limit: 20, Cursor: "abc"}))
+	if err != nil || page.Limit != 20 || page.Cursor != "abc" || string(body) != "message" {
+		t.Fatalf("page frame did not round trip: %+v %q %v", page, body, err)
+	}
+	if _, _, err := decodePage([]byte{1, 0, 9, 0, 'a'}); err == nil {
+		t.Fatal("short page frame accepted")
+	}
+	p := PageParams{}
+	if err := p.check(); err != nil || p.Limit != DefaultPageLimit {
+		t.Fatalf("default page limit not applied: %+v %v", p, err)
+	}
+	p = PageParams{Limit: MaxPageLimit + 1}
+	if p.check() == nil {
+		t.Fatal("oversize page accepted")
+	}
+}
+
+func TestNumberedFrame(t *testing.T) {
+	m := &core.Message{Encoded: []byte("message"), PersistSeq: 42}
+	cmd, seq, body, err := decodeNumbered(encodeNumbered(nCmdReplicate, m))
+	if err != nil || cmd != nCmdReplicate || seq != 42 || string(body) != "message" {
+		t.Fatalf("numbered frame did not round trip: %d %d %q %v", cmd, seq, body, err)
+	}
+	if _, _, _, err := decodeNumbered(encodeNumbered(nCmdMessage, m)); err == nil {
+		t.Fatal("numbered publish accepted")
+	}
+	fs := resultFrames(7, m)
+	if len(fs) != 2 || fs[0].cmd != nCmdSeq || decodeSeq(fs[0].body) != 42 || fs[1].cmd != nCmdResult {
+		t.Fatalf("unexpected result frames %+v", fs)
+	}
+	m.PersistSeq = 0
+	if fs = resultFrames(7, m); len(fs) != 1 || fs[0].cmd != nCmdResult {
+		t.Fatalf("unexpected result frames %+v", fs)
+	}
+}
+
+func TestTransformSteps(t *testing.T) {
+	doc, _ := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, map[string]interface{}{"temp": 21, "badge": "ab12"})
+	text, _ := objects.CreateOpaquePayloadObject(objects.PONumText, []byte("hello"))
+	rule, err := newTransformRule("test", "ns/a/+/b", "T", []string{"strip:64.0.0.0/8", "redact:badge", "downsample:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []objects.PayloadObject
+	kept := 0
+	for i := 0; i < 4; i++ {
+		pos := []objects.PayloadObject{doc, text}
+		ok := true
+		for _, step := range rule.steps {
+			if pos, ok = step("a/x/b", pos); !ok {
+				break
+			}
+		}
+		if ok {
+			kept++
+			out = pos
+		}
+	}
+	if kept != 2 {
+		t.Fatalf("downsample kept %d of 4", kept)
+	}
+	if len(out) != 1 || out[0].GetPONum() != objects.PONumMsgPack {
+		t.Fatalf("strip left %v", out)
+	}
+	if strings.Contains(string(out[0].GetContent()), "badge") {
+		t.Fatal("redact left the field")
+	}
+	if !rule.exempts(objects.GetADPSFromPermString("C*T")) || rule.exempts(objects.GetADPSFromPermString("C*")) {
+		t.Fatal("Unless T is not applied")
+	}
+	if _, err := newTransformRule("bad", "ns/a", "", []string{"nosuch"}); err == nil {
+		t.Fatal("unknown transform accepted")
+	}
+}
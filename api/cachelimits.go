@@ -0,0 +1,193 @@
+package api
+
+import (
+	"container/list"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/objects"
+)
+
+const (
+	//DefaultMaxCachedEntities is used if [cache] MaxEntities is not set
+	DefaultMaxCachedEntities = 10000
+	//DefaultMaxCachedDOTs is used if [cache] MaxDOTs is not set
+	DefaultMaxCachedDOTs = 50000
+	//DefaultMaxCachedChains is used if [cache] MaxChains is not set. Each
+	//entry is the list of chains built for one URI, permissions and target
+	DefaultMaxCachedChains = 10000
+)
+
+//The defaults for a router with the thin profile, which is short of memory
+const (
+	thinMaxCachedEntities = 1000
+	thinMaxCachedDOTs     = 5000
+	thinMaxCachedChains   = 1000
+)
+
+//cacheLRU tracks the use of the keys in one resolution cache. It does not
+//hold the values, the cache's map does
+type cacheLRU struct {
+	max   int
+	order *list.List
+	elems map[interface{}]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newCacheLRU(max int) *cacheLRU {
+	return &cacheLRU{
+		max:   max,
+		order: list.New(),
+		elems: make(map[interface{}]*list.Element),
+	}
+}
+
+//touch marks k as the most recently used key
+func (c *cacheLRU) touch(k interface{}) {
+	if e, ok := c.elems[k]; ok {
+		c.order.MoveToFront(e)
+	}
+}
+
+//add marks k as the most recently used key and returns the keys that must
+//be evicted to keep the cache within its limit. A limit of zero or less
+//means there is no limit
+func (c *cacheLRU) add(k interface{}) []interface{} {
+	if e, ok := c.elems[k]; ok {
+		c.order.MoveToFront(e)
+		return nil
+	}
+	c.elems[k] = c.order.PushFront(k)
+	var rv []interface{}
+	for c.max > 0 && c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.elems, e.Value)
+		c.evictions++
+		rv = append(rv, e.Value)
+	}
+	return rv
+}
+
+func (c *cacheLRU) remove(k interface{}) {
+	if e, ok := c.elems[k]; ok {
+		c.order.Remove(e)
+		delete(c.elems, k)
+	}
+}
+
+//reset forgets all the keys, but keeps the counters
+func (c *cacheLRU) reset() {
+	c.order.Init()
+	c.elems = make(map[interface{}]*list.Element)
+}
+
+func (c *cacheLRU) stats() CacheStats {
+	max := c.max
+	if max < 0 {
+		max = 0
+	}
+	return CacheStats{
+		Size:      c.order.Len(),
+		Max:       max,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+//CacheStats describes one of the resolution caches
+type CacheStats struct {
+	Size int
+	//Zero if the cache is not limited
+	Max       int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+//ResolutionCacheStats describes the entity, DOT and built chain caches
+type ResolutionCacheStats struct {
+	Entities CacheStats
+	DOTs     CacheStats
+	Chains   CacheStats
+}
+
+func cacheLimit(configured, def int) int {
+	if configured == 0 {
+		return def
+	}
+	return configured
+}
+
+//setCacheLimits applies the [cache] section of the config. A negative
+//limit means the cache is not limited
+func (bw *BW) setCacheLimits() {
+	cfg := bw.Config.Cache
+	bw.getlock()
+	defer bw.rellock()
+	if bw.Config.IsThin() {
+		bw.rdata.entityLRU.max = cacheLimit(cfg.MaxEntities, thinMaxCachedEntities)
+		bw.rdata.dotLRU.max = cacheLimit(cfg.MaxDOTs, thinMaxCachedDOTs)
+		bw.rdata.chainLRU.max = cacheLimit(cfg.MaxChains, thinMaxCachedChains)
+		return
+	}
+	bw.rdata.entityLRU.max = cacheLimit(cfg.MaxEntities, DefaultMaxCachedEntities)
+	bw.rdata.dotLRU.max = cacheLimit(cfg.MaxDOTs, DefaultMaxCachedDOTs)
+	bw.rdata.chainLRU.max = cacheLimit(cfg.MaxChains, DefaultMaxCachedChains)
+}
+
+//ResolutionCacheStats returns the size, limit and counters of the caches
+func (bw *BW) ResolutionCacheStats() ResolutionCacheStats {
+	bw.getlock()
+	defer bw.rellock()
+	return ResolutionCacheStats{
+		Entities: bw.rdata.entityLRU.stats(),
+		DOTs:     bw.rdata.dotLRU.stats(),
+		Chains:   bw.rdata.chainLRU.stats(),
+	}
+}
+
+//FlushResolutionCaches discards everything resolved from the chain. It does
+//not discard imported snapshots or the registry search index
+func (bw *BW) FlushResolutionCaches() {
+	bw.dropAllCaches()
+}
+
+//The evict functions remove keys returned by cacheLRU.add from the maps.
+//Lock must be held
+
+func (bw *BW) evictEntities(keys []interface{}) {
+	for _, k := range keys {
+		delete(bw.rdata.entityCache, k.(bc.Bytes32))
+	}
+}
+
+//A DOT's entry in the inv caches is kept, so that flushing an entity still
+//flushes it if it is cached again
+func (bw *BW) evictDOTs(keys []interface{}) {
+	for _, k := range keys {
+		delete(bw.rdata.dotHashCache, k.(bc.Bytes32))
+	}
+}
+
+func (bw *BW) evictChains(keys []interface{}) {
+	for _, k := range keys {
+		ck := k.(CacheKey)
+		nsmap := bw.rdata.chaincache[ck.nsvk]
+		delete(nsmap, ck)
+		if len(nsmap) == 0 {
+			delete(bw.rdata.chaincache, ck.nsvk)
+		}
+	}
+}
+
+//forgetChainNSVK removes the LRU entries of a namespace's built chains.
+//Lock must be held
+func (bw *BW) forgetChainNSVK(nsmap map[CacheKey][]*objects.DChain) {
+	for k := range nsmap {
+		bw.rdata.chainLRU.remove(k)
+	}
+}
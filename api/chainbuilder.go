@@ -3,9 +3,7 @@ package api
 import (
 	"bytes"
 	"container/list"
-	"errors"
 	"fmt"
-	"strings"
 
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
@@ -101,12 +99,16 @@ func NewChainBuilder(cl *BosswaveClient, uri, perms string, target []byte, statu
 		status <- "Bad permissions"
 		return nil
 	}
-	uriparts := strings.SplitN(uri, "/", 2)
-	nsvk, err := cl.BW().ResolveKey(uriparts[0])
+	ns, suffix, err := util.SplitURI(uri)
+	if err != nil {
+		status <- "Bad URI"
+		return nil
+	}
+	nsvk, err := cl.BW().ResolveKey(ns)
 	if err != nil {
 		panic("need to fix this")
 	}
-	rv.urisuffix = uriparts[1]
+	rv.urisuffix = suffix
 	rv.nsvk = nsvk
 	return &rv
 }
@@ -163,6 +165,7 @@ func (b *ChainBuilder) Build() ([]*objects.DChain, error) {
 	copy(ck.target[:], b.target)
 	copy(ck.nsvk[:], b.nsvk)
 	cached, states := b.cl.bw.resolveBuiltChain(ck)
+	b.cl.noteChainLookup(cached != nil)
 	if cached != nil {
 		log.Infof("chain build cache hit")
 		rv := make([]*objects.DChain, 0, len(cached))
@@ -177,15 +180,11 @@ func (b *ChainBuilder) Build() ([]*objects.DChain, error) {
 	} else {
 		log.Infof("chain build cache miss")
 	}
-	parts := strings.SplitN(b.uri, "/", 2)
-	if len(parts) != 2 {
-		return nil, errors.New("Invalid URI")
-	}
-	valid, _, _, _ := util.AnalyzeSuffix(parts[1])
-	if !valid {
-		return nil, errors.New("Invalid URI")
+	ns, _, err := util.SplitURI(b.uri)
+	if err != nil {
+		return nil, err
 	}
-	mvk, err := b.cl.BW().ResolveKey(parts[0])
+	mvk, err := b.cl.BW().ResolveKey(ns)
 	if err != nil {
 		return nil, err
 	}
@@ -214,6 +213,10 @@ func (b *ChainBuilder) Build() ([]*objects.DChain, error) {
 			if !okay {
 				continue
 			}
+			if !b.desperms.IsSubsetOf(objects.ChainPermissionSet(newscenario.chain)) {
+				b.status <- fmt.Sprintf("rejecting DOT(%s) - permissions may not be delegated to it", crypto.FmtHash(dt.GetHash()))
+				continue
+			}
 			if bytes.Equal(newscenario.GetTerminalVK(), b.target) || bytes.Equal(newscenario.GetTerminalVK(), util.EverybodySlice) {
 				b.status <- "graph walk found a valid scenario!"
 				validscenarios.PushBack(newscenario)
@@ -236,6 +239,6 @@ func (b *ChainBuilder) Build() ([]*objects.DChain, error) {
 		e = e.Next()
 	}
 	b.status <- "chain build operation complete"
-	b.cl.bw.cacheBuiltChains(ck, rv)
+	b.cl.bw.cacheBuiltChains(b.cl, ck, rv)
 	return rv, nil
 }
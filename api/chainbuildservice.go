@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const defaultChainBuildWorkers = 4
+
+//Chains sent for a request that does not give a maximum, and the most that
+//will be sent for any request
+const (
+	defaultChainBuildMax = 4
+	maxChainBuildMax     = 32
+)
+
+//How often the service looks for namespaces it has become the designated
+//router for
+const chainBuildRefresh = 60 * time.Second
+
+//ChainBuildRequest is the msgpack payload of a message published on
+//$chainbuild/<id>/request. The router builds chains granting Perms on URI
+//(a suffix in the namespace the request was published on) to VK, which
+//may be an alias
+type ChainBuildRequest struct {
+	VK    string `msgpack:"vk"`
+	URI   string `msgpack:"uri"`
+	Perms string `msgpack:"perms"`
+	//The most chains to send, zero for the default
+	Max int `msgpack:"max"`
+}
+
+//ChainBuildResult is the msgpack payload of each message the router
+//publishes on $chainbuild/<id>/result. There is a message for each chain,
+//best first, carrying the elaborated chain as a routing object, and then a
+//message with Done set
+type ChainBuildResult struct {
+	Index int    `msgpack:"index"`
+	Hash  string `msgpack:"hash"`
+	Done  bool   `msgpack:"done"`
+	//Set on the Done message
+	Count int    `msgpack:"count"`
+	Error string `msgpack:"error"`
+}
+
+type chainBuildService struct {
+	bw   *BW
+	cl   *BosswaveClient
+	busy chan struct{}
+
+	mu         sync.Mutex
+	subscribed map[bc.Bytes32]bool
+}
+
+//StartChainBuildService builds chains for clients that cannot, such as
+//microcontrollers behind a gateway. They subscribe to
+//$chainbuild/<id>/result and publish a ChainBuildRequest on
+//$chainbuild/<id>/request, with an id of their choosing, in a namespace
+//this router is a designated router for. [router] ChainBuildWorkers limits
+//the builds at once, and a negative number disables the service
+func StartChainBuildService(bw *BW) {
+	workers := bw.Config.Router.ChainBuildWorkers
+	if workers < 0 {
+		return
+	} else if workers == 0 {
+		workers = defaultChainBuildWorkers
+	}
+	cl := bw.CreateClient(context.Background(), "CHAINBUILD")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("chain build service: could not use router entity: %v", err)
+		return
+	}
+	svc := &chainBuildService{
+		bw:         bw,
+		cl:         cl,
+		busy:       make(chan struct{}, workers),
+		subscribed: make(map[bc.Bytes32]bool),
+	}
+	for {
+		for _, nsvk := range bw.replicaNamespaces() {
+			if ok, err := bw.IsDesignatedRouterFor(nsvk); err == nil && ok {
+				svc.subscribe(nsvk)
+			}
+		}
+		time.Sleep(chainBuildRefresh)
+	}
+}
+
+//subscribe listens for requests on a namespace, unless it already is. If
+//the subscription ends, the next refresh subscribes again
+func (svc *chainBuildService) subscribe(nsvk []byte) {
+	k := bc.SliceToBytes32(nsvk)
+	svc.mu.Lock()
+	if svc.subscribed[k] {
+		svc.mu.Unlock()
+		return
+	}
+	svc.subscribed[k] = true
+	svc.mu.Unlock()
+	forget := func() {
+		svc.mu.Lock()
+		delete(svc.subscribed, k)
+		svc.mu.Unlock()
+	}
+	svc.cl.Subscribe(&SubscribeParams{
+		MVK:       nsvk,
+		URISuffix: util.ChainBuildURIPrefix + "/+/request",
+	}, func(err error, id core.UniqueMessageID) {
+		if err != nil {
+			log.Warnf("chain build service: could not subscribe on %s: %v", crypto.FmtKey(nsvk), err)
+			forget()
+		}
+	}, func(m *core.Message) {
+		if m == nil {
+			forget()
+			return
+		}
+		go svc.handle(nsvk, m)
+	})
+}
+
+func (svc *chainBuildService) handle(nsvk []byte, m *core.Message) {
+	parts := strings.Split(m.TopicSuffix, "/")
+	if !util.IsChainBuildRequest(m.TopicSuffix) {
+		return
+	}
+	id := parts[1]
+	fail := func(msg string) {
+		svc.reply(nsvk, id, &ChainBuildResult{Done: true, Error: msg}, nil)
+	}
+	req := ChainBuildRequest{}
+	found := false
+	for _, po := range m.PayloadObjects {
+		if po.GetPONum() == objects.PONumMsgPack {
+			found = msgpack.Unmarshal(po.GetContent(), &req) == nil
+			break
+		}
+	}
+	if !found {
+		fail("the request must have a msgpack payload object")
+		return
+	}
+	star, plus, _, uerr := util.AnalyzeSuffixDetailed(req.URI)
+	if uerr != nil {
+		fail(uerr.Error())
+		return
+	}
+	if star || plus {
+		fail("uri must be a URI suffix without wildcards")
+		return
+	}
+	if objects.GetADPSFromPermString(req.Perms) == nil {
+		fail("bad permissions")
+		return
+	}
+	target, err := svc.bw.ResolveKey(req.VK)
+	if err != nil {
+		fail("could not resolve vk: " + err.Error())
+		return
+	}
+	max := req.Max
+	if max <= 0 {
+		max = defaultChainBuildMax
+	} else if max > maxChainBuildMax {
+		max = maxChainBuildMax
+	}
+	select {
+	case svc.busy <- struct{}{}:
+	default:
+		fail("the router is busy building chains, try again later")
+		return
+	}
+	defer func() { <-svc.busy }()
+	ch, err := svc.cl.BuildChain(&BuildChainParams{
+		To:          target,
+		URI:         crypto.FmtKey(nsvk) + "/" + req.URI,
+		Permissions: req.Perms,
+	})
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	count := 0
+	for c := range ch {
+		if count == max {
+			continue
+		}
+		svc.reply(nsvk, id, &ChainBuildResult{Index: count, Hash: crypto.FmtHash(c.GetChainHash())}, c)
+		count++
+	}
+	svc.reply(nsvk, id, &ChainBuildResult{Done: true, Count: count}, nil)
+}
+
+func (svc *chainBuildService) reply(nsvk []byte, id string, res *ChainBuildResult, chain *objects.DChain) {
+	blob, err := msgpack.Marshal(res)
+	if err != nil {
+		log.Errorf("chain build service: could not encode result: %v", err)
+		return
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	suffix := util.ChainBuildURIPrefix + "/" + id + "/result"
+	p := &PublishParams{
+		MVK:            nsvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+	}
+	if chain != nil {
+		p.RoutingObjects = []objects.RoutingObject{chain}
+	}
+	svc.cl.Publish(p, func(err error) {
+		if err != nil {
+			log.Warnf("chain build service: could not publish %s: %v", suffix, err)
+		}
+	})
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//ChainEventsURIPrefix is the free path a router publishes chain events
+//under, in every namespace it is a designated router for, if [router]
+//ChainEvents is set. Each event goes to $chain/<kind>
+const ChainEventsURIPrefix = "$chain"
+
+//The kinds of ChainEvent
+const (
+	ChainEventBlock            = "block"
+	ChainEventDOT              = "dot"
+	ChainEventEntity           = "entity"
+	ChainEventChain            = "chain"
+	ChainEventDOTRevocation    = "dotrevocation"
+	ChainEventEntityRevocation = "entityrevocation"
+	ChainEventAlias            = "alias"
+	ChainEventAliasUpdate      = "aliasupdate"
+	ChainEventAliasTransfer    = "aliastransfer"
+	ChainEventAliasDelete      = "aliasdelete"
+	ChainEventAffinityOffer    = "affinityoffer"
+	ChainEventDesignatedRouter = "designatedrouter"
+	ChainEventSRV              = "srv"
+	//The chain has had no new block for [p2p] SyncStallTimeout, and its
+	//peers were rotated, or it has new blocks again after that
+	ChainEventSyncStall   = "syncstall"
+	ChainEventSyncResumed = "syncresumed"
+)
+
+//How often the namespaces to publish chain events in are found again
+const chainEventNamespaceInterval = 5 * time.Minute
+
+//ChainEvent is a new block, or a decoded registry, alias or affinity
+//contract event. It is published msgpack encoded. Fields that do not
+//apply to the kind are empty
+type ChainEvent struct {
+	Kind  string `msgpack:"kind"`
+	Block uint64 `msgpack:"block"`
+	//The block hash for block events, otherwise the transaction hash
+	Hash string `msgpack:"hash"`
+	//The block time for block events, or when the head arrived for sync
+	//events, in seconds since the epoch
+	Time int64 `msgpack:"time"`
+	//The hash of the DOT, chain or revoked object, or the VK of the entity
+	Subject string `msgpack:"subject"`
+	//For DOTs, the giver and receiver VKs and the URI
+	From string `msgpack:"from"`
+	To   string `msgpack:"to"`
+	URI  string `msgpack:"uri"`
+	//For aliases, the key and value in hex, and for transfers the new
+	//owner's address in hex
+	Key   string `msgpack:"key"`
+	Value string `msgpack:"value"`
+	Owner string `msgpack:"owner"`
+	//For affinity events
+	NSVK string `msgpack:"nsvk"`
+	DRVK string `msgpack:"drvk"`
+	SRV  string `msgpack:"srv"`
+	//For sync events, the chain peers left connected, and for stalls the
+	//peers dropped and how many of them were banned
+	Peers   int `msgpack:"peers"`
+	Dropped int `msgpack:"dropped"`
+	Banned  int `msgpack:"banned"`
+}
+
+//chainEventHub fans chain events out to the in process subscribers
+type chainEventHub struct {
+	mu   sync.Mutex
+	subs map[chan *ChainEvent]struct{}
+	//Sync events for StartChainEvents, which come without a new head
+	alerts chan *ChainEvent
+}
+
+//SubscribeChainEvents delivers the chain events until the context is
+//cancelled. Events are dropped for a subscriber that falls too far behind.
+//StartChainEvents must be running for there to be any
+func (bw *BW) SubscribeChainEvents(ctx context.Context) <-chan *ChainEvent {
+	h := &bw.chainEvents
+	rv := make(chan *ChainEvent, 100)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan *ChainEvent]struct{})
+	}
+	h.subs[rv] = struct{}{}
+	h.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subs, rv)
+		h.mu.Unlock()
+		close(rv)
+	}()
+	return rv
+}
+
+func (h *chainEventHub) alertChan() chan *ChainEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.alerts == nil {
+		h.alerts = make(chan *ChainEvent, 16)
+	}
+	return h.alerts
+}
+
+//chainStalled is told by the chain's watchdog when the sync stalls and
+//resumes, and raises a chain event
+func (bw *BW) chainStalled(st *bc.SyncStall) {
+	ev := &ChainEvent{
+		Kind:    ChainEventSyncResumed,
+		Block:   st.Height,
+		Time:    st.Since.Unix(),
+		Peers:   st.Peers,
+		Dropped: st.Dropped,
+		Banned:  st.Banned,
+	}
+	if st.Recovered {
+		log.Infof("chain sync resumed at block %d", st.Height)
+	} else {
+		ev.Kind = ChainEventSyncStall
+		log.Warnf("chain sync stalled at block %d since %s: dropped %d peers (%d banned), dialled %d boot nodes, %d peers left",
+			st.Height, st.Since.Format(time.RFC3339), st.Dropped, st.Banned, st.Redialed, st.Peers)
+	}
+	select {
+	case bw.chainEvents.alertChan() <- ev:
+	default:
+	}
+}
+
+func (h *chainEventHub) deliver(ev *ChainEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+//StartChainEvents decodes the new blocks and contract events, delivers them
+//to SubscribeChainEvents and, if [router] ChainEvents is set, publishes them
+//under ChainEventsURIPrefix
+func StartChainEvents(bw *BW) {
+	var cl *BosswaveClient
+	if bw.Config.Router.ChainEvents {
+		cl = bw.CreateClient(context.Background(), "CHAINEVENTS")
+		if err := cl.SetEntityObj(bw.Entity); err != nil {
+			log.Errorf("chain events: could not use router entity: %v", err)
+			cl = nil
+		}
+	}
+	var nsvks [][]byte
+	var nsfound time.Time
+	last := bw.BC().CurrentBlock()
+	heads := bw.BC().NewHeads(context.Background())
+	alerts := bw.chainEvents.alertChan()
+	for {
+		events := []*ChainEvent{}
+		select {
+		case ev := <-alerts:
+			events = append(events, ev)
+		case hdr, ok := <-heads:
+			if !ok {
+				return
+			}
+			current := hdr.Number.Uint64()
+			if current <= last {
+				//A reorg to a shorter or equal chain. The logs of the new
+				//blocks are picked up with the next head
+				last = current
+				continue
+			}
+			for n := last + 1; n <= current; n++ {
+				if h := bw.BC().GetHeader(n); h != nil {
+					events = append(events, blockEvent(h))
+				}
+			}
+			events = append(events, bw.contractEvents(int64(last+1), int64(current))...)
+			last = current
+		}
+		for _, ev := range events {
+			bw.chainEvents.deliver(ev)
+		}
+		if cl == nil {
+			continue
+		}
+		if time.Since(nsfound) > chainEventNamespaceInterval {
+			nsvks = nsvks[:0]
+			for _, nsvk := range bw.replicaNamespaces() {
+				if ok, err := bw.IsDesignatedRouterFor(nsvk); err == nil && ok {
+					nsvks = append(nsvks, nsvk)
+				}
+			}
+			nsfound = time.Now()
+		}
+		for _, ev := range events {
+			for _, nsvk := range nsvks {
+				bw.publishChainEvent(cl, nsvk, ev)
+			}
+		}
+	}
+}
+
+func blockEvent(h *types.Header) *ChainEvent {
+	return &ChainEvent{
+		Kind:  ChainEventBlock,
+		Block: h.Number.Uint64(),
+		Hash:  h.Hash().Hex(),
+		Time:  h.Time.Int64(),
+	}
+}
+
+//contractEvents decodes the events of the builtin contracts in the blocks
+//from since to until inclusive
+func (bw *BW) contractEvents(since int64, until int64) []*ChainEvent {
+	rv := []*ChainEvent{}
+	for _, name := range bc.ContractNames {
+		addr := common.Address(bc.ContractAddress(name))
+		lgs, err := bw.BC().FindLogsBetweenHeavy(context.Background(), since, until, addr, [][]common.Hash{})
+		if err != nil {
+			log.Warnf("chain events: could not scan the %s contract logs: %v", name, err)
+			continue
+		}
+		for _, lg := range lgs {
+			if ev := decodeContractEvent(lg); ev != nil {
+				rv = append(rv, ev)
+			}
+		}
+	}
+	return rv
+}
+
+//logBytes decodes the bytes argument at the start of a log's data
+func logBytes(lg bc.Log) []byte {
+	data := lg.Data()
+	if len(data) < 64 {
+		return nil
+	}
+	ln := new(big.Int).SetBytes(data[32:64])
+	if ln.BitLen() > 62 || ln.Int64() > int64(len(data)-64) {
+		return nil
+	}
+	return data[64 : 64+ln.Int64()]
+}
+
+func decodeContractEvent(lg bc.Log) *ChainEvent {
+	topics := lg.Topics()
+	if len(topics) < 2 {
+		return nil
+	}
+	txhash := lg.TxHash()
+	ev := &ChainEvent{Block: lg.BlockNumber(), Hash: "0x" + txhash.Hex()}
+	t1 := topics[1]
+	switch topics[0] {
+	case bc.HexToBytes32(bc.EventSig_Registry_NewDOT):
+		ev.Kind = ChainEventDOT
+		ev.Subject = crypto.FmtHash(t1[:])
+		if ro, err := objects.NewDOT(objects.ROAccessDOT, logBytes(lg)); err == nil {
+			dot := ro.(*objects.DOT)
+			ev.From = crypto.FmtKey(dot.GetGiverVK())
+			ev.To = crypto.FmtKey(dot.GetReceiverVK())
+			if dot.IsAccess() {
+				ev.URI = crypto.FmtKey(dot.GetAccessURIMVK()) + "/" + dot.GetAccessURISuffix()
+			}
+		}
+	case bc.HexToBytes32(bc.EventSig_Registry_NewEntity):
+		ev.Kind = ChainEventEntity
+		ev.Subject = crypto.FmtKey(t1[:])
+	case bc.HexToBytes32(bc.EventSig_Registry_NewDChain):
+		ev.Kind = ChainEventChain
+		ev.Subject = crypto.FmtHash(t1[:])
+	case bc.HexToBytes32(bc.EventSig_Registry_NewDOTRevocation):
+		ev.Kind = ChainEventDOTRevocation
+		ev.Subject = crypto.FmtHash(t1[:])
+	case bc.HexToBytes32(bc.EventSig_Registry_NewEntityRevocation):
+		ev.Kind = ChainEventEntityRevocation
+		ev.Subject = crypto.FmtKey(t1[:])
+	case bc.HexToBytes32(bc.EventSig_Alias_AliasCreated):
+		if len(topics) < 3 {
+			return nil
+		}
+		ev.Kind = ChainEventAlias
+		ev.Key = t1.Hex()
+		ev.Value = topics[2].Hex()
+	case bc.HexToBytes32(bc.EventSig_Alias_AliasUpdated), bc.HexToBytes32(bc.EventSig_Alias_AliasDeleted):
+		if len(topics) < 3 {
+			return nil
+		}
+		ev.Kind = ChainEventAliasUpdate
+		if topics[0] == bc.HexToBytes32(bc.EventSig_Alias_AliasDeleted) {
+			ev.Kind = ChainEventAliasDelete
+		}
+		ev.Key = t1.Hex()
+		ev.Value = topics[2].Hex()
+	case bc.HexToBytes32(bc.EventSig_Alias_AliasTransferred):
+		if len(topics) < 3 {
+			return nil
+		}
+		ev.Kind = ChainEventAliasTransfer
+		ev.Key = t1.Hex()
+		owner := bc.Address(common.BytesToAddress(topics[2][:]))
+		ev.Owner = owner.Hex()
+	case bc.HexToBytes32(bc.EventSig_Affinity_NewAffinityOffer):
+		if len(topics) < 3 {
+			return nil
+		}
+		ev.Kind = ChainEventAffinityOffer
+		ev.DRVK = crypto.FmtKey(t1[:])
+		ev.NSVK = crypto.FmtKey(topics[2][:])
+	case bc.HexToBytes32(bc.EventSig_Affinity_NewDesignatedRouter):
+		if len(topics) < 3 {
+			return nil
+		}
+		ev.Kind = ChainEventDesignatedRouter
+		ev.NSVK = crypto.FmtKey(t1[:])
+		ev.DRVK = crypto.FmtKey(topics[2][:])
+	case bc.HexToBytes32(bc.EventSig_Affinity_NewSRV):
+		ev.Kind = ChainEventSRV
+		ev.DRVK = crypto.FmtKey(t1[:])
+		ev.SRV = string(logBytes(lg))
+	default:
+		return nil
+	}
+	return ev
+}
+
+func (bw *BW) publishChainEvent(cl *BosswaveClient, nsvk []byte, ev *ChainEvent) {
+	blob, err := msgpack.Marshal(ev)
+	if err != nil {
+		log.Errorf("chain events: could not encode %s event: %v", ev.Kind, err)
+		return
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	suffix := ChainEventsURIPrefix + "/" + ev.Kind
+	cl.Publish(&PublishParams{
+		MVK:            nsvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("chain events: could not publish %s: %v", suffix, err)
+		}
+	})
+}
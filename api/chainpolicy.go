@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+)
+
+//DefaultMinTimeToExpiry is how long a chain must remain valid under the
+//default policy to be preferred over the others
+const DefaultMinTimeToExpiry = 15 * time.Minute
+
+//ChainPolicy decides which of the valid chains for a URI is used. Chains
+//are ordered best first by BuildChain and AutoChain uses the first one
+type ChainPolicy struct {
+	//A chain with a DOT expiring within this duration is only used if
+	//there is no other chain
+	MinTimeToExpiry time.Duration
+	//Chains through more of these VKs are preferred, before expiry and
+	//length are considered
+	PreferredIntermediaries [][]byte
+	//Prefer fewer hops over a later expiry. By default the chain that
+	//stays valid the longest is used, with fewer hops breaking ties
+	PreferShortest bool
+	//How long before a DOT in a chain in use expires the chain is
+	//rebuilt. Zero uses [clients] ChainRefresh, negative never rebuilds
+	RefreshBefore time.Duration
+}
+
+//DefaultChainPolicy is used when no policy is given
+var DefaultChainPolicy = ChainPolicy{MinTimeToExpiry: DefaultMinTimeToExpiry}
+
+//SetChainPolicy sets the policy used for the chains this client builds. A
+//nil policy restores DefaultChainPolicy
+func (c *BosswaveClient) SetChainPolicy(p *ChainPolicy) {
+	c.policymu.Lock()
+	c.policy = p
+	c.policymu.Unlock()
+}
+
+//GetChainPolicy returns the policy used for the chains this client builds
+func (c *BosswaveClient) GetChainPolicy() *ChainPolicy {
+	c.policymu.Lock()
+	defer c.policymu.Unlock()
+	if c.policy == nil {
+		return &DefaultChainPolicy
+	}
+	return c.policy
+}
+
+type rankedChain struct {
+	ch        *objects.DChain
+	expiry    time.Time
+	expires   bool
+	preferred int
+	//The chain ends in a DOT to everybody
+	public bool
+}
+
+type chainRanking struct {
+	p      *ChainPolicy
+	now    time.Time
+	chains []rankedChain
+}
+
+func (r *chainRanking) Len() int      { return len(r.chains) }
+func (r *chainRanking) Swap(i, j int) { r.chains[i], r.chains[j] = r.chains[j], r.chains[i] }
+func (r *chainRanking) Less(i, j int) bool {
+	a, b := &r.chains[i], &r.chains[j]
+	if a.public != b.public {
+		return b.public
+	}
+	asoon, bsoon := r.expiresSoon(a), r.expiresSoon(b)
+	if asoon != bsoon {
+		return bsoon
+	}
+	if a.preferred != b.preferred {
+		return a.preferred > b.preferred
+	}
+	ahops, bhops := a.ch.NumHashes(), b.ch.NumHashes()
+	if r.p.PreferShortest && ahops != bhops {
+		return ahops < bhops
+	}
+	if later(a, b) != later(b, a) {
+		return later(a, b)
+	}
+	return ahops < bhops
+}
+
+func (r *chainRanking) expiresSoon(c *rankedChain) bool {
+	return c.expires && c.expiry.Sub(r.now) < r.p.MinTimeToExpiry
+}
+
+//later is true if a stays valid for longer than b
+func later(a, b *rankedChain) bool {
+	if !a.expires || !b.expires {
+		return !a.expires && b.expires
+	}
+	return a.expiry.After(b.expiry)
+}
+
+//Order sorts chains best first. Chains that grant the permissions to
+//everybody come after those that grant them to the caller, whatever the
+//policy, so they are only used if there is no direct grant. Chains whose
+//DOTs are not elaborated are resolved to find their expiry, and a DOT that
+//cannot be resolved counts as expiring now
+func (p *ChainPolicy) Order(bw *BW, chains []*objects.DChain) []*objects.DChain {
+	r := &chainRanking{p: p, now: time.Now()}
+	for _, ch := range chains {
+		rc := rankedChain{ch: ch}
+		for i := 0; i < ch.NumHashes(); i++ {
+			d := ch.GetDOT(i)
+			if d == nil {
+				d, _, _ = bw.ResolveDOT(ch.GetDotHash(i))
+			}
+			if d == nil {
+				rc.expires = true
+				rc.expiry = r.now
+				break
+			}
+			if exp := d.GetExpiry(); exp != nil && (!rc.expires || exp.Before(rc.expiry)) {
+				rc.expires = true
+				rc.expiry = *exp
+			}
+			//The first DOT is given by the namespace, so its giver is not
+			//an intermediary
+			if i > 0 && p.isPreferred(d.GetGiverVK()) {
+				rc.preferred++
+			}
+			if i == ch.NumHashes()-1 && objects.IsEveryoneVK(d.GetReceiverVK()) {
+				rc.public = true
+			}
+		}
+		r.chains = append(r.chains, rc)
+	}
+	sort.Stable(r)
+	rv := make([]*objects.DChain, len(r.chains))
+	for i, rc := range r.chains {
+		rv[i] = rc.ch
+	}
+	return rv
+}
+
+func (p *ChainPolicy) isPreferred(vk []byte) bool {
+	for _, pvk := range p.PreferredIntermediaries {
+		if bytes.Equal(pvk, vk) {
+			return true
+		}
+	}
+	return false
+}
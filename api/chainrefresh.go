@@ -0,0 +1,244 @@
+package api
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+)
+
+//DefaultChainRefresh is how long before a DOT in a chain in use expires
+//the chain is rebuilt, if [clients] ChainRefresh is not set
+const DefaultChainRefresh = 6 * time.Hour
+
+//How often a client looks for chains that need rebuilding
+const chainRefreshInterval = 10 * time.Minute
+
+//A chain that has not been autochained for this long is no longer tracked
+const chainInUse = time.Hour
+
+//usedChain is the chain autochained messages on a URI last used
+type usedChain struct {
+	chain *objects.DChain
+	used  time.Time
+}
+
+//chainKey is the key in the built chain cache of the chains that grant
+//perms on mvk/suffix to target
+func chainKey(mvk []byte, suffix string, perms string, target []byte) CacheKey {
+	ck := CacheKey{uri: util.FullURI(mvk, suffix), perms: perms}
+	copy(ck.target[:], target)
+	copy(ck.nsvk[:], mvk)
+	return ck
+}
+
+//chainExpiry returns when the first DOT in ch expires, or false if none
+//do. A DOT that cannot be resolved counts as expiring now
+func (bw *BW) chainExpiry(ch *objects.DChain) (time.Time, bool) {
+	var rv time.Time
+	expires := false
+	for i := 0; i < ch.NumHashes(); i++ {
+		d := ch.GetDOT(i)
+		if d == nil {
+			d, _, _ = bw.ResolveDOT(ch.GetDotHash(i))
+		}
+		if d == nil {
+			return time.Now(), true
+		}
+		if exp := d.GetExpiry(); exp != nil && (!expires || exp.Before(rv)) {
+			rv, expires = *exp, true
+		}
+	}
+	return rv, expires
+}
+
+//forgetBuiltChain drops the chains cached under ck, so the next build
+//looks for new DOTs
+func (bw *BW) forgetBuiltChain(ck CacheKey) {
+	bw.getlock()
+	bw.evictChains([]interface{}{ck})
+	bw.rdata.chainLRU.remove(ck)
+	bw.rellock()
+}
+
+//noteUsedChain records the chain an autochained message used
+func (c *BosswaveClient) noteUsedChain(ck CacheKey, ch *objects.DChain) {
+	c.usedchainsmu.Lock()
+	c.usedchains[ck] = &usedChain{chain: ch, used: time.Now()}
+	c.usedchainsmu.Unlock()
+}
+
+//chainRefreshWindow is how long before a DOT expires the chains using it
+//are rebuilt, or zero if they are not
+func (c *BosswaveClient) chainRefreshWindow() time.Duration {
+	if rb := c.GetChainPolicy().RefreshBefore; rb != 0 {
+		if rb < 0 {
+			return 0
+		}
+		return rb
+	}
+	hours := c.bw.Config.Clients.ChainRefresh
+	if hours < 0 {
+		return 0
+	}
+	if hours == 0 {
+		return DefaultChainRefresh
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+//refreshChainsLoop rebuilds the chains of the client's publishes and
+//subscriptions before they expire, so that long running services are not
+//cut off when a DOT in their chain does, as long as a newer DOT has been
+//granted. It ends with the client
+func (c *BosswaveClient) refreshChainsLoop() {
+	ticker := time.NewTicker(chainRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if window := c.chainRefreshWindow(); window > 0 {
+				c.refreshChains(window, now)
+			}
+		}
+	}
+}
+
+//expiresWithin is true if ch has a DOT that expires before now+window
+func (c *BosswaveClient) expiresWithin(ch *objects.DChain, window time.Duration, now time.Time) bool {
+	exp, ok := c.bw.chainExpiry(ch)
+	return ok && exp.Before(now.Add(window))
+}
+
+//refreshChains rebuilds the chains in use that expire within window. The
+//next publish on a URI picks the new chain up from the cache, and
+//subscriptions are renewed with it
+func (c *BosswaveClient) refreshChains(window time.Duration, now time.Time) {
+	if c.GetUs() == nil {
+		return
+	}
+	c.usedchainsmu.Lock()
+	var stale []CacheKey
+	for ck, uc := range c.usedchains {
+		if now.Sub(uc.used) > chainInUse {
+			delete(c.usedchains, ck)
+		} else if c.expiresWithin(uc.chain, window, now) {
+			stale = append(stale, ck)
+		}
+	}
+	c.usedchainsmu.Unlock()
+	for _, ck := range stale {
+		ch := c.freshChain(ck, window, now)
+		if ch == nil || c.expiresWithin(ch, window, now) {
+			log.Warnf("no chain grants %s on %s for longer than %s", ck.perms, ck.uri, window)
+			continue
+		}
+		c.usedchainsmu.Lock()
+		if uc, ok := c.usedchains[ck]; ok {
+			uc.chain = ch
+		}
+		c.usedchainsmu.Unlock()
+	}
+
+	var subs []*Subscription
+	c.subsmu.Lock()
+	for _, s := range c.subs {
+		if s.autochained && s.Msg.PrimaryAccessChain != nil {
+			subs = append(subs, s)
+		}
+	}
+	c.subsmu.Unlock()
+	for _, s := range subs {
+		c.subsmu.Lock()
+		pac := s.Msg.PrimaryAccessChain
+		mvk, suffix := s.Msg.MVK, s.Msg.TopicSuffix
+		c.subsmu.Unlock()
+		if !c.expiresWithin(pac, window, now) {
+			continue
+		}
+		ck := chainKey(mvk, suffix, consumePerms(s.mtype, suffix), c.GetUs().GetVK())
+		ch := c.freshChain(ck, window, now)
+		if ch == nil {
+			log.Warnf("no chain grants %s on %s to renew a subscription", ck.perms, ck.uri)
+			continue
+		}
+		oldexp, _ := c.bw.chainExpiry(pac)
+		if newexp, ok := c.bw.chainExpiry(ch); ok && !newexp.After(oldexp) {
+			log.Warnf("no chain grants %s on %s for longer than %s", ck.perms, ck.uri, window)
+			continue
+		}
+		c.renewSubscription(s, ch)
+	}
+}
+
+//freshChain returns the best chain for ck, rebuilding it if the cached
+//chains expire within window
+func (c *BosswaveClient) freshChain(ck CacheKey, window time.Duration, now time.Time) *objects.DChain {
+	ch := c.bestChain(ck)
+	if ch != nil && !c.expiresWithin(ch, window, now) {
+		return ch
+	}
+	c.bw.forgetBuiltChain(ck)
+	return c.bestChain(ck)
+}
+
+//bestChain builds the chains for ck and returns the best under the
+//client's policy, or nil
+func (c *BosswaveClient) bestChain(ck CacheKey) *objects.DChain {
+	ch, err := c.BuildChain(&BuildChainParams{
+		To:          ck.target[:],
+		URI:         ck.uri,
+		Permissions: ck.perms,
+	})
+	if err != nil {
+		log.Infof("could not rebuild the chain for %s: %v", ck.uri, err)
+		return nil
+	}
+	rv := <-ch
+	go func() {
+		for _ = range ch {
+		}
+	}()
+	return rv
+}
+
+//renewSubscription subscribes again with pac, and once that succeeds
+//unsubscribes the old subscription from the router. The subscription keeps
+//its ID, and for a moment both may deliver the same message
+func (c *BosswaveClient) renewSubscription(s *Subscription, pac *objects.DChain) {
+	c.subsmu.Lock()
+	if c.subs[s.key] != s {
+		c.subsmu.Unlock()
+		return
+	}
+	old := s.UMid
+	p := *s.params
+	p.PrimaryAccessChain = pac
+	p.RoutingObjects = append([]objects.RoutingObject(nil), s.params.RoutingObjects...)
+	topic := s.Msg.Topic
+	c.subsmu.Unlock()
+	log.Infof("renewing subscription to %s with chain %s", topic, crypto.FmtHash(pac.GetChainHash()))
+	c.doSubscribe(&p, s.mtype, s, func(err error, id core.UniqueMessageID) {
+		if err != nil {
+			log.Warnf("could not renew the subscription to %s: %v", topic, err)
+			return
+		}
+		c.subsmu.Lock()
+		gone := c.subs[s.key] != s
+		c.subsmu.Unlock()
+		//If it was unsubscribed meanwhile, the new one must go too
+		if gone {
+			old = id
+		}
+		c.sendUnsubscribe(p.MVK, p.URISuffix, old, func(err error) {
+			if err != nil {
+				log.Infof("could not end the replaced subscription to %s: %v", topic, err)
+			}
+		})
+	}, s.deliver)
+}
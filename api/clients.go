@@ -0,0 +1,253 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//ClientQuota limits what one client of the agent may use, so that clients
+//acting as different entities can share an agent without one starving the
+//others. Zero means no limit
+type ClientQuota struct {
+	MaxSubscriptions int
+	//How many of the entries in the built chain cache may be this client's.
+	//Past that its own least recently used chains are evicted, rather than
+	//the chains of other clients
+	MaxCachedChains   int
+	MessagesPerSecond float64
+	//How many messages the client may publish at once
+	Burst int
+}
+
+//ClientInfo describes a client of the agent
+type ClientInfo struct {
+	ID   uint64
+	Name string
+	//nil if the client has not set an entity
+	VK            []byte
+	Connected     time.Time
+	Subscriptions int
+	Published     uint64
+	//The client's use of the built chain cache. Max is its quota
+	Chains CacheStats
+	Quota  ClientQuota
+}
+
+//clientRegistry holds the clients of the BW until their context is done
+type clientRegistry struct {
+	mu      sync.Mutex
+	seq     uint64
+	clients map[uint64]*BosswaveClient
+}
+
+//defaultClientQuota is the quota from the [clients] section of the config
+func (bw *BW) defaultClientQuota() ClientQuota {
+	cfg := bw.Config.Clients
+	return ClientQuota{
+		MaxSubscriptions:  cfg.MaxSubscriptions,
+		MaxCachedChains:   cfg.MaxCachedChains,
+		MessagesPerSecond: cfg.MessagesPerSecond,
+		Burst:             cfg.Burst,
+	}
+}
+
+//registerClient adds the client to the registry and removes it again once
+//its context is done
+func (bw *BW) registerClient(c *BosswaveClient) {
+	bw.clients.mu.Lock()
+	if bw.clients.clients == nil {
+		bw.clients.clients = make(map[uint64]*BosswaveClient)
+	}
+	bw.clients.seq++
+	c.id = bw.clients.seq
+	bw.clients.clients[c.id] = c
+	bw.clients.mu.Unlock()
+	go func() {
+		<-c.ctx.Done()
+		bw.clients.mu.Lock()
+		delete(bw.clients.clients, c.id)
+		bw.clients.mu.Unlock()
+	}()
+}
+
+//Clients returns the clients of the agent, including the router's own
+//internal clients, in the order they connected
+func (bw *BW) Clients() []ClientInfo {
+	bw.clients.mu.Lock()
+	cls := make([]*BosswaveClient, 0, len(bw.clients.clients))
+	for _, c := range bw.clients.clients {
+		cls = append(cls, c)
+	}
+	bw.clients.mu.Unlock()
+	rv := make([]ClientInfo, 0, len(cls))
+	for _, c := range cls {
+		rv = append(rv, c.Info())
+	}
+	sort.Sort(clientsByID(rv))
+	return rv
+}
+
+//Subscriptions returns the active subscriptions and taps on the router,
+//oldest first. If nsvk is not nil only those on that namespace are listed
+func (bw *BW) Subscriptions(nsvk []byte) []core.SubscriptionInfo {
+	prefix := ""
+	if nsvk != nil {
+		prefix = crypto.FmtKey(nsvk) + "/"
+	}
+	rv := []core.SubscriptionInfo{}
+	for _, s := range bw.tm.Subscriptions() {
+		if strings.HasPrefix(s.URI, prefix) {
+			rv = append(rv, s)
+		}
+	}
+	sort.Sort(subsByCreated(rv))
+	return rv
+}
+
+type subsByCreated []core.SubscriptionInfo
+
+func (s subsByCreated) Len() int           { return len(s) }
+func (s subsByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s subsByCreated) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+
+type clientsByID []ClientInfo
+
+func (s clientsByID) Len() int           { return len(s) }
+func (s clientsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s clientsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+//IsClientAdmin is true if the VK may list the clients of the agent: the
+//router's own VK and those in [clients] Admins
+func (bw *BW) IsClientAdmin(vk []byte) bool {
+	if vk == nil {
+		return false
+	}
+	if bytes.Equal(vk, bw.Entity.GetVK()) {
+		return true
+	}
+	for _, a := range strings.Split(bw.Config.Clients.Admins, ",") {
+		avk, err := crypto.UnFmtKey(strings.TrimSpace(a))
+		if err == nil && bytes.Equal(avk, vk) {
+			return true
+		}
+	}
+	return false
+}
+
+//ID identifies the client among the clients of the agent
+func (c *BosswaveClient) ID() uint64 {
+	return c.id
+}
+
+//Info describes the client
+func (c *BosswaveClient) Info() ClientInfo {
+	rv := ClientInfo{
+		ID:        c.id,
+		Name:      c.name,
+		Connected: c.connected,
+		Published: atomic.LoadUint64(&c.published),
+	}
+	if us := c.GetUs(); us != nil {
+		rv.VK = us.GetVK()
+	}
+	c.subsmu.Lock()
+	rv.Subscriptions = len(c.subs)
+	c.subsmu.Unlock()
+	c.quotamu.Lock()
+	rv.Quota = c.quota
+	rv.Chains = c.chainLRU.stats()
+	c.quotamu.Unlock()
+	return rv
+}
+
+//SetQuota replaces the client's quota, which starts as the one in the
+//[clients] section of the config. Subscriptions the client already has are
+//kept even if there are more than the new quota allows
+func (c *BosswaveClient) SetQuota(q ClientQuota) {
+	c.quotamu.Lock()
+	c.quota = q
+	c.chainLRU.max = q.MaxCachedChains
+	c.quotamu.Unlock()
+}
+
+//GetQuota returns the client's quota
+func (c *BosswaveClient) GetQuota() ClientQuota {
+	c.quotamu.Lock()
+	defer c.quotamu.Unlock()
+	return c.quota
+}
+
+//isRouter is true if the client acts as the router entity, like the
+//router's own internal clients. Quotas do not apply to it
+func (c *BosswaveClient) isRouter() bool {
+	us := c.GetUs()
+	return us != nil && bytes.Equal(us.GetVK(), c.bw.Entity.GetVK())
+}
+
+//checkSubscriptionQuota refuses a new subscription or tap if the client
+//already has as many as its quota allows
+func (c *BosswaveClient) checkSubscriptionQuota() error {
+	max := c.GetQuota().MaxSubscriptions
+	if max <= 0 || c.isRouter() {
+		return nil
+	}
+	c.subsmu.Lock()
+	n := len(c.subs)
+	c.subsmu.Unlock()
+	if n >= max {
+		return bwe.M(bwe.QuotaExceeded, fmt.Sprintf("client may only have %d subscriptions", max))
+	}
+	return nil
+}
+
+//checkPublishQuota takes a token from the client's message rate. Unlike
+//the per VK limit it applies to messages for other routers as well
+func (c *BosswaveClient) checkPublishQuota() error {
+	q := c.GetQuota()
+	if q.MessagesPerSecond > 0 && !c.isRouter() {
+		burst := float64(q.Burst)
+		if burst <= 0 {
+			burst = q.MessagesPerSecond
+		}
+		if !c.bw.ratelim.allow("client:"+strconv.FormatUint(c.id, 10), q.MessagesPerSecond, burst, time.Now()) {
+			return bwe.M(bwe.QuotaExceeded, fmt.Sprintf("client may only publish %v messages per second", q.MessagesPerSecond))
+		}
+	}
+	atomic.AddUint64(&c.published, 1)
+	return nil
+}
+
+//noteChainLookup counts a hit or miss in the built chain cache against the
+//client
+func (c *BosswaveClient) noteChainLookup(hit bool) {
+	c.quotamu.Lock()
+	if hit {
+		c.chainLRU.hits++
+	} else {
+		c.chainLRU.misses++
+	}
+	c.quotamu.Unlock()
+}
+
+//chargeChain records that the client cached chains under k, and returns
+//the keys of its own chains that must be evicted to keep it within its
+//quota. Another client with the same entity shares these entries, so it
+//may see them evicted as well
+func (c *BosswaveClient) chargeChain(k CacheKey) []interface{} {
+	if c.isRouter() {
+		return nil
+	}
+	c.quotamu.Lock()
+	defer c.quotamu.Unlock()
+	return c.chainLRU.add(k)
+}
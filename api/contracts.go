@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2bc/common"
+)
+
+//configureContracts points the builtin UFIs at the contracts configured in
+//[contracts "<chain id>"], if there is a section for this chain
+func (bw *BW) configureContracts() error {
+	chainID := bw.bchain.ChainID().Text(10)
+	cfg, ok := bw.Config.Contracts[chainID]
+	if !ok || cfg == nil {
+		return nil
+	}
+	cs := &bc.ContractSet{Addresses: map[string]bc.Address{}, CodeHashes: map[string]common.Hash{}}
+	for _, c := range []struct {
+		name, addr, hash string
+	}{
+		{bc.ContractRegistry, cfg.Registry, cfg.RegistryCodeHash},
+		{bc.ContractAlias, cfg.Alias, cfg.AliasCodeHash},
+		{bc.ContractAffinity, cfg.Affinity, cfg.AffinityCodeHash},
+	} {
+		if c.addr != "" {
+			if len(strings.TrimPrefix(c.addr, "0x")) != 40 {
+				return fmt.Errorf("bad %s address %q for chain %s", c.name, c.addr, chainID)
+			}
+			cs.Addresses[c.name] = bc.HexToAddress(c.addr)
+		}
+		if c.hash != "" {
+			if len(strings.TrimPrefix(c.hash, "0x")) != 64 {
+				return fmt.Errorf("bad %s code hash %q for chain %s", c.name, c.hash, chainID)
+			}
+			cs.CodeHashes[c.name] = common.HexToHash(c.hash)
+		}
+	}
+	bc.SetContracts(cs)
+	for _, name := range bc.ContractNames {
+		addr := bc.ContractAddress(name)
+		log.Infof("using the %s contract at 0x%s on chain %s", name, addr.Hex(), chainID)
+	}
+	return nil
+}
+
+//checkContracts logs a warning for each builtin contract that is missing or
+//does not match its expected code. The code is only there once the chain
+//has synced past the deployment, so this is worth repeating
+func (bw *BW) checkContracts() []bc.ContractStatus {
+	sts := bc.VerifyContracts(context.Background(), bw.bchain)
+	for _, st := range sts {
+		if st.Err != nil {
+			log.Warnf("builtin %s contract: %v", st.Name, st.Err)
+		}
+	}
+	return sts
+}
+
+//The chain must be at most this old (in seconds) before the contracts are
+//checked at startup
+const contractCheckMaxAge = 600
+
+//checkContractsWhenSynced checks the contracts once the chain has synced
+func (bw *BW) checkContractsWhenSynced() {
+	for bw.bchain.HeadBlockAge() > contractCheckMaxAge {
+		time.Sleep(30 * time.Second)
+	}
+	bw.checkContracts()
+}
+
+//VerifyContracts checks the builtin contracts against the chain, see
+//bc.VerifyContracts
+func (cl *BosswaveClient) VerifyContracts() []bc.ContractStatus {
+	return cl.bw.checkContracts()
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//How long discovered namespaces are kept if [dns] CacheTime is zero
+const defaultDNSCacheTime = time.Hour
+
+//Failed lookups are remembered for this long, so that names that are not
+//bw2 domains do not go to DNS every time they are resolved
+const dnsNegativeCacheTime = time.Minute
+
+//DNSNamespace is a namespace and its designated router as published in
+//DNS by a domain. The domain has a TXT record at _bw2.<domain> of
+//"bw2 ns=<nsvk> dr=<drvk>" and an SRV record at _bw2._tcp.<domain> for the
+//designated router
+type DNSNamespace struct {
+	Domain string
+	NSVK   []byte
+	DRVK   []byte
+	//host:port, empty if the domain has no SRV record
+	SRV     string
+	Fetched time.Time
+	//Whether the chain agrees that DRVK is the designated router of NSVK.
+	//Until the chain has synced this cannot be checked, and the records
+	//are used as they are
+	Verified bool
+}
+
+type dnsFailure struct {
+	err    error
+	failed time.Time
+}
+
+//dnsCache holds the namespaces discovered through DNS. Like the preloaded
+//snapshots it is only consulted when the chain does not answer
+type dnsCache struct {
+	mu       sync.Mutex
+	domains  map[string]*DNSNamespace
+	failures map[string]dnsFailure
+	// nsvk -> domain
+	namespaces map[bc.Bytes32]string
+	// drvk -> domain
+	routers map[bc.Bytes32]string
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		domains:    make(map[string]*DNSNamespace),
+		failures:   make(map[string]dnsFailure),
+		namespaces: make(map[bc.Bytes32]string),
+		routers:    make(map[bc.Bytes32]string),
+	}
+}
+
+func (bw *BW) dnsCacheTime() time.Duration {
+	if bw.Config.DNS.CacheTime > 0 {
+		return time.Duration(bw.Config.DNS.CacheTime) * time.Second
+	}
+	return defaultDNSCacheTime
+}
+
+//chainSynced is true if the chain is recent enough to be trusted over DNS
+func (bw *BW) chainSynced() bool {
+	age := bw.bchain.HeadBlockAge()
+	return age >= 0 && age <= contractCheckMaxAge
+}
+
+//discoverConfiguredDomains looks up the [dns] Domains so that their
+//namespaces can be routed before the chain has synced
+func (bw *BW) discoverConfiguredDomains() {
+	for _, d := range strings.Split(bw.Config.DNS.Domains, ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if _, err := bw.DiscoverNamespace(d); err != nil {
+			log.Warnf("Could not discover namespace for %s: %v", d, err)
+		}
+	}
+}
+
+//lookupDNSNamespace reads the bw2 TXT and SRV records of a domain
+func lookupDNSNamespace(domain string) (*DNSNamespace, error) {
+	txts, err := net.LookupTXT("_bw2." + domain)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.ResolutionFailed, "No bw2 TXT record", err)
+	}
+	rv := &DNSNamespace{Domain: domain, Fetched: time.Now()}
+	for _, txt := range txts {
+		fields := strings.Fields(txt)
+		if len(fields) == 0 || fields[0] != "bw2" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "ns":
+				rv.NSVK, err = crypto.UnFmtKey(kv[1])
+			case "dr":
+				rv.DRVK, err = crypto.UnFmtKey(kv[1])
+			}
+			if err != nil {
+				return nil, bwe.WrapM(bwe.ResolutionFailed, "Bad key in bw2 TXT record", err)
+			}
+		}
+		break
+	}
+	if rv.NSVK == nil || rv.DRVK == nil {
+		return nil, bwe.M(bwe.ResolutionFailed, "TXT record for "+domain+" does not have ns= and dr=")
+	}
+	//The SRV record is optional, the chain may have one for the router
+	_, srvs, err := net.LookupSRV("bw2", "tcp", domain)
+	if err == nil && len(srvs) > 0 {
+		host := strings.TrimSuffix(srvs[0].Target, ".")
+		rv.SRV = net.JoinHostPort(host, strconv.Itoa(int(srvs[0].Port)))
+	}
+	return rv, nil
+}
+
+//verifyDNSNamespace checks a discovered namespace against the affinity on
+//the chain. It returns false without an error if the chain has not synced
+//yet. Once it has, a namespace whose designated router is not on the chain
+//is rejected
+func (bw *BW) verifyDNSNamespace(ns *DNSNamespace) (bool, error) {
+	if !bw.chainSynced() {
+		return false, nil
+	}
+	drvk, err := bw.bchain.GetDesignatedRouterFor(context.Background(), ns.NSVK)
+	if err != nil {
+		return false, bwe.WrapM(bwe.AffinityMismatch, "Chain has no designated router for the namespace in DNS", err)
+	}
+	if !bytes.Equal(drvk, ns.DRVK) {
+		return false, bwe.M(bwe.AffinityMismatch, "DNS designated router for "+ns.Domain+" does not match the chain")
+	}
+	return true, nil
+}
+
+//DiscoverNamespace finds the namespace and designated router published by
+//a domain in DNS. Results are cached for [dns] CacheTime seconds. Once the
+//chain has synced, only records that match the designated router on the
+//chain are returned
+func (bw *BW) DiscoverNamespace(domain string) (*DNSNamespace, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	dc := bw.dns
+	dc.mu.Lock()
+	ns, ok := dc.domains[domain]
+	if ok && time.Now().Sub(ns.Fetched) > bw.dnsCacheTime() {
+		ok = false
+	}
+	fail, failed := dc.failures[domain]
+	dc.mu.Unlock()
+	if !ok {
+		if failed && time.Now().Sub(fail.failed) < dnsNegativeCacheTime {
+			return nil, fail.err
+		}
+		var err error
+		ns, err = lookupDNSNamespace(domain)
+		if err != nil {
+			dc.mu.Lock()
+			dc.failures[domain] = dnsFailure{err: err, failed: time.Now()}
+			dc.mu.Unlock()
+			return nil, err
+		}
+	}
+	if !ns.Verified {
+		verified, err := bw.verifyDNSNamespace(ns)
+		if err != nil {
+			log.Warnf("Rejecting DNS namespace for %s: %v", domain, err)
+			bw.forgetDNSNamespace(domain)
+			dc.mu.Lock()
+			dc.failures[domain] = dnsFailure{err: err, failed: time.Now()}
+			dc.mu.Unlock()
+			return nil, err
+		}
+		if verified {
+			//Entries are shared, so verify a copy
+			cp := *ns
+			cp.Verified = true
+			ns = &cp
+		}
+	}
+	dc.mu.Lock()
+	dc.domains[domain] = ns
+	delete(dc.failures, domain)
+	dc.namespaces[bc.SliceToBytes32(ns.NSVK)] = domain
+	dc.routers[bc.SliceToBytes32(ns.DRVK)] = domain
+	dc.mu.Unlock()
+	cp := *ns
+	return &cp, nil
+}
+
+func (bw *BW) forgetDNSNamespace(domain string) {
+	dc := bw.dns
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	ns, ok := dc.domains[domain]
+	if !ok {
+		return
+	}
+	delete(dc.domains, domain)
+	if dc.namespaces[bc.SliceToBytes32(ns.NSVK)] == domain {
+		delete(dc.namespaces, bc.SliceToBytes32(ns.NSVK))
+	}
+	if dc.routers[bc.SliceToBytes32(ns.DRVK)] == domain {
+		delete(dc.routers, bc.SliceToBytes32(ns.DRVK))
+	}
+}
+
+//DNSNamespaces returns the namespaces that have been discovered through DNS
+func (bw *BW) DNSNamespaces() []DNSNamespace {
+	dc := bw.dns
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	rv := make([]DNSNamespace, 0, len(dc.domains))
+	for _, ns := range dc.domains {
+		rv = append(rv, *ns)
+	}
+	return rv
+}
+
+//dnsDesignatedRouter is the designated router of a namespace that was
+//discovered through DNS
+func (bw *BW) dnsDesignatedRouter(nsvk []byte) ([]byte, bool) {
+	bw.dns.mu.Lock()
+	domain, ok := bw.dns.namespaces[bc.SliceToBytes32(nsvk)]
+	bw.dns.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	ns, err := bw.DiscoverNamespace(domain)
+	if err != nil || !bytes.Equal(ns.NSVK, nsvk) {
+		return nil, false
+	}
+	return ns.DRVK, true
+}
+
+//dnsSRV is the SRV record of a designated router that was discovered
+//through DNS
+func (bw *BW) dnsSRV(drvk []byte) (string, bool) {
+	bw.dns.mu.Lock()
+	domain, ok := bw.dns.routers[bc.SliceToBytes32(drvk)]
+	bw.dns.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	ns, err := bw.DiscoverNamespace(domain)
+	if err != nil || !bytes.Equal(ns.DRVK, drvk) || ns.SRV == "" {
+		return "", false
+	}
+	return ns.SRV, true
+}
+
+//dnsNamespaceKey resolves a domain name used in place of a namespace VK
+func (bw *BW) dnsNamespaceKey(name string) ([]byte, bool) {
+	if !strings.Contains(name, ".") || strings.ContainsAny(name, "@[]/") {
+		return nil, false
+	}
+	ns, err := bw.DiscoverNamespace(name)
+	if err != nil {
+		return nil, false
+	}
+	return ns.NSVK, true
+}
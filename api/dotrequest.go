@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//DOTRequest is the msgpack payload of a message persisted on
+//$dotrequest/<granter>/<requester>, in the namespace of the URI, asking the
+//granter for an access DOT. Free paths can be read by anyone, so requests
+//are public
+type DOTRequest struct {
+	//A URI suffix in the namespace the request is persisted on
+	URI   string `msgpack:"uri"`
+	Perms string `msgpack:"perms"`
+	TTL   int    `msgpack:"ttl"`
+	//The DOT's expiry in unix nanoseconds, zero to leave it to the granter
+	Expiry  int64  `msgpack:"expiry"`
+	Comment string `msgpack:"comment"`
+	//Unix nanoseconds
+	Created int64 `msgpack:"created"`
+}
+
+//PendingDOTRequest is a DOTRequest found by ListDOTRequests
+type PendingDOTRequest struct {
+	DOTRequest
+	MVK       []byte
+	Granter   []byte
+	Requester []byte
+}
+
+//dotRequestSuffix is where requester's request to granter is persisted
+func dotRequestSuffix(granter []byte, requester []byte) string {
+	return util.DOTRequestURIPrefix + "/" + crypto.FmtKey(granter) + "/" + crypto.FmtKey(requester)
+}
+
+//check returns an error unless the request could become a DOT
+func (r *DOTRequest) check() error {
+	if _, _, _, err := util.AnalyzeSuffixDetailed(r.URI); err != nil {
+		return bwe.WrapC(bwe.BadURI, err)
+	}
+	if util.IsFreePath(r.URI) {
+		return bwe.M(bwe.BadURI, "DOTs cannot grant free paths")
+	}
+	if objects.GetADPSFromPermString(r.Perms) == nil {
+		return bwe.M(bwe.BadPermissions, "Permission string is invalid")
+	}
+	if r.TTL < 0 || r.TTL > 255 {
+		return bwe.M(bwe.BadOperation, "ttl out of range")
+	}
+	return nil
+}
+
+//RequestDOT persists a request for an access DOT from granter on a URI in
+//the namespace mvk, replacing any earlier request the client's entity made
+//to granter there. The granter finds it with ListDOTRequests
+func (c *BosswaveClient) RequestDOT(mvk []byte, granter []byte, req *DOTRequest, cb PublishCallback) {
+	if c.GetUs() == nil {
+		cb(bwe.M(bwe.NoEntity, "No entity set"))
+		return
+	}
+	if len(granter) != 32 {
+		cb(bwe.M(bwe.InvalidSlice, "granter VK is bad"))
+		return
+	}
+	if err := req.check(); err != nil {
+		cb(err)
+		return
+	}
+	req.Created = time.Now().UnixNano()
+	po, err := advpo.CreateMsgPackPayloadObject(objects.PONumMsgPack, req)
+	if err != nil {
+		cb(err)
+		return
+	}
+	c.Publish(&PublishParams{
+		MVK:            mvk,
+		URISuffix:      dotRequestSuffix(granter, c.GetUs().GetVK()),
+		PayloadObjects: []objects.PayloadObject{po},
+		Persist:        true,
+	}, cb)
+}
+
+//ListDOTRequests returns the pending requests for DOTs from the client's
+//entity in the namespace mvk. Malformed requests are left out
+func (c *BosswaveClient) ListDOTRequests(mvk []byte) ([]*PendingDOTRequest, error) {
+	if c.GetUs() == nil {
+		return nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	return c.queryDOTRequests(mvk, util.DOTRequestURIPrefix+"/"+crypto.FmtKey(c.GetUs().GetVK())+"/+")
+}
+
+func (c *BosswaveClient) queryDOTRequests(mvk []byte, suffix string) ([]*PendingDOTRequest, error) {
+	rv := []*PendingDOTRequest{}
+	done := make(chan error, 1)
+	c.Query(&QueryParams{
+		MVK:       mvk,
+		URISuffix: suffix,
+	}, func(err error) {
+		if err != nil {
+			done <- err
+		}
+	}, func(m *core.Message) {
+		if m == nil {
+			done <- nil
+			return
+		}
+		if pr := loadDOTRequest(m); pr != nil {
+			rv = append(rv, pr)
+		} else {
+			log.Infof("ignoring malformed DOT request on %s", m.Topic)
+		}
+	})
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func loadDOTRequest(m *core.Message) *PendingDOTRequest {
+	granter, requester, ok := util.DOTRequestPath(m.TopicSuffix)
+	if !ok {
+		return nil
+	}
+	rv := &PendingDOTRequest{MVK: m.MVK}
+	var err error
+	if rv.Granter, err = crypto.UnFmtKey(granter); err != nil {
+		return nil
+	}
+	if rv.Requester, err = crypto.UnFmtKey(requester); err != nil {
+		return nil
+	}
+	for _, po := range m.PayloadObjects {
+		if po.GetPONum() == objects.PONumMsgPack {
+			if msgpack.Unmarshal(po.GetContent(), &rv.DOTRequest) != nil || rv.check() != nil {
+				return nil
+			}
+			return rv
+		}
+	}
+	return nil
+}
+
+//ApproveDOTRequestParams describes the approval of a DOT request made to
+//the client's entity. The DOT's fields are those asked for unless they are
+//overridden
+type ApproveDOTRequestParams struct {
+	MVK       []byte
+	Requester []byte
+	//Overrides, nil to keep what was asked for
+	AccessPermissions *string
+	TTL               *int
+	Expiry            *time.Time
+	ExpiryDelta       *time.Duration
+	Comment           *string
+	Contact           string
+	Revokers          [][]byte
+	//The account of the client's entity that pays for publishing
+	Account     int
+	Interaction *bc.InteractionParams
+}
+
+//ApproveDOTRequest grants the DOT a pending request asks for, publishes
+//it, and then deletes the request
+func (c *BosswaveClient) ApproveDOTRequest(ctx context.Context, p *ApproveDOTRequestParams) (*objects.DOT, *bc.TxResult, error) {
+	if c.GetUs() == nil || c.BCC() == nil {
+		return nil, nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	reqs, err := c.queryDOTRequests(p.MVK, dotRequestSuffix(c.GetUs().GetVK(), p.Requester))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, nil, bwe.M(bwe.BadOperation, "no pending DOT request from "+crypto.FmtKey(p.Requester))
+	}
+	req := reqs[0]
+	cp := &CreateDOTParams{
+		To:                req.Requester,
+		TTL:               uint8(req.TTL),
+		Expiry:            p.Expiry,
+		ExpiryDelta:       p.ExpiryDelta,
+		Contact:           p.Contact,
+		Comment:           req.Comment,
+		Revokers:          p.Revokers,
+		URISuffix:         req.URI,
+		MVK:               req.MVK,
+		AccessPermissions: req.Perms,
+	}
+	if p.AccessPermissions != nil {
+		cp.AccessPermissions = *p.AccessPermissions
+	}
+	if p.TTL != nil {
+		if *p.TTL < 0 || *p.TTL > 255 {
+			return nil, nil, bwe.M(bwe.BadOperation, "ttl out of range")
+		}
+		cp.TTL = uint8(*p.TTL)
+	}
+	if p.Comment != nil {
+		cp.Comment = *p.Comment
+	}
+	if cp.Expiry == nil && cp.ExpiryDelta == nil && req.Expiry != 0 {
+		t := time.Unix(0, req.Expiry)
+		cp.Expiry = &t
+	}
+	dot, err := c.CreateDOT(cp)
+	if err != nil {
+		return nil, nil, err
+	}
+	var res *bc.TxResult
+	published := make(chan error, 1)
+	c.BCC().WithInteractionParams(p.Interaction).PublishDOT(ctx, p.Account, dot, func(r *bc.TxResult, err error) {
+		res = r
+		published <- err
+	})
+	if err := <-published; err != nil {
+		return nil, nil, err
+	}
+	//The DOT is granted, so failing to tidy up is not an error
+	if err := c.RemoveDOTRequest(p.MVK, p.Requester); err != nil {
+		log.Warnf("could not delete approved DOT request from %s: %v", crypto.FmtKey(p.Requester), err)
+	}
+	return dot, res, nil
+}
+
+//RemoveDOTRequest deletes the pending request from requester to the
+//client's entity, rejecting it
+func (c *BosswaveClient) RemoveDOTRequest(mvk []byte, requester []byte) error {
+	if c.GetUs() == nil {
+		return bwe.M(bwe.NoEntity, "No entity set")
+	}
+	done := make(chan error, 1)
+	c.Delete(&DeleteParams{
+		MVK:       mvk,
+		URISuffix: dotRequestSuffix(c.GetUs().GetVK(), requester),
+	}, func(err error) {
+		done <- err
+	})
+	return <-done
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+const drCheckTimeout = 10 * time.Second
+
+//DRHealth is the result of a designated router health check
+type DRHealth struct {
+	Checked time.Time
+	//The SRV record on the chain for this router
+	SRV string
+	//This router's public IP, as reported by the PublicIPService
+	PublicIP string
+	//Whether dialing the SRV record reached this router
+	Reachable bool
+	//How long it took to connect and verify the router's proof
+	Latency  time.Duration
+	Problems []string
+	//The last automatic SRV update, if there has been one
+	UpdatedSRV    string
+	Updated       time.Time
+	UpdateErr     string
+	UpdatePending bool
+}
+
+type drMonitor struct {
+	mu      sync.Mutex
+	running bool
+	last    *DRHealth
+	//Kept across checks
+	updatedSRV    string
+	updated       time.Time
+	updateErr     string
+	updatePending bool
+}
+
+//StartDRMonitor periodically checks that the SRV record for the router
+//entity reaches this router, and updates the record if configured to. It
+//does nothing if the check interval is zero
+func StartDRMonitor(bw *BW) {
+	if bw.Config.DR.CheckInterval <= 0 {
+		return
+	}
+	interval := time.Duration(bw.Config.DR.CheckInterval) * time.Second
+	bw.drmon.mu.Lock()
+	bw.drmon.running = true
+	bw.drmon.mu.Unlock()
+	log.Infof("DR monitor checking every %s", interval)
+	for {
+		h := bw.CheckDRHealth()
+		if len(h.Problems) != 0 {
+			log.Warnf("DR health check: %s", strings.Join(h.Problems, "; "))
+		}
+		time.Sleep(interval)
+	}
+}
+
+//DRHealth returns the last health check, or nil if there has not been one
+func (bw *BW) DRHealth() *DRHealth {
+	bw.drmon.mu.Lock()
+	defer bw.drmon.mu.Unlock()
+	return bw.drmon.last
+}
+
+//DRMonitorRunning returns true if the router is checking its health
+//periodically
+func (bw *BW) DRMonitorRunning() bool {
+	bw.drmon.mu.Lock()
+	defer bw.drmon.mu.Unlock()
+	return bw.drmon.running
+}
+
+//advertisePort is the port that the SRV record should have
+func (bw *BW) advertisePort() string {
+	if bw.Config.DR.AdvertisePort != 0 {
+		return strconv.Itoa(bw.Config.DR.AdvertisePort)
+	}
+	_, port, err := net.SplitHostPort(bw.Config.Native.ListenOn)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+func lookupPublicIP(service string) (string, error) {
+	cl := http.Client{Timeout: drCheckTimeout}
+	resp, err := cl.Get(service)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", bwe.M(bwe.BadOperation, "public IP service returned "+resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", bwe.M(bwe.BadOperation, "public IP service did not return an IP")
+	}
+	return ip.String(), nil
+}
+
+//CheckDRHealth checks that the router's SRV record resolves to its public
+//IP and that dialing it reaches this router. If the monitor is running
+//with AutoUpdateSRV, a stale record is replaced
+func (bw *BW) CheckDRHealth() *DRHealth {
+	h := &DRHealth{Checked: time.Now()}
+	vk := bw.Entity.GetVK()
+	if bw.Config.DR.PublicIPService != "" {
+		ip, err := lookupPublicIP(bw.Config.DR.PublicIPService)
+		if err != nil {
+			h.Problems = append(h.Problems, "could not get public IP: "+err.Error())
+		} else {
+			h.PublicIP = ip
+		}
+	}
+	srv, err := bw.LookupDesignatedRouterSRV(vk)
+	if err != nil {
+		h.Problems = append(h.Problems, "no SRV record: "+err.Error())
+	} else {
+		h.SRV = srv
+	}
+
+	//Whether the SRV record can be replaced with the public IP. A missing
+	//record is not, as the lookup can also fail when the chain is not
+	//synced. The first record is set by the operator
+	stale := false
+	if h.SRV != "" {
+		host, _, err := net.SplitHostPort(h.SRV)
+		if err != nil {
+			h.Problems = append(h.Problems, "SRV record is not host:port")
+			stale = true
+		} else if net.ParseIP(host) != nil {
+			if h.PublicIP != "" && !net.ParseIP(host).Equal(net.ParseIP(h.PublicIP)) {
+				h.Problems = append(h.Problems, "SRV record is not the public IP "+h.PublicIP)
+				stale = true
+			}
+		} else {
+			addrs, err := net.LookupHost(host)
+			if err != nil {
+				h.Problems = append(h.Problems, "SRV host does not resolve: "+err.Error())
+			} else if h.PublicIP != "" {
+				found := false
+				for _, a := range addrs {
+					if net.ParseIP(a).Equal(net.ParseIP(h.PublicIP)) {
+						found = true
+					}
+				}
+				if !found {
+					//We don't rewrite hostnames, they are probably dynamic DNS
+					h.Problems = append(h.Problems, "SRV host does not resolve to the public IP "+h.PublicIP)
+				}
+			}
+		}
+		//If we are behind NAT without hairpinning this can fail even though
+		//the internet can reach us
+		then := time.Now()
+		conn, err := dialPeer(h.SRV, vk, drCheckTimeout)
+		if err != nil {
+			h.Problems = append(h.Problems, "SRV record does not reach this router: "+err.Error())
+		} else {
+			h.Latency = time.Now().Sub(then)
+			h.Reachable = true
+			conn.Close()
+		}
+	}
+
+	bw.drmon.mu.Lock()
+	defer bw.drmon.mu.Unlock()
+	//A standby with the primary's entity must not take over the SRV
+	//record until it is promoted
+	if stale && bw.drmon.running && bw.Config.DR.AutoUpdateSRV && h.PublicIP != "" && !bw.drmon.updatePending && !bw.Following() {
+		if port := bw.advertisePort(); port != "" {
+			newsrv := net.JoinHostPort(h.PublicIP, port)
+			bw.drmon.updatePending = true
+			bw.drmon.updatedSRV = newsrv
+			go bw.updateSRV(newsrv)
+		} else {
+			h.Problems = append(h.Problems, "cannot update SRV record: no port to advertise")
+		}
+	}
+	h.UpdatedSRV = bw.drmon.updatedSRV
+	h.Updated = bw.drmon.updated
+	h.UpdateErr = bw.drmon.updateErr
+	h.UpdatePending = bw.drmon.updatePending
+	bw.drmon.last = h
+	return h
+}
+
+//updateSRV publishes a new SRV record for the router entity
+func (bw *BW) updateSRV(srv string) {
+	log.Infof("DR monitor updating SRV record to %s", srv)
+	done := func(err error) {
+		bw.drmon.mu.Lock()
+		defer bw.drmon.mu.Unlock()
+		bw.drmon.updatePending = false
+		bw.drmon.updated = time.Now()
+		if err != nil {
+			log.Errorf("DR monitor could not update SRV record: %v", err)
+			bw.drmon.updateErr = err.Error()
+		} else {
+			bw.drmon.updateErr = ""
+		}
+	}
+	//The chain calls panic on some failures, which should not take the
+	//router down
+	defer func() {
+		if r := recover(); r != nil {
+			done(bwe.M(bwe.BlockChainGenericError, "SRV update failed"))
+		}
+	}()
+	bcc := bw.BC().GetClient(bw.Entity)
+	bcc.CreateSRVRecord(context.Background(), bw.Config.DR.Account, bw.Entity, srv, done)
+}
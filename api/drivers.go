@@ -0,0 +1,367 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+)
+
+const (
+	//How long a driver that crashed waits before it is started again. It
+	//doubles with each crash, up to driverRestartMax, and is reset once the
+	//driver has run for driverRestartMax
+	driverRestartMin = time.Second
+	driverRestartMax = 5 * time.Minute
+	//How often the health of a running driver is checked
+	driverHealthInterval = 30 * time.Second
+)
+
+//A Service is a driver that runs inside the router, such as the driver of
+//a device, configured in a [driver "name"] section. Start is given a
+//client with the driver's entity, and returns once the service is running.
+//Stop must end everything it started. A panic in Start, Stop or Health, or
+//in a function run with the client's RunIsolated, stops the service and
+//starts it again with a new client after a delay, without taking the router
+//down
+type Service interface {
+	Start(cl *BosswaveClient) error
+	Stop()
+}
+
+//HealthReporter is implemented by services that can tell whether they are
+//working, e.g. whether they can reach their device. A running service whose
+//Health returns an error is reported as unhealthy, but not restarted
+type HealthReporter interface {
+	Health() error
+}
+
+//A ServiceFactory makes a service from the Param lines of its config
+//section, as key=value
+type ServiceFactory func(params map[string]string) (Service, error)
+
+var serviceKindsMu sync.Mutex
+var serviceKinds = make(map[string]ServiceFactory)
+
+//RegisterService makes a kind of service usable as the Kind of [driver]
+//sections. It must be called before StartDrivers, e.g. from an init
+//function of the driver's package, and replaces any kind of the same name
+func RegisterService(kind string, f ServiceFactory) {
+	serviceKindsMu.Lock()
+	serviceKinds[kind] = f
+	serviceKindsMu.Unlock()
+}
+
+//Driver states
+const (
+	DriverStarting  = "starting"
+	DriverRunning   = "running"
+	DriverUnhealthy = "unhealthy"
+	DriverCrashed   = "crashed"
+	DriverStopped   = "stopped"
+)
+
+//DriverStatus is one of the list persisted at $router/drivers
+type DriverStatus struct {
+	Name  string `msgpack:"name"`
+	Kind  string `msgpack:"kind"`
+	VK    string `msgpack:"vk"`
+	State string `msgpack:"state"`
+	//Why it crashed or is unhealthy
+	Error    string `msgpack:"error"`
+	Restarts int    `msgpack:"restarts"`
+	//When it entered the state, in nanoseconds since the epoch
+	Since int64 `msgpack:"since"`
+}
+
+type driver struct {
+	bw      *BW
+	ent     *objects.Entity
+	factory ServiceFactory
+	params  map[string]string
+
+	mu      sync.Mutex
+	status  DriverStatus
+	stopped bool
+	stop    chan struct{}
+}
+
+//driverRun is one run of a driver's service, from Start until it crashes
+//or is stopped. A panic in a goroutine left over from an earlier run does
+//not end a later one
+type driverRun struct {
+	d       *driver
+	crashed chan struct{}
+	once    sync.Once
+	err     error
+}
+
+type driverHost struct {
+	mu      sync.Mutex
+	drivers []*driver
+}
+
+//StartDrivers starts the services in the [driver "name"] sections of the
+//config. Each gets its own client, with the entity in the key file Entity
+//or the router's if that is empty, so that its permissions can be scoped by
+//DOTs to what the driver needs. Each Param line is key=value
+func StartDrivers(bw *BW) {
+	if len(bw.Config.Driver) == 0 {
+		return
+	}
+	serviceKindsMu.Lock()
+	defer serviceKindsMu.Unlock()
+	for name, cfg := range bw.Config.Driver {
+		if cfg == nil {
+			continue
+		}
+		d, err := newDriver(bw, name, cfg.Kind, cfg.Entity, cfg.Param)
+		if err != nil {
+			log.Errorf("driver %s: %v", name, err)
+			continue
+		}
+		bw.drivers.mu.Lock()
+		bw.drivers.drivers = append(bw.drivers.drivers, d)
+		bw.drivers.mu.Unlock()
+		go d.run()
+	}
+}
+
+//newDriver sets up a driver. The service kinds are locked
+func newDriver(bw *BW, name string, kind string, entity string, params []string) (*driver, error) {
+	factory, ok := serviceKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown Kind %q", kind)
+	}
+	d := &driver{
+		bw:      bw,
+		ent:     bw.Entity,
+		factory: factory,
+		params:  make(map[string]string),
+		stop:    make(chan struct{}),
+		status:  DriverStatus{Name: name, Kind: kind, State: DriverStarting, Since: time.Now().UnixNano()},
+	}
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Param %q is not key=value", p)
+		}
+		d.params[kv[0]] = kv[1]
+	}
+	if entity != "" {
+		ent, err := loadDriverEntity(entity)
+		if err != nil {
+			return nil, fmt.Errorf("could not load entity: %v", err)
+		}
+		d.ent = ent
+	}
+	d.status.VK = crypto.FmtKey(d.ent.GetVK())
+	return d, nil
+}
+
+func loadDriverEntity(fname string) (*objects.Entity, error) {
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	kf, err := objects.DecodeKeyFile(contents, []byte(os.Getenv(objects.KeyFilePassphraseEnv)))
+	if err != nil {
+		return nil, err
+	}
+	ro, err := objects.NewEntity(kf.RONum, kf.Content)
+	if err != nil {
+		return nil, err
+	}
+	ent, ok := ro.(*objects.Entity)
+	if !ok || ent.GetSK() == nil {
+		return nil, fmt.Errorf("not an entity with its key")
+	}
+	return ent, nil
+}
+
+func (d *driver) setState(state string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status.State != state {
+		d.status.Since = time.Now().UnixNano()
+	}
+	d.status.State = state
+	d.status.Error = ""
+	if err != nil {
+		d.status.Error = err.Error()
+	}
+}
+
+//crash ends the run. Only the first crash is recorded
+func (r *driverRun) crash(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.crashed)
+	})
+}
+
+//isolate runs f, turning a panic into a crash of the run
+func (r *driverRun) isolate(what string, f func()) (ok bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("driver %s: panic in %s: %v\n%s", r.d.status.Name, what, p, debug.Stack())
+			r.crash(fmt.Errorf("panic in %s: %v", what, p))
+			ok = false
+		}
+	}()
+	f()
+	return true
+}
+
+//run starts the service, and starts it again whenever it crashes, until
+//the driver is stopped
+func (d *driver) run() {
+	backoff := driverRestartMin
+	for {
+		started := time.Now()
+		err := d.runOnce()
+		if err == nil {
+			d.setState(DriverStopped, nil)
+			return
+		}
+		if time.Since(started) > driverRestartMax {
+			backoff = driverRestartMin
+		}
+		log.Warnf("driver %s crashed, restarting in %s: %v", d.status.Name, backoff, err)
+		d.mu.Lock()
+		d.status.Restarts++
+		d.mu.Unlock()
+		d.setState(DriverCrashed, err)
+		select {
+		case <-d.stop:
+			d.setState(DriverStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > driverRestartMax {
+			backoff = driverRestartMax
+		}
+	}
+}
+
+//runOnce runs the service until it crashes, returning why, or until the
+//driver is stopped, returning nil
+func (d *driver) runOnce() error {
+	d.mu.Lock()
+	stopped := d.stopped
+	d.mu.Unlock()
+	if stopped {
+		return nil
+	}
+	d.setState(DriverStarting, nil)
+	run := &driverRun{d: d, crashed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cl := d.bw.CreateClient(ctx, "DRIVER:"+d.status.Name)
+	cl.driver = run
+	if err := cl.SetEntityObj(d.ent); err != nil {
+		return err
+	}
+	var svc Service
+	var err error
+	if !run.isolate("the factory", func() { svc, err = d.factory(d.params) }) {
+		return run.err
+	}
+	if err != nil {
+		return err
+	}
+	if !run.isolate("Start", func() { err = svc.Start(cl) }) {
+		run.isolate("Stop", svc.Stop)
+		return run.err
+	}
+	if err != nil {
+		return err
+	}
+	d.setState(DriverRunning, nil)
+	health, _ := svc.(HealthReporter)
+	ticker := time.NewTicker(driverHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			run.isolate("Stop", svc.Stop)
+			return nil
+		case <-run.crashed:
+			run.isolate("Stop", svc.Stop)
+			return run.err
+		case <-ticker.C:
+			if health == nil {
+				continue
+			}
+			var herr error
+			run.isolate("Health", func() { herr = health.Health() })
+			if herr != nil {
+				d.setState(DriverUnhealthy, herr)
+			} else {
+				d.setState(DriverRunning, nil)
+			}
+		}
+	}
+}
+
+//RunIsolated runs f in a new goroutine. If the client belongs to a driver,
+//a panic in f stops the driver's service and restarts it, instead of taking
+//the router down. Services should start their goroutines with it
+func (c *BosswaveClient) RunIsolated(f func()) {
+	run := c.driver
+	if run == nil {
+		go f()
+		return
+	}
+	go run.isolate("a goroutine", f)
+}
+
+//DriverStatuses returns the state of each driver, in the order they
+//were started
+func (bw *BW) DriverStatuses() []DriverStatus {
+	bw.drivers.mu.Lock()
+	defer bw.drivers.mu.Unlock()
+	rv := make([]DriverStatus, 0, len(bw.drivers.drivers))
+	for _, d := range bw.drivers.drivers {
+		d.mu.Lock()
+		rv = append(rv, d.status)
+		d.mu.Unlock()
+	}
+	return rv
+}
+
+//stopDrivers stops every driver and waits up to timeout for their services
+//to stop
+func (bw *BW) stopDrivers(timeout time.Duration) {
+	bw.drivers.mu.Lock()
+	drivers := append([]*driver{}, bw.drivers.drivers...)
+	bw.drivers.mu.Unlock()
+	for _, d := range drivers {
+		d.mu.Lock()
+		if !d.stopped {
+			d.stopped = true
+			close(d.stop)
+		}
+		d.mu.Unlock()
+	}
+	deadline := time.Now().Add(timeout)
+	for _, d := range drivers {
+		for time.Now().Before(deadline) {
+			d.mu.Lock()
+			state := d.status.State
+			d.mu.Unlock()
+			if state == DriverStopped {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
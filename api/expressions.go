@@ -1,8 +1,14 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
 
 	"github.com/immesys/bw2/crypto"
 )
@@ -123,7 +129,7 @@ func (e *orExpression) CanonicalSuffixes() []string {
 	for _, s := range e.subex {
 		retv = append(retv, s.CanonicalSuffixes()...)
 	}
-	return retv
+	return minimalSuffixes(retv)
 }
 func (e *orExpression) MightMatch(uri string, v *View) bool {
 	for _, s := range e.subex {
@@ -166,8 +172,38 @@ func (e *metaEqExpression) MightMatch(uri string, v *View) bool {
 	return true
 }
 
+//maxCachedRegexps bounds the regexp cache, as the patterns come from clients
+const maxCachedRegexps = 1024
+
+var regexpCache = struct {
+	mu sync.Mutex
+	m  map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+//cachedRegexp compiles a pattern once, so that views made from the same
+//expressions share the compiled pattern
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCache.mu.Lock()
+	defer regexpCache.mu.Unlock()
+	if re, ok := regexpCache.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexpCache.m) >= maxCachedRegexps {
+		regexpCache.m = make(map[string]*regexp.Regexp)
+	}
+	regexpCache.m[pattern] = re
+	return re, nil
+}
+
+//RegexURI matches URIs against a regular expression. A bad pattern panics
+//when the view is evaluated
 func RegexURI(pattern string) Expression {
-	return &uriEqExpression{pattern: pattern, regex: true}
+	re, _ := cachedRegexp(pattern)
+	return &uriEqExpression{pattern: pattern, regex: true, re: re}
 }
 
 //If the URI does not begin with a slash it is considered a full
@@ -193,6 +229,7 @@ func Prefix(pattern string) Expression {
 type uriEqExpression struct {
 	pattern string
 	regex   bool
+	re      *regexp.Regexp
 	ns      *string
 }
 
@@ -205,8 +242,11 @@ func (e *uriEqExpression) Namespaces() []string {
 }
 func (e *uriEqExpression) Matches(uri string, v *View) bool {
 	if e.regex {
-		rv := regexp.MustCompile(e.pattern).MatchString(uri)
-		return rv
+		if e.re == nil {
+			//The pattern did not compile
+			return regexp.MustCompile(e.pattern).MatchString(uri)
+		}
+		return e.re.MatchString(uri)
 	} else {
 		panic("have not done thing yet")
 	}
@@ -277,3 +317,186 @@ func (e *metaHasExpression) MightMatch(uri string, v *View) bool {
 	//You don't know until the final resource
 	return true
 }
+
+//Not matches the resources that the given expression does not. It does not
+//add namespaces to the view, so it must be used with an expression that does
+func Not(ex Expression) Expression {
+	return &notExpression{subex: ex}
+}
+
+type notExpression struct {
+	subex Expression
+}
+
+func (e *notExpression) Namespaces() []string {
+	//The excluded namespaces are not ones we want to operate on
+	return []string{}
+}
+func (e *notExpression) Matches(uri string, v *View) bool {
+	return !e.subex.Matches(uri, v)
+}
+func (e *notExpression) CanonicalSuffixes() []string {
+	return []string{"*"}
+}
+func (e *notExpression) MightMatch(uri string, v *View) bool {
+	//The subexpression not matching a prefix does not tell us whether it
+	//matches every resource under it, so we never know
+	return true
+}
+
+const (
+	metaCmpPrefix = "$prefix"
+	metaCmpRegex  = "$re"
+	metaCmpGt     = "$gt"
+	metaCmpLt     = "$lt"
+)
+
+//PrefixMeta matches resources where the metadata key's value starts with
+//prefix
+func PrefixMeta(key, prefix string) Expression {
+	return &metaCmpExpression{key: key, op: metaCmpPrefix, val: prefix}
+}
+
+//RegexMeta matches resources where the metadata key's value matches the
+//regular expression. A bad pattern panics when the view is evaluated
+func RegexMeta(key, pattern string) Expression {
+	re, _ := cachedRegexp(pattern)
+	return &metaCmpExpression{key: key, op: metaCmpRegex, val: pattern, re: re}
+}
+
+//GtMeta matches resources where the metadata key's value is a number
+//greater than n
+func GtMeta(key string, n float64) Expression {
+	return &metaCmpExpression{key: key, op: metaCmpGt, num: n}
+}
+
+//LtMeta matches resources where the metadata key's value is a number less
+//than n
+func LtMeta(key string, n float64) Expression {
+	return &metaCmpExpression{key: key, op: metaCmpLt, num: n}
+}
+
+type metaCmpExpression struct {
+	key string
+	op  string
+	val string
+	re  *regexp.Regexp
+	num float64
+}
+
+func (e *metaCmpExpression) Namespaces() []string {
+	return []string{}
+}
+func (e *metaCmpExpression) Matches(uri string, v *View) bool {
+	val, ok := v.Meta(uri, e.key)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case metaCmpPrefix:
+		return strings.HasPrefix(val.Value, e.val)
+	case metaCmpRegex:
+		if e.re == nil {
+			//The pattern did not compile
+			return regexp.MustCompile(e.val).MatchString(val.Value)
+		}
+		return e.re.MatchString(val.Value)
+	}
+	//Values that are not numbers never match a numeric comparison
+	n, err := strconv.ParseFloat(strings.TrimSpace(val.Value), 64)
+	if err != nil {
+		return false
+	}
+	if e.op == metaCmpGt {
+		return n > e.num
+	}
+	return n < e.num
+}
+func (e *metaCmpExpression) CanonicalSuffixes() []string {
+	return []string{"*"}
+}
+func (e *metaCmpExpression) MightMatch(uri string, v *View) bool {
+	//You don't know until the final resource
+	return true
+}
+
+//ExpressionToTree is the inverse of ExpressionFromTree. Every map in the
+//tree has a single key, so encoding it gives a canonical form
+func ExpressionToTree(ex Expression) (map[string]interface{}, error) {
+	switch e := ex.(type) {
+	case *nsExpression:
+		nsz := make([]interface{}, len(e.nsz))
+		for i, n := range e.nsz {
+			nsz[i] = n
+		}
+		return map[string]interface{}{"ns": nsz}, nil
+	case *andExpression:
+		subex, err := expressionsToTrees(e.subex)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$and": subex}, nil
+	case *orExpression:
+		subex, err := expressionsToTrees(e.subex)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$or": subex}, nil
+	case *uriEqExpression:
+		if e.regex {
+			return map[string]interface{}{"uri": map[string]interface{}{"$re": e.pattern}}, nil
+		}
+		return map[string]interface{}{"uri": e.pattern}, nil
+	case *metaEqExpression:
+		if e.key == "$has" {
+			return nil, fmt.Errorf("metadata key $has cannot be serialized")
+		}
+		return map[string]interface{}{"meta": map[string]interface{}{e.key: e.val}}, nil
+	case *metaHasExpression:
+		return map[string]interface{}{"meta": map[string]interface{}{"$has": e.key}}, nil
+	case *metaCmpExpression:
+		var operand interface{} = e.val
+		if e.op == metaCmpGt || e.op == metaCmpLt {
+			operand = e.num
+		}
+		cmp := map[string]interface{}{e.op: operand}
+		return map[string]interface{}{"meta": map[string]interface{}{e.key: cmp}}, nil
+	case *notExpression:
+		subex, err := ExpressionToTree(e.subex)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"$not": subex}, nil
+	}
+	return nil, fmt.Errorf("cannot serialize expression %T", ex)
+}
+
+func expressionsToTrees(exz []Expression) ([]interface{}, error) {
+	rv := make([]interface{}, len(exz))
+	for i, ex := range exz {
+		t, err := ExpressionToTree(ex)
+		if err != nil {
+			return nil, err
+		}
+		rv[i] = t
+	}
+	return rv, nil
+}
+
+//ExpressionToMsgPack encodes an expression in the form NewViewFromBlob takes
+func ExpressionToMsgPack(ex Expression) ([]byte, error) {
+	t, err := ExpressionToTree(ex)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(t)
+}
+
+//ExpressionToJSON encodes an expression in the form NewViewFromJSON takes
+func ExpressionToJSON(ex Expression) ([]byte, error) {
+	t, err := ExpressionToTree(ex)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(t)
+}
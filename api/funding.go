@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2/util/coldstore"
+)
+
+//AccountBalance is the balance of one of an entity's accounts
+type AccountBalance struct {
+	Index int
+	//The address in hex, with 0x
+	Address string
+	Wei     *big.Int
+	Human   string
+}
+
+//EntityBalances returns the balances of all the accounts of the client's
+//entity, in account order
+func (cl *BosswaveClient) EntityBalances(ctx context.Context) ([]AccountBalance, error) {
+	if cl.BCC() == nil {
+		return nil, bwe.M(bwe.NoEntity, "set an entity before getting balances")
+	}
+	rv := make([]AccountBalance, 0, bc.MaxEntityAccounts)
+	for i := 0; i < bc.MaxEntityAccounts; i++ {
+		bal, err := cl.AccountBalance(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, bal)
+	}
+	return rv, nil
+}
+
+//AccountBalance returns the balance of one of the accounts of the client's
+//entity
+func (cl *BosswaveClient) AccountBalance(ctx context.Context, account int) (AccountBalance, error) {
+	if cl.BCC() == nil {
+		return AccountBalance{}, bwe.M(bwe.NoEntity, "set an entity before getting balances")
+	}
+	addr, err := cl.BCC().GetAddress(account)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+	decimal, human, err := cl.BCC().GetBalance(ctx, account)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+	wei, ok := new(big.Int).SetString(decimal, 10)
+	if !ok {
+		return AccountBalance{}, bwe.M(bwe.BlockChainGenericError, fmt.Sprintf("bad balance %q", decimal))
+	}
+	return AccountBalance{Index: account, Address: "0x" + addr.Hex(), Wei: wei, Human: human}, nil
+}
+
+//TransferWei transfers wei from one of the client entity's accounts to the
+//given address (in hex). The balance is checked first so that an
+//underfunded transfer fails without a transaction. confirmed is called
+//once the transaction has enough confirmations, or with the error if it
+//fails or times out. A nil ip uses the client's interaction params
+func (cl *BosswaveClient) TransferWei(ctx context.Context, ip *bc.InteractionParams, account int, to string, wei *big.Int, confirmed func(res *bc.TxResult, err error)) {
+	if wei.Sign() <= 0 {
+		confirmed(nil, bwe.M(bwe.BadOperation, "the amount to transfer must be positive"))
+		return
+	}
+	bal, err := cl.AccountBalance(ctx, account)
+	if err != nil {
+		confirmed(nil, err)
+		return
+	}
+	//The gas is paid on top of the value, but the price is not known until
+	//the transaction is made, so only the value is checked
+	if bal.Wei.Cmp(wei) < 0 {
+		confirmed(nil, bwe.M(bwe.InsufficientFunds, fmt.Sprintf("account %d (%s) holds %s wei, less than %s", account, bal.Address, bal.Wei.Text(10), wei.Text(10))))
+		return
+	}
+	bcc := cl.BCC().WithInteractionParams(ip)
+	txhash, err := bcc.Transact(ctx, account, to, wei.Text(10), "", "", nil)
+	if err != nil {
+		confirmed(nil, err)
+		return
+	}
+	cl.BC().WaitForTransaction(ctx, txhash, bcc.GetDefaultTimeout(), bcc.GetDefaultConfirmations(), confirmed)
+}
+
+//FundEntity transfers wei from one of the client entity's accounts to the
+//first account of the given entity. The entity must include its signing
+//key, as its account addresses are derived from it
+func (cl *BosswaveClient) FundEntity(ctx context.Context, ip *bc.InteractionParams, account int, to *objects.Entity, wei *big.Int, confirmed func(res *bc.TxResult, err error)) {
+	addr, err := coldstore.GetAccountHex(to, 0)
+	if err != nil {
+		confirmed(nil, err)
+		return
+	}
+	cl.TransferWei(ctx, ip, account, addr, wei, confirmed)
+}
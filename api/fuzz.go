@@ -0,0 +1,48 @@
+// +build gofuzz
+
+package api
+
+import (
+	"bytes"
+
+	"github.com/immesys/bw2/internal/core"
+)
+
+//FuzzPeerFrame is a go-fuzz entry point for the peer protocol. It reads
+//frames from the input as a peer connection does and decodes their bodies
+//as the peer server and client would. See fuzz/README.md for how to run it
+func FuzzPeerFrame(data []byte) int {
+	r := bytes.NewReader(data)
+	rv := 0
+	for {
+		nf, err := readNativeFrame(r, 1<<20)
+		if err == errOversizeFrame {
+			continue
+		}
+		if err != nil {
+			return rv
+		}
+		switch nf.cmd {
+		case nCmdMessage, nCmdReplicate, nCmdGossip:
+			if _, err := core.LoadMessage(nf.body); err == nil {
+				rv = 1
+			}
+		case nCmdNumbered:
+			if _, _, body, err := decodeNumbered(nf.body); err == nil {
+				if _, err := core.LoadMessage(body); err == nil {
+					rv = 1
+				}
+			}
+		case nCmdListTree:
+			if len(nf.body) >= 2 {
+				if _, err := core.LoadMessage(nf.body[2:]); err == nil {
+					rv = 1
+				}
+			}
+		case nCmdResult:
+			//Results are either messages or list entries
+			core.LoadMessage(nf.body)
+			decodeListEntry(nf.body)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//DefaultHeartbeatInterval is how often RunHeartbeat republishes lastalive
+//if no interval is given
+const DefaultHeartbeatInterval = 10 * time.Second
+
+//HeartbeatParams configures RunHeartbeat
+type HeartbeatParams struct {
+	//The fully qualified URIs (namespace/suffix) of the services and
+	//interfaces to keep alive
+	URIs []string
+	//How often lastalive is republished, DefaultHeartbeatInterval if zero
+	Interval time.Duration
+	//Up to this much is added at random to each interval, so that services
+	//started together do not all publish together
+	Jitter time.Duration
+	//If not nil, this is called when lastalive could not be set on a URI.
+	//The heartbeat carries on
+	OnError func(uri string, err error)
+}
+
+//RunHeartbeat sets the lastalive metadata that views filter on for each
+//of the URIs now, and then every interval until the returned function is
+//called or the client is destroyed. Stopping waits for a heartbeat in
+//progress to be sent, and is safe to call more than once
+func (c *BosswaveClient) RunHeartbeat(p *HeartbeatParams) (stop func()) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	uris := append([]string{}, p.URIs...)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			now := time.Now().Format(time.RFC3339Nano)
+			wg := sync.WaitGroup{}
+			wg.Add(len(uris))
+			for _, uri := range uris {
+				uri := uri
+				c.SetMeta(uri, "lastalive", now, func(err error) {
+					if err != nil && p.OnError != nil {
+						p.OnError(uri, err)
+					}
+					wg.Done()
+				})
+			}
+			wg.Wait()
+			wait := interval
+			if p.Jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(p.Jitter)))
+			}
+			select {
+			case <-done:
+				return
+			case <-c.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}
+
+//RunHeartbeat is like BosswaveClient.RunHeartbeat, but the heartbeat also
+//stops when the view is torn down
+func (v *View) RunHeartbeat(p *HeartbeatParams) (stop func()) {
+	stop = v.c.RunHeartbeat(p)
+	v.msmu.Lock()
+	if v.torndown {
+		v.msmu.Unlock()
+		stop()
+		return stop
+	}
+	v.heartbeats = append(v.heartbeats, stop)
+	v.msmu.Unlock()
+	return stop
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/internal/core"
+)
+
+//How long idempotency keys are remembered if [router] IdempotencyWindow
+//is zero
+const defaultIdempotencyWindow = 600 * time.Second
+
+//How often the keys that are older than the window are forgotten
+const idempotencySweep = time.Minute
+
+type idempotentPublish struct {
+	at time.Time
+	//How many consumers the first delivery had, zero until it is done
+	consumers int
+}
+
+type idempotency struct {
+	mu sync.Mutex
+	//Keyed by the origin VK, the topic and the key
+	seen      map[string]*idempotentPublish
+	lastSweep time.Time
+}
+
+func (bw *BW) idempotencyWindow() time.Duration {
+	w := bw.Config.Router.IdempotencyWindow
+	if w == 0 {
+		return defaultIdempotencyWindow
+	}
+	return time.Duration(w) * time.Second
+}
+
+//deliverOnce is deliver for messages from publishers, on the designated
+//router. A message with an idempotency key that was delivered on the same
+//URI from the same origin within the window is not delivered again, and
+//gets the number of consumers the first one had. fresh is false for such a
+//retry, which must not be replicated either
+func (bw *BW) deliverOnce(cl *core.Client, m *core.Message) (consumers int, fresh bool) {
+	window := bw.idempotencyWindow()
+	key, ok := m.IdempotencyKey()
+	if !ok || window < 0 {
+		return bw.deliver(cl, m), true
+	}
+	id := &bw.idempotency
+	now := time.Now()
+	//Publishers pick their own keys, so one publisher's key must not hide
+	//another's message. Messages without an origin share the zero VK
+	origin := make([]byte, 32)
+	if m.OriginVK != nil {
+		copy(origin, *m.OriginVK)
+	}
+	rkey := string(origin) + m.Topic + "\x00" + key
+	id.mu.Lock()
+	if id.seen == nil {
+		id.seen = make(map[string]*idempotentPublish)
+	}
+	if now.Sub(id.lastSweep) > idempotencySweep {
+		for k, p := range id.seen {
+			if now.Sub(p.at) > window {
+				delete(id.seen, k)
+			}
+		}
+		id.lastSweep = now
+	}
+	if p, ok := id.seen[rkey]; ok && now.Sub(p.at) <= window {
+		consumers = p.consumers
+		id.mu.Unlock()
+		return consumers, false
+	}
+	p := &idempotentPublish{at: now}
+	id.seen[rkey] = p
+	id.mu.Unlock()
+	consumers = bw.deliver(cl, m)
+	id.mu.Lock()
+	p.consumers = consumers
+	id.mu.Unlock()
+	return consumers, true
+}
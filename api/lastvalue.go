@@ -0,0 +1,40 @@
+package api
+
+import (
+	"github.com/immesys/bw2/internal/core"
+)
+
+//retainsLastValue is true if m is a publish that the designated router
+//keeps as the last value on its URI, so that a query finds it as it would
+//a persisted message. Every DOT in the primary access chain must have a
+//non zero Retain in its publish limits, so a publisher cannot grant it to
+//itself further down the chain
+func (bw *BW) retainsLastValue(m *core.Message) bool {
+	if m.Type != core.TypePublish {
+		return false
+	}
+	pac := m.PrimaryAccessChain
+	if pac == nil || pac.NumHashes() == 0 {
+		return false
+	}
+	for i := 0; i < pac.NumHashes(); i++ {
+		d := pac.GetDOT(i)
+		if d == nil {
+			d, _, _ = bw.ResolveDOT(pac.GetDotHash(i))
+		}
+		if d == nil || d.GetPublishLimits() == nil || d.GetPublishLimits().Retain == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//deliver hands a publish or persist to the local terminus, persisting
+//publishes that retain their last value, and returns the number of
+//consumers it was delivered to
+func (bw *BW) deliver(cl *core.Client, m *core.Message) int {
+	if m.Type == core.TypePersist || bw.retainsLastValue(m) {
+		return cl.Persist(m)
+	}
+	return cl.Publish(m)
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/mdns"
+)
+
+//MDNSService is the DNS-SD service type that routers advertise on the
+//local network. The TXT record has vk=<router vk>
+const MDNSService = "_bw2._tcp"
+
+//LocalRouter is a router found on the local network. It has proven that
+//it holds VK over TLS at Addr
+type LocalRouter struct {
+	VK       []byte
+	Addr     string
+	Instance string
+	//How long it took to connect and verify the router's proof
+	Latency time.Duration
+	Found   time.Time
+}
+
+//localRouters holds the routers found by the background mDNS queries
+type localRouters struct {
+	mu      sync.Mutex
+	routers map[bc.Bytes32]LocalRouter
+	adv     *mdns.Server
+}
+
+//DiscoverLocalRouters asks the local network for routers with mDNS and
+//returns those that prove they hold the VK they advertise. Routers that
+//answer after the timeout are missed, and each one is given the same
+//timeout to prove its VK
+func DiscoverLocalRouters(timeout time.Duration) ([]LocalRouter, error) {
+	es, err := mdns.Query(MDNSService, timeout)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*LocalRouter, len(es))
+	wg := sync.WaitGroup{}
+	for i, e := range es {
+		vks, ok := e.TXTValue("vk")
+		if !ok {
+			continue
+		}
+		vk, err := crypto.UnFmtKey(vks)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, e *mdns.Entry, vk []byte) {
+			defer wg.Done()
+			then := time.Now()
+			conn, err := dialPeer(e.Addr, vk, timeout)
+			if err != nil {
+				log.Infof("Router %s at %s did not prove its VK: %v", e.Instance, e.Addr, err)
+				return
+			}
+			conn.Close()
+			res[i] = &LocalRouter{
+				VK:       vk,
+				Addr:     e.Addr,
+				Instance: e.Instance,
+				Latency:  time.Now().Sub(then),
+				Found:    time.Now(),
+			}
+		}(i, e, vk)
+	}
+	wg.Wait()
+	rv := []LocalRouter{}
+	for _, r := range res {
+		if r != nil {
+			rv = append(rv, *r)
+		}
+	}
+	return rv, nil
+}
+
+//startMDNS advertises the router and looks for others on the local
+//network, as configured in [mdns]
+func (bw *BW) startMDNS() {
+	cfg := bw.Config.MDNS
+	if cfg.Advertise {
+		port, err := strconv.Atoi(bw.advertisePort())
+		if err != nil {
+			log.Warnf("Not advertising with mDNS: no port to advertise")
+		} else {
+			instance, _ := os.Hostname()
+			instance = strings.SplitN(instance, ".", 2)[0]
+			if instance == "" {
+				instance = "bw2"
+			}
+			adv, err := mdns.Advertise(&mdns.Service{
+				Instance: instance,
+				Service:  MDNSService,
+				Port:     uint16(port),
+				TXT:      []string{"vk=" + crypto.FmtKey(bw.Entity.GetVK())},
+			})
+			if err != nil {
+				log.Warnf("Could not advertise with mDNS: %v", err)
+			} else {
+				bw.local.mu.Lock()
+				bw.local.adv = adv
+				bw.local.mu.Unlock()
+			}
+		}
+	}
+	if cfg.DiscoverInterval > 0 {
+		go bw.discoverLocalLoop(time.Duration(cfg.DiscoverInterval) * time.Second)
+	}
+}
+
+func (bw *BW) discoverLocalLoop(interval time.Duration) {
+	for {
+		rs, err := DiscoverLocalRouters(drCheckTimeout)
+		if err != nil {
+			log.Warnf("mDNS discovery failed: %v", err)
+		}
+		now := time.Now()
+		bw.local.mu.Lock()
+		for _, r := range rs {
+			if bytes.Equal(r.VK, bw.Entity.GetVK()) {
+				continue
+			}
+			bw.local.routers[bc.SliceToBytes32(r.VK)] = r
+		}
+		//Forget routers that have not answered for a few rounds
+		for k, r := range bw.local.routers {
+			if now.Sub(r.Found) > 3*interval {
+				delete(bw.local.routers, k)
+			}
+		}
+		bw.local.mu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+//LocalRouters returns the routers on the local network found by the
+//background mDNS queries. It is empty unless [mdns] DiscoverInterval is set
+func (bw *BW) LocalRouters() []LocalRouter {
+	bw.local.mu.Lock()
+	defer bw.local.mu.Unlock()
+	rv := make([]LocalRouter, 0, len(bw.local.routers))
+	for _, r := range bw.local.routers {
+		rv = append(rv, r)
+	}
+	return rv
+}
+
+//localSRV is the address of a designated router that was found on the
+//local network
+func (bw *BW) localSRV(drvk []byte) (string, bool) {
+	bw.local.mu.Lock()
+	defer bw.local.mu.Unlock()
+	r, ok := bw.local.routers[bc.SliceToBytes32(drvk)]
+	return r.Addr, ok
+}
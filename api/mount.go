@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+)
+
+const mountRetryInterval = 30 * time.Second
+
+//mount republishes the messages under one URI prefix under another
+type mount struct {
+	bw   *BW
+	cl   *BosswaveClient
+	name string
+	from string
+	to   string
+
+	frommvk    []byte
+	fromsuffix string
+	tomvk      []byte
+	tosuffix   string
+}
+
+//StartMounts mounts the subtrees in the [mount "name"] sections of the
+//config. Messages published under From are republished by the router
+//under To, with their topic rewritten, so clients of To see them as if
+//they had been published there. The router entity must be granted C* on
+//From and P on To by DOTs, so both namespaces authorize the mount.
+//Messages published by the router entity itself are not mounted, which
+//lets two mounts map a subtree both ways without a loop
+func StartMounts(bw *BW) {
+	if len(bw.Config.Mount) == 0 {
+		return
+	}
+	cl := bw.CreateClient(context.Background(), "MOUNT")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("mount: could not use router entity: %v", err)
+		return
+	}
+	for name, cfg := range bw.Config.Mount {
+		if cfg == nil {
+			continue
+		}
+		mt := &mount{
+			bw:   bw,
+			cl:   cl,
+			name: name,
+			from: strings.TrimSuffix(cfg.From, "/"),
+			to:   strings.TrimSuffix(cfg.To, "/"),
+		}
+		go mt.run()
+	}
+}
+
+//splitMountURI splits a mount URI into its namespace and suffix. The
+//suffix may be empty to mount the whole namespace
+func splitMountURI(uri string) (string, string, bool) {
+	if uri != "" && !strings.Contains(uri, "/") {
+		return uri, "", true
+	}
+	ns, suffix, err := util.SplitURI(uri)
+	if err != nil {
+		return "", "", false
+	}
+	_, star, plus, _ := util.AnalyzeSuffix(suffix)
+	if star || plus || util.IsFreePath(suffix) {
+		return "", "", false
+	}
+	return ns, suffix, true
+}
+
+//run subscribes to the source subtree, again whenever the subscription
+//ends, e.g. because a DOT in its chain was revoked
+func (mt *mount) run() {
+	fromns, fromsuffix, ok := splitMountURI(mt.from)
+	tons, tosuffix, ok2 := splitMountURI(mt.to)
+	if !ok || !ok2 {
+		log.Errorf("mount %s: From and To must be namespace/suffix without wildcards or free paths", mt.name)
+		return
+	}
+	mt.fromsuffix, mt.tosuffix = fromsuffix, tosuffix
+	for {
+		var err error
+		mt.frommvk, err = mt.bw.ResolveKey(fromns)
+		if err == nil {
+			mt.tomvk, err = mt.bw.ResolveKey(tons)
+		}
+		ended := make(chan struct{})
+		var once sync.Once
+		if err == nil {
+			sub := "*"
+			if mt.fromsuffix != "" {
+				sub = mt.fromsuffix + "/*"
+			}
+			done := make(chan error, 1)
+			mt.cl.Subscribe(&SubscribeParams{
+				MVK:       mt.frommvk,
+				URISuffix: sub,
+				AutoChain: true,
+			}, func(err error, id core.UniqueMessageID) {
+				done <- err
+			}, func(m *core.Message) {
+				if m == nil {
+					once.Do(func() { close(ended) })
+					return
+				}
+				mt.handle(m)
+			})
+			err = <-done
+		}
+		if err == nil {
+			log.Infof("mount %s: mounted %s on %s", mt.name, mt.from, mt.to)
+			<-ended
+			log.Warnf("mount %s: the subscription to %s ended", mt.name, mt.from)
+		} else {
+			log.Warnf("mount %s: could not subscribe to %s: %v", mt.name, mt.from, err)
+		}
+		time.Sleep(mountRetryInterval)
+	}
+}
+
+//mountedSuffix returns the suffix under To that a suffix under From is
+//mounted at
+func (mt *mount) mountedSuffix(suffix string) (string, bool) {
+	rest := suffix
+	if mt.fromsuffix != "" {
+		if suffix != mt.fromsuffix && !strings.HasPrefix(suffix, mt.fromsuffix+"/") {
+			return "", false
+		}
+		rest = strings.TrimPrefix(strings.TrimPrefix(suffix, mt.fromsuffix), "/")
+	}
+	//Free paths belong to the source namespace's routers
+	if util.IsFreePath(rest) {
+		return "", false
+	}
+	switch {
+	case rest == "":
+		return mt.tosuffix, mt.tosuffix != ""
+	case mt.tosuffix == "":
+		return rest, true
+	default:
+		return mt.tosuffix + "/" + rest, true
+	}
+}
+
+func (mt *mount) handle(m *core.Message) {
+	if m.OriginVK != nil && string(*m.OriginVK) == string(mt.bw.Entity.GetVK()) {
+		return
+	}
+	_, topic, err := util.SplitURI(m.Topic)
+	if err != nil {
+		return
+	}
+	suffix, ok := mt.mountedSuffix(topic)
+	if !ok {
+		return
+	}
+	pos := make([]objects.PayloadObject, len(m.PayloadObjects))
+	copy(pos, m.PayloadObjects)
+	mt.cl.Publish(&PublishParams{
+		MVK:            mt.tomvk,
+		URISuffix:      suffix,
+		PayloadObjects: pos,
+		Persist:        m.Type == core.TypePersist,
+		Consumers:      m.Consumers,
+		AutoChain:      true,
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("mount %s: could not republish %s: %v", mt.name, m.Topic, err)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//MaxMessageSize is the largest encoded message in bytes the router
+//accepts, from [router] MaxMessageSize
+func (bw *BW) MaxMessageSize() int {
+	if bw.Config.Router.MaxMessageSize <= 0 {
+		return objects.SaneObjectSize
+	}
+	return bw.Config.Router.MaxMessageSize
+}
+
+func (bw *BW) messageTooLarge(size int) error {
+	return bwe.M(bwe.MessageTooLarge, fmt.Sprintf("message is %d bytes, the limit is %d. Split large payloads into chunk POs", size, bw.MaxMessageSize()))
+}
+
+//checkMessageSize refuses a message larger than MaxMessageSize. It is
+//checked where messages enter the router, so that they are not passed on
+func (bw *BW) checkMessageSize(m *core.Message) error {
+	if len(m.Encoded) > bw.MaxMessageSize() {
+		return bw.messageTooLarge(len(m.Encoded))
+	}
+	return nil
+}
@@ -50,6 +50,13 @@ import (
 // #4 cache and lookup chain
 //  inv: new DOTs on nsvk
 //       changes to any of the DOTs
+// #5 alias key -> value and value -> first key
+//  inv: alias updated or deleted (only nonzero results are cached)
+// #6 all aliases for a value
+//  inv: new alias for that value
+//       alias in the list updated or deleted
+// Objects preloaded from namespace snapshots are consulted after the chain
+// and are never cached, so they stop mattering once the chain has them
 //
 // GOTCHAs
 //  - expiry may not reflect on chain (must be done in fromBC methods)
@@ -74,6 +81,10 @@ type ResolutionData struct {
 	entityCache map[bc.Bytes32]*registryEntityResult
 	// dothash -> dot
 	dotHashCache map[bc.Bytes32]*registryDOTResult
+	// use of the above three caches, for eviction
+	entityLRU *cacheLRU
+	dotLRU    *cacheLRU
+	chainLRU  *cacheLRU
 	// dot from vk -> hash used for inv
 	dotFromInvCache map[bc.Bytes32][]bc.Bytes32
 	// This is similar to above, but has a stronger guarantee.
@@ -88,6 +99,18 @@ type ResolutionData struct {
 	// suppress caching built chains on these nsvks until this block number
 	// has passed
 	holdoff map[bc.Bytes32]uint64
+	// alias key -> value
+	aliasCache map[bc.Bytes32]bc.Bytes32
+	// alias value -> first key created for it
+	unaliasCache map[bc.Bytes32]bc.Bytes32
+	// alias value -> all aliases created for it
+	aliasesForCache map[bc.Bytes32][]*bc.AliasRecord
+	// published entities and DOTs for metadata search. This is not
+	// dropped with the caches as it only ever grows
+	regindex *registryIndex
+	// objects imported from namespace snapshots, used when the chain
+	// does not have them. Also not dropped with the caches
+	preload *nsPreload
 
 	chainchangemu sync.Mutex
 	lastblock     uint64
@@ -103,12 +126,20 @@ func newResolutionData() *ResolutionData {
 		chaincache:           make(map[bc.Bytes32]map[CacheKey][]*objects.DChain),
 		entityCache:          make(map[bc.Bytes32]*registryEntityResult),
 		dotHashCache:         make(map[bc.Bytes32]*registryDOTResult),
+		entityLRU:            newCacheLRU(DefaultMaxCachedEntities),
+		dotLRU:               newCacheLRU(DefaultMaxCachedDOTs),
+		chainLRU:             newCacheLRU(DefaultMaxCachedChains),
 		dotFromInvCache:      make(map[bc.Bytes32][]bc.Bytes32),
 		dotFromCompleteCache: make(map[bc.Bytes32][]bc.Bytes32),
 		dotToInvCache:        make(map[bc.Bytes32][]bc.Bytes32),
 		dotChainCache:        make(map[bc.Bytes32][]bc.Bytes32),
 		expinvchan:           make(chan struct{}),
 		holdoff:              make(map[bc.Bytes32]uint64),
+		aliasCache:           make(map[bc.Bytes32]bc.Bytes32),
+		unaliasCache:         make(map[bc.Bytes32]bc.Bytes32),
+		aliasesForCache:      make(map[bc.Bytes32][]*bc.AliasRecord),
+		regindex:             newRegistryIndex(),
+		preload:              newNSPreload(),
 		nextInterval:         5 * time.Second,
 	}
 }
@@ -119,12 +150,18 @@ func (bw *BW) dropAllCaches() {
 	bw.rdata.chaincache = make(map[bc.Bytes32]map[CacheKey][]*objects.DChain)
 	bw.rdata.entityCache = make(map[bc.Bytes32]*registryEntityResult)
 	bw.rdata.dotHashCache = make(map[bc.Bytes32]*registryDOTResult)
+	bw.rdata.entityLRU.reset()
+	bw.rdata.dotLRU.reset()
+	bw.rdata.chainLRU.reset()
 	bw.rdata.dotFromInvCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.dotFromCompleteCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.dotToInvCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.dotChainCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.expinvchan = make(chan struct{})
 	bw.rdata.holdoff = make(map[bc.Bytes32]uint64)
+	bw.rdata.aliasCache = make(map[bc.Bytes32]bc.Bytes32)
+	bw.rdata.unaliasCache = make(map[bc.Bytes32]bc.Bytes32)
+	bw.rdata.aliasesForCache = make(map[bc.Bytes32][]*bc.AliasRecord)
 }
 
 func init() {
@@ -221,8 +258,10 @@ func (bw *BW) checkExpiryInv() time.Duration {
 	bw.getlock()
 	defer bw.rellock()
 	minexpiry := time.Now().Add(1 * time.Hour)
+	expired := false
 	for _, er := range bw.rdata.entityCache {
 		if er.ro.IsExpired() {
+			expired = true
 			go bw.FlushEntity(er.ro.GetVK())
 		} else {
 			ex := er.ro.GetExpiry()
@@ -233,6 +272,7 @@ func (bw *BW) checkExpiryInv() time.Duration {
 	}
 	for _, dr := range bw.rdata.dotHashCache {
 		if dr.ro.IsExpired() {
+			expired = true
 			go bw.FlushDOT(dr.ro.GetHash())
 		} else {
 			ex := dr.ro.GetExpiry()
@@ -241,6 +281,9 @@ func (bw *BW) checkExpiryInv() time.Duration {
 			}
 		}
 	}
+	if expired {
+		bw.triggerSubscriptionRecheck()
+	}
 	return minexpiry.Sub(time.Now())
 }
 func (bw *BW) forceExpiryInv() {
@@ -291,12 +334,32 @@ func (bw *BW) checkChainChange() {
 		go bw.dropAllCaches()
 	}
 	//TODO maybe fix this
-	logs, err := bw.BC().FindLogsBetweenHeavy(context.Background(), int64(bw.rdata.lastblock)-BlockReplay, int64(currentBlock), common.Address(bc.HexToAddress(bc.UFI_Registry_Address)),
+	logs, err := bw.BC().FindLogsBetweenHeavy(context.Background(), int64(bw.rdata.lastblock)-BlockReplay, int64(currentBlock), common.Address(bc.ContractAddress(bc.ContractRegistry)),
 		[][]common.Hash{})
+	//A thin router's registry may be unreachable for a while. The logs
+	//are fetched again on the next head
 	if err != nil {
-		panic(err)
+		log.Warnf("could not get the registry logs: %v", err)
+		return
+	}
+	aliaslogs, err := bw.BC().FindLogsBetweenHeavy(context.Background(), int64(bw.rdata.lastblock)-BlockReplay, int64(currentBlock), common.Address(bc.ContractAddress(bc.ContractAlias)),
+		[][]common.Hash{[]common.Hash{
+			common.Hash(bc.HexToBytes32(bc.EventSig_Alias_AliasCreated)),
+			common.Hash(bc.HexToBytes32(bc.EventSig_Alias_AliasUpdated)),
+			common.Hash(bc.HexToBytes32(bc.EventSig_Alias_AliasDeleted)),
+		}})
+	if err != nil {
+		log.Warnf("could not get the alias logs: %v", err)
+		return
 	}
 	bw.rdata.lastblock = currentBlock
+	revoked := false
+	for _, log := range aliaslogs {
+		if log.Topics()[0] != bc.HexToBytes32(bc.EventSig_Alias_AliasCreated) {
+			bw.FlushAlias(log.Topics()[1][:])
+		}
+		bw.FlushAliasesFor(log.Topics()[2][:])
+	}
 	for _, log := range logs {
 		switch log.Topics()[0] {
 		case bc.HexToBytes32(bc.EventSig_Registry_NewDOT):
@@ -314,12 +377,23 @@ func (bw *BW) checkChainChange() {
 		case bc.HexToBytes32(bc.EventSig_Registry_NewDOTRevocation):
 			fmt.Printf("flushing dot")
 			bw.FlushDOT(log.Topics()[1][:])
+			if log.Topics()[0] == bc.HexToBytes32(bc.EventSig_Registry_NewDOTRevocation) {
+				revoked = true
+			}
 		case bc.HexToBytes32(bc.EventSig_Registry_NewEntityRevocation), bc.HexToBytes32(bc.EventSig_Registry_NewEntity):
 			fmt.Printf("flushing entity")
 			bw.FlushEntity(log.Topics()[1][:])
+			if log.Topics()[0] == bc.HexToBytes32(bc.EventSig_Registry_NewEntityRevocation) {
+				revoked = true
+			}
 		default:
 		}
 	}
+	//The revoked objects have been flushed, so the subscriptions that rely
+	//on them will now fail verification
+	if revoked {
+		bw.triggerSubscriptionRecheck()
+	}
 }
 
 // Resolve an Entity and it's state. An error will only be returned
@@ -334,6 +408,10 @@ func (bw *BW) ResolveEntity(vk []byte) (ro *objects.Entity, s int, err error) {
 	ro, s, err = bw.resolveEntityFromBC(vk)
 	if err == nil && ro != nil && s != StateUnknown {
 		bw.cacheEntity(ro, s)
+		return
+	}
+	if pro, ps, ok := bw.preloadedEntity(vk); ok {
+		return pro, ps, nil
 	}
 	return
 }
@@ -347,6 +425,10 @@ func (bw *BW) ResolveDOT(hash []byte) (ro *objects.DOT, s int, err error) {
 	ro, s, err = bw.resolveDOTFromBC(hash)
 	if err == nil && ro != nil && s != StateUnknown {
 		bw.cacheDOT(ro, s)
+		return
+	}
+	if pro, ps, ok := bw.preloadedDOT(hash); ok {
+		return pro, ps, nil
 	}
 	return
 }
@@ -357,6 +439,8 @@ func (bw *BW) ResolveGrantedDOTs(fromVK []byte) (links []DOTLink, err error) {
 		hashes, err = bw.resolveGrantedDOTsFromBC(fromVK)
 		if err == nil {
 			bw.cacheGrantedDOTs(fromVK, hashes)
+		} else if phashes, ok := bw.preloadedGrantedDOTs(fromVK); ok {
+			hashes = phashes
 		} else {
 			return nil, err
 		}
@@ -367,6 +451,12 @@ func (bw *BW) ResolveGrantedDOTs(fromVK []byte) (links []DOTLink, err error) {
 
 func (bw *BW) ResolveAccessDChain(hash []byte) (ro *objects.DChain, s int, err error) {
 	ro, s, err = bw.resolveAccessDChainFromBC(hash)
+	if err == nil && ro != nil && s != StateUnknown {
+		return
+	}
+	if pro, ps, ok := bw.preloadedAccessDChain(hash); ok {
+		return pro, ps, nil
+	}
 	return
 }
 
@@ -376,6 +466,7 @@ func (bw *BW) FlushEntity(vk []byte) {
 	defer bw.rellock()
 	kvk := bc.SliceToBytes32(vk)
 	delete(bw.rdata.entityCache, kvk)
+	bw.rdata.entityLRU.remove(kvk)
 	dTo := bw.rdata.dotToInvCache[kvk]
 	for _, dhash := range dTo {
 		bw.flushDOT(dhash)
@@ -401,12 +492,22 @@ func (bw *BW) FlushDOT(hash []byte) {
 //Lock must be held
 func (bw *BW) flushDOT(hash bc.Bytes32) {
 	delete(bw.rdata.dotHashCache, hash)
+	bw.rdata.dotLRU.remove(hash)
 	//We don't need to flush toVK or fromVK because those are not stale
 	//and they are hard to look up :p
 	//We don't flush the chains because their validity is checked every time
 	//they are accessed
 }
 
+//FlushRevoked discards the cached state of a revoked DOT or entity and
+//rechecks the subscriptions, as the router does when it sees a revocation
+//on the chain
+func (bw *BW) FlushRevoked(target []byte) {
+	bw.FlushDOT(target)
+	bw.FlushEntity(target)
+	bw.triggerSubscriptionRecheck()
+}
+
 // If a DOT appears from a VK (e.g), we need to flush the complete granted from cache
 func (bw *BW) FlushGrantedFromCache(vk []byte) {
 	kvk := bc.SliceToBytes32(vk)
@@ -419,19 +520,59 @@ func (bw *BW) FlushGrantedFromCache(vk []byte) {
 func (bw *BW) FlushChainNSVK(nsvk []byte) {
 	bw.getlock()
 	knsvk := bc.SliceToBytes32(nsvk)
+	bw.forgetChainNSVK(bw.rdata.chaincache[knsvk])
 	delete(bw.rdata.chaincache, knsvk)
 	bw.rdata.holdoff[knsvk] = bw.BC().CurrentBlock() + holdoffConstant
 	bw.rellock()
 }
 
+// If a new alias appears for a value, discard the cached list of aliases
+// for that value
+func (bw *BW) FlushAliasesFor(value []byte) {
+	kval := bc.SliceToBytes32(value)
+	bw.getlock()
+	delete(bw.rdata.aliasesForCache, kval)
+	bw.rellock()
+}
+
+// If an alias is updated or deleted, discard its cached value, the cached
+// reverse lookups that lead to it and the cached lists it is in. The
+// preloaded value is dropped too, as the chain knows better now
+func (bw *BW) FlushAlias(key []byte) {
+	kkey := bc.SliceToBytes32(key)
+	bw.getlock()
+	delete(bw.rdata.aliasCache, kkey)
+	for v, k := range bw.rdata.unaliasCache {
+		if k == kkey {
+			delete(bw.rdata.unaliasCache, v)
+		}
+	}
+	for v, recs := range bw.rdata.aliasesForCache {
+		for _, r := range recs {
+			if r.Key == kkey {
+				delete(bw.rdata.aliasesForCache, v)
+				break
+			}
+		}
+	}
+	bw.rellock()
+	pl := bw.rdata.preload
+	pl.mu.Lock()
+	delete(pl.aliases, kkey)
+	pl.mu.Unlock()
+}
+
 func (bw *BW) resolveEntityFromCache(vk []byte) (bool, *objects.Entity, int) {
 	bw.getlock()
 	defer bw.rellock()
 	kvk := bc.SliceToBytes32(vk)
 	entry, ok := bw.rdata.entityCache[kvk]
 	if ok {
+		bw.rdata.entityLRU.hits++
+		bw.rdata.entityLRU.touch(kvk)
 		return true, entry.ro, entry.s
 	}
+	bw.rdata.entityLRU.misses++
 	return false, nil, StateUnknown
 }
 func (bw *BW) resolveEntityFromBC(vk []byte) (ro *objects.Entity, s int, err error) {
@@ -448,6 +589,7 @@ func (bw *BW) cacheEntity(ro *objects.Entity, s int) {
 	defer bw.rellock()
 	kvk := bc.SliceToBytes32(ro.GetVK())
 	bw.rdata.entityCache[kvk] = &registryEntityResult{ro: ro, s: s}
+	bw.evictEntities(bw.rdata.entityLRU.add(kvk))
 }
 func (bw *BW) resolveDOTFromCache(hash []byte) (bool, *objects.DOT, int) {
 	bw.getlock()
@@ -457,8 +599,11 @@ func (bw *BW) resolveDOTFromCache(hash []byte) (bool, *objects.DOT, int) {
 	if ok {
 		//We can trust the state stored in the DOT cache because any change
 		//in the entity state would have flushed the DOT from the cache
+		bw.rdata.dotLRU.hits++
+		bw.rdata.dotLRU.touch(khash)
 		return true, entry.ro, entry.s
 	}
+	bw.rdata.dotLRU.misses++
 	return false, nil, StateUnknown
 }
 func (bw *BW) resolveDOTFromBC(hash []byte) (*objects.DOT, int, error) {
@@ -494,6 +639,7 @@ func (bw *BW) cacheDOT(ro *objects.DOT, s int) {
 	defer bw.rellock()
 	khash := bc.SliceToBytes32(ro.GetHash())
 	bw.rdata.dotHashCache[khash] = &registryDOTResult{ro: ro, s: s}
+	bw.evictDOTs(bw.rdata.dotLRU.add(khash))
 	kFromVK := bc.SliceToBytes32(ro.GetGiverVK())
 	kToVK := bc.SliceToBytes32(ro.GetReceiverVK())
 	existing := false
@@ -535,14 +681,19 @@ func (bw *BW) resolveBuiltChain(k CacheKey) ([]*objects.DChain, []int) {
 	bw.getlock()
 	nsmap, ok := bw.rdata.chaincache[k.nsvk]
 	if !ok {
+		bw.rdata.chainLRU.misses++
 		bw.rellock()
 		return nil, nil
 	}
 	chains, ok2 := nsmap[k]
-	bw.rellock()
 	if !ok2 {
+		bw.rdata.chainLRU.misses++
+		bw.rellock()
 		return nil, nil
 	}
+	bw.rdata.chainLRU.hits++
+	bw.rdata.chainLRU.touch(k)
+	bw.rellock()
 	states := make([]int, len(chains))
 	for idx, chain := range chains {
 		for dotidx := 0; dotidx < chain.NumHashes(); dotidx++ {
@@ -562,7 +713,9 @@ func (bw *BW) resolveBuiltChain(k CacheKey) ([]*objects.DChain, []int) {
 	}
 	return chains, states
 }
-func (bw *BW) cacheBuiltChains(k CacheKey, ro []*objects.DChain) {
+//cacheBuiltChains caches the chains cl built for k, charging them to cl's
+//share of the cache
+func (bw *BW) cacheBuiltChains(cl *BosswaveClient, k CacheKey, ro []*objects.DChain) {
 	bw.getlock()
 	defer bw.rellock()
 	//To workaround the mismatch between a new dot appearing (and invalidating
@@ -587,6 +740,12 @@ func (bw *BW) cacheBuiltChains(k CacheKey, ro []*objects.DChain) {
 	}
 	nsmap[k] = ro
 	bw.rdata.chaincache[k.nsvk] = nsmap
+	bw.evictChains(bw.rdata.chainLRU.add(k))
+	own := cl.chargeChain(k)
+	for _, ok := range own {
+		bw.rdata.chainLRU.remove(ok)
+	}
+	bw.evictChains(own)
 }
 func (bw *BW) resolveGrantedDOTsFromCache(vk []byte) (bool, []bc.Bytes32) {
 	bw.getlock()
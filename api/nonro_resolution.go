@@ -14,26 +14,122 @@ import (
 	"github.com/immesys/bw2/util/bwe"
 )
 
+//UnresolveAlias finds the first alias created for val. Short aliases
+//are returned as @hex] so that they can be resolved again
 func (bw *BW) UnresolveAlias(val []byte) (string, bool, error) {
 	if len(val) > 32 {
 		return "", false, nil
 	}
-	key, iszero, err := bw.BC().UnresolveAlias(context.TODO(), bc.SliceToBytes32(val))
+	kval := bc.SliceToBytes32(val)
+	bw.getlock()
+	key, ok := bw.rdata.unaliasCache[kval]
+	bw.rellock()
+	if !ok {
+		var iszero bool
+		var err error
+		key, iszero, err = bw.BC().UnresolveAlias(context.TODO(), kval)
+		if err != nil || iszero {
+			return "", false, err
+		}
+		bw.getlock()
+		bw.rdata.unaliasCache[kval] = key
+		bw.rellock()
+	}
+	return bc.FmtAliasKey(key), true, nil
+}
+
+//resolveAlias is ResolveAlias through the alias cache. A nonzero value is
+//kept until the alias is seen to be updated or deleted, see FlushAlias
+func (bw *BW) resolveAlias(k bc.Bytes32) (bc.Bytes32, bool, error) {
+	bw.getlock()
+	res, ok := bw.rdata.aliasCache[k]
+	bw.rellock()
+	if ok {
+		return res, false, nil
+	}
+	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
 	if err != nil || iszero {
-		return "", false, err
+		if pres, ok := bw.preloadedAlias(k); ok {
+			return pres, false, nil
+		}
+		return res, iszero, err
+	}
+	bw.getlock()
+	bw.rdata.aliasCache[k] = res
+	bw.rellock()
+	return res, false, nil
+}
+
+//FindAliasesFor returns every alias (long or short) that currently has
+//the value, oldest first
+func (bw *BW) FindAliasesFor(val []byte) ([]*bc.AliasRecord, error) {
+	if len(val) > 32 {
+		return nil, bwe.M(bwe.AliasError, "Alias values cannot be longer than 32 bytes")
+	}
+	kval := bc.SliceToBytes32(val)
+	bw.getlock()
+	recs, ok := bw.rdata.aliasesForCache[kval]
+	bw.rellock()
+	if ok {
+		return recs, nil
+	}
+	recs, err := bw.bchain.FindAliasesFor(context.TODO(), kval)
+	if err != nil {
+		return nil, err
 	}
-	return NullTerminatedByteSliceToString(key[:]), true, nil
+	bw.getlock()
+	bw.rdata.aliasesForCache[kval] = recs
+	for _, r := range recs {
+		bw.rdata.aliasCache[r.Key] = r.Value
+	}
+	bw.rellock()
+	return recs, nil
+}
+
+//FindAliasesCreatedBy returns every alias paid for by one of the given
+//accounts, oldest first. This scans the whole alias history so it is not
+//cached
+func (bw *BW) FindAliasesCreatedBy(addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	return bw.bchain.FindAliasesCreatedBy(context.TODO(), addrs)
+}
+
+//FindAliasesOwnedBy returns every alias that one of the given accounts can
+//update, transfer or delete, oldest first. Like FindAliasesCreatedBy it
+//is not cached
+func (bw *BW) FindAliasesOwnedBy(addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	return bw.bchain.FindAliasesOwnedBy(context.TODO(), addrs)
 }
 
 //Get the host:port SRV record for a drvk. XTAG add this to the bc caching
 //mechanism
 func (bw *BW) LookupDesignatedRouterSRV(drvk []byte) (string, error) {
-	return bw.bchain.GetSRVRecordFor(context.TODO(), drvk)
+	srv, err := bw.bchain.GetSRVRecordFor(context.TODO(), drvk)
+	if err != nil {
+		if psrv, ok := bw.preloadedSRV(drvk); ok {
+			return psrv, nil
+		}
+		if dsrv, ok := bw.dnsSRV(drvk); ok {
+			return dsrv, nil
+		}
+		if lsrv, ok := bw.localSRV(drvk); ok {
+			return lsrv, nil
+		}
+	}
+	return srv, err
 }
 
 //XTAG add this to the bc caching mechanism
 func (bw *BW) LookupDesignatedRouter(nsvk []byte) ([]byte, error) {
-	return bw.bchain.GetDesignatedRouterFor(context.TODO(), nsvk)
+	drvk, err := bw.bchain.GetDesignatedRouterFor(context.TODO(), nsvk)
+	if err != nil {
+		if pdrvk, ok := bw.preloadedDesignatedRouter(nsvk); ok {
+			return pdrvk, nil
+		}
+		if ddrvk, ok := bw.dnsDesignatedRouter(nsvk); ok {
+			return ddrvk, nil
+		}
+	}
+	return drvk, err
 }
 func (bw *BW) LookupDesignatedRouterS(nsvk string) ([]byte, error) {
 	nsvkbin, err := crypto.UnFmtKey(nsvk)
@@ -46,7 +142,7 @@ func (bw *BW) LookupDesignatedRouterS(nsvk string) ([]byte, error) {
 func (bw *BW) ResolveLongAlias(in string) ([]byte, error) {
 	k := bc.Bytes32{}
 	copy(k[:], []byte(in))
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.resolveAlias(k)
 	if err != nil {
 		return nil, err
 	}
@@ -63,9 +159,12 @@ func (bw *BW) ResolveShortAlias(hexstr string) ([]byte, error) {
 	if err != nil {
 		return nil, bwe.M(bwe.UnresolvedAlias, "Bad hex for short alias")
 	}
+	if len(bin) > 32 {
+		return nil, bwe.M(bwe.UnresolvedAlias, "Short alias is longer than 32 bytes")
+	}
 	k := bc.Bytes32{}
 	copy(k[32-len(bin):], bin)
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.resolveAlias(k)
 	if err != nil {
 		return nil, err
 	}
@@ -132,20 +231,23 @@ func (bw *BW) ExpandAliases(in string) (string, error) {
 	return buffer.String(), nil
 }
 
-//A little like expand aliases except we first check if it is
-//a valid encoded key and only if that fails do we  assume it
-//is a long alias. The result is a binary VK
-func (bw *BW) ResolveKey(name string) ([]byte, error) {
-	nsvk, err := crypto.UnFmtKey(name)
-	if err == nil {
-		return nsvk, nil
+var aliasRefRegex = regexp.MustCompile(`^@([0-9a-zA-Z]*)(\]|\[)$`)
+
+//resolveAliasRef resolves a whole-string alias: @hex] for a short alias,
+//@key[ or just key for a long alias
+func (bw *BW) resolveAliasRef(name string) ([]byte, error) {
+	if m := aliasRefRegex.FindStringSubmatch(name); m != nil {
+		if m[2] == "]" {
+			return bw.ResolveShortAlias(m[1])
+		}
+		return bw.ResolveLongAlias(m[1])
 	}
 	if len([]byte(name)) > 32 {
 		return nil, bwe.M(bwe.UnresolvedAlias, "Key is not a VK/Hash but longer than an alias"+name)
 	}
 	k := bc.Bytes32{}
 	copy(k[:], []byte(name))
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.resolveAlias(k)
 	if err != nil {
 		return nil, err
 	}
@@ -155,27 +257,30 @@ func (bw *BW) ResolveKey(name string) ([]byte, error) {
 	return res[:], nil
 }
 
+//A little like expand aliases except we first check if it is
+//a valid encoded key and only if that fails do we  assume it
+//is an alias (short or long). A name with a dot that is not an
+//alias is tried as a domain publishing a namespace in DNS. The
+//result is a binary VK
+func (bw *BW) ResolveKey(name string) ([]byte, error) {
+	nsvk, err := crypto.UnFmtKey(name)
+	if err == nil {
+		return nsvk, nil
+	}
+	rv, err := bw.resolveAliasRef(name)
+	if err != nil {
+		if dvk, ok := bw.dnsNamespaceKey(name); ok {
+			return dvk, nil
+		}
+	}
+	return rv, err
+}
+
 func (bw *BW) ResolveRO(aliasorhash string) (ros objects.RoutingObject, state int, err error) {
 	bhash, err := crypto.UnFmtKey(aliasorhash)
 	if err != nil {
 		//Try and resolve it as an alias
-		if len([]byte(aliasorhash)) > 32 {
-			return nil, StateError, bwe.M(bwe.UnresolvedAlias, "Key is not a VK/Hash but longer than an alias"+aliasorhash)
-		}
-		match, err := regexp.MatchString(`^@[0-9a-zA-Z]*(\]|\[)$`, aliasorhash)
-		if err != nil {
-			panic(err)
-		}
-		if match {
-			key := aliasorhash[1 : len(aliasorhash)-1]
-			if aliasorhash[len(aliasorhash)-1] == ']' {
-				bhash, err = bw.ResolveShortAlias(key)
-			} else {
-				bhash, err = bw.ResolveLongAlias(key)
-			}
-		} else {
-			bhash, err = bw.ResolveLongAlias(aliasorhash)
-		}
+		bhash, err = bw.resolveAliasRef(aliasorhash)
 		if err != nil {
 			return nil, StateError, err
 		}
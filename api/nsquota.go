@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//NamespaceQuota is what a [quota] section allows on a namespace. Zero
+//means no limit
+type NamespaceQuota struct {
+	MessagesPerHour   int
+	BytesPerHour      int
+	MaxPersistedBytes int
+}
+
+//namespaceQuota returns the quota configured for nsvk, or false if there
+//is none
+func (bw *BW) namespaceQuota(nsvk []byte) (NamespaceQuota, bool) {
+	for name, q := range bw.Config.Quota {
+		vk, err := bw.ResolveKey(q.Namespace)
+		if err != nil {
+			log.Warnf("quota %q: could not resolve namespace %q: %v", name, q.Namespace, err)
+			continue
+		}
+		if bytes.Equal(vk, nsvk) {
+			return NamespaceQuota{
+				MessagesPerHour:   q.MessagesPerHour,
+				BytesPerHour:      q.BytesPerHour,
+				MaxPersistedBytes: q.MaxPersistedBytes,
+			}, true
+		}
+	}
+	return NamespaceQuota{}, false
+}
+
+//checkNamespaceQuota refuses a publish or persist that this router is
+//delivering if its namespace has used up a quota. The persisted bytes
+//count a persist as if it adds to the store, even if it replaces a message.
+//The router's own messages are not limited
+func (bw *BW) checkNamespaceQuota(m *core.Message, ovk []byte) error {
+	if len(bw.Config.Quota) == 0 || bytes.Equal(ovk, bw.Entity.GetVK()) {
+		return nil
+	}
+	if m.Type != core.TypePublish && m.Type != core.TypePersist {
+		return nil
+	}
+	q, ok := bw.namespaceQuota(m.MVK)
+	if !ok {
+		return nil
+	}
+	ns := crypto.FmtKey(m.MVK)
+	u := bw.tm.Usage(ns)
+	size := uint64(len(m.Encoded))
+	switch {
+	case q.MessagesPerHour > 0 && u.WindowMessages+1 > uint64(q.MessagesPerHour):
+		return bwe.M(bwe.NamespaceQuotaExceeded, fmt.Sprintf("%s may have %d messages an hour", ns, q.MessagesPerHour))
+	case q.BytesPerHour > 0 && u.WindowBytes+size > uint64(q.BytesPerHour):
+		return bwe.M(bwe.NamespaceQuotaExceeded, fmt.Sprintf("%s may have %d bytes an hour", ns, q.BytesPerHour))
+	case m.Type == core.TypePersist && q.MaxPersistedBytes > 0 && u.Persisted+int64(size) > int64(q.MaxPersistedBytes):
+		return bwe.M(bwe.NamespaceQuotaExceeded, fmt.Sprintf("%s may persist %d bytes", ns, q.MaxPersistedBytes))
+	}
+	return nil
+}
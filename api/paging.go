@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/binary"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+const (
+	//DefaultPageLimit is the size of a page if PageParams.Limit is zero
+	DefaultPageLimit = 100
+	//MaxPageLimit is the largest page that may be asked for
+	MaxPageLimit = 10000
+)
+
+//PageParams selects one page of the results of a QueryPage or ListPage, so
+//that a large persisted tree can be browsed a bit at a time. Results come
+//in URI order
+type PageParams struct {
+	//The most results in the page. Zero means DefaultPageLimit
+	Limit int
+	//The cursor given with the previous page, or empty for the first page
+	Cursor string
+}
+
+//PageEndCallback is called after the last result of a page with the cursor
+//for the next page, which is empty if there are no more results
+type PageEndCallback func(next string)
+
+//check fills in the default limit and checks the cursor is one of ours
+func (p *PageParams) check() error {
+	if p.Limit == 0 {
+		p.Limit = DefaultPageLimit
+	}
+	if p.Limit < 0 || p.Limit > MaxPageLimit {
+		return bwe.M(bwe.BadOperation, "page limit out of range")
+	}
+	_, err := store.DecodeCursor(p.Cursor)
+	return err
+}
+
+//QueryPage is Query for a single page of the results. resultCB is not
+//called with nil, endCB is called instead
+func (c *BosswaveClient) QueryPage(params *QueryParams, page PageParams,
+	actionCB QueryInitialCallback,
+	resultCB QueryResultCallback,
+	endCB PageEndCallback) {
+	c.queryPage(params, core.TypeQuery, page, actionCB, resultCB, endCB)
+}
+
+//TapQueryPage is QueryPage with T permissions instead of C
+func (c *BosswaveClient) TapQueryPage(params *QueryParams, page PageParams,
+	actionCB QueryInitialCallback,
+	resultCB QueryResultCallback,
+	endCB PageEndCallback) {
+	c.queryPage(params, core.TypeTapQuery, page, actionCB, resultCB, endCB)
+}
+
+func (c *BosswaveClient) queryPage(params *QueryParams, mtype int, page PageParams,
+	actionCB QueryInitialCallback,
+	resultCB QueryResultCallback,
+	endCB PageEndCallback) {
+	if err := page.check(); err != nil {
+		actionCB(err)
+		return
+	}
+	m, err := c.newQueryMessage(params, mtype)
+	if err != nil {
+		actionCB(err)
+		return
+	}
+	err = c.VerifyAffinity(m)
+	if err == nil { //Local delivery
+		actionCB(nil)
+		//The cursor was checked, so there is no error
+		next, _ := c.cl.QueryPage(m, page.Cursor, page.Limit, func(m *core.Message) {
+			if err := m.Verify(c.BW()); err != nil {
+				log.Infof("dropping local query result (failed verify %s)", err.Error())
+				return
+			}
+			resultCB(m)
+		})
+		endCB(next)
+	} else { //Remote delivery
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			actionCB(bwe.WrapM(bwe.PeerError, "could not peer", err))
+			return
+		}
+		peer.Page(m, page, actionCB, func(body []byte, seq uint64) {
+			nm, err := core.LoadMessage(body)
+			if err != nil {
+				log.Info("dropping incoming query result (malformed message)")
+				return
+			}
+			nm.PersistSeq = seq
+			if err := nm.Verify(c.BW()); err != nil {
+				log.Warnf("dropping incoming query result on uri=%s (failed local validation (%s))", m.Topic, err.Error())
+				return
+			}
+			resultCB(nm)
+		}, endCB)
+	}
+}
+
+//ListPage is List for a single page of the children. resultCB is only
+//called with ok set, endCB is called at the end instead
+func (c *BosswaveClient) ListPage(params *ListParams, page PageParams,
+	actionCB ListInitialCallback,
+	resultCB ListResultCallback,
+	endCB PageEndCallback) {
+	if err := page.check(); err != nil {
+		actionCB(err)
+		return
+	}
+	m, err := c.newListMessage(params)
+	if err != nil {
+		actionCB(err)
+		return
+	}
+	err = c.VerifyAffinity(m)
+	if err == nil { //Local delivery
+		actionCB(nil)
+		next, _ := c.cl.ListPage(m, page.Cursor, page.Limit, func(s string) {
+			resultCB(s, true)
+		})
+		endCB(next)
+	} else { //Remote delivery
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			actionCB(bwe.WrapM(bwe.PeerError, "could not peer", err))
+			return
+		}
+		peer.Page(m, page, actionCB, func(body []byte, seq uint64) {
+			resultCB(string(body), true)
+		}, endCB)
+	}
+}
+
+//encodePage is the body of a nCmdPage frame
+func encodePage(m *core.Message, page PageParams) []byte {
+	body := make([]byte, 4+len(page.Cursor)+len(m.Encoded))
+	binary.LittleEndian.PutUint16(body, uint16(page.Limit))
+	binary.LittleEndian.PutUint16(body[2:], uint16(len(page.Cursor)))
+	copy(body[4:], page.Cursor)
+	copy(body[4+len(page.Cursor):], m.Encoded)
+	return body
+}
+
+func decodePage(b []byte) (PageParams, []byte, error) {
+	if len(b) < 4 || len(b) < 4+int(binary.LittleEndian.Uint16(b[2:])) {
+		return PageParams{}, nil, bwe.M(bwe.MalformedMessage, "short page frame")
+	}
+	cl := int(binary.LittleEndian.Uint16(b[2:]))
+	page := PageParams{
+		Limit:  int(binary.LittleEndian.Uint16(b)),
+		Cursor: string(b[4 : 4+cl]),
+	}
+	return page, b[4+cl:], nil
+}
+
+//Page asks the peer for a page of the results of a query, tap query or
+//list message. resultCB gets the body of each result frame, and the
+//persist sequence number of a message if it has one
+func (pc *PeerClient) Page(m *core.Message, page PageParams,
+	actionCB func(err error),
+	resultCB func(body []byte, seq uint64),
+	endCB PageEndCallback) {
+	nf := nativeFrame{
+		cmd:   nCmdPage,
+		body:  encodePage(m, page),
+		seqno: pc.getSeqno(),
+	}
+	started := false
+	var seq uint64
+	pc.transact(&nf, func(f *nativeFrame) {
+		if f == nil {
+			if started {
+				log.Infof("peer disconnected during a page of %s", m.Topic)
+				endCB("")
+			} else {
+				actionCB(bwe.M(bwe.PeerError, "Peer disconnected"))
+			}
+			return
+		}
+		switch f.cmd {
+		case nCmdRStatus:
+			if len(f.body) < 2 {
+				actionCB(bwe.M(bwe.PeerError, "short response frame"))
+				return
+			}
+			code := int(binary.LittleEndian.Uint16(f.body))
+			if code != bwe.Okay {
+				actionCB(bwe.M(code, string(f.body[2:])))
+				pc.removeCB(nf.seqno)
+			} else {
+				started = true
+				actionCB(nil)
+			}
+			return
+		case nCmdSeq:
+			seq = decodeSeq(f.body)
+			return
+		case nCmdResult:
+			resultCB(f.body, seq)
+			seq = 0
+			return
+		case nCmdEnd:
+			endCB(string(f.body))
+			pc.removeCB(nf.seqno)
+		}
+	})
+}
@@ -25,6 +25,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,11 +33,13 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/util/bwe"
 )
 
 type PeerClient struct {
 	seqno      uint64
+	stats      peerCounters
 	conn       net.Conn
 	txmtx      sync.Mutex
 	replyCB    map[uint64]func(*nativeFrame)
@@ -45,40 +48,72 @@ type PeerClient struct {
 	bwcl       *BosswaveClient
 	asublock   sync.Mutex
 	activesubs map[uint64]*core.Message
+	pipe       *publishPipeline
+	//When each outstanding transaction was sent, and the smoothed RTT
+	sent   map[uint64]time.Time
+	rtt    time.Duration
+	statmu sync.Mutex
+	//1 while the connection is up, used for failing over to another
+	//designated router
+	connected int32
 }
 
-func (cl *PeerClient) reconnectPeer() error {
+//dialPeer connects to a peer server and checks that it proves it has the
+//SK for vk. A zero timeout waits forever
+func dialPeer(target string, vk []byte, timeout time.Duration) (*tls.Conn, error) {
 	roots := x509.NewCertPool()
-	conn, err := tls.Dial("tcp", cl.target, &tls.Config{
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", target, &tls.Config{
 		InsecureSkipVerify: true,
 		RootCAs:            roots,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cs := conn.ConnectionState()
 	if len(cs.PeerCertificates) != 1 {
 		log.Criticalf("peer connection weird response")
-		return errors.New("Wrong certificates")
+		conn.Close()
+		return nil, errors.New("Wrong certificates")
+	}
+	if timeout != 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
 	}
 	proof := make([]byte, 96)
 	_, err = io.ReadFull(conn, proof)
 	if err != nil {
-		return errors.New("failed to read proof: " + err.Error())
+		conn.Close()
+		return nil, errors.New("failed to read proof: " + err.Error())
 	}
+	conn.SetReadDeadline(time.Time{})
 	proofOK := crypto.VerifyBlob(proof[:32], proof[32:], cs.PeerCertificates[0].Signature)
 	if !proofOK {
-		return errors.New("peer verification failed")
+		conn.Close()
+		return nil, errors.New("peer verification failed")
+	}
+	if !bytes.Equal(proof[:32], vk) {
+		conn.Close()
+		return nil, errors.New("peer has a different VK")
 	}
-	if !bytes.Equal(proof[:32], cl.expectedVK) {
-		return errors.New("peer has a different VK")
+	return conn, nil
+}
+
+func (cl *PeerClient) reconnectPeer() error {
+	conn, err := dialPeer(cl.target, cl.expectedVK, 0)
+	if err != nil {
+		return err
 	}
 	cl.txmtx.Lock()
 	cl.conn = conn
 	cl.txmtx.Unlock()
+	atomic.StoreInt32(&cl.connected, 1)
 	return nil
 }
 
+//Connected returns false while the peer is reconnecting
+func (pc *PeerClient) Connected() bool {
+	return atomic.LoadInt32(&pc.connected) == 1
+}
+
 func (cl *BosswaveClient) ConnectToPeer(vk []byte, target string) (*PeerClient, error) {
 	rv := PeerClient{
 		conn:       nil,
@@ -87,6 +122,8 @@ func (cl *BosswaveClient) ConnectToPeer(vk []byte, target string) (*PeerClient,
 		bwcl:       cl,
 		expectedVK: vk,
 		activesubs: make(map[uint64]*core.Message),
+		pipe:       newPublishPipeline(cl.bw.publishWindow()),
+		sent:       make(map[uint64]time.Time),
 	}
 	err := rv.reconnectPeer()
 	if err != nil {
@@ -97,6 +134,7 @@ func (cl *BosswaveClient) ConnectToPeer(vk []byte, target string) (*PeerClient,
 		rv.conn.Close()
 	}()
 	go rv.rxloop()
+	go rv.watchSlowPeer()
 	return &rv, nil
 }
 
@@ -138,15 +176,16 @@ func (pc *PeerClient) regenSubs() {
 	}
 }
 func (pc *PeerClient) rxloop() {
-	hdr := make([]byte, 17)
 	for {
-		_, err := io.ReadFull(pc.conn, hdr)
+		fr, err := readNativeFrame(pc.conn, maxNativeFrame)
 		if err != nil {
 			log.Infof("PEER CONNECTION to %s: %s", pc.target, err)
+			atomic.StoreInt32(&pc.connected, 0)
 			if pc.bwcl.ctx.Err() != nil {
 				return
 			}
 			pc.conn.Close()
+			pc.noteDisconnect()
 			pc.txmtx.Lock()
 			cbz := pc.replyCB
 			for _, e := range cbz {
@@ -169,27 +208,24 @@ func (pc *PeerClient) rxloop() {
 			}
 			continue
 		}
-		ln := binary.LittleEndian.Uint64(hdr)
-		seqno := binary.LittleEndian.Uint64(hdr[8:])
-		cmd := hdr[16]
-		body := make([]byte, ln)
-		_, err = io.ReadFull(pc.conn, body)
-		if err != nil {
-			log.Info("peer client: ", err)
-			continue
-		}
-		fr := nativeFrame{
-			length: ln,
-			seqno:  seqno,
-			cmd:    cmd,
-			body:   body,
-		}
-		//fmt.Printf("dispatching peer frame %x to %d\n", cmd, seqno)
+		//fmt.Printf("dispatching peer frame %x to %d\n", fr.cmd, fr.seqno)
+		pc.noteReceived(fr.seqno, len(fr.body))
 		pc.txmtx.Lock()
-		cb := pc.replyCB[seqno]
+		cb, ok := pc.replyCB[fr.seqno]
 		pc.txmtx.Unlock()
-		cb(&fr)
+		if !ok {
+			log.Info("peer client: frame for unknown seqno ", fr.seqno)
+			continue
+		}
+		cb(fr)
+	}
+}
+//decodeSeq is the sequence number in the body of a nCmdSeq frame
+func decodeSeq(body []byte) uint64 {
+	if len(body) != 8 {
+		return 0
 	}
+	return binary.LittleEndian.Uint64(body)
 }
 func (pc *PeerClient) getSeqno() uint64 {
 	return atomic.AddUint64(&pc.seqno, 1)
@@ -207,6 +243,7 @@ func (pc *PeerClient) transact(f *nativeFrame, onRX func(f *nativeFrame)) {
 	pc.txmtx.Lock()
 	pc.replyCB[f.seqno] = onRX
 	defer pc.txmtx.Unlock()
+	pc.noteSent(f.seqno, len(f.body))
 	_, err := pc.conn.Write(tmphdr)
 	if err != nil {
 		log.Info("peer write error: ", err.Error())
@@ -222,27 +259,101 @@ func (pc *PeerClient) transact(f *nativeFrame, onRX func(f *nativeFrame)) {
 	}
 }
 func (pc *PeerClient) PublishPersist(m *core.Message, actionCB func(err error)) {
+	pc.transactStatus(nCmdMessage, m, actionCB)
+}
+
+//Replicate delivers a message to another member of the namespace's
+//replica set, which will not replicate it further. A persisted message
+//keeps its sequence number there
+func (pc *PeerClient) Replicate(m *core.Message, actionCB func(err error)) {
+	pc.transactNumbered(nCmdReplicate, m, actionCB)
+}
+
+//Gossip sends a persisted message to another member of the replica set,
+//which keeps it, with its sequence number, only if it has nothing
+//persisted on that URI
+func (pc *PeerClient) Gossip(m *core.Message, actionCB func(err error)) {
+	pc.transactNumbered(nCmdGossip, m, actionCB)
+}
+
+//transactNumbered is transactStatus for a replicate or gossip frame, which
+//is sent in a nCmdNumbered frame if the message has a sequence number.
+//Peers that refuse that are sent the plain frame
+func (pc *PeerClient) transactNumbered(cmd uint8, m *core.Message, actionCB func(err error)) {
+	if m.PersistSeq == 0 {
+		pc.transactStatus(cmd, m, actionCB)
+		return
+	}
+	pc.transactStatusBody(nCmdNumbered, encodeNumbered(cmd, m), func(err error, msg string) {
+		if err != nil && bwe.AsBW(err).Code == bwe.BadOperation {
+			pc.transactStatus(cmd, m, actionCB)
+			return
+		}
+		actionCB(err)
+	})
+}
+
+//PublishPersistReport is PublishPersist, but also gives the number of
+//consumers the message was delivered to, or -1 if the peer did not say
+func (pc *PeerClient) PublishPersistReport(m *core.Message, actionCB PublishReportCallback) {
+	pc.transactStatusBody(nCmdMessage, m.Encoded, func(err error, msg string) {
+		if err != nil {
+			actionCB(err, -1)
+			return
+		}
+		consumers, perr := strconv.Atoi(msg)
+		if perr != nil {
+			consumers = -1
+		}
+		actionCB(nil, consumers)
+	})
+}
+
+//Nack asks the peer to deliver a consumer limited message to another
+//consumer, as the one on subscription subid could not process it
+func (pc *PeerClient) Nack(msgid core.UniqueMessageID, subid core.UniqueMessageID,
+	actionCB func(redelivered bool, err error)) {
+	body := make([]byte, 32)
+	binary.LittleEndian.PutUint64(body, msgid.Mid)
+	binary.LittleEndian.PutUint64(body[8:], msgid.Sig)
+	binary.LittleEndian.PutUint64(body[16:], subid.Mid)
+	binary.LittleEndian.PutUint64(body[24:], subid.Sig)
+	pc.transactStatusBody(nCmdNack, body, func(err error, msg string) {
+		actionCB(err == nil && msg == "true", err)
+	})
+}
+
+//transactStatus sends a message that gets a single status frame back
+func (pc *PeerClient) transactStatus(cmd uint8, m *core.Message, actionCB func(err error)) {
+	pc.transactStatusBody(cmd, m.Encoded, func(err error, msg string) {
+		actionCB(err)
+	})
+}
+
+//transactStatusBody sends a frame that gets a single status frame back,
+//giving the status message on success
+func (pc *PeerClient) transactStatusBody(cmd uint8, body []byte, actionCB func(err error, msg string)) {
 	nf := nativeFrame{
-		cmd:   nCmdMessage,
-		body:  m.Encoded,
+		cmd:   cmd,
+		body:  body,
 		seqno: pc.getSeqno(),
 	}
 	pc.transact(&nf, func(f *nativeFrame) {
 		defer pc.removeCB(nf.seqno)
 		if f == nil {
-			actionCB(bwe.M(bwe.PeerError, "Peer disconnected"))
+			actionCB(bwe.M(bwe.PeerError, "Peer disconnected"), "")
 			return
 		}
 		if len(f.body) < 2 {
-			actionCB(bwe.M(bwe.PeerError, "short response frame"))
+			actionCB(bwe.M(bwe.PeerError, "short response frame"), "")
 			return
 		}
 		code := int(binary.LittleEndian.Uint16(f.body))
 		msg := string(f.body[2:])
 		if code != bwe.Okay {
-			actionCB(bwe.M(code, msg))
+			actionCB(bwe.M(code, msg), "")
 		} else {
-			actionCB(nil)
+			actionCB(nil, msg)
 		}
 		return
 	})
@@ -256,6 +367,8 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 		body:  m.Encoded,
 		seqno: pc.getSeqno(),
 	}
+	//From the nCmdSeq frame before a result
+	var seq uint64
 	pc.transact(&nf, func(f *nativeFrame) {
 		if f == nil {
 			//Peer error, on a subscribe it will just get regenned
@@ -273,6 +386,8 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 			code := int(binary.LittleEndian.Uint16(f.body))
 			if code != bwe.Okay {
 				actionCB(bwe.M(code, string(f.body[2:])), core.UniqueMessageID{})
+			} else if len(f.body) < 18 {
+				actionCB(bwe.M(bwe.PeerError, "short subscribe response frame"), core.UniqueMessageID{})
 			} else {
 				mid := binary.LittleEndian.Uint64(f.body[2:])
 				sig := binary.LittleEndian.Uint64(f.body[10:])
@@ -281,15 +396,29 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 				pc.activesubs[nf.seqno] = m
 				pc.asublock.Unlock()
 				actionCB(nil, umid)
+				//The DR ends the subscription when it expires, but if it is
+				//unreachable then we must end it ourselves, as it would
+				//refuse to regenerate it
+				if exp, ok := m.Expiry(); ok {
+					time.AfterFunc(exp.Sub(time.Now()), func() {
+						pc.endSub(nf.seqno, messageCB)
+					})
+				}
 			}
 			return
+		case nCmdSeq:
+			seq = decodeSeq(f.body)
+			return
 		case nCmdResult:
 			//log.Infof("Got subscribe message response")
+			pseq := seq
+			seq = 0
 			nm, err := core.LoadMessage(f.body)
 			if err != nil {
 				log.Info("dropping incoming subscription result (malformed message)")
 				return
 			}
+			nm.PersistSeq = pseq
 			err = nm.Verify(pc.bwcl.BW())
 			if err != nil {
 				log.Infof("dropping incoming subscription result on uri=%s (failed local validation %s)", nm.Topic, err.Error())
@@ -299,14 +428,24 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 			return
 		case nCmdEnd:
 			//This will be signalled when we unsubscribe
-			pc.asublock.Lock()
-			delete(pc.activesubs, nf.seqno)
-			pc.asublock.Unlock()
-			messageCB(nil)
-			pc.removeCB(nf.seqno)
+			pc.endSub(nf.seqno, messageCB)
 		}
 	})
 }
+
+//endSub delivers the end of a subscription to its callback, unless it has
+//already ended
+func (pc *PeerClient) endSub(seqno uint64, messageCB func(m *core.Message)) {
+	pc.asublock.Lock()
+	_, active := pc.activesubs[seqno]
+	delete(pc.activesubs, seqno)
+	pc.asublock.Unlock()
+	if !active {
+		return
+	}
+	messageCB(nil)
+	pc.removeCB(seqno)
+}
 func (pc *PeerClient) Unsubscribe(m *core.Message, actionCB func(err error)) {
 	nf := nativeFrame{
 		cmd:   nCmdMessage,
@@ -362,6 +501,59 @@ func (pc *PeerClient) List(m *core.Message,
 	})
 }
 
+//ListTree is List with a depth, returning the child count of each node
+//and whether it has data
+func (pc *PeerClient) ListTree(m *core.Message, depth int,
+	actionCB func(err error),
+	resultCB func(e *store.ListEntry)) {
+	body := make([]byte, 2+len(m.Encoded))
+	binary.LittleEndian.PutUint16(body, uint16(depth))
+	copy(body[2:], m.Encoded)
+	nf := nativeFrame{
+		cmd:   nCmdListTree,
+		body:  body,
+		seqno: pc.getSeqno(),
+	}
+	started := false
+	pc.transact(&nf, func(f *nativeFrame) {
+		if f == nil {
+			if started {
+				resultCB(nil)
+			} else {
+				actionCB(bwe.M(bwe.PeerError, "Peer disconnected"))
+			}
+			return
+		}
+		switch f.cmd {
+		case nCmdRStatus:
+			if len(f.body) < 2 {
+				actionCB(bwe.M(bwe.PeerError, "short response frame"))
+				return
+			}
+			code := int(binary.LittleEndian.Uint16(f.body))
+			if code != bwe.Okay {
+				actionCB(bwe.M(code, string(f.body[2:])))
+				pc.removeCB(nf.seqno)
+			} else {
+				started = true
+				actionCB(nil)
+			}
+			return
+		case nCmdResult:
+			e, err := decodeListEntry(f.body)
+			if err != nil {
+				log.Infof("dropping list result: %v", err)
+				return
+			}
+			resultCB(e)
+			return
+		case nCmdEnd:
+			resultCB(nil)
+			pc.removeCB(nf.seqno)
+		}
+	})
+}
+
 func (pc *PeerClient) Query(m *core.Message,
 	actionCB func(err error),
 	resultCB func(m *core.Message)) {
@@ -370,6 +562,7 @@ func (pc *PeerClient) Query(m *core.Message,
 		body:  m.Encoded,
 		seqno: pc.getSeqno(),
 	}
+	var seq uint64
 	pc.transact(&nf, func(f *nativeFrame) {
 		switch f.cmd {
 		case nCmdRStatus:
@@ -384,12 +577,17 @@ func (pc *PeerClient) Query(m *core.Message,
 				actionCB(nil)
 			}
 			return
+		case nCmdSeq:
+			seq = decodeSeq(f.body)
 		case nCmdResult:
+			pseq := seq
+			seq = 0
 			nm, err := core.LoadMessage(f.body)
 			if err != nil {
 				log.Info("dropping incoming query result (malformed message)")
 				return
 			}
+			nm.PersistSeq = pseq
 			err = nm.Verify(pc.bwcl.BW())
 			if err != nil {
 				log.Warnf("dropping incoming query result on uri=%s (failed local validation (%s))", m.Topic, err.Error())
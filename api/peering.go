@@ -0,0 +1,187 @@
+package api
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//peerPolicy decides which peers the native listener serves and which of
+//their messages it accepts, from the [peering] section of the config. The
+//listener does not learn a peer's VK, so the VK lists apply to the origin
+//VK of each message
+type peerPolicy struct {
+	allow [][]byte
+	deny  [][]byte
+	//If there are any, only messages on these namespaces are accepted
+	namespaces []peerNamespace
+	maxPerIP   int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+//peerNamespace is a namespace peers may send messages on, optionally only
+//from some networks
+type peerNamespace struct {
+	nsvk     []byte
+	networks []*net.IPNet
+}
+
+//newPeerPolicy parses the [peering] section. Keys must be VKs rather
+//than aliases, as the chain may not have synced when the listener starts
+func newPeerPolicy(cfg *core.BWConfig) (*peerPolicy, error) {
+	p := &peerPolicy{
+		maxPerIP: cfg.Peering.MaxConnsPerIP,
+		conns:    make(map[string]int),
+	}
+	var err error
+	if p.allow, err = parseVKs("peering", cfg.Peering.AllowVK); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseVKs("peering", cfg.Peering.DenyVK); err != nil {
+		return nil, err
+	}
+	for _, ns := range cfg.Peering.Namespace {
+		fields := strings.Fields(ns)
+		if len(fields) == 0 {
+			continue
+		}
+		nsvk, err := crypto.UnFmtKey(fields[0])
+		if err != nil {
+			return nil, bwe.M(bwe.InvalidEntity, "[peering] namespace is not a key: "+fields[0])
+		}
+		pn := peerNamespace{nsvk: nsvk}
+		for _, f := range fields[1:] {
+			for _, c := range strings.Split(f, ",") {
+				if c == "" {
+					continue
+				}
+				_, ipn, err := net.ParseCIDR(c)
+				if err != nil {
+					return nil, bwe.M(bwe.BadOperation, "[peering] bad network "+c)
+				}
+				pn.networks = append(pn.networks, ipn)
+			}
+		}
+		p.namespaces = append(p.namespaces, pn)
+	}
+	return p, nil
+}
+
+//parseVKs parses repeated config lines of comma separated VKs, from the
+//named section
+func parseVKs(section string, vals []string) ([][]byte, error) {
+	var rv [][]byte
+	for _, v := range vals {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			vk, err := crypto.UnFmtKey(s)
+			if err != nil {
+				return nil, bwe.M(bwe.InvalidEntity, "["+section+"] VK is not a key: "+s)
+			}
+			rv = append(rv, vk)
+		}
+	}
+	return rv, nil
+}
+
+func containsVK(vks [][]byte, vk []byte) bool {
+	for _, v := range vks {
+		if bytes.Equal(v, vk) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+//admit counts a new connection from addr, and returns false if there are
+//already as many from its IP as are allowed. Admitted connections must be
+//released
+func (p *peerPolicy) admit(addr net.Addr) bool {
+	ip := remoteIP(addr).String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.maxPerIP > 0 && p.conns[ip] >= p.maxPerIP {
+		return false
+	}
+	p.conns[ip]++
+	return true
+}
+
+func (p *peerPolicy) release(addr net.Addr) {
+	ip := remoteIP(addr).String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[ip]--
+	if p.conns[ip] <= 0 {
+		delete(p.conns, ip)
+	}
+}
+
+//check refuses a verified message from the peer at addr that the policy
+//does not allow
+func (p *peerPolicy) check(msg *core.Message, addr net.Addr) error {
+	if msg.OriginVK != nil {
+		if containsVK(p.deny, *msg.OriginVK) {
+			return bwe.M(bwe.BadPermissions, "origin VK may not send messages through this router")
+		}
+		if len(p.allow) != 0 && !containsVK(p.allow, *msg.OriginVK) {
+			return bwe.M(bwe.BadPermissions, "origin VK is not allowed to send messages through this router")
+		}
+	} else if len(p.allow) != 0 {
+		return bwe.M(bwe.BadPermissions, "message has no origin VK")
+	}
+	if len(p.namespaces) == 0 {
+		return nil
+	}
+	for _, ns := range p.namespaces {
+		if !bytes.Equal(ns.nsvk, msg.MVK) {
+			continue
+		}
+		if len(ns.networks) == 0 {
+			return nil
+		}
+		ip := remoteIP(addr)
+		for _, n := range ns.networks {
+			if ip != nil && n.Contains(ip) {
+				return nil
+			}
+		}
+		return bwe.M(bwe.BadPermissions, "peers on this network may not send messages on the namespace")
+	}
+	return bwe.M(bwe.BadPermissions, "this router does not accept messages on the namespace from peers")
+}
+
+//DropPeer ends the subscriptions of a peer and closes its connection,
+//given its client ID from Clients
+func (bw *BW) DropPeer(id uint64) error {
+	bw.clients.mu.Lock()
+	c, ok := bw.clients.clients[id]
+	bw.clients.mu.Unlock()
+	if !ok {
+		return bwe.M(bwe.BadOperation, "no such client")
+	}
+	if c.peerConn == nil {
+		return bwe.M(bwe.BadOperation, "client is not a peer")
+	}
+	//The session sends the end of the peer's subscriptions and closes
+	//the connection
+	c.ctxCancel()
+	return nil
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//DefaultPublishWindow is how many publishes to a peer may await their acks
+//at once if [router] PublishWindow is not set
+const DefaultPublishWindow = 64
+
+//publishWindow is the in flight limit for publishes to each peer
+func (bw *BW) publishWindow() int {
+	if w := bw.Config.Router.PublishWindow; w > 0 {
+		return w
+	}
+	return DefaultPublishWindow
+}
+
+//pendingPublish is a publish sent to a peer whose callback has not run
+type pendingPublish struct {
+	cb        PublishReportCallback
+	acked     bool
+	err       error
+	consumers int
+	//Closed once the callback has returned
+	delivered chan struct{}
+}
+
+//publishPipeline lets publishes to a peer go out without waiting for the
+//acks of those before them, up to a window. The peer acks them in any
+//order, as it handles each frame separately, but the callbacks run in the
+//order the publishes were sent
+type publishPipeline struct {
+	slots      chan struct{}
+	mu         sync.Mutex
+	queue      []*pendingPublish
+	delivering bool
+}
+
+func newPublishPipeline(window int) *publishPipeline {
+	return &publishPipeline{slots: make(chan struct{}, window)}
+}
+
+//begin waits for a slot in the window and queues a publish, or fails if ctx
+//is done first
+func (p *publishPipeline) begin(ctx context.Context, cb PublishReportCallback) (*pendingPublish, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pp := &pendingPublish{cb: cb, delivered: make(chan struct{})}
+	p.mu.Lock()
+	p.queue = append(p.queue, pp)
+	p.mu.Unlock()
+	return pp, nil
+}
+
+//ack records the peer's response to pp and frees its slot. The callbacks
+//of the acked publishes at the front of the queue are run, by whichever
+//ack gets there first, so that they run in order and one at a time
+func (p *publishPipeline) ack(pp *pendingPublish, err error, consumers int) {
+	<-p.slots
+	p.mu.Lock()
+	pp.acked, pp.err, pp.consumers = true, err, consumers
+	if p.delivering {
+		p.mu.Unlock()
+		return
+	}
+	p.delivering = true
+	for {
+		n := 0
+		for n < len(p.queue) && p.queue[n].acked {
+			n++
+		}
+		if n == 0 {
+			p.delivering = false
+			p.mu.Unlock()
+			return
+		}
+		ready := p.queue[:n]
+		p.queue = p.queue[n:]
+		p.mu.Unlock()
+		for _, r := range ready {
+			r.cb(r.err, r.consumers)
+			close(r.delivered)
+		}
+		p.mu.Lock()
+	}
+}
+
+//flush waits until the callbacks of every queued publish have returned
+func (p *publishPipeline) flush(ctx context.Context) error {
+	p.mu.Lock()
+	if len(p.queue) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	last := p.queue[len(p.queue)-1]
+	p.mu.Unlock()
+	select {
+	case <-last.delivered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//PublishPipelined is PublishPersistReport without a round trip for each
+//message. It only blocks if the window of publishes awaiting acks is full,
+//and the callbacks run in the order the messages were sent
+func (pc *PeerClient) PublishPipelined(m *core.Message, actionCB PublishReportCallback) {
+	pp, err := pc.pipe.begin(pc.bwcl.ctx, actionCB)
+	if err != nil {
+		actionCB(bwe.WrapM(bwe.PeerError, "client closed", err), -1)
+		return
+	}
+	pc.PublishPersistReport(m, func(err error, consumers int) {
+		pc.pipe.ack(pp, err, consumers)
+	})
+}
+
+//Flush waits until every publish sent with PublishPipelined has been acked
+//and its callback has returned. It must not be called from such a callback
+func (pc *PeerClient) Flush(ctx context.Context) error {
+	return pc.pipe.flush(ctx)
+}
+
+//FlushPublishes waits until the publishes the client sent to other routers
+//have been acked, so a publisher can know its messages arrived before it
+//exits
+func (c *BosswaveClient) FlushPublishes(ctx context.Context) error {
+	c.peerlock.Lock()
+	peers := make([]*PeerClient, 0, len(c.peers))
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	c.peerlock.Unlock()
+	for _, p := range peers {
+		if err := p.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
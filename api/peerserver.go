@@ -25,11 +25,16 @@ import (
 	"crypto/x509/pkix"
 	"encoding/binary"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -37,6 +42,7 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/util/bwe"
 )
 
@@ -85,37 +91,74 @@ func genCert(vk string) (tls.Certificate, *x509.Certificate) {
 }
 
 func Start(bw *BW) {
+	_, err := Listen(bw, bw.Config.Native.ListenOn)
+	if err != nil {
+		log.Criticalf("Could not open native adapter socket: %v", err)
+		log.Flush()
+		os.Exit(1)
+	}
+	select {}
+}
+
+//Listen serves peer routers on the given address in the background. Close
+//the returned listener to stop accepting peers
+func Listen(bw *BW, addr string) (net.Listener, error) {
+	policy, err := newPeerPolicy(bw.Config)
+	if err != nil {
+		return nil, err
+	}
 	//Generate TLS certificate
 	vk := crypto.FmtKey(bw.Entity.GetVK())
 	cert, cert2 := genCert(vk)
 	tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
-	ln, err := tls.Listen("tcp", bw.Config.Native.ListenOn, &tlsConfig)
-	log.Info("peer server listening on:", bw.Config.Native.ListenOn)
+	ln, err := tls.Listen("tcp", addr, &tlsConfig)
 	if err != nil {
-		log.Criticalf("Could not open native adapter socket: %v", err)
-		os.Exit(1)
+		return nil, err
 	}
+	log.Info("peer server listening on:", ln.Addr())
+	bw.addListener(ln)
 	proof := make([]byte, 32+64)
 	copy(proof, bw.Entity.GetVK())
-	if err != nil {
-		log.Criticalf("Could not parse certificate")
-		log.Flush()
-		os.Exit(1)
-	}
 	crypto.SignBlob(bw.Entity.GetSK(), bw.Entity.GetVK(), proof[32:], cert2.Signature)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Criticalf("Socket error: %v", err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					log.Criticalf("Socket error: %v", err)
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				//The listener was closed
+				return
+			}
+			if bw.Draining() {
+				conn.Close()
+				continue
+			}
+			if !policy.admit(conn.RemoteAddr()) {
+				log.Infof("refusing peer %s: too many connections from its IP", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			//First thing we do is write the 96 byte proof that the self-signed cert was
+			//generated by the person posessing the router's SK
+			conn.Write(proof)
+			//Create a client
+			cl := bw.CreateClient(context.Background(), "PEER:"+conn.RemoteAddr().String())
+			bw.clients.mu.Lock()
+			cl.peerConn = conn
+			bw.clients.mu.Unlock()
+			//Then handle the session
+			bw.addSession(1)
+			go func(cl *BosswaveClient, conn net.Conn) {
+				handleSession(cl, conn, policy, cert2.Signature)
+				policy.release(conn.RemoteAddr())
+				bw.addSession(-1)
+			}(cl, conn)
 		}
-		//First thing we do is write the 96 byte proof that the self-signed cert was
-		//generated by the person posessing the router's SK
-		conn.Write(proof)
-		//Create a client
-		cl := bw.CreateClient(context.Background(), "PEER:"+conn.RemoteAddr().String())
-		//Then handle the session
-		go handleSession(cl, conn)
-	}
+	}()
+	return ln, nil
 }
 
 type nativeFrame struct {
@@ -132,38 +175,186 @@ const (
 	nCmdRStatus = 6
 	nCmdRSub    = 7
 	nCmdResult  = 8
+	//Between members of a replica set
+	nCmdReplicate = 9
+	nCmdGossip    = 10
+	//A list message prefixed by a 16 bit depth. Results are
+	//encoded with encodeListEntry
+	nCmdListTree = 11
+	//The 16 byte ID of a consumer limited message and then the 16 byte ID
+	//of the subscription that could not process it. The status message is
+	//"true" if it was delivered to another consumer
+	nCmdNack = 12
+	//A standby router's VK and its signature over the signature of the
+	//listener's certificate. Results are encoded with encodeStandbyRecord
+	nCmdStandby = 13
+	//A msgpack registryQuery from a thin router, answered with a result
+	//frame holding a msgpack registryAnswer
+	nCmdRegistry = 14
+	//A query, tap query or list message for one page of its results,
+	//encoded with encodePage. Results are as for the message, and the end
+	//frame holds the cursor for the next page
+	nCmdPage = 15
+	//The persist sequence number of the message in the next result frame
+	//with the same seqno, as a 64 bit integer. It is only sent for messages
+	//that have one, and peers that do not know it ignore it
+	nCmdSeq = 16
+	//A replicate or gossip frame for a message with a persist sequence
+	//number: the command, the 64 bit sequence number and then the message.
+	//The status is as for the command. Peers that do not know it refuse it
+	//with BadOperation, and are sent the plain frame instead
+	nCmdNumbered = 17
 )
 
-func handleSession(cl *BosswaveClient, conn net.Conn) {
+//resultFrames are the frames delivering m as a result, which are sent
+//together so that the nCmdSeq frame, if m has a sequence number, is
+//directly before the result frame it belongs to
+func resultFrames(seqno uint64, m *core.Message) []*nativeFrame {
+	rv := &nativeFrame{seqno: seqno, cmd: nCmdResult, body: m.Encoded}
+	if m.PersistSeq == 0 {
+		return []*nativeFrame{rv}
+	}
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, m.PersistSeq)
+	return []*nativeFrame{{seqno: seqno, cmd: nCmdSeq, body: body}, rv}
+}
+
+//encodeNumbered is the body of a nCmdNumbered frame holding cmd for m
+func encodeNumbered(cmd uint8, m *core.Message) []byte {
+	body := make([]byte, 9+len(m.Encoded))
+	body[0] = cmd
+	binary.LittleEndian.PutUint64(body[1:], m.PersistSeq)
+	copy(body[9:], m.Encoded)
+	return body
+}
+
+//decodeNumbered splits the body of a nCmdNumbered frame into the command,
+//the sequence number and the message
+func decodeNumbered(body []byte) (uint8, uint64, []byte, error) {
+	if len(body) < 9 || (body[0] != nCmdReplicate && body[0] != nCmdGossip) {
+		return 0, 0, nil, bwe.M(bwe.MalformedMessage, "bad numbered frame")
+	}
+	return body[0], binary.LittleEndian.Uint64(body[1:]), body[9:], nil
+}
+
+//encodeListEntry is the body of a nCmdListTree result frame: the 32 bit
+//child count, a byte set if the node has data, the 16 bit depth and then
+//the URI
+func encodeListEntry(e *store.ListEntry) []byte {
+	rv := make([]byte, 7+len(e.URI))
+	binary.LittleEndian.PutUint32(rv, uint32(e.Children))
+	if e.HasData {
+		rv[4] = 1
+	}
+	binary.LittleEndian.PutUint16(rv[5:], uint16(e.Depth))
+	copy(rv[7:], e.URI)
+	return rv
+}
+
+func decodeListEntry(b []byte) (*store.ListEntry, error) {
+	if len(b) < 7 {
+		return nil, bwe.M(bwe.PeerError, "short list result frame")
+	}
+	return &store.ListEntry{
+		Children: int(binary.LittleEndian.Uint32(b)),
+		HasData:  b[4] != 0,
+		Depth:    int(binary.LittleEndian.Uint16(b[5:])),
+		URI:      string(b[7:]),
+	}, nil
+}
+
+//errOversizeFrame is returned by readNativeFrame for a frame whose body
+//was skipped
+var errOversizeFrame = errors.New("oversize peer frame")
+
+//maxNativeFrame is the largest frame body a peer may send at all. Larger
+//frames are not skipped, the connection is dropped
+const maxNativeFrame = 1 << 31
+
+//loadPeerMessage decodes a message from a peer. With [router]
+//LazyRoutingObjects set, the ROs that routing does not need are left
+//unparsed
+func (bw *BW) loadPeerMessage(b []byte) (*core.Message, error) {
+	if bw.Config.Router.LazyRoutingObjects {
+		return core.LoadMessageLazy(b)
+	}
+	return core.LoadMessage(b)
+}
+
+//readNativeFrame reads a frame from a peer connection. A frame with a body
+//longer than max is skipped, so the connection stays in step, and returned
+//without a body along with errOversizeFrame
+func readNativeFrame(r io.Reader, max uint64) (*nativeFrame, error) {
+	hdr := make([]byte, 17)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	nf := &nativeFrame{}
+	nf.length = binary.LittleEndian.Uint64(hdr)
+	nf.seqno = binary.LittleEndian.Uint64(hdr[8:])
+	nf.cmd = hdr[16]
+	if nf.length > maxNativeFrame {
+		return nil, bwe.M(bwe.PeerError, fmt.Sprintf("frame of %d bytes", nf.length))
+	}
+	if nf.length > max {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(nf.length)); err != nil {
+			return nil, err
+		}
+		return nf, errOversizeFrame
+	}
+	nf.body = make([]byte, nf.length)
+	if _, err := io.ReadFull(r, nf.body); err != nil {
+		return nil, err
+	}
+	return nf, nil
+}
+
+func handleSession(cl *BosswaveClient, conn net.Conn, policy *peerPolicy, certSig []byte) {
 	log.Info("peer ", conn.RemoteAddr().String(), " connected on ", conn.LocalAddr().String())
 	defer func() {
 		cl.ctxCancel()
 	}()
-	hdr := make([]byte, 17)
-
 	rmutex := sync.Mutex{}
+	//Subscriptions end with the session's context, each sending an end
+	//frame. Those are given a moment to go out before the connection is
+	//closed, so that a peer dropped by Stop or DropPeer sees its
+	//subscriptions end
+	var activeSubs int32
+	go func() {
+		<-cl.ctx.Done()
+		deadline := time.Now().Add(DrainTimeout)
+		for atomic.LoadInt32(&activeSubs) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Close()
+	}()
 
-	reply := func(f *nativeFrame) {
-		//log.Infof("Sending reply of length %v to seqno %v", len(f.body), f.seqno)
-		tmphdr := make([]byte, 17)
-		binary.LittleEndian.PutUint64(tmphdr, uint64(len(f.body)))
-		binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
-		tmphdr[16] = byte(f.cmd)
+	//reply sends the frames one after the other, with no other frame
+	//between them
+	reply := func(fs ...*nativeFrame) {
 		rmutex.Lock()
 		defer rmutex.Unlock()
-		conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
-		_, err := conn.Write(tmphdr)
-		if err != nil {
-			log.Info("peer write error: ", err.Error())
-			conn.Close()
-			cl.ctxCancel()
-			return
-		}
-		_, err = conn.Write(f.body)
-		if err != nil {
-			log.Info("peer write error: ", err.Error())
-			conn.Close()
-			cl.ctxCancel()
+		for _, f := range fs {
+			//log.Infof("Sending reply of length %v to seqno %v", len(f.body), f.seqno)
+			tmphdr := make([]byte, 17)
+			binary.LittleEndian.PutUint64(tmphdr, uint64(len(f.body)))
+			binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
+			tmphdr[16] = byte(f.cmd)
+			conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
+			_, err := conn.Write(tmphdr)
+			if err != nil {
+				log.Info("peer write error: ", err.Error())
+				conn.Close()
+				cl.ctxCancel()
+				return
+			}
+			_, err = conn.Write(f.body)
+			if err != nil {
+				log.Info("peer write error: ", err.Error())
+				conn.Close()
+				cl.ctxCancel()
+				return
+			}
 		}
 	}
 	errframe := func(seqno uint64, code int, msg string) {
@@ -178,26 +369,23 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 	}
 
 	for {
-		_, err := io.ReadFull(conn, hdr)
-		if err != nil {
-			log.Info("peer error: ", err.Error())
-			return
+		//Refuse oversize frames before buffering them
+		nf, err := readNativeFrame(conn, uint64(cl.bw.MaxMessageSize()))
+		if err == errOversizeFrame {
+			bws := bwe.AsBW(cl.bw.messageTooLarge(int(nf.length)))
+			errframe(nf.seqno, bws.Code, bws.Msg)
+			continue
 		}
-		nf := nativeFrame{}
-		nf.length = binary.LittleEndian.Uint64(hdr)
-		nf.seqno = binary.LittleEndian.Uint64(hdr[8:])
-		nf.cmd = hdr[16]
-		nf.body = make([]byte, nf.length)
-		_, err = io.ReadFull(conn, nf.body)
 		if err != nil {
 			log.Info("peer error: ", err.Error())
 			return
 		}
+		recvd := time.Now()
 
 		go func() {
 			switch nf.cmd {
 			case nCmdMessage:
-				msg, err := core.LoadMessage(nf.body)
+				msg, err := cl.bw.loadPeerMessage(nf.body)
 				//log.Info("Load message returned")
 				if err != nil {
 					log.Info("Load message error: ", err.Error())
@@ -211,6 +399,7 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 				}
 				err = msg.Verify(cl.BW())
 				if err != nil {
+					cl.bw.auditDenied(msg, err)
 					bws := bwe.AsBW(err)
 					errframe(nf.seqno, bws.Code, bws.Msg)
 					log.Infof("message failed verification: %#v", msg)
@@ -226,15 +415,53 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					}
 					return
 				}
+				cl.bw.auditWaived(msg)
+				if err := policy.check(msg, conn.RemoteAddr()); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
 				//log.Info("message verified ok")
+				if msg.Type == core.TypePublish || msg.Type == core.TypePersist || msg.Type == core.TypeDelete {
+					if err := cl.bw.beginWork(); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+					defer cl.bw.endWork()
+				}
+				if msg.Type == core.TypePublish || msg.Type == core.TypePersist {
+					if err := cl.bw.checkPayloads(msg); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+					if err := cl.bw.checkRateLimit(msg, *msg.OriginVK); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+					if err := cl.bw.checkNamespaceQuota(msg, *msg.OriginVK); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+					msg = cl.bw.traceHop(msg, recvd)
+				}
 
 				switch msg.Type {
-				case core.TypePublish:
-					errframe(nf.seqno, bwe.Okay, "")
-					cl.cl.Publish(msg)
-				case core.TypePersist:
+				//The status message is the number of consumers it was
+				//delivered to
+				case core.TypePublish, core.TypePersist:
+					consumers, fresh := cl.bw.deliverOnce(cl.cl, msg)
+					errframe(nf.seqno, bwe.Okay, strconv.Itoa(consumers))
+					if fresh {
+						cl.bw.replicate(msg)
+					}
+				case core.TypeDelete:
 					errframe(nf.seqno, bwe.Okay, "")
-					cl.cl.Persist(msg)
+					cl.cl.Delete(msg)
+					cl.bw.replicate(msg)
 				case core.TypeUnsubscribe:
 					err := cl.cl.Unsubscribe(msg.UnsubUMid)
 					if err == nil {
@@ -244,22 +471,25 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					}
 
 				case core.TypeSubscribe, core.TypeTap:
-					subid := cl.cl.Subscribe(cl.ctx, msg, func(m *core.Message) {
+					if err := cl.bw.checkAccepting(); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+					atomic.AddInt32(&activeSubs, 1)
+					subid := cl.cl.Subscribe(cl.ctx, msg, cl.bw.transformFor(msg, func(m *core.Message) {
 						if m == nil {
 							rv := nativeFrame{
 								seqno: nf.seqno,
 								cmd:   nCmdEnd,
 							}
 							reply(&rv)
+							atomic.AddInt32(&activeSubs, -1)
 						} else {
-							rv := nativeFrame{
-								seqno: nf.seqno,
-								cmd:   nCmdResult,
-								body:  m.Encoded,
-							}
-							reply(&rv)
+							m = cl.bw.traceHop(m, time.Time{})
+							reply(resultFrames(nf.seqno, m)...)
 						}
-					})
+					}))
 					rv := nativeFrame{
 						seqno: nf.seqno,
 						cmd:   nCmdRSub,
@@ -272,17 +502,11 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 				case core.TypeQuery, core.TypeTapQuery:
 					errframe(nf.seqno, bwe.Okay, "")
 					cl.cl.Query(msg, func(m *core.Message) {
-						rv := nativeFrame{
-							seqno: nf.seqno,
-						}
 						if m == nil {
-							rv.cmd = nCmdEnd
-							rv.body = []byte{}
+							reply(&nativeFrame{seqno: nf.seqno, cmd: nCmdEnd, body: []byte{}})
 						} else {
-							rv.cmd = nCmdResult
-							rv.body = m.Encoded
+							reply(resultFrames(nf.seqno, m)...)
 						}
-						reply(&rv)
 					})
 				case core.TypeLS:
 					errframe(nf.seqno, bwe.Okay, "")
@@ -303,6 +527,210 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					errframe(nf.seqno, bwe.BadOperation, "type mismatch")
 					return
 				}
+			case nCmdReplicate, nCmdGossip, nCmdNumbered:
+				if err := cl.bw.beginWork(); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				defer cl.bw.endWork()
+				cmd, seq, body := nf.cmd, uint64(0), nf.body
+				if cmd == nCmdNumbered {
+					var err error
+					if cmd, seq, body, err = decodeNumbered(nf.body); err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+						return
+					}
+				}
+				msg, err := cl.bw.loadPeerMessage(body)
+				if err != nil {
+					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					return
+				}
+				//The sender numbered it, so it keeps its number here
+				msg.PersistSeq = seq
+				err = cl.VerifyAffinity(msg)
+				if err != nil {
+					errframe(nf.seqno, bwe.AffinityMismatch, err.Error())
+					return
+				}
+				err = msg.Verify(cl.BW())
+				if err != nil {
+					cl.bw.auditDenied(msg, err)
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				cl.bw.auditWaived(msg)
+				if err := policy.check(msg, conn.RemoteAddr()); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				if cmd == nCmdGossip {
+					err = cl.bw.acceptGossip(msg)
+					if err != nil {
+						bws := bwe.AsBW(err)
+						errframe(nf.seqno, bws.Code, bws.Msg)
+					} else {
+						errframe(nf.seqno, bwe.Okay, "")
+					}
+					return
+				}
+				switch msg.Type {
+				case core.TypePublish, core.TypePersist:
+					errframe(nf.seqno, bwe.Okay, "")
+					cl.bw.deliver(cl.cl, msg)
+				case core.TypeDelete:
+					errframe(nf.seqno, bwe.Okay, "")
+					cl.cl.Delete(msg)
+				default:
+					errframe(nf.seqno, bwe.BadOperation, "only publish, persist and delete are replicated")
+				}
+			case nCmdNack:
+				if len(nf.body) != 32 {
+					errframe(nf.seqno, bwe.MalformedMessage, "bad nack frame")
+					return
+				}
+				msgid := core.UniqueMessageID{
+					Mid: binary.LittleEndian.Uint64(nf.body),
+					Sig: binary.LittleEndian.Uint64(nf.body[8:]),
+				}
+				subid := core.UniqueMessageID{
+					Mid: binary.LittleEndian.Uint64(nf.body[16:]),
+					Sig: binary.LittleEndian.Uint64(nf.body[24:]),
+				}
+				redelivered, err := cl.cl.Nack(msgid, subid)
+				if err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				errframe(nf.seqno, bwe.Okay, strconv.FormatBool(redelivered))
+			case nCmdListTree:
+				if len(nf.body) < 2 {
+					errframe(nf.seqno, bwe.MalformedMessage, "short list frame")
+					return
+				}
+				depth := int(binary.LittleEndian.Uint16(nf.body))
+				msg, err := cl.bw.loadPeerMessage(nf.body[2:])
+				if err != nil {
+					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					return
+				}
+				if msg.Type != core.TypeLS {
+					errframe(nf.seqno, bwe.BadOperation, "type mismatch")
+					return
+				}
+				err = cl.VerifyAffinity(msg)
+				if err != nil {
+					errframe(nf.seqno, bwe.AffinityMismatch, err.Error())
+					return
+				}
+				err = msg.Verify(cl.BW())
+				if err != nil {
+					cl.bw.auditDenied(msg, err)
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				cl.bw.auditWaived(msg)
+				if err := policy.check(msg, conn.RemoteAddr()); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				errframe(nf.seqno, bwe.Okay, "")
+				cl.cl.ListTree(msg, depth, func(e *store.ListEntry) {
+					rv := nativeFrame{
+						seqno: nf.seqno,
+					}
+					if e == nil {
+						rv.cmd = nCmdEnd
+						rv.body = []byte{}
+					} else {
+						rv.cmd = nCmdResult
+						rv.body = encodeListEntry(e)
+					}
+					reply(&rv)
+				})
+			case nCmdPage:
+				page, body, err := decodePage(nf.body)
+				if err != nil {
+					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					return
+				}
+				msg, err := cl.bw.loadPeerMessage(body)
+				if err != nil {
+					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					return
+				}
+				if msg.Type != core.TypeQuery && msg.Type != core.TypeTapQuery && msg.Type != core.TypeLS {
+					errframe(nf.seqno, bwe.BadOperation, "type mismatch")
+					return
+				}
+				if err := page.check(); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				err = cl.VerifyAffinity(msg)
+				if err != nil {
+					errframe(nf.seqno, bwe.AffinityMismatch, err.Error())
+					return
+				}
+				err = msg.Verify(cl.BW())
+				if err != nil {
+					cl.bw.auditDenied(msg, err)
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				cl.bw.auditWaived(msg)
+				if err := policy.check(msg, conn.RemoteAddr()); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				errframe(nf.seqno, bwe.Okay, "")
+				result := func(body []byte) {
+					reply(&nativeFrame{seqno: nf.seqno, cmd: nCmdResult, body: body})
+				}
+				var next string
+				if msg.Type == core.TypeLS {
+					next, _ = cl.cl.ListPage(msg, page.Cursor, page.Limit, func(s string) {
+						result([]byte(s))
+					})
+				} else {
+					next, _ = cl.cl.QueryPage(msg, page.Cursor, page.Limit, func(m *core.Message) {
+						reply(resultFrames(nf.seqno, m)...)
+					})
+				}
+				reply(&nativeFrame{seqno: nf.seqno, cmd: nCmdEnd, body: []byte(next)})
+			case nCmdStandby:
+				if err := cl.bw.authStandby(nf.body, certSig); err != nil {
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
+					return
+				}
+				atomic.AddInt32(&activeSubs, 1)
+				errframe(nf.seqno, bwe.Okay, "")
+				cl.bw.streamStore(cl.ctx, func(cmd uint8, body []byte) {
+					reply(&nativeFrame{seqno: nf.seqno, cmd: cmd, body: body})
+				})
+				atomic.AddInt32(&activeSubs, -1)
+			case nCmdRegistry:
+				ans, err := cl.bw.answerRegistry(nf.body)
+				if err != nil {
+					code, msg := bwe.ResolutionFailed, err.Error()
+					if bws, ok := err.(*bwe.BWStatus); ok {
+						code, msg = bws.Code, bws.Msg
+					}
+					errframe(nf.seqno, code, msg)
+					return
+				}
+				reply(&nativeFrame{seqno: nf.seqno, cmd: nCmdResult, body: ans})
 			default: //nCmd
 				errframe(nf.seqno, bwe.BadOperation, "what command is this?")
 				return
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+)
+
+//DefaultSlowPeerAck is how long a peer may take to answer before it is
+//considered slow, if [router] SlowPeerAck is not set
+const DefaultSlowPeerAck = 10 * time.Second
+
+//A slow peer is warned about at most this often
+const slowPeerWarnInterval = time.Minute
+
+//PeerStats describes the connection to another router
+type PeerStats struct {
+	Target    string
+	VK        []byte
+	Connected bool
+	BytesOut  uint64
+	BytesIn   uint64
+	FramesOut uint64
+	FramesIn  uint64
+	//How many times the connection was lost
+	Reconnects uint64
+	//Transactions that have had no response yet
+	Outstanding int
+	//How long the oldest of them has been waiting
+	OldestOutstanding time.Duration
+	//The smoothed time to the first response to a transaction
+	RTT time.Duration
+}
+
+//peerCounters are updated atomically, so they come first in PeerClient for
+//64 bit alignment
+type peerCounters struct {
+	bytesOut   uint64
+	bytesIn    uint64
+	framesOut  uint64
+	framesIn   uint64
+	reconnects uint64
+}
+
+//noteSent counts a frame sent on the transaction seqno, which is
+//outstanding until its first response
+func (pc *PeerClient) noteSent(seqno uint64, length int) {
+	atomic.AddUint64(&pc.stats.framesOut, 1)
+	atomic.AddUint64(&pc.stats.bytesOut, uint64(17+length))
+	pc.statmu.Lock()
+	if _, ok := pc.sent[seqno]; !ok {
+		pc.sent[seqno] = time.Now()
+	}
+	pc.statmu.Unlock()
+}
+
+//noteReceived counts a frame for the transaction seqno, and if it is the
+//first response adds its round trip to the RTT
+func (pc *PeerClient) noteReceived(seqno uint64, length int) {
+	atomic.AddUint64(&pc.stats.framesIn, 1)
+	atomic.AddUint64(&pc.stats.bytesIn, uint64(17+length))
+	pc.statmu.Lock()
+	if t, ok := pc.sent[seqno]; ok {
+		delete(pc.sent, seqno)
+		sample := time.Since(t)
+		if pc.rtt == 0 {
+			pc.rtt = sample
+		} else {
+			pc.rtt = pc.rtt*7/8 + sample/8
+		}
+	}
+	pc.statmu.Unlock()
+}
+
+//noteDisconnect forgets the outstanding transactions, which have all
+//failed, and the RTT, which the new connection may not share
+func (pc *PeerClient) noteDisconnect() {
+	atomic.AddUint64(&pc.stats.reconnects, 1)
+	pc.statmu.Lock()
+	pc.sent = make(map[uint64]time.Time)
+	pc.rtt = 0
+	pc.statmu.Unlock()
+}
+
+//Stats returns the statistics of the connection to the peer
+func (pc *PeerClient) Stats() PeerStats {
+	rv := PeerStats{
+		Target:     pc.target,
+		VK:         pc.expectedVK,
+		Connected:  pc.Connected(),
+		BytesOut:   atomic.LoadUint64(&pc.stats.bytesOut),
+		BytesIn:    atomic.LoadUint64(&pc.stats.bytesIn),
+		FramesOut:  atomic.LoadUint64(&pc.stats.framesOut),
+		FramesIn:   atomic.LoadUint64(&pc.stats.framesIn),
+		Reconnects: atomic.LoadUint64(&pc.stats.reconnects),
+	}
+	now := time.Now()
+	pc.statmu.Lock()
+	rv.Outstanding = len(pc.sent)
+	for _, t := range pc.sent {
+		if age := now.Sub(t); age > rv.OldestOutstanding {
+			rv.OldestOutstanding = age
+		}
+	}
+	rv.RTT = pc.rtt
+	pc.statmu.Unlock()
+	return rv
+}
+
+//slowPeerAck is how long a peer may take to answer, or zero if peers are
+//not checked
+func (bw *BW) slowPeerAck() time.Duration {
+	s := bw.Config.Router.SlowPeerAck
+	if s < 0 {
+		return 0
+	}
+	if s == 0 {
+		return DefaultSlowPeerAck
+	}
+	return time.Duration(s) * time.Second
+}
+
+//watchSlowPeer warns when the peer takes longer than [router] SlowPeerAck
+//to answer, on average or for a transaction still waiting, to help find
+//the slow link between routers. With [router] DropSlowPeers the connection
+//is also closed when a transaction has waited that long, so it reconnects
+//or another designated router is used. It ends with the client
+func (pc *PeerClient) watchSlowPeer() {
+	limit := pc.bwcl.bw.slowPeerAck()
+	if limit <= 0 {
+		return
+	}
+	ticker := time.NewTicker(limit / 2)
+	defer ticker.Stop()
+	var warned time.Time
+	for {
+		select {
+		case <-pc.bwcl.ctx.Done():
+			return
+		case now := <-ticker.C:
+			st := pc.Stats()
+			stuck := st.OldestOutstanding > limit
+			if !stuck && st.RTT <= limit {
+				continue
+			}
+			if now.Sub(warned) > slowPeerWarnInterval {
+				warned = now
+				log.Warnf("peer %s (%s) is slow: RTT %s, %d outstanding, the oldest for %s",
+					pc.target, crypto.FmtKey(pc.expectedVK), st.RTT, st.Outstanding, st.OldestOutstanding)
+			}
+			if stuck && pc.bwcl.bw.Config.Router.DropSlowPeers && st.Connected {
+				log.Warnf("dropping the connection to slow peer %s", pc.target)
+				pc.txmtx.Lock()
+				pc.conn.Close()
+				pc.txmtx.Unlock()
+			}
+		}
+	}
+}
+
+//PeerStats returns the statistics of the connections the agent's clients
+//have to other routers
+func (bw *BW) PeerStats() []PeerStats {
+	bw.clients.mu.Lock()
+	cls := make([]*BosswaveClient, 0, len(bw.clients.clients))
+	for _, c := range bw.clients.clients {
+		cls = append(cls, c)
+	}
+	bw.clients.mu.Unlock()
+	rv := []PeerStats{}
+	for _, c := range cls {
+		c.peerlock.Lock()
+		for _, p := range c.peers {
+			rv = append(rv, p.Stats())
+		}
+		c.peerlock.Unlock()
+	}
+	sort.Sort(peerStatsByTarget(rv))
+	return rv
+}
+
+type peerStatsByTarget []PeerStats
+
+func (s peerStatsByTarget) Len() int           { return len(s) }
+func (s peerStatsByTarget) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s peerStatsByTarget) Less(i, j int) bool { return s[i].Target < s[j].Target }
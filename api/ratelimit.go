@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+const (
+	//DefaultRateLimit is the messages per second an origin VK may publish if
+	//[ratelimit] PerVK is not set
+	DefaultRateLimit = 100
+	//DefaultRateBurst is the messages an origin VK may publish at once if
+	//[ratelimit] Burst is not set
+	DefaultRateBurst = 200
+)
+
+//Buckets that have been idle this long are full, so they are discarded
+const rateBucketIdle = 10 * time.Minute
+
+//tokenBucket allows rate messages per second on average, and up to burst
+//at once
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+//take removes a token, returning false if there are none
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+//allow takes a token from the bucket for key, creating it if need be
+func (rl *rateLimiter) allow(key string, rate, burst float64, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastPrune) > rateBucketIdle {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > rateBucketIdle {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+	b, ok := rl.buckets[key]
+	if !ok || b.rate != rate || b.burst != burst {
+		b = newTokenBucket(rate, burst, now)
+		rl.buckets[key] = b
+	}
+	return b.take(now)
+}
+
+//vkRateLimit returns the configured rate and burst for origin VKs. A rate
+//of zero means no limit
+func (bw *BW) vkRateLimit() (float64, float64) {
+	cfg := bw.Config.RateLimit
+	rate, burst := cfg.PerVK, float64(cfg.Burst)
+	if rate == 0 {
+		rate = DefaultRateLimit
+	}
+	if rate < 0 {
+		return 0, 0
+	}
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	return rate, burst
+}
+
+//checkRateLimit takes a token for the origin VK of a publish or persist
+//that this router is delivering, and for every DOT in its chain that has
+//a TxLimit. The router's own messages are not limited
+func (bw *BW) checkRateLimit(m *core.Message, ovk []byte) error {
+	if bytes.Equal(ovk, bw.Entity.GetVK()) {
+		return nil
+	}
+	now := time.Now()
+	if rate, burst := bw.vkRateLimit(); rate > 0 && ovk != nil {
+		if !bw.ratelim.allow("vk:"+crypto.FmtKey(ovk), rate, burst, now) {
+			return bwe.M(bwe.RateLimited, fmt.Sprintf("%s is sending more than %v messages per second", crypto.FmtKey(ovk), rate))
+		}
+	}
+	pac := m.PrimaryAccessChain
+	if pac == nil {
+		return nil
+	}
+	for i := 0; i < pac.NumHashes(); i++ {
+		d := pac.GetDOT(i)
+		if d == nil {
+			d, _, _ = bw.ResolveDOT(pac.GetDotHash(i))
+		}
+		if d == nil || d.GetPublishLimits() == nil || d.GetPublishLimits().TxLimit <= 0 {
+			continue
+		}
+		rate := float64(d.GetPublishLimits().TxLimit)
+		if !bw.ratelim.allow("dot:"+crypto.FmtHash(d.GetHash()), rate, rate, now) {
+			return bwe.M(bwe.RateLimited, fmt.Sprintf("DOT %s allows %v messages per second", crypto.FmtHash(d.GetHash()), rate))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+)
+
+//registryIndex holds every entity, DOT and chain that has been published,
+//so that they can be searched by their metadata. It is built from the
+//registry logs, and brought up to date on every search
+type registryIndex struct {
+	mu sync.Mutex
+	//The first block that has not been indexed
+	nextBlock uint64
+	entities  map[bc.Bytes32]*objects.Entity
+	dots      map[bc.Bytes32]*objects.DOT
+	chains    map[bc.Bytes32]*objects.DChain
+}
+
+func newRegistryIndex() *registryIndex {
+	return &registryIndex{
+		entities: make(map[bc.Bytes32]*objects.Entity),
+		dots:     make(map[bc.Bytes32]*objects.DOT),
+		chains:   make(map[bc.Bytes32]*objects.DChain),
+	}
+}
+
+//RegistrySearch selects the published objects to return from SearchRegistry
+type RegistrySearch struct {
+	//Matched against the contact and comment fields. It is a case
+	//insensitive substring unless Regex is set
+	Pattern string
+	Regex   bool
+	//If neither is set, both are searched
+	Entities bool
+	DOTs     bool
+}
+
+//RegistryMatch is an object found by SearchRegistry, with its current
+//registry state
+type RegistryMatch struct {
+	RO    objects.RoutingObject
+	State int
+}
+
+//logObject extracts the object from a registry log. The data is the ABI
+//encoding of the object bytes
+func logObject(data []byte) ([]byte, bool) {
+	if len(data) < 64 {
+		return nil, false
+	}
+	ln := new(big.Int).SetBytes(data[32:64])
+	if ln.BitLen() > 31 || int(ln.Int64()) > len(data)-64 {
+		return nil, false
+	}
+	return data[64 : 64+int(ln.Int64())], true
+}
+
+//update indexes the registry logs since the last update. Lock must be held
+func (ri *registryIndex) update(bw *BW) error {
+	if bw.Config.IsThin() {
+		return bwe.M(bwe.BadOperation, "the registry cannot be searched on a thin router")
+	}
+	current := bw.BC().CurrentBlock()
+	if ri.nextBlock > current {
+		return nil
+	}
+	logs, err := bw.BC().FindLogsBetweenHeavy(context.TODO(), int64(ri.nextBlock), int64(current),
+		common.Address(bc.ContractAddress(bc.ContractRegistry)),
+		[][]common.Hash{[]common.Hash{
+			common.Hash(bc.HexToBytes32(bc.EventSig_Registry_NewEntity)),
+			common.Hash(bc.HexToBytes32(bc.EventSig_Registry_NewDOT)),
+			common.Hash(bc.HexToBytes32(bc.EventSig_Registry_NewDChain)),
+		}})
+	if err != nil {
+		return bwe.WrapM(bwe.BlockChainGenericError, "Could not scan registry logs", err)
+	}
+	for _, lg := range logs {
+		content, ok := logObject(lg.Data())
+		if !ok {
+			continue
+		}
+		//Objects that do not decode were rejected by the registry contract
+		//anyway, so they are skipped
+		switch lg.Topics()[0] {
+		case bc.HexToBytes32(bc.EventSig_Registry_NewEntity):
+			ro, err := objects.NewEntity(objects.ROEntity, content)
+			if err != nil {
+				continue
+			}
+			ent := ro.(*objects.Entity)
+			ri.entities[bc.SliceToBytes32(ent.GetVK())] = ent
+		case bc.HexToBytes32(bc.EventSig_Registry_NewDOT):
+			//The log does not say which kind of DOT it is, and each only
+			//decodes as its own kind
+			ro, err := objects.NewDOT(objects.ROAccessDOT, content)
+			if err != nil {
+				ro, err = objects.NewDOT(objects.ROPermissionDOT, content)
+			}
+			if err != nil {
+				continue
+			}
+			dot := ro.(*objects.DOT)
+			ri.dots[bc.SliceToBytes32(dot.GetHash())] = dot
+		case bc.HexToBytes32(bc.EventSig_Registry_NewDChain):
+			ro, err := objects.NewDChain(objects.ROAccessDChain, content)
+			if err != nil {
+				continue
+			}
+			dc := ro.(*objects.DChain)
+			ri.chains[bc.SliceToBytes32(dc.GetChainHash())] = dc
+		}
+	}
+	ri.nextBlock = current + 1
+	return nil
+}
+
+type entitiesByVK []*objects.Entity
+
+func (s entitiesByVK) Len() int           { return len(s) }
+func (s entitiesByVK) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entitiesByVK) Less(i, j int) bool { return bytes.Compare(s[i].GetVK(), s[j].GetVK()) < 0 }
+
+type dotsByHash []*objects.DOT
+
+func (s dotsByHash) Len() int           { return len(s) }
+func (s dotsByHash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s dotsByHash) Less(i, j int) bool { return bytes.Compare(s[i].GetHash(), s[j].GetHash()) < 0 }
+
+//SearchRegistry finds the published entities and DOTs, access and
+//permission, whose contact or comment fields match. The entities come
+//first, ordered by VK, and then the DOTs, ordered by hash. The first
+//search scans the whole registry history, so it can take a while
+func (bw *BW) SearchRegistry(q *RegistrySearch) ([]RegistryMatch, error) {
+	var match func(s string) bool
+	if q.Regex {
+		re, err := regexp.Compile(q.Pattern)
+		if err != nil {
+			return nil, bwe.WrapM(bwe.BadOperation, "Invalid search pattern", err)
+		}
+		match = re.MatchString
+	} else {
+		pat := strings.ToLower(q.Pattern)
+		match = func(s string) bool {
+			return strings.Contains(strings.ToLower(s), pat)
+		}
+	}
+	matches := func(contact, comment string) bool {
+		return (contact != "" && match(contact)) || (comment != "" && match(comment))
+	}
+	all := !q.Entities && !q.DOTs
+
+	ri := bw.rdata.regindex
+	ri.mu.Lock()
+	if err := ri.update(bw); err != nil {
+		ri.mu.Unlock()
+		return nil, err
+	}
+	ents := []*objects.Entity{}
+	if all || q.Entities {
+		for _, e := range ri.entities {
+			if matches(e.GetContact(), e.GetComment()) {
+				ents = append(ents, e)
+			}
+		}
+	}
+	dots := []*objects.DOT{}
+	if all || q.DOTs {
+		for _, d := range ri.dots {
+			if matches(d.GetContact(), d.GetComment()) {
+				dots = append(dots, d)
+			}
+		}
+	}
+	ri.mu.Unlock()
+	sort.Sort(entitiesByVK(ents))
+	sort.Sort(dotsByHash(dots))
+
+	//The index does not track revocations or expiry, so get the current
+	//state through the resolution caches
+	rv := []RegistryMatch{}
+	for _, e := range ents {
+		_, s, err := bw.ResolveEntity(e.GetVK())
+		if err != nil {
+			s = StateError
+		}
+		rv = append(rv, RegistryMatch{RO: e, State: s})
+	}
+	for _, d := range dots {
+		_, s, err := bw.ResolveDOT(d.GetHash())
+		if err != nil {
+			s = StateError
+		}
+		rv = append(rv, RegistryMatch{RO: d, State: s})
+	}
+	return rv, nil
+}
+
+//registryDOTs returns the published DOTs granted to and by the VK, each
+//ordered by hash
+func (bw *BW) registryDOTs(vk []byte) (to []*objects.DOT, from []*objects.DOT, err error) {
+	ri := bw.rdata.regindex
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if err := ri.update(bw); err != nil {
+		return nil, nil, err
+	}
+	for _, d := range ri.dots {
+		if bytes.Equal(d.GetReceiverVK(), vk) {
+			to = append(to, d)
+		} else if bytes.Equal(d.GetGiverVK(), vk) {
+			from = append(from, d)
+		}
+	}
+	sort.Sort(dotsByHash(to))
+	sort.Sort(dotsByHash(from))
+	return to, from, nil
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+	"github.com/immesys/bw2bc/rlp"
+)
+
+//maxProofLag is how far behind the verified head the block a proof is
+//against may be
+const maxProofLag = 64
+
+//maxProvenArray bounds the length of an array read from proven storage
+const maxProvenArray = 4096
+
+//registryLayout is the contract state that proves the answer to a query
+type registryLayout struct {
+	contract string
+	slots    []common.Hash
+	//Slots among them that hold a bytes value, or the length of a dynamic
+	//array, whose contents are proven as well
+	bytesAt []common.Hash
+	arrayAt []common.Hash
+}
+
+//proofLayout is the state that proves the answer to q, or nil if the
+//answer is not proven, as for logs
+func proofLayout(q *registryQuery, ans *registryAnswer) *registryLayout {
+	mapping := func(contract string, n int64) *registryLayout {
+		return &registryLayout{contract: contract, slots: []common.Hash{bc.MappingSlot(q.Key, bc.SlotNumber(n))}}
+	}
+	object := func(n int64) *registryLayout {
+		base := bc.MappingSlot(q.Key, bc.SlotNumber(n))
+		return &registryLayout{
+			contract: bc.ContractRegistry,
+			slots:    []common.Hash{base, bc.SlotOffset(base, 1)},
+			bytesAt:  []common.Hash{base},
+		}
+	}
+	switch q.Op {
+	case regOpEntity:
+		return object(bc.SlotRegistryEntities)
+	case regOpDOT:
+		return object(bc.SlotRegistryDOTs)
+	case regOpChain:
+		return object(bc.SlotRegistryDChains)
+	case regOpDOTsFrom:
+		l := mapping(bc.ContractRegistry, bc.SlotRegistryDOTFromVK)
+		l.arrayAt = l.slots
+		return l
+	case regOpAlias:
+		return mapping(bc.ContractAlias, bc.SlotAliasDB)
+	case regOpUnalias:
+		return mapping(bc.ContractAlias, bc.SlotAliasFor)
+	case regOpAliasOwner:
+		return mapping(bc.ContractAlias, bc.SlotAliasOwner)
+	case regOpDR:
+		return mapping(bc.ContractAffinity, bc.SlotAffinityDR)
+	case regOpSRV:
+		l := mapping(bc.ContractAffinity, bc.SlotAffinityDRSRV)
+		l.bytesAt = l.slots
+		return l
+	case regOpOffers:
+		l := &registryLayout{contract: bc.ContractAffinity}
+		for _, drvk := range ans.Keys {
+			l.slots = append(l.slots, bc.MappingSlot(q.Key, bc.MappingSlot(drvk, bc.SlotNumber(bc.SlotAffinityOffers))))
+		}
+		return l
+	case regOpAffinities:
+		l := &registryLayout{contract: bc.ContractAffinity}
+		for _, nsvk := range ans.Keys {
+			l.slots = append(l.slots, bc.MappingSlot(nsvk, bc.SlotNumber(bc.SlotAffinityDR)))
+		}
+		return l
+	case regOpAliasesFor:
+		l := &registryLayout{contract: bc.ContractAlias}
+		for _, a := range ans.Aliases {
+			l.slots = append(l.slots, bc.MappingSlot(a.Key, bc.SlotNumber(bc.SlotAliasDB)))
+		}
+		return l
+	case regOpOwnedBy:
+		//The value and then the owner of each alias
+		l := &registryLayout{contract: bc.ContractAlias}
+		for _, a := range ans.Aliases {
+			l.slots = append(l.slots,
+				bc.MappingSlot(a.Key, bc.SlotNumber(bc.SlotAliasDB)),
+				bc.MappingSlot(a.Key, bc.SlotNumber(bc.SlotAliasOwner)))
+		}
+		return l
+	}
+	return nil
+}
+
+//contentSlots are the slots holding the contents of the layout's bytes
+//values and arrays, given the values of its slots
+func (l *registryLayout) contentSlots(values map[common.Hash]common.Hash) ([]common.Hash, error) {
+	var rv []common.Hash
+	for _, s := range l.bytesAt {
+		more, err := bc.BytesSlots(s, values[s])
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, more...)
+	}
+	for _, s := range l.arrayAt {
+		n, err := arrayLength(values[s])
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, bc.ArraySlots(s, n)...)
+	}
+	return rv, nil
+}
+
+func arrayLength(v common.Hash) (int, error) {
+	n := v.Big()
+	if n.BitLen() > 31 || n.Int64() > maxProvenArray {
+		return 0, bwe.M(bwe.RegistryProofInvalid, "array too long to prove")
+	}
+	return int(n.Int64()), nil
+}
+
+//proveAnswer attaches to rv the header of the block RegistryLag blocks
+//behind the head and a proof, against it, of the state that the answer
+//to q depends on. Head answers get the header of their block
+func (bw *BW) proveAnswer(ctx context.Context, q *registryQuery, rv *registryAnswer) error {
+	prover, ok := bw.bchain.(bc.StorageProver)
+	if !ok {
+		return bwe.M(bwe.BadOperation, "this router cannot prove registry answers")
+	}
+	block := bw.bchain.CurrentBlock()
+	if q.Op == regOpHead && q.Block != 0 {
+		block = q.Block
+	} else if q.Op != regOpHead && block > bc.RegistryLag {
+		block -= bc.RegistryLag
+	}
+	hdr := bw.bchain.GetHeader(block)
+	if hdr == nil {
+		return bwe.M(bwe.ResolutionFailed, "no such block")
+	}
+	var err error
+	if rv.Header, err = rlp.EncodeToBytes(hdr); err != nil {
+		return err
+	}
+	l := proofLayout(q, rv)
+	if l == nil {
+		return nil
+	}
+	addr := bc.ContractAddress(l.contract)
+	p, err := prover.ProveStorage(ctx, block, addr, l.slots)
+	if err != nil {
+		return err
+	}
+	values := make(map[common.Hash]common.Hash)
+	for _, sp := range p.Slots {
+		values[sp.Slot] = sp.Value
+	}
+	more, err := l.contentSlots(values)
+	if err != nil {
+		return err
+	}
+	if len(more) > 0 {
+		mp, err := prover.ProveStorage(ctx, block, addr, more)
+		if err != nil {
+			return err
+		}
+		p.Slots = append(p.Slots, mp.Slots...)
+	}
+	rv.Proof, err = rlp.EncodeToBytes(p)
+	return err
+}
+
+//checkAnswer verifies the proof in a registry answer and replaces the
+//proven parts of it with what the proof says. Lists the registry finds
+//from logs are cut down to the entries the proof confirms
+func (t *thinChain) checkAnswer(q *registryQuery, ans *registryAnswer) error {
+	hdr, err := t.checkHeader(ans.Header, q.Op == regOpHead)
+	if err != nil {
+		return err
+	}
+	if q.Op == regOpHead {
+		ans.Head = headerOf(hdr)
+		return nil
+	}
+	l := proofLayout(q, ans)
+	if l == nil {
+		return nil
+	}
+	p := &bc.StorageProof{}
+	if err := rlp.DecodeBytes(ans.Proof, p); err != nil {
+		return bwe.WrapM(bwe.RegistryProofInvalid, "bad proof", err)
+	}
+	if p.Block != hdr.Number.Uint64() || p.Address != bc.ContractAddress(l.contract) {
+		return bwe.M(bwe.RegistryProofInvalid, "the proof is for another block or contract")
+	}
+	values, err := p.Verify(hdr.Root)
+	if err != nil {
+		return err
+	}
+	for _, s := range l.slots {
+		if _, ok := values[s]; !ok {
+			return bwe.M(bwe.RegistryProofInvalid, "the proof is missing a slot")
+		}
+	}
+	return l.apply(q, ans, values)
+}
+
+//apply sets the parts of the answer that the proven values determine
+func (l *registryLayout) apply(q *registryQuery, ans *registryAnswer, values map[common.Hash]common.Hash) error {
+	switch q.Op {
+	case regOpEntity, regOpDOT, regOpChain:
+		ans.State = int(values[l.slots[1]].Big().Int64())
+		ans.Object = nil
+		if ans.State == bc.StateUnknown {
+			return nil
+		}
+		blob, err := bc.DecodeBytes(l.slots[0], values)
+		if err != nil {
+			return err
+		}
+		ans.Object = blob
+	case regOpDOTsFrom:
+		n, err := arrayLength(values[l.slots[0]])
+		if err != nil {
+			return err
+		}
+		ans.Keys = [][]byte{}
+		for _, s := range bc.ArraySlots(l.slots[0], n) {
+			v, ok := values[s]
+			if !ok {
+				return bwe.M(bwe.RegistryProofInvalid, "the proof is missing a slot")
+			}
+			ans.Keys = append(ans.Keys, append([]byte{}, v[:]...))
+		}
+	case regOpAlias, regOpUnalias, regOpAliasOwner:
+		v := values[l.slots[0]]
+		ans.Keys = [][]byte{v[:]}
+		ans.Zero = v == common.Hash{}
+	case regOpDR:
+		v := values[l.slots[0]]
+		if v == (common.Hash{}) {
+			return bwe.M(bwe.BlockChainGenericError, "Designated router not found")
+		}
+		ans.Keys = [][]byte{v[:]}
+	case regOpSRV:
+		srv, err := bc.DecodeBytes(l.slots[0], values)
+		if err != nil {
+			return err
+		}
+		if len(srv) == 0 {
+			return bwe.M(bwe.BlockChainGenericError, "SRV record not found")
+		}
+		ans.Text = string(srv)
+	case regOpOffers:
+		keys := [][]byte{}
+		for i, drvk := range ans.Keys {
+			if values[l.slots[i]] != (common.Hash{}) {
+				keys = append(keys, drvk)
+			}
+		}
+		ans.Keys = keys
+	case regOpAffinities:
+		keys := [][]byte{}
+		for i, nsvk := range ans.Keys {
+			v := values[l.slots[i]]
+			if bytes.Equal(v[:], common.LeftPadBytes(q.Key, 32)) {
+				keys = append(keys, nsvk)
+			}
+		}
+		ans.Keys = keys
+	case regOpAliasesFor:
+		aliases := []registryAlias{}
+		for i, a := range ans.Aliases {
+			v := values[l.slots[i]]
+			if bytes.Equal(v[:], common.LeftPadBytes(q.Key, 32)) {
+				aliases = append(aliases, a)
+			}
+		}
+		ans.Aliases = aliases
+	case regOpOwnedBy:
+		aliases := []registryAlias{}
+		for i, a := range ans.Aliases {
+			v, o := values[l.slots[2*i]], values[l.slots[2*i+1]]
+			if v != (common.Hash{}) && bytes.Equal(o[:], common.LeftPadBytes(q.Key, 32)) {
+				a.Value = append([]byte{}, v[:]...)
+				aliases = append(aliases, a)
+			}
+		}
+		ans.Aliases = aliases
+	}
+	return nil
+}
+
+//checkHeader decodes a header from the registry and checks it. A header
+//for a block already checked must be the same one. Otherwise its proof of
+//work must be valid, at no less than half the difficulty of the head, and
+//unless it is a head it must be within maxProofLag blocks of the head. A
+//registry that forges state must therefore mine a block to do it
+func (t *thinChain) checkHeader(enc []byte, isHead bool) (*types.Header, error) {
+	hdr := &types.Header{}
+	if err := rlp.DecodeBytes(enc, hdr); err != nil {
+		return nil, bwe.WrapM(bwe.RegistryProofInvalid, "bad block header", err)
+	}
+	n := hdr.Number.Uint64()
+	hash := hdr.Hash()
+	t.mu.Lock()
+	known, seen := t.verified[n]
+	parent, hasParent := t.verified[n-1]
+	head, difficulty := t.head.Number, t.difficulty
+	t.mu.Unlock()
+	if seen {
+		if known != hash {
+			return nil, bwe.M(bwe.RegistryProofInvalid, fmt.Sprintf("the registry sent two headers for block %d", n))
+		}
+		return hdr, nil
+	}
+	if !isHead && (n > head || n+maxProofLag < head) {
+		return nil, bwe.M(bwe.RegistryProofInvalid, fmt.Sprintf("proof against block %d, but the head is %d", n, head))
+	}
+	if hasParent && parent != hdr.ParentHash {
+		return nil, bwe.M(bwe.RegistryProofInvalid, fmt.Sprintf("block %d is not a child of the block before it", n))
+	}
+	if difficulty != nil && hdr.Difficulty.Cmp(new(big.Int).Rsh(difficulty, 1)) < 0 {
+		return nil, bwe.M(bwe.RegistryProofInvalid, fmt.Sprintf("block %d has too low a difficulty", n))
+	}
+	if err := t.pow.VerifySeal(nil, hdr); err != nil {
+		return nil, bwe.WrapM(bwe.RegistryProofInvalid, fmt.Sprintf("block %d has a bad proof of work", n), err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.verified[n] = hash
+	if isHead && n >= t.head.Number {
+		t.difficulty = hdr.Difficulty
+	}
+	for k := range t.verified {
+		if k+2*maxProofLag < t.head.Number {
+			delete(t.verified, k)
+		}
+	}
+	return hdr, nil
+}
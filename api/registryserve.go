@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//Operations in a registryQuery
+const (
+	regOpHead       = "head"
+	regOpEntity     = "entity"
+	regOpDOT        = "dot"
+	regOpChain      = "chain"
+	regOpDOTsFrom   = "dotsfrom"
+	regOpAlias      = "alias"
+	regOpUnalias    = "unalias"
+	regOpAliasesFor = "aliasesfor"
+	regOpAliasOwner = "aliasowner"
+	regOpOwnedBy    = "ownedby"
+	regOpDR         = "dr"
+	regOpSRV        = "srv"
+	regOpOffers     = "offers"
+	regOpAffinities = "affinities"
+	regOpLogs       = "logs"
+)
+
+//registryQuery is the msgpack body of a nCmdRegistry frame, sent by a thin
+//router to the full router it resolves through. Key is the VK, hash or
+//alias key the operation is about
+type registryQuery struct {
+	Op  string `msgpack:"op"`
+	Key []byte `msgpack:"key"`
+	//For head, the block whose header is wanted, zero for the latest
+	Block uint64 `msgpack:"block"`
+	//For logs, as for FindLogsBetweenHeavy
+	After   int64      `msgpack:"after"`
+	Before  int64      `msgpack:"before"`
+	Address []byte     `msgpack:"address"`
+	Topics  [][][]byte `msgpack:"topics"`
+	//Ask for the answer to be proven, see proveAnswer
+	Prove bool `msgpack:"prove"`
+}
+
+//registryAnswer is the msgpack body of the nCmdResult frame answering a
+//registryQuery. Errors are sent as a nCmdRStatus frame instead
+type registryAnswer struct {
+	//The entity, DOT or chain in its wire form, and its state
+	Object []byte `msgpack:"object"`
+	State  int    `msgpack:"state"`
+	//The VKs, hashes or alias value the operation returns
+	Keys    [][]byte        `msgpack:"keys"`
+	Zero    bool            `msgpack:"zero"`
+	Text    string          `msgpack:"text"`
+	Aliases []registryAlias `msgpack:"aliases"`
+	Logs    []registryLog   `msgpack:"logs"`
+	//The server's head block when it answered
+	Head registryHead `msgpack:"head"`
+	//For a proven answer, the RLP of the header of the block it is proven
+	//in and of the bc.StorageProof
+	Header []byte `msgpack:"header"`
+	Proof  []byte `msgpack:"proof"`
+}
+
+type registryHead struct {
+	Number     uint64 `msgpack:"number"`
+	Time       int64  `msgpack:"time"`
+	Difficulty int64  `msgpack:"difficulty"`
+}
+
+type registryAlias struct {
+	Key         []byte `msgpack:"key"`
+	Value       []byte `msgpack:"value"`
+	BlockNumber uint64 `msgpack:"block"`
+	TxHash      []byte `msgpack:"tx"`
+}
+
+type registryLog struct {
+	Address   []byte   `msgpack:"address"`
+	Topics    [][]byte `msgpack:"topics"`
+	Data      []byte   `msgpack:"data"`
+	Block     uint64   `msgpack:"block"`
+	TxHash    []byte   `msgpack:"tx"`
+	BlockHash []byte   `msgpack:"blockhash"`
+}
+
+//answerRegistry answers a thin router's query from this router's chain.
+//The registry is public, so any peer may ask, but only if [router]
+//ServeRegistry is set
+func (bw *BW) answerRegistry(body []byte) ([]byte, error) {
+	if !bw.Config.Router.ServeRegistry || bw.Config.IsThin() {
+		return nil, bwe.M(bwe.BadOperation, "this router does not serve the registry")
+	}
+	q := registryQuery{}
+	if err := msgpack.Unmarshal(body, &q); err != nil {
+		return nil, bwe.WrapM(bwe.MalformedMessage, "bad registry query", err)
+	}
+	ctx := context.Background()
+	ch := bw.bchain
+	rv := registryAnswer{Head: bw.registryHead()}
+	var err error
+	switch q.Op {
+	case regOpHead:
+		if q.Block != 0 {
+			h := ch.GetHeader(q.Block)
+			if h == nil {
+				return nil, bwe.M(bwe.ResolutionFailed, "no such block")
+			}
+			rv.Head = headerOf(h)
+		}
+	case regOpEntity:
+		e, s, rerr := ch.ResolveEntity(ctx, q.Key)
+		if e != nil {
+			rv.Object = e.GetContent()
+		}
+		rv.State, err = s, rerr
+	case regOpDOT:
+		d, s, rerr := ch.ResolveDOT(ctx, q.Key)
+		if d != nil {
+			rv.Object = d.GetContent()
+		}
+		rv.State, err = s, rerr
+	case regOpChain:
+		dc, s, rerr := ch.ResolveAccessDChain(ctx, q.Key)
+		if dc != nil {
+			rv.Object = dc.GetContent()
+		}
+		rv.State, err = s, rerr
+	case regOpDOTsFrom:
+		var hashes []bc.Bytes32
+		hashes, err = ch.ResolveDOTsFromVK(ctx, bc.SliceToBytes32(q.Key))
+		for _, h := range hashes {
+			rv.Keys = append(rv.Keys, append([]byte{}, h[:]...))
+		}
+	case regOpAlias:
+		var v bc.Bytes32
+		v, rv.Zero, err = ch.ResolveAlias(ctx, bc.SliceToBytes32(q.Key))
+		rv.Keys = [][]byte{v[:]}
+	case regOpUnalias:
+		var k bc.Bytes32
+		k, rv.Zero, err = ch.UnresolveAlias(ctx, bc.SliceToBytes32(q.Key))
+		rv.Keys = [][]byte{k[:]}
+	case regOpAliasesFor:
+		var recs []*bc.AliasRecord
+		recs, err = ch.FindAliasesFor(ctx, bc.SliceToBytes32(q.Key))
+		for _, r := range recs {
+			rv.Aliases = append(rv.Aliases, registryAlias{
+				Key:         append([]byte{}, r.Key[:]...),
+				Value:       append([]byte{}, r.Value[:]...),
+				BlockNumber: r.BlockNumber,
+				TxHash:      r.TxHash.Bytes(),
+			})
+		}
+	case regOpAliasOwner:
+		var o bc.Address
+		o, err = ch.AliasOwner(ctx, bc.SliceToBytes32(q.Key))
+		rv.Keys = [][]byte{common.LeftPadBytes(o[:], 32)}
+		rv.Zero = o == bc.Address{}
+	case regOpOwnedBy:
+		var recs []*bc.AliasRecord
+		recs, err = ch.FindAliasesOwnedBy(ctx, []bc.Address{bc.Address(common.BytesToAddress(q.Key))})
+		for _, r := range recs {
+			rv.Aliases = append(rv.Aliases, registryAlias{
+				Key:         append([]byte{}, r.Key[:]...),
+				Value:       append([]byte{}, r.Value[:]...),
+				BlockNumber: r.BlockNumber,
+				TxHash:      r.TxHash.Bytes(),
+			})
+		}
+	case regOpDR:
+		var drvk []byte
+		drvk, err = ch.GetDesignatedRouterFor(ctx, q.Key)
+		rv.Keys = [][]byte{drvk}
+	case regOpSRV:
+		rv.Text, err = ch.GetSRVRecordFor(ctx, q.Key)
+	case regOpOffers:
+		rv.Keys, err = ch.FindRoutingOffers(ctx, q.Key)
+	case regOpAffinities:
+		rv.Keys, err = ch.FindRoutingAffinities(ctx, q.Key)
+	case regOpLogs:
+		topics := make([][]common.Hash, len(q.Topics))
+		for i, opts := range q.Topics {
+			for _, t := range opts {
+				topics[i] = append(topics[i], common.BytesToHash(t))
+			}
+		}
+		var logs []bc.Log
+		logs, err = ch.FindLogsBetweenHeavy(ctx, q.After, q.Before, common.BytesToAddress(q.Address), topics)
+		for _, l := range logs {
+			addr, txh, bh := l.ContractAddress(), l.TxHash(), l.BlockHash()
+			rl := registryLog{
+				Address:   addr[:],
+				Data:      l.Data(),
+				Block:     l.BlockNumber(),
+				TxHash:    txh[:],
+				BlockHash: bh[:],
+			}
+			for _, t := range l.Topics() {
+				rl.Topics = append(rl.Topics, append([]byte{}, t[:]...))
+			}
+			rv.Logs = append(rv.Logs, rl)
+		}
+	default:
+		return nil, bwe.M(bwe.BadOperation, "unknown registry operation "+q.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.Prove {
+		if err := bw.proveAnswer(ctx, &q, &rv); err != nil {
+			return nil, err
+		}
+	}
+	return msgpack.Marshal(&rv)
+}
+
+func (bw *BW) registryHead() registryHead {
+	return headerOf(bw.bchain.GetHeader(bw.bchain.CurrentBlock()))
+}
+
+func headerOf(h *types.Header) registryHead {
+	if h == nil {
+		return registryHead{}
+	}
+	return registryHead{
+		Number:     h.Number.Uint64(),
+		Time:       h.Time.Int64(),
+		Difficulty: h.Difficulty.Int64(),
+	}
+}
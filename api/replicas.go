@@ -0,0 +1,303 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//ReplicaURISuffix is the URI a namespace grants P on to a designated router
+//to make it a replica of the namespace's designated router. The chain only
+//records one designated router per namespace (the primary), so the rest of
+//the replica set is declared with DOTs, which the namespace can revoke
+const ReplicaURISuffix = "$/dr/replica"
+
+const (
+	//ReplicaModeFanout delivers publishes and persists to every member of
+	//the replica set
+	ReplicaModeFanout = "fanout"
+	//ReplicaModeStandby only copies persisted messages to the other
+	//members, so that they can take over from the primary
+	ReplicaModeStandby = "standby"
+)
+
+type replicator struct {
+	mu sync.Mutex
+	//Used to connect to the other replicas
+	cl *BosswaveClient
+}
+
+type byCreated []DOTLink
+
+func (b byCreated) Len() int      { return len(b) }
+func (b byCreated) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCreated) Less(i, j int) bool {
+	ci, cj := b[i].D.GetCreated(), b[j].D.GetCreated()
+	return ci != nil && cj != nil && ci.Before(*cj)
+}
+
+//LookupDesignatedRouters returns the replica set for a namespace, the
+//primary (the designated router on the chain) first and then the replicas,
+//oldest grant first
+func (bw *BW) LookupDesignatedRouters(nsvk []byte) ([][]byte, error) {
+	primary, err := bw.LookupDesignatedRouter(nsvk)
+	if err != nil {
+		return nil, err
+	}
+	rv := [][]byte{primary}
+	links, err := bw.ResolveGrantedDOTs(nsvk)
+	if err != nil {
+		//The primary still works on its own
+		log.Warnf("could not resolve replicas for %s: %v", crypto.FmtKey(nsvk), err)
+		return rv, nil
+	}
+	replicas := []DOTLink{}
+	seen := map[bc.Bytes32]bool{bc.SliceToBytes32(primary): true}
+	for _, l := range links {
+		d := l.D
+		if l.S != StateValid || !d.IsAccess() ||
+			!bytes.Equal(d.GetAccessURIMVK(), nsvk) ||
+			d.GetAccessURISuffix() != ReplicaURISuffix ||
+			!strings.Contains(d.GetPermString(), "P") {
+			continue
+		}
+		kvk := bc.SliceToBytes32(d.GetReceiverVK())
+		if seen[kvk] {
+			continue
+		}
+		seen[kvk] = true
+		replicas = append(replicas, l)
+	}
+	sort.Stable(byCreated(replicas))
+	for _, l := range replicas {
+		rv = append(rv, l.D.GetReceiverVK())
+	}
+	return rv, nil
+}
+
+//IsDesignatedRouterFor returns true if this router is in the replica set
+//for the namespace
+func (bw *BW) IsDesignatedRouterFor(nsvk []byte) (bool, error) {
+	drvks, err := bw.LookupDesignatedRouters(nsvk)
+	if err != nil {
+		return false, err
+	}
+	for _, drvk := range drvks {
+		if bytes.Equal(drvk, bw.Entity.GetVK()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//CanWriteFreePath is true if vk is a designated router for the namespace.
+//Only they may write to its free paths
+func (bw *BW) CanWriteFreePath(nsvk []byte, vk []byte) bool {
+	drvks, err := bw.LookupDesignatedRouters(nsvk)
+	if err != nil {
+		return false
+	}
+	for _, drvk := range drvks {
+		if bytes.Equal(drvk, vk) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bw *BW) replicaMode() string {
+	if bw.Config.DR.ReplicaMode == "" {
+		return ReplicaModeFanout
+	}
+	return bw.Config.DR.ReplicaMode
+}
+
+//replicaClient is the client used to connect to the other members of
+//replica sets
+func (bw *BW) replicaClient() *BosswaveClient {
+	bw.repl.mu.Lock()
+	defer bw.repl.mu.Unlock()
+	if bw.repl.cl == nil {
+		bw.repl.cl = bw.CreateClient(context.Background(), "REPLICA")
+	}
+	return bw.repl.cl
+}
+
+//otherReplicas returns the members of the replica set that are not us
+func (bw *BW) otherReplicas(nsvk []byte) [][]byte {
+	drvks, err := bw.LookupDesignatedRouters(nsvk)
+	if err != nil {
+		return nil
+	}
+	rv := [][]byte{}
+	for _, drvk := range drvks {
+		if !bytes.Equal(drvk, bw.Entity.GetVK()) {
+			rv = append(rv, drvk)
+		}
+	}
+	return rv
+}
+
+//replicate sends a message that was delivered locally to the other members
+//of the replica set. Messages received from another replica are not
+//replicated again. Deletes are replicated like persists. Free paths are
+//not replicated, as each router keeps its own state there. Publishes that
+//retain their last value are replicated even to standbys
+func (bw *BW) replicate(m *core.Message) {
+	if util.IsFreePath(m.TopicSuffix) {
+		return
+	}
+	switch m.Type {
+	case core.TypePersist, core.TypeDelete:
+	case core.TypePublish:
+		if bw.replicaMode() == ReplicaModeStandby && !bw.retainsLastValue(m) {
+			return
+		}
+	default:
+		return
+	}
+	others := bw.otherReplicas(m.MVK)
+	if len(others) == 0 {
+		return
+	}
+	rcl := bw.replicaClient()
+	for _, drvk := range others {
+		go func(drvk []byte) {
+			peer, err := rcl.peerFor(drvk)
+			if err != nil {
+				log.Infof("could not replicate to %s: %v", crypto.FmtKey(drvk), err)
+				return
+			}
+			peer.Replicate(m, func(err error) {
+				if err != nil {
+					log.Infof("replica %s rejected message: %v", crypto.FmtKey(drvk), err)
+				}
+			})
+		}(drvk)
+	}
+}
+
+//replicaNamespaces finds the namespaces this router is a designated
+//router for, as primary or replica
+func (bw *BW) replicaNamespaces() [][]byte {
+	ourvk := bw.Entity.GetVK()
+	rv := [][]byte{}
+	seen := make(map[bc.Bytes32]bool)
+	nsvks, err := bw.BC().FindRoutingAffinities(context.TODO(), ourvk)
+	if err != nil {
+		log.Warnf("could not find routing affinities: %v", err)
+	}
+	for _, nsvk := range nsvks {
+		seen[bc.SliceToBytes32(nsvk)] = true
+		rv = append(rv, nsvk)
+	}
+	ri := bw.rdata.regindex
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if err := ri.update(bw); err != nil {
+		log.Warnf("could not find replica grants: %v", err)
+		return rv
+	}
+	for _, d := range ri.dots {
+		if d.IsAccess() && d.GetAccessURISuffix() == ReplicaURISuffix &&
+			bytes.Equal(d.GetReceiverVK(), ourvk) {
+			knsvk := bc.SliceToBytes32(d.GetAccessURIMVK())
+			if !seen[knsvk] {
+				seen[knsvk] = true
+				rv = append(rv, d.GetAccessURIMVK())
+			}
+		}
+	}
+	return rv
+}
+
+//gossipNamespace sends every message persisted on the namespace to the
+//other replicas. They only keep the messages they do not have, as there is
+//no way to tell which of two persisted messages is newer
+func (bw *BW) gossipNamespace(nsvk []byte) {
+	if ok, err := bw.IsDesignatedRouterFor(nsvk); err != nil || !ok {
+		return
+	}
+	others := bw.otherReplicas(nsvk)
+	if len(others) == 0 {
+		return
+	}
+	rcl := bw.replicaClient()
+	peers := []*PeerClient{}
+	for _, drvk := range others {
+		peer, err := rcl.peerFor(drvk)
+		if err != nil {
+			log.Infof("could not gossip to %s: %v", crypto.FmtKey(drvk), err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		return
+	}
+	rc := make(chan store.SM, 3)
+	go store.GetMatchingMessage(base64.URLEncoding.EncodeToString(nsvk)+"/*", rc)
+	count := 0
+	for sm := range rc {
+		m, err := core.LoadMessage(sm.Body)
+		if err != nil || m.ExpireTime.Before(time.Now()) || util.IsFreePath(m.TopicSuffix) {
+			continue
+		}
+		m.PersistSeq, _ = store.GetSequence(sm.URI, sm.Body)
+		count++
+		for _, peer := range peers {
+			peer.Gossip(m, func(err error) {})
+		}
+	}
+	log.Infof("gossiped %d persisted messages on %s to %d replicas", count, crypto.FmtKey(nsvk), len(peers))
+}
+
+//StartReplicaGossip periodically sends the persisted messages on every
+//namespace this router is a designated router for to the rest of the
+//replica set, so that members that were down catch up. It does nothing if
+//the gossip interval is zero
+func StartReplicaGossip(bw *BW) {
+	if bw.Config.DR.GossipInterval <= 0 {
+		return
+	}
+	interval := time.Duration(bw.Config.DR.GossipInterval) * time.Second
+	for {
+		for _, nsvk := range bw.replicaNamespaces() {
+			bw.gossipNamespace(nsvk)
+		}
+		time.Sleep(interval)
+	}
+}
+
+//acceptGossip persists a message from another replica, keeping its
+//sequence number, unless there is already a message at that URI, or the
+//message there was deleted
+func (bw *BW) acceptGossip(m *core.Message) error {
+	if m.Type != core.TypePersist && !bw.retainsLastValue(m) {
+		return bwe.M(bwe.BadOperation, "only persisted messages are gossiped")
+	}
+	if _, ok := store.GetExactMessage(m.Topic); ok {
+		return nil
+	}
+	if _, ok := store.GetTombstone(m.Topic); ok {
+		return nil
+	}
+	if m.PersistSeq != 0 {
+		store.PutNumberedMessage(m.Topic, m.Encoded, m.PersistSeq)
+	} else {
+		store.PutMessage(m.Topic, m.Encoded)
+	}
+	return nil
+}
@@ -87,7 +87,7 @@ skip:
 		//Check the logs for DOTs
 		for _, l := range b.Logs {
 			log.Tracef("Found log from %x \n %s", l.ContractAddress(), l.String())
-			if l.ContractAddress() == bc.HexToAddress(bc.UFI_Registry_Address) {
+			if l.ContractAddress() == bc.ContractAddress(bc.ContractRegistry) {
 				switch {
 				case l.MatchesTopicsStrict([]bc.Bytes32{
 					bc.HexToBytes32(bc.EventSig_Registry_NewDOT)}):
@@ -435,10 +435,8 @@ const (
 // real wall time. Err is actually a useful value that can be used higher up
 // plus we validate the entities in the DOT too
 func (bw *BW) GetDOTState(d *objects.DOT) (err error) {
-	if d.GetExpiry() != nil {
-		if d.GetExpiry().Before(time.Now()) {
-			return bwe.M(bwe.ExpiredDOT, "DOT "+crypto.FmtHash(d.GetHash())+" is expired by our clock")
-		}
+	if d.IsExpired() {
+		return bwe.M(bwe.ExpiredDOT, "DOT "+crypto.FmtHash(d.GetHash())+" is expired by our clock")
 	}
 	_, state, err := bw.ResolveDOT(d.GetHash())
 	switch state {
@@ -472,10 +470,8 @@ func (bw *BW) GetDOTState(d *objects.DOT) (err error) {
 // Although this is in resolution, we actually evaluate expiry based on the
 // real wall time. Err is actually a useful value that can be used higher up
 func (bw *BW) GetEntityState(e *objects.Entity) (err error) {
-	if e.GetExpiry() != nil {
-		if e.GetExpiry().Before(time.Now()) {
-			return bwe.M(bwe.ExpiredEntity, "Entity "+crypto.FmtKey(e.GetVK())+" is expired by our clock")
-		}
+	if e.IsExpired() {
+		return bwe.M(bwe.ExpiredEntity, "Entity "+crypto.FmtKey(e.GetVK())+" is expired by our clock")
 	}
 	_, state, err := bw.ResolveEntity(e.GetVK())
 	switch state {
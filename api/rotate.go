@@ -0,0 +1,260 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//RotateEntityParams describes an entity rotation. Entities cannot be
+//changed once published, so the new entity has a new key. Unless they are
+//given, its contact, comment, revokers and expiry are those of the old one
+type RotateEntityParams struct {
+	//The entity being replaced, with its signing key
+	Old         *objects.Entity
+	Contact     *string
+	Comment     *string
+	Revokers    [][]byte
+	Expiry      *time.Time
+	ExpiryDelta *time.Duration
+	//Entities, with their signing keys, that granted DOTs to the old
+	//entity. Those DOTs are granted to the new entity again. DOTs from
+	//other granters are left out of the rotation, and listed in the report
+	Granters []*objects.Entity
+	//Leave the old entity valid rather than revoking it
+	KeepOld bool
+	//Create the objects without publishing them
+	NoPublish bool
+	//The account of the client's entity that pays for publishing
+	Account     int
+	Interaction *bc.InteractionParams
+}
+
+//RotatedDOT is one of the old entity's DOTs in a RotationReport
+type RotatedDOT struct {
+	Old *objects.DOT
+	//The replacement, nil if there is none
+	New *objects.DOT
+	//True for a DOT granted to the old entity, false for one it granted
+	Held bool
+	//Why there is no replacement, or why it could not be published
+	Error string
+}
+
+//RotationReport is the result of RotateEntity. It lists every DOT the old
+//entity held or granted that was valid, and what became of it
+type RotationReport struct {
+	Old  *objects.Entity
+	New  *objects.Entity
+	DOTs []RotatedDOT
+	//The revocation of the old entity, nil if it is kept
+	Revocation *objects.Revocation
+	//Whether the objects are in the registry. The revocation is only
+	//published once the new entity and DOTs are
+	Published bool
+	Revoked   bool
+	//Why publishing stopped, if it did
+	Error string
+}
+
+//RotateEntity replaces an entity with a new one. The DOTs the old entity
+//granted are granted again by the new one, and the DOTs it was granted by
+//one of p.Granters are granted again to the new one. The old entity is
+//then revoked. Everything is published, paid for by the client's entity,
+//unless p.NoPublish is set. An error is only returned if the rotation
+//could not start; what happened to each object is in the report
+func (cl *BosswaveClient) RotateEntity(ctx context.Context, p *RotateEntityParams) (*RotationReport, error) {
+	old := p.Old
+	if old == nil || !crypto.CheckKeypair(old.GetSK(), old.GetVK()) {
+		return nil, bwe.M(bwe.InvalidEntity, "the old entity's signing key is needed to rotate it")
+	}
+	for _, g := range p.Granters {
+		if !crypto.CheckKeypair(g.GetSK(), g.GetVK()) {
+			return nil, bwe.M(bwe.InvalidEntity, "granter "+crypto.FmtKey(g.GetVK())+" has no signing key")
+		}
+	}
+	if !p.NoPublish && cl.BCC() == nil {
+		return nil, bwe.M(bwe.NoEntity, "set an entity to pay for publishing")
+	}
+	ne, err := CreateEntity(rotatedEntityParams(p))
+	if err != nil {
+		return nil, err
+	}
+	held, granted, err := cl.BW().registryDOTs(old.GetVK())
+	if err != nil {
+		return nil, err
+	}
+	rep := &RotationReport{Old: old, New: ne}
+	for _, d := range held {
+		if !cl.dotValid(d) {
+			continue
+		}
+		rd := RotatedDOT{Old: d, Held: true}
+		var giver *objects.Entity
+		for _, g := range p.Granters {
+			if bytes.Equal(g.GetVK(), d.GetGiverVK()) {
+				giver = g
+			}
+		}
+		switch {
+		case bytes.Equal(d.GetGiverVK(), old.GetVK()):
+			//Granted to itself, which is handled with the granted DOTs
+			continue
+		case !d.IsAccess():
+			rd.Error = "permission DOTs are not granted again"
+		case giver == nil:
+			rd.Error = "the granter's key was not given"
+		default:
+			rd.New = regrantDOT(d, giver, ne.GetVK(), old.GetVK(), ne.GetVK())
+		}
+		rep.DOTs = append(rep.DOTs, rd)
+	}
+	for _, d := range granted {
+		if !cl.dotValid(d) {
+			continue
+		}
+		rd := RotatedDOT{Old: d}
+		to := d.GetReceiverVK()
+		if bytes.Equal(to, old.GetVK()) {
+			to = ne.GetVK()
+		}
+		if d.IsAccess() {
+			rd.New = regrantDOT(d, ne, to, old.GetVK(), ne.GetVK())
+		} else {
+			rd.Error = "permission DOTs are not granted again"
+		}
+		rep.DOTs = append(rep.DOTs, rd)
+	}
+	if !p.KeepOld {
+		rep.Revocation = objects.CreateRevocation(old.GetVK(), old.GetVK(), "rotated to "+crypto.FmtKey(ne.GetVK()))
+		rep.Revocation.Encode(old.GetSK())
+	}
+	if p.NoPublish {
+		return rep, nil
+	}
+	cl.publishRotation(ctx, p, rep)
+	return rep, nil
+}
+
+//rotatedEntityParams describes the new entity of a rotation
+func rotatedEntityParams(p *RotateEntityParams) *CreateEntityParams {
+	rv := &CreateEntityParams{
+		Contact:     p.Old.GetContact(),
+		Comment:     p.Old.GetComment(),
+		Revokers:    p.Old.GetRevokers(),
+		Expiry:      p.Old.GetExpiry(),
+		ExpiryDelta: p.ExpiryDelta,
+	}
+	if p.Contact != nil {
+		rv.Contact = *p.Contact
+	}
+	if p.Comment != nil {
+		rv.Comment = *p.Comment
+	}
+	if p.Revokers != nil {
+		rv.Revokers = p.Revokers
+	}
+	if p.Expiry != nil || p.ExpiryDelta != nil {
+		rv.Expiry = p.Expiry
+	}
+	return rv
+}
+
+func (cl *BosswaveClient) dotValid(d *objects.DOT) bool {
+	_, s, err := cl.BW().ResolveDOT(d.GetHash())
+	return err == nil && s == StateValid
+}
+
+//regrantDOT copies an access DOT to a new giver and receiver. A delegated
+//revoker of from becomes to
+func regrantDOT(d *objects.DOT, giver *objects.Entity, receiver []byte, from []byte, to []byte) *objects.DOT {
+	nd := objects.CreateDOT(true, giver.GetVK(), receiver)
+	nd.SetSigAlgorithm(giver.GetSigAlgorithm())
+	nd.SetTTL(d.GetTTL())
+	nd.SetContact(d.GetContact())
+	nd.SetComment(d.GetComment())
+	if d.GetExpiry() != nil {
+		nd.SetExpiry(*d.GetExpiry())
+	}
+	nd.SetCreationToNow()
+	for _, r := range d.GetRevokers() {
+		if bytes.Equal(r, from) {
+			r = to
+		}
+		nd.AddRevoker(r)
+	}
+	nd.SetAccessURI(d.GetAccessURIMVK(), d.GetAccessURISuffix())
+	nd.SetPermString(d.GetPermString())
+	nd.SetPublishLimits(d.GetPublishLimits())
+	nd.SetNoDelegate(d.GetNoDelegate())
+	nd.Encode(giver.GetSK())
+	return nd
+}
+
+//waitTx runs a chain operation and waits for it to be confirmed
+func waitTx(op func(confirmed func(res *bc.TxResult, err error))) error {
+	done := make(chan error, 1)
+	op(func(res *bc.TxResult, err error) {
+		done <- err
+	})
+	return <-done
+}
+
+//publishRotation publishes the new entity, then the new DOTs, and then the
+//revocation if nothing failed
+func (cl *BosswaveClient) publishRotation(ctx context.Context, p *RotateEntityParams, rep *RotationReport) {
+	bcc := cl.BCC().WithInteractionParams(p.Interaction)
+	err := waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+		bcc.PublishEntity(ctx, p.Account, rep.New, confirmed)
+	})
+	if err != nil {
+		rep.Error = "could not publish the new entity: " + err.Error()
+		return
+	}
+	wg := sync.WaitGroup{}
+	failed := false
+	mu := sync.Mutex{}
+	for i := range rep.DOTs {
+		rd := &rep.DOTs[i]
+		if rd.New == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+				bcc.PublishDOT(ctx, p.Account, rd.New, confirmed)
+			})
+			if err != nil {
+				mu.Lock()
+				rd.Error = "could not publish: " + err.Error()
+				failed = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed {
+		rep.Error = "some DOTs could not be published, so the old entity was not revoked"
+		return
+	}
+	rep.Published = true
+	if rep.Revocation == nil {
+		return
+	}
+	err = waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+		bcc.PublishRevocation(ctx, p.Account, rep.Revocation, confirmed)
+	})
+	if err != nil {
+		rep.Error = "could not publish the revocation: " + err.Error()
+		return
+	}
+	rep.Revoked = true
+	cl.BW().FlushRevoked(rep.Old.GetVK())
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//How often RotateDR dials the new router while waiting for it to come up
+const rotateDRPoll = 5 * time.Second
+
+//RotateDRParams describes a designated router key rotation. The new router
+//entity must already be serving at SRV, usually as a second router, so
+//that the namespaces are never without a reachable designated router
+type RotateDRParams struct {
+	//The router entity being retired, with its signing key
+	OldDR *objects.Entity
+	//The router entity taking over, with its signing key. It is published
+	//if it is not in the registry
+	NewDR *objects.Entity
+	//The namespaces moved to the new router, with their signing keys
+	Namespaces []*objects.Entity
+	//Where the new router serves, as host:port
+	SRV string
+	//How long to wait for the new router to be reachable at SRV. It is
+	//dialed once if this is zero
+	Wait time.Duration
+	//Leave the old router's routing offers in place rather than retracting
+	//them once the new affinities are confirmed
+	KeepOld bool
+	//The account of the client's entity that pays for the transactions
+	Account     int
+	Interaction *bc.InteractionParams
+	//Called as each step starts, may be nil
+	Progress func(step string)
+}
+
+//DRRotation is the result of RotateDR
+type DRRotation struct {
+	//The namespaces whose designated router is now the new one
+	Moved [][]byte
+	//The namespaces the old router no longer offers to route
+	Retracted [][]byte
+}
+
+//RotateDR moves namespaces from one designated router entity to another
+//without a gap in service. The new entity is published, checked to be
+//serving at p.SRV and given that SRV record, and then offers to route
+//each namespace, which accepts. Until an acceptance is confirmed, peers
+//still find the old router for that namespace, which keeps serving it.
+//Once every namespace has moved the old router's offers are retracted,
+//and it can be shut down. On an error the returned rotation says how far
+//it got
+func (cl *BosswaveClient) RotateDR(ctx context.Context, p *RotateDRParams) (*DRRotation, error) {
+	rv := &DRRotation{}
+	for _, e := range append([]*objects.Entity{p.OldDR, p.NewDR}, p.Namespaces...) {
+		if e == nil || !crypto.CheckKeypair(e.GetSK(), e.GetVK()) {
+			return rv, bwe.M(bwe.InvalidEntity, "the routers and namespaces must be given with their signing keys")
+		}
+	}
+	if bytes.Equal(p.OldDR.GetVK(), p.NewDR.GetVK()) {
+		return rv, bwe.M(bwe.InvalidEntity, "the new router entity is the old one")
+	}
+	if len(p.Namespaces) == 0 {
+		return rv, bwe.M(bwe.BadOperation, "no namespaces to move")
+	}
+	if cl.BCC() == nil {
+		return rv, bwe.M(bwe.NoEntity, "set an entity to pay for the rotation")
+	}
+	bw := cl.BW()
+	for _, ns := range p.Namespaces {
+		drvk, err := bw.LookupDesignatedRouter(ns.GetVK())
+		if err != nil || !bytes.Equal(drvk, p.OldDR.GetVK()) {
+			return rv, bwe.M(bwe.BadOperation, "the old router is not the designated router for "+crypto.FmtKey(ns.GetVK()))
+		}
+	}
+	progress := func(step string) {
+		if p.Progress != nil {
+			p.Progress(step)
+		}
+	}
+	bcc := cl.BCC().WithInteractionParams(p.Interaction)
+
+	if _, s, err := bw.ResolveEntity(p.NewDR.GetVK()); err != nil || s != StateValid {
+		progress("publishing the new router entity")
+		err := waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+			bcc.PublishEntity(ctx, p.Account, p.NewDR, confirmed)
+		})
+		if err != nil {
+			return rv, err
+		}
+	}
+	progress("waiting for the new router at " + p.SRV)
+	if err := waitReachable(ctx, p.SRV, p.NewDR.GetVK(), p.Wait); err != nil {
+		return rv, bwe.WrapM(bwe.BadOperation, "the new router is not serving at "+p.SRV, err)
+	}
+	progress("setting the SRV record")
+	err := waitChain(func(confirmed func(err error)) {
+		bcc.CreateSRVRecord(ctx, p.Account, p.NewDR, p.SRV, confirmed)
+	})
+	if err != nil {
+		return rv, err
+	}
+	for _, ns := range p.Namespaces {
+		nsvk := crypto.FmtKey(ns.GetVK())
+		progress("offering to route " + nsvk)
+		err := waitChain(func(confirmed func(err error)) {
+			bcc.CreateRoutingOffer(ctx, p.Account, p.NewDR, ns.GetVK(), confirmed)
+		})
+		if err != nil {
+			return rv, err
+		}
+		progress("accepting the offer for " + nsvk)
+		err = waitChain(func(confirmed func(err error)) {
+			bcc.AcceptRoutingOffer(ctx, p.Account, ns, p.NewDR.GetVK(), confirmed)
+		})
+		if err != nil {
+			return rv, err
+		}
+		drvk, err := bw.LookupDesignatedRouter(ns.GetVK())
+		if err != nil || !bytes.Equal(drvk, p.NewDR.GetVK()) {
+			return rv, bwe.M(bwe.BlockChainGenericError, "the acceptance for "+nsvk+" confirmed, but the chain does not show the new router")
+		}
+		rv.Moved = append(rv.Moved, ns.GetVK())
+	}
+	if p.KeepOld {
+		return rv, nil
+	}
+	for _, ns := range p.Namespaces {
+		progress("retracting the old offer for " + crypto.FmtKey(ns.GetVK()))
+		err := waitChain(func(confirmed func(err error)) {
+			bcc.RetractRoutingOffer(ctx, p.Account, p.OldDR, ns.GetVK(), confirmed)
+		})
+		if err != nil {
+			return rv, err
+		}
+		rv.Retracted = append(rv.Retracted, ns.GetVK())
+	}
+	return rv, nil
+}
+
+//waitChain runs a chain operation that reports only an error and waits for
+//it to be confirmed
+func waitChain(op func(confirmed func(err error))) error {
+	done := make(chan error, 1)
+	op(func(err error) {
+		done <- err
+	})
+	return <-done
+}
+
+//waitReachable dials target until it proves vk or the wait is over
+func waitReachable(ctx context.Context, target string, vk []byte, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		conn, err := dialPeer(target, vk, drCheckTimeout)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().Add(rotateDRPoll).After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(rotateDRPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//RouterInfoURIPrefix is the free path a router persists its state under,
+//in every namespace it is a designated router for. As it is a free path,
+//anyone can query it without permissions, but only the namespace's
+//designated routers can write to it
+const RouterInfoURIPrefix = "$router"
+
+const defaultRouterInfoInterval = 60 * time.Second
+
+//RouterChainInfo is persisted at $router/chain
+type RouterChainInfo struct {
+	Height  uint64 `msgpack:"height"`
+	Highest uint64 `msgpack:"highest"`
+	Peers   int    `msgpack:"peers"`
+}
+
+//RouterPeerInfo is one of the list persisted at $router/peers. It describes
+//a router connected to this one to deliver messages
+type RouterPeerInfo struct {
+	Address string `msgpack:"address"`
+}
+
+//RouterPeerLinkInfo is one of the list persisted at $router/peerlinks. It
+//describes a connection from this router to another, to deliver messages
+//on namespaces it is not the designated router for
+type RouterPeerLinkInfo struct {
+	Address     string `msgpack:"address"`
+	VK          string `msgpack:"vk"`
+	Connected   bool   `msgpack:"connected"`
+	BytesOut    uint64 `msgpack:"bytesout"`
+	BytesIn     uint64 `msgpack:"bytesin"`
+	FramesOut   uint64 `msgpack:"framesout"`
+	FramesIn    uint64 `msgpack:"framesin"`
+	Reconnects  uint64 `msgpack:"reconnects"`
+	Outstanding int    `msgpack:"outstanding"`
+	//In nanoseconds
+	OldestOutstanding int64 `msgpack:"oldestoutstanding"`
+	RTT               int64 `msgpack:"rtt"`
+}
+
+//RouterSubscriptionInfo is one of the list persisted at
+//$router/subscriptions. Only the subscriptions on the namespace are listed
+type RouterSubscriptionInfo struct {
+	URI    string `msgpack:"uri"`
+	Client string `msgpack:"client"`
+	Tap    bool   `msgpack:"tap"`
+	//In nanoseconds since the epoch
+	Created int64 `msgpack:"created"`
+}
+
+//RouterUsageInfo is persisted at $router/usage. It is what the router has
+//handled on the namespace, and the limits of its [quota] where zero means
+//no limit
+type RouterUsageInfo struct {
+	Messages uint64 `msgpack:"messages"`
+	Bytes    uint64 `msgpack:"bytes"`
+	//In nanoseconds since the epoch
+	WindowStart       int64  `msgpack:"windowstart"`
+	WindowMessages    uint64 `msgpack:"windowmessages"`
+	WindowBytes       uint64 `msgpack:"windowbytes"`
+	Persisted         int64  `msgpack:"persisted"`
+	MessagesPerHour   int    `msgpack:"messagesperhour"`
+	BytesPerHour      int    `msgpack:"bytesperhour"`
+	MaxPersistedBytes int    `msgpack:"maxpersistedbytes"`
+}
+
+//RouterCacheInfo is one of the caches persisted at $router/caches
+type RouterCacheInfo struct {
+	Size      int    `msgpack:"size"`
+	Max       int    `msgpack:"max"`
+	Hits      uint64 `msgpack:"hits"`
+	Misses    uint64 `msgpack:"misses"`
+	Evictions uint64 `msgpack:"evictions"`
+}
+
+//RouterInfo is persisted at $router/info
+type RouterInfo struct {
+	VK      string `msgpack:"vk"`
+	Version string `msgpack:"version"`
+	//When the router last persisted its state, in nanoseconds since the epoch
+	Updated int64 `msgpack:"updated"`
+}
+
+//StartRouterInfo periodically persists the router's peers, the statistics
+//of its connections to other routers, subscriptions, namespace usage, cache
+//stats, chain height, affinity namespaces and the state of its drivers
+//under RouterInfoURIPrefix.
+//[router] InfoInterval sets the period in seconds, and a negative interval
+//disables it
+func StartRouterInfo(bw *BW) {
+	interval := defaultRouterInfoInterval
+	if bw.Config.Router.InfoInterval < 0 {
+		return
+	} else if bw.Config.Router.InfoInterval > 0 {
+		interval = time.Duration(bw.Config.Router.InfoInterval) * time.Second
+	}
+	cl := bw.CreateClient(context.Background(), "ROUTERINFO")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("router info: could not use router entity: %v", err)
+		return
+	}
+	for {
+		bw.persistRouterInfo(cl)
+		time.Sleep(interval)
+	}
+}
+
+func (bw *BW) persistRouterInfo(cl *BosswaveClient) {
+	nsvks := [][]byte{}
+	for _, nsvk := range bw.replicaNamespaces() {
+		if ok, err := bw.IsDesignatedRouterFor(nsvk); err == nil && ok {
+			nsvks = append(nsvks, nsvk)
+		}
+	}
+	if len(nsvks) == 0 {
+		return
+	}
+	affinity := make([]string, len(nsvks))
+	for i, nsvk := range nsvks {
+		affinity[i] = crypto.FmtKey(nsvk)
+	}
+	peercount, _, current, highest := bw.BC().SyncProgress()
+	subs := bw.tm.Subscriptions()
+	common := map[string]interface{}{
+		"info": &RouterInfo{
+			VK:      crypto.FmtKey(bw.Entity.GetVK()),
+			Version: util.BW2Version,
+			Updated: time.Now().UnixNano(),
+		},
+		"chain":     &RouterChainInfo{Height: current, Highest: highest, Peers: peercount},
+		"peers":     bw.routerPeers(),
+		"peerlinks": bw.routerPeerLinks(),
+		"caches":    bw.routerCaches(),
+		"affinity":  affinity,
+		"drivers":   bw.DriverStatuses(),
+	}
+	for _, nsvk := range nsvks {
+		prefix := crypto.FmtKey(nsvk) + "/"
+		nssubs := []RouterSubscriptionInfo{}
+		for _, s := range subs {
+			if strings.HasPrefix(s.URI, prefix) {
+				nssubs = append(nssubs, RouterSubscriptionInfo{
+					URI:     s.URI,
+					Client:  s.Client,
+					Tap:     s.Tap,
+					Created: s.Created.UnixNano(),
+				})
+			}
+		}
+		u := bw.tm.Usage(crypto.FmtKey(nsvk))
+		q, _ := bw.namespaceQuota(nsvk)
+		usage := &RouterUsageInfo{
+			Messages:          u.Messages,
+			Bytes:             u.Bytes,
+			WindowStart:       u.WindowStart.UnixNano(),
+			WindowMessages:    u.WindowMessages,
+			WindowBytes:       u.WindowBytes,
+			Persisted:         u.Persisted,
+			MessagesPerHour:   q.MessagesPerHour,
+			BytesPerHour:      q.BytesPerHour,
+			MaxPersistedBytes: q.MaxPersistedBytes,
+		}
+		for name, v := range common {
+			bw.persistRouterValue(cl, nsvk, name, v)
+		}
+		bw.persistRouterValue(cl, nsvk, "subscriptions", nssubs)
+		bw.persistRouterValue(cl, nsvk, "usage", usage)
+	}
+}
+
+func (bw *BW) routerPeers() []RouterPeerInfo {
+	peers := []RouterPeerInfo{}
+	for _, name := range bw.tm.Clients() {
+		if strings.HasPrefix(name, "PEER:") {
+			peers = append(peers, RouterPeerInfo{Address: strings.TrimPrefix(name, "PEER:")})
+		}
+	}
+	return peers
+}
+
+func (bw *BW) routerPeerLinks() []RouterPeerLinkInfo {
+	links := []RouterPeerLinkInfo{}
+	for _, ps := range bw.PeerStats() {
+		links = append(links, RouterPeerLinkInfo{
+			Address:           ps.Target,
+			VK:                crypto.FmtKey(ps.VK),
+			Connected:         ps.Connected,
+			BytesOut:          ps.BytesOut,
+			BytesIn:           ps.BytesIn,
+			FramesOut:         ps.FramesOut,
+			FramesIn:          ps.FramesIn,
+			Reconnects:        ps.Reconnects,
+			Outstanding:       ps.Outstanding,
+			OldestOutstanding: int64(ps.OldestOutstanding),
+			RTT:               int64(ps.RTT),
+		})
+	}
+	return links
+}
+
+func (bw *BW) routerCaches() map[string]RouterCacheInfo {
+	st := bw.ResolutionCacheStats()
+	caches := make(map[string]RouterCacheInfo)
+	for name, cs := range map[string]CacheStats{"entity": st.Entities, "dot": st.DOTs, "chain": st.Chains} {
+		caches[name] = RouterCacheInfo(cs)
+	}
+	return caches
+}
+
+//RouterTrafficInfo is what the router has handled on a namespace or topic
+//since it started
+type RouterTrafficInfo struct {
+	URI      string `msgpack:"uri"`
+	Messages uint64 `msgpack:"messages"`
+	Bytes    uint64 `msgpack:"bytes"`
+}
+
+//RouterStats is a snapshot of the router's state and counters, as shown by
+//bw2 top. The counters are totals, so rates are the difference between two
+//snapshots divided by the difference in Time
+type RouterStats struct {
+	//In nanoseconds since the epoch
+	Time          int64                      `msgpack:"time"`
+	Info          RouterInfo                 `msgpack:"info"`
+	Chain         RouterChainInfo            `msgpack:"chain"`
+	Clients       int                        `msgpack:"clients"`
+	Subscriptions int                        `msgpack:"subscriptions"`
+	Peers         []RouterPeerInfo           `msgpack:"peers"`
+	PeerLinks     []RouterPeerLinkInfo       `msgpack:"peerlinks"`
+	Caches        map[string]RouterCacheInfo `msgpack:"caches"`
+	//Every namespace with traffic, and the topics with the most messages
+	Namespaces []RouterTrafficInfo `msgpack:"namespaces"`
+	Topics     []RouterTrafficInfo `msgpack:"topics"`
+}
+
+//Stats returns a snapshot of the router, with up to topics of its busiest
+//topics
+func (bw *BW) Stats(topics int) *RouterStats {
+	peercount, _, current, highest := bw.BC().SyncProgress()
+	now := time.Now().UnixNano()
+	rv := &RouterStats{
+		Time: now,
+		Info: RouterInfo{
+			VK:      crypto.FmtKey(bw.Entity.GetVK()),
+			Version: util.BW2Version,
+			Updated: now,
+		},
+		Chain:         RouterChainInfo{Height: current, Highest: highest, Peers: peercount},
+		Clients:       len(bw.Clients()),
+		Subscriptions: len(bw.tm.Subscriptions()),
+		Peers:         bw.routerPeers(),
+		PeerLinks:     bw.routerPeerLinks(),
+		Caches:        bw.routerCaches(),
+		Namespaces:    []RouterTrafficInfo{},
+		Topics:        []RouterTrafficInfo{},
+	}
+	for _, u := range bw.tm.AllUsage() {
+		rv.Namespaces = append(rv.Namespaces, RouterTrafficInfo{URI: u.Namespace, Messages: u.Messages, Bytes: u.Bytes})
+	}
+	for _, u := range bw.tm.TopUsage(topics) {
+		rv.Topics = append(rv.Topics, RouterTrafficInfo{URI: u.Topic, Messages: u.Messages, Bytes: u.Bytes})
+	}
+	return rv
+}
+
+func (bw *BW) persistRouterValue(cl *BosswaveClient, nsvk []byte, name string, v interface{}) {
+	blob, err := msgpack.Marshal(v)
+	if err != nil {
+		log.Errorf("router info: could not encode %s: %v", name, err)
+		return
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	suffix := RouterInfoURIPrefix + "/" + name
+	cl.Publish(&PublishParams{
+		MVK:            nsvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+		Persist:        true,
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("router info: could not persist %s: %v", suffix, err)
+		}
+	})
+}
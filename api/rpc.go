@@ -0,0 +1,190 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//CorrelationKey is the key in the msgpack map of a call and its reply
+//that holds the correlation ID. A service answering calls copies it from
+//the request on the slot to its reply on the signal
+const CorrelationKey = "corrid"
+
+//DefaultCallTimeout is how long each attempt of a call waits for the
+//reply if CallParams does not say
+const DefaultCallTimeout = 10 * time.Second
+
+type CallParams struct {
+	//The fully qualified URI of the interface, ending in i.<name>
+	InterfaceURI string
+	//The slot the request is published on, and the signal the reply comes
+	//on. ReplySignal defaults to the slot's name
+	Slot        string
+	ReplySignal string
+	//The request. It is sent as a msgpack map with CorrelationKey added
+	Request map[string]interface{}
+	//How long each attempt waits for the reply, and how many times the
+	//request is published again, with the same ID, if it does not come
+	Timeout time.Duration
+	Retries int
+	//Chains are always built automatically, this is the elaboration level
+	ElaboratePAC int
+}
+
+//NewCorrelationID makes a random correlation ID for a call
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//CorrelationID finds the correlation ID in the msgpack payload of a call
+//or its reply
+func CorrelationID(m *core.Message) (string, bool) {
+	for _, po := range m.PayloadObjects {
+		if po.GetPONum() != objects.PONumMsgPack {
+			continue
+		}
+		var body map[string]interface{}
+		if msgpack.Unmarshal(po.GetContent(), &body) != nil {
+			continue
+		}
+		switch id := body[CorrelationKey].(type) {
+		case string:
+			return id, true
+		case []byte:
+			return string(id), true
+		}
+	}
+	return "", false
+}
+
+//Call publishes a request on a slot of an interface and calls cb with the
+//reply on its signal that has the same correlation ID. The subscription
+//for the reply carries a filter on the ID, so the designated router only
+//sends the reply. If there is no reply in time the request is published
+//again, up to Retries times, after which cb gets a CallTimeout error
+func (c *BosswaveClient) Call(p *CallParams, cb func(reply *core.Message, err error)) {
+	if !strings.Contains(p.InterfaceURI, "/i.") || p.Slot == "" {
+		cb(nil, bwe.M(bwe.BadURI, "a call needs an interface URI and a slot"))
+		return
+	}
+	signal := p.ReplySignal
+	if signal == "" {
+		signal = p.Slot
+	}
+	ns, suffix, err := util.SplitURI(strings.TrimSuffix(p.InterfaceURI, "/"))
+	var slotSuffix, signalSuffix string
+	if err == nil {
+		slotSuffix, err = util.JoinSuffix(suffix, "slot", p.Slot)
+	}
+	if err == nil {
+		signalSuffix, err = util.JoinSuffix(suffix, "signal", signal)
+	}
+	if err != nil {
+		cb(nil, bwe.WrapC(bwe.BadURI, err))
+		return
+	}
+	mvk, err := c.BW().ResolveKey(ns)
+	if err != nil {
+		cb(nil, bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err))
+		return
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCallTimeout
+	}
+	id := NewCorrelationID()
+	req := make(map[string]interface{}, len(p.Request)+1)
+	for k, v := range p.Request {
+		req[k] = v
+	}
+	req[CorrelationKey] = id
+	blob, err := msgpack.Marshal(req)
+	if err != nil {
+		cb(nil, bwe.WrapM(bwe.InvalidPayload, "Could not encode the request", err))
+		return
+	}
+	reqPO, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	idValue, _ := msgpack.Marshal(id)
+	filter, err := objects.CreateSubscriptionFilter(nil, 0, 0, []objects.FieldMatch{{Field: CorrelationKey, Value: idValue}})
+	if err != nil {
+		cb(nil, err)
+		return
+	}
+
+	var once sync.Once
+	replies := make(chan *core.Message, 1)
+	var subid core.UniqueMessageID
+	finish := func(reply *core.Message, err error) {
+		once.Do(func() {
+			if subid != (core.UniqueMessageID{}) {
+				c.Unsubscribe(subid, func(error) {})
+			}
+			cb(reply, err)
+		})
+	}
+	c.Subscribe(&SubscribeParams{
+		MVK:          mvk,
+		URISuffix:    signalSuffix,
+		AutoChain:    true,
+		ElaboratePAC: p.ElaboratePAC,
+		Filter:       filter,
+	}, func(err error, sid core.UniqueMessageID) {
+		if err != nil {
+			finish(nil, err)
+			return
+		}
+		subid = sid
+		go func() {
+			for attempt := 0; attempt <= p.Retries; attempt++ {
+				perr := make(chan error, 1)
+				c.Publish(&PublishParams{
+					MVK:            mvk,
+					URISuffix:      slotSuffix,
+					AutoChain:      true,
+					ElaboratePAC:   p.ElaboratePAC,
+					PayloadObjects: []objects.PayloadObject{reqPO},
+				}, func(err error) {
+					perr <- err
+				})
+				if err := <-perr; err != nil {
+					finish(nil, err)
+					return
+				}
+				select {
+				case m := <-replies:
+					finish(m, nil)
+					return
+				case <-c.ctx.Done():
+					finish(nil, bwe.M(bwe.ShuttingDown, "the client was destroyed during the call"))
+					return
+				case <-time.After(timeout):
+				}
+			}
+			finish(nil, bwe.M(bwe.CallTimeout, fmt.Sprintf("no reply on signal/%s after %d attempts", signal, p.Retries+1)))
+		}()
+	}, func(m *core.Message) {
+		if m == nil {
+			return
+		}
+		//The filter is checked here too, as a router that does not know
+		//it delivers everything
+		if rid, ok := CorrelationID(m); ok && rid == id {
+			select {
+			case replies <- m:
+			default:
+			}
+		}
+	})
+}
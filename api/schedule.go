@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//schedulesFile holds the scheduled publishes, under [router] DB, so that
+//they survive a restart. It has the signing keys of their entities, so it
+//is only readable by the router's user
+const schedulesFile = "schedules.json"
+
+//How often the schedules are checked for publishes that are due
+const scheduleCheck = time.Second
+
+//ScheduleParams describes a recurring publish
+type ScheduleParams struct {
+	//When to publish, as parsed by util.ParseCron
+	Cron      string
+	MVK       []byte
+	URISuffix string
+	PONum     int
+	//The payload, in which {time} is replaced by the time of the publish
+	//in RFC3339, {unix} by it in seconds and {seq} by how many times the
+	//schedule has published before
+	Template string
+	Persist  bool
+}
+
+//ScheduledPublish is a recurring publish made by an entity
+type ScheduledPublish struct {
+	ID        string
+	Cron      string
+	URI       string
+	PONum     int
+	Template  string
+	Persist   bool
+	Owner     string
+	Created   time.Time
+	Next      time.Time
+	Runs      uint64
+	LastError string
+}
+
+//scheduleEntry is a ScheduledPublish as it is saved
+type scheduleEntry struct {
+	ScheduledPublish
+	//The signing blob of the owner's entity
+	Entity []byte
+
+	cron *util.CronSchedule
+}
+
+type schedules struct {
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+	//A client for each owner, by VK
+	clients map[string]*BosswaveClient
+}
+
+func (bw *BW) schedulesPath() string {
+	return path.Join(bw.Config.Router.DB, schedulesFile)
+}
+
+//saveSchedules writes the schedules. The lock is held
+func (bw *BW) saveSchedules() error {
+	entries := make([]*scheduleEntry, 0, len(bw.schedules.entries))
+	for _, e := range bw.schedules.entries {
+		entries = append(entries, e)
+	}
+	contents, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bw.schedulesPath(), contents, 0600)
+}
+
+//expandPayload fills in the payload template for a publish at t
+func expandPayload(tmpl string, t time.Time, seq uint64) string {
+	return strings.NewReplacer(
+		"{time}", t.Format(time.RFC3339),
+		"{unix}", strconv.FormatInt(t.Unix(), 10),
+		"{seq}", strconv.FormatUint(seq, 10),
+	).Replace(tmpl)
+}
+
+//AddSchedule has the router publish as the client's entity on the given
+//schedule until it is cancelled. The entity's signing key is kept with the
+//schedule so that it can go on after the router restarts
+func (c *BosswaveClient) AddSchedule(p *ScheduleParams) (*ScheduledPublish, error) {
+	if c.GetUs() == nil {
+		return nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	cron, err := util.ParseCron(p.Cron)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BadOperation, "bad schedule", err)
+	}
+	star, plus, _, uerr := util.AnalyzeSuffixDetailed(p.URISuffix)
+	if uerr != nil {
+		return nil, bwe.WrapC(bwe.BadURI, uerr)
+	}
+	if len(p.MVK) != 32 || star || plus {
+		return nil, bwe.M(bwe.BadURI, "a scheduled publish needs a URI without wildcards")
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	now := time.Now()
+	e := &scheduleEntry{
+		ScheduledPublish: ScheduledPublish{
+			ID:       hex.EncodeToString(id),
+			Cron:     p.Cron,
+			URI:      util.FullURI(p.MVK, p.URISuffix),
+			PONum:    p.PONum,
+			Template: p.Template,
+			Persist:  p.Persist,
+			Owner:    crypto.FmtKey(c.GetUs().GetVK()),
+			Created:  now,
+			Next:     cron.Next(now),
+		},
+		Entity: c.GetUs().GetSigningBlob(),
+		cron:   cron,
+	}
+	if e.Next.IsZero() {
+		return nil, bwe.M(bwe.BadOperation, "the schedule never fires")
+	}
+	bw := c.BW()
+	bw.schedules.mu.Lock()
+	defer bw.schedules.mu.Unlock()
+	bw.schedules.entries[e.ID] = e
+	if err := bw.saveSchedules(); err != nil {
+		delete(bw.schedules.entries, e.ID)
+		return nil, bwe.WrapM(bwe.BadOperation, "could not save the schedule", err)
+	}
+	rv := e.ScheduledPublish
+	return &rv, nil
+}
+
+//ListSchedules returns the schedules of the client's entity, or every
+//schedule if it is the router entity, ordered by when they next publish
+func (c *BosswaveClient) ListSchedules() ([]*ScheduledPublish, error) {
+	if c.GetUs() == nil {
+		return nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	us := crypto.FmtKey(c.GetUs().GetVK())
+	all := us == crypto.FmtKey(c.BW().Entity.GetVK())
+	bw := c.BW()
+	bw.schedules.mu.Lock()
+	defer bw.schedules.mu.Unlock()
+	rv := []*ScheduledPublish{}
+	for _, e := range bw.schedules.entries {
+		if all || e.Owner == us {
+			sp := e.ScheduledPublish
+			rv = append(rv, &sp)
+		}
+	}
+	for i := 1; i < len(rv); i++ {
+		for j := i; j > 0 && rv[j].Next.Before(rv[j-1].Next); j-- {
+			rv[j], rv[j-1] = rv[j-1], rv[j]
+		}
+	}
+	return rv, nil
+}
+
+//CancelSchedule stops a schedule of the client's entity. The router entity
+//may cancel any schedule
+func (c *BosswaveClient) CancelSchedule(id string) error {
+	if c.GetUs() == nil {
+		return bwe.M(bwe.NoEntity, "No entity set")
+	}
+	bw := c.BW()
+	us := crypto.FmtKey(c.GetUs().GetVK())
+	bw.schedules.mu.Lock()
+	defer bw.schedules.mu.Unlock()
+	e, ok := bw.schedules.entries[id]
+	if !ok || (e.Owner != us && us != crypto.FmtKey(bw.Entity.GetVK())) {
+		return bwe.M(bwe.BadOperation, "no schedule "+id)
+	}
+	delete(bw.schedules.entries, id)
+	return bw.saveSchedules()
+}
+
+//runSchedules loads the schedules saved before the router last stopped,
+//and publishes each one when it is due. A publish that was missed while
+//the router was down is not made up
+func (bw *BW) runSchedules() {
+	contents, err := ioutil.ReadFile(bw.schedulesPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("could not read the scheduled publishes: %v", err)
+	}
+	now := time.Now()
+	bw.schedules.mu.Lock()
+	if len(contents) != 0 {
+		loaded := []*scheduleEntry{}
+		if err := json.Unmarshal(contents, &loaded); err != nil {
+			log.Warnf("bad scheduled publishes: %v", err)
+		}
+		for _, e := range loaded {
+			if e.cron, err = util.ParseCron(e.Cron); err != nil {
+				log.Warnf("dropping schedule %s: %v", e.ID, err)
+				continue
+			}
+			if e.Next.Before(now) {
+				e.Next = e.cron.Next(now)
+			}
+			bw.schedules.entries[e.ID] = e
+		}
+	}
+	bw.schedules.mu.Unlock()
+	for {
+		time.Sleep(scheduleCheck)
+		bw.publishDueSchedules()
+	}
+}
+
+//publishDueSchedules publishes the entries that are due, and saves the
+//schedules if any were
+func (bw *BW) publishDueSchedules() {
+	now := time.Now()
+	bw.schedules.mu.Lock()
+	defer bw.schedules.mu.Unlock()
+	ran := false
+	for _, e := range bw.schedules.entries {
+		if e.Next.IsZero() || e.Next.After(now) {
+			continue
+		}
+		ran = true
+		at := e.Next
+		e.Next = e.cron.Next(now)
+		cl, err := bw.scheduleClient(e)
+		if err == nil {
+			err = bw.publishScheduled(cl, e, at)
+		}
+		e.Runs++
+		e.LastError = ""
+		if err != nil {
+			e.LastError = err.Error()
+			log.Infof("scheduled publish %s on %s failed: %v", e.ID, e.URI, err)
+		}
+	}
+	if !ran {
+		return
+	}
+	if err := bw.saveSchedules(); err != nil {
+		log.Warnf("could not save the scheduled publishes: %v", err)
+	}
+}
+
+//scheduleClient returns the client that publishes as the owner of e. The
+//lock is held
+func (bw *BW) scheduleClient(e *scheduleEntry) (*BosswaveClient, error) {
+	if cl, ok := bw.schedules.clients[e.Owner]; ok {
+		return cl, nil
+	}
+	ro, err := objects.NewEntity(objects.ROEntityWKey, e.Entity)
+	if err != nil {
+		return nil, err
+	}
+	cl := bw.CreateClient(context.Background(), "SCHEDULE:"+e.Owner)
+	if err := cl.SetEntityObj(ro.(*objects.Entity)); err != nil {
+		cl.ctxCancel()
+		return nil, err
+	}
+	bw.schedules.clients[e.Owner] = cl
+	return cl, nil
+}
+
+//publishScheduled starts a publish for e. The publish, which may build a
+//chain, goes on without the lock, and records its own error if it fails
+func (bw *BW) publishScheduled(cl *BosswaveClient, e *scheduleEntry, at time.Time) error {
+	mvk, suffix, err := util.ParseFullURI(e.URI)
+	if err != nil {
+		return err
+	}
+	po, err := objects.CreateOpaquePayloadObject(e.PONum, []byte(expandPayload(e.Template, at, e.Runs)))
+	if err != nil {
+		return err
+	}
+	id, uri := e.ID, e.URI
+	go cl.Publish(&PublishParams{
+		MVK:            mvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+		ElaboratePAC:   PartialElaboration,
+		Persist:        e.Persist,
+		AutoChain:      true,
+	}, func(err error) {
+		if err == nil {
+			return
+		}
+		log.Infof("scheduled publish %s on %s failed: %v", id, uri, err)
+		bw.schedules.mu.Lock()
+		if e, ok := bw.schedules.entries[id]; ok {
+			e.LastError = err.Error()
+		}
+		bw.schedules.mu.Unlock()
+	})
+	return nil
+}
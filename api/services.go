@@ -0,0 +1,337 @@
+package api
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//The health of a service or interface, from how long ago its lastalive
+//metadata was set
+const (
+	HealthAlive = "alive"
+	HealthStale = "stale"
+	HealthGone  = "gone"
+)
+
+const (
+	//DefaultStaleAfter is how old lastalive may be before an interface is
+	//stale, if ServiceRegistryParams does not say. It allows two missed
+	//heartbeats
+	DefaultStaleAfter = 3 * DefaultHeartbeatInterval
+	//DefaultGoneAfter is how old lastalive may be before an interface is
+	//gone, if ServiceRegistryParams does not say
+	DefaultGoneAfter = 30 * DefaultHeartbeatInterval
+)
+
+type ServiceRegistryParams struct {
+	//The namespaces to find services in
+	Namespaces []string
+	//How old lastalive may be before an interface is stale or gone. Zero
+	//means the defaults
+	StaleAfter time.Duration
+	GoneAfter  time.Duration
+}
+
+//ServiceInterface is an interface of a service in the inventory
+type ServiceInterface struct {
+	URI       string `msgpack:"uri"`
+	Interface string `msgpack:"iface"`
+	Health    string `msgpack:"health"`
+	//When lastalive was set, in nanoseconds since the epoch, or zero if it
+	//never was
+	LastAlive int64 `msgpack:"lastalive"`
+}
+
+//ServiceInstance is a service in the inventory. It is alive if all its
+//interfaces are, gone if all of them are, and otherwise stale
+type ServiceInstance struct {
+	URI        string             `msgpack:"uri"`
+	Service    string             `msgpack:"svc"`
+	Namespace  string             `msgpack:"namespace"`
+	Health     string             `msgpack:"health"`
+	LastAlive  int64              `msgpack:"lastalive"`
+	Interfaces []ServiceInterface `msgpack:"interfaces"`
+}
+
+//ServiceCounts are how many instances of a service are in each state
+type ServiceCounts struct {
+	Alive int `msgpack:"alive"`
+	Stale int `msgpack:"stale"`
+	Gone  int `msgpack:"gone"`
+}
+
+//ServiceInventory is the services in some namespaces at one time, ordered
+//by URI, and the counts of each service by health
+type ServiceInventory struct {
+	Taken    int64                     `msgpack:"taken"`
+	Services []ServiceInstance         `msgpack:"services"`
+	Counts   map[string]*ServiceCounts `msgpack:"counts"`
+}
+
+//ServiceChange is a service that appeared, disappeared or changed health.
+//A service that appeared has no old health, and one whose metadata is gone
+//has no new health
+type ServiceChange struct {
+	URI     string `msgpack:"uri"`
+	Service string `msgpack:"svc"`
+	Old     string `msgpack:"old"`
+	New     string `msgpack:"new"`
+}
+
+//ServiceRegistry keeps a live inventory of the services in some
+//namespaces, built on a view of them
+type ServiceRegistry struct {
+	v *View
+	p ServiceRegistryParams
+	//Refreshes are serialised so that an older inventory never replaces
+	//a newer one
+	refreshmu sync.Mutex
+	mu        sync.Mutex
+	inv       *ServiceInventory
+	cbs       []func([]ServiceChange)
+	stop      chan struct{}
+	closed    bool
+}
+
+//NewServiceRegistry makes a view of the namespaces and calls onready with
+//a registry of the services in them once the view has loaded
+func (c *BosswaveClient) NewServiceRegistry(p *ServiceRegistryParams, onready func(*ServiceRegistry, error)) {
+	if len(p.Namespaces) == 0 {
+		onready(nil, bwe.M(bwe.BadOperation, "a service registry needs at least one namespace"))
+		return
+	}
+	rp := *p
+	if rp.StaleAfter <= 0 {
+		rp.StaleAfter = DefaultStaleAfter
+	}
+	if rp.GoneAfter <= 0 {
+		rp.GoneAfter = DefaultGoneAfter
+	}
+	if rp.GoneAfter < rp.StaleAfter {
+		onready(nil, bwe.M(bwe.BadOperation, "services cannot be gone before they are stale"))
+		return
+	}
+	c.NewView(func(err error, vid int) {
+		if err != nil {
+			onready(nil, bwe.WrapM(bwe.BadView, "Could not create view", err))
+			return
+		}
+		r := &ServiceRegistry{v: c.LookupView(vid), p: rp, stop: make(chan struct{})}
+		r.refresh()
+		r.v.OnChange(r.refresh)
+		go r.ageLoop()
+		onready(r, nil)
+	}, Namespace(rp.Namespaces...))
+}
+
+//Inventory returns the current inventory
+func (r *ServiceRegistry) Inventory() *ServiceInventory {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.inv
+}
+
+//OnChange calls f with the services that appeared, disappeared or changed
+//health each time any do
+func (r *ServiceRegistry) OnChange(f func([]ServiceChange)) {
+	r.mu.Lock()
+	r.cbs = append(r.cbs, f)
+	r.mu.Unlock()
+}
+
+//TearDown stops the registry and tears down its view
+func (r *ServiceRegistry) TearDown() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.stop)
+	r.cbs = nil
+	r.mu.Unlock()
+	r.v.TearDown()
+}
+
+//ageLoop refreshes the inventory as lastalive ages, which changes health
+//without the view changing
+func (r *ServiceRegistry) ageLoop() {
+	interval := r.p.StaleAfter / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.v.c.ctx.Done():
+			return
+		case <-time.After(interval):
+			r.refresh()
+		}
+	}
+}
+
+func (r *ServiceRegistry) refresh() {
+	r.refreshmu.Lock()
+	defer r.refreshmu.Unlock()
+	inv := serviceInventory(r.v, time.Now(), &r.p)
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	changes := diffInventories(r.inv, inv)
+	r.inv = inv
+	cbs := r.cbs
+	r.mu.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+	for _, cb := range cbs {
+		cb(changes)
+	}
+}
+
+//healthAt is the health of something whose lastalive was set at la, zero
+//if it never was
+func healthAt(la int64, now time.Time, p *ServiceRegistryParams) string {
+	if la == 0 {
+		return HealthGone
+	}
+	age := now.Sub(time.Unix(0, la))
+	switch {
+	case age < p.StaleAfter:
+		return HealthAlive
+	case age < p.GoneAfter:
+		return HealthStale
+	}
+	return HealthGone
+}
+
+//serviceInventory groups the interfaces in the view's metadata by service.
+//Unlike View.Interfaces, interfaces without lastalive are included as gone
+func serviceInventory(v *View, now time.Time, p *ServiceRegistryParams) *ServiceInventory {
+	v.msmu.RLock()
+	uris := make([]string, 0, len(v.metastore))
+	for uri := range v.metastore {
+		uris = append(uris, uri)
+	}
+	v.msmu.RUnlock()
+	svcs := make(map[string]*ServiceInstance)
+	seen := make(map[string]bool)
+	for _, uri := range uris {
+		groups := interfaceURIRe.FindStringSubmatch(uri)
+		if groups == nil || seen[groups[1]] {
+			continue
+		}
+		seen[groups[1]] = true
+		ifuri := groups[1]
+		svcuri := strings.TrimSuffix(ifuri, "/"+groups[5]+"/"+groups[6])
+		si, ok := svcs[svcuri]
+		if !ok {
+			si = &ServiceInstance{URI: svcuri, Service: groups[4], Namespace: groups[2]}
+			svcs[svcuri] = si
+		}
+		var la int64
+		if t, ok := v.AllMeta(ifuri)["lastalive"]; ok {
+			la = t.Timestamp
+		}
+		si.Interfaces = append(si.Interfaces, ServiceInterface{
+			URI:       ifuri,
+			Interface: groups[6],
+			Health:    healthAt(la, now, p),
+			LastAlive: la,
+		})
+		if la > si.LastAlive {
+			si.LastAlive = la
+		}
+	}
+	rv := &ServiceInventory{
+		Taken:    now.UnixNano(),
+		Services: make([]ServiceInstance, 0, len(svcs)),
+		Counts:   make(map[string]*ServiceCounts),
+	}
+	for _, si := range svcs {
+		sort.Sort(serviceInterfaceSorter(si.Interfaces))
+		alive, gone := 0, 0
+		for _, i := range si.Interfaces {
+			switch i.Health {
+			case HealthAlive:
+				alive++
+			case HealthGone:
+				gone++
+			}
+		}
+		counts, ok := rv.Counts[si.Service]
+		if !ok {
+			counts = &ServiceCounts{}
+			rv.Counts[si.Service] = counts
+		}
+		switch len(si.Interfaces) {
+		case alive:
+			si.Health = HealthAlive
+			counts.Alive++
+		case gone:
+			si.Health = HealthGone
+			counts.Gone++
+		default:
+			si.Health = HealthStale
+			counts.Stale++
+		}
+		rv.Services = append(rv.Services, *si)
+	}
+	sort.Sort(serviceInstanceSorter(rv.Services))
+	return rv
+}
+
+//diffInventories lists the services whose health differs between two
+//inventories, in URI order. Old may be nil
+func diffInventories(old, nw *ServiceInventory) []ServiceChange {
+	prev := make(map[string]*ServiceInstance)
+	if old != nil {
+		for i := range old.Services {
+			prev[old.Services[i].URI] = &old.Services[i]
+		}
+	}
+	var rv []ServiceChange
+	for _, s := range nw.Services {
+		o, ok := prev[s.URI]
+		delete(prev, s.URI)
+		if ok && o.Health == s.Health {
+			continue
+		}
+		c := ServiceChange{URI: s.URI, Service: s.Service, New: s.Health}
+		if ok {
+			c.Old = o.Health
+		}
+		rv = append(rv, c)
+	}
+	for _, o := range prev {
+		rv = append(rv, ServiceChange{URI: o.URI, Service: o.Service, Old: o.Health})
+	}
+	sort.Sort(serviceChangeSorter(rv))
+	return rv
+}
+
+type serviceInstanceSorter []ServiceInstance
+
+func (s serviceInstanceSorter) Len() int           { return len(s) }
+func (s serviceInstanceSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s serviceInstanceSorter) Less(i, j int) bool { return s[i].URI < s[j].URI }
+
+type serviceInterfaceSorter []ServiceInterface
+
+func (s serviceInterfaceSorter) Len() int           { return len(s) }
+func (s serviceInterfaceSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s serviceInterfaceSorter) Less(i, j int) bool { return s[i].URI < s[j].URI }
+
+type serviceChangeSorter []ServiceChange
+
+func (s serviceChangeSorter) Len() int           { return len(s) }
+func (s serviceChangeSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s serviceChangeSorter) Less(i, j int) bool { return s[i].URI < s[j].URI }
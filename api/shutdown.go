@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//DrainTimeout is how long Stop waits for publishes that are in progress,
+//and then for peers to be sent the end of their subscriptions
+var DrainTimeout = 10 * time.Second
+
+//The resolution cache is saved here, under [router] DB, when the router
+//stops
+const cacheCheckpointFile = "resolution.checkpoint"
+
+//lifecycle tracks whether the router is taking new work
+type lifecycle struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	draining bool
+	stopped  bool
+	//Publishes and peer frames being processed
+	inflight int
+	//Peer sessions that have not closed their connection
+	sessions  int
+	listeners []net.Listener
+}
+
+func newLifecycle() *lifecycle {
+	rv := &lifecycle{}
+	rv.cond = sync.NewCond(&rv.mu)
+	return rv
+}
+
+var errDraining = bwe.M(bwe.ShuttingDown, "the router is shutting down")
+
+//beginWork refuses new work once the router is draining. Otherwise the
+//work must be ended with endWork, and Stop waits for it
+func (bw *BW) beginWork() error {
+	bw.life.mu.Lock()
+	defer bw.life.mu.Unlock()
+	if bw.life.draining {
+		return errDraining
+	}
+	bw.life.inflight++
+	return nil
+}
+
+func (bw *BW) endWork() {
+	bw.life.mu.Lock()
+	bw.life.inflight--
+	bw.life.cond.Broadcast()
+	bw.life.mu.Unlock()
+}
+
+//checkAccepting refuses new subscriptions once the router is draining
+func (bw *BW) checkAccepting() error {
+	if bw.Draining() {
+		return errDraining
+	}
+	return nil
+}
+
+//addListener records a listener to close when the router stops
+func (bw *BW) addListener(ln net.Listener) {
+	bw.life.mu.Lock()
+	bw.life.listeners = append(bw.life.listeners, ln)
+	bw.life.mu.Unlock()
+}
+
+//Drain stops the router taking new work. New subscriptions, publishes and
+//peer connections are refused with ShuttingDown, but existing
+//subscriptions still get messages published before the drain
+func (bw *BW) Drain() {
+	bw.life.mu.Lock()
+	if !bw.life.draining {
+		log.Info("router draining")
+	}
+	bw.life.draining = true
+	bw.life.mu.Unlock()
+}
+
+//Draining is true once Drain or Stop has been called
+func (bw *BW) Draining() bool {
+	bw.life.mu.Lock()
+	defer bw.life.mu.Unlock()
+	return bw.life.draining
+}
+
+//waitInflight waits until no work is in progress or the timeout passes
+func (bw *BW) waitInflight(timeout time.Duration) bool {
+	t := time.AfterFunc(timeout, func() {
+		bw.life.mu.Lock()
+		bw.life.cond.Broadcast()
+		bw.life.mu.Unlock()
+	})
+	defer t.Stop()
+	deadline := time.Now().Add(timeout)
+	bw.life.mu.Lock()
+	defer bw.life.mu.Unlock()
+	for bw.life.inflight > 0 && time.Now().Before(deadline) {
+		bw.life.cond.Wait()
+	}
+	return bw.life.inflight == 0
+}
+
+//Stop shuts the router down gracefully. It drains, waits for publishes
+//and persists in progress, ends every client's subscriptions (peers are
+//sent end frames before they are disconnected), closes the listeners,
+//saves the resolution cache and closes the store. Finally the chain is
+//shut down, which closes the channel returned by NewBWContext. The router
+//cannot be used afterwards
+func (bw *BW) Stop() {
+	bw.life.mu.Lock()
+	if bw.life.stopped {
+		bw.life.mu.Unlock()
+		return
+	}
+	bw.life.stopped = true
+	bw.life.mu.Unlock()
+	bw.Drain()
+	if !bw.waitInflight(DrainTimeout) {
+		log.Warnf("stopping with publishes still in progress")
+	}
+
+	//Services are stopped while their clients can still publish
+	bw.stopDrivers(DrainTimeout)
+
+	bw.clients.mu.Lock()
+	cls := make([]*BosswaveClient, 0, len(bw.clients.clients))
+	for _, c := range bw.clients.clients {
+		cls = append(cls, c)
+	}
+	bw.clients.mu.Unlock()
+	for _, c := range cls {
+		c.ctxCancel()
+	}
+	//Peer sessions close their connection once their end frames are sent
+	deadline := time.Now().Add(DrainTimeout)
+	for time.Now().Before(deadline) && bw.openSessions() > 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	bw.life.mu.Lock()
+	for _, ln := range bw.life.listeners {
+		ln.Close()
+	}
+	bw.life.mu.Unlock()
+	bw.local.mu.Lock()
+	if bw.local.adv != nil {
+		bw.local.adv.Close()
+	}
+	bw.local.mu.Unlock()
+	//A standby stops following before the store is closed
+	bw.standby.mu.Lock()
+	if bw.standby.conn != nil {
+		bw.standby.conn.Close()
+	}
+	bw.standby.mu.Unlock()
+
+	if err := bw.checkpointCaches(); err != nil {
+		log.Warnf("could not save the resolution cache: %v", err)
+	}
+	if s := store.Default(); s != nil {
+		if err := s.Close(); err != nil {
+			log.Warnf("could not close the store: %v", err)
+		}
+	}
+	log.Info("router stopped, shutting down the chain")
+	log.Flush()
+	bw.bchain.Shutdown()
+}
+
+//addSession counts a peer session until its connection closes, so that
+//Stop can wait for the end of its subscriptions to be sent
+func (bw *BW) addSession(delta int) {
+	bw.life.mu.Lock()
+	bw.life.sessions += delta
+	bw.life.mu.Unlock()
+}
+
+func (bw *BW) openSessions() int {
+	bw.life.mu.Lock()
+	defer bw.life.mu.Unlock()
+	return bw.life.sessions
+}
+
+//cacheCheckpoint is the valid part of the resolution cache, saved when
+//the router stops so that it can resolve them again before the chain has
+//caught up on the next start. Objects are in their wire form
+type cacheCheckpoint struct {
+	Saved    time.Time
+	Block    uint64
+	Entities [][]byte
+	DOTs     [][]byte
+	Aliases  []SnapshotAlias
+}
+
+func (bw *BW) checkpointPath() string {
+	return path.Join(bw.Config.Router.DB, cacheCheckpointFile)
+}
+
+//checkpointCaches saves the valid entities, DOTs and aliases in the
+//resolution cache
+func (bw *BW) checkpointCaches() error {
+	cp := cacheCheckpoint{Saved: time.Now()}
+	bw.getlock()
+	for _, r := range bw.rdata.entityCache {
+		if r.ro != nil && r.s == StateValid {
+			cp.Entities = append(cp.Entities, r.ro.GetContent())
+		}
+	}
+	for _, r := range bw.rdata.dotHashCache {
+		if r.ro != nil && r.s == StateValid && r.ro.IsAccess() {
+			cp.DOTs = append(cp.DOTs, r.ro.GetContent())
+		}
+	}
+	for k, v := range bw.rdata.aliasCache {
+		cp.Aliases = append(cp.Aliases, SnapshotAlias{Key: append([]byte{}, k[:]...), Value: append([]byte{}, v[:]...)})
+	}
+	bw.rellock()
+	cp.Block = bw.bchain.CurrentBlock()
+	contents, err := json.Marshal(&cp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bw.checkpointPath(), contents, 0600)
+}
+
+//loadCacheCheckpoint preloads the objects saved by the last Stop. Like
+//imported namespace snapshots, they are only used when the chain does
+//not know them
+func (bw *BW) loadCacheCheckpoint() {
+	contents, err := ioutil.ReadFile(bw.checkpointPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("could not read the resolution checkpoint: %v", err)
+		}
+		return
+	}
+	cp := cacheCheckpoint{}
+	if err := json.Unmarshal(contents, &cp); err != nil {
+		log.Warnf("bad resolution checkpoint: %v", err)
+		return
+	}
+	pl := bw.rdata.preload
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	loaded := 0
+	for _, content := range cp.Entities {
+		ro, err := objects.NewEntity(objects.ROEntity, content)
+		if err != nil {
+			continue
+		}
+		e := ro.(*objects.Entity)
+		if !e.SigValid() || e.IsExpired() {
+			continue
+		}
+		pl.entities[bc.SliceToBytes32(e.GetVK())] = e
+		loaded++
+	}
+	for _, content := range cp.DOTs {
+		ro, err := objects.NewDOT(objects.ROAccessDOT, content)
+		if err != nil {
+			continue
+		}
+		d := ro.(*objects.DOT)
+		if !d.SigValid() || d.IsExpired() {
+			continue
+		}
+		khash := bc.SliceToBytes32(d.GetHash())
+		if _, ok := pl.dots[khash]; !ok {
+			kFromVK := bc.SliceToBytes32(d.GetGiverVK())
+			pl.dotsFrom[kFromVK] = append(pl.dotsFrom[kFromVK], khash)
+		}
+		pl.dots[khash] = d
+		loaded++
+	}
+	for _, a := range cp.Aliases {
+		if len(a.Key) == 32 && len(a.Value) == 32 {
+			pl.aliases[bc.SliceToBytes32(a.Key)] = bc.SliceToBytes32(a.Value)
+			loaded++
+		}
+	}
+	log.Infof("preloaded %d objects from the resolution checkpoint of block %d", loaded, cp.Block)
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//NamespaceSnapshotVersion is the version of the snapshot format written by
+//ExportNamespace
+const NamespaceSnapshotVersion = 1
+
+//NamespaceSnapshot is every registry object a router needs to resolve
+//messages on a namespace. Objects are stored in their wire form
+type NamespaceSnapshot struct {
+	Version int
+	NSVK    []byte
+	//The block the snapshot was taken at
+	Block    uint64
+	Entities [][]byte
+	//Access DOTs granted on the namespace
+	DOTs [][]byte
+	//Elaborated access chains made only of the DOTs above
+	Chains           [][]byte
+	Aliases          []SnapshotAlias
+	DesignatedRouter []byte
+	SRV              string
+	//Routers offering to route the namespace. This is informational, it is
+	//not loaded by ImportNamespace
+	Offers [][]byte
+}
+
+//SnapshotAlias is an alias for one of the objects in a snapshot
+type SnapshotAlias struct {
+	Key   []byte
+	Value []byte
+}
+
+//nsPreload holds objects imported from namespace snapshots. They are only
+//used when the chain does not know an object (or cannot be reached), so
+//the chain always wins once it has caught up. Like the registry index it
+//is not dropped with the caches
+type nsPreload struct {
+	mu       sync.RWMutex
+	entities map[bc.Bytes32]*objects.Entity
+	dots     map[bc.Bytes32]*objects.DOT
+	// giver vk -> dot hashes
+	dotsFrom map[bc.Bytes32][]bc.Bytes32
+	chains   map[bc.Bytes32]*objects.DChain
+	aliases  map[bc.Bytes32]bc.Bytes32
+	// nsvk -> drvk
+	drs map[bc.Bytes32][]byte
+	// drvk -> srv
+	srvs map[bc.Bytes32]string
+}
+
+func newNSPreload() *nsPreload {
+	return &nsPreload{
+		entities: make(map[bc.Bytes32]*objects.Entity),
+		dots:     make(map[bc.Bytes32]*objects.DOT),
+		dotsFrom: make(map[bc.Bytes32][]bc.Bytes32),
+		chains:   make(map[bc.Bytes32]*objects.DChain),
+		aliases:  make(map[bc.Bytes32]bc.Bytes32),
+		drs:      make(map[bc.Bytes32][]byte),
+		srvs:     make(map[bc.Bytes32]string),
+	}
+}
+
+//ExportNamespace collects the valid entities, DOTs, chains and aliases on
+//a namespace along with its designated router. Like SearchRegistry, the
+//first call scans the whole registry history
+func (bw *BW) ExportNamespace(nsvk []byte) (*NamespaceSnapshot, error) {
+	ns, s, err := bw.ResolveEntity(nsvk)
+	if err != nil {
+		return nil, err
+	}
+	if ns == nil {
+		return nil, bwe.M(bwe.NoEntity, "Namespace entity not found")
+	}
+	if s != StateValid {
+		return nil, bwe.M(bwe.BadOperation, "Namespace entity is "+bw.StateToString(s))
+	}
+	rv := &NamespaceSnapshot{
+		Version: NamespaceSnapshotVersion,
+		NSVK:    nsvk,
+		Block:   bw.BC().CurrentBlock(),
+	}
+
+	ri := bw.rdata.regindex
+	ri.mu.Lock()
+	if err := ri.update(bw); err != nil {
+		ri.mu.Unlock()
+		return nil, err
+	}
+	cdots := []*objects.DOT{}
+	for _, d := range ri.dots {
+		if d.IsAccess() && bytes.Equal(d.GetAccessURIMVK(), nsvk) {
+			cdots = append(cdots, d)
+		}
+	}
+	cchains := []*objects.DChain{}
+	for _, dc := range ri.chains {
+		cchains = append(cchains, dc)
+	}
+	ri.mu.Unlock()
+
+	values := [][]byte{}
+	seen := make(map[bc.Bytes32]bool)
+	addEntity := func(vk []byte) {
+		kvk := bc.SliceToBytes32(vk)
+		if seen[kvk] {
+			return
+		}
+		seen[kvk] = true
+		e, s, err := bw.ResolveEntity(vk)
+		if err != nil || e == nil || s != StateValid {
+			return
+		}
+		rv.Entities = append(rv.Entities, e.GetContent())
+		values = append(values, vk)
+	}
+	addEntity(nsvk)
+	for _, d := range cdots {
+		_, s, err := bw.ResolveDOT(d.GetHash())
+		if err != nil || s != StateValid {
+			continue
+		}
+		seen[bc.SliceToBytes32(d.GetHash())] = true
+		rv.DOTs = append(rv.DOTs, d.GetContent())
+		values = append(values, d.GetHash())
+		addEntity(d.GetGiverVK())
+		addEntity(d.GetReceiverVK())
+	}
+	for _, dc := range cchains {
+		ok := true
+		for i := 0; i < dc.NumHashes(); i++ {
+			if !seen[bc.SliceToBytes32(dc.GetDotHash(i))] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			rv.Chains = append(rv.Chains, dc.GetContent())
+			values = append(values, dc.GetChainHash())
+		}
+	}
+
+	//No designated router is not an error, the snapshot is still useful
+	//for verifying messages
+	drvk, err := bw.LookupDesignatedRouter(nsvk)
+	if err == nil {
+		rv.DesignatedRouter = drvk
+		addEntity(drvk)
+		rv.SRV, _ = bw.LookupDesignatedRouterSRV(drvk)
+	}
+	rv.Offers, err = bw.BC().FindRoutingOffers(context.TODO(), nsvk)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		recs, err := bw.FindAliasesFor(v)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recs {
+			rv.Aliases = append(rv.Aliases, SnapshotAlias{Key: r.Key[:], Value: r.Value[:]})
+		}
+	}
+	return rv, nil
+}
+
+//ImportNamespace loads a snapshot so that its objects can be resolved
+//before the chain has them. Objects with bad signatures and expired
+//objects are skipped. Aliases and the designated router are not signed,
+//so the snapshot must come from a trusted source. It returns the number
+//of objects loaded and skipped
+func (bw *BW) ImportNamespace(snap *NamespaceSnapshot) (loaded int, skipped int, err error) {
+	if snap.Version != NamespaceSnapshotVersion {
+		return 0, 0, bwe.M(bwe.BadOperation, "Unsupported namespace snapshot version")
+	}
+	if len(snap.NSVK) != 32 {
+		return 0, 0, bwe.M(bwe.BadOperation, "Namespace snapshot has no namespace")
+	}
+	pl := bw.rdata.preload
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for _, content := range snap.Entities {
+		ro, err := objects.NewEntity(objects.ROEntity, content)
+		if err != nil {
+			skipped++
+			continue
+		}
+		e := ro.(*objects.Entity)
+		if !e.SigValid() || e.IsExpired() {
+			skipped++
+			continue
+		}
+		pl.entities[bc.SliceToBytes32(e.GetVK())] = e
+		loaded++
+	}
+	for _, content := range snap.DOTs {
+		ro, err := objects.NewDOT(objects.ROAccessDOT, content)
+		if err != nil {
+			skipped++
+			continue
+		}
+		d := ro.(*objects.DOT)
+		if !d.SigValid() || d.IsExpired() || !d.IsAccess() || !bytes.Equal(d.GetAccessURIMVK(), snap.NSVK) {
+			skipped++
+			continue
+		}
+		khash := bc.SliceToBytes32(d.GetHash())
+		if _, ok := pl.dots[khash]; !ok {
+			kFromVK := bc.SliceToBytes32(d.GetGiverVK())
+			pl.dotsFrom[kFromVK] = append(pl.dotsFrom[kFromVK], khash)
+		}
+		pl.dots[khash] = d
+		loaded++
+	}
+	for _, content := range snap.Chains {
+		ro, err := objects.NewDChain(objects.ROAccessDChain, content)
+		if err != nil {
+			skipped++
+			continue
+		}
+		dc := ro.(*objects.DChain)
+		pl.chains[bc.SliceToBytes32(dc.GetChainHash())] = dc
+		loaded++
+	}
+	for _, a := range snap.Aliases {
+		if len(a.Key) != 32 || len(a.Value) != 32 {
+			skipped++
+			continue
+		}
+		pl.aliases[bc.SliceToBytes32(a.Key)] = bc.SliceToBytes32(a.Value)
+		loaded++
+	}
+	if len(snap.DesignatedRouter) == 32 {
+		pl.drs[bc.SliceToBytes32(snap.NSVK)] = snap.DesignatedRouter
+		if snap.SRV != "" {
+			pl.srvs[bc.SliceToBytes32(snap.DesignatedRouter)] = snap.SRV
+		}
+	}
+	return loaded, skipped, nil
+}
+
+func (bw *BW) preloadedEntity(vk []byte) (*objects.Entity, int, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	e, ok := pl.entities[bc.SliceToBytes32(vk)]
+	pl.mu.RUnlock()
+	if !ok {
+		return nil, StateUnknown, false
+	}
+	if e.IsExpired() {
+		return e, StateExpired, true
+	}
+	return e, StateValid, true
+}
+
+func (bw *BW) preloadedDOT(hash []byte) (*objects.DOT, int, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	d, ok := pl.dots[bc.SliceToBytes32(hash)]
+	pl.mu.RUnlock()
+	if !ok {
+		return nil, StateUnknown, false
+	}
+	//The entities might not be preloaded, in which case the chain is asked
+	for _, vk := range [][]byte{d.GetGiverVK(), d.GetReceiverVK()} {
+		_, s, err := bw.ResolveEntity(vk)
+		if err != nil {
+			return d, StateError, true
+		}
+		if s != StateValid {
+			return d, s, true
+		}
+	}
+	if d.IsExpired() {
+		return d, StateExpired, true
+	}
+	return d, StateValid, true
+}
+
+func (bw *BW) preloadedAccessDChain(hash []byte) (*objects.DChain, int, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	dc, ok := pl.chains[bc.SliceToBytes32(hash)]
+	pl.mu.RUnlock()
+	if !ok {
+		return nil, StateUnknown, false
+	}
+	for i := 0; i < dc.NumHashes(); i++ {
+		_, s, err := bw.ResolveDOT(dc.GetDotHash(i))
+		if err != nil {
+			return dc, StateError, true
+		}
+		if s != StateValid {
+			return dc, s, true
+		}
+	}
+	return dc, StateValid, true
+}
+
+func (bw *BW) preloadedGrantedDOTs(vk []byte) ([]bc.Bytes32, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	hashes, ok := pl.dotsFrom[bc.SliceToBytes32(vk)]
+	return hashes, ok
+}
+
+func (bw *BW) preloadedAlias(k bc.Bytes32) (bc.Bytes32, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	v, ok := pl.aliases[k]
+	return v, ok
+}
+
+func (bw *BW) preloadedDesignatedRouter(nsvk []byte) ([]byte, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	drvk, ok := pl.drs[bc.SliceToBytes32(nsvk)]
+	return drvk, ok
+}
+
+func (bw *BW) preloadedSRV(drvk []byte) (string, bool) {
+	pl := bw.rdata.preload
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	srv, ok := pl.srvs[bc.SliceToBytes32(drvk)]
+	return srv, ok
+}
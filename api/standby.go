@@ -0,0 +1,366 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//defaultStandbyBuffer is how many writes may queue for a slow standby
+//when [standby] BufferSize is zero
+const defaultStandbyBuffer = 10000
+
+//standbyRetry is how long a standby waits before connecting to the
+//primary again
+var standbyRetry = 5 * time.Second
+
+//Flags in a nCmdStandby result frame
+const (
+	standbyDeleted = 1 << iota
+	//Sent once the whole store has been copied, without a record
+	standbySynced
+	//The message's sequence number follows the topic
+	standbySequenced
+)
+
+//StandbyStatus describes both sides of hot standby replication
+type StandbyStatus struct {
+	//On a standby, the primary it follows
+	Primary string
+	//Whether the standby is connected to the primary and has copied its
+	//whole store since connecting
+	Connected bool
+	Synced    bool
+	//Writes applied from the primary, since the router started
+	Applied     uint64
+	LastApplied time.Time
+	LastError   string
+	//When the standby was promoted, zero if it has not been
+	Promoted time.Time
+	//On a primary, the standbys following it
+	Followers int
+}
+
+type standby struct {
+	mu        sync.Mutex
+	status    StandbyStatus
+	promoted  bool
+	conn      net.Conn
+	followers int
+}
+
+//encodeStandbyRecord is the body of a nCmdStandby result frame: the flags,
+//the 16 bit length of the topic, the topic, the 64 bit sequence number if
+//the message has one and then the message or tombstone
+func encodeStandbyRecord(r *store.Record, flags byte) []byte {
+	seqlen := 0
+	if r.Seq != 0 {
+		flags |= standbySequenced
+		seqlen = 8
+	}
+	rv := make([]byte, 3+len(r.Topic)+seqlen+len(r.Value))
+	if r.Deleted {
+		flags |= standbyDeleted
+	}
+	rv[0] = flags
+	binary.LittleEndian.PutUint16(rv[1:], uint16(len(r.Topic)))
+	copy(rv[3:], r.Topic)
+	if r.Seq != 0 {
+		binary.LittleEndian.PutUint64(rv[3+len(r.Topic):], r.Seq)
+	}
+	copy(rv[3+len(r.Topic)+seqlen:], r.Value)
+	return rv
+}
+
+func decodeStandbyRecord(b []byte) (*store.Record, byte, error) {
+	if len(b) < 3 {
+		return nil, 0, bwe.M(bwe.PeerError, "short standby frame")
+	}
+	tlen := int(binary.LittleEndian.Uint16(b[1:]))
+	if len(b) < 3+tlen {
+		return nil, 0, bwe.M(bwe.PeerError, "short standby frame")
+	}
+	rv := &store.Record{
+		Topic:   string(b[3 : 3+tlen]),
+		Deleted: b[0]&standbyDeleted != 0,
+	}
+	b, flags := b[3+tlen:], b[0]
+	if flags&standbySequenced != 0 {
+		if len(b) < 8 {
+			return nil, 0, bwe.M(bwe.PeerError, "short standby frame")
+		}
+		rv.Seq = binary.LittleEndian.Uint64(b)
+		b = b[8:]
+	}
+	rv.Value = b
+	return rv, flags, nil
+}
+
+//authStandby checks the body of a nCmdStandby frame, which is the VK of
+//the standby router and its signature over the signature of the
+//listener's certificate. The VK must be in [standby] Allow
+func (bw *BW) authStandby(body []byte, certSig []byte) error {
+	if len(body) != 96 {
+		return bwe.M(bwe.MalformedMessage, "bad standby frame")
+	}
+	allow, err := parseVKs("standby", bw.Config.Standby.Allow)
+	if err != nil {
+		return err
+	}
+	if !containsVK(allow, body[:32]) {
+		return bwe.M(bwe.BadPermissions, "router is not allowed to be a standby of this one")
+	}
+	if !crypto.VerifyBlob(body[:32], body[32:], certSig) {
+		return bwe.M(bwe.BadPermissions, "standby did not prove its VK")
+	}
+	return nil
+}
+
+//streamStore sends a standby the whole store, and then each write as it
+//happens, until ctx is done or the standby falls too far behind. Writes
+//during the copy are queued, so the standby ends up with the latest
+//value either way. The stream always ends with a nCmdEnd frame
+func (bw *BW) streamStore(ctx context.Context, send func(cmd uint8, body []byte)) {
+	size := bw.Config.Standby.BufferSize
+	if size <= 0 {
+		size = defaultStandbyBuffer
+	}
+	live := make(chan store.Record, size)
+	overflow := make(chan struct{})
+	once := sync.Once{}
+	cancel := store.Watch(func(r store.Record) {
+		select {
+		case live <- r:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+	defer cancel()
+	defer send(nCmdEnd, []byte{})
+
+	bw.standby.mu.Lock()
+	bw.standby.followers++
+	bw.standby.mu.Unlock()
+	defer func() {
+		bw.standby.mu.Lock()
+		bw.standby.followers--
+		bw.standby.mu.Unlock()
+	}()
+
+	all := make(chan store.Record, 100)
+	go store.Walk(all)
+	for r := range all {
+		if ctx.Err() != nil {
+			//Let the walk finish so that it releases its iterator
+			for range all {
+			}
+			return
+		}
+		send(nCmdResult, encodeStandbyRecord(&r, 0))
+	}
+	send(nCmdResult, encodeStandbyRecord(&store.Record{}, standbySynced))
+	for {
+		select {
+		case r := <-live:
+			send(nCmdResult, encodeStandbyRecord(&r, 0))
+		case <-overflow:
+			log.Warnf("standby fell %d writes behind, making it copy the store again", size)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//StartStandby follows the primary in [standby] until the router is
+//promoted. It does nothing if there is no primary
+func StartStandby(bw *BW) {
+	cfg := bw.Config.Standby
+	if cfg.Primary == "" {
+		return
+	}
+	pvk, err := crypto.UnFmtKey(cfg.PrimaryVK)
+	if err != nil {
+		log.Criticalf("Not following the primary: [standby] PrimaryVK is not a key")
+		return
+	}
+	bw.standby.mu.Lock()
+	bw.standby.status.Primary = cfg.Primary
+	bw.standby.mu.Unlock()
+	for {
+		err := bw.followPrimary(cfg.Primary, pvk)
+		bw.standby.mu.Lock()
+		bw.standby.status.Connected = false
+		bw.standby.status.Synced = false
+		bw.standby.conn = nil
+		promoted := bw.standby.promoted
+		if err != nil && !promoted {
+			bw.standby.status.LastError = err.Error()
+		}
+		bw.standby.mu.Unlock()
+		if promoted || bw.Draining() {
+			return
+		}
+		log.Warnf("standby lost the primary at %s: %v", cfg.Primary, err)
+		time.Sleep(standbyRetry)
+	}
+}
+
+//followPrimary copies the primary's store over one connection, applying
+//the writes it sends until the connection ends
+func (bw *BW) followPrimary(target string, pvk []byte) error {
+	conn, err := dialPeer(target, pvk, drCheckTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	bw.standby.mu.Lock()
+	if bw.standby.promoted {
+		bw.standby.mu.Unlock()
+		return nil
+	}
+	bw.standby.conn = conn
+	bw.standby.mu.Unlock()
+
+	vk := bw.Entity.GetVK()
+	hdr := make([]byte, 17+96)
+	binary.LittleEndian.PutUint64(hdr, 96)
+	binary.LittleEndian.PutUint64(hdr[8:], 1)
+	hdr[16] = nCmdStandby
+	copy(hdr[17:], vk)
+	crypto.SignBlob(bw.Entity.GetSK(), vk, hdr[17+32:], conn.ConnectionState().PeerCertificates[0].Signature)
+	if _, err := conn.Write(hdr); err != nil {
+		return err
+	}
+	nf, err := readNativeFrame(conn, maxNativeFrame)
+	if err != nil {
+		return err
+	}
+	if nf.cmd != nCmdRStatus || len(nf.body) < 2 {
+		return bwe.M(bwe.PeerError, "unexpected reply from the primary")
+	}
+	if code := int(binary.LittleEndian.Uint16(nf.body)); code != bwe.Okay {
+		return bwe.M(code, string(nf.body[2:]))
+	}
+	log.Infof("standby following the primary at %s", target)
+	bw.standby.mu.Lock()
+	bw.standby.status.Connected = true
+	bw.standby.status.LastError = ""
+	bw.standby.mu.Unlock()
+	for {
+		nf, err := readNativeFrame(conn, maxNativeFrame)
+		if err != nil {
+			return err
+		}
+		switch nf.cmd {
+		case nCmdResult:
+			r, flags, err := decodeStandbyRecord(nf.body)
+			if err != nil {
+				return err
+			}
+			if flags&standbySynced != 0 {
+				log.Infof("standby has copied the primary's store")
+				bw.standby.mu.Lock()
+				bw.standby.status.Synced = true
+				bw.standby.mu.Unlock()
+				continue
+			}
+			//The primary proved its VK, so its writes are taken as they are
+			//Numbered messages keep their numbers, so that a promoted standby
+			//numbers the next persists where the primary would have
+			switch {
+			case r.Deleted:
+				store.DeleteMessage(r.Topic, r.Value)
+			case r.Seq != 0:
+				store.PutNumberedMessage(r.Topic, r.Value, r.Seq)
+			default:
+				store.PutMessage(r.Topic, r.Value)
+			}
+			bw.standby.mu.Lock()
+			bw.standby.status.Applied++
+			bw.standby.status.LastApplied = time.Now()
+			bw.standby.mu.Unlock()
+		case nCmdEnd:
+			return bwe.M(bwe.PeerError, "the primary ended the stream")
+		default:
+			return bwe.M(bwe.PeerError, "unexpected frame from the primary")
+		}
+	}
+}
+
+//Following is true for a standby that has not been promoted
+func (bw *BW) Following() bool {
+	bw.standby.mu.Lock()
+	defer bw.standby.mu.Unlock()
+	return bw.Config.Standby.Primary != "" && !bw.standby.promoted
+}
+
+//StandbyStatus returns the state of replication to and from this router
+func (bw *BW) StandbyStatus() StandbyStatus {
+	bw.standby.mu.Lock()
+	defer bw.standby.mu.Unlock()
+	rv := bw.standby.status
+	rv.Followers = bw.standby.followers
+	return rv
+}
+
+//PromoteStandby stops the standby following the primary, so it serves
+//the persisted messages it has copied as its own. If the standby holds the
+//primary's router entity, the SRV record is pointed at srv, or at its
+//public IP and advertised port if srv is empty, and the new record is
+//returned
+func (bw *BW) PromoteStandby(srv string) (string, error) {
+	bw.standby.mu.Lock()
+	if bw.Config.Standby.Primary == "" {
+		bw.standby.mu.Unlock()
+		return "", bwe.M(bwe.BadOperation, "this router is not a standby")
+	}
+	if bw.standby.promoted {
+		bw.standby.mu.Unlock()
+		return "", bwe.M(bwe.BadOperation, "this router has already been promoted")
+	}
+	bw.standby.promoted = true
+	bw.standby.status.Promoted = time.Now()
+	if bw.standby.conn != nil {
+		bw.standby.conn.Close()
+	}
+	bw.standby.mu.Unlock()
+	log.Info("standby promoted, no longer following the primary")
+
+	pvk, _ := crypto.UnFmtKey(bw.Config.Standby.PrimaryVK)
+	if !bytes.Equal(pvk, bw.Entity.GetVK()) {
+		return "", nil
+	}
+	if srv == "" {
+		if bw.Config.DR.PublicIPService == "" {
+			return "", bwe.M(bwe.BadOperation, "promoted, but not updating the SRV record: give one or set [dr] PublicIPService")
+		}
+		ip, err := lookupPublicIP(bw.Config.DR.PublicIPService)
+		if err != nil {
+			return "", bwe.M(bwe.BadOperation, "promoted, but could not get public IP: "+err.Error())
+		}
+		port := bw.advertisePort()
+		if port == "" {
+			return "", bwe.M(bwe.BadOperation, "promoted, but there is no port to advertise")
+		}
+		srv = net.JoinHostPort(ip, port)
+	}
+	bw.drmon.mu.Lock()
+	if bw.drmon.updatePending {
+		bw.drmon.mu.Unlock()
+		return "", bwe.M(bwe.BadOperation, "promoted, but an SRV update is already in progress")
+	}
+	bw.drmon.updatePending = true
+	bw.drmon.updatedSRV = srv
+	bw.drmon.mu.Unlock()
+	go bw.updateSRV(srv)
+	return srv, nil
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//StatsURIPrefix is the subtree that summaries are persisted under. The
+//summary of ns/a/b over the 1m interval is at ns/!stats/1m/a/b
+const StatsURIPrefix = "!stats"
+
+const statsRetryInterval = 30 * time.Second
+
+//StatsBucket summarizes the numbers seen in one interval
+type StatsBucket struct {
+	//The start of the interval, in nanoseconds since the epoch
+	Start int64   `msgpack:"start"`
+	Count int     `msgpack:"count"`
+	Min   float64 `msgpack:"min"`
+	Max   float64 `msgpack:"max"`
+	Mean  float64 `msgpack:"mean"`
+}
+
+//StatsSummary is persisted (as a msgpack PO) under StatsURIPrefix each time
+//an interval ends
+type StatsSummary struct {
+	URI string `msgpack:"uri"`
+	//For numbers in a msgpack map, the key. Empty otherwise
+	Field    string `msgpack:"field"`
+	Interval string `msgpack:"interval"`
+	//The last completed intervals, oldest first
+	Buckets []StatsBucket `msgpack:"buckets"`
+}
+
+type statsSeries struct {
+	summary  StatsSummary
+	interval time.Duration
+	mvk      []byte
+	suffix   string
+	cur      *StatsBucket
+	sum      float64
+}
+
+type statsArchiver struct {
+	bw        *BW
+	cl        *BosswaveClient
+	intervals []time.Duration
+	names     []string
+	history   int
+
+	mu     sync.Mutex
+	series map[string]*statsSeries
+}
+
+//StartStats subscribes to the URIs in the stats config with the router
+//entity and persists the min, max and mean of their numeric payloads for
+//each interval. It does nothing if there are no URIs
+func StartStats(bw *BW) {
+	cfg := bw.Config.Stats
+	if len(cfg.URI) == 0 {
+		return
+	}
+	sa := &statsArchiver{
+		bw:      bw,
+		history: cfg.History,
+		series:  make(map[string]*statsSeries),
+	}
+	if sa.history <= 0 {
+		sa.history = 1
+	}
+	intervals := cfg.Intervals
+	if intervals == "" {
+		intervals = "1m"
+	}
+	for _, name := range strings.Split(intervals, ",") {
+		name = strings.TrimSpace(name)
+		d, err := time.ParseDuration(name)
+		if err != nil || d < time.Second {
+			log.Errorf("stats: bad interval %q, not starting", name)
+			return
+		}
+		sa.intervals = append(sa.intervals, d)
+		sa.names = append(sa.names, name)
+	}
+	sa.cl = bw.CreateClient(context.Background(), "STATS")
+	if err := sa.cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("stats: could not use router entity: %v", err)
+		return
+	}
+	for _, uri := range cfg.URI {
+		go sa.subscribe(uri)
+	}
+	shortest := sa.intervals[0]
+	for _, d := range sa.intervals {
+		if d < shortest {
+			shortest = d
+		}
+	}
+	//Close the intervals of signals that have gone quiet
+	for {
+		time.Sleep(shortest)
+		sa.flush(time.Now())
+	}
+}
+
+//subscribe retries until the subscription succeeds, as the chain may not
+//be synced when the router starts
+func (sa *statsArchiver) subscribe(uri string) {
+	for {
+		ns, suffix, err := util.SplitURI(uri)
+		if err != nil {
+			log.Errorf("stats: %v", err)
+			return
+		}
+		mvk, err := sa.bw.ResolveKey(ns)
+		if err == nil {
+			done := make(chan error, 1)
+			sa.cl.Subscribe(&SubscribeParams{
+				MVK:       mvk,
+				URISuffix: suffix,
+				AutoChain: true,
+			}, func(err error, id core.UniqueMessageID) {
+				done <- err
+			}, sa.handle)
+			err = <-done
+		}
+		if err == nil {
+			log.Infof("stats: archiving %s", uri)
+			return
+		}
+		log.Warnf("stats: could not subscribe to %s: %v", uri, err)
+		time.Sleep(statsRetryInterval)
+	}
+}
+
+func (sa *statsArchiver) handle(m *core.Message) {
+	if m == nil {
+		return
+	}
+	_, topic, err := util.SplitURI(m.Topic)
+	if err != nil {
+		return
+	}
+	//The summaries go under a ! element, and a URI can only have one
+	if _, _, _, hasBang := util.AnalyzeSuffix(topic); hasBang {
+		return
+	}
+	vals := numericValues(m)
+	if len(vals) == 0 {
+		return
+	}
+	now := time.Now()
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	for field, val := range vals {
+		for i, d := range sa.intervals {
+			key := sa.names[i] + "|" + field + "|" + m.Topic
+			s, ok := sa.series[key]
+			if !ok {
+				suffix, err := util.JoinSuffix(StatsURIPrefix, sa.names[i], topic, field)
+				if err != nil {
+					continue
+				}
+				s = &statsSeries{
+					summary:  StatsSummary{URI: m.Topic, Field: field, Interval: sa.names[i]},
+					interval: d,
+					mvk:      m.MVK,
+					suffix:   suffix,
+				}
+				sa.series[key] = s
+			}
+			start := now.Truncate(d).UnixNano()
+			if s.cur != nil && s.cur.Start != start {
+				sa.closeBucket(s)
+			}
+			if s.cur == nil {
+				s.cur = &StatsBucket{Start: start, Min: val, Max: val}
+			}
+			s.cur.Count++
+			s.sum += val
+			if val < s.cur.Min {
+				s.cur.Min = val
+			}
+			if val > s.cur.Max {
+				s.cur.Max = val
+			}
+		}
+	}
+}
+
+//flush closes the intervals that ended before now
+func (sa *statsArchiver) flush(now time.Time) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	for _, s := range sa.series {
+		if s.cur != nil && now.Truncate(s.interval).UnixNano() != s.cur.Start {
+			sa.closeBucket(s)
+		}
+	}
+}
+
+//closeBucket adds the current interval to the summary and persists it.
+//sa.mu must be held
+func (sa *statsArchiver) closeBucket(s *statsSeries) {
+	b := *s.cur
+	b.Mean = s.sum / float64(b.Count)
+	s.cur = nil
+	s.sum = 0
+	s.summary.Buckets = append(s.summary.Buckets, b)
+	if len(s.summary.Buckets) > sa.history {
+		s.summary.Buckets = append([]StatsBucket{}, s.summary.Buckets[len(s.summary.Buckets)-sa.history:]...)
+	}
+	blob, err := msgpack.Marshal(&s.summary)
+	if err != nil {
+		log.Errorf("stats: could not encode summary: %v", err)
+		return
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumMsgPack, blob)
+	suffix := s.suffix
+	go sa.cl.Publish(&PublishParams{
+		MVK:            s.mvk,
+		URISuffix:      suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+		Persist:        true,
+		AutoChain:      true,
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("stats: could not persist %s: %v", suffix, err)
+		}
+	})
+}
+
+//numericValues extracts the numbers in a message's payload objects. A text
+//payload that is a number, or a msgpack number, has the field "". The
+//numbers in a msgpack map have their key as the field
+func numericValues(m *core.Message) map[string]float64 {
+	rv := make(map[string]float64)
+	for _, po := range m.PayloadObjects {
+		bpo := advpo.CreateBasePayloadObject(po.GetPONum(), po.GetContent())
+		switch {
+		case bpo.IsTypeDF("64.0.0.0/4"):
+			n, err := strconv.ParseFloat(strings.TrimSpace(string(po.GetContent())), 64)
+			if err == nil {
+				rv[""] = n
+			}
+		case bpo.IsTypeDF("2.0.0.0/8") && po.GetPONum() != objects.PONumSMetadata:
+			var v interface{}
+			if err := msgpack.Unmarshal(po.GetContent(), &v); err != nil {
+				continue
+			}
+			if n, ok := toFloat(v); ok {
+				rv[""] = n
+				continue
+			}
+			if fields, ok := stringMap(v); ok {
+				for k, fv := range fields {
+					if n, ok := toFloat(fv); ok {
+						rv[k] = n
+					}
+				}
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"time"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//ExportStore returns a page of the messages persisted on the router that
+//match the (possibly wildcard) topic, expired or not, with the cursor for
+//the next page. The messages keep their routing objects and signatures,
+//and their sequence numbers are in Seq, so they can be restored with
+//ImportMessage. It does not check permissions, so it is only for the
+//router's admins
+func (bw *BW) ExportStore(topic string, page PageParams) ([]store.SM, string, error) {
+	if err := page.check(); err != nil {
+		return nil, "", err
+	}
+	after, _ := store.DecodeCursor(page.Cursor)
+	sms, more := store.GetMatchingPage(topic, after, page.Limit)
+	for i := range sms {
+		sms[i].Seq, _ = store.GetSequence(sms[i].URI, sms[i].Body)
+	}
+	if !more {
+		return sms, "", nil
+	}
+	return sms, store.EncodeCursor(sms[len(sms)-1].URI), nil
+}
+
+//ImportMessage persists a message exported with ExportStore, replacing
+//whatever is persisted on its topic, without delivering it to subscribers.
+//It must be a persist signed by its origin that has not expired. With
+//checkChain its chain must also still grant the persist, which fails for
+//messages whose DOTs have since expired. A non zero seq is the sequence
+//number the message was exported with, which it keeps. It returns the
+//message's topic
+func (bw *BW) ImportMessage(body []byte, seq uint64, checkChain bool) (string, error) {
+	m, err := core.LoadMessage(body)
+	if err != nil {
+		return "", bwe.WrapC(bwe.MalformedMessage, err)
+	}
+	m.PersistSeq = seq
+	if m.Type != core.TypePersist {
+		return m.Topic, bwe.M(bwe.BadOperation, "only persisted messages can be imported")
+	}
+	if !m.SigValid() {
+		return m.Topic, bwe.M(bwe.InvalidSig, "message signature invalid")
+	}
+	if m.ExpireTime.Before(time.Now()) {
+		return m.Topic, bwe.M(bwe.ExpiredMessage, "message is expired: "+m.ExpireTime.String())
+	}
+	if checkChain {
+		if err := m.Reverify(bw); err != nil {
+			return m.Topic, err
+		}
+	}
+	bw.tm.Restore(m)
+	return m.Topic, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+)
+
+//DefaultSubscriptionRecheck is how often subscriptions are verified again if
+//[router] SubscriptionRecheck is not set
+const DefaultSubscriptionRecheck = 5 * time.Minute
+
+//After a revocation or expiry, wait this long before checking so that a
+//burst of changes is checked once and the flushes have finished
+const subscriptionRecheckHoldoff = 1 * time.Second
+
+//triggerSubscriptionRecheck asks for the subscriptions to be verified
+//again soon. It does not block
+func (bw *BW) triggerSubscriptionRecheck() {
+	select {
+	case bw.recheck <- struct{}{}:
+	default:
+	}
+}
+
+//recheckSubscriptionsLoop verifies the chains of the active subscriptions
+//when a DOT or entity is revoked or expires, and periodically to catch
+//anything that was missed. [router] SubscriptionRecheck sets the period in
+//seconds, and a negative period leaves only the event driven checks
+func (bw *BW) recheckSubscriptionsLoop() {
+	interval := DefaultSubscriptionRecheck
+	if bw.Config.Router.SubscriptionRecheck > 0 {
+		interval = time.Duration(bw.Config.Router.SubscriptionRecheck) * time.Second
+	}
+	var periodic <-chan time.Time
+	if bw.Config.Router.SubscriptionRecheck >= 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		periodic = ticker.C
+	}
+	for {
+		select {
+		case <-bw.recheck:
+			time.Sleep(subscriptionRecheckHoldoff)
+			//Changes during the holdoff are covered by this check
+			select {
+			case <-bw.recheck:
+			default:
+			}
+		case <-periodic:
+		}
+		bw.recheckSubscriptions()
+	}
+}
+
+//recheckSubscriptions ends the subscriptions whose chains no longer grant
+//them access. Only subscriptions that were verified when they were made,
+//or that carry a chain, are checked. Local clients are trusted otherwise
+func (bw *BW) recheckSubscriptions() int {
+	ended := bw.tm.RecheckSubscriptions(func(m *core.Message) error {
+		if m.PrimaryAccessChain == nil && !m.Verified() {
+			return nil
+		}
+		return m.Reverify(bw)
+	})
+	if ended > 0 {
+		log.Infof("ended %d subscriptions that are no longer authorized", ended)
+	}
+	return ended
+}
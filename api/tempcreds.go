@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//MaxTempCredentialLife is the longest a temporary credential may last
+const MaxTempCredentialLife = 24 * time.Hour
+
+//tempRevocationsFile holds the revocations scheduled for temporary
+//credentials, so that they survive a restart
+const tempRevocationsFile = "temprevocations.json"
+
+//How often the scheduled revocations are checked
+const tempRevocationCheck = time.Minute
+
+//TempCredentialParams describes a temporary credential: a new entity with
+//a short lived DOT, for handing to an ephemeral workload such as a CI job
+type TempCredentialParams struct {
+	//The URI the credential grants on. It may have + wildcards but not *
+	URI         string
+	Permissions string
+	//How long the entity and DOT last, at most MaxTempCredentialLife
+	Life    time.Duration
+	Contact string
+	Comment string
+	//When to revoke the DOT, measured from now. Zero revokes it when it
+	//expires, so that clock skew does not extend it, and negative leaves it
+	//to expire
+	RevokeAfter time.Duration
+	//The account of the client's entity that pays for publishing
+	Account     int
+	Interaction *bc.InteractionParams
+}
+
+//TempCredential is a minted temporary credential
+type TempCredential struct {
+	//The new entity, with its signing key
+	Entity *objects.Entity
+	//The DOT from the client's entity to Entity. It has a TTL of zero and
+	//forbids delegating any of its permissions
+	DOT *objects.DOT
+	//The elaborated chain from the namespace to Entity, to use as the
+	//primary access chain
+	Chain   *objects.DChain
+	Expires time.Time
+	//When the DOT will be revoked, zero if it will not be
+	RevokeAt time.Time
+}
+
+//MintTempCredential creates and publishes a temporary credential, paid for
+//by the client's entity, which must hold a chain that can be delegated
+//granting p.Permissions on p.URI. The DOT's revocation is signed now and
+//published by the router at the time asked for, paid for by the router's
+//entity
+func (cl *BosswaveClient) MintTempCredential(ctx context.Context, p *TempCredentialParams) (*TempCredential, error) {
+	if cl.GetUs() == nil || cl.BCC() == nil {
+		return nil, bwe.M(bwe.NoEntity, "No entity set")
+	}
+	if p.Life <= 0 || p.Life > MaxTempCredentialLife {
+		return nil, bwe.M(bwe.BadOperation, "a temporary credential must last between zero and "+MaxTempCredentialLife.String())
+	}
+	if p.RevokeAfter > p.Life {
+		return nil, bwe.M(bwe.BadOperation, "the revocation must not be after the expiry")
+	}
+	ns, suffix, err := util.SplitURI(p.URI)
+	if err != nil {
+		return nil, bwe.WrapC(bwe.BadURI, err)
+	}
+	if strings.Contains(suffix, "*") || util.IsFreePath(suffix) {
+		return nil, bwe.M(bwe.BadURI, "temporary credentials cannot grant * wildcards or free paths")
+	}
+	perms := objects.GetADPSFromPermString(p.Permissions)
+	if perms == nil || perms.GetPermString() == "" {
+		return nil, bwe.M(bwe.BadPermissions, "Permission string is invalid")
+	}
+	mvk, err := cl.BW().ResolveKey(ns)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err)
+	}
+	var dots []*objects.DOT
+	if string(mvk) != string(cl.GetUs().GetVK()) {
+		pac, err := cl.delegableChain(mvk, suffix, perms)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < pac.NumHashes(); i++ {
+			dots = append(dots, pac.GetDOT(i))
+		}
+	}
+
+	comment := p.Comment
+	if comment == "" {
+		comment = "temporary credential for " + p.URI
+	}
+	expires := time.Now().Add(p.Life)
+	ent, err := CreateEntity(&CreateEntityParams{
+		Expiry:   &expires,
+		Contact:  p.Contact,
+		Comment:  comment,
+		Revokers: [][]byte{cl.GetUs().GetVK()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	bcc := cl.BCC().WithInteractionParams(p.Interaction)
+	err = waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+		bcc.PublishEntity(ctx, p.Account, ent, confirmed)
+	})
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "could not publish the entity", err)
+	}
+	dot, err := cl.CreateDOT(&CreateDOTParams{
+		To:                ent.GetVK(),
+		Expiry:            &expires,
+		Contact:           p.Contact,
+		Comment:           comment,
+		URISuffix:         suffix,
+		MVK:               mvk,
+		AccessPermissions: perms.GetPermString(),
+		NoDelegate:        perms.GetPermString(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+		bcc.PublishDOT(ctx, p.Account, dot, confirmed)
+	})
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "could not publish the DOT", err)
+	}
+	chain, err := objects.CreateDChain(true, append(dots, dot)...)
+	if err != nil {
+		return nil, err
+	}
+	rv := &TempCredential{Entity: ent, DOT: dot, Chain: chain, Expires: expires}
+	if p.RevokeAfter >= 0 {
+		rv.RevokeAt = expires
+		if p.RevokeAfter > 0 {
+			rv.RevokeAt = time.Now().Add(p.RevokeAfter)
+		}
+		rvk := objects.CreateRevocation(cl.GetUs().GetVK(), dot.GetHash(), "temporary credential ended")
+		rvk.Encode(cl.GetUs().GetSK())
+		if err := cl.BW().scheduleRevocation(rvk, rv.RevokeAt); err != nil {
+			log.Warnf("could not save the revocation of temporary DOT %s: %v", crypto.FmtHash(dot.GetHash()), err)
+		}
+	}
+	return rv, nil
+}
+
+//delegableChain finds a chain granting perms on the URI to the client's
+//entity that it may delegate to a new DOT
+func (cl *BosswaveClient) delegableChain(mvk []byte, suffix string, perms *objects.AccessDOTPermissionSet) (*objects.DChain, error) {
+	ch, err := cl.BuildChain(&BuildChainParams{
+		To:          cl.GetUs().GetVK(),
+		URI:         crypto.FmtKey(mvk) + "/" + suffix,
+		Permissions: perms.GetPermString(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rv *objects.DChain
+	for pac := range ch {
+		if rv != nil {
+			continue
+		}
+		//Built chains carry their DOTs, which the new chain needs too
+		dots := []*objects.DOT{}
+		for i := 0; pac.IsElaborated() && i < pac.NumHashes(); i++ {
+			if pac.GetDOT(i) == nil {
+				dots = nil
+				break
+			}
+			dots = append(dots, pac.GetDOT(i))
+		}
+		if len(dots) == 0 {
+			continue
+		}
+		//Delegating adds a hop, and must not drop any of the permissions
+		extended := append(dots, objects.CreateDOT(true, cl.GetUs().GetVK(), cl.GetUs().GetVK()))
+		extended[len(dots)].SetPermString(perms.GetPermString())
+		if pac.GetTTL() > 0 && perms.IsSubsetOf(objects.ChainPermissionSet(extended)) {
+			rv = pac
+		}
+	}
+	if rv == nil {
+		return nil, bwe.M(bwe.ChainBuildFailed, "no chain that may be delegated grants "+perms.GetPermString()+" on "+crypto.FmtKey(mvk)+"/"+suffix)
+	}
+	return rv, nil
+}
+
+//scheduledRevocation is a revocation the router publishes at a given time
+type scheduledRevocation struct {
+	At         time.Time
+	Revocation []byte
+}
+
+type tempRevocations struct {
+	mu      sync.Mutex
+	pending []scheduledRevocation
+}
+
+func (bw *BW) tempRevocationsPath() string {
+	return path.Join(bw.Config.Router.DB, tempRevocationsFile)
+}
+
+//saveTempRevocations writes the pending revocations. The lock is held
+func (bw *BW) saveTempRevocations() error {
+	contents, err := json.Marshal(bw.temprevs.pending)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bw.tempRevocationsPath(), contents, 0600)
+}
+
+//scheduleRevocation has the router publish rvk at the given time
+func (bw *BW) scheduleRevocation(rvk *objects.Revocation, at time.Time) error {
+	bw.temprevs.mu.Lock()
+	defer bw.temprevs.mu.Unlock()
+	bw.temprevs.pending = append(bw.temprevs.pending, scheduledRevocation{At: at, Revocation: rvk.GetContent()})
+	return bw.saveTempRevocations()
+}
+
+//runTempRevocations loads the revocations scheduled before the router
+//last stopped and publishes each one when it is due
+func (bw *BW) runTempRevocations() {
+	contents, err := ioutil.ReadFile(bw.tempRevocationsPath())
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("could not read the scheduled revocations: %v", err)
+	}
+	bw.temprevs.mu.Lock()
+	if len(contents) != 0 {
+		loaded := []scheduledRevocation{}
+		if err := json.Unmarshal(contents, &loaded); err != nil {
+			log.Warnf("bad scheduled revocations: %v", err)
+		}
+		bw.temprevs.pending = append(loaded, bw.temprevs.pending...)
+	}
+	bw.temprevs.mu.Unlock()
+	cl := bw.CreateClient(context.Background(), "TEMPREVOKE")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("scheduled revocations: could not use router entity: %v", err)
+		return
+	}
+	for {
+		bw.publishDueRevocations(cl)
+		time.Sleep(tempRevocationCheck)
+	}
+}
+
+func (bw *BW) publishDueRevocations(cl *BosswaveClient) {
+	now := time.Now()
+	bw.temprevs.mu.Lock()
+	due := []scheduledRevocation{}
+	for _, s := range bw.temprevs.pending {
+		if !s.At.After(now) {
+			due = append(due, s)
+		}
+	}
+	bw.temprevs.mu.Unlock()
+	for _, s := range due {
+		ro, err := objects.NewRevocation(objects.RORevocation, s.Revocation)
+		if err == nil {
+			err = waitTx(func(confirmed func(res *bc.TxResult, err error)) {
+				cl.BCC().PublishRevocation(context.Background(), 0, ro.(*objects.Revocation), confirmed)
+			})
+		}
+		if err != nil {
+			//It is tried again at the next check
+			log.Warnf("could not publish a scheduled revocation: %v", err)
+			continue
+		}
+		bw.temprevs.mu.Lock()
+		for i := range bw.temprevs.pending {
+			if bw.temprevs.pending[i].At.Equal(s.At) && string(bw.temprevs.pending[i].Revocation) == string(s.Revocation) {
+				bw.temprevs.pending = append(bw.temprevs.pending[:i], bw.temprevs.pending[i+1:]...)
+				break
+			}
+		}
+		if err := bw.saveTempRevocations(); err != nil {
+			log.Warnf("could not save the scheduled revocations: %v", err)
+		}
+		bw.temprevs.mu.Unlock()
+	}
+}
@@ -0,0 +1,729 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/consensus/ethash"
+	"github.com/immesys/bw2bc/core/types"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//defaultThinHeadInterval is how often a thin router fetches the registry's
+//head when [thin] HeadInterval is zero
+const defaultThinHeadInterval = 15 * time.Second
+
+//thinQueryTimeout bounds each query to the registry
+const thinQueryTimeout = 30 * time.Second
+
+//maxRegistryLogBlocks is the most blocks of logs a registry sends for one
+//query. A thin router only needs recent logs, to flush its caches
+const maxRegistryLogBlocks = 10000
+
+var errThin = bwe.M(bwe.BlockChainGenericError, "not available on a thin router")
+
+//thinChain is the chain of a router with the thin profile. It runs no
+//chain node. Instead it resolves through a full router, the registry,
+//over the native protocol, checking the proofs the registry sends with
+//its answers unless it is trusted. Transactions cannot be sent
+type thinChain struct {
+	target   string
+	vk       []byte
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	shutdown chan bool
+
+	mu      sync.Mutex
+	conn    *tls.Conn
+	seqno   uint64
+	waiting map[uint64]chan *nativeFrame
+	head    registryHead
+	heads   map[chan *types.Header]struct{}
+
+	//Unless the registry is trusted, its answers are proven and the
+	//headers they are proven against are checked with pow
+	prove      bool
+	pow        *ethash.Ethash
+	verified   map[uint64]common.Hash
+	difficulty *big.Int
+}
+
+//newThinChain connects to the registry in [thin]. A registry that cannot
+//be reached is not an error, it is tried again for each query
+func newThinChain(cfg *core.BWConfig) (*thinChain, chan bool, error) {
+	vk, err := crypto.UnFmtKey(cfg.Thin.RegistryVK)
+	if err != nil {
+		return nil, nil, bwe.M(bwe.InvalidEntity, "[thin] RegistryVK is not a key")
+	}
+	rv := &thinChain{
+		target:   cfg.Thin.Registry,
+		vk:       vk,
+		interval: time.Duration(cfg.Thin.HeadInterval) * time.Second,
+		shutdown: make(chan bool, 1),
+		waiting:  make(map[uint64]chan *nativeFrame),
+		heads:    make(map[chan *types.Header]struct{}),
+		prove:    !cfg.Thin.TrustRegistry,
+		verified: make(map[uint64]common.Hash),
+	}
+	if rv.prove {
+		rv.pow = ethash.New("", 1, 0, "", 0, 0)
+	}
+	if rv.interval <= 0 {
+		rv.interval = defaultThinHeadInterval
+	}
+	rv.ctx, rv.cancel = context.WithCancel(context.Background())
+	if err := rv.refreshHead(); err != nil {
+		log.Warnf("thin router could not reach the registry at %s: %v", rv.target, err)
+	}
+	go rv.followHead()
+	return rv, rv.shutdown, nil
+}
+
+//connection returns the connection to the registry, dialing it if there
+//is none
+func (t *thinChain) connection() (*tls.Conn, error) {
+	t.mu.Lock()
+	if t.conn != nil {
+		defer t.mu.Unlock()
+		return t.conn, nil
+	}
+	t.mu.Unlock()
+	conn, err := dialPeer(t.target, t.vk, drCheckTimeout)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		conn.Close()
+		return t.conn, nil
+	}
+	t.conn = conn
+	go t.rxloop(conn)
+	return conn, nil
+}
+
+func (t *thinChain) rxloop(conn *tls.Conn) {
+	for {
+		nf, err := readNativeFrame(conn, maxNativeFrame)
+		if err != nil {
+			conn.Close()
+			t.mu.Lock()
+			if t.conn == conn {
+				t.conn = nil
+			}
+			for seqno, ch := range t.waiting {
+				close(ch)
+				delete(t.waiting, seqno)
+			}
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Lock()
+		ch, ok := t.waiting[nf.seqno]
+		delete(t.waiting, nf.seqno)
+		t.mu.Unlock()
+		if ok {
+			ch <- nf
+		}
+	}
+}
+
+//query sends a query to the registry and waits for its answer
+func (t *thinChain) query(ctx context.Context, q *registryQuery) (*registryAnswer, error) {
+	q.Prove = t.prove
+	body, err := msgpack.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.connection()
+	if err != nil {
+		return nil, bwe.WrapM(bwe.PeerError, "could not reach the registry", err)
+	}
+	ch := make(chan *nativeFrame, 1)
+	hdr := make([]byte, 17)
+	t.mu.Lock()
+	t.seqno++
+	seqno := t.seqno
+	t.waiting[seqno] = ch
+	binary.LittleEndian.PutUint64(hdr, uint64(len(body)))
+	binary.LittleEndian.PutUint64(hdr[8:], seqno)
+	hdr[16] = nCmdRegistry
+	_, err = conn.Write(append(hdr, body...))
+	t.mu.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, bwe.WrapM(bwe.PeerError, "could not reach the registry", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, thinQueryTimeout)
+	defer cancel()
+	var nf *nativeFrame
+	select {
+	case nf = <-ch:
+	case <-ctx.Done():
+		t.mu.Lock()
+		delete(t.waiting, seqno)
+		t.mu.Unlock()
+		return nil, bwe.M(bwe.PeerError, "the registry did not answer in time")
+	}
+	if nf == nil {
+		return nil, bwe.M(bwe.PeerError, "lost the connection to the registry")
+	}
+	switch nf.cmd {
+	case nCmdResult:
+		ans := &registryAnswer{}
+		if err := msgpack.Unmarshal(nf.body, ans); err != nil {
+			return nil, bwe.WrapM(bwe.PeerError, "bad answer from the registry", err)
+		}
+		if t.prove {
+			if err := t.checkAnswer(q, ans); err != nil {
+				log.Warnf("thin router rejected an answer from the registry at %s: %v", t.target, err)
+				return nil, err
+			}
+		}
+		//Only a checked header moves the head on when proofs are used
+		if !t.prove || q.Op == regOpHead {
+			t.noteHead(ans.Head)
+		}
+		return ans, nil
+	case nCmdRStatus:
+		if len(nf.body) >= 2 {
+			return nil, bwe.M(int(binary.LittleEndian.Uint16(nf.body)), string(nf.body[2:]))
+		}
+	}
+	return nil, bwe.M(bwe.PeerError, "unexpected frame from the registry")
+}
+
+//noteHead records the registry's head, telling NewHeads subscribers if it
+//has moved on
+func (t *thinChain) noteHead(h registryHead) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h.Number <= t.head.Number {
+		return
+	}
+	t.head = h
+	hdr := h.header()
+	for hc := range t.heads {
+		select {
+		case hc <- hdr:
+		default:
+		}
+	}
+}
+
+func (t *thinChain) refreshHead() error {
+	_, err := t.query(t.ctx, &registryQuery{Op: regOpHead})
+	return err
+}
+
+func (t *thinChain) followHead() {
+	for {
+		select {
+		case <-time.After(t.interval):
+		case <-t.ctx.Done():
+			return
+		}
+		if err := t.refreshHead(); err != nil {
+			log.Warnf("thin router could not reach the registry at %s: %v", t.target, err)
+		}
+	}
+}
+
+func (h registryHead) header() *types.Header {
+	return &types.Header{
+		Number:     new(big.Int).SetUint64(h.Number),
+		Time:       big.NewInt(h.Time),
+		Difficulty: big.NewInt(h.Difficulty),
+	}
+}
+
+//Shutdown closes the connection to the registry
+func (t *thinChain) Shutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() != nil {
+		return
+	}
+	t.cancel()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.shutdown <- true
+}
+
+func (t *thinChain) ENode() string { return "" }
+
+//GetClient returns a client that cannot send transactions
+func (t *thinChain) GetClient(e *objects.Entity) bc.BlockChainClient {
+	return &thinClient{}
+}
+
+//HeadBlockAge is the age of the registry's head. Until the registry has
+//answered, the chain looks as stale as it can be
+func (t *thinChain) HeadBlockAge() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Unix() - t.head.Time
+}
+
+func (t *thinChain) GetAddrBalance(ctx context.Context, addr string) (string, string, error) {
+	return "", "", errThin
+}
+
+//ChainID is zero, the registry applies its own [contracts]
+func (t *thinChain) ChainID() *big.Int { return new(big.Int) }
+
+func (t *thinChain) GetCode(ctx context.Context, addr string) ([]byte, error) {
+	return nil, errThin
+}
+
+//GetBlock returns the block's number and time, without logs
+func (t *thinChain) GetBlock(height uint64) *bc.Block {
+	h := t.GetHeader(height)
+	if h == nil {
+		return nil
+	}
+	return &bc.Block{Number: height, Time: h.Time.Int64(), Difficulty: h.Difficulty.Uint64()}
+}
+
+func (t *thinChain) GetHeader(height uint64) *types.Header {
+	t.mu.Lock()
+	head := t.head
+	t.mu.Unlock()
+	if height == head.Number {
+		return head.header()
+	}
+	if height == 0 || height > head.Number {
+		return nil
+	}
+	ans, err := t.query(t.ctx, &registryQuery{Op: regOpHead, Block: height})
+	if err != nil {
+		return nil
+	}
+	return ans.Head.header()
+}
+
+func (t *thinChain) NewHeads(ctx context.Context) chan *types.Header {
+	rv := make(chan *types.Header, 100)
+	t.mu.Lock()
+	t.heads[rv] = struct{}{}
+	t.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		t.mu.Lock()
+		delete(t.heads, rv)
+		t.mu.Unlock()
+		close(rv)
+	}()
+	return rv
+}
+
+func (t *thinChain) AfterBlocks(ctx context.Context, n uint64) chan bool {
+	rv := make(chan bool, 1)
+	target := t.CurrentBlock() + n
+	octx, cancel := context.WithCancel(ctx)
+	hdrs := t.NewHeads(octx)
+	go func() {
+		defer cancel()
+		for {
+			if t.CurrentBlock() >= target {
+				rv <- true
+				return
+			}
+			if _, ok := <-hdrs; !ok {
+				rv <- false
+				return
+			}
+		}
+	}()
+	return rv
+}
+
+//SyncProgress counts the registry as the only peer
+func (t *thinChain) SyncProgress() (int, uint64, uint64, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := 0
+	if t.conn != nil {
+		peers = 1
+	}
+	return peers, 0, t.head.Number, t.head.Number
+}
+
+func (t *thinChain) CurrentBlock() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.head.Number
+}
+
+func (t *thinChain) CallOffChain(ctx context.Context, ufi bc.UFI, params ...interface{}) ([]interface{}, error) {
+	return nil, errThin
+}
+
+func (t *thinChain) CallOffSpecificChain(ctx context.Context, block int64, ufi bc.UFI, params ...interface{}) ([]interface{}, error) {
+	return nil, errThin
+}
+
+func (t *thinChain) GasPrice(ctx context.Context) (*big.Int, error) {
+	return nil, errThin
+}
+
+//FindLogsBetweenHeavy only finds logs in the last maxRegistryLogBlocks
+//blocks before the end of the range
+func (t *thinChain) FindLogsBetweenHeavy(ctx context.Context, after int64, before int64, addr common.Address, topics [][]common.Hash) ([]bc.Log, error) {
+	if before < 0 {
+		before = int64(t.CurrentBlock())
+	}
+	if before-after > maxRegistryLogBlocks {
+		after = before - maxRegistryLogBlocks
+	}
+	q := &registryQuery{Op: regOpLogs, After: after, Before: before, Address: addr[:]}
+	for _, opts := range topics {
+		var qopts [][]byte
+		for _, h := range opts {
+			qopts = append(qopts, append([]byte{}, h[:]...))
+		}
+		q.Topics = append(q.Topics, qopts)
+	}
+	ans, err := t.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]bc.Log, 0, len(ans.Logs))
+	for _, l := range ans.Logs {
+		lg := &types.Log{
+			Address:     common.BytesToAddress(l.Address),
+			Data:        l.Data,
+			BlockNumber: l.Block,
+			TxHash:      common.BytesToHash(l.TxHash),
+			BlockHash:   common.BytesToHash(l.BlockHash),
+		}
+		for _, tp := range l.Topics {
+			lg.Topics = append(lg.Topics, common.BytesToHash(tp))
+		}
+		rv = append(rv, bc.WrapLog(lg))
+	}
+	return rv, nil
+}
+
+func (t *thinChain) FindRoutingOffers(ctx context.Context, nsvk []byte) ([][]byte, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpOffers, Key: nsvk})
+	if err != nil {
+		return nil, err
+	}
+	return ans.Keys, nil
+}
+
+func (t *thinChain) FindRoutingAffinities(ctx context.Context, drvk []byte) ([][]byte, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpAffinities, Key: drvk})
+	if err != nil {
+		return nil, err
+	}
+	return ans.Keys, nil
+}
+
+func (t *thinChain) GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpDR, Key: nsvk})
+	if err != nil {
+		return nil, err
+	}
+	if len(ans.Keys) != 1 {
+		return nil, bwe.M(bwe.PeerError, "bad answer from the registry")
+	}
+	return ans.Keys[0], nil
+}
+
+func (t *thinChain) GetSRVRecordFor(ctx context.Context, drvk []byte) (string, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpSRV, Key: drvk})
+	if err != nil {
+		return "", err
+	}
+	return ans.Text, nil
+}
+
+//errWrongObject is returned if the registry sends an object other than the
+//one asked for, or one with a bad signature
+var errWrongObject = bwe.M(bwe.ResolutionFailed, "the registry sent a different or invalid object")
+
+func (t *thinChain) ResolveDOT(ctx context.Context, dothash []byte) (*objects.DOT, int, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpDOT, Key: dothash})
+	if err != nil {
+		return nil, bc.StateError, err
+	}
+	if ans.Object == nil {
+		return nil, ans.State, nil
+	}
+	ro, err := objects.NewDOT(objects.ROAccessDOT, ans.Object)
+	if err != nil {
+		return nil, bc.StateError, errWrongObject
+	}
+	d := ro.(*objects.DOT)
+	if !bytes.Equal(d.GetHash(), dothash) || !d.SigValid() {
+		return nil, bc.StateError, errWrongObject
+	}
+	return d, ans.State, nil
+}
+
+func (t *thinChain) ResolveEntity(ctx context.Context, vk []byte) (*objects.Entity, int, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpEntity, Key: vk})
+	if err != nil {
+		return nil, bc.StateError, err
+	}
+	if ans.Object == nil {
+		return nil, ans.State, nil
+	}
+	ro, err := objects.NewEntity(objects.ROEntity, ans.Object)
+	if err != nil {
+		return nil, bc.StateError, errWrongObject
+	}
+	e := ro.(*objects.Entity)
+	if !bytes.Equal(e.GetVK(), vk) || !e.SigValid() {
+		return nil, bc.StateError, errWrongObject
+	}
+	return e, ans.State, nil
+}
+
+func (t *thinChain) ResolveAccessDChain(ctx context.Context, chainhash []byte) (*objects.DChain, int, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpChain, Key: chainhash})
+	if err != nil {
+		return nil, bc.StateError, err
+	}
+	if ans.Object == nil {
+		return nil, ans.State, nil
+	}
+	ro, err := objects.NewDChain(objects.ROAccessDChain, ans.Object)
+	if err != nil {
+		return nil, bc.StateError, errWrongObject
+	}
+	dc := ro.(*objects.DChain)
+	if !bytes.Equal(dc.GetChainHash(), chainhash) {
+		return nil, bc.StateError, errWrongObject
+	}
+	return dc, ans.State, nil
+}
+
+func (t *thinChain) ResolveDOTsFromVK(ctx context.Context, vk bc.Bytes32) ([]bc.Bytes32, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: regOpDOTsFrom, Key: vk[:]})
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]bc.Bytes32, 0, len(ans.Keys))
+	for _, k := range ans.Keys {
+		rv = append(rv, bc.SliceToBytes32(k))
+	}
+	return rv, nil
+}
+
+func (t *thinChain) ResolveShortAlias(ctx context.Context, alias uint64) (bc.Bytes32, bool, error) {
+	return t.ResolveAlias(ctx, bc.ShortAliasKey(alias))
+}
+
+func (t *thinChain) ResolveAlias(ctx context.Context, key bc.Bytes32) (bc.Bytes32, bool, error) {
+	return t.aliasQuery(ctx, regOpAlias, key)
+}
+
+func (t *thinChain) UnresolveAlias(ctx context.Context, value bc.Bytes32) (bc.Bytes32, bool, error) {
+	return t.aliasQuery(ctx, regOpUnalias, value)
+}
+
+func (t *thinChain) aliasQuery(ctx context.Context, op string, k bc.Bytes32) (bc.Bytes32, bool, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: op, Key: k[:]})
+	if err != nil {
+		return bc.Bytes32{}, false, err
+	}
+	if len(ans.Keys) != 1 || len(ans.Keys[0]) > 32 {
+		return bc.Bytes32{}, false, bwe.M(bwe.PeerError, "bad answer from the registry")
+	}
+	return bc.SliceToBytes32(ans.Keys[0]), ans.Zero, nil
+}
+
+func (t *thinChain) AliasOwner(ctx context.Context, key bc.Bytes32) (bc.Address, error) {
+	o, _, err := t.aliasQuery(ctx, regOpAliasOwner, key)
+	if err != nil {
+		return bc.Address{}, err
+	}
+	return bc.Address(common.BytesToAddress(o[:])), nil
+}
+
+func (t *thinChain) FindAliasesFor(ctx context.Context, value bc.Bytes32) ([]*bc.AliasRecord, error) {
+	return t.aliasesQuery(ctx, regOpAliasesFor, value[:])
+}
+
+func (t *thinChain) FindAliasesOwnedBy(ctx context.Context, addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	rv := []*bc.AliasRecord{}
+	for _, a := range addrs {
+		recs, err := t.aliasesQuery(ctx, regOpOwnedBy, a[:])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recs {
+			r.Owner = a
+		}
+		rv = append(rv, recs...)
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].BlockNumber < rv[j].BlockNumber
+	})
+	return rv, nil
+}
+
+func (t *thinChain) aliasesQuery(ctx context.Context, op string, k []byte) ([]*bc.AliasRecord, error) {
+	ans, err := t.query(ctx, &registryQuery{Op: op, Key: k})
+	if err != nil {
+		return nil, err
+	}
+	rv := []*bc.AliasRecord{}
+	for _, a := range ans.Aliases {
+		if len(a.Key) > 32 || len(a.Value) > 32 {
+			return nil, bwe.M(bwe.PeerError, "bad answer from the registry")
+		}
+		rv = append(rv, &bc.AliasRecord{
+			Key:         bc.SliceToBytes32(a.Key),
+			Value:       bc.SliceToBytes32(a.Value),
+			BlockNumber: a.BlockNumber,
+			TxHash:      common.BytesToHash(a.TxHash),
+		})
+	}
+	return rv, nil
+}
+
+func (t *thinChain) FindAliasesCreatedBy(ctx context.Context, addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	return nil, errThin
+}
+
+func (t *thinChain) GetAffinityNSNonce(ctx context.Context, nsvk []byte) (*big.Int, error) {
+	return nil, errThin
+}
+
+func (t *thinChain) GetTxParams(ctx context.Context, addr bc.Address) (*bc.OfflineTx, error) {
+	return nil, errThin
+}
+
+func (t *thinChain) SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error) {
+	return common.Hash{}, errThin
+}
+
+func (t *thinChain) WaitForTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(nil, errThin)
+}
+
+func (t *thinChain) WatchTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64) <-chan bc.TxEvent {
+	rv := make(chan bc.TxEvent, 1)
+	rv <- bc.TxEvent{Kind: bc.TxEventFailed, TxHash: txhash, Err: errThin}
+	close(rv)
+	return rv
+}
+
+//thinClient is the client of a thinChain. Everything that needs an
+//account fails
+type thinClient struct{}
+
+func (tc *thinClient) SetEntity(e *objects.Entity)         {}
+func (tc *thinClient) SetDefaultConfirmations(c uint64)    {}
+func (tc *thinClient) SetDefaultTimeout(c uint64)          {}
+func (tc *thinClient) SetMaxGasPrice(p *big.Int)           {}
+func (tc *thinClient) GetDefaultConfirmations() uint64     { return 0 }
+func (tc *thinClient) GetDefaultTimeout() uint64           { return 0 }
+func (tc *thinClient) GetMaxGasPrice() *big.Int            { return new(big.Int) }
+func (tc *thinClient) SetRetryPolicy(p bc.RetryPolicy)     {}
+func (tc *thinClient) GetRetryPolicy() bc.RetryPolicy      { return bc.RetryPolicy{MaxAttempts: 1} }
+func (tc *thinClient) GetAddresses() ([]bc.Address, error) { return nil, errThin }
+
+func (tc *thinClient) WithInteractionParams(p *bc.InteractionParams) bc.BlockChainClient {
+	return tc
+}
+
+func (tc *thinClient) GetAddress(idx int) (bc.Address, error) {
+	return bc.Address{}, errThin
+}
+
+func (tc *thinClient) CallOnChain(ctx context.Context, account int, ufi bc.UFI, value, gas, gasPrice string, params ...interface{}) (common.Hash, error) {
+	return common.Hash{}, errThin
+}
+
+func (tc *thinClient) Transact(ctx context.Context, fromacc int, to, value, gas, gasPrice string, code []byte) (common.Hash, error) {
+	return common.Hash{}, errThin
+}
+
+func (tc *thinClient) TransactAndCheck(ctx context.Context, fromacc int, to, value, gas, gasPrice string, code []byte, confirmed func(error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) GetBalance(ctx context.Context, idx int) (string, string, error) {
+	return "", "", errThin
+}
+
+func (tc *thinClient) CreateRoutingOffer(ctx context.Context, acc int, dr *objects.Entity, nsvk []byte, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) AcceptRoutingOffer(ctx context.Context, acc int, ns *objects.Entity, drvk []byte, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) RetractRoutingAcceptance(ctx context.Context, acc int, ns *objects.Entity, drvk []byte, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) RetractRoutingOffer(ctx context.Context, acc int, dr *objects.Entity, nsvk []byte, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) CreateSRVRecord(ctx context.Context, acc int, dr *objects.Entity, record string, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(nil, errThin)
+}
+
+func (tc *thinClient) PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(nil, errThin)
+}
+
+func (tc *thinClient) PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(nil, errThin)
+}
+
+func (tc *thinClient) EstimateAccessDChain(ctx context.Context, acc int, chain *objects.DChain) (*bc.TxCost, error) {
+	return nil, errThin
+}
+
+func (tc *thinClient) PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(nil, errThin)
+}
+
+func (tc *thinClient) CreateShortAlias(ctx context.Context, acc int, val bc.Bytes32, confirmed func(alias uint64, err error)) {
+	confirmed(0, errThin)
+}
+
+func (tc *thinClient) SetAlias(ctx context.Context, acc int, key bc.Bytes32, val bc.Bytes32, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) UpdateAlias(ctx context.Context, acc int, key bc.Bytes32, val bc.Bytes32, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) TransferAlias(ctx context.Context, acc int, key bc.Bytes32, to bc.Address, confirmed func(err error)) {
+	confirmed(errThin)
+}
+
+func (tc *thinClient) DeleteAlias(ctx context.Context, acc int, key bc.Bytes32, confirmed func(err error)) {
+	confirmed(errThin)
+}
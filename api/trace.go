@@ -0,0 +1,25 @@
+package api
+
+import (
+	"time"
+
+	"github.com/immesys/bw2/internal/core"
+)
+
+//traceHop appends this router's hop to a traced message. The queue latency
+//is the time since since, or if that is zero, since this router's previous
+//hop on the message. Messages that are not traced are returned as is
+func (bw *BW) traceHop(m *core.Message, since time.Time) *core.Message {
+	if m == nil || !m.IsTraced() {
+		return m
+	}
+	vk := bw.Entity.GetVK()
+	if since.IsZero() {
+		since = m.LastTraceHopBy(vk)
+	}
+	var queued time.Duration
+	if !since.IsZero() {
+		queued = time.Since(since)
+	}
+	return m.WithTraceHop(bw.Entity.GetSK(), vk, queued)
+}
@@ -0,0 +1,370 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//How many transformed messages each rule remembers, so that a message is
+//transformed once however many subscribers it is delivered to
+const transformCacheSize = 1024
+
+//A Transform changes the payload objects of a message on a topic before it
+//is delivered, returning false to drop the message. It must not modify the
+//payload objects it is given, and is called once for each message
+type Transform func(topic string, pos []objects.PayloadObject) ([]objects.PayloadObject, bool)
+
+//A TransformMaker makes a Transform from the argument it is given in the
+//config, which is empty if there is none
+type TransformMaker func(arg string) (Transform, error)
+
+var transformMakersMu sync.Mutex
+var transformMakers = map[string]TransformMaker{
+	"strip":      makeStripTransform,
+	"downsample": makeDownsampleTransform,
+	"redact":     makeRedactTransform,
+}
+
+//RegisterTransform makes a transform usable in the Apply of [transform]
+//sections as name or name:arg. It must be called before the router is
+//started, and replaces any transform of the same name
+func RegisterTransform(name string, mk TransformMaker) {
+	transformMakersMu.Lock()
+	transformMakers[name] = mk
+	transformMakersMu.Unlock()
+}
+
+//strip:<ponum mask> removes the payload objects matching the mask
+func makeStripTransform(arg string) (Transform, error) {
+	pm, err := objects.ParsePONumMatch(arg)
+	if err != nil {
+		return nil, err
+	}
+	return func(topic string, pos []objects.PayloadObject) ([]objects.PayloadObject, bool) {
+		rv := make([]objects.PayloadObject, 0, len(pos))
+		for _, po := range pos {
+			if !pm.Matches(po.GetPONum()) {
+				rv = append(rv, po)
+			}
+		}
+		return rv, true
+	}, nil
+}
+
+//downsample:<n> delivers one in every n messages on each topic
+func makeDownsampleTransform(arg string) (Transform, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("downsample needs a positive count, not %q", arg)
+	}
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	return func(topic string, pos []objects.PayloadObject) ([]objects.PayloadObject, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		count := seen[topic]
+		seen[topic] = (count + 1) % n
+		return pos, count == 0
+	}, nil
+}
+
+//redact:<field> deletes a dotted field from the payload objects that are
+//msgpack maps
+func makeRedactTransform(arg string) (Transform, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("redact needs a field")
+	}
+	path := strings.Split(arg, ".")
+	return func(topic string, pos []objects.PayloadObject) ([]objects.PayloadObject, bool) {
+		rv := make([]objects.PayloadObject, 0, len(pos))
+		for _, po := range pos {
+			var doc interface{}
+			if msgpack.Unmarshal(po.GetContent(), &doc) != nil || !deleteField(doc, path) {
+				rv = append(rv, po)
+				continue
+			}
+			content, err := msgpack.Marshal(doc)
+			if err != nil {
+				continue
+			}
+			npo, err := objects.CreateOpaquePayloadObject(po.GetPONum(), content)
+			if err != nil {
+				continue
+			}
+			rv = append(rv, npo)
+		}
+		return rv, true
+	}, nil
+}
+
+//deleteField deletes the field at path from nested msgpack maps, returning
+//false if it is not there
+func deleteField(doc interface{}, path []string) bool {
+	switch d := doc.(type) {
+	case map[interface{}]interface{}:
+		if len(path) == 1 {
+			_, ok := d[path[0]]
+			delete(d, path[0])
+			return ok
+		}
+		return deleteField(d[path[0]], path[1:])
+	case map[string]interface{}:
+		if len(path) == 1 {
+			_, ok := d[path[0]]
+			delete(d, path[0])
+			return ok
+		}
+		return deleteField(d[path[0]], path[1:])
+	}
+	return false
+}
+
+//transformRule is a [transform] section
+type transformRule struct {
+	name   string
+	ns     string
+	suffix string
+	unless *objects.AccessDOTPermissionSet
+	steps  []Transform
+
+	mu  sync.Mutex
+	mvk []byte
+	//Keyed by the signature of the original message
+	recent map[string]*transformedMessage
+	//So that a router without a chain to sign with warns once
+	warned bool
+}
+
+type transformedMessage struct {
+	once sync.Once
+	//nil if the message is dropped
+	m *core.Message
+}
+
+type transforms struct {
+	rules []*transformRule
+	cl    *BosswaveClient
+}
+
+//startTransforms loads the [transform "name"] sections of the config.
+//Messages on a topic matching Pattern are transformed by each of Apply in
+//turn before they are delivered to the subscribers whose chain does not
+//grant Unless. Transformed messages are signed by the router entity, which
+//needs P on Pattern, so that routers further on can verify them
+func (bw *BW) startTransforms() {
+	if len(bw.Config.Transform) == 0 {
+		return
+	}
+	tr := &transforms{cl: bw.CreateClient(context.Background(), "TRANSFORM")}
+	if err := tr.cl.SetEntityObj(bw.Entity); err != nil {
+		log.Errorf("transform: could not use router entity: %v", err)
+		return
+	}
+	transformMakersMu.Lock()
+	defer transformMakersMu.Unlock()
+	for name, cfg := range bw.Config.Transform {
+		if cfg == nil {
+			continue
+		}
+		rule, err := newTransformRule(name, cfg.Pattern, cfg.Unless, cfg.Apply)
+		if err != nil {
+			log.Errorf("transform %s: %v", name, err)
+			continue
+		}
+		tr.rules = append(tr.rules, rule)
+	}
+	bw.transforms = tr
+}
+
+//newTransformRule parses a rule. The transform makers are locked
+func newTransformRule(name string, pattern string, unless string, apply []string) (*transformRule, error) {
+	ns, suffix, err := util.SplitURI(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad Pattern: %v", err)
+	}
+	rule := &transformRule{
+		name:   name,
+		ns:     ns,
+		suffix: suffix,
+		unless: objects.GetADPSFromPermString(unless),
+		recent: make(map[string]*transformedMessage),
+	}
+	if rule.unless == nil {
+		return nil, fmt.Errorf("bad Unless %q", unless)
+	}
+	if len(apply) == 0 {
+		return nil, fmt.Errorf("nothing to Apply")
+	}
+	for _, a := range apply {
+		parts := strings.SplitN(a, ":", 2)
+		mk, ok := transformMakers[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", parts[0])
+		}
+		arg := ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+		step, err := mk(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", a, err)
+		}
+		rule.steps = append(rule.steps, step)
+	}
+	return rule, nil
+}
+
+//exempts is true if a subscriber with perms gets messages as they are. An
+//empty Unless exempts nobody
+func (rule *transformRule) exempts(perms *objects.AccessDOTPermissionSet) bool {
+	return rule.unless.GetPermString() != "" && rule.unless.IsSubsetOf(perms)
+}
+
+//matches is true if the rule applies to the message's topic. The namespace
+//is resolved the first time it is needed
+func (rule *transformRule) matches(bw *BW, m *core.Message) bool {
+	rule.mu.Lock()
+	mvk := rule.mvk
+	rule.mu.Unlock()
+	if mvk == nil {
+		var err error
+		if mvk, err = bw.ResolveKey(rule.ns); err != nil {
+			return false
+		}
+		rule.mu.Lock()
+		rule.mvk = mvk
+		rule.mu.Unlock()
+	}
+	if string(mvk) != string(m.MVK) {
+		return false
+	}
+	r, ok := util.RestrictBy(m.TopicSuffix, rule.suffix)
+	return ok && r == m.TopicSuffix
+}
+
+//apply returns the transformed message, or nil if it is dropped
+func (rule *transformRule) apply(tr *transforms, m *core.Message) *core.Message {
+	key := string(m.Signature)
+	rule.mu.Lock()
+	t, ok := rule.recent[key]
+	if !ok {
+		if len(rule.recent) >= transformCacheSize {
+			rule.recent = make(map[string]*transformedMessage)
+		}
+		t = &transformedMessage{}
+		rule.recent[key] = t
+	}
+	rule.mu.Unlock()
+	t.once.Do(func() {
+		pos := m.PayloadObjects
+		for _, step := range rule.steps {
+			var kept bool
+			if pos, kept = step(m.TopicSuffix, pos); !kept {
+				return
+			}
+		}
+		nm, err := tr.resign(m, pos)
+		rule.mu.Lock()
+		defer rule.mu.Unlock()
+		if err != nil {
+			//Dropped rather than delivered as it was
+			if !rule.warned {
+				log.Warnf("transform %s: could not sign transformed messages on %s: %v", rule.name, m.Topic, err)
+				rule.warned = true
+			}
+			return
+		}
+		rule.warned = false
+		t.m = nm
+	})
+	return t.m
+}
+
+//resign makes a copy of m with the given payload objects, signed by the
+//router entity
+func (tr *transforms) resign(m *core.Message, pos []objects.PayloadObject) (rv *core.Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rv, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	cl := tr.cl
+	nm, err := cl.newMessage(int(m.Type), m.MVK, m.TopicSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := cl.doAutoChain(m.MVK, m.TopicSuffix, "P", true, &nm.PrimaryAccessChain); err != nil {
+		return nil, err
+	}
+	nm.Consumers = m.Consumers
+	nm.PayloadObjects = pos
+	if err := cl.doPAC(nm, PartialElaboration); err != nil {
+		return nil, err
+	}
+	cl.checkAddOriginVK(nm)
+	if exp, ok := m.Expiry(); ok {
+		nm.RoutingObjects = append(nm.RoutingObjects, objects.CreateNewExpiry(exp))
+	}
+	cl.finishMessage(nm)
+	nm.PersistSeq = m.PersistSeq
+	return nm, nil
+}
+
+//subscriberPerms returns what the chain of a subscribe or tap message
+//grants its subscriber, which is nothing if it cannot be resolved
+func (bw *BW) subscriberPerms(sub *core.Message) *objects.AccessDOTPermissionSet {
+	if sub.OriginVK != nil && string(*sub.OriginVK) == string(sub.MVK) {
+		return objects.GetADPSFromPermString("C*T*PL")
+	}
+	none := &objects.AccessDOTPermissionSet{}
+	pac := sub.PrimaryAccessChain
+	if pac == nil {
+		return none
+	}
+	if pac = core.ElaborateDChain(pac, bw); pac == nil || pac.NumHashes() == 0 {
+		return none
+	}
+	dots := make([]*objects.DOT, pac.NumHashes())
+	for i := range dots {
+		if dots[i] = pac.GetDOT(i); dots[i] == nil {
+			if dots[i], _, _ = bw.ResolveDOT(pac.GetDotHash(i)); dots[i] == nil {
+				return none
+			}
+		}
+	}
+	return objects.ChainPermissionSet(dots)
+}
+
+//transformFor wraps the handler of the subscription sub so that it gets
+//the messages as the [transform] rules have it
+func (bw *BW) transformFor(sub *core.Message, cb func(m *core.Message)) func(m *core.Message) {
+	tr := bw.transforms
+	if tr == nil || len(tr.rules) == 0 {
+		return cb
+	}
+	perms := bw.subscriberPerms(sub)
+	return func(m *core.Message) {
+		if m == nil {
+			cb(nil)
+			return
+		}
+		for _, rule := range tr.rules {
+			if rule.exempts(perms) || !rule.matches(bw, m) {
+				continue
+			}
+			if m = rule.apply(tr, m); m == nil {
+				return
+			}
+		}
+		cb(m)
+	}
+}
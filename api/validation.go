@@ -0,0 +1,51 @@
+package api
+
+import (
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+const (
+	//ValidateOff does not check payloads
+	ValidateOff = "off"
+	//ValidateFlag logs messages with malformed payloads but delivers them
+	ValidateFlag = "flag"
+	//ValidateReject refuses messages with malformed payloads
+	ValidateReject = "reject"
+)
+
+//ValidatePayloads checks a message's payload objects with the validators
+//registered in advpo
+func ValidatePayloads(m *core.Message) error {
+	if err := advpo.ValidateMessage(m); err != nil {
+		return bwe.WrapM(bwe.InvalidPayload, "Malformed payload", err)
+	}
+	return nil
+}
+
+func (bw *BW) validateMode() string {
+	if bw.Config.Router.ValidatePayloads == "" {
+		return ValidateOff
+	}
+	return bw.Config.Router.ValidatePayloads
+}
+
+//checkPayloads applies the router's validation mode to a publish or
+//persist that this router is delivering as the designated router
+func (bw *BW) checkPayloads(m *core.Message) error {
+	mode := bw.validateMode()
+	if mode == ValidateOff {
+		return nil
+	}
+	err := ValidatePayloads(m)
+	if err == nil {
+		return nil
+	}
+	if mode == ValidateReject {
+		return err
+	}
+	log.Warnf("message on %s has a malformed payload: %v", m.Topic, err)
+	return nil
+}
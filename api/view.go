@@ -1,15 +1,18 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/objects/advpo"
@@ -17,6 +20,13 @@ import (
 	"github.com/immesys/bw2/util/bwe"
 )
 
+//metaTopicRe splits a metadata topic into the URI and the key
+var metaTopicRe = regexp.MustCompile("^(.*)/!meta/([^/]*)$")
+
+//interfaceURIRe finds the interface in a URI, with the groups being the
+//interface URI, namespace, service prefix, service, prefix and interface
+var interfaceURIRe = regexp.MustCompile(`^(([^/]+)(/.*)?/(s\.[^/]+)/([^/]+)/(i\.[^/]+)).*$`)
+
 type View struct {
 	c         *BosswaveClient
 	ex        Expression
@@ -27,9 +37,16 @@ type View struct {
 	msloaded  bool
 	changecb  []func()
 	matchset  []*InterfaceDescription
+	journal   viewJournal
+	metasubs  []core.UniqueMessageID
+	torndown  bool
+	hosted    *hostedView
 
 	subs  []*vsub
 	submu sync.Mutex
+
+	//The stop functions of the heartbeats run through the view
+	heartbeats []func()
 }
 
 const (
@@ -41,6 +58,11 @@ const (
 	stateToRemove
 )
 
+//umidHistory is how many recent message IDs a view subscription remembers
+//so that a message matched by more than one of its subscriptions is only
+//delivered once
+const umidHistory = 256
+
 type vsub struct {
 	iface    string
 	sigslot  string
@@ -49,6 +71,8 @@ type vsub struct {
 	actual   []*vsubsub
 	v        *View
 	mu       sync.Mutex
+	seen     map[core.UniqueMessageID]bool
+	seenq    []core.UniqueMessageID
 }
 
 // The expression tree can be used to construct a view using a simple syntax.
@@ -59,16 +83,38 @@ If the top object is a list, all the clauses are ANDED together
 or {uri:"matchpattern"}
 or {uri:{$re:"regexpattern"}}
 or {meta:{"key":"value"}}
+or {meta:{"key":{$prefix:"value"}}} (also $re, and $gt or $lt with a number)
+or {$not:{...}}
 //or {svc:"servicename"}
 //or {iface:"ifacename"}
 or {uri:{$or:{$re:..}}}
 
 */
-func _parseURI(t interface{}) (Expression, error) {
+//stringMap converts the maps made by the msgpack and JSON decoders to the
+//same type
+func stringMap(t interface{}) (map[string]interface{}, bool) {
 	switch t := t.(type) {
-	case string:
-		return MatchURI(t), nil
+	case map[string]interface{}:
+		return t, true
 	case map[interface{}]interface{}:
+		rv := make(map[string]interface{}, len(t))
+		for ikey, el := range t {
+			key, ok := ikey.(string)
+			if !ok {
+				return nil, false
+			}
+			rv[key] = el
+		}
+		return rv, true
+	}
+	return nil, false
+}
+
+func _parseURI(t interface{}) (Expression, error) {
+	if s, ok := t.(string); ok {
+		return MatchURI(s), nil
+	}
+	if t, ok := stringMap(t); ok {
 		ipat, ok := t["$re"]
 		if len(t) > 1 || !ok {
 			return nil, fmt.Errorf("unexpected keys in uri filter")
@@ -77,21 +123,33 @@ func _parseURI(t interface{}) (Expression, error) {
 		if !ok {
 			return nil, fmt.Errorf("expected string $re pattern")
 		}
+		if _, err := cachedRegexp(pat); err != nil {
+			return nil, fmt.Errorf("bad $re pattern: %v", err)
+		}
 		return RegexURI(pat), nil
 	}
 	return nil, fmt.Errorf("unexpected URI structure: %T : %#v", t, t)
 }
 func _parseMeta(t interface{}) (Expression, error) {
 	//fmt.Printf("Parsing meta: %#v", t)
-	m, ok := t.(map[interface{}]interface{})
+	m, ok := stringMap(t)
 	if !ok {
 		return nil, fmt.Errorf("unexpected meta structure %T : %#v", t, t)
 	}
 	rv := []Expression{}
-	for ikey, value := range m {
-		key, ok1 := ikey.(string)
-		valueS, ok2 := value.(string)
-		if !ok1 || !ok2 {
+	for key, value := range m {
+		if cmp, ok := stringMap(value); ok && key != "$has" {
+			for op, operand := range cmp {
+				subex, err := _parseMetaCmp(key, op, operand)
+				if err != nil {
+					return nil, err
+				}
+				rv = append(rv, subex)
+			}
+			continue
+		}
+		valueS, ok := value.(string)
+		if !ok {
 			return nil, fmt.Errorf("expected map[string]string")
 		}
 		switch key {
@@ -104,6 +162,63 @@ func _parseMeta(t interface{}) (Expression, error) {
 	}
 	return And(rv...), nil
 }
+
+//_parseMetaCmp parses one comparison in {meta:{"key":{op:operand}}}
+func _parseMetaCmp(key, op string, operand interface{}) (Expression, error) {
+	switch op {
+	case metaCmpPrefix, metaCmpRegex:
+		s, ok := operand.(string)
+		if !ok {
+			return nil, fmt.Errorf("operand to %s must be a string", op)
+		}
+		if op == metaCmpPrefix {
+			return PrefixMeta(key, s), nil
+		}
+		if _, err := cachedRegexp(s); err != nil {
+			return nil, fmt.Errorf("bad $re pattern: %v", err)
+		}
+		return RegexMeta(key, s), nil
+	case metaCmpGt, metaCmpLt:
+		n, ok := toFloat(operand)
+		if !ok {
+			return nil, fmt.Errorf("operand to %s must be a number", op)
+		}
+		if op == metaCmpGt {
+			return GtMeta(key, n), nil
+		}
+		return LtMeta(key, n), nil
+	}
+	return nil, fmt.Errorf("unexpected metadata comparison '%s'", op)
+}
+
+//toFloat converts the numbers made by the msgpack and JSON decoders
+func toFloat(t interface{}) (float64, bool) {
+	switch n := t.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	}
+	return 0, false
+}
 func _parseSvc(t interface{}) (Expression, error) {
 	panic("oops")
 }
@@ -208,6 +323,12 @@ func _parseGlobal(t interface{}) (Expression, error) {
 				}
 			}
 			rv = append(rv, Or(subex...))
+		case "$not":
+			subex, err := _parseGlobal(el)
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, Not(subex))
 		default:
 			return nil, fmt.Errorf("unexpected key at this scope: '%s'", key)
 		}
@@ -219,6 +340,26 @@ func ExpressionFromTree(t interface{}) (Expression, error) {
 	return _parseGlobal(t)
 }
 
+//ExpressionFromMsgPack parses an expression tree in msgpack form
+func ExpressionFromMsgPack(blob []byte) (Expression, error) {
+	var v map[string]interface{}
+	err := msgpack.Unmarshal(blob, &v)
+	if err != nil {
+		return nil, err
+	}
+	return ExpressionFromTree(v)
+}
+
+//ExpressionFromJSON parses an expression tree in JSON form
+func ExpressionFromJSON(blob []byte) (Expression, error) {
+	var v map[string]interface{}
+	err := json.Unmarshal(blob, &v)
+	if err != nil {
+		return nil, err
+	}
+	return ExpressionFromTree(v)
+}
+
 // Get the given key for the given fully qualified URI (including ns)
 func (v *View) Meta(ruri, key string) (*advpo.MetadataTuple, bool) {
 	//TODO going forward, when metadata sub is driven by canonical
@@ -273,6 +414,62 @@ func (v *View) AllMeta(ruri string) map[string]*advpo.MetadataTuple {
 	return rv
 }
 
+//SetMeta sets a metadata key on a fully qualified URI by persisting it to
+//uri/!meta/key. Views that match the URI see the change once it is routed
+func (v *View) SetMeta(ruri, key, value string, cb func(error)) {
+	v.c.SetMeta(ruri, key, value, cb)
+}
+
+//DelMeta deletes a metadata key from a fully qualified URI. Like bw2bind,
+//this persists a message with no metadata, which views treat as a delete
+func (v *View) DelMeta(ruri, key string, cb func(error)) {
+	v.c.publishMeta(ruri, key, nil, cb)
+}
+
+//SetMeta sets a metadata key on a fully qualified URI, as View.SetMeta
+//does, without needing a view
+func (c *BosswaveClient) SetMeta(ruri, key, value string, cb func(error)) {
+	po := advpo.CreateMetadataPayloadObject(&advpo.MetadataTuple{
+		Value:     value,
+		Timestamp: time.Now().UnixNano(),
+	})
+	c.publishMeta(ruri, key, []objects.PayloadObject{po}, cb)
+}
+
+func (c *BosswaveClient) publishMeta(ruri, key string, poz []objects.PayloadObject, cb func(error)) {
+	if key == "" || strings.ContainsAny(key, "/+*!") {
+		cb(bwe.M(bwe.BadURI, "Invalid metadata key"))
+		return
+	}
+	ns, suffix, err := util.SplitURI(ruri)
+	if err == nil {
+		suffix, err = util.JoinSuffix(suffix, "!meta", key)
+	}
+	if err != nil {
+		cb(bwe.WrapC(bwe.BadURI, err))
+		return
+	}
+	mvk, err := c.BW().ResolveKey(ns)
+	if err != nil {
+		cb(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err))
+		return
+	}
+	c.Publish(&PublishParams{
+		MVK:            mvk,
+		URISuffix:      suffix,
+		AutoChain:      true,
+		ElaboratePAC:   PartialElaboration,
+		Persist:        true,
+		PayloadObjects: poz,
+	}, func(e error) {
+		if e != nil {
+			cb(bwe.WrapM(bwe.ViewError, "Could not publish metadata", e))
+			return
+		}
+		cb(nil)
+	})
+}
+
 /*
   (a or b) and (c or d)
 */
@@ -291,6 +488,12 @@ func foldAndCanonicalSuffixes(lhs []string, rhsz ...[]string) []string {
 			}
 		}
 	}
+	return foldAndCanonicalSuffixes(minimalSuffixes(retv), rhsz[1:]...)
+}
+
+//minimalSuffixes removes the patterns that are covered by another pattern
+//in the list, keeping the first of identical patterns
+func minimalSuffixes(retv []string) []string {
 	//Now we need to dedup RV
 	// if A restrictBy B == A, then A is redundant and B is superior
 	//                   == B, then B is redundant and A is superior
@@ -320,7 +523,7 @@ func foldAndCanonicalSuffixes(lhs []string, rhsz ...[]string) []string {
 		dedup = append(dedup, retv[out])
 	nextOut:
 	}
-	return foldAndCanonicalSuffixes(dedup, rhsz[1:]...)
+	return dedup
 }
 
 // func Service(name string) Expression {
@@ -331,13 +534,17 @@ func foldAndCanonicalSuffixes(lhs []string, rhsz ...[]string) []string {
 // 	return RegexURI("^.*/" + name + "$")
 // }
 func (c *BosswaveClient) NewViewFromBlob(onready func(error, int), blob []byte) {
-	var v map[string]interface{}
-	err := msgpack.Unmarshal(blob, &v)
+	ex, err := ExpressionFromMsgPack(blob)
 	if err != nil {
 		onready(err, -1)
 		return
 	}
-	ex, err := ExpressionFromTree(v)
+	c.NewView(onready, ex)
+}
+
+//NewViewFromJSON is like NewViewFromBlob, but the expression is in JSON
+func (c *BosswaveClient) NewViewFromJSON(onready func(error, int), blob []byte) {
+	ex, err := ExpressionFromJSON(blob)
 	if err != nil {
 		onready(err, -1)
 		return
@@ -405,7 +612,9 @@ func (v *View) checkMatchset() {
 	}
 
 	if changed {
+		changes := diffInterfaces(v.matchset, newIfaceList)
 		v.matchset = newIfaceList
+		v.recordChanges(changes)
 		v.checkSubs()
 		v.msmu.RLock()
 		for _, cb := range v.changecb {
@@ -415,8 +624,56 @@ func (v *View) checkMatchset() {
 	}
 }
 
+//TearDown unsubscribes the view and drops its callbacks
 func (v *View) TearDown() {
-	//Release all the assets here
+	v.msmu.Lock()
+	if v.torndown {
+		v.msmu.Unlock()
+		return
+	}
+	v.torndown = true
+	metasubs := v.metasubs
+	v.metasubs = nil
+	heartbeats := v.heartbeats
+	v.heartbeats = nil
+	v.msmu.Unlock()
+	for _, stop := range heartbeats {
+		stop()
+	}
+	v.ClearCallbacks()
+	for _, id := range metasubs {
+		v.c.Unsubscribe(id, func(error) {})
+	}
+}
+
+//ClearCallbacks removes the OnChange and OnChangeDiff callbacks and the
+//interface subscriptions, so that a new holder of the view can add its own
+func (v *View) ClearCallbacks() {
+	v.msmu.Lock()
+	v.changecb = nil
+	v.msmu.Unlock()
+	v.journal.mu.Lock()
+	v.journal.cbs = nil
+	v.journal.mu.Unlock()
+	v.submu.Lock()
+	subs := v.subs
+	v.subs = nil
+	v.submu.Unlock()
+	for _, s := range subs {
+		s.mu.Lock()
+		actual := append([]*vsubsub{}, s.actual...)
+		s.mu.Unlock()
+		for _, vss := range actual {
+			if vss.state == stateStartSub || vss.state == stateSubComplete {
+				s.unsub(vss)
+			}
+		}
+	}
+}
+
+//Expression returns the expression the view was made from
+func (v *View) Expression() Expression {
+	return v.ex
 }
 func (v *View) fatal(err error) {
 	//Sometimes an error can happen deep inside a goroutine, this aborts the view
@@ -432,7 +689,7 @@ func (v *View) initMetaView() {
 			//end of subscription.
 			//v.fatal(fmt.Errorf("subscription ended in view"))
 		}
-		groups := regexp.MustCompile("^(.*)/!meta/([^/]*)$").FindStringSubmatch(m.Topic)
+		groups := metaTopicRe.FindStringSubmatch(m.Topic)
 		if groups == nil {
 			fmt.Println("mt is: ", *m.MergedTopic)
 			panic("bad re match")
@@ -464,15 +721,25 @@ func (v *View) initMetaView() {
 		v.checkMatchset()
 	}
 	go func() {
-		//First subscribe and wait for that to finish
-		wg := sync.WaitGroup{}
-		wg.Add(len(v.ns))
+		//Several names can resolve to the same namespace, which would
+		//deliver every metadata change more than once
+		mvks := [][]byte{}
+		seen := make(map[string]bool)
 		for _, n := range v.ns {
 			mvk, err := v.c.bw.ResolveKey(n)
 			if err != nil {
 				v.fatal(err)
 				return
 			}
+			if !seen[crypto.FmtKey(mvk)] {
+				seen[crypto.FmtKey(mvk)] = true
+				mvks = append(mvks, mvk)
+			}
+		}
+		//First subscribe and wait for that to finish
+		wg := sync.WaitGroup{}
+		wg.Add(len(mvks))
+		for _, mvk := range mvks {
 			v.c.Subscribe(&SubscribeParams{
 				MVK:          mvk,
 				URISuffix:    "*/!meta/+",
@@ -483,19 +750,24 @@ func (v *View) initMetaView() {
 				wg.Done()
 				if err != nil {
 					v.fatal(err)
+					return
+				}
+				v.msmu.Lock()
+				torndown := v.torndown
+				if !torndown {
+					v.metasubs = append(v.metasubs, id)
+				}
+				v.msmu.Unlock()
+				if torndown {
+					v.c.Unsubscribe(id, func(error) {})
 				}
 			}, procChange)
 		}
 		wg.Wait()
 		wg = sync.WaitGroup{}
-		wg.Add(len(v.ns))
+		wg.Add(len(mvks))
 		//Then we query
-		for _, n := range v.ns {
-			mvk, err := v.c.bw.ResolveKey(n)
-			if err != nil {
-				v.fatal(err)
-				return
-			}
+		for _, mvk := range mvks {
 			v.c.Query(&QueryParams{
 				MVK:          mvk,
 				URISuffix:    "*/!meta/+",
@@ -525,7 +797,8 @@ func (v *View) initMetaView() {
 }
 
 func (v *View) SubscribeInterface(iface, sigslot string, isSignal bool, reply func(error), result func(m *core.Message)) {
-	s := &vsub{iface: iface, sigslot: sigslot, isSignal: isSignal, result: result, v: v}
+	s := &vsub{iface: iface, sigslot: sigslot, isSignal: isSignal, result: result, v: v,
+		seen: make(map[core.UniqueMessageID]bool)}
 	v.submu.Lock()
 	v.subs = append(v.subs, s)
 	v.submu.Unlock()
@@ -538,71 +811,112 @@ func (v *View) SubscribeInterface(iface, sigslot string, isSignal bool, reply fu
 func (v *View) checkSubs() {
 	v.submu.Lock()
 	for _, s := range v.subs {
-		newVss := v.expandSub(s)
-		intersection := make(map[*InterfaceDescription]bool)
-		tosub := []*InterfaceDescription{}
+		topics := v.subTopics(s)
+		want := make(map[string]bool)
+		for _, t := range topics {
+			want[t] = true
+		}
+		have := make(map[string]bool)
 		toremove := []*vsubsub{}
-		//check for new
-		for _, id := range newVss {
-			//Checking new iterface 'id'
-			foundInExisting := false
-			for _, oid := range s.actual {
-				if oid.id.URI == id.URI {
-					foundInExisting = true
-					intersection[oid.id] = true
-					break
-				}
-			}
-			if !foundInExisting {
-				//this is a new iface
-				tosub = append(tosub, id)
+		s.mu.Lock()
+		for _, vss := range s.actual {
+			if vss.state != stateStartSub && vss.state != stateSubComplete {
+				//Already on its way out
+				continue
 			}
-		}
-		//Check for missing
-		for _, oid := range s.actual {
-			//Skip over entries that we know are in the intersection
-			_, donealready := intersection[oid.id]
-			if donealready {
+			if want[vss.topic] && !have[vss.topic] {
+				have[vss.topic] = true
 				continue
 			}
 			//Ok this is a sub that needs to be removed
-			toremove = append(toremove, oid)
+			toremove = append(toremove, vss)
 		}
+		s.mu.Unlock()
 		for _, vss := range toremove {
 			s.unsub(vss)
 		}
-		for _, vss := range tosub {
-			s.sub(vss)
+		for _, t := range topics {
+			if !have[t] {
+				s.sub(t)
+			}
 		}
 	}
 	v.submu.Unlock()
 }
 
+//subTopics is the minimal set of topics that covers the interfaces a view
+//subscription matches
+func (v *View) subTopics(s *vsub) []string {
+	pfx := "/slot/"
+	if s.isSignal {
+		pfx = "/signal/"
+	}
+	topics := []string{}
+	for _, id := range v.expandSub(s) {
+		topics = append(topics, id.URI+pfx+s.sigslot)
+	}
+	return minimalSuffixes(topics)
+}
+
+//deliver passes a message to the result callback unless it has already
+//been delivered through another of the subscriptions
+func (s *vsub) deliver(m *core.Message) {
+	s.mu.Lock()
+	if s.seen[m.UMid] {
+		s.mu.Unlock()
+		return
+	}
+	s.seen[m.UMid] = true
+	s.seenq = append(s.seenq, m.UMid)
+	if len(s.seenq) > umidHistory {
+		delete(s.seen, s.seenq[0])
+		s.seenq = s.seenq[1:]
+	}
+	s.mu.Unlock()
+	s.result(m)
+}
+
 func (s *vsub) unsub(vss *vsubsub) {
-	if vss.state != stateSubComplete {
+	s.mu.Lock()
+	switch vss.state {
+	case stateStartSub:
+		//It will be removed once the subscribe completes
+		vss.state = stateToRemove
+		s.mu.Unlock()
+		return
+	case stateSubComplete:
+	default:
+		s.mu.Unlock()
 		log.Criticalf("Unsubscribe, but sub is not complete: %d", vss.state)
 		return
 	}
 	vss.state = stateStartUnsub
-	s.v.c.Unsubscribe(vss.subid, func(err error) {
+	subid := vss.subid
+	s.mu.Unlock()
+	s.v.c.Unsubscribe(subid, func(err error) {
 		if err != nil {
 			s.v.fatal(err)
 		}
 	})
 }
-func (s *vsub) sub(id *InterfaceDescription) {
-	vss := &vsubsub{id: id, state: stateStartSub}
-	parts := strings.SplitN(id.URI, "/", 2)
-	mvk, err := s.v.c.BW().ResolveKey(parts[0])
+
+func (s *vsub) sub(topic string) {
+	ns, suffix, err := util.SplitURI(topic)
 	if err != nil {
-		s.v.fatal(err)
+		s.v.fatal(bwe.WrapC(bwe.BadURI, err))
 		return
 	}
-	pfx := "/slot/"
-	if s.isSignal {
-		pfx = "/signal/"
+	mvk, err := s.v.c.BW().ResolveKey(ns)
+	if err != nil {
+		s.v.fatal(err)
+		return
 	}
-	suffix := parts[1] + pfx + s.sigslot
+	//It is added before the subscribe completes so that a matchset change
+	//in the meantime does not subscribe to the topic again
+	vss := &vsubsub{topic: topic, state: stateStartSub}
+	s.mu.Lock()
+	s.actual = append(s.actual, vss)
+	s.mu.Unlock()
 	s.v.c.Subscribe(&SubscribeParams{
 		MVK:          mvk,
 		URISuffix:    suffix,
@@ -615,12 +929,15 @@ func (s *vsub) sub(id *InterfaceDescription) {
 		}
 		s.mu.Lock()
 		vss.subid = id
+		remove := vss.state == stateToRemove
 		vss.state = stateSubComplete
-		s.actual = append(s.actual, vss)
 		s.mu.Unlock()
+		if remove {
+			s.unsub(vss)
+		}
 	}, func(m *core.Message) {
 		if m != nil {
-			s.result(m)
+			s.deliver(m)
 		} else {
 			s.mu.Lock()
 			np := s.actual[:0]
@@ -638,7 +955,7 @@ func (s *vsub) sub(id *InterfaceDescription) {
 }
 
 type vsubsub struct {
-	id    *InterfaceDescription
+	topic string
 	state int
 	subid core.UniqueMessageID
 }
@@ -669,13 +986,19 @@ func (v *View) PublishInterface(iface, sigslot string, isSignal bool, poz []obje
 	}
 	errc := make(chan error, len(todo)+1)
 	for _, viewiface := range todo {
-		parts := strings.SplitN(viewiface.URI, "/", 2)
-		mvk, err := v.c.BW().ResolveKey(parts[0])
+		ns, suffix, err := util.SplitURI(viewiface.URI)
+		if err == nil {
+			suffix, err = util.JoinSuffix(suffix, pfx, sigslot)
+		}
+		if err != nil {
+			cb(bwe.WrapC(bwe.BadURI, err))
+			return
+		}
+		mvk, err := v.c.BW().ResolveKey(ns)
 		if err != nil {
 			cb(err)
 			return
 		}
-		suffix := parts[1] + pfx + sigslot
 		v.c.Publish(&PublishParams{
 			MVK:            mvk,
 			URISuffix:      suffix,
@@ -708,27 +1031,31 @@ func (v *View) interfacesImpl() []*InterfaceDescription {
 	v.msmu.RLock()
 	found := make(map[string]InterfaceDescription)
 	for uri, _ := range v.metastore {
-		if v.ex.Matches(uri, v) {
-			pat := `^(([^/]+)(/.*)?/(s\.[^/]+)/([^/]+)/(i\.[^/]+)).*$`
-			//"^((([^/]+)/(.*)/(s\\.[^/]+)/+)/(i\\.[^/]+)).*$"
-			groups := regexp.MustCompile(pat).FindStringSubmatch(uri)
-			if groups != nil {
-				id := InterfaceDescription{
-					URI:       groups[1],
-					Interface: groups[6],
-					Service:   groups[4],
-					Namespace: groups[2],
-					Prefix:    groups[5],
-					v:         v,
-				}
-				id.Suffix = strings.TrimPrefix(id.URI, id.Namespace+"/")
-				id.Metadata = make(map[string]string)
-				for k, v := range v.AllMeta(id.URI) {
-					id.Metadata[k] = v.Value
-				}
-				found[id.URI] = id
-			}
+		groups := interfaceURIRe.FindStringSubmatch(uri)
+		if groups == nil {
+			continue
+		}
+		//Every URI under an interface describes the same interface
+		if _, ok := found[groups[1]]; ok {
+			continue
+		}
+		if !v.ex.Matches(uri, v) {
+			continue
+		}
+		id := InterfaceDescription{
+			URI:       groups[1],
+			Interface: groups[6],
+			Service:   groups[4],
+			Namespace: groups[2],
+			Prefix:    groups[5],
+			v:         v,
 		}
+		id.Suffix = strings.TrimPrefix(id.URI, id.Namespace+"/")
+		id.Metadata = make(map[string]string)
+		for k, v := range v.AllMeta(id.URI) {
+			id.Metadata[k] = v.Value
+		}
+		found[id.URI] = id
 	}
 	v.msmu.RUnlock()
 	rv := []*InterfaceDescription{}
@@ -802,6 +1129,17 @@ func (id *InterfaceDescription) ToPO() objects.PayloadObject {
 	return po
 }
 
+//SetMeta sets a metadata key on the interface
+func (id *InterfaceDescription) SetMeta(key, value string, cb func(error)) {
+	id.v.SetMeta(id.URI, key, value, cb)
+}
+
+//DelMeta deletes a metadata key from the interface. A key inherited from a
+//parent URI is not affected
+func (id *InterfaceDescription) DelMeta(key string, cb func(error)) {
+	id.v.DelMeta(id.URI, key, cb)
+}
+
 func (id *InterfaceDescription) Meta(key string) string {
 	mdat, ok := id.v.Meta(id.URI, key)
 	if !ok {
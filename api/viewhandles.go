@@ -0,0 +1,223 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//hostedView is a view that runs on its own client, so that it can be
+//handed from one client to another. It is held by at most one client
+type hostedView struct {
+	handle string
+	v      *View
+	host   *BosswaveClient
+	linger time.Duration
+	holder *BosswaveClient
+	//The view's id on the holder
+	holderID int
+	//Incremented each time the view is held, so that a linger timer from an
+	//earlier holder does not tear it down
+	gen   int
+	timer *time.Timer
+}
+
+type viewHost struct {
+	mu    sync.Mutex
+	views map[string]*hostedView
+}
+
+func newViewHost() *viewHost {
+	return &viewHost{views: make(map[string]*hostedView)}
+}
+
+func newViewHandle() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//NewHostedView is like NewView, but the view runs on its own client with
+//this client's entity, so that it can outlive this client. onready is given
+//the view's id on this client and a handle that another client can pass to
+//BindView. When this client ends, the view is torn down unless another
+//client binds it within linger
+func (c *BosswaveClient) NewHostedView(linger time.Duration, onready func(err error, id int, handle string), exz ...Expression) {
+	if c.GetUs() == nil {
+		onready(bwe.M(bwe.NoEntity, "no entity set"), -1, "")
+		return
+	}
+	host := c.bw.CreateClient(context.Background(), "VIEW")
+	if err := host.SetEntityObj(c.GetUs()); err != nil {
+		host.ctxCancel()
+		onready(err, -1, "")
+		return
+	}
+	host.NewView(func(err error, hostid int) {
+		if err != nil {
+			host.ctxCancel()
+			onready(err, -1, "")
+			return
+		}
+		hv := &hostedView{
+			handle: newViewHandle(),
+			v:      host.LookupView(hostid),
+			host:   host,
+			linger: linger,
+		}
+		hv.v.hosted = hv
+		vh := c.bw.vhost
+		vh.mu.Lock()
+		vh.views[hv.handle] = hv
+		vh.mu.Unlock()
+		id, err := c.bw.holdView(hv, c)
+		if err != nil {
+			onready(err, -1, "")
+			return
+		}
+		onready(nil, id, hv.handle)
+	}, exz...)
+}
+
+//BindView makes a hosted view available to this client, which must have the
+//same entity as the client that made it. The view's callbacks and interface
+//subscriptions are cleared, as they belonged to the previous holder
+func (c *BosswaveClient) BindView(handle string) (int, *View, error) {
+	vh := c.bw.vhost
+	vh.mu.Lock()
+	hv, ok := vh.views[handle]
+	vh.mu.Unlock()
+	if !ok {
+		return -1, nil, bwe.M(bwe.BadView, "No view with that handle")
+	}
+	if c.GetUs() == nil || !bytes.Equal(c.GetUs().GetVK(), hv.host.GetUs().GetVK()) {
+		return -1, nil, bwe.M(bwe.BadView, "The view belongs to another entity")
+	}
+	id, err := c.bw.holdView(hv, c)
+	if err != nil {
+		return -1, nil, err
+	}
+	return id, hv.v, nil
+}
+
+//TearDownView tears down a view this client made or bound. A hosted view
+//is torn down for every client
+func (c *BosswaveClient) TearDownView(id int) error {
+	c.viewmu.Lock()
+	v, ok := c.views[id]
+	delete(c.views, id)
+	c.viewmu.Unlock()
+	if !ok {
+		return bwe.M(bwe.BadView, "Cannot find view")
+	}
+	if v.hosted != nil {
+		vh := c.bw.vhost
+		vh.mu.Lock()
+		c.bw.tearDownHostedLocked(v.hosted)
+		vh.mu.Unlock()
+		return nil
+	}
+	v.TearDown()
+	return nil
+}
+
+//Handle returns the handle of a hosted view, or "" if the view is not
+//hosted
+func (v *View) Handle() string {
+	if v.hosted == nil {
+		return ""
+	}
+	return v.hosted.handle
+}
+
+func (c *BosswaveClient) forgetView(id int) {
+	c.viewmu.Lock()
+	delete(c.views, id)
+	c.viewmu.Unlock()
+}
+
+//holdView registers a hosted view with a client, taking it from the
+//previous holder
+func (bw *BW) holdView(hv *hostedView, c *BosswaveClient) (int, error) {
+	vh := bw.vhost
+	vh.mu.Lock()
+	if vh.views[hv.handle] != hv {
+		vh.mu.Unlock()
+		return -1, bwe.M(bwe.BadView, "The view was torn down")
+	}
+	if hv.timer != nil {
+		hv.timer.Stop()
+		hv.timer = nil
+	}
+	old, oldid := hv.holder, hv.holderID
+	if old != nil {
+		//They belong to the previous holder
+		hv.v.ClearCallbacks()
+	}
+	hv.gen++
+	gen := hv.gen
+	hv.holder = c
+	hv.holderID = c.registerView(hv.v)
+	id := hv.holderID
+	vh.mu.Unlock()
+	if old != nil && old != c {
+		old.forgetView(oldid)
+	}
+	go func() {
+		<-c.ctx.Done()
+		bw.releaseView(hv, c, gen)
+	}()
+	return id, nil
+}
+
+//releaseView is called when a holder ends. The view lingers for another
+//client to bind it
+func (bw *BW) releaseView(hv *hostedView, c *BosswaveClient, gen int) {
+	vh := bw.vhost
+	vh.mu.Lock()
+	defer vh.mu.Unlock()
+	if hv.holder != c || hv.gen != gen {
+		return
+	}
+	hv.holder = nil
+	//Nothing is listening any more
+	hv.v.ClearCallbacks()
+	if hv.linger <= 0 {
+		bw.tearDownHostedLocked(hv)
+		return
+	}
+	hv.timer = time.AfterFunc(hv.linger, func() {
+		vh.mu.Lock()
+		defer vh.mu.Unlock()
+		if hv.holder == nil && hv.gen == gen {
+			bw.tearDownHostedLocked(hv)
+		}
+	})
+}
+
+func (bw *BW) tearDownHostedLocked(hv *hostedView) {
+	if bw.vhost.views[hv.handle] != hv {
+		return
+	}
+	delete(bw.vhost.views, hv.handle)
+	if hv.timer != nil {
+		hv.timer.Stop()
+		hv.timer = nil
+	}
+	if hv.holder != nil {
+		hv.holder.forgetView(hv.holderID)
+		hv.holder = nil
+	}
+	go func() {
+		hv.v.TearDown()
+		hv.host.ctxCancel()
+	}()
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//ChangeAppeared means an interface started matching the view
+	ChangeAppeared = iota + 1
+	//ChangeDisappeared means an interface stopped matching the view
+	ChangeDisappeared
+	//ChangeMeta means a metadata key on a matching interface changed
+	ChangeMeta
+)
+
+//ViewChange is one change to the interfaces a view matches
+type ViewChange struct {
+	//Sequence numbers start at 1 and increase by one per change
+	Seq uint64 `msgpack:"seq"`
+	//When the view saw the change, in nanoseconds since the epoch
+	Timestamp int64  `msgpack:"ts"`
+	Kind      int    `msgpack:"kind"`
+	URI       string `msgpack:"uri"`
+	Interface string `msgpack:"iface"`
+	//For ChangeMeta, the key and its values before and after. A key that
+	//was added has no old value and a key that was removed has no new value
+	Key string `msgpack:"key"`
+	Old string `msgpack:"old"`
+	New string `msgpack:"new"`
+}
+
+//Time is when the view saw the change
+func (c *ViewChange) Time() time.Time {
+	return time.Unix(0, c.Timestamp)
+}
+
+type viewJournal struct {
+	mu      sync.Mutex
+	seq     uint64
+	size    int
+	entries []ViewChange
+	cbs     []func([]ViewChange)
+}
+
+//diffInterfaces lists the changes between two matchsets. Both must be
+//sorted by URI, as interfacesImpl returns them
+func diffInterfaces(old, new []*InterfaceDescription) []ViewChange {
+	rv := []ViewChange{}
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case j == len(new) || (i < len(old) && old[i].URI < new[j].URI):
+			rv = append(rv, ViewChange{Kind: ChangeDisappeared, URI: old[i].URI, Interface: old[i].Interface})
+			i++
+		case i == len(old) || new[j].URI < old[i].URI:
+			rv = append(rv, ViewChange{Kind: ChangeAppeared, URI: new[j].URI, Interface: new[j].Interface})
+			j++
+		default:
+			o, n := old[i], new[j]
+			keys := []string{}
+			for k := range o.Metadata {
+				keys = append(keys, k)
+			}
+			for k := range n.Metadata {
+				if _, ok := o.Metadata[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				ov, oldok := o.Metadata[k]
+				nv, newok := n.Metadata[k]
+				if oldok != newok || ov != nv {
+					rv = append(rv, ViewChange{Kind: ChangeMeta, URI: n.URI, Interface: n.Interface,
+						Key: k, Old: ov, New: nv})
+				}
+			}
+			i++
+			j++
+		}
+	}
+	return rv
+}
+
+//recordChanges numbers the changes, keeps them if the journal is enabled
+//and passes them to the OnChangeDiff callbacks
+func (v *View) recordChanges(changes []ViewChange) {
+	if len(changes) == 0 {
+		return
+	}
+	j := &v.journal
+	now := time.Now().UnixNano()
+	j.mu.Lock()
+	for i := range changes {
+		j.seq++
+		changes[i].Seq = j.seq
+		changes[i].Timestamp = now
+	}
+	if j.size > 0 {
+		j.entries = append(j.entries, changes...)
+		if len(j.entries) > j.size {
+			j.entries = append([]ViewChange{}, j.entries[len(j.entries)-j.size:]...)
+		}
+	}
+	cbs := j.cbs
+	j.mu.Unlock()
+	for _, cb := range cbs {
+		go cb(changes)
+	}
+}
+
+//EnableJournal makes the view keep its last size changes, to be read with
+//Journal. A size of zero stops keeping them
+func (v *View) EnableJournal(size int) {
+	j := &v.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.size = size
+	if len(j.entries) > size {
+		j.entries = append([]ViewChange{}, j.entries[len(j.entries)-size:]...)
+	}
+}
+
+//Journal returns the kept changes with a sequence number after since, oldest
+//first. Use zero to get all of them
+func (v *View) Journal(since uint64) []ViewChange {
+	j := &v.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rv := []ViewChange{}
+	for _, c := range j.entries {
+		if c.Seq > since {
+			rv = append(rv, c)
+		}
+	}
+	return rv
+}
+
+//OnChangeDiff is like OnChange, but the callback is given the changes. It
+//does not need the journal to be enabled
+func (v *View) OnChangeDiff(f func([]ViewChange)) {
+	j := &v.journal
+	j.mu.Lock()
+	j.cbs = append(j.cbs, f)
+	j.mu.Unlock()
+}
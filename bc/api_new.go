@@ -57,6 +57,12 @@ type logWrapper struct {
 	vmlog *types.Log
 }
 
+//WrapLog returns a Log for a log that did not come from this node, such as
+//one a thin router was sent by its registry
+func WrapLog(l *types.Log) Log {
+	return &logWrapper{l}
+}
+
 func (bc *blockChain) HeadBlockAge() int64 {
 	var hdr *types.Header
 	if bc.isLight {
@@ -437,6 +443,34 @@ func (bcc *bcClient) GetDefaultConfirmations() uint64 {
 func (bcc *bcClient) GetDefaultTimeout() uint64 {
 	return bcc.DefaultTimeout
 }
+func (bcc *bcClient) SetMaxGasPrice(p *big.Int) {
+	bcc.MaxGasPrice = p
+}
+func (bcc *bcClient) GetMaxGasPrice() *big.Int {
+	return bcc.MaxGasPrice
+}
+func (bcc *bcClient) WithInteractionParams(p *InteractionParams) BlockChainClient {
+	rv := *bcc
+	if p == nil {
+		return &rv
+	}
+	if p.Confirmations != nil {
+		rv.DefaultConfirmations = *p.Confirmations
+	}
+	if p.TimeoutBlocks != nil {
+		rv.DefaultTimeout = *p.TimeoutBlocks
+	}
+	if p.MaxGasPrice != nil {
+		rv.MaxGasPrice = p.MaxGasPrice
+	}
+	if p.Retry != nil {
+		rv.SetRetryPolicy(*p.Retry)
+	}
+	if p.Progress != nil {
+		rv.Progress = p.Progress
+	}
+	return &rv
+}
 func (bcc *bcClient) GetAddress(idx int) (addr Address, err error) {
 	if idx >= MaxEntityAccounts {
 		return Address{}, bwe.M(bwe.InvalidAccountNumber, fmt.Sprintf("bad account: %d", idx))
@@ -466,37 +500,142 @@ func (bcc *bcClient) CallOnChain(ctx context.Context, acc int, ufi UFI, value, g
 	return bcc.Transact(ctx, acc, addr.Hex(), value, gas, gasPrice, calldata)
 }
 
-func (bcc *bcClient) signAndSendTransaction(ctx context.Context, accidx int, tx *types.Transaction) (common.Hash, error) {
-	var chainID *big.Int
+//signingChainID returns the chain ID to sign new transactions with, or nil
+//if EIP155 is not active yet
+func (bc *blockChain) signingChainID() *big.Int {
 	var cfg *params.ChainConfig
-	if bcc.bc.isLight {
-		cfg = bcc.bc.lethi.ApiBackend.ChainConfig()
+	if bc.isLight {
+		cfg = bc.lethi.ApiBackend.ChainConfig()
 	} else {
-		cfg = bcc.bc.fethi.ApiBackend.ChainConfig()
+		cfg = bc.fethi.ApiBackend.ChainConfig()
 	}
-	if cfg.IsEIP155(bcc.bc.CurrentHeader().Number) {
-		chainID = cfg.ChainId
+	if cfg.IsEIP155(bc.CurrentHeader().Number) {
+		return cfg.ChainId
 	}
-	signed, err := bcc.bc.ks.BWSignTx(accidx, bcc.ent, tx, chainID)
-	if err != nil {
-		return common.Hash{}, err
+	return nil
+}
+
+//pendingNonce returns the next nonce for the address, taking the pending
+//transactions in the pool into account
+func (bc *blockChain) pendingNonce(ctx context.Context, addr common.Address) (uint64, error) {
+	if bc.isLight {
+		nonce, err := bc.lethi.TxPool().GetNonce(ctx, addr)
+		if err != nil {
+			return 0, bwe.WrapM(bwe.BlockChainGenericError, "Could not get txpool nonce", err)
+		}
+		return nonce, nil
 	}
-	if bcc.bc.isLight {
-		err = bcc.bc.lethi.ApiBackend.SendTx(ctx, signed)
+	return bc.fethi.TxPool().State().GetNonce(addr), nil
+}
+
+func (bc *blockChain) sendTx(ctx context.Context, signed *types.Transaction) error {
+	var err error
+	if bc.isLight {
+		err = bc.lethi.ApiBackend.SendTx(ctx, signed)
 	} else {
-		err = bcc.bc.fethi.ApiBackend.SendTx(ctx, signed)
+		err = bc.fethi.ApiBackend.SendTx(ctx, signed)
 	}
+	if err == nil {
+		return nil
+	}
+	switch err {
+	case core.ErrNonceTooLow:
+		return bwe.WrapM(bwe.TransactionNonceTooLow, "Could not transact", err)
+	case core.ErrUnderpriced, core.ErrReplaceUnderpriced:
+		return bwe.WrapM(bwe.TransactionUnderpriced, "Could not transact", err)
+	}
+	return bwe.WrapM(bwe.BlockChainGenericError, "Could not transact", err)
+}
+
+func (bcc *bcClient) signAndSendTransaction(ctx context.Context, accidx int, tx *types.Transaction) (common.Hash, error) {
+	signed, err := bcc.bc.ks.BWSignTx(accidx, bcc.ent, tx, bcc.bc.signingChainID())
 	if err != nil {
+		return common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not sign transaction", err)
+	}
+	if err := bcc.bc.sendTx(ctx, signed); err != nil {
 		return common.Hash{}, err
 	}
 	return signed.Hash(), nil
 }
 
+func (bc *blockChain) SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error) {
+	tx, err := DecodeRawTransaction(raw)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := bc.sendTx(ctx, tx); err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+func (bc *blockChain) GetTxParams(ctx context.Context, addr Address) (*OfflineTx, error) {
+	nonce, err := bc.pendingNonce(ctx, common.Address(addr))
+	if err != nil {
+		return nil, err
+	}
+	gasp, err := bc.api_contract.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "Could not get optimal gas price", err)
+	}
+	return &OfflineTx{
+		Nonce:    nonce,
+		GasPrice: gasp,
+		ChainID:  bc.signingChainID(),
+	}, nil
+}
+
+func (bc *blockChain) WaitForTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64, confirmed func(res *TxResult, err error)) {
+	bc.GetTransactionDetailsInt(ctx, txhash, timeoutblocks, confirmations,
+		nil, func(bn uint64, err error) {
+			if err != nil {
+				confirmed(nil, err)
+				return
+			}
+			confirmed(bc.txResult(txhash, bn), nil)
+		})
+}
+
+//gasPrice works out the gas price for a transaction. An empty gasPrice means
+//use the suggested price, capped at MaxGasPrice. An explicit gasPrice above
+//MaxGasPrice is an error
+func (bcc *bcClient) gasPrice(ctx context.Context, gasPrice string) (*big.Int, error) {
+	if gasPrice != "" {
+		gasp := big.NewInt(0)
+		_, ok := gasp.SetString(gasPrice, 0)
+		if !ok {
+			return nil, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call gasPrice")
+		}
+		if bcc.MaxGasPrice != nil && gasp.Cmp(bcc.MaxGasPrice) > 0 {
+			return nil, bwe.M(bwe.GasPriceTooHigh, fmt.Sprintf("Gas price %s exceeds maximum %s", gasp.Text(10), bcc.MaxGasPrice.Text(10)))
+		}
+		return gasp, nil
+	}
+	gasp, err := bcc.bc.api_contract.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "Could not get optimal gas price", err)
+	}
+	if bcc.MaxGasPrice != nil && gasp.Cmp(bcc.MaxGasPrice) > 0 {
+		gasp = new(big.Int).Set(bcc.MaxGasPrice)
+	}
+	return gasp, nil
+}
+
 func (bcc *bcClient) Transact(ctx context.Context, accidx int, to, value, gas, gasPrice string, code []byte) (txhash common.Hash, err error) {
-	acc, err := bcc.GetAddress(accidx)
+	tx, err := bcc.prepareTx(ctx, accidx, to, value, gas, gasPrice, code)
 	if err != nil {
 		return common.Hash{}, err
 	}
+	return bcc.signAndSendTransaction(ctx, accidx, tx)
+}
+
+//prepareTx makes the unsigned transaction that Transact would send, with
+//the next nonce for the account
+func (bcc *bcClient) prepareTx(ctx context.Context, accidx int, to, value, gas, gasPrice string, code []byte) (*types.Transaction, error) {
+	acc, err := bcc.GetAddress(accidx)
+	if err != nil {
+		return nil, err
+	}
 	if gas == "" {
 		if len(code) == 0 {
 			gas = BWDefaultSmallGas
@@ -507,20 +646,11 @@ func (bcc *bcClient) Transact(ctx context.Context, accidx int, to, value, gas, g
 	gasb := big.NewInt(0)
 	_, ok := gasb.SetString(gas, 0)
 	if !ok {
-		return common.Hash{}, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call gas")
+		return nil, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call gas")
 	}
-	var gasp *big.Int = nil
-	if gasPrice != "" {
-		gasp = big.NewInt(0)
-		_, ok = gasp.SetString(gasPrice, 0)
-		if !ok {
-			return common.Hash{}, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call gasPrice")
-		}
-	} else {
-		gasp, err = bcc.bc.api_contract.SuggestGasPrice(ctx)
-		if err != nil {
-			return common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not get optimal gas price", err)
-		}
+	gasp, err := bcc.gasPrice(ctx, gasPrice)
+	if err != nil {
+		return nil, err
 	}
 	if value == "" {
 		value = "0"
@@ -528,10 +658,9 @@ func (bcc *bcClient) Transact(ctx context.Context, accidx int, to, value, gas, g
 	valb := big.NewInt(0)
 	_, ok = valb.SetString(value, 0)
 	if !ok {
-		return common.Hash{}, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call value")
+		return nil, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call value")
 	}
 	toa := common.HexToAddress(to)
-	var nonce uint64
 
 	if gasb.Int64() == 0 {
 		egas, err := bcc.bc.api_contract.EstimateGas(ctx, ethereum.CallMsg{
@@ -543,26 +672,16 @@ func (bcc *bcClient) Transact(ctx context.Context, accidx int, to, value, gas, g
 			Data:     code,
 		})
 		if err != nil {
-			return common.Hash{}, bwe.WrapM(bwe.InvalidUFI, "Invalid gas estimation", err)
+			return nil, bwe.WrapM(bwe.InvalidUFI, "Invalid gas estimation", err)
 		}
 		gasb = egas
 	}
 
-	if bcc.bc.isLight {
-		nonce, err = bcc.bc.lethi.TxPool().GetNonce(ctx, common.Address(acc))
-		if err != nil {
-			return common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not get txpool nonce", err)
-		}
-	} else {
-		nonce = bcc.bc.fethi.TxPool().State().GetNonce(common.Address(acc))
-	}
-	tx := types.NewTransaction(nonce, toa, valb, gasb, gasp, code)
-
-	txhash, terr := bcc.signAndSendTransaction(ctx, accidx, tx)
-	if terr != nil {
-		return common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not transact", terr)
+	nonce, err := bcc.bc.pendingNonce(ctx, common.Address(acc))
+	if err != nil {
+		return nil, err
 	}
-	return txhash, nil
+	return types.NewTransaction(nonce, toa, valb, gasb, gasp, code), nil
 }
 
 func (bcc *bcClient) TransactAndCheck(ctx context.Context, accidx int, to, value, gas, gasPrice string, code []byte, confirmed func(error)) {
@@ -577,7 +696,25 @@ func (bcc *bcClient) TransactAndCheck(ctx context.Context, accidx int, to, value
 		})
 }
 
+//txResult describes a transaction that was confirmed in the given block
+func (bc *blockChain) txResult(txhash common.Hash, blocknum uint64) *TxResult {
+	rv := &TxResult{TxHash: txhash, BlockNumber: blocknum}
+	if !bc.isLight {
+		if rcpt := bc.GetTransactionReceipt(txhash); rcpt != nil {
+			rv.GasUsed = rcpt.GasUsed
+		}
+	}
+	return rv
+}
+
 func (bc *blockChain) getTransaction(txHash common.Hash) (tx *types.Transaction, pending bool, blocknum int64, err error) {
+	tx, pending, blocknum, _, err = bc.getTransactionBlock(txHash)
+	return
+}
+
+//getTransactionBlock is getTransaction, but also returns the hash of the
+//block the transaction was mined in
+func (bc *blockChain) getTransactionBlock(txHash common.Hash) (tx *types.Transaction, pending bool, blocknum int64, blockhash common.Hash, err error) {
 	var txData []byte
 	if bc.isLight {
 		panic("not supported on light yet")
@@ -591,7 +728,7 @@ func (bc *blockChain) getTransaction(txHash common.Hash) (tx *types.Transaction,
 
 	if err == nil && len(txData) > 0 {
 		if err := rlp.DecodeBytes(txData, tx); err != nil {
-			return nil, isPending, -1, err
+			return nil, isPending, -1, common.Hash{}, err
 		}
 	} else {
 		// pending transaction?
@@ -613,18 +750,39 @@ func (bc *blockChain) getTransaction(txHash common.Hash) (tx *types.Transaction,
 		//TODO LIGHTIFY
 		blockData, err := bc.fethi.ChainDb().Get(append(txHash.Bytes(), 0x0001))
 		if err != nil {
-			return nil, false, 0, err
+			return nil, false, 0, common.Hash{}, err
 		}
 
 		reader := bytes.NewReader(blockData)
 		if err = rlp.Decode(reader, &txBlock); err != nil {
-			return nil, false, 0, err
+			return nil, false, 0, common.Hash{}, err
 		}
 
-		return tx, false, int64(txBlock.BlockIndex), nil
+		return tx, false, int64(txBlock.BlockIndex), txBlock.BlockHash, nil
 	}
 
-	return tx, true, -1, nil
+	return tx, true, -1, common.Hash{}, nil
+}
+
+//txSender recovers the address that signed a mined transaction. Full
+//node only
+func (bc *blockChain) txSender(txhash common.Hash) (Address, error) {
+	tx, _, _, err := bc.getTransaction(txhash)
+	if err != nil {
+		return Address{}, err
+	}
+	if tx == nil {
+		return Address{}, bwe.M(bwe.BlockChainGenericError, "Transaction not found")
+	}
+	var signer types.Signer = types.HomesteadSigner{}
+	if tx.Protected() {
+		signer = types.NewEIP155Signer(tx.ChainId())
+	}
+	from, err := types.Sender(signer, tx)
+	if err != nil {
+		return Address{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not recover sender", err)
+	}
+	return Address(from), nil
 }
 
 // func (bc *blockChain) intGetTransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, error) {
@@ -665,68 +823,28 @@ func (bc *blockChain) GetTransactionDetailsInt(ctx context.Context, txhash commo
 	onseen func(blocknum uint64, err error),
 	onconfirmed func(blocknum uint64, err error)) {
 
-	startblock := bc.CurrentBlock()
-
-	waitConfirmations := func(found uint64) {
-		for {
-			if ctx.Err() != nil {
-				if onconfirmed != nil {
-					onconfirmed(0, bwe.M(bwe.TransactionConfirmationTimeout, "Timeout waiting for confirmations"))
-				}
-				return
-			}
-			//If we are past the number of confirmations required
-			curblock := bc.CurrentBlock()
-			fmt.Println("Waiting for confirmations on", txhash, "seen at", found, "curblock", curblock)
-			if curblock >= found+confirmations {
-				tx, pending, blocknum, err := bc.getTransaction(txhash)
-				if err != nil {
-					onconfirmed(0, bwe.WrapM(bwe.TransactionConfirmationTimeout, "Got TX error", err))
-				}
-				if !(pending || tx == nil) {
-					if blocknum > 0 && uint64(blocknum) < curblock-confirmations {
-						onconfirmed(uint64(blocknum), nil)
-						return
-					}
+	events := bc.WatchTransaction(ctx, txhash, timeoutblocks, confirmations)
+	go func() {
+		seen := false
+		for ev := range events {
+			switch ev.Kind {
+			case TxEventMined:
+				if !seen && onseen != nil {
+					onseen(ev.BlockNumber, nil)
 				}
-			}
-			//Or we have timed out
-			if curblock >= startblock+timeoutblocks {
+				seen = true
+			case TxEventConfirmed:
 				if onconfirmed != nil {
-					onconfirmed(0, bwe.M(bwe.TransactionConfirmationTimeout, "Timeout waiting for confirmations"))
-				}
-				return
-			}
-			<-bc.AfterBlocks(ctx, 1)
-		}
-	}
-
-	go func() {
-		for {
-			curblock := bc.CurrentBlock()
-			tx, pending, blocknum, err := bc.getTransaction(txhash)
-			if err != nil {
-				panic("hmm2?" + err.Error())
-			}
-			if err == nil && !pending && tx != nil && blocknum > 0 {
-				if onseen != nil {
-					onseen(uint64(blocknum), nil)
+					onconfirmed(ev.BlockNumber, nil)
 				}
-				waitConfirmations(uint64(blocknum))
-				return
-			}
-			if curblock >= startblock+timeoutblocks {
-				if onseen != nil {
-					onseen(0, bwe.M(bwe.TransactionTimeout, "Timeout waiting for tx to appear"))
+			case TxEventFailed:
+				if !seen && onseen != nil {
+					onseen(0, ev.Err)
 				}
 				if onconfirmed != nil {
-					onconfirmed(0, bwe.M(bwe.TransactionTimeout, "Timeout waiting for tx to appear"))
+					onconfirmed(0, ev.Err)
 				}
-				return
 			}
-			sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			<-bc.AfterBlocks(sctx, 1)
-			cancel()
 		}
 	}()
 }
@@ -9,6 +9,44 @@ import (
 	"github.com/immesys/bw2bc/core/types"
 )
 
+//InteractionParams control how a single on-chain operation is carried out.
+//Nil fields keep the client's current defaults
+type InteractionParams struct {
+	//The number of blocks after the transaction before it is considered confirmed
+	Confirmations *uint64
+	//The number of blocks to wait for the transaction before timing out
+	TimeoutBlocks *uint64
+	//The maximum gas price (in wei) the operation may pay
+	MaxGasPrice *big.Int
+	//How the operation is retried
+	Retry *RetryPolicy
+	//Called as the operation's transactions are sent and mined
+	Progress func(p *TxProgress)
+}
+
+//TxResult describes a transaction that has been mined and confirmed
+type TxResult struct {
+	TxHash      common.Hash
+	BlockNumber uint64
+	//Nil if the receipt is not available (e.g. on a light client)
+	GasUsed *big.Int
+}
+
+//TxCost is what a transaction is expected to cost, before it is sent
+type TxCost struct {
+	Gas      *big.Int
+	GasPrice *big.Int
+	//The value sent with the transaction, zero for most calls
+	Value *big.Int
+}
+
+//Total is the most the transaction can cost in wei, all of its gas at its
+//gas price plus its value
+func (c *TxCost) Total() *big.Int {
+	rv := new(big.Int).Mul(c.Gas, c.GasPrice)
+	return rv.Add(rv, c.Value)
+}
+
 type BlockChainClient interface {
 
 	//Set the entity
@@ -16,9 +54,20 @@ type BlockChainClient interface {
 
 	SetDefaultConfirmations(c uint64)
 	SetDefaultTimeout(c uint64)
+	SetMaxGasPrice(p *big.Int)
 
 	GetDefaultConfirmations() uint64
 	GetDefaultTimeout() uint64
+	GetMaxGasPrice() *big.Int
+
+	//Set how operations that send a transaction are retried. See
+	//RetryPolicy
+	SetRetryPolicy(p RetryPolicy)
+	GetRetryPolicy() RetryPolicy
+
+	//Get a copy of this client that uses the given params for its
+	//operations. The original client is not modified
+	WithInteractionParams(p *InteractionParams) BlockChainClient
 
 	//Get the address of the given account
 	GetAddress(idx int) (addr Address, err error)
@@ -57,17 +106,22 @@ type BlockChainClient interface {
 	//Create the service record (host:port) for the given designated router
 	CreateSRVRecord(ctx context.Context, acc int, dr *objects.Entity, record string, confirmed func(err error))
 
-	//Publish the given entity
-	PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(err error))
+	//Publish the given entity. If it is already in the registry, confirmed
+	//is called with a nil result
+	PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(res *TxResult, err error))
 
 	//Publish the given DOT. The entities must be published already
-	PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(err error))
+	PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(res *TxResult, err error))
 
 	//Publish the given DChain. The dots and entities must be published already
-	PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(err error))
+	PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(res *TxResult, err error))
+
+	//Estimate what PublishAccessDChain would cost. The cost is nil if the
+	//chain is in the registry already, as nothing would be sent
+	EstimateAccessDChain(ctx context.Context, acc int, chain *objects.DChain) (*TxCost, error)
 
 	//Publish the given revocation. The target must be published already
-	PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(err error))
+	PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(res *TxResult, err error))
 
 	// Builtins
 	//Create a short alias on the chain. After a few confirmations (or timeout)
@@ -78,10 +132,26 @@ type BlockChainClient interface {
 	//Sets a full alias on the chain. Note that you cannot collide with
 	//short aliases, so don't have too many leading zeroes.
 	SetAlias(ctx context.Context, acc int, key Bytes32, val Bytes32, confirmed func(err error))
+
+	//Point an existing alias at a new value. Only the alias's owner can
+	//update it
+	UpdateAlias(ctx context.Context, acc int, key Bytes32, val Bytes32, confirmed func(err error))
+
+	//Give an alias to another account, which becomes the only one that
+	//can update, transfer or delete it
+	TransferAlias(ctx context.Context, acc int, key Bytes32, to Address, confirmed func(err error))
+
+	//Delete an alias, which frees its key. Only the alias's owner can
+	//delete it
+	DeleteAlias(ctx context.Context, acc int, key Bytes32, confirmed func(err error))
 }
 
 type BlockChainProvider interface {
 
+	//Stop the node. True is written to the channel returned by
+	//NewBlockChain once it has stopped. It is safe to call more than once
+	Shutdown()
+
 	//Get the ENode string
 	ENode() string
 
@@ -96,6 +166,13 @@ type BlockChainProvider interface {
 	//Get the balance of an address (in hex) in decimal and human readable
 	GetAddrBalance(ctx context.Context, addr string) (decimal string, human string, err error)
 
+	//Get the chain ID from the chain config, zero if it has none
+	ChainID() *big.Int
+
+	//Get the contract code at an address (in hex). Not available on light
+	//clients
+	GetCode(ctx context.Context, addr string) ([]byte, error)
+
 	//Get a specific block
 	GetBlock(height uint64) *Block
 
@@ -175,4 +252,38 @@ type BlockChainProvider interface {
 
 	//Check what the first alias made for the given value is
 	UnresolveAlias(ctx context.Context, value Bytes32) (key Bytes32, iszero bool, err error)
+
+	//Get the account that can update, transfer or delete an alias. It is
+	//zero if the alias does not exist
+	AliasOwner(ctx context.Context, key Bytes32) (Address, error)
+
+	//Find every alias that currently has the given value, oldest first
+	FindAliasesFor(ctx context.Context, value Bytes32) ([]*AliasRecord, error)
+
+	//Find every alias currently owned by one of the given addresses,
+	//oldest first
+	FindAliasesOwnedBy(ctx context.Context, addrs []Address) ([]*AliasRecord, error)
+
+	//Find every alias paid for by one of the given addresses, oldest
+	//first. Only supported on a full node
+	FindAliasesCreatedBy(ctx context.Context, addrs []Address) ([]*AliasRecord, error)
+
+	//Get the namespace's current affinity nonce, needed to sign an
+	//acceptance of a designated router offer
+	GetAffinityNSNonce(ctx context.Context, nsvk []byte) (*big.Int, error)
+
+	//Get the nonce, suggested gas price and chain ID that a transaction
+	//from the given address would be signed with. Gas is left nil
+	GetTxParams(ctx context.Context, addr Address) (*OfflineTx, error)
+
+	//Broadcast an RLP encoded signed transaction, such as one made by
+	//SignOffline
+	SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error)
+
+	//Wait for a transaction to be mined and confirmed
+	WaitForTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64, confirmed func(res *TxResult, err error))
+
+	//Follow a transaction until it is confirmed, reporting its progress and
+	//any reorgs. See TxEvent
+	WatchTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64) <-chan TxEvent
 }
@@ -35,16 +35,10 @@ func (bcc *bcClient) CreateRoutingOffer(ctx context.Context, acc int, dr *object
 	crypto.SignBlob(dr.GetSK(), dr.GetVK(), sig, hsh)
 
 	//Then let us try create offer
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Affinity_OfferRouting), "", "", "",
-		dr.GetVK(), nsvk, nonce, sig)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
+	//Send it, and wait for it to confirm
 	//meh we need to rewrite this function
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Affinity_OfferRouting), params: []interface{}{dr.GetVK(), nsvk, nonce, sig}},
+		func(res *TxResult, err error) {
 			//Check to see if it all matches now:
 			rvz, err := bcc.bc.CallOffChain(ctx, StringToUFI(UFI_Affinity_AffinityOffers),
 				dr.GetVK(), nsvk)
@@ -81,16 +75,10 @@ func (bcc *bcClient) CreateSRVRecord(ctx context.Context, acc int, dr *objects.E
 	crypto.SignBlob(dr.GetSK(), dr.GetVK(), sig, hsh)
 
 	//Then let us set the record
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Affinity_SetDesignatedRouterSRV), "", "", "",
-		dr.GetVK(), nonce, []byte(record), sig)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
+	//Send it, and wait for it to confirm
 	//meh we need to rewrite this function
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Affinity_SetDesignatedRouterSRV), params: []interface{}{dr.GetVK(), nonce, []byte(record), sig}},
+		func(res *TxResult, err error) {
 			if err != nil {
 				confirmed(err)
 				return
@@ -112,7 +100,7 @@ func (bcc *bcClient) CreateSRVRecord(ctx context.Context, acc int, dr *objects.E
 
 func (bc *blockChain) FindRoutingOffers(ctx context.Context, nsvk []byte) (drs [][]byte, err error) {
 	//func (bc *blockChain) CallOnLogsSinceInt(since int64, hexaddr string, topics [][]common.Hash, cb func(l *vm.Log) bool) {
-	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(HexToAddress(UFI_Affinity_Address)),
+	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(ContractAddress(ContractAffinity)),
 		[][]common.Hash{
 			[]common.Hash{common.Hash(HexToBytes32(EventSig_Affinity_NewAffinityOffer))}, //sig
 			[]common.Hash{common.Hash{}},                                                 //drvk
@@ -144,7 +132,7 @@ func (bc *blockChain) FindRoutingOffers(ctx context.Context, nsvk []byte) (drs [
 
 func (bc *blockChain) FindRoutingAffinities(ctx context.Context, drvk []byte) (nsvks [][]byte, err error) {
 	//func (bc *blockChain) CallOnLogsSinceInt(since int64, hexaddr string, topics [][]common.Hash, cb func(l *vm.Log) bool) {
-	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(HexToAddress(UFI_Affinity_Address)),
+	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(ContractAddress(ContractAffinity)),
 		[][]common.Hash{
 			[]common.Hash{common.Hash(HexToBytes32(EventSig_Affinity_NewDesignatedRouter))}, //sig
 			[]common.Hash{common.Hash{}},                                                    //drvk
@@ -190,15 +178,9 @@ func (bcc *bcClient) RetractRoutingOffer(ctx context.Context, acc int, dr *objec
 	crypto.SignBlob(dr.GetSK(), dr.GetVK(), sig, hsh)
 
 	//Then let us try create offer
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Affinity_RetractRoutingDR), "", "", "",
-		dr.GetVK(), nsvk, nonce, sig)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	//Send it, and wait for it to confirm
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Affinity_RetractRoutingDR), params: []interface{}{dr.GetVK(), nsvk, nonce, sig}},
+		func(res *TxResult, err error) {
 			//Check to see if it all matches now:
 			rvz, err := bcc.bc.CallOffChain(ctx, StringToUFI(UFI_Affinity_AffinityOffers),
 				dr.GetVK(), nsvk)
@@ -244,17 +226,10 @@ func (bcc *bcClient) RetractRoutingAcceptance(ctx context.Context, acc int, ns *
 	crypto.SignBlob(ns.GetSK(), ns.GetVK(), sig, hsh)
 
 	//Then let us try reject offer
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Affinity_RetractRoutingNS), "", "", "",
-		ns.GetVK(), drvk, nonce, sig)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-
-	//And wait for it to confirm
+	//Send it, and wait for it to confirm
 	//meh we need to rewrite this function
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Affinity_RetractRoutingNS), params: []interface{}{ns.GetVK(), drvk, nonce, sig}},
+		func(res *TxResult, err error) {
 			if err != nil {
 				confirmed(err)
 				return
@@ -284,27 +259,13 @@ func (bcc *bcClient) AcceptRoutingOffer(ctx context.Context, acc int, ns *object
 	}
 	nonce := rv[0].(*big.Int)
 	nonce.Add(nonce, big.NewInt(1))
-	//Lets create the signature
-	d := sha3.NewKeccak256()
-	d.Write([]byte("AcceptRouting"))
-	d.Write(ns.GetVK())
-	d.Write(drvk)
-	d.Write(math.PaddedBigBytes(nonce, 32))
-	hsh := d.Sum(nil)
-	sig := make([]byte, 64)
-	crypto.SignBlob(ns.GetSK(), ns.GetVK(), sig, hsh)
+	sig := acceptRoutingSig(ns, drvk, nonce)
 
 	//Then let us try accept offer
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Affinity_AcceptRouting), "", "", "",
-		ns.GetVK(), drvk, nonce, sig)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
+	//Send it, and wait for it to confirm
 	//meh we need to rewrite this function
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Affinity_AcceptRouting), params: []interface{}{ns.GetVK(), drvk, nonce, sig}},
+		func(res *TxResult, err error) {
 			if err != nil {
 				confirmed(err)
 				return
@@ -324,6 +285,28 @@ func (bcc *bcClient) AcceptRoutingOffer(ctx context.Context, acc int, ns *object
 		})
 }
 
+//acceptRoutingSig is the namespace's signature over an acceptance of the
+//DR's offer, using the given (next) namespace nonce
+func acceptRoutingSig(ns *objects.Entity, drvk []byte, nonce *big.Int) []byte {
+	d := sha3.NewKeccak256()
+	d.Write([]byte("AcceptRouting"))
+	d.Write(ns.GetVK())
+	d.Write(drvk)
+	d.Write(math.PaddedBigBytes(nonce, 32))
+	hsh := d.Sum(nil)
+	sig := make([]byte, 64)
+	crypto.SignBlob(ns.GetSK(), ns.GetVK(), sig, hsh)
+	return sig
+}
+
+func (bc *blockChain) GetAffinityNSNonce(ctx context.Context, nsvk []byte) (*big.Int, error) {
+	rv, err := bc.CallOffChain(ctx, StringToUFI(UFI_Affinity_NSNonces), nsvk)
+	if err != nil {
+		return nil, err
+	}
+	return rv[0].(*big.Int), nil
+}
+
 func (bc *blockChain) GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error) {
 	rvz, err := bc.CallOffChain(ctx, StringToUFI(UFI_Affinity_DesignatedRouterFor), nsvk)
 	if err != nil {
@@ -1,7 +1,10 @@
 package bc
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/immesys/bw2/util/bwe"
@@ -40,14 +43,51 @@ const (
 	UFI_Alias_AliasFor = "cc74681c3e3b7bcccf7a05524b75ba8feccc7418c83560ea4010000000000000"
 	// Admin() -> address
 	UFI_Alias_Admin = "cc74681c3e3b7bcccf7a05524b75ba8feccc7418ff1b636d0?00000000000000"
+	// Owner(uint256 ) -> address, returned as a uint
+	UFI_Alias_Owner = "cc74681c3e3b7bcccf7a05524b75ba8feccc741884af87921010000000000000"
+	// UpdateAlias(uint256 k, bytes32 v) ->
+	UFI_Alias_UpdateAlias = "cc74681c3e3b7bcccf7a05524b75ba8feccc7418774d7bd91400000000000000"
+	// TransferAlias(uint256 k, address to) ->, to passed as a uint
+	UFI_Alias_TransferAlias = "cc74681c3e3b7bcccf7a05524b75ba8feccc74181730883a1100000000000000"
+	// DeleteAlias(uint256 k) ->
+	UFI_Alias_DeleteAlias = "cc74681c3e3b7bcccf7a05524b75ba8feccc74182be72cbd1000000000000000"
 	// EVENT  AliasCreated(uint256 key, bytes32 value)
 	EventSig_Alias_AliasCreated = "170b239b7d2c41f8c5caacdafe7409cda0f4b5012440739feea0576a40a156eb"
+	// EVENT  AliasUpdated(uint256 key, bytes32 value)
+	EventSig_Alias_AliasUpdated = "ed64f72ef11258dc682829c9bc1ed5105cfc5d883cc336a07f750929bca9d576"
+	// EVENT  AliasTransferred(uint256 key, address owner)
+	EventSig_Alias_AliasTransferred = "44bb48c40a09604f117a0e84d12115475e86630fe24a4dbb7ed32a9cda584c39"
+	// EVENT  AliasDeleted(uint256 key, bytes32 value)
+	EventSig_Alias_AliasDeleted = "c6e56a4bdd822cb328548929248737b051821c0b62c014f38e0fbb00ac26815e"
 )
 
+//ShortAliasKey is the alias key for a short alias. Short aliases are
+//numbers, so they are left padded unlike long aliases
+func ShortAliasKey(alias uint64) Bytes32 {
+	return SliceToBytes32(math.PaddedBigBytes(new(big.Int).SetUint64(alias), 32))
+}
+
+//IsShortAliasKey is true if the key is a short alias. A long alias cannot
+//start with a zero byte
+func IsShortAliasKey(key Bytes32) bool {
+	return key[0] == 0
+}
+
+//FmtAliasKey formats a short alias as @<hex>] and a long alias as its
+//text, which are the forms that alias resolution accepts
+func FmtAliasKey(key Bytes32) string {
+	if IsShortAliasKey(key) {
+		return fmt.Sprintf("@%x]", new(big.Int).SetBytes(key[:]))
+	}
+	end := bytes.IndexByte(key[:], 0)
+	if end == -1 {
+		end = 32
+	}
+	return string(key[:end])
+}
+
 func (bc *blockChain) ResolveShortAlias(ctx context.Context, alias uint64) (res Bytes32, iszero bool, err error) {
-	key := big.NewInt(int64(alias))
-	keyarr := SliceToBytes32(math.PaddedBigBytes(key, 32))
-	res, iszero, err = bc.ResolveAlias(ctx, keyarr)
+	res, iszero, err = bc.ResolveAlias(ctx, ShortAliasKey(alias))
 	return
 }
 
@@ -63,6 +103,14 @@ func (bc *blockChain) ResolveAlias(ctx context.Context, key Bytes32) (res Bytes3
 	return res, iszer, nil
 }
 
+//aliasCost is the value to send with an alias creation, which the contract
+//charges for in gas
+func aliasCost(gas int64) func(gasPrice *big.Int) *big.Int {
+	return func(gasPrice *big.Int) *big.Int {
+		return new(big.Int).Mul(big.NewInt(gas), gasPrice)
+	}
+}
+
 //CreateShortAlias creates an alias, waits (Confirmations) then locates the
 //created short ID and sends it to the callback. If it times out (10 blocks)
 //then and error is passed
@@ -72,31 +120,35 @@ func (bcc *bcClient) CreateShortAlias(ctx context.Context, acc int, val Bytes32,
 		return
 	}
 
-	gprice, err := bcc.bc.GasPrice(ctx)
-	if err != nil {
-		confirmed(0, err)
-		return
+	call := &txCall{
+		acc:     acc,
+		ufi:     StringToUFI(UFI_Alias_CreateShortAlias),
+		params:  []interface{}{val},
+		valueAt: aliasCost(AliasCreateShortCost),
 	}
-	sgprice := gprice.Text(10)
-	cash := big.NewInt(AliasCreateShortCost)
-	cash = cash.Mul(cash, gprice)
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Alias_CreateShortAlias), cash.Text(10), "", sgprice, val)
-	if err != nil {
-		confirmed(0, err)
-		return
-	}
-
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bnum uint64, err error) {
+	bcc.sendAndConfirm(ctx, call,
+		func(res *TxResult, err error) {
 			if err != nil {
 				confirmed(0, err)
 				return
 			}
-			rcpt := bcc.bc.GetTransactionReceipt(txhash)
-			for _, lg := range rcpt.Logs {
-				if lg.Topics[2] == common.Hash(val) {
-					short := new(big.Int).SetBytes(lg.Topics[1][:]).Int64()
-					confirmed(uint64(short), nil)
+			bnum, txhash := res.BlockNumber, res.TxHash
+			//Receipts are not available on a light client, so find the
+			//AliasCreated log for our transaction instead
+			lgs, err := bcc.bc.FindLogsBetweenHeavy(ctx, int64(bnum), int64(bnum), common.Address(ContractAddress(ContractAlias)),
+				[][]common.Hash{
+					[]common.Hash{common.Hash(HexToBytes32(EventSig_Alias_AliasCreated))}, //sig
+					[]common.Hash{common.Hash{}},                                          //key
+					[]common.Hash{common.Hash(val)},                                       //value
+				})
+			if err != nil {
+				confirmed(0, bwe.WrapM(bwe.BlockChainGenericError, "Could not scan logs:", err))
+				return
+			}
+			for _, lg := range lgs {
+				if common.Hash(lg.TxHash()) == txhash {
+					short := new(big.Int).SetBytes(lg.Topics()[1][:]).Uint64()
+					confirmed(short, nil)
 					return
 				}
 			}
@@ -118,26 +170,99 @@ func (bcc *bcClient) SetAlias(ctx context.Context, acc int, key Bytes32, val Byt
 		if rval == val {
 			confirmed(bwe.M(bwe.AliasExists, "Alias exists (with the same value)"))
 		} else {
-			confirmed(bwe.M(bwe.AliasExists, "Alias exists (with a different value)"))
+			confirmed(bwe.M(bwe.AliasExists, "Alias exists (with a different value), update it instead"))
 		}
 		return
 	}
-	gprice, err := bcc.bc.GasPrice(ctx)
+	call := &txCall{
+		acc:     acc,
+		ufi:     StringToUFI(UFI_Alias_SetAlias),
+		params:  []interface{}{key, val},
+		valueAt: aliasCost(AliasCreateLongCost),
+	}
+	bcc.sendAndConfirm(ctx, call,
+		func(res *TxResult, err error) {
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			v, _, err := bcc.bc.ResolveAlias(ctx, key)
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			if v != val {
+				confirmed(bwe.M(bwe.AliasError, "Created alias contents do not match"))
+				return
+			}
+			confirmed(nil)
+			return
+		})
+}
+
+//ErrNoAliasOwners is returned when the alias contract on the chain is the
+//one from before aliases had owners, which has no Owner function
+var ErrNoAliasOwners = bwe.M(bwe.AliasError, "The alias contract on this chain has no owners, so aliases cannot be updated, transferred or deleted until it is upgraded")
+
+func (bc *blockChain) AliasOwner(ctx context.Context, key Bytes32) (Address, error) {
+	rvz, err := bc.CallOffChain(ctx, StringToUFI(UFI_Alias_Owner), new(big.Int).SetBytes(key[:]))
+	if err != nil && errors.Is(err, bwe.Code(bwe.InvalidUFI)) {
+		//The old contract throws on an unknown function, so nothing is
+		//returned
+		return Address{}, ErrNoAliasOwners
+	}
+	if err != nil || len(rvz) != 1 {
+		return Address{}, bwe.WrapM(bwe.UFIInvocationError, "Expected 1 rv: ", err)
+	}
+	return Address(common.BigToAddress(rvz[0].(*big.Int))), nil
+}
+
+//ownAlias gets the value of an alias after checking that it exists and
+//that the account owns it, so that a transaction the contract would refuse
+//is not sent
+func (bcc *bcClient) ownAlias(ctx context.Context, acc int, key Bytes32) (Bytes32, error) {
+	me, err := bcc.GetAddress(acc)
+	if err != nil {
+		return Bytes32{}, err
+	}
+	val, zero, err := bcc.bc.ResolveAlias(ctx, key)
+	if err != nil {
+		return Bytes32{}, bwe.WrapM(bwe.AliasError, "Preresolve error: ", err)
+	}
+	if zero {
+		return Bytes32{}, bwe.M(bwe.AliasError, "Alias does not exist")
+	}
+	owner, err := bcc.bc.AliasOwner(ctx, key)
 	if err != nil {
-		confirmed(bwe.WrapM(bwe.AliasError, "Gas error: ", err))
+		return Bytes32{}, err
+	}
+	if owner != me {
+		return Bytes32{}, bwe.M(bwe.AliasError, fmt.Sprintf("Alias is owned by 0x%s, not by account %d (0x%s)", owner.Hex(), acc, me.Hex()))
+	}
+	return val, nil
+}
+
+func (bcc *bcClient) UpdateAlias(ctx context.Context, acc int, key Bytes32, val Bytes32, confirmed func(err error)) {
+	if val.Zero() {
+		confirmed(bwe.M(bwe.AliasError, "You cannot point an alias to zero, delete it instead"))
 		return
 	}
-	sgprice := gprice.Text(10)
-	cash := big.NewInt(AliasCreateLongCost)
-	cash = cash.Mul(cash, gprice)
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Alias_SetAlias), cash.Text(10), "", sgprice, key, val)
+	old, err := bcc.ownAlias(ctx, acc, key)
 	if err != nil {
 		confirmed(err)
 		return
 	}
-
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bnum uint64, err error) {
+	if old == val {
+		confirmed(bwe.M(bwe.AliasExists, "Alias exists (with the same value)"))
+		return
+	}
+	call := &txCall{
+		acc:    acc,
+		ufi:    StringToUFI(UFI_Alias_UpdateAlias),
+		params: []interface{}{key, val},
+	}
+	bcc.sendAndConfirm(ctx, call,
+		func(res *TxResult, err error) {
 			if err != nil {
 				confirmed(err)
 				return
@@ -148,11 +273,72 @@ func (bcc *bcClient) SetAlias(ctx context.Context, acc int, key Bytes32, val Byt
 				return
 			}
 			if v != val {
-				confirmed(bwe.M(bwe.AliasError, "Created alias contents do not match"))
+				confirmed(bwe.M(bwe.AliasError, "Contract did not update alias"))
+				return
+			}
+			confirmed(nil)
+		})
+}
+
+func (bcc *bcClient) TransferAlias(ctx context.Context, acc int, key Bytes32, to Address, confirmed func(err error)) {
+	if to == (Address{}) {
+		confirmed(bwe.M(bwe.AliasError, "You cannot transfer an alias to the zero address, delete it instead"))
+		return
+	}
+	if _, err := bcc.ownAlias(ctx, acc, key); err != nil {
+		confirmed(err)
+		return
+	}
+	call := &txCall{
+		acc:    acc,
+		ufi:    StringToUFI(UFI_Alias_TransferAlias),
+		params: []interface{}{key, new(big.Int).SetBytes(to[:])},
+	}
+	bcc.sendAndConfirm(ctx, call,
+		func(res *TxResult, err error) {
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			owner, err := bcc.bc.AliasOwner(ctx, key)
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			if owner != to {
+				confirmed(bwe.M(bwe.AliasError, "Contract did not transfer alias"))
+				return
+			}
+			confirmed(nil)
+		})
+}
+
+func (bcc *bcClient) DeleteAlias(ctx context.Context, acc int, key Bytes32, confirmed func(err error)) {
+	if _, err := bcc.ownAlias(ctx, acc, key); err != nil {
+		confirmed(err)
+		return
+	}
+	call := &txCall{
+		acc:    acc,
+		ufi:    StringToUFI(UFI_Alias_DeleteAlias),
+		params: []interface{}{key},
+	}
+	bcc.sendAndConfirm(ctx, call,
+		func(res *TxResult, err error) {
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			_, zero, err := bcc.bc.ResolveAlias(ctx, key)
+			if err != nil {
+				confirmed(err)
+				return
+			}
+			if !zero {
+				confirmed(bwe.M(bwe.AliasError, "Contract did not delete alias"))
 				return
 			}
 			confirmed(nil)
-			return
 		})
 }
 
@@ -171,3 +357,156 @@ func (bc *blockChain) UnresolveAlias(ctx context.Context, value Bytes32) (key By
 	key = Bytes32(common.BigToHash(k))
 	return key, key == Bytes32{}, nil
 }
+
+//AliasRecord describes an alias, as found in the alias contract's logs.
+//The block and transaction are where the alias got the value or owner that
+//it was found by
+type AliasRecord struct {
+	Key         Bytes32
+	Value       Bytes32
+	BlockNumber uint64
+	TxHash      common.Hash
+	//The account that sent the transaction. Only known on a full node,
+	//otherwise it is zero
+	Creator Address
+	//The account that can update, transfer or delete the alias. It is
+	//zero if the alias contract has no owners
+	Owner Address
+}
+
+func (bc *blockChain) aliasRecordFromLog(lg Log) *AliasRecord {
+	rv := &AliasRecord{
+		Key:         lg.Topics()[1],
+		Value:       lg.Topics()[2],
+		BlockNumber: lg.BlockNumber(),
+		TxHash:      common.Hash(lg.TxHash()),
+	}
+	if !bc.isLight {
+		if sender, err := bc.txSender(rv.TxHash); err == nil {
+			rv.Creator = sender
+		}
+	}
+	return rv
+}
+
+//findAliasLogs gets the logs with one of the given event signatures,
+//restricted to those whose second topic (the value or owner) is one of
+//topic2s, unless it is empty
+func (bc *blockChain) findAliasLogs(ctx context.Context, sigs []string, topic2s ...Bytes32) ([]Log, error) {
+	sigtopic := []common.Hash{}
+	for _, sig := range sigs {
+		sigtopic = append(sigtopic, common.Hash(HexToBytes32(sig)))
+	}
+	topics := [][]common.Hash{sigtopic}
+	if len(topic2s) != 0 {
+		t2 := []common.Hash{}
+		for _, t := range topic2s {
+			t2 = append(t2, common.Hash(t))
+		}
+		topics = append(topics,
+			[]common.Hash{common.Hash{}}, //key
+			t2)                           //value or owner
+	}
+	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(ContractAddress(ContractAlias)), topics)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "Could not scan logs:", err)
+	}
+	return lgs, nil
+}
+
+//currentAliases keeps the last record for each key, and only if the alias
+//still has the record's value (or owner, if byOwner). The logs say what
+//an alias was, not what it is, as it may have been updated since
+func (bc *blockChain) currentAliases(ctx context.Context, lgs []Log, byOwner bool) ([]*AliasRecord, error) {
+	last := make(map[Bytes32]int)
+	recs := make([]*AliasRecord, 0, len(lgs))
+	for _, lg := range lgs {
+		rec := bc.aliasRecordFromLog(lg)
+		if i, ok := last[rec.Key]; ok {
+			recs[i] = nil
+		}
+		last[rec.Key] = len(recs)
+		recs = append(recs, rec)
+	}
+	rv := []*AliasRecord{}
+	for _, rec := range recs {
+		if rec == nil {
+			continue
+		}
+		val, zero, err := bc.ResolveAlias(ctx, rec.Key)
+		if err != nil {
+			return nil, err
+		}
+		if zero {
+			continue
+		}
+		owner, err := bc.AliasOwner(ctx, rec.Key)
+		if err != nil && err != ErrNoAliasOwners {
+			return nil, err
+		}
+		if byOwner {
+			if owner != Address(common.BytesToAddress(rec.Value[:])) {
+				continue
+			}
+			rec.Value = val
+		} else if val != rec.Value {
+			continue
+		}
+		rec.Owner = owner
+		rv = append(rv, rec)
+	}
+	return rv, nil
+}
+
+func (bc *blockChain) FindAliasesFor(ctx context.Context, value Bytes32) ([]*AliasRecord, error) {
+	if value.Zero() {
+		return nil, bwe.M(bwe.AliasError, "There are no aliases to zero")
+	}
+	lgs, err := bc.findAliasLogs(ctx, []string{EventSig_Alias_AliasCreated, EventSig_Alias_AliasUpdated}, value)
+	if err != nil {
+		return nil, err
+	}
+	return bc.currentAliases(ctx, lgs, false)
+}
+
+func (bc *blockChain) FindAliasesOwnedBy(ctx context.Context, addrs []Address) ([]*AliasRecord, error) {
+	//An owner that cannot be found means there is no point looking
+	if _, err := bc.AliasOwner(ctx, Bytes32{}); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return []*AliasRecord{}, nil
+	}
+	owners := make([]Bytes32, len(addrs))
+	for i, a := range addrs {
+		//Indexed addresses are left padded
+		owners[i] = Bytes32(common.BytesToHash(a[:]))
+	}
+	lgs, err := bc.findAliasLogs(ctx, []string{EventSig_Alias_AliasTransferred}, owners...)
+	if err != nil {
+		return nil, err
+	}
+	return bc.currentAliases(ctx, lgs, true)
+}
+
+func (bc *blockChain) FindAliasesCreatedBy(ctx context.Context, addrs []Address) ([]*AliasRecord, error) {
+	if bc.isLight {
+		return nil, bwe.M(bwe.BlockChainGenericError, "Finding alias creators is not supported on a light client")
+	}
+	lgs, err := bc.findAliasLogs(ctx, []string{EventSig_Alias_AliasCreated})
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[Address]struct{}, len(addrs))
+	for _, a := range addrs {
+		want[a] = struct{}{}
+	}
+	rv := []*AliasRecord{}
+	for _, lg := range lgs {
+		rec := bc.aliasRecordFromLog(lg)
+		if _, ok := want[rec.Creator]; ok {
+			rv = append(rv, rec)
+		}
+	}
+	return rv, nil
+}
@@ -19,7 +19,7 @@ const (
 const RegistryLag = 5
 
 //Publish the given entity
-func (bcc *bcClient) PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(err error)) {
+func (bcc *bcClient) PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(res *TxResult, err error)) {
 	blob := ent.GetContent()
 	if len(blob) < 96 {
 		panic(bwe.M(bwe.BadOperation, "Entity not encoded"))
@@ -27,35 +27,29 @@ func (bcc *bcClient) PublishEntity(ctx context.Context, acc int, ent *objects.En
 	ob, _, _ := bcc.bc.ResolveEntity(ctx, ent.GetVK())
 	if ob != nil {
 		//Entity already exists
-		confirmed(nil)
+		confirmed(nil, nil)
 		return
 	}
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Registry_AddEntity), "", "", "",
-		blob)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	//Send it, and wait for it to confirm
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Registry_AddEntity), params: []interface{}{blob}},
+		func(res *TxResult, err error) {
 			if err != nil {
-				confirmed(err)
+				confirmed(nil, err)
 				return
 			}
 			//Check to see if entity state is valid
 			_, _, err = bcc.bc.ResolveEntity(ctx, ent.GetVK())
 			if err != nil {
-				confirmed(bwe.WrapM(bwe.RegistryEntityInvalid, "Could not publish: ", err))
+				confirmed(nil, bwe.WrapM(bwe.RegistryEntityInvalid, "Could not publish: ", err))
 				return
 			}
 			//We are good
-			confirmed(nil)
+			confirmed(res, nil)
 		})
 }
 
 //Publish the given DOT. The entities must be published already
-func (bcc *bcClient) PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(err error)) {
+func (bcc *bcClient) PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(res *TxResult, err error)) {
 	blob := dot.GetContent()
 	if len(blob) < 96 {
 		panic(bwe.M(bwe.BadOperation, "DOT not encoded"))
@@ -63,36 +57,30 @@ func (bcc *bcClient) PublishDOT(ctx context.Context, acc int, dot *objects.DOT,
 	ob, _, _ := bcc.bc.ResolveDOT(ctx, dot.GetHash())
 	if ob != nil {
 		//DOT already exists
-		confirmed(nil)
+		confirmed(nil, nil)
 		return
 	}
 
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Registry_AddDOT), "", "", "",
-		blob)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	//Send it, and wait for it to confirm
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Registry_AddDOT), params: []interface{}{blob}},
+		func(res *TxResult, err error) {
 			if err != nil {
-				confirmed(err)
+				confirmed(nil, err)
 				return
 			}
 			//Check to see if entity state is valid
 			_, _, err = bcc.bc.ResolveDOT(ctx, dot.GetHash())
 			if err != nil {
-				confirmed(bwe.WrapM(bwe.RegistryDOTInvalid, "Could not publish: ", err))
+				confirmed(nil, bwe.WrapM(bwe.RegistryDOTInvalid, "Could not publish: ", err))
 				return
 			}
 			//We are good
-			confirmed(nil)
+			confirmed(res, nil)
 		})
 }
 
 //Publish the given DChain. The dots and entities must be published already
-func (bcc *bcClient) PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(err error)) {
+func (bcc *bcClient) PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(res *TxResult, err error)) {
 	blob := chain.GetContent()
 	if len(blob) < 32 {
 		panic(bwe.M(bwe.BadOperation, "Chain not encoded"))
@@ -100,34 +88,42 @@ func (bcc *bcClient) PublishAccessDChain(ctx context.Context, acc int, chain *ob
 	ob, _, _ := bcc.bc.ResolveAccessDChain(ctx, chain.GetChainHash())
 	if ob != nil {
 		//Chain already exists
-		confirmed(nil)
+		confirmed(nil, nil)
 		return
 	}
 
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(UFI_Registry_AddChain), "", "", "",
-		blob)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-	//And wait for it to confirm
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	//Send it, and wait for it to confirm
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Registry_AddChain), params: []interface{}{blob}},
+		func(res *TxResult, err error) {
 			if err != nil {
-				confirmed(err)
+				confirmed(nil, err)
 				return
 			}
 			//Check to see if entity state is valid
 			_, _, err = bcc.bc.ResolveAccessDChain(ctx, chain.GetChainHash())
 			if err != nil {
-				confirmed(bwe.WrapM(bwe.RegistryChainInvalid, "Could not publish: ", err))
+				confirmed(nil, bwe.WrapM(bwe.RegistryChainInvalid, "Could not publish: ", err))
 				return
 			}
 			//We are good
-			confirmed(nil)
+			confirmed(res, nil)
 		})
 }
-func (bcc *bcClient) PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(err error)) {
+
+//Estimate what publishing the given DChain would cost
+func (bcc *bcClient) EstimateAccessDChain(ctx context.Context, acc int, chain *objects.DChain) (*TxCost, error) {
+	blob := chain.GetContent()
+	if len(blob) < 32 {
+		return nil, bwe.M(bwe.BadOperation, "Chain not encoded")
+	}
+	ob, _, _ := bcc.bc.ResolveAccessDChain(ctx, chain.GetChainHash())
+	if ob != nil {
+		return nil, nil
+	}
+	return bcc.estimateCall(ctx, &txCall{acc: acc, ufi: StringToUFI(UFI_Registry_AddChain), params: []interface{}{blob}})
+}
+
+func (bcc *bcClient) PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(res *TxResult, err error)) {
 	blob := rvk.GetContent()
 	if len(blob) < 128 {
 		panic(bwe.M(bwe.BadOperation, "Revocation not encoded"))
@@ -140,7 +136,7 @@ func (bcc *bcClient) PublishRevocation(ctx context.Context, acc int, rvk *object
 		targetufi = UFI_Registry_RevokeDOT
 		targetparam = SliceToBytes32(ob.GetHash())
 		if s != StateValid {
-			confirmed(bwe.M(bwe.NotRevokable, "DOT is not valid in the registry"))
+			confirmed(nil, bwe.M(bwe.NotRevokable, "DOT is not valid in the registry"))
 			return
 		}
 	} else {
@@ -149,54 +145,47 @@ func (bcc *bcClient) PublishRevocation(ctx context.Context, acc int, rvk *object
 			targetufi = UFI_Registry_RevokeEntity
 			targetparam = SliceToBytes32(ob.GetVK())
 			if s != StateValid {
-				confirmed(bwe.M(bwe.NotRevokable, "Entity is not valid in the registry"))
+				confirmed(nil, bwe.M(bwe.NotRevokable, "Entity is not valid in the registry"))
 				return
 			}
 			isEntity = true
 		} else {
 			//This should have been caught way earlier
-			confirmed(bwe.M(bwe.NotRevokable, "Could not resolve target to DOT or Entity"))
+			confirmed(nil, bwe.M(bwe.NotRevokable, "Could not resolve target to DOT or Entity"))
 			return
 		}
 	}
 
-	txhash, err := bcc.CallOnChain(ctx, acc, StringToUFI(targetufi), "", "", "",
-		targetparam, blob)
-	if err != nil {
-		confirmed(err)
-		return
-	}
-
-	//And wait for it to confirm
-	bcc.bc.GetTransactionDetailsInt(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations,
-		nil, func(bn uint64, err error) {
+	//Send it, and wait for it to confirm
+	bcc.sendAndConfirm(ctx, &txCall{acc: acc, ufi: StringToUFI(targetufi), params: []interface{}{targetparam, blob}},
+		func(res *TxResult, err error) {
 			if err != nil {
-				confirmed(err)
+				confirmed(nil, err)
 				return
 			}
 			if isEntity {
 				_, s, err = bcc.bc.ResolveEntity(ctx, rvk.GetTarget())
 				if err != nil {
-					confirmed(bwe.WrapM(bwe.RegistryEntityInvalid, "Could not revoke: ", err))
+					confirmed(nil, bwe.WrapM(bwe.RegistryEntityInvalid, "Could not revoke: ", err))
 					return
 				}
 				if s != StateRevoked {
-					confirmed(bwe.M(bwe.RegistryEntityInvalid, "Revocation didn't stick"))
+					confirmed(nil, bwe.M(bwe.RegistryEntityInvalid, "Revocation didn't stick"))
 					return
 				}
 			} else {
 				_, s, err = bcc.bc.ResolveDOT(ctx, rvk.GetTarget())
 				if err != nil {
-					confirmed(bwe.WrapM(bwe.RegistryDOTInvalid, "Could not revoke: ", err))
+					confirmed(nil, bwe.WrapM(bwe.RegistryDOTInvalid, "Could not revoke: ", err))
 					return
 				}
 				if s != StateRevoked {
-					confirmed(bwe.M(bwe.RegistryDOTInvalid, "Revocation didn't stick"))
+					confirmed(nil, bwe.M(bwe.RegistryDOTInvalid, "Revocation didn't stick"))
 					return
 				}
 			}
 			//We are good
-			confirmed(nil)
+			confirmed(res, nil)
 		})
 }
 
@@ -229,6 +218,10 @@ func (bc *blockChain) ResolveDOT(ctx context.Context, dothash []byte) (*objects.
 		return nil, StateError, bwe.M(bwe.RegistryDOTResolutionFailed, "DOT not found (but registry said it was ok!!)")
 	}
 	dti, err := objects.LoadRoutingObject(objects.ROAccessDOT, blob)
+	if err != nil {
+		//The registry holds permission DOTs too, which only decode as such
+		dti, err = objects.LoadRoutingObject(objects.ROPermissionDOT, blob)
+	}
 	if err != nil {
 		return nil, StateError, bwe.WrapM(bwe.RegistryDOTInvalid, "DOT Decoding failed (but registry said it was ok!!)", err)
 	}
@@ -0,0 +1,142 @@
+package bc
+
+import (
+	"context"
+	"time"
+
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+)
+
+//The kinds of TxEvent
+const (
+	//The transaction was mined in BlockNumber
+	TxEventMined = iota
+	//Another block was mined after the transaction's block. Confirmations
+	//says how many
+	TxEventConfirming
+	//The block the transaction was in (BlockNumber) is no longer in the
+	//chain. If the transaction is mined again, a TxEventMined follows
+	TxEventReorged
+	//The transaction was dropped by a reorg and has been sent again
+	TxEventRebroadcast
+	//The transaction has the required confirmations. Result is set. This
+	//is the last event
+	TxEventConfirmed
+	//Watching failed or timed out. Err is set. This is the last event
+	TxEventFailed
+)
+
+//A transaction dropped by reorgs is sent again at most this many times
+const maxTxRebroadcasts = 3
+
+//TxEvent is the progress of a transaction being watched
+type TxEvent struct {
+	Kind   int
+	TxHash common.Hash
+	//The block the transaction is in, or for TxEventReorged, was in
+	BlockNumber   uint64
+	Confirmations uint64
+	Result        *TxResult
+	Err           error
+}
+
+//WatchTransaction follows a transaction until it has more than the given
+//number of confirmations, writing its progress to the returned channel.
+//If a reorg removes the transaction's block, the confirmations start again
+//once it is mined in another, and if it was dropped from the pool as well
+//it is sent again. The timeout (in blocks) restarts after a reorg. The
+//channel is closed after the TxEventConfirmed or TxEventFailed, and must
+//be read until then
+func (bc *blockChain) WatchTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64) <-chan TxEvent {
+	rv := make(chan TxEvent, 16)
+	go bc.watchTransaction(ctx, txhash, timeoutblocks, confirmations, rv)
+	return rv
+}
+
+func (bc *blockChain) watchTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64, rv chan TxEvent) {
+	defer close(rv)
+	emit := func(ev TxEvent) {
+		ev.TxHash = txhash
+		rv <- ev
+	}
+	mined := false
+	timeout := func() {
+		if mined {
+			emit(TxEvent{Kind: TxEventFailed, Err: bwe.M(bwe.TransactionConfirmationTimeout, "Timeout waiting for confirmations")})
+		} else {
+			emit(TxEvent{Kind: TxEventFailed, Err: bwe.M(bwe.TransactionTimeout, "Timeout waiting for tx to appear")})
+		}
+	}
+	startblock := bc.CurrentBlock()
+	//The transaction as last seen, so it can be sent again
+	var known *types.Transaction
+	var minedNum, lastConf uint64
+	var minedHash common.Hash
+	rebroadcasts := 0
+	for {
+		if ctx.Err() != nil {
+			timeout()
+			return
+		}
+		curblock := bc.CurrentBlock()
+		tx, pending, blocknum, blockhash, err := bc.getTransactionBlock(txhash)
+		if err != nil {
+			emit(TxEvent{Kind: TxEventFailed, Err: bwe.WrapM(bwe.BlockChainGenericError, "Got TX error", err)})
+			return
+		}
+		if tx != nil {
+			known = tx
+		}
+		//The lookup may lag a reorg, so check the block is still canonical
+		inChain := !pending && tx != nil && blocknum > 0
+		if inChain {
+			hdr := bc.GetHeader(uint64(blocknum))
+			inChain = hdr != nil && hdr.Hash() == blockhash
+		}
+		switch {
+		case inChain && (!mined || blockhash != minedHash):
+			if mined {
+				emit(TxEvent{Kind: TxEventReorged, BlockNumber: minedNum})
+			}
+			mined, minedNum, minedHash, lastConf = true, uint64(blocknum), blockhash, 0
+			emit(TxEvent{Kind: TxEventMined, BlockNumber: minedNum})
+		case !inChain && mined:
+			emit(TxEvent{Kind: TxEventReorged, BlockNumber: minedNum})
+			mined = false
+			startblock = curblock
+			//Not in the pool either, so it will not be mined unless sent again
+			if pending && tx == nil && known != nil {
+				if rebroadcasts >= maxTxRebroadcasts {
+					emit(TxEvent{Kind: TxEventFailed, Err: bwe.M(bwe.BlockChainGenericError, "The transaction was dropped by a reorg too many times")})
+					return
+				}
+				rebroadcasts++
+				if err := bc.sendTx(ctx, known); err != nil {
+					emit(TxEvent{Kind: TxEventFailed, Err: bwe.WrapM(bwe.BlockChainGenericError, "The transaction was dropped by a reorg and could not be sent again", err)})
+					return
+				}
+				emit(TxEvent{Kind: TxEventRebroadcast})
+			}
+		}
+		if mined && curblock > minedNum {
+			conf := curblock - minedNum
+			if conf > confirmations {
+				emit(TxEvent{Kind: TxEventConfirmed, BlockNumber: minedNum, Confirmations: conf, Result: bc.txResult(txhash, minedNum)})
+				return
+			}
+			if conf != lastConf {
+				lastConf = conf
+				emit(TxEvent{Kind: TxEventConfirming, BlockNumber: minedNum, Confirmations: conf})
+			}
+		}
+		if curblock >= startblock+timeoutblocks {
+			timeout()
+			return
+		}
+		sctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		<-bc.AfterBlocks(sctx, 1)
+		cancel()
+	}
+}
@@ -3,10 +3,11 @@ package bc
 import (
 	"fmt"
 	"io"
+	"math/big"
 	"os"
-	"os/signal"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/immesys/bw2/objects"
@@ -38,6 +39,7 @@ const (
 	GpoMaxGasPrice       = "1000000000000000" // 1 finney
 	DefaultConfirmations = 2
 	DefaultTimeout       = 20
+	DefaultMaxGasPrice   = GpoMaxGasPrice
 )
 
 type blockChain struct {
@@ -49,8 +51,9 @@ type blockChain struct {
 	fethi *eth.Ethereum
 	lethi *les.LightEthereum
 
-	nd    *node.Node
-	shdwn chan bool
+	nd       *node.Node
+	shdwn    chan bool
+	stopOnce sync.Once
 
 	isLight bool
 
@@ -72,6 +75,10 @@ type bcClient struct {
 	acc                  int
 	DefaultConfirmations uint64
 	DefaultTimeout       uint64
+	MaxGasPrice          *big.Int
+	Retry                RetryPolicy
+	//Told how each operation that sends a transaction is going
+	Progress func(p *TxProgress)
 }
 
 type PunchTransaction struct {
@@ -129,6 +136,13 @@ type NBCParams struct {
 	MinerThreads      int
 	ExternalAddr      string
 	ListenPort        int
+	//Nil for the public BOSSWAVE chain
+	Private *PrivateChain
+	//How long the head of the chain may go without changing before the
+	//peers are rotated, zero for DefaultStallTimeout and negative to not
+	//watch it. OnStall, if set, is told when the sync stalls and resumes
+	StallTimeout time.Duration
+	OnStall      func(*SyncStall)
 }
 
 func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
@@ -186,14 +200,31 @@ func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
 		panic(err)
 	}
 	nodeUserIdent := strings.Join(comps, "/")
+	genesis := core.DefaultGenesisBlock()
+	networkID := uint64(28589)
+	bootNodes, bootNodes5 := BOSSWAVEBootNodes, BOSSWAVEBootNodes5
+	if args.Private != nil {
+		genesis, err = args.Private.loadGenesis()
+		if err != nil {
+			panic(err)
+		}
+		networkID = args.Private.networkID(genesis)
+		bootNodes, bootNodes5, err = args.Private.bootNodes()
+		if err != nil {
+			panic(err)
+		}
+		if args.Private.DevMiner && args.MinerThreads < 1 {
+			args.MinerThreads = 1
+		}
+	}
 	p2p := p2p.Config{
 		PrivateKey:       nil,
 		NoDiscovery:      false, //Only use v5
 		DiscoveryV5:      true,
 		DiscoveryV5Addr:  fmt.Sprintf(":%d", args.ListenPort+1),
 		NetRestrict:      netrestrictl,
-		BootstrapNodes:   BOSSWAVEBootNodes,
-		BootstrapNodesV5: BOSSWAVEBootNodes5,
+		BootstrapNodes:   bootNodes,
+		BootstrapNodesV5: bootNodes5,
 		ListenAddr:       fmt.Sprintf(":%d", args.ListenPort),
 		NAT:              nati,
 		MaxPeers:         args.MaxPeers,
@@ -253,14 +284,14 @@ func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
 	*/
 
 	ethConf := &eth.Config{
-		Genesis:       core.DefaultGenesisBlock(),
+		Genesis:       genesis,
 		Etherbase:     args.CoinBase,
 		SyncMode:      downloader.FastSync,
 		LightServ:     args.MaxLightResources,
 		LightPeers:    args.MaxLightPeers,
 		MaxPeers:      args.MaxPeers,
 		DatabaseCache: DefaultDBCache,
-		NetworkId:     28589,
+		NetworkId:     networkID,
 		MinerThreads:  args.MinerThreads,
 		ExtraData:     []byte(extra),
 		DocRoot:       "",
@@ -282,6 +313,7 @@ func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
 		EthashDatasetsInMem:     1,
 		EthashDatasetsOnDisk:    2,
 		EnablePreimageRecording: false,
+		PowTest:                 args.Private != nil,
 	}
 	if args.IsLight {
 		if err := stack.Register(func(ctx *node.ServiceContext) (node.Service, error) {
@@ -401,7 +433,8 @@ func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
 	// Start auxiliary services if enabled
 	if args.MinerThreads > 0 && !args.IsLight {
 		go func() {
-			for {
+			//A dev miner has no public chain to sync first
+			for args.Private == nil || !args.Private.DevMiner {
 				time.Sleep(30 * time.Second)
 				if rv.CurrentBlock() > 3000000 {
 					break
@@ -418,14 +451,16 @@ func NewBlockChain(args NBCParams) (BlockChainProvider, chan bool) {
 	// rv.api_pubeth = eth.NewPublicEthereumAPI(ethi)
 	// rv.fm = filters.NewFilterSystem(rv.eth.EventMux())
 	//	eth.NewPublicBlockChainAPI(config *core.ChainConfig, bc *core.BlockChain, m *miner.Miner, chainDb ethdb.Database, gpo *eth.GasPriceOracle, eventMux *event.TypeMux, am *accounts.Manager)
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	go func() {
-		<-sig
-		rv.nd.Stop()
-		rv.shdwn <- true
-	}()
+	//The router shuts the chain down on SIGINT and SIGTERM, once it has
+	//stopped itself
 	go rv.DebugTXPoolLoop()
+	if args.StallTimeout >= 0 {
+		w := &syncWatchdog{bc: rv, timeout: args.StallTimeout, bootNodes: bootNodes, onStall: args.OnStall}
+		if w.timeout == 0 {
+			w.timeout = DefaultStallTimeout
+		}
+		go w.run()
+	}
 	peersg := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "total_peers",
 		Help: "total number of peers",
@@ -686,6 +721,8 @@ func (bc *blockChain) GetClient(ent *objects.Entity) BlockChainClient {
 		ent:                  ent,
 		DefaultConfirmations: DefaultConfirmations,
 		DefaultTimeout:       DefaultTimeout,
+		MaxGasPrice:          math.MustParseBig256(DefaultMaxGasPrice),
+		Retry:                DefaultRetryPolicy,
 	}
 	bc.ks.AddEntity(ent)
 	return rv
@@ -698,10 +735,12 @@ func (bcc *bcClient) SetEntity(ent *objects.Entity) {
 	bcc.bc.ks.AddEntity(ent)
 }
 
-/*
 func (bc *blockChain) Shutdown() {
-	bc.nd.Stop()
-}*/
+	bc.stopOnce.Do(func() {
+		bc.nd.Stop()
+		bc.shdwn <- true
+	})
+}
 
 // Frontend stuff
 /*
@@ -0,0 +1,145 @@
+package bc
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/crypto"
+)
+
+//The names of the builtin contracts
+const (
+	ContractRegistry = "registry"
+	ContractAlias    = "alias"
+	ContractAffinity = "affinity"
+)
+
+//ContractNames lists the builtin contracts in a stable order
+var ContractNames = []string{ContractRegistry, ContractAlias, ContractAffinity}
+
+//ContractSet is where the builtin contracts are deployed on a chain
+type ContractSet struct {
+	Addresses map[string]Address
+	//The keccak256 of the expected runtime code of each contract. Contracts
+	//without an entry are not checked
+	CodeHashes map[string]common.Hash
+}
+
+//DefaultContracts returns the addresses the UFI constants were generated
+//for, which is where the contracts are on the public BOSSWAVE chain
+func DefaultContracts() *ContractSet {
+	return &ContractSet{
+		Addresses: map[string]Address{
+			ContractRegistry: HexToAddress(UFI_Registry_Address),
+			ContractAlias:    HexToAddress(UFI_Alias_Address),
+			ContractAffinity: HexToAddress(UFI_Affinity_Address),
+		},
+		CodeHashes: map[string]common.Hash{},
+	}
+}
+
+var contractsMu sync.RWMutex
+
+//Maps the address in a UFI constant to the address the contract is
+//actually at, for contracts that have moved
+var contractRemap = map[Address]Address{}
+var activeContracts = DefaultContracts()
+
+//SetContracts points the builtin UFIs at the given contracts, e.g. after
+//an upgrade deployed them at new addresses. Contracts missing from cs keep
+//their default address
+func SetContracts(cs *ContractSet) {
+	def := DefaultContracts()
+	active := &ContractSet{Addresses: map[string]Address{}, CodeHashes: map[string]common.Hash{}}
+	remap := map[Address]Address{}
+	for _, name := range ContractNames {
+		addr, ok := cs.Addresses[name]
+		if !ok {
+			addr = def.Addresses[name]
+		}
+		active.Addresses[name] = addr
+		if addr != def.Addresses[name] {
+			remap[def.Addresses[name]] = addr
+		}
+		if h, ok := cs.CodeHashes[name]; ok {
+			active.CodeHashes[name] = h
+		}
+	}
+	contractsMu.Lock()
+	activeContracts = active
+	contractRemap = remap
+	contractsMu.Unlock()
+}
+
+//ContractAddress returns the address of a builtin contract on this chain
+func ContractAddress(name string) Address {
+	contractsMu.RLock()
+	defer contractsMu.RUnlock()
+	return activeContracts.Addresses[name]
+}
+
+//remapContract returns the address a UFI's contract is actually at
+func remapContract(addr common.Address) common.Address {
+	contractsMu.RLock()
+	defer contractsMu.RUnlock()
+	if to, ok := contractRemap[Address(addr)]; ok {
+		return common.Address(to)
+	}
+	return addr
+}
+
+//ContractStatus is the result of checking a builtin contract's code
+type ContractStatus struct {
+	Name    string
+	Address Address
+	//Zero if the code could not be read
+	CodeHash common.Hash
+	//Zero if no hash is expected
+	ExpectedHash common.Hash
+	//Nil if the contract has code matching its expected hash, if any
+	Err error
+}
+
+//VerifyContracts checks that each builtin contract has code on the chain,
+//and that the code matches its expected hash
+func VerifyContracts(ctx context.Context, bcp BlockChainProvider) []ContractStatus {
+	contractsMu.RLock()
+	cs := activeContracts
+	contractsMu.RUnlock()
+	rv := make([]ContractStatus, 0, len(ContractNames))
+	for _, name := range ContractNames {
+		st := ContractStatus{Name: name, Address: cs.Addresses[name], ExpectedHash: cs.CodeHashes[name]}
+		code, err := bcp.GetCode(ctx, st.Address.Hex())
+		switch {
+		case err != nil:
+			st.Err = err
+		case len(code) == 0:
+			st.Err = bwe.M(bwe.BlockChainGenericError, "there is no contract at 0x"+st.Address.Hex())
+		default:
+			st.CodeHash = crypto.Keccak256Hash(code)
+			if (st.ExpectedHash != common.Hash{}) && st.CodeHash != st.ExpectedHash {
+				st.Err = bwe.M(bwe.BlockChainGenericError, "the code at 0x"+st.Address.Hex()+" does not match the expected hash")
+			}
+		}
+		rv = append(rv, st)
+	}
+	return rv
+}
+
+//ChainID returns the chain ID from the chain config, or zero if it has
+//none
+func (bc *blockChain) ChainID() *big.Int {
+	var id *big.Int
+	if bc.isLight {
+		id = bc.lethi.ApiBackend.ChainConfig().ChainId
+	} else {
+		id = bc.fethi.ApiBackend.ChainConfig().ChainId
+	}
+	if id == nil {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(id)
+}
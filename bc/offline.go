@@ -0,0 +1,120 @@
+package bc
+
+import (
+	"math/big"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+	"github.com/immesys/bw2bc/rlp"
+)
+
+//OfflineTx holds the transaction fields that would normally be filled in
+//from the chain, so that a transaction can be signed on a machine that has
+//no chain at all
+type OfflineTx struct {
+	Nonce    uint64
+	GasPrice *big.Int
+	//If nil, BWDefaultGasBig is used
+	Gas *big.Int
+	//Nil for pre EIP155 signing
+	ChainID *big.Int
+}
+
+//OfflineCall is an on-chain invocation that can be signed offline
+type OfflineCall struct {
+	UFI    UFI
+	Value  *big.Int
+	Params []interface{}
+}
+
+//PublishEntityCall adds the entity to the registry
+func PublishEntityCall(ent *objects.Entity) *OfflineCall {
+	return &OfflineCall{UFI: StringToUFI(UFI_Registry_AddEntity), Params: []interface{}{ent.GetContent()}}
+}
+
+//PublishDOTCall adds the DOT to the registry
+func PublishDOTCall(dot *objects.DOT) *OfflineCall {
+	return &OfflineCall{UFI: StringToUFI(UFI_Registry_AddDOT), Params: []interface{}{dot.GetContent()}}
+}
+
+//SetAliasCall creates a long alias. The alias contract charges in
+//proportion to the gas price, so this must match the transaction's
+func SetAliasCall(key Bytes32, val Bytes32, gasPrice *big.Int) *OfflineCall {
+	cash := big.NewInt(AliasCreateLongCost)
+	cash = cash.Mul(cash, gasPrice)
+	return &OfflineCall{UFI: StringToUFI(UFI_Alias_SetAlias), Value: cash, Params: []interface{}{key, val}}
+}
+
+//AcceptRoutingOfferCall accepts a designated router offer for the
+//namespace. nsnonce is the namespace's current affinity nonce, see
+//GetAffinityNSNonce
+func AcceptRoutingOfferCall(ns *objects.Entity, drvk []byte, nsnonce *big.Int) *OfflineCall {
+	nonce := new(big.Int).Add(nsnonce, big.NewInt(1))
+	sig := acceptRoutingSig(ns, drvk, nonce)
+	return &OfflineCall{UFI: StringToUFI(UFI_Affinity_AcceptRouting), Params: []interface{}{ns.GetVK(), drvk, nonce, sig}}
+}
+
+//EntityAccountAddress returns the address of one of the entity's accounts
+func EntityAccountAddress(ent *objects.Entity, acc int) (Address, error) {
+	if acc < 0 || acc >= MaxEntityAccounts {
+		return Address{}, bwe.M(bwe.InvalidAccountNumber, "Invalid account number")
+	}
+	key, err := createKeyByIndex(ent, acc)
+	if err != nil {
+		return Address{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not derive account key", err)
+	}
+	return Address(key.Address), nil
+}
+
+//SignOffline builds and signs the call as a transaction from the given
+//account of ent, returning the RLP encoded transaction
+func SignOffline(ent *objects.Entity, acc int, call *OfflineCall, otx *OfflineTx) (raw []byte, txhash common.Hash, err error) {
+	if acc < 0 || acc >= MaxEntityAccounts {
+		return nil, common.Hash{}, bwe.M(bwe.InvalidAccountNumber, "Invalid account number")
+	}
+	if otx.GasPrice == nil {
+		return nil, common.Hash{}, bwe.M(bwe.InvalidUFI, "Offline transactions need a gas price")
+	}
+	addr, calldata, err := EncodeABICall(call.UFI, call.Params...)
+	if err != nil {
+		return nil, common.Hash{}, bwe.WrapM(bwe.InvalidUFI, "Invalid on-chain UFI call args", err)
+	}
+	gas := otx.Gas
+	if gas == nil {
+		gas = BWDefaultGasBig
+	}
+	value := call.Value
+	if value == nil {
+		value = big.NewInt(0)
+	}
+	key, err := createKeyByIndex(ent, acc)
+	if err != nil {
+		return nil, common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not derive account key", err)
+	}
+	tx := types.NewTransaction(otx.Nonce, addr, value, gas, otx.GasPrice, calldata)
+	var signed *types.Transaction
+	if otx.ChainID != nil {
+		signed, err = types.SignTx(tx, types.NewEIP155Signer(otx.ChainID), key.PrivateKey)
+	} else {
+		signed, err = types.SignTx(tx, types.HomesteadSigner{}, key.PrivateKey)
+	}
+	if err != nil {
+		return nil, common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not sign transaction", err)
+	}
+	raw, err = rlp.EncodeToBytes(signed)
+	if err != nil {
+		return nil, common.Hash{}, bwe.WrapM(bwe.BlockChainGenericError, "Could not encode transaction", err)
+	}
+	return raw, signed.Hash(), nil
+}
+
+//DecodeRawTransaction decodes a transaction produced by SignOffline
+func DecodeRawTransaction(raw []byte) (*types.Transaction, error) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(raw, tx); err != nil {
+		return nil, bwe.WrapM(bwe.MalformedMessage, "Could not decode transaction", err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,150 @@
+package bc
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core"
+	"github.com/immesys/bw2bc/p2p/discover"
+	"github.com/immesys/bw2bc/p2p/discv5"
+	"github.com/immesys/bw2bc/params"
+)
+
+//PrivateChain selects a chain other than the public BOSSWAVE chain, so that
+//a deployment can run without it or real Ether. Private chains use the
+//cheap test proof of work, so every node on one must be configured with it
+type PrivateChain struct {
+	//The genesis block in geth's JSON format, see MakePrivateGenesis
+	GenesisFile string
+	//If nonzero, overrides the chain ID in the genesis
+	ChainID uint64
+	//Defaults to the chain ID
+	NetworkID uint64
+	//Enode URLs of other nodes on the chain. The public boot nodes are
+	//never used for a private chain
+	BootNodes []string
+	//Mine from the start, on at least one thread, so that transactions
+	//are confirmed without dedicated miners
+	DevMiner bool
+}
+
+//The difficulty of a private genesis block. This is the lowest the
+//difficulty adjustment allows, so a single CPU mines blocks quickly
+const privateGenesisDifficulty = 131072
+
+//The gas limit of a private genesis block, high enough for the largest
+//BOSSWAVE transactions
+const privateGenesisGasLimit = 8000000
+
+//BuiltinContracts are the addresses of the contracts BOSSWAVE uses. They
+//must exist on any chain a router uses
+var BuiltinContracts = []string{
+	UFI_Registry_Address,
+	UFI_Alias_Address,
+	UFI_Affinity_Address,
+}
+
+//MakePrivateGenesis returns the JSON genesis for a private chain. The code
+//is placed at each address of contracts without running any constructor,
+//so the builtin contracts are deployed at the addresses the UFIs expect at
+//no cost, and with all their prices at zero. funds gives the balance in wei
+//of each prefunded address
+func MakePrivateGenesis(chainID uint64, contracts map[Address][]byte, funds map[Address]*big.Int) ([]byte, error) {
+	for _, addr := range BuiltinContracts {
+		if len(contracts[HexToAddress(addr)]) == 0 {
+			return nil, bwe.M(bwe.BadOperation, "missing code for builtin contract 0x"+addr)
+		}
+	}
+	alloc := core.GenesisAlloc{}
+	for addr, code := range contracts {
+		alloc[common.Address(addr)] = core.GenesisAccount{Code: code, Balance: big.NewInt(0)}
+	}
+	for addr, wei := range funds {
+		acc := alloc[common.Address(addr)]
+		acc.Balance = wei
+		alloc[common.Address(addr)] = acc
+	}
+	g := &core.Genesis{
+		Config:     privateChainConfig(new(big.Int).SetUint64(chainID)),
+		GasLimit:   privateGenesisGasLimit,
+		Difficulty: big.NewInt(privateGenesisDifficulty),
+		Alloc:      alloc,
+	}
+	return json.MarshalIndent(g, "", "  ")
+}
+
+//All the forks a private chain supports are active from the genesis
+func privateChainConfig(chainID *big.Int) *params.ChainConfig {
+	return &params.ChainConfig{
+		ChainId:        chainID,
+		HomesteadBlock: big.NewInt(0),
+		EIP150Block:    big.NewInt(0),
+		EIP155Block:    big.NewInt(0),
+		EIP158Block:    big.NewInt(0),
+	}
+}
+
+//loadGenesis reads the genesis of the private chain and applies the chain
+//ID override
+func (p *PrivateChain) loadGenesis() (*core.Genesis, error) {
+	contents, err := ioutil.ReadFile(p.GenesisFile)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BadOperation, "could not read the private chain genesis", err)
+	}
+	g := new(core.Genesis)
+	if err := json.Unmarshal(contents, g); err != nil {
+		return nil, bwe.WrapM(bwe.BadOperation, "could not parse the private chain genesis", err)
+	}
+	if g.Config == nil {
+		g.Config = privateChainConfig(big.NewInt(0))
+	}
+	if p.ChainID != 0 {
+		g.Config.ChainId = new(big.Int).SetUint64(p.ChainID)
+	}
+	if g.Config.ChainId == nil || g.Config.ChainId.Sign() == 0 {
+		return nil, bwe.M(bwe.BadOperation, "the private chain needs a chain ID")
+	}
+	return g, nil
+}
+
+func (p *PrivateChain) networkID(g *core.Genesis) uint64 {
+	if p.NetworkID != 0 {
+		return p.NetworkID
+	}
+	return g.Config.ChainId.Uint64()
+}
+
+func (p *PrivateChain) bootNodes() ([]*discover.Node, []*discv5.Node, error) {
+	v4 := []*discover.Node{}
+	v5 := []*discv5.Node{}
+	for _, url := range p.BootNodes {
+		n, err := discover.ParseNode(url)
+		if err != nil {
+			return nil, nil, bwe.WrapM(bwe.BadOperation, "bad private chain boot node", err)
+		}
+		v4 = append(v4, n)
+		n5, err := discv5.ParseNode(url)
+		if err != nil {
+			return nil, nil, bwe.WrapM(bwe.BadOperation, "bad private chain boot node", err)
+		}
+		v5 = append(v5, n5)
+	}
+	return v4, v5, nil
+}
+
+//GetCode returns the contract code at an address (in hex). It is used to
+//copy the builtin contracts into a private genesis
+func (bc *blockChain) GetCode(ctx context.Context, addr string) ([]byte, error) {
+	if bc.isLight {
+		return nil, bwe.M(bwe.BlockChainGenericError, "contract code is not available on a light client")
+	}
+	sdb, err := bc.fethi.BlockChain().State()
+	if err != nil {
+		return nil, err
+	}
+	return sdb.GetCode(common.HexToAddress(addr)), nil
+}
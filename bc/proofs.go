@@ -0,0 +1,225 @@
+package bc
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/state"
+	"github.com/immesys/bw2bc/crypto"
+	"github.com/immesys/bw2bc/rlp"
+	"github.com/immesys/bw2bc/trie"
+)
+
+//The storage slots of the state of the builtin contracts, in the order it
+//is declared in contracts/
+const (
+	SlotRegistryEntities  = 1
+	SlotRegistryDOTs      = 2
+	SlotRegistryDChains   = 3
+	SlotRegistryDOTFromVK = 5
+	SlotAliasDB           = 0
+	SlotAliasFor          = 1
+	SlotAliasOwner        = 7
+	SlotAffinityDRSRV     = 2
+	SlotAffinityOffers    = 3
+	SlotAffinityDR        = 4
+)
+
+//maxProvenBytes bounds the length of a bytes value read from proven storage
+const maxProvenBytes = 1 << 20
+
+//StorageProof proves the values of some of a contract's storage slots in
+//the state of a block, so that a client without the state can check what
+//a node that has it says
+type StorageProof struct {
+	Block   uint64
+	Address Address
+	//The trie nodes from the block's state root to the contract's account
+	Account []rlp.RawValue
+	Slots   []SlotProof
+}
+
+//SlotProof is the value of one storage slot, and the trie nodes from the
+//contract's storage root to it
+type SlotProof struct {
+	Slot  common.Hash
+	Value common.Hash
+	Nodes []rlp.RawValue
+}
+
+//StorageProver is implemented by providers that hold the chain state, and
+//not by light clients
+type StorageProver interface {
+	//ProveStorage proves the given slots of the contract at addr in the
+	//state of the given block
+	ProveStorage(ctx context.Context, block uint64, addr Address, slots []common.Hash) (*StorageProof, error)
+}
+
+func (bc *blockChain) ProveStorage(ctx context.Context, block uint64, addr Address, slots []common.Hash) (*StorageProof, error) {
+	if bc.isLight {
+		return nil, bwe.M(bwe.BadOperation, "a light client has no state to prove")
+	}
+	hdr := bc.fethi.BlockChain().GetHeaderByNumber(block)
+	if hdr == nil {
+		return nil, bwe.M(bwe.BlockChainGenericError, "no such block")
+	}
+	db := bc.fethi.ChainDb()
+	st, err := trie.New(hdr.Root, db)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "could not open the state", err)
+	}
+	akey := crypto.Keccak256(addr[:])
+	rv := &StorageProof{Block: block, Address: addr, Account: st.Prove(akey)}
+	enc, err := st.TryGet(akey)
+	if err != nil || len(enc) == 0 {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "no contract at "+common.Address(addr).Hex(), err)
+	}
+	acc := state.Account{}
+	if err := rlp.DecodeBytes(enc, &acc); err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "bad account in the state", err)
+	}
+	storage, err := trie.New(acc.Root, db)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "could not open the contract's storage", err)
+	}
+	for _, s := range slots {
+		skey := crypto.Keccak256(s[:])
+		sp := SlotProof{Slot: s, Nodes: storage.Prove(skey)}
+		enc, err := storage.TryGet(skey)
+		if err != nil {
+			return nil, bwe.WrapM(bwe.BlockChainGenericError, "could not read the contract's storage", err)
+		}
+		if sp.Value, err = storageValue(enc); err != nil {
+			return nil, err
+		}
+		rv.Slots = append(rv.Slots, sp)
+	}
+	return rv, nil
+}
+
+//Verify checks the proof against the state root of its block and returns
+//the value of each slot in it
+func (p *StorageProof) Verify(stateRoot common.Hash) (map[common.Hash]common.Hash, error) {
+	enc, err := trie.VerifyProof(stateRoot, crypto.Keccak256(p.Address[:]), p.Account)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.RegistryProofInvalid, "bad account proof", err)
+	}
+	if len(enc) == 0 {
+		return nil, bwe.M(bwe.RegistryProofInvalid, "the contract is not in the state")
+	}
+	acc := state.Account{}
+	if err := rlp.DecodeBytes(enc, &acc); err != nil {
+		return nil, bwe.WrapM(bwe.RegistryProofInvalid, "bad account in the proof", err)
+	}
+	rv := make(map[common.Hash]common.Hash, len(p.Slots))
+	for _, sp := range p.Slots {
+		enc, err := trie.VerifyProof(acc.Root, crypto.Keccak256(sp.Slot[:]), sp.Nodes)
+		if err != nil {
+			return nil, bwe.WrapM(bwe.RegistryProofInvalid, "bad storage proof", err)
+		}
+		v, err := storageValue(enc)
+		if err != nil {
+			return nil, err
+		}
+		if v != sp.Value {
+			return nil, bwe.M(bwe.RegistryProofInvalid, "storage proof is for another value")
+		}
+		rv[sp.Slot] = v
+	}
+	return rv, nil
+}
+
+//storageValue decodes a storage trie value, which is a trimmed RLP string.
+//A missing value is zero
+func storageValue(enc []byte) (common.Hash, error) {
+	if len(enc) == 0 {
+		return common.Hash{}, nil
+	}
+	_, content, _, err := rlp.Split(enc)
+	if err != nil || len(content) > 32 {
+		return common.Hash{}, bwe.M(bwe.RegistryProofInvalid, "bad storage value")
+	}
+	return common.BytesToHash(content), nil
+}
+
+//SlotNumber is the slot of a contract's n'th state variable
+func SlotNumber(n int64) common.Hash {
+	return common.BigToHash(big.NewInt(n))
+}
+
+//MappingSlot is the slot of m[key] for a mapping m at the given slot
+func MappingSlot(key []byte, slot common.Hash) common.Hash {
+	return common.BytesToHash(crypto.Keccak256(common.LeftPadBytes(key, 32), slot[:]))
+}
+
+//SlotOffset is the n'th slot after the given one, as for the fields of a
+//struct or the elements of an array
+func SlotOffset(slot common.Hash, n int) common.Hash {
+	v := new(big.Int).SetBytes(slot[:])
+	return common.BigToHash(v.Add(v, big.NewInt(int64(n))))
+}
+
+//ArraySlots are the slots of the first n elements of a dynamic array of
+//32 byte values whose length is at the given slot
+func ArraySlots(slot common.Hash, n int) []common.Hash {
+	base := common.BytesToHash(crypto.Keccak256(slot[:]))
+	rv := make([]common.Hash, n)
+	for i := range rv {
+		rv[i] = SlotOffset(base, i)
+	}
+	return rv
+}
+
+//bytesLength decodes the head slot of a bytes value. Short values are kept
+//in the head slot itself
+func bytesLength(head common.Hash) (n int, short bool, err error) {
+	if head[31]&1 == 0 {
+		if head[31] > 62 {
+			return 0, false, bwe.M(bwe.RegistryProofInvalid, "bad bytes value")
+		}
+		return int(head[31] / 2), true, nil
+	}
+	l := new(big.Int).SetBytes(head[:])
+	l.Rsh(l, 1)
+	if l.BitLen() > 31 || l.Int64() > maxProvenBytes {
+		return 0, false, bwe.M(bwe.RegistryProofInvalid, "bytes value too long")
+	}
+	return int(l.Int64()), false, nil
+}
+
+//BytesSlots are the slots holding the content of a bytes value at slot,
+//given the value of that slot
+func BytesSlots(slot common.Hash, head common.Hash) ([]common.Hash, error) {
+	n, short, err := bytesLength(head)
+	if err != nil || short {
+		return nil, err
+	}
+	return ArraySlots(slot, (n+31)/32), nil
+}
+
+//DecodeBytes reads the bytes value at slot from storage values, which must
+//include its content slots
+func DecodeBytes(slot common.Hash, values map[common.Hash]common.Hash) ([]byte, error) {
+	head, ok := values[slot]
+	if !ok {
+		return nil, bwe.M(bwe.RegistryProofInvalid, "the proof is missing a slot")
+	}
+	n, short, err := bytesLength(head)
+	if err != nil {
+		return nil, err
+	}
+	if short {
+		return append([]byte{}, head[:n]...), nil
+	}
+	rv := make([]byte, 0, n+31)
+	for _, s := range ArraySlots(slot, (n+31)/32) {
+		v, ok := values[s]
+		if !ok {
+			return nil, bwe.M(bwe.RegistryProofInvalid, "the proof is missing a slot")
+		}
+		rv = append(rv, v[:]...)
+	}
+	return rv[:n], nil
+}
@@ -0,0 +1,219 @@
+package bc
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+)
+
+//RetryPolicy controls how the operations that send a transaction for an
+//entity (publishing objects, aliases and routing offers) are retried when
+//the transaction is not accepted or not mined in time. Every attempt at an
+//operation reuses the nonce of the first, so at most one of them can be
+//mined and a retry never carries out the operation twice
+type RetryPolicy struct {
+	//The most times the transaction is sent, at least one
+	MaxAttempts int
+	//The wait before the second attempt, which doubles for each attempt
+	//after that up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	//The percentage the gas price is raised by on each attempt, so that
+	//the pool takes the new transaction in place of the old one. It is
+	//never raised above the client's MaxGasPrice
+	GasBump int
+}
+
+//DefaultRetryPolicy is the policy of a new client
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     time.Minute,
+	GasBump:        10,
+}
+
+//TxProgress is passed to InteractionParams.Progress as an operation is
+//carried out
+type TxProgress struct {
+	//Starts at one
+	Attempt int
+	//The transaction of this attempt
+	TxHash common.Hash
+	//Set for each event while the transaction is watched. It is nil when
+	//the transaction has just been sent, or when the attempt failed
+	Event *TxEvent
+	//Set when the attempt failed, with the wait before the next one. There
+	//is no next attempt if Backoff is zero
+	Err     error
+	Backoff time.Duration
+}
+
+//txCall is the transaction an operation sends
+type txCall struct {
+	acc    int
+	ufi    UFI
+	params []interface{}
+	//For contracts that charge for an operation in gas, the value to send
+	//at the given gas price. Nil sends no value
+	valueAt func(gasPrice *big.Int) *big.Int
+}
+
+//backoff is the wait before the given attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 2; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+//retryable is true for the errors that a later attempt at the same
+//transaction could avoid
+func retryable(err error) bool {
+	switch bwe.AsBW(err).Code {
+	case bwe.TransactionUnderpriced, bwe.TransactionTimeout, bwe.BlockChainGenericError:
+		return true
+	}
+	return false
+}
+
+//bumpTx is tx at a gas price GasBump percent higher, capped at the
+//client's MaxGasPrice, with the value the call needs at that price
+func (bcc *bcClient) bumpTx(tx *types.Transaction, call *txCall) *types.Transaction {
+	gasp := new(big.Int).Mul(tx.GasPrice(), big.NewInt(int64(100+bcc.Retry.GasBump)))
+	gasp.Div(gasp, big.NewInt(100))
+	if bcc.MaxGasPrice != nil && gasp.Cmp(bcc.MaxGasPrice) > 0 {
+		gasp = new(big.Int).Set(bcc.MaxGasPrice)
+	}
+	value := tx.Value()
+	if call.valueAt != nil {
+		value = call.valueAt(gasp)
+	}
+	return types.NewTransaction(tx.Nonce(), *tx.To(), value, tx.Gas(), gasp, tx.Data())
+}
+
+//sendAndConfirm sends the call as a transaction and waits for it to be
+//confirmed, retrying as the client's RetryPolicy allows. confirmed is
+//called once, from another goroutine
+func (bcc *bcClient) sendAndConfirm(ctx context.Context, call *txCall, confirmed func(res *TxResult, err error)) {
+	tx, err := bcc.prepareCall(ctx, call)
+	if err != nil {
+		confirmed(nil, err)
+		return
+	}
+	go bcc.retryTx(ctx, call, tx, confirmed)
+}
+
+//prepareCall makes the unsigned transaction for the call, with its gas
+//estimated
+func (bcc *bcClient) prepareCall(ctx context.Context, call *txCall) (*types.Transaction, error) {
+	to, calldata, err := EncodeABICall(call.ufi, call.params...)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.InvalidUFI, "Invalid on-chain UFI call args", err)
+	}
+	value, gasPrice := "", ""
+	if call.valueAt != nil {
+		gasp, err := bcc.gasPrice(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		value = call.valueAt(gasp).Text(10)
+		gasPrice = gasp.Text(10)
+	}
+	return bcc.prepareTx(ctx, call.acc, to.Hex(), value, "", gasPrice, calldata)
+}
+
+//estimateCall is what sendAndConfirm would spend on the first attempt of
+//the call. Retries bump the gas price, so may cost more
+func (bcc *bcClient) estimateCall(ctx context.Context, call *txCall) (*TxCost, error) {
+	tx, err := bcc.prepareCall(ctx, call)
+	if err != nil {
+		return nil, err
+	}
+	return &TxCost{Gas: tx.Gas(), GasPrice: tx.GasPrice(), Value: tx.Value()}, nil
+}
+
+func (bcc *bcClient) retryTx(ctx context.Context, call *txCall, tx *types.Transaction, confirmed func(res *TxResult, err error)) {
+	policy := bcc.Retry
+	progress := func(p *TxProgress) {
+		if bcc.Progress != nil {
+			bcc.Progress(p)
+		}
+	}
+	//Every transaction sent, all with the same nonce
+	var sent []common.Hash
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			tx = bcc.bumpTx(tx, call)
+		}
+		txhash, err := bcc.signAndSendTransaction(ctx, call.acc, tx)
+		if err != nil && len(sent) > 0 && bwe.AsBW(err).Code == bwe.TransactionNonceTooLow {
+			//One of the earlier attempts was mined after all
+			for _, h := range sent {
+				if _, pending, bn, terr := bcc.bc.getTransaction(h); terr == nil && !pending && bn > 0 {
+					txhash, err = h, nil
+					break
+				}
+			}
+		}
+		if err == nil {
+			sent = append(sent, txhash)
+			progress(&TxProgress{Attempt: attempt, TxHash: txhash})
+			err = bcc.watchAttempt(ctx, attempt, txhash, progress, confirmed)
+			if err == nil {
+				return
+			}
+		}
+		if attempt >= policy.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			progress(&TxProgress{Attempt: attempt, TxHash: txhash, Err: err})
+			confirmed(nil, err)
+			return
+		}
+		wait := policy.backoff(attempt + 1)
+		progress(&TxProgress{Attempt: attempt, TxHash: txhash, Err: err, Backoff: wait})
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			confirmed(nil, err)
+			return
+		}
+	}
+}
+
+//watchAttempt follows a transaction until it is confirmed, when confirmed
+//is called and nil returned, or until it fails
+func (bcc *bcClient) watchAttempt(ctx context.Context, attempt int, txhash common.Hash, progress func(p *TxProgress), confirmed func(res *TxResult, err error)) error {
+	var err error
+	for ev := range bcc.bc.WatchTransaction(ctx, txhash, bcc.DefaultTimeout, bcc.DefaultConfirmations) {
+		ev := ev
+		progress(&TxProgress{Attempt: attempt, TxHash: txhash, Event: &ev})
+		switch ev.Kind {
+		case TxEventConfirmed:
+			confirmed(ev.Result, nil)
+			return nil
+		case TxEventFailed:
+			err = ev.Err
+		}
+	}
+	if err == nil {
+		err = bwe.M(bwe.BlockChainGenericError, "Stopped watching the transaction")
+	}
+	return err
+}
+
+func (bcc *bcClient) SetRetryPolicy(p RetryPolicy) {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	bcc.Retry = p
+}
+func (bcc *bcClient) GetRetryPolicy() RetryPolicy {
+	return bcc.Retry
+}
@@ -183,7 +183,7 @@ func DecodeABIReturn(ufi UFI, data []byte) (retvalues []interface{}, err error)
 }
 
 func DecodeUFI(ufi UFI) (contract common.Address, fsig []byte, args []int, rets []int, err error) {
-	contract = common.BytesToAddress(ufi[:20])
+	contract = remapContract(common.BytesToAddress(ufi[:20]))
 	fsig = ufi[20:24]
 	args = make([]int, 0, 16)
 	rets = make([]int, 0, 16)
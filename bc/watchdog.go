@@ -0,0 +1,155 @@
+package bc
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/immesys/bw2bc/eth"
+	"github.com/immesys/bw2bc/log"
+	"github.com/immesys/bw2bc/p2p"
+	"github.com/immesys/bw2bc/p2p/discover"
+)
+
+//DefaultStallTimeout is how long the head of the chain may go without
+//changing before the sync is considered stalled, if NBCParams.StallTimeout
+//is zero
+const DefaultStallTimeout = 5 * time.Minute
+
+//How often the watchdog looks at the head of the chain
+const stallCheck = 15 * time.Second
+
+//How long a peer that claimed blocks it did not send us during a stall is
+//disconnected again whenever it reconnects
+const stallBan = 30 * time.Minute
+
+//SyncStall reports that no new block has arrived for the stall timeout,
+//and what was done about it. It is reported again, with Recovered set,
+//once blocks arrive again
+type SyncStall struct {
+	//The head of the chain, and when it arrived
+	Height uint64
+	Since  time.Time
+	//The peers that were left connected
+	Peers int
+	//The peers that were disconnected, and how many of those were banned
+	//because they claimed to be ahead but did not send us their blocks
+	Dropped int
+	Banned  int
+	//The boot nodes dialled again
+	Redialed  int
+	Recovered bool
+}
+
+//syncWatchdog watches the head of the chain, and when it stops moving
+//rotates the eth peers, so that operations waiting for blocks do not just
+//time out
+type syncWatchdog struct {
+	bc        *blockChain
+	timeout   time.Duration
+	bootNodes []*discover.Node
+	onStall   func(*SyncStall)
+
+	height  uint64
+	since   time.Time
+	stalled bool
+	rotated time.Time
+	banned  map[discover.NodeID]time.Time
+}
+
+func (w *syncWatchdog) run() {
+	w.height, w.since = w.bc.CurrentBlock(), time.Now()
+	w.banned = make(map[discover.NodeID]time.Time)
+	for {
+		time.Sleep(stallCheck)
+		w.check(time.Now())
+	}
+}
+
+func (w *syncWatchdog) check(now time.Time) {
+	srv := w.bc.nd.Server()
+	if srv == nil {
+		return
+	}
+	w.dropBanned(srv, now)
+	if h := w.bc.CurrentBlock(); h != w.height {
+		w.height, w.since = h, now
+		if w.stalled {
+			w.stalled = false
+			log.Info("Chain sync resumed", "height", h)
+			w.report(&SyncStall{Height: h, Since: now, Peers: srv.PeerCount(), Recovered: true})
+		}
+		return
+	}
+	//While stalled, the peers are rotated once per timeout
+	if now.Sub(w.since) < w.timeout || now.Sub(w.rotated) < w.timeout {
+		return
+	}
+	w.rotated = now
+	ev := &SyncStall{Height: w.height, Since: w.since}
+	ev.Dropped, ev.Banned = w.dropPeers(srv, now)
+	//The boot nodes become static peers, which are dialled until they
+	//are connected
+	for _, n := range w.bootNodes {
+		srv.AddPeer(n)
+		ev.Redialed++
+	}
+	ev.Peers = srv.PeerCount()
+	log.Warn("Chain sync stalled, rotated peers", "height", w.height, "since", w.since,
+		"dropped", ev.Dropped, "banned", ev.Banned, "redialed", ev.Redialed)
+	//The rotations after the first are only logged
+	if !w.stalled {
+		w.stalled = true
+		w.report(ev)
+	}
+}
+
+func (w *syncWatchdog) report(ev *SyncStall) {
+	if w.onStall != nil {
+		go w.onStall(ev)
+	}
+}
+
+//ourTD is the total difficulty of our head, nil on a light client
+func (w *syncWatchdog) ourTD() *big.Int {
+	if w.bc.isLight {
+		return nil
+	}
+	chain := w.bc.fethi.BlockChain()
+	return chain.GetTdByHash(chain.CurrentHeader().Hash())
+}
+
+//dropPeers disconnects every peer, none of which has sent us a block for
+//the stall timeout. Those that claim a higher total difficulty than ours
+//are slow or lying, and are banned. The others have nothing we lack, and
+//may connect again
+func (w *syncWatchdog) dropPeers(srv *p2p.Server, now time.Time) (dropped int, banned int) {
+	td := w.ourTD()
+	for _, p := range srv.Peers() {
+		info, ok := p.Info().Protocols["eth"].(*eth.PeerInfo)
+		if ok && td != nil && info.Difficulty != nil && info.Difficulty.Cmp(td) > 0 {
+			w.banned[p.ID()] = now.Add(stallBan)
+			banned++
+		}
+		p.Disconnect(p2p.DiscUselessPeer)
+		dropped++
+	}
+	return dropped, banned
+}
+
+//dropBanned disconnects the banned peers that have connected again, and
+//forgets the bans that are over
+func (w *syncWatchdog) dropBanned(srv *p2p.Server, now time.Time) {
+	for id, until := range w.banned {
+		if now.After(until) {
+			delete(w.banned, id)
+		}
+	}
+	if len(w.banned) == 0 {
+		return
+	}
+	for _, p := range srv.Peers() {
+		if _, ok := w.banned[p.ID()]; ok {
+			p.Disconnect(p2p.DiscUselessPeer)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/urfave/cli"
+)
+
+//queryPOs returns the payload objects of the message persisted on the URI,
+//or nil if there is none
+func queryPOs(ac *agentConn, uri string) ([]objects.PayloadObject, error) {
+	f := ac.newFrame(objects.CmdQuery)
+	f.AddHeader("uri", uri)
+	f.AddHeader("autochain", "true")
+	f.AddHeader("unpack", "true")
+	results, err := ac.stream(f)
+	if err != nil {
+		return nil, err
+	}
+	var rv []objects.PayloadObject
+	for r := range results {
+		if rv == nil {
+			rv = r.GetAllPOs()
+		}
+	}
+	return rv, nil
+}
+
+//blobURI checks a blob URI, which must not already have a ! cell
+func blobURI(c *cli.Context) string {
+	if len(c.Args()) != 1 {
+		fmt.Printf("Usage: bw2 %s -e entity [options] <uri>\n", c.Command.Name)
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	uri := strings.TrimSuffix(c.Args()[0], "/")
+	if strings.Contains(uri, "!") || strings.ContainsAny(uri, "*+") {
+		fmt.Println("The blob URI cannot have wildcards or ! cells")
+		os.Exit(1)
+	}
+	return uri
+}
+
+//putblob -e entity --file f [--name n] [--chunksize n] uri
+func actionPutBlob(c *cli.Context) error {
+	uri := blobURI(c)
+	if c.String("file") == "" {
+		fmt.Println("You need to specify the file to publish (--file)")
+		os.Exit(1)
+	}
+	content, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		fmt.Println("Could not read file:", err)
+		os.Exit(1)
+	}
+	name := c.String("name")
+	if name == "" {
+		name = filepath.Base(c.String("file"))
+	}
+	chunkSize := c.Int("chunksize")
+	if chunkSize <= 0 {
+		chunkSize = objects.DefaultChunkSize
+	}
+	m, chunks, err := advpo.CreateBlob(name, content, chunkSize)
+	if err != nil {
+		fmt.Println("Could not split the file:", err)
+		os.Exit(1)
+	}
+	m.Created = time.Now().UnixNano()
+	mpo, err := advpo.CreateBlobManifestPayloadObject(m)
+	if err != nil {
+		fmt.Println("Could not encode the manifest:", err)
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	for n, ch := range chunks {
+		if err := ac.publishMessage(uri+"/"+advpo.BlobChunkSuffix(n), true, []objects.PayloadObject{ch}); err != nil {
+			fmt.Printf("Could not persist chunk %d: %v\n", n, err)
+			os.Exit(1)
+		}
+		fmt.Printf("\rpersisted chunk %d/%d", n+1, len(chunks))
+	}
+	fmt.Println()
+	if err := ac.publishMessage(uri+"/"+advpo.BlobManifestSuffix, true, []objects.PayloadObject{mpo}); err != nil {
+		fmt.Println("Could not persist the manifest:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Published %s (%d bytes in %d chunks)\nRoot: %s\n", name, m.Size, m.Chunks(), hex.EncodeToString(m.Root))
+	return nil
+}
+
+//getblob -e entity [-o out] [--root hex] uri
+//Rerunning an interrupted getblob only fetches the chunks still missing
+func actionGetBlob(c *cli.Context) error {
+	uri := blobURI(c)
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	pos, err := queryPOs(ac, uri+"/"+advpo.BlobManifestSuffix)
+	if err != nil {
+		fmt.Println("Could not query the manifest:", err)
+		os.Exit(1)
+	}
+	var m *advpo.BlobManifest
+	for _, po := range pos {
+		apo, err := advpo.LoadPayloadObject(po.GetPONum(), po.GetContent())
+		if err != nil || !apo.IsTypeDF(advpo.PODFBlobManifest) {
+			continue
+		}
+		m, err = advpo.LoadBlobManifest(apo)
+		if err != nil {
+			fmt.Println("Bad manifest:", err)
+			os.Exit(1)
+		}
+	}
+	if m == nil {
+		fmt.Println("There is no blob on", uri)
+		os.Exit(1)
+	}
+	if c.String("root") != "" && !strings.EqualFold(c.String("root"), hex.EncodeToString(m.Root)) {
+		fmt.Println("The blob's root does not match --root")
+		os.Exit(1)
+	}
+	out := c.String("outfile")
+	if out == "" {
+		out = filepath.Base(m.Name)
+	}
+	if out == "" || out == "." || out == string(filepath.Separator) {
+		fmt.Println("The blob has no usable name, specify -o")
+		os.Exit(1)
+	}
+	f, err := os.OpenFile(out, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Println("Could not open output file:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	err = m.FetchBlob(f, func(n int) (objects.PayloadObject, error) {
+		pos, err := queryPOs(ac, uri+"/"+advpo.BlobChunkSuffix(n))
+		if err != nil {
+			return nil, err
+		}
+		for _, po := range pos {
+			if po.GetPONum() == objects.PONumChunk {
+				return po, nil
+			}
+		}
+		return nil, fmt.Errorf("chunk is not persisted")
+	}, func(left int) {
+		fmt.Printf("\rfetched chunk %d/%d", m.Chunks()-left, m.Chunks())
+	})
+	fmt.Println()
+	if err != nil {
+		fmt.Println("Download interrupted, run again to resume:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %s (%d bytes)\nRoot: %s\n", out, m.Size, hex.EncodeToString(m.Root))
+	return nil
+}
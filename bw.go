@@ -20,7 +20,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/immesys/bw2/adapter/oob"
@@ -65,6 +67,65 @@ func main() {
 		Name:  "outfile, o",
 		Usage: "save the result to this file",
 	}
+	confflag := cli.StringFlag{
+		Name:  "confirmations, wait-confirmations",
+		Usage: "blocks to wait before an on-chain operation is confirmed",
+	}
+	timeoutflag := cli.StringFlag{
+		Name:  "timeout",
+		Usage: "blocks to wait for an on-chain operation to appear",
+	}
+	gaspflag := cli.StringFlag{
+		Name:  "maxgasprice",
+		Usage: "the highest gas price (in wei) an on-chain operation may pay",
+	}
+	attemptsflag := cli.StringFlag{
+		Name:  "attempts",
+		Usage: "times to send an on-chain operation's transaction before giving up",
+	}
+	aliasLongFlag := cli.StringFlag{
+		Name:  "long",
+		Usage: "the key of the long alias",
+	}
+	aliasShortFlag := cli.StringFlag{
+		Name:  "short",
+		Usage: "the short alias, in hex",
+	}
+	eflag := cli.StringFlag{
+		Name:   "entity, e",
+		Usage:  "the entity to use",
+		Value:  "",
+		EnvVar: "BW2_DEFAULT_ENTITY",
+	}
+	podfflag := cli.StringSliceFlag{
+		Name:  "podf",
+		Usage: "only show payload objects matching this dot form, e.g. 2.0.0.0/8 (repeatable)",
+	}
+	jsonflag := cli.BoolFlag{
+		Name:  "json",
+		Usage: "print one JSON object per message",
+	}
+	tapflag := cli.BoolFlag{
+		Name:  "tap",
+		Usage: "tap instead, which needs T permissions and sees every message",
+	}
+	mnemonicflag := cli.StringFlag{
+		Name:   "mnemonic",
+		Usage:  "derive the entity from this mnemonic (- to read it from stdin)",
+		EnvVar: "BW2_MNEMONIC",
+	}
+	passphraseflag := cli.StringFlag{
+		Name:  "passphrase",
+		Usage: "the optional passphrase of the mnemonic",
+	}
+	indexflag := cli.IntFlag{
+		Name:  "index",
+		Usage: "the index of the entity derived from the mnemonic",
+	}
+	pathflag := cli.StringFlag{
+		Name:  "path",
+		Usage: "derive the entity at this path instead, e.g. m/8802'/0'",
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "router",
@@ -76,6 +137,23 @@ func main() {
 					Usage: "override the default config file",
 				},
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "subs",
+					Usage: "list the subscriptions on the agent's router",
+					Description: "Shows each subscription's URI pattern, client, subscribing entity, " +
+						"age and how many messages it has been delivered. The entity must be the " +
+						"router's or one of the VKs in [clients] Admins in bw2.ini",
+					Action: cli.ActionFunc(actionRouterSubs),
+					Flags: []cli.Flag{
+						eflag, jsonflag,
+						cli.StringFlag{
+							Name:  "ns",
+							Usage: "only list the subscriptions on this namespace",
+						},
+					},
+				},
+			},
 		},
 		// {
 		// 	Name:   "dtrig",
@@ -131,6 +209,68 @@ func main() {
 					Name:  "maxlightpeers",
 					Value: 10,
 				},
+				cli.StringFlag{
+					Name:  "registry",
+					Usage: "make a thin router that resolves through the full router at this host:port",
+				},
+				cli.StringFlag{
+					Name:  "registryvk",
+					Usage: "the router VK of the --registry",
+				},
+			},
+		},
+		{
+			Name:   "contracts",
+			Usage:  "check the registry, alias and affinity contracts the agent uses",
+			Action: cli.ActionFunc(actionContracts),
+		},
+		{
+			Name:   "mkgenesis",
+			Usage:  "create the genesis for a private chain",
+			Action: cli.ActionFunc(actionMkGenesis),
+			Description: "The BOSSWAVE contracts are copied from the chain the agent is on, " +
+				"so the agent must be a synced full node. They cost nothing to deploy and " +
+				"charge nothing on the private chain",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "chainid",
+					Value: 0,
+					Usage: "the chain ID, which must not be used by another chain",
+				},
+				cli.StringSliceFlag{
+					Name:  "fund",
+					Usage: "prefund an entity or address with ether, e.g. bankroll.ent=1000 (repeatable)",
+				},
+				oflag,
+			},
+		},
+		{
+			Name:  "migratedb",
+			Usage: "copy the router DB to another storage backend",
+			Description: "The router must not be running. By default the DB named in the " +
+				"config file is copied. Change DB and DBBackend in the config to use the copy",
+			Action: cli.ActionFunc(actionMigrateDB),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "conf",
+					Usage: "override the default config file",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "the DB to copy, instead of the one in the config file",
+				},
+				cli.StringFlag{
+					Name:  "from-backend",
+					Usage: "the backend of the DB to copy, if --from is given",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "the directory for the new DB",
+				},
+				cli.StringFlag{
+					Name:  "to-backend",
+					Usage: "the backend for the new DB",
+				},
 			},
 		},
 		{
@@ -162,7 +302,71 @@ func main() {
 					Usage:  "set the expiry measured from now e.g. 10d5h10s",
 					EnvVar: "BW2_DEFAULT_EXPIRY",
 				},
-				oflag, nflag, bflag,
+				cli.StringFlag{
+					Name:  "alias",
+					Usage: "once the entity is published, also create this long alias for its VK",
+				},
+				mnemonicflag, passphraseflag, indexflag, pathflag,
+				oflag, nflag, bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:   "convert",
+			Usage:  "convert an entity, DOT or chain file to the v2 file format",
+			Action: cli.ActionFunc(actionConvert),
+			Description: "v2 files carry a checksum, optional comment and alias hints, and " +
+				"can be encrypted. Encrypted files are read with the passphrase in " +
+				"BW2_KEYFILE_PASSPHRASE. Other bindings may only read v1 files, use --v1 to " +
+				"convert back for them",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "v1",
+					Usage: "convert to the old format instead",
+				},
+				cli.BoolFlag{
+					Name:  "encrypt",
+					Usage: "encrypt the file",
+				},
+				cli.StringFlag{
+					Name:  "passphrase",
+					Usage: "the passphrase to encrypt with, instead of BW2_KEYFILE_PASSPHRASE",
+				},
+				cli.StringFlag{
+					Name:  "comment",
+					Usage: "set the comment hint",
+				},
+				cli.StringFlag{
+					Name:  "alias",
+					Usage: "set the alias hint",
+				},
+				oflag,
+			},
+		},
+		{
+			Name:   "mkmnemonic",
+			Usage:  "create a new mnemonic to derive entities from",
+			Action: cli.ActionFunc(actionMkMnemonic),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "words",
+					Value: 24,
+					Usage: "the number of words: 12, 15, 18, 21 or 24",
+				},
+			},
+		},
+		{
+			Name:    "recoverentity",
+			Aliases: []string{"rece"},
+			Usage:   "recreate the key files of published entities derived from a mnemonic",
+			Action:  cli.ActionFunc(actionRecoverEntity),
+			Flags: []cli.Flag{
+				mnemonicflag, passphraseflag, indexflag, pathflag,
+				cli.IntFlag{
+					Name:  "count",
+					Value: 1,
+					Usage: "the number of consecutive indices to recover, from --index",
+				},
+				oflag,
 			},
 		},
 		{
@@ -238,6 +442,39 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "meta",
+			Usage: "get, set and delete the metadata on a URI",
+			Subcommands: []cli.Command{
+				{
+					Name:      "get",
+					Usage:     "get the metadata for a URI (all keys if the key is omitted)",
+					ArgsUsage: "<uri> [key]",
+					Action:    cli.ActionFunc(actionMget),
+					Flags: []cli.Flag{
+						eflag,
+						cli.BoolFlag{
+							Name:  "i, verbose",
+							Usage: "show where the values are inherited from",
+						},
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "set a metadata key for a URI",
+					ArgsUsage: "<uri> <key> <value>",
+					Action:    cli.ActionFunc(actionMset),
+					Flags:     []cli.Flag{eflag},
+				},
+				{
+					Name:      "del",
+					Usage:     "delete a metadata key for a URI",
+					ArgsUsage: "<uri> <key>",
+					Action:    cli.ActionFunc(actionMdel),
+					Flags:     []cli.Flag{eflag},
+				},
+			},
+		},
 		{
 			Name:    "coldstore",
 			Aliases: []string{"redeem", "cs"},
@@ -249,6 +486,7 @@ func main() {
 					Value: "",
 					Usage: "the account to transfer the coldstore to",
 				},
+				confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -280,7 +518,364 @@ func main() {
 					Name:  "micro",
 					Value: "",
 					Usage: "an amount in microEther",
-				}, bflag,
+				}, bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:   "fund",
+			Usage:  "transfer Ether to an entity's first account and wait for it to be confirmed",
+			Action: cli.ActionFunc(actionFund),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from, f",
+					Value: "",
+					Usage: "the entity to fund from (defaults to the bankroll)",
+				},
+				cli.StringFlag{
+					Name:  "to, t",
+					Value: "",
+					Usage: "the entity (or account) to fund",
+				},
+				cli.StringFlag{
+					Name:  "amount, a",
+					Value: "",
+					Usage: "the amount in ether",
+				},
+				cli.IntFlag{
+					Name:  "accountnum",
+					Value: 0,
+					Usage: "the account number to fund from",
+				}, bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:  "tx",
+			Usage: "sign registry transactions offline and broadcast them later",
+			Subcommands: []cli.Command{
+				{
+					Name:   "params",
+					Usage:  "get the params needed to sign a transaction offline",
+					Action: cli.ActionFunc(actionTxParams),
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "accountnum",
+							Value: 0,
+							Usage: "the account number that will send the transaction",
+						},
+						cli.StringFlag{
+							Name:  "ns",
+							Usage: "also get the nonce for accepting a DR offer for this namespace",
+							Value: "",
+						},
+						bflag,
+					},
+				},
+				{
+					Name:   "sign",
+					Usage:  "sign a registry transaction",
+					Action: cli.ActionFunc(actionTxSign),
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "offline",
+							Usage: "do not contact the agent, all params must be given",
+						},
+						cli.IntFlag{
+							Name:  "accountnum",
+							Value: 0,
+							Usage: "the account number to send the transaction from",
+						},
+						cli.StringFlag{
+							Name:  "nonce",
+							Usage: "the account nonce",
+						},
+						cli.StringFlag{
+							Name:  "gasprice",
+							Usage: "the gas price in wei",
+						},
+						cli.StringFlag{
+							Name:  "gas",
+							Usage: "the gas limit",
+						},
+						cli.StringFlag{
+							Name:  "chainid",
+							Usage: "the chain ID for EIP155 signing",
+						},
+						cli.StringFlag{
+							Name:  "nsnonce",
+							Usage: "the namespace affinity nonce, when accepting a DR offer",
+						},
+						cli.StringFlag{
+							Name:  "entity",
+							Usage: "publish this entity file",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "dot",
+							Usage: "publish this DOT file",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "long",
+							Usage: "create a long alias with the given key",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "hex",
+							Usage: "specify the alias content as a hex string",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "b64",
+							Usage: "specify the alias content as urlsafe base64",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "text",
+							Usage: "specify the alias content as UTF-8 text",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "dr",
+							Usage: "accept the offer from this designated router VK",
+							Value: "",
+						},
+						cli.StringFlag{
+							Name:  "ns",
+							Usage: "the namespace entity accepting the offer",
+							Value: "",
+						},
+						bflag, oflag,
+					},
+				},
+				{
+					Name:      "send",
+					Usage:     "broadcast a signed transaction",
+					ArgsUsage: "file",
+					Action:    cli.ActionFunc(actionTxSend),
+					Flags: []cli.Flag{
+						confflag, timeoutflag,
+					},
+				},
+			},
+		},
+		{
+			Name:  "ns",
+			Usage: "move namespace registry objects between routers",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "save the entities, DOTs, chains, aliases and DR of a namespace",
+					ArgsUsage: "<nsvk>",
+					Action:    cli.ActionFunc(actionNSExport),
+					Flags: []cli.Flag{
+						oflag,
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "preload the agent's resolution with a namespace snapshot",
+					Description: "The agent uses the snapshot for objects the chain does not have, " +
+						"so a router can serve the namespace before it has synced, or without " +
+						"reaching the chain at all. The snapshot is kept until the agent restarts",
+					ArgsUsage: "<file>",
+					Action:    cli.ActionFunc(actionNSImport),
+				},
+			},
+		},
+		{
+			Name:  "store",
+			Usage: "back up and restore the messages persisted on the agent's router",
+			Subcommands: []cli.Command{
+				{
+					Name:  "export",
+					Usage: "save the messages persisted on a URI to an archive",
+					Description: "Use a wildcard URI such as ns/building/* to save a subtree. The " +
+						"archive is a tar of the signed messages, compressed with zstd if the " +
+						"file name ends in .zst. The entity must be the router's or one of the " +
+						"VKs in [clients] Admins in bw2.ini",
+					ArgsUsage: "<uri> <file.tar.zst>",
+					Action:    cli.ActionFunc(actionStoreExport),
+					Flags:     []cli.Flag{eflag},
+				},
+				{
+					Name:  "import",
+					Usage: "persist the messages in an archive on the agent's router",
+					Description: "Each message must be a persist signed by its origin that has not " +
+						"expired, and replaces what is persisted on its URI without being delivered " +
+						"to subscribers. The entity must be the router's or one of the VKs in " +
+						"[clients] Admins in bw2.ini",
+					ArgsUsage: "<file.tar.zst>",
+					Action:    cli.ActionFunc(actionStoreImport),
+					Flags: []cli.Flag{
+						eflag,
+						cli.BoolFlag{
+							Name:  "verify-chain",
+							Usage: "also require that each message's chain still grants the persist",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "requests",
+			Usage: "ask for DOTs, and approve the requests made to you",
+			Subcommands: []cli.Command{
+				{
+					Name:  "send",
+					Usage: "ask an entity for a DOT on a URI",
+					Description: "The request is persisted, signed by the -e entity, on a free path " +
+						"in the URI's namespace where the granter can list it. Anyone can read it. " +
+						"Sending again replaces the earlier request to the same granter",
+					ArgsUsage: "<uri>",
+					Action:    cli.ActionFunc(actionRequestsSend),
+					Flags: []cli.Flag{
+						eflag,
+						cli.StringFlag{
+							Name:  "granter, g",
+							Usage: "the VK or alias of the entity to ask",
+						},
+						cli.StringFlag{
+							Name:  "permissions, x",
+							Usage: "the access permissions string e.g LPC*T*",
+							Value: "C*",
+						},
+						cli.IntFlag{
+							Name:  "ttl, l",
+							Usage: "the TTL (number of hops) the DOT should transfer",
+						},
+						cli.StringFlag{
+							Name:  "expiry",
+							Usage: "the expiry to ask for, measured from now e.g. 30d. Left to the granter if not given",
+						},
+						cli.StringFlag{
+							Name:  "comment, m",
+							Usage: "why you want the DOT",
+						},
+					},
+				},
+				{
+					Name:      "list",
+					Usage:     "list the pending requests for DOTs from the -e entity",
+					ArgsUsage: "<namespace>",
+					Action:    cli.ActionFunc(actionRequestsList),
+					Flags:     []cli.Flag{eflag},
+				},
+				{
+					Name:  "approve",
+					Usage: "grant and publish the DOT a request asks for",
+					Description: "The DOT is granted by the -e entity, which also pays to publish " +
+						"it. Its fields are those asked for unless overridden. The request is " +
+						"deleted once the DOT is published",
+					ArgsUsage: "<namespace> <requester>",
+					Action:    cli.ActionFunc(actionRequestsApprove),
+					Flags: []cli.Flag{
+						eflag,
+						cli.StringFlag{
+							Name:  "permissions, x",
+							Usage: "grant these access permissions instead",
+						},
+						cli.IntFlag{
+							Name:  "ttl, l",
+							Usage: "grant this TTL instead",
+						},
+						cli.StringFlag{
+							Name:  "expiry",
+							Usage: "set the expiry measured from now instead e.g. 3d7h20m",
+						},
+						cli.StringFlag{
+							Name:  "comment, m",
+							Usage: "set this comment instead",
+						},
+						cli.StringFlag{
+							Name:   "contact, c",
+							Usage:  "contact attribute e.g. 'Oski Bear <oski@berkeley.edu>'",
+							EnvVar: "BW2_DEFAULT_CONTACT",
+						},
+						cli.StringSliceFlag{
+							Name:  "revoker, r",
+							Value: &cli.StringSlice{},
+							Usage: "add a delegated revoker to the DOT",
+						},
+						confflag, timeoutflag, gaspflag, attemptsflag,
+					},
+				},
+				{
+					Name:      "reject",
+					Usage:     "delete a request made to the -e entity",
+					ArgsUsage: "<namespace> <requester>",
+					Action:    cli.ActionFunc(actionRequestsReject),
+					Flags:     []cli.Flag{eflag},
+				},
+			},
+		},
+		{
+			Name:  "top",
+			Usage: "show the live traffic and state of the agent's router",
+			Description: "Shows the message rates on each namespace and the busiest URIs, " +
+				"the connections to other routers, the chain height and the hit rates of " +
+				"the resolution caches, refreshed every interval. The entity must be the " +
+				"router's or one of the VKs in [clients] Admins in bw2.ini",
+			Action: cli.ActionFunc(actionTop),
+			Flags: []cli.Flag{
+				eflag,
+				cli.DurationFlag{
+					Name:  "interval, i",
+					Usage: "how often to refresh",
+					Value: time.Second,
+				},
+				cli.IntFlag{
+					Name:  "rows, n",
+					Usage: "how many namespaces and URIs to show",
+					Value: 10,
+				},
+			},
+		},
+		{
+			Name:  "schedule",
+			Usage: "have the agent publish on a URI on a schedule",
+			Subcommands: []cli.Command{
+				{
+					Name:  "add",
+					Usage: "publish on a URI whenever a cron expression fires",
+					Description: "The agent publishes as the -e entity, with an automatically built " +
+						"chain, until the schedule is cancelled. The schedule is five cron fields, " +
+						"a macro such as @hourly, or @every and a duration e.g. '@every 30s'. It and " +
+						"the entity's key are kept by the router, so it survives restarts. In the " +
+						"template, {time}, {unix} and {seq} are replaced by the time of the publish " +
+						"in RFC3339 and in seconds, and the number of earlier publishes",
+					ArgsUsage: "<uri> <cron>",
+					Action:    cli.ActionFunc(actionScheduleAdd),
+					Flags: []cli.Flag{
+						eflag,
+						cli.StringFlag{
+							Name:  "template, t",
+							Usage: "the payload to publish",
+							Value: "heartbeat {seq} at {time}",
+						},
+						cli.StringFlag{
+							Name:  "ponum",
+							Usage: "the PO number (dot form) of the payload",
+							Value: "64.0.1.0",
+						},
+						cli.BoolFlag{
+							Name:  "persist",
+							Usage: "persist the messages instead of publishing them",
+						},
+					},
+				},
+				{
+					Name:   "list",
+					Usage:  "list the scheduled publishes of the -e entity",
+					Action: cli.ActionFunc(actionScheduleList),
+					Flags:  []cli.Flag{eflag},
+				},
+				{
+					Name:      "cancel",
+					Usage:     "stop a scheduled publish",
+					ArgsUsage: "<id>",
+					Action:    cli.ActionFunc(actionScheduleCancel),
+					Flags:     []cli.Flag{eflag},
+				},
 			},
 		},
 		{
@@ -345,14 +940,99 @@ func main() {
 					Value:  0,
 					EnvVar: "BW2_DEFAULT_TTL",
 				},
-				oflag, nflag, bflag,
+				cli.StringFlag{
+					Name:  "no-delegate",
+					Usage: "permissions the receiver may not delegate further e.g. P",
+				},
+				oflag, nflag, bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:  "mktemp",
+			Usage: "mint a short lived credential for an ephemeral workload",
+			Description: "Creates and publishes a new entity and a DOT to it from the -e entity, " +
+				"which pays, with a TTL of 0 that forbids delegating any of its permissions. " +
+				"Both expire after --life, at most 24h, and the router revokes the DOT at " +
+				"--revoke-after, by default when it expires. The -e entity must hold a chain " +
+				"it may delegate unless it is the namespace. The key is written to --outfile " +
+				"and the chain from the namespace to --chainfile",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionMkTemp),
+			Flags: []cli.Flag{
+				eflag,
+				cli.StringFlag{
+					Name:  "permissions, x",
+					Usage: "the access permissions string e.g PC",
+					Value: "C",
+				},
+				cli.StringFlag{
+					Name:  "life",
+					Usage: "how long the credential lasts e.g. 2h",
+					Value: "1h",
+				},
+				cli.StringFlag{
+					Name:  "revoke-after",
+					Usage: "when to revoke the DOT e.g. 30m, or never to leave it to expire",
+				},
+				cli.StringFlag{
+					Name:  "comment, m",
+					Usage: "comment attribute e.g. 'CI run 1234'",
+				},
+				cli.StringFlag{
+					Name:  "chainfile",
+					Usage: "save the chain to this file",
+				},
+				oflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:  "mkpublic",
+			Usage: "let everybody read a URI",
+			Description: "Creates a DOT to the everybody VK granting consume on the URI, " +
+				"with the wildcards it has. Anyone can then subscribe and query without a " +
+				"grant of their own: chains ending in it are built for them automatically " +
+				"when they have no direct grant, and their messages carry their VK. The " +
+				"from entity needs the same permissions on the URI",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionMkPublic),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "contact, c",
+					Value:  "",
+					Usage:  "contact attribute e.g. 'Oski Bear <oski@berkeley.edu>'",
+					EnvVar: "BW2_DEFAULT_CONTACT",
+				},
+				cli.StringFlag{
+					Name:  "comment, m",
+					Value: "",
+					Usage: "comment attribute e.g. 'Public temperature feed'",
+				},
+				cli.StringFlag{
+					Name:   "expiry, e",
+					Value:  "90d",
+					Usage:  "set the expiry measured from now e.g. 3d7h20m",
+					EnvVar: "BW2_DEFAULT_EXPIRY",
+				},
+				cli.StringFlag{
+					Name:   "from, f",
+					Usage:  "the entity to grant from",
+					Value:  "",
+					EnvVar: "BW2_DEFAULT_ENTITY",
+				},
+				cli.BoolFlag{
+					Name:  "tap",
+					Usage: "also let everybody tap the URI",
+				},
+				oflag, nflag, bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
 			Name:    "inspect",
 			Aliases: []string{"i"},
 			Usage:   "inspect a file, alias, VK or address",
-			Action:  cli.ActionFunc(actionInspect),
+			Description: "Objects are expanded recursively, resolving the DOTs and entities they " +
+				"refer to. Exits with status 1 if any element is not valid",
+			Action: cli.ActionFunc(actionInspect),
 			Flags: []cli.Flag{
 				cli.BoolFlag{
 					Name:  "publish, p",
@@ -362,7 +1042,11 @@ func main() {
 					Name:  "qrcode, q",
 					Usage: "makes QR Codes for entities with available siging keys",
 				},
-				bflag,
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the inspected objects and their validity as JSON",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -380,7 +1064,7 @@ func main() {
 					Usage: "the namespace (VK or alias) to grant to",
 					Value: "",
 				},
-				bflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -412,6 +1096,109 @@ func main() {
 					Usage: "specify the content as UTF-8 text",
 					Value: "",
 				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:    "updatealias",
+			Aliases: []string{"upalias"},
+			Usage:   "point an alias you own at a new value",
+			Action:  cli.ActionFunc(actionUpdateAlias),
+			Flags: []cli.Flag{
+				aliasLongFlag, aliasShortFlag,
+				cli.StringFlag{
+					Name:  "hex",
+					Usage: "specify the new content as a hex string",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "b64",
+					Usage: "specify the new content as urlsafe base64",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "text",
+					Usage: "specify the new content as UTF-8 text",
+					Value: "",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:    "transferalias",
+			Aliases: []string{"xfalias"},
+			Usage:   "give an alias you own to another account",
+			Action:  cli.ActionFunc(actionTransferAlias),
+			Flags: []cli.Flag{
+				aliasLongFlag, aliasShortFlag,
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "the address (40 characters of hex) to give the alias to",
+					Value: "",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:    "deletealias",
+			Aliases: []string{"rmalias"},
+			Usage:   "delete an alias you own, freeing its key",
+			Action:  cli.ActionFunc(actionRmAlias),
+			Flags: []cli.Flag{
+				aliasLongFlag, aliasShortFlag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:      "find",
+			Usage:     "search the registry for entities and DOTs by contact or comment",
+			ArgsUsage: "<pattern>",
+			Action:    cli.ActionFunc(actionFind),
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "regex",
+					Usage: "the pattern is a regular expression, rather than a case insensitive substring",
+				},
+				cli.StringFlag{
+					Name:  "type",
+					Usage: "only find objects of this type (entity or dot)",
+					Value: "",
+				},
+				cli.BoolFlag{
+					Name:  "valid",
+					Usage: "only show objects that are currently valid",
+				},
+			},
+		},
+		{
+			Name:    "listaliases",
+			Aliases: []string{"lsalias"},
+			Usage:   "list the aliases for a value, or those owned by some accounts",
+			Description: "Only aliases that still have the value, or are still owned by the " +
+				"accounts, are listed. With no value or --address, the --bankroll entity's " +
+				"accounts are used. If the alias contract has no owners yet, the aliases " +
+				"the accounts paid for are listed instead",
+			Action: cli.ActionFunc(actionLsAlias),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "hex",
+					Usage: "list aliases for this value, as a hex string",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "b64",
+					Usage: "list aliases for this value, as urlsafe base64 (e.g. a VK)",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "text",
+					Usage: "list aliases for this value, as UTF-8 text",
+					Value: "",
+				},
+				cli.StringSliceFlag{
+					Name:  "address",
+					Usage: "list aliases owned by this address (may be repeated)",
+				},
 				bflag,
 			},
 		},
@@ -444,7 +1231,7 @@ func main() {
 					Usage: "the namespace entity",
 					Value: "",
 				},
-				bflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -463,7 +1250,7 @@ func main() {
 					Usage: "the namespace entity to revoke",
 					Value: "",
 				},
-				bflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -482,7 +1269,7 @@ func main() {
 					Usage: "the namespace entity that accepted the offer",
 					Value: "",
 				},
-				bflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -500,9 +1287,167 @@ func main() {
 					Usage: "the srv record e.g. 100.12.42.23:4514",
 					Value: "",
 				},
-				bflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:  "drstatus",
+			Usage: "check that the agent's SRV record reaches it as a designated router",
+			Description: "Shows the last check done by the DR monitor (see the [dr] section of " +
+				"bw2.ini). If the monitor is not running, or --check is given, the agent checks " +
+				"now. Exits with status 1 if there are problems",
+			Action: cli.ActionFunc(actionDRStatus),
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "check",
+					Usage: "check now instead of showing the last result",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the status as JSON",
+				},
+			},
+		},
+		{
+			Name:  "clients",
+			Usage: "list the clients connected to the agent",
+			Description: "Shows each client's entity and its use of the agent. The entity " +
+				"must be the router's or one of the VKs in [clients] Admins in bw2.ini",
+			Action: cli.ActionFunc(actionListClients),
+			Flags:  []cli.Flag{eflag, jsonflag},
+		},
+		{
+			Name:      "services",
+			Aliases:   []string{"svcs"},
+			Usage:     "list the services in namespaces and their health",
+			ArgsUsage: "<ns>...",
+			Description: "Services are found from the metadata in the namespaces. An " +
+				"interface is alive, stale or gone by the age of its lastalive metadata, " +
+				"and a service is alive if all its interfaces are, gone if all of them " +
+				"are and otherwise stale. With --watch, changes are printed as they happen",
+			Action: cli.ActionFunc(actionServices),
+			Flags: []cli.Flag{
+				eflag, jsonflag,
+				cli.BoolFlag{
+					Name:  "watch, w",
+					Usage: "keep printing services that appear, disappear or change health",
+				},
+				cli.DurationFlag{
+					Name:  "staleafter",
+					Usage: "how old lastalive may be before an interface is stale (default 30s)",
+				},
+				cli.DurationFlag{
+					Name:  "goneafter",
+					Usage: "how old lastalive may be before an interface is gone (default 5m)",
+				},
+			},
+		},
+		{
+			Name:      "call",
+			Usage:     "publish a request on a slot of an interface and print the reply",
+			ArgsUsage: "<iface-uri> <slot>",
+			Description: "The request is published on <iface-uri>/slot/<slot> as a msgpack " +
+				"map with a random correlation ID under \"corrid\". The reply is the first " +
+				"message on the reply signal whose msgpack payload has the same ID, so the " +
+				"service must copy it from the request",
+			Action: cli.ActionFunc(actionCall),
+			Flags: []cli.Flag{
+				eflag, jsonflag,
+				cli.StringFlag{
+					Name:  "request, r",
+					Usage: "the request, as a JSON object",
+				},
+				cli.StringFlag{
+					Name:  "reply",
+					Usage: "the signal the reply is published on, if not named like the slot",
+				},
+				cli.DurationFlag{
+					Name:  "timeout, t",
+					Value: api.DefaultCallTimeout,
+					Usage: "how long to wait for the reply to each attempt",
+				},
+				cli.IntFlag{
+					Name:  "retries",
+					Usage: "how many times to publish the request again if no reply comes",
+				},
+			},
+		},
+		{
+			Name:  "drain",
+			Usage: "stop the router taking new subscriptions, publishes and peers",
+			Description: "Existing subscriptions continue until the router is stopped with " +
+				"SIGTERM or SIGINT. The entity must be the router's or one of the VKs in " +
+				"[clients] Admins in bw2.ini",
+			Action: cli.ActionFunc(actionDrain),
+			Flags:  []cli.Flag{eflag},
+		},
+		{
+			Name:  "droppeer",
+			Usage: "close the connection of a peer of the agent",
+			Description: "The ID is the one shown by bw2 clients for a PEER: client. The entity " +
+				"must be the router's or one of the VKs in [clients] Admins in bw2.ini",
+			ArgsUsage: "<client id>",
+			Action:    cli.ActionFunc(actionDropPeer),
+			Flags:     []cli.Flag{eflag},
+		},
+		{
+			Name:  "standby",
+			Usage: "show the state of hot standby replication",
+			Description: "On a standby, shows whether it is following its primary ([standby] " +
+				"Primary in bw2.ini). On a primary, shows how many standbys follow it",
+			Action: cli.ActionFunc(actionStandbyStatus),
+			Flags:  []cli.Flag{jsonflag},
+		},
+		{
+			Name:  "promote",
+			Usage: "make a standby stop following its primary and take over",
+			Description: "If the standby has the primary's router entity, its SRV record is " +
+				"also pointed at the standby: at --srv, or at the public IP from [dr] " +
+				"PublicIPService. The entity must be the router's or one of the VKs in " +
+				"[clients] Admins in bw2.ini",
+			Action: cli.ActionFunc(actionPromote),
+			Flags: []cli.Flag{
+				eflag,
+				cli.StringFlag{
+					Name:  "srv",
+					Usage: "the SRV record (host:port) to publish for the router",
+				},
 			},
 		},
+		{
+			Name:  "dns",
+			Usage: "discover the namespace a domain publishes in DNS",
+			Description: "The domain has a TXT record at _bw2.<domain> of \"bw2 ns=<nsvk> dr=<drvk>\" " +
+				"and optionally an SRV record at _bw2._tcp.<domain> for the designated router. " +
+				"The domain can then be used in place of the namespace in URIs",
+			ArgsUsage: "<domain>",
+			Action:    cli.ActionFunc(actionDiscoverNamespace),
+			Flags:     []cli.Flag{jsonflag},
+		},
+		{
+			Name:  "discover",
+			Usage: "find routers on the local network",
+			Description: "Looks for routers advertising with mDNS ([mdns] Advertise in their " +
+				"bw2.ini). Only routers that prove they hold the VK they advertise are shown",
+			Action: cli.ActionFunc(actionDiscover),
+			Flags: []cli.Flag{
+				jsonflag,
+				cli.DurationFlag{
+					Name:  "wait, w",
+					Usage: "how long to wait for routers to answer",
+					Value: 2 * time.Second,
+				},
+			},
+		},
+		{
+			Name:  "replicas",
+			Usage: "list the designated routers of a namespace",
+			Description: "The first is the designated router on the chain. The rest are " +
+				"replicas, which the namespace makes by granting them P on " +
+				"<ns>/" + api.ReplicaURISuffix + ". Clients use the first router they can reach",
+			ArgsUsage: "<nsvk>",
+			Action:    cli.ActionFunc(actionListReplicas),
+		},
 		{
 			Name:    "buildchain",
 			Aliases: []string{"bc"},
@@ -531,9 +1476,14 @@ func main() {
 				},
 				cli.BoolFlag{
 					Name:  "publish, p",
-					Usage: "publish inspected objects to the registry",
+					Usage: "publish the chains to the registry so they can be referenced by hash, after showing what it would cost",
 				},
-				bflag,
+				cli.StringFlag{
+					Name:  "maxcost",
+					Usage: "with --publish, publish nothing if it could cost more than this many ether",
+					Value: "",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
 			},
 		},
 		{
@@ -550,13 +1500,125 @@ func main() {
 			},
 		},
 		{
-			Name:    "query",
-			Aliases: []string{"q"},
-			Action:  cli.ActionFunc(actionQuery),
+			Name:      "tail",
+			Usage:     "subscribe to URIs and print the messages, decoding their payloads",
+			ArgsUsage: "<uri>...",
+			Action:    cli.ActionFunc(actionTail),
+			Flags: []cli.Flag{eflag, podfflag, jsonflag, tapflag,
+				cli.StringSliceFlag{
+					Name:  "only",
+					Usage: "have the router only deliver messages with a payload object matching this dot form (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "where",
+					Usage: "have the router only deliver messages with a msgpack payload object whose field path=value, the value as JSON (repeatable)",
+				},
+				cli.IntFlag{
+					Name:  "maxsize",
+					Usage: "have the router only deliver messages whose payload is at most this many bytes",
+				},
+			},
+		},
+		{
+			Name:      "query",
+			Aliases:   []string{"q"},
+			Usage:     "print the messages persisted on URIs, decoding their payloads",
+			ArgsUsage: "<uri>...",
+			Action:    cli.ActionFunc(actionQuery),
+			Flags:     []cli.Flag{eflag, podfflag, jsonflag, tapflag},
+		},
+		{
+			Name:      "trace",
+			Usage:     "publish a traced probe to a URI and print the routers it passed through",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionTrace),
+			Flags: []cli.Flag{
+				eflag,
+				cli.DurationFlag{
+					Name:  "wait, w",
+					Usage: "how long to wait for the probe to arrive",
+					Value: 10 * time.Second,
+				},
+			},
+		},
+		{
+			Name:      "pub",
+			Aliases:   []string{"publish"},
+			Usage:     "publish (or persist) a message, building the chain automatically",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionPub),
+			Flags: []cli.Flag{
+				eflag,
+				cli.StringFlag{
+					Name:  "text, t",
+					Usage: "a string payload (PO 64.0.1.0)",
+				},
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "a payload read from this file, or stdin if - (PO 1.0.0.0)",
+				},
+				cli.StringFlag{
+					Name:  "msgpack, m",
+					Usage: "a JSON document to send as a msgpack payload (PO 2.0.0.0)",
+				},
+				cli.StringFlag{
+					Name:  "ponum",
+					Usage: "the PO number (dot form) to use instead of the default",
+				},
+				cli.BoolFlag{
+					Name:  "persist",
+					Usage: "persist the message instead of publishing it",
+				},
+				cli.IntFlag{
+					Name:  "chunksize",
+					Usage: "split payloads larger than this many bytes into chunk POs, one message each (bw2 tail reassembles them)",
+				},
+			},
+		},
+		{
+			Name:      "putblob",
+			Usage:     "persist a large file in chunks under uri/!blob with a manifest, e.g. firmware for devices",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionPutBlob),
+			Flags: []cli.Flag{
+				eflag,
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "the file to publish",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "the name in the manifest, by default the file's name",
+				},
+				cli.IntFlag{
+					Name:  "chunksize",
+					Usage: "the size of each chunk in bytes (default 1 MiB)",
+				},
+			},
+		},
+		{
+			Name:      "getblob",
+			Usage:     "fetch and verify a file published with putblob, resuming an interrupted download",
+			ArgsUsage: "<uri>",
+			Action:    cli.ActionFunc(actionGetBlob),
+			Flags: []cli.Flag{
+				eflag,
+				oflag,
+				cli.StringFlag{
+					Name:  "root",
+					Usage: "the expected hash tree root (hex) of the blob",
+				},
+			},
+		},
+		{
+			Name:      "del",
+			Usage:     "delete the messages persisted on URIs",
+			ArgsUsage: "<uri>...",
+			Action:    cli.ActionFunc(actionDelete),
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "entity, e",
-					Usage:  "the entity to query as",
+					Usage:  "the entity to delete as, which needs PL on the URI",
 					Value:  "",
 					EnvVar: "BW2_DEFAULT_ENTITY",
 				},
@@ -585,7 +1647,143 @@ func main() {
 					Usage: "the revocation comment",
 					Value: "",
 				},
-				bflag, nflag, oflag,
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag, nflag, oflag,
+			},
+		},
+		{
+			Name:   "rotate-entity",
+			Usage:  "replace an entity with a new one, moving its DOTs",
+			Action: cli.ActionFunc(actionRotateEntity),
+			Description: "Entities cannot be changed once published, so this creates a new " +
+				"one with the old one's contact, comment, revokers and expiry unless they " +
+				"are given. The DOTs the old entity granted are granted again by the new " +
+				"one, and the DOTs it holds are granted again by the --granter entities " +
+				"that granted them. Once they are published the old entity is revoked. " +
+				"A report of what happened to each DOT is printed",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "entity, e",
+					Usage: "the entity to rotate",
+				},
+				cli.StringSliceFlag{
+					Name:  "granter, g",
+					Value: &cli.StringSlice{},
+					Usage: "an entity that granted DOTs to the old one (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "contact, c",
+					Usage: "the new contact attribute",
+				},
+				cli.StringFlag{
+					Name:  "comment, m",
+					Usage: "the new comment attribute",
+				},
+				cli.StringSliceFlag{
+					Name:  "revoker, r",
+					Value: &cli.StringSlice{},
+					Usage: "the new delegated revokers (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "expiry",
+					Usage: "set the expiry measured from now e.g. 10d5h10s",
+				},
+				cli.BoolFlag{
+					Name:  "keepold",
+					Usage: "do not revoke the old entity",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "also write the report to this file as JSON",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag, nflag, oflag,
+			},
+		},
+		{
+			Name:   "rotate-dr",
+			Usage:  "move namespaces to a new designated router entity",
+			Action: cli.ActionFunc(actionRotateDR),
+			Description: "Start a router with the new entity at --srv first, leaving the " +
+				"old router running. This publishes the new entity, waits until it is " +
+				"reachable at --srv, sets its SRV record, and then offers to route each " +
+				"namespace and accepts the offer. The old router serves each namespace " +
+				"until its acceptance is confirmed. Once they all are, the old router's " +
+				"offers are retracted and it can be shut down",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dr",
+					Usage: "the designated router entity being retired",
+				},
+				cli.StringFlag{
+					Name:  "newdr",
+					Usage: "the designated router entity taking over",
+				},
+				cli.StringSliceFlag{
+					Name:  "ns",
+					Value: &cli.StringSlice{},
+					Usage: "a namespace entity to move (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "srv",
+					Usage: "the ip:port the new router serves on",
+				},
+				cli.StringFlag{
+					Name:  "wait",
+					Usage: "how long to wait for the new router to be reachable e.g. 5m",
+				},
+				cli.BoolFlag{
+					Name:  "keepold",
+					Usage: "do not retract the old router's offers",
+				},
+				bflag, confflag, timeoutflag, gaspflag, attemptsflag,
+			},
+		},
+		{
+			Name:   "gen-service",
+			Usage:  "generate the scaffolding of a service in Go",
+			Action: cli.ActionFunc(actionGenService),
+			Description: "Writes a bw2bind program that registers the service under " +
+				"$BW2_BASEURI (or --baseuri) with each interface at " +
+				"<base>/<svc>/<prefix>/<iface>, subscribes a handler to each slot, has " +
+				"a publisher for each signal and keeps the lastalive metadata that " +
+				"views use to list interfaces up to date",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "svc",
+					Usage: "the service name e.g. s.mydevice",
+				},
+				cli.StringSliceFlag{
+					Name:  "iface",
+					Value: &cli.StringSlice{},
+					Usage: "an interface name e.g. i.example (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "slot",
+					Value: &cli.StringSlice{},
+					Usage: "a slot each interface handles (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "signal",
+					Value: &cli.StringSlice{},
+					Usage: "a signal each interface publishes (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "prefix",
+					Value: "default",
+					Usage: "the URI element between the service and its interfaces",
+				},
+				cli.StringFlag{
+					Name:  "baseuri",
+					Usage: "the default base URI, if $BW2_BASEURI is not set",
+				},
+				cli.DurationFlag{
+					Name:  "heartbeat",
+					Value: 10 * time.Second,
+					Usage: "how often to republish lastalive",
+				},
+				cli.StringFlag{
+					Name:  "outfile, o",
+					Usage: "the file to write, standard output if not given",
+				},
 			},
 		},
 	}
@@ -609,15 +1807,33 @@ func actionRouter(c *cli.Context) error {
 	}
 	if bw.Config.Native.ListenOn != "" {
 		go api.Start(bw)
+		go api.StartDRMonitor(bw)
+		go api.StartReplicaGossip(bw)
 	} else {
 		fmt.Println("not starting native server: no listen address")
 	}
+	go api.StartStats(bw)
+	go api.StartRouterInfo(bw)
+	go api.StartChainBuildService(bw)
+	go api.StartChainEvents(bw)
+	go api.StartMounts(bw)
+	go api.StartDrivers(bw)
+	go api.StartStandby(bw)
 	if bw.Config.OOB.ListenOn != "" {
 		oob := new(oob.Adapter)
 		go oob.Start(bw)
 	} else {
 		fmt.Println("not starting oob server: no listen address")
 	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Println("shutting down, send the signal again to stop immediately")
+		go bw.Stop()
+		<-sig
+		bw.BC().Shutdown()
+	}()
 	<-shd
 	fmt.Printf("got shutdown\n")
 	return nil
@@ -0,0 +1,765 @@
+package bw2test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+	"github.com/immesys/bw2bc/core/types"
+)
+
+// Change describes an update to the Chain's registry. Exactly one of the
+// fields is set, apart from AliasKey which goes with Alias
+type Change struct {
+	Entity *objects.Entity
+	DOT    *objects.DOT
+	//The DOT hash or entity VK that was revoked
+	Revoked []byte
+	//The value an alias was created or updated for, or the value of a
+	//deleted alias
+	Alias []byte
+	//The key of an alias that was updated or deleted, nil for a new alias
+	AliasKey []byte
+}
+
+// Chain is an in-memory stand in for the block chain. It implements
+// bc.BlockChainProvider with a registry, alias and affinity store that
+// confirm every operation immediately, each in a new block. Operations
+// that need a real chain, like transactions and contract calls, return
+// errors
+type Chain struct {
+	mu        sync.Mutex
+	block     uint64
+	blockTime int64
+	entities  map[bc.Bytes32]*objects.Entity
+	dots      map[bc.Bytes32]*objects.DOT
+	dotsFrom  map[bc.Bytes32][]bc.Bytes32
+	chains    map[bc.Bytes32]*objects.DChain
+	revoked   map[bc.Bytes32]bool
+	aliases   map[bc.Bytes32]bc.Bytes32
+	aliasFor  map[bc.Bytes32]bc.Bytes32
+	owners    map[bc.Bytes32]bc.Address
+	aliasRecs []*bc.AliasRecord
+	shortnext uint64
+	drs       map[bc.Bytes32][]byte
+	offers    map[bc.Bytes32][][]byte
+	srvs      map[bc.Bytes32]string
+	txs       map[common.Hash]uint64
+	heads     map[chan *types.Header]struct{}
+	hooks     []func(Change)
+	//If set, namespaces without a designated router are routed by it
+	defaultDR []byte
+}
+
+// NewChain returns an empty chain at block 1
+func NewChain() *Chain {
+	return &Chain{
+		block:     1,
+		blockTime: time.Now().Unix(),
+		entities:  make(map[bc.Bytes32]*objects.Entity),
+		dots:      make(map[bc.Bytes32]*objects.DOT),
+		dotsFrom:  make(map[bc.Bytes32][]bc.Bytes32),
+		chains:    make(map[bc.Bytes32]*objects.DChain),
+		revoked:   make(map[bc.Bytes32]bool),
+		aliases:   make(map[bc.Bytes32]bc.Bytes32),
+		aliasFor:  make(map[bc.Bytes32]bc.Bytes32),
+		owners:    make(map[bc.Bytes32]bc.Address),
+		shortnext: 1,
+		drs:       make(map[bc.Bytes32][]byte),
+		offers:    make(map[bc.Bytes32][][]byte),
+		srvs:      make(map[bc.Bytes32]string),
+		txs:       make(map[common.Hash]uint64),
+		heads:     make(map[chan *types.Header]struct{}),
+	}
+}
+
+var errNotSupported = bwe.M(bwe.BlockChainGenericError, "not supported by the bw2test chain")
+
+// OnChange calls cb after every registry or alias change, once the change
+// is visible
+func (c *Chain) OnChange(cb func(Change)) {
+	c.mu.Lock()
+	c.hooks = append(c.hooks, cb)
+	c.mu.Unlock()
+}
+
+// SetDefaultRouter makes the entity the designated router of every
+// namespace that does not have one
+func (c *Chain) SetDefaultRouter(drvk []byte) {
+	c.mu.Lock()
+	c.defaultDR = drvk
+	c.mu.Unlock()
+}
+
+// mine adds a block holding a transaction for the change, and calls the
+// hooks. The lock must be held, it is released
+func (c *Chain) mine(ch *Change) (*bc.TxResult, error) {
+	c.block++
+	c.blockTime = time.Now().Unix()
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], c.block)
+	txhash := common.Hash(sha256.Sum256(seed[:]))
+	c.txs[txhash] = c.block
+	hdr := c.header(c.block)
+	for hc := range c.heads {
+		select {
+		case hc <- hdr:
+		default:
+		}
+	}
+	hooks := c.hooks
+	c.mu.Unlock()
+	if ch != nil {
+		for _, h := range hooks {
+			h(*ch)
+		}
+	}
+	return &bc.TxResult{TxHash: txhash, BlockNumber: c.block}, nil
+}
+
+func (c *Chain) header(n uint64) *types.Header {
+	return &types.Header{
+		Number: new(big.Int).SetUint64(n),
+		Time:   big.NewInt(c.blockTime),
+	}
+}
+
+// AddEntity puts the entity in the registry
+func (c *Chain) AddEntity(e *objects.Entity) (*bc.TxResult, error) {
+	if !e.SigValid() {
+		return nil, bwe.M(bwe.InvalidEntity, "entity signature is invalid")
+	}
+	c.mu.Lock()
+	c.entities[bc.SliceToBytes32(e.GetVK())] = e
+	return c.mine(&Change{Entity: e})
+}
+
+// AddDOT puts the DOT in the registry. Its entities must be there already
+func (c *Chain) AddDOT(d *objects.DOT) (*bc.TxResult, error) {
+	if !d.SigValid() {
+		return nil, bwe.M(bwe.InvalidDOT, "DOT signature is invalid")
+	}
+	c.mu.Lock()
+	//Like the public chain, the everybody VK counts as an entity
+	if c.entities[bc.SliceToBytes32(d.GetGiverVK())] == nil ||
+		(c.entities[bc.SliceToBytes32(d.GetReceiverVK())] == nil && !objects.IsEveryoneVK(d.GetReceiverVK())) {
+		c.mu.Unlock()
+		return nil, bwe.M(bwe.RegistryDOTInvalid, "the DOT's entities are not in the registry")
+	}
+	h := bc.SliceToBytes32(d.GetHash())
+	if c.dots[h] == nil {
+		from := bc.SliceToBytes32(d.GetGiverVK())
+		c.dotsFrom[from] = append(c.dotsFrom[from], h)
+	}
+	c.dots[h] = d
+	return c.mine(&Change{DOT: d})
+}
+
+// AddChain puts the access chain in the registry. Its DOTs must be there
+// already
+func (c *Chain) AddChain(dc *objects.DChain) (*bc.TxResult, error) {
+	c.mu.Lock()
+	for i := 0; i < dc.NumHashes(); i++ {
+		if c.dots[bc.SliceToBytes32(dc.GetDotHash(i))] == nil {
+			c.mu.Unlock()
+			return nil, bwe.M(bwe.RegistryChainInvalid, "the chain's DOTs are not in the registry")
+		}
+	}
+	c.chains[bc.SliceToBytes32(dc.GetChainHash())] = dc
+	return c.mine(nil)
+}
+
+// Revoke marks the target (a DOT hash or entity VK) of a valid revocation
+// as revoked
+func (c *Chain) Revoke(rvk *objects.Revocation) (*bc.TxResult, error) {
+	c.mu.Lock()
+	k := bc.SliceToBytes32(rvk.GetTarget())
+	var target objects.RoutingObject
+	if d, ok := c.dots[k]; ok {
+		target = d
+	} else if e, ok := c.entities[k]; ok {
+		target = e
+	}
+	if target == nil {
+		c.mu.Unlock()
+		return nil, bwe.M(bwe.NotRevokable, "could not resolve target to DOT or Entity")
+	}
+	if !rvk.IsValidFor(target) {
+		c.mu.Unlock()
+		return nil, bwe.M(bwe.InvalidRevocation, "the revocation is not valid for its target")
+	}
+	c.revoked[k] = true
+	return c.mine(&Change{Revoked: rvk.GetTarget()})
+}
+
+// SetAlias creates a long alias with no owner, so it cannot be changed
+// once set. Use SetOwnedAlias for an alias that can be
+func (c *Chain) SetAlias(key bc.Bytes32, val bc.Bytes32) (*bc.TxResult, error) {
+	return c.SetOwnedAlias(bc.Address{}, key, val)
+}
+
+// SetOwnedAlias creates a long alias that the owner can update, transfer
+// or delete
+func (c *Chain) SetOwnedAlias(owner bc.Address, key bc.Bytes32, val bc.Bytes32) (*bc.TxResult, error) {
+	c.mu.Lock()
+	if _, ok := c.aliases[key]; ok {
+		c.mu.Unlock()
+		return nil, bwe.M(bwe.AliasExists, "alias exists")
+	}
+	c.aliases[key] = val
+	c.owners[key] = owner
+	if _, ok := c.aliasFor[val]; !ok {
+		c.aliasFor[val] = key
+	}
+	c.aliasRecs = append(c.aliasRecs, &bc.AliasRecord{Key: key, Value: val, BlockNumber: c.block + 1})
+	return c.mine(&Change{Alias: val[:]})
+}
+
+// CreateShortAlias creates the next short alias for the value, with no
+// owner
+func (c *Chain) CreateShortAlias(val bc.Bytes32) (uint64, error) {
+	return c.createShortAlias(bc.Address{}, val)
+}
+
+func (c *Chain) createShortAlias(owner bc.Address, val bc.Bytes32) (uint64, error) {
+	c.mu.Lock()
+	alias := c.shortnext
+	c.shortnext++
+	c.mu.Unlock()
+	_, err := c.SetOwnedAlias(owner, bc.ShortAliasKey(alias), val)
+	return alias, err
+}
+
+// ownedAlias checks, with c.mu held, that the alias exists and that the
+// account owns it, as the alias contract does
+func (c *Chain) ownedAlias(owner bc.Address, key bc.Bytes32) error {
+	if _, ok := c.aliases[key]; !ok {
+		return bwe.M(bwe.AliasError, "Alias does not exist")
+	}
+	if o := c.owners[key]; o == (bc.Address{}) || o != owner {
+		return bwe.M(bwe.AliasError, "Alias is not owned by the account")
+	}
+	return nil
+}
+
+// UpdateAlias points an alias the owner owns at a new value
+func (c *Chain) UpdateAlias(owner bc.Address, key bc.Bytes32, val bc.Bytes32) (*bc.TxResult, error) {
+	c.mu.Lock()
+	if err := c.ownedAlias(owner, key); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	if old := c.aliases[key]; c.aliasFor[old] == key {
+		delete(c.aliasFor, old)
+	}
+	if _, ok := c.aliasFor[val]; !ok {
+		c.aliasFor[val] = key
+	}
+	c.aliases[key] = val
+	c.aliasRecs = append(c.aliasRecs, &bc.AliasRecord{Key: key, Value: val, BlockNumber: c.block + 1})
+	return c.mine(&Change{Alias: val[:], AliasKey: key[:]})
+}
+
+// TransferAlias gives an alias the owner owns to another account
+func (c *Chain) TransferAlias(owner bc.Address, key bc.Bytes32, to bc.Address) (*bc.TxResult, error) {
+	if to == (bc.Address{}) {
+		return nil, bwe.M(bwe.AliasError, "You cannot transfer an alias to the zero address, delete it instead")
+	}
+	c.mu.Lock()
+	if err := c.ownedAlias(owner, key); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.owners[key] = to
+	return c.mine(nil)
+}
+
+// DeleteAlias deletes an alias the owner owns
+func (c *Chain) DeleteAlias(owner bc.Address, key bc.Bytes32) (*bc.TxResult, error) {
+	c.mu.Lock()
+	if err := c.ownedAlias(owner, key); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	old := c.aliases[key]
+	if c.aliasFor[old] == key {
+		delete(c.aliasFor, old)
+	}
+	delete(c.aliases, key)
+	delete(c.owners, key)
+	return c.mine(&Change{Alias: old[:], AliasKey: key[:]})
+}
+
+// SetDesignatedRouter makes drvk the designated router of the namespace,
+// with the given SRV record (host:port) if it is not empty
+func (c *Chain) SetDesignatedRouter(nsvk []byte, drvk []byte, srv string) {
+	c.mu.Lock()
+	c.drs[bc.SliceToBytes32(nsvk)] = drvk
+	if srv != "" {
+		c.srvs[bc.SliceToBytes32(drvk)] = srv
+	}
+	c.mine(nil)
+}
+
+// state returns the registry state of an entity or DOT, which is expired
+// or revoked if the object or one of its entities is
+func (c *Chain) state(k bc.Bytes32, ro objects.RoutingObject) int {
+	if c.revoked[k] {
+		return bc.StateRevoked
+	}
+	if ro, ok := ro.(objects.DescribedObject); ok && ro.IsExpired() {
+		return bc.StateExpired
+	}
+	if ro, ok := ro.(*objects.DOT); ok {
+		for _, vk := range [][]byte{ro.GetGiverVK(), ro.GetReceiverVK()} {
+			ek := bc.SliceToBytes32(vk)
+			if s := c.state(ek, c.entities[ek]); s != bc.StateValid {
+				return s
+			}
+		}
+	}
+	return bc.StateValid
+}
+
+// Shutdown does nothing
+func (c *Chain) Shutdown() {}
+
+// ENode returns an empty node string
+func (c *Chain) ENode() string { return "" }
+
+// GetClient returns a client that publishes to this chain
+func (c *Chain) GetClient(e *objects.Entity) bc.BlockChainClient {
+	return &chainClient{c: c, ent: e}
+}
+
+// HeadBlockAge is always zero, the chain is never stale
+func (c *Chain) HeadBlockAge() int64 { return 0 }
+
+func (c *Chain) GetAddrBalance(ctx context.Context, addr string) (string, string, error) {
+	return "0", "0 Ξ", nil
+}
+
+// ChainID is zero, so no [contracts] apply
+func (c *Chain) ChainID() *big.Int { return new(big.Int) }
+
+func (c *Chain) GetCode(ctx context.Context, addr string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (c *Chain) GetBlock(height uint64) *bc.Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height > c.block {
+		return nil
+	}
+	return &bc.Block{Number: height, Time: c.blockTime}
+}
+
+func (c *Chain) GetHeader(height uint64) *types.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height > c.block {
+		return nil
+	}
+	return c.header(height)
+}
+
+func (c *Chain) NewHeads(ctx context.Context) chan *types.Header {
+	rv := make(chan *types.Header, 100)
+	c.mu.Lock()
+	c.heads[rv] = struct{}{}
+	c.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.heads, rv)
+		c.mu.Unlock()
+		close(rv)
+	}()
+	return rv
+}
+
+func (c *Chain) AfterBlocks(ctx context.Context, n uint64) chan bool {
+	rv := make(chan bool, 1)
+	target := c.CurrentBlock() + n
+	octx, cancel := context.WithCancel(ctx)
+	hdrs := c.NewHeads(octx)
+	go func() {
+		defer cancel()
+		for {
+			if c.CurrentBlock() >= target {
+				rv <- true
+				return
+			}
+			if _, ok := <-hdrs; !ok {
+				rv <- false
+				return
+			}
+		}
+	}()
+	return rv
+}
+
+func (c *Chain) SyncProgress() (int, uint64, uint64, uint64) {
+	cur := c.CurrentBlock()
+	return 0, 0, cur, cur
+}
+
+func (c *Chain) CurrentBlock() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.block
+}
+
+func (c *Chain) CallOffChain(ctx context.Context, ufi bc.UFI, params ...interface{}) ([]interface{}, error) {
+	return nil, errNotSupported
+}
+
+func (c *Chain) CallOffSpecificChain(ctx context.Context, block int64, ufi bc.UFI, params ...interface{}) ([]interface{}, error) {
+	return nil, errNotSupported
+}
+
+func (c *Chain) GasPrice(ctx context.Context) (*big.Int, error) {
+	return new(big.Int), nil
+}
+
+// FindLogsBetweenHeavy finds no logs. Changes are announced with OnChange
+func (c *Chain) FindLogsBetweenHeavy(ctx context.Context, after int64, before int64, addr common.Address, topics [][]common.Hash) ([]bc.Log, error) {
+	return nil, nil
+}
+
+func (c *Chain) FindRoutingOffers(ctx context.Context, nsvk []byte) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offers[bc.SliceToBytes32(nsvk)], nil
+}
+
+func (c *Chain) FindRoutingAffinities(ctx context.Context, drvk []byte) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rv := [][]byte{}
+	for ns, dr := range c.drs {
+		if string(dr) == string(drvk) {
+			rv = append(rv, append([]byte{}, ns[:]...))
+		}
+	}
+	return rv, nil
+}
+
+func (c *Chain) GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dr, ok := c.drs[bc.SliceToBytes32(nsvk)]; ok {
+		return dr, nil
+	}
+	if c.defaultDR != nil {
+		return c.defaultDR, nil
+	}
+	return nil, bwe.M(bwe.ResolutionFailed, "the namespace has no designated router")
+}
+
+func (c *Chain) GetSRVRecordFor(ctx context.Context, drvk []byte) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if srv, ok := c.srvs[bc.SliceToBytes32(drvk)]; ok {
+		return srv, nil
+	}
+	return "", bwe.M(bwe.ResolutionFailed, "the designated router has no SRV record")
+}
+
+func (c *Chain) ResolveDOT(ctx context.Context, dothash []byte) (*objects.DOT, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := bc.SliceToBytes32(dothash)
+	d, ok := c.dots[k]
+	if !ok {
+		return nil, bc.StateUnknown, nil
+	}
+	return d, c.state(k, d), nil
+}
+
+func (c *Chain) ResolveEntity(ctx context.Context, vk []byte) (*objects.Entity, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := bc.SliceToBytes32(vk)
+	e, ok := c.entities[k]
+	if !ok {
+		return nil, bc.StateUnknown, nil
+	}
+	return e, c.state(k, e), nil
+}
+
+func (c *Chain) ResolveAccessDChain(ctx context.Context, chainhash []byte) (*objects.DChain, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dc, ok := c.chains[bc.SliceToBytes32(chainhash)]
+	if !ok {
+		return nil, bc.StateUnknown, nil
+	}
+	for i := 0; i < dc.NumHashes(); i++ {
+		k := bc.SliceToBytes32(dc.GetDotHash(i))
+		if s := c.state(k, c.dots[k]); s != bc.StateValid {
+			return dc, s, nil
+		}
+	}
+	return dc, bc.StateValid, nil
+}
+
+func (c *Chain) ResolveDOTsFromVK(ctx context.Context, vk bc.Bytes32) ([]bc.Bytes32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bc.Bytes32{}, c.dotsFrom[vk]...), nil
+}
+
+func (c *Chain) ResolveShortAlias(ctx context.Context, alias uint64) (bc.Bytes32, bool, error) {
+	return c.ResolveAlias(ctx, bc.ShortAliasKey(alias))
+}
+
+func (c *Chain) ResolveAlias(ctx context.Context, key bc.Bytes32) (bc.Bytes32, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := c.aliases[key]
+	return v, v.Zero(), nil
+}
+
+func (c *Chain) UnresolveAlias(ctx context.Context, value bc.Bytes32) (bc.Bytes32, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.aliasFor[value]
+	return k, !ok, nil
+}
+
+func (c *Chain) AliasOwner(ctx context.Context, key bc.Bytes32) (bc.Address, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owners[key], nil
+}
+
+// currentAliases returns, with c.mu held, the last record of each alias
+// that match says to keep, oldest first
+func (c *Chain) currentAliases(match func(r *bc.AliasRecord) bool) []*bc.AliasRecord {
+	last := make(map[bc.Bytes32]*bc.AliasRecord)
+	for _, r := range c.aliasRecs {
+		last[r.Key] = r
+	}
+	rv := []*bc.AliasRecord{}
+	for _, r := range c.aliasRecs {
+		if last[r.Key] != r || c.aliases[r.Key] != r.Value || !match(r) {
+			continue
+		}
+		cp := *r
+		cp.Owner = c.owners[r.Key]
+		rv = append(rv, &cp)
+	}
+	return rv
+}
+
+func (c *Chain) FindAliasesFor(ctx context.Context, value bc.Bytes32) ([]*bc.AliasRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentAliases(func(r *bc.AliasRecord) bool {
+		return r.Value == value
+	}), nil
+}
+
+func (c *Chain) FindAliasesOwnedBy(ctx context.Context, addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentAliases(func(r *bc.AliasRecord) bool {
+		for _, a := range addrs {
+			if a != (bc.Address{}) && c.owners[r.Key] == a {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (c *Chain) FindAliasesCreatedBy(ctx context.Context, addrs []bc.Address) ([]*bc.AliasRecord, error) {
+	return nil, errNotSupported
+}
+
+func (c *Chain) GetAffinityNSNonce(ctx context.Context, nsvk []byte) (*big.Int, error) {
+	return new(big.Int), nil
+}
+
+func (c *Chain) GetTxParams(ctx context.Context, addr bc.Address) (*bc.OfflineTx, error) {
+	return nil, errNotSupported
+}
+
+func (c *Chain) SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error) {
+	return common.Hash{}, errNotSupported
+}
+
+func (c *Chain) WaitForTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64, confirmed func(res *bc.TxResult, err error)) {
+	c.mu.Lock()
+	bn, ok := c.txs[txhash]
+	c.mu.Unlock()
+	if !ok {
+		confirmed(nil, bwe.M(bwe.TransactionTimeout, "unknown transaction"))
+		return
+	}
+	confirmed(&bc.TxResult{TxHash: txhash, BlockNumber: bn}, nil)
+}
+
+func (c *Chain) WatchTransaction(ctx context.Context, txhash common.Hash, timeoutblocks uint64, confirmations uint64) <-chan bc.TxEvent {
+	rv := make(chan bc.TxEvent, 1)
+	c.WaitForTransaction(ctx, txhash, timeoutblocks, confirmations, func(res *bc.TxResult, err error) {
+		if err != nil {
+			rv <- bc.TxEvent{Kind: bc.TxEventFailed, TxHash: txhash, Err: err}
+		} else {
+			rv <- bc.TxEvent{Kind: bc.TxEventConfirmed, TxHash: txhash, BlockNumber: res.BlockNumber, Result: res}
+		}
+		close(rv)
+	})
+	return rv
+}
+
+// chainClient publishes to a Chain on behalf of an entity. Routing offers
+// and money are not supported
+type chainClient struct {
+	c   *Chain
+	ent *objects.Entity
+}
+
+func (cc *chainClient) SetEntity(e *objects.Entity)         { cc.ent = e }
+func (cc *chainClient) SetDefaultConfirmations(c uint64)    {}
+func (cc *chainClient) SetDefaultTimeout(c uint64)          {}
+func (cc *chainClient) SetMaxGasPrice(p *big.Int)           {}
+func (cc *chainClient) GetDefaultConfirmations() uint64     { return 0 }
+func (cc *chainClient) GetDefaultTimeout() uint64           { return 0 }
+func (cc *chainClient) GetMaxGasPrice() *big.Int            { return new(big.Int) }
+func (cc *chainClient) SetRetryPolicy(p bc.RetryPolicy)     {}
+func (cc *chainClient) GetRetryPolicy() bc.RetryPolicy      { return bc.RetryPolicy{MaxAttempts: 1} }
+func (cc *chainClient) GetAddresses() ([]bc.Address, error) { return nil, errNotSupported }
+
+func (cc *chainClient) WithInteractionParams(p *bc.InteractionParams) bc.BlockChainClient {
+	return cc
+}
+
+// GetAddress returns a stand in for the account's address, made from the
+// entity's VK, so that the aliases the entity creates have an owner
+func (cc *chainClient) GetAddress(idx int) (bc.Address, error) {
+	if cc.ent == nil || idx < 0 || idx >= bc.MaxEntityAccounts {
+		return bc.Address{}, bwe.M(bwe.InvalidAccountNumber, "bad account")
+	}
+	h := sha256.Sum256(append(cc.ent.GetVK(), byte(idx)))
+	return bc.Address(common.BytesToAddress(h[:])), nil
+}
+
+func (cc *chainClient) CallOnChain(ctx context.Context, account int, ufi bc.UFI, value, gas, gasPrice string, params ...interface{}) (common.Hash, error) {
+	return common.Hash{}, errNotSupported
+}
+
+func (cc *chainClient) Transact(ctx context.Context, fromacc int, to, value, gas, gasPrice string, code []byte) (common.Hash, error) {
+	return common.Hash{}, errNotSupported
+}
+
+func (cc *chainClient) TransactAndCheck(ctx context.Context, fromacc int, to, value, gas, gasPrice string, code []byte, confirmed func(error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) GetBalance(ctx context.Context, idx int) (string, string, error) {
+	return "0", "0 Ξ", nil
+}
+
+func (cc *chainClient) CreateRoutingOffer(ctx context.Context, acc int, dr *objects.Entity, nsvk []byte, confirmed func(err error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) AcceptRoutingOffer(ctx context.Context, acc int, ns *objects.Entity, drvk []byte, confirmed func(err error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) RetractRoutingAcceptance(ctx context.Context, acc int, ns *objects.Entity, drvk []byte, confirmed func(err error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) RetractRoutingOffer(ctx context.Context, acc int, dr *objects.Entity, nsvk []byte, confirmed func(err error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) CreateSRVRecord(ctx context.Context, acc int, dr *objects.Entity, record string, confirmed func(err error)) {
+	confirmed(errNotSupported)
+}
+
+func (cc *chainClient) PublishEntity(ctx context.Context, acc int, ent *objects.Entity, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(cc.c.AddEntity(ent))
+}
+
+func (cc *chainClient) PublishDOT(ctx context.Context, acc int, dot *objects.DOT, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(cc.c.AddDOT(dot))
+}
+
+func (cc *chainClient) PublishAccessDChain(ctx context.Context, acc int, chain *objects.DChain, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(cc.c.AddChain(chain))
+}
+
+//EstimateAccessDChain says publishing is free, as the test chain has no gas
+func (cc *chainClient) EstimateAccessDChain(ctx context.Context, acc int, chain *objects.DChain) (*bc.TxCost, error) {
+	if dc, _, _ := cc.c.ResolveAccessDChain(ctx, chain.GetChainHash()); dc != nil {
+		return nil, nil
+	}
+	return &bc.TxCost{Gas: new(big.Int), GasPrice: new(big.Int), Value: new(big.Int)}, nil
+}
+
+func (cc *chainClient) PublishRevocation(ctx context.Context, acc int, rvk *objects.Revocation, confirmed func(res *bc.TxResult, err error)) {
+	confirmed(cc.c.Revoke(rvk))
+}
+
+func (cc *chainClient) CreateShortAlias(ctx context.Context, acc int, val bc.Bytes32, confirmed func(alias uint64, err error)) {
+	if val.Zero() {
+		confirmed(0, bwe.M(bwe.AliasError, "You cannot create an alias to zero"))
+		return
+	}
+	owner, err := cc.GetAddress(acc)
+	if err != nil {
+		confirmed(0, err)
+		return
+	}
+	confirmed(cc.c.createShortAlias(owner, val))
+}
+
+func (cc *chainClient) SetAlias(ctx context.Context, acc int, key bc.Bytes32, val bc.Bytes32, confirmed func(err error)) {
+	cc.aliasOp(acc, confirmed, func(owner bc.Address) (*bc.TxResult, error) {
+		return cc.c.SetOwnedAlias(owner, key, val)
+	})
+}
+
+func (cc *chainClient) UpdateAlias(ctx context.Context, acc int, key bc.Bytes32, val bc.Bytes32, confirmed func(err error)) {
+	if val.Zero() {
+		confirmed(bwe.M(bwe.AliasError, "You cannot point an alias to zero, delete it instead"))
+		return
+	}
+	cc.aliasOp(acc, confirmed, func(owner bc.Address) (*bc.TxResult, error) {
+		return cc.c.UpdateAlias(owner, key, val)
+	})
+}
+
+func (cc *chainClient) TransferAlias(ctx context.Context, acc int, key bc.Bytes32, to bc.Address, confirmed func(err error)) {
+	cc.aliasOp(acc, confirmed, func(owner bc.Address) (*bc.TxResult, error) {
+		return cc.c.TransferAlias(owner, key, to)
+	})
+}
+
+func (cc *chainClient) DeleteAlias(ctx context.Context, acc int, key bc.Bytes32, confirmed func(err error)) {
+	cc.aliasOp(acc, confirmed, func(owner bc.Address) (*bc.TxResult, error) {
+		return cc.c.DeleteAlias(owner, key)
+	})
+}
+
+// aliasOp runs an alias operation as the account
+func (cc *chainClient) aliasOp(acc int, confirmed func(err error), op func(owner bc.Address) (*bc.TxResult, error)) {
+	owner, err := cc.GetAddress(acc)
+	if err == nil {
+		_, err = op(owner)
+	}
+	confirmed(err)
+}
@@ -0,0 +1,195 @@
+package bw2test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+// Client is a client of the router acting as one entity. Its operations
+// wait for the router to accept or refuse them, and build the access
+// chains they need automatically
+type Client struct {
+	BosswaveClient *api.BosswaveClient
+	r              *Router
+}
+
+// Client returns a new client of the router acting as the entity
+func (r *Router) Client(e *objects.Entity) (*Client, error) {
+	cl := r.BW.CreateClient(context.Background(), "bw2test")
+	if err := cl.SetEntityObj(e); err != nil {
+		return nil, err
+	}
+	return &Client{BosswaveClient: cl, r: r}, nil
+}
+
+// splitURI resolves the namespace of a URI
+func (r *Router) splitURI(uri string) ([]byte, string, error) {
+	parts := strings.SplitN(uri, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, "", bwe.M(bwe.BadURI, "URI should be namespace/suffix")
+	}
+	mvk, err := r.BW.ResolveKey(parts[0])
+	if err != nil {
+		return nil, "", bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err)
+	}
+	return mvk, parts[1], nil
+}
+
+func (c *Client) publish(uri string, persist bool, pos []objects.PayloadObject) error {
+	mvk, suffix, err := c.r.splitURI(uri)
+	if err != nil {
+		return err
+	}
+	rv := make(chan error, 1)
+	c.BosswaveClient.Publish(&api.PublishParams{
+		MVK:            mvk,
+		URISuffix:      suffix,
+		AutoChain:      true,
+		ElaboratePAC:   api.PartialElaboration,
+		Persist:        persist,
+		PayloadObjects: pos,
+	}, func(err error) {
+		rv <- err
+	})
+	return <-rv
+}
+
+// Publish publishes the payload objects on the URI
+func (c *Client) Publish(uri string, pos ...objects.PayloadObject) error {
+	return c.publish(uri, false, pos)
+}
+
+// Persist publishes the payload objects on the URI and persists them
+func (c *Client) Persist(uri string, pos ...objects.PayloadObject) error {
+	return c.publish(uri, true, pos)
+}
+
+// Query returns the messages persisted on the URI
+func (c *Client) Query(uri string) ([]*advpo.SimpleMessage, error) {
+	mvk, suffix, err := c.r.splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	rv := []*advpo.SimpleMessage{}
+	c.BosswaveClient.Query(&api.QueryParams{
+		MVK:          mvk,
+		URISuffix:    suffix,
+		AutoChain:    true,
+		ElaboratePAC: api.PartialElaboration,
+	}, func(err error) {
+		errc <- err
+	}, func(m *core.Message) {
+		if m == nil {
+			close(done)
+			return
+		}
+		rv = append(rv, toSimpleMessage(m))
+	})
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	<-done
+	return rv, nil
+}
+
+// Subscription holds the messages received on a subscription until the
+// test takes them
+type Subscription struct {
+	C  chan *advpo.SimpleMessage
+	c  *Client
+	id core.UniqueMessageID
+}
+
+// Subscribe subscribes to the URI, which may have wildcards. Messages
+// that arrive while the subscription's buffer is full are dropped
+func (c *Client) Subscribe(uri string) (*Subscription, error) {
+	mvk, suffix, err := c.r.splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	rv := &Subscription{C: make(chan *advpo.SimpleMessage, 100), c: c}
+	errc := make(chan error, 1)
+	c.BosswaveClient.Subscribe(&api.SubscribeParams{
+		MVK:          mvk,
+		URISuffix:    suffix,
+		AutoChain:    true,
+		ElaboratePAC: api.PartialElaboration,
+	}, func(err error, id core.UniqueMessageID) {
+		rv.id = id
+		errc <- err
+	}, func(m *core.Message) {
+		if m == nil {
+			return
+		}
+		select {
+		case rv.C <- toSimpleMessage(m):
+		default:
+		}
+	})
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Unsubscribe ends the subscription
+func (s *Subscription) Unsubscribe() error {
+	rv := make(chan error, 1)
+	s.c.BosswaveClient.Unsubscribe(s.id, func(err error) {
+		rv <- err
+	})
+	return <-rv
+}
+
+// Next returns the next message, or nil if none arrives in time
+func (s *Subscription) Next(timeout time.Duration) *advpo.SimpleMessage {
+	select {
+	case m := <-s.C:
+		return m
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Expect fails the test if no message arrives in time, and returns the
+// message otherwise
+func (s *Subscription) Expect(t testing.TB, timeout time.Duration) *advpo.SimpleMessage {
+	m := s.Next(timeout)
+	if m == nil {
+		t.Fatalf("expected a message within %s", timeout)
+	}
+	return m
+}
+
+// ExpectNone fails the test if a message arrives within d
+func (s *Subscription) ExpectNone(t testing.TB, d time.Duration) {
+	if m := s.Next(d); m != nil {
+		t.Fatalf("expected no message, got one on %s", m.URI)
+	}
+}
+
+// toSimpleMessage is like advpo.ToSimpleMessage, but does not need the
+// message to have an origin VK
+func toSimpleMessage(m *core.Message) *advpo.SimpleMessage {
+	if m.OriginVK != nil {
+		return advpo.ToSimpleMessage(m)
+	}
+	rv := advpo.ToSimpleMessage(&core.Message{
+		OriginVK:       &[]byte{},
+		Topic:          m.Topic,
+		PayloadObjects: m.PayloadObjects,
+		RoutingObjects: m.RoutingObjects,
+	})
+	rv.From = ""
+	return rv
+}
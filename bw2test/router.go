@@ -0,0 +1,182 @@
+// Package bw2test runs a router in memory for unit tests. The router is the
+// real terminus and resolver, on top of an in-memory Chain that confirms
+// registry changes at once, so a test can mint entities, grant DOTs and
+// check that messages do or do not get through without a block chain:
+//
+//	r, err := bw2test.New()
+//	...
+//	defer r.Close()
+//	ns, _ := r.NewEntity("ns")
+//	alice, _ := r.NewEntity("alice")
+//	r.Grant(ns, alice.GetVK(), r.URI(ns, "a/*"), "PC")
+//	cl, _ := r.Client(alice)
+//	sub, _ := cl.Subscribe(r.URI(ns, "a/b"))
+//	cl.Publish(r.URI(ns, "a/b"), po)
+//	sub.Expect(t, time.Second)
+//
+// The router is the designated router of every namespace. Persisted
+// messages go to the process-wide store, which is opened by the first
+// router in the process and shared by the others
+package bw2test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+// Router is a router running in memory
+type Router struct {
+	BW     *api.BW
+	Chain  *Chain
+	Entity *objects.Entity
+	dir    string
+}
+
+// New starts a router on a new Chain
+func New() (*Router, error) {
+	dir, err := ioutil.TempDir("", "bw2test")
+	if err != nil {
+		return nil, err
+	}
+	rv := &Router{Chain: NewChain(), dir: dir}
+	rv.Entity, err = api.CreateEntity(&api.CreateEntityParams{Contact: "bw2test router"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if _, err := rv.Chain.AddEntity(rv.Entity); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	rv.Chain.SetDefaultRouter(rv.Entity.GetVK())
+	config := &core.BWConfig{}
+	config.Router.DB = dir
+	rv.BW = api.NewBWContextWithChain(config, rv.Entity, rv.Chain)
+	//The chain emits no logs, so flush the resolver caches as the router
+	//would when it sees the matching events
+	rv.Chain.OnChange(func(ch Change) {
+		switch {
+		case ch.Entity != nil:
+			rv.BW.FlushEntity(ch.Entity.GetVK())
+		case ch.DOT != nil:
+			rv.BW.FlushGrantedFromCache(ch.DOT.GetGiverVK())
+			if ch.DOT.IsAccess() {
+				rv.BW.FlushChainNSVK(ch.DOT.GetAccessURIMVK())
+			}
+			rv.BW.FlushDOT(ch.DOT.GetHash())
+		case ch.Revoked != nil:
+			rv.BW.FlushRevoked(ch.Revoked)
+		case ch.Alias != nil:
+			if ch.AliasKey != nil {
+				rv.BW.FlushAlias(ch.AliasKey)
+			}
+			rv.BW.FlushAliasesFor(ch.Alias)
+		}
+	})
+	return rv, nil
+}
+
+// Close removes the router's temporary directory. The store stays open
+// for the other routers in the process
+func (r *Router) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// NewEntity creates an entity that expires in a day and puts it in the
+// registry
+func (r *Router) NewEntity(contact string) (*objects.Entity, error) {
+	expiry := 24 * time.Hour
+	e, err := api.CreateEntity(&api.CreateEntityParams{Contact: contact, ExpiryDelta: &expiry})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Chain.AddEntity(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// URI returns the URI of suffix in the namespace of ns
+func (r *Router) URI(ns *objects.Entity, suffix string) string {
+	return crypto.FmtKey(ns.GetVK()) + "/" + suffix
+}
+
+// Grant creates an access DOT from one entity to a VK on the URI, with
+// the given permissions (e.g. "PC*"), and puts it in the registry. The
+// namespace of the URI may be an alias
+func (r *Router) Grant(from *objects.Entity, to []byte, uri string, perms string) (*objects.DOT, error) {
+	mvk, suffix, err := r.splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	expiry := 24 * time.Hour
+	cl, err := r.Client(from)
+	if err != nil {
+		return nil, err
+	}
+	d, err := cl.BosswaveClient.CreateDOT(&api.CreateDOTParams{
+		To:                to,
+		TTL:               10,
+		ExpiryDelta:       &expiry,
+		MVK:               mvk,
+		URISuffix:         suffix,
+		AccessPermissions: perms,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Chain.AddDOT(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GrantPublic creates a DOT from one entity to everybody, letting anyone
+// consume on the URI, and puts it in the registry
+func (r *Router) GrantPublic(from *objects.Entity, uri string) (*objects.DOT, error) {
+	cl, err := r.Client(from)
+	if err != nil {
+		return nil, err
+	}
+	expiry := 24 * time.Hour
+	d, err := cl.BosswaveClient.CreatePublicDOT(&api.CreatePublicDOTParams{
+		URI:         uri,
+		ExpiryDelta: &expiry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Chain.AddDOT(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Revoke revokes a DOT (by hash) or an entity (by VK). The revoking
+// entity must be the giver of the DOT, the entity itself, or one of their
+// delegated revokers. Subscriptions that relied on the target are
+// rechecked before Revoke returns, though they may take a moment to close
+func (r *Router) Revoke(by *objects.Entity, target []byte) error {
+	rvk := objects.CreateRevocation(by.GetVK(), target, "bw2test")
+	rvk.Encode(by.GetSK())
+	_, err := r.Chain.Revoke(rvk)
+	return err
+}
+
+// Alias creates a long alias for the value, e.g. so that a namespace can
+// be named in URIs
+func (r *Router) Alias(name string, value []byte) error {
+	if len(name) > 32 {
+		return bwe.M(bwe.AliasError, "alias is longer than 32 bytes")
+	}
+	_, err := r.Chain.SetAlias(bc.SliceToBytes32([]byte(name)), bc.SliceToBytes32(value))
+	return err
+}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +19,8 @@ import (
 	"unicode/utf8"
 
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
@@ -52,10 +57,11 @@ func loadSigningEntityFile(fpath string) *objects.Entity {
 	if err != nil {
 		return nil
 	}
-	if contents[0] != objects.ROEntityWKey {
+	kf, err := decodeKeyFile(contents)
+	if err != nil || kf.RONum != objects.ROEntityWKey {
 		return nil
 	}
-	enti, err := objects.NewEntity(int(contents[0]), contents[1:])
+	enti, err := objects.NewEntity(kf.RONum, kf.Content)
 	if err != nil {
 		return nil
 	}
@@ -95,7 +101,7 @@ func getAvailableEntity(c *cli.Context, param string) *objects.Entity {
 	//TODO
 	return nil
 }
-func getBankroll(c *cli.Context, bwcl *bw2bind.BW2Client) []byte {
+func getBankroll(c *cli.Context) []byte {
 
 	par := c.String("bankroll")
 
@@ -103,7 +109,7 @@ func getBankroll(c *cli.Context, bwcl *bw2bind.BW2Client) []byte {
 		fmt.Println("No bankroll entity specified")
 		os.Exit(1)
 	}
-	enti, ok := getEntityParam(bwcl, c, par, true)
+	enti, ok := getEntityParam(nil, c, par, true)
 	if !ok {
 		fmt.Printf("Could not load bankroll entity '%s'\n", par)
 		os.Exit(1)
@@ -111,7 +117,7 @@ func getBankroll(c *cli.Context, bwcl *bw2bind.BW2Client) []byte {
 	return enti.(*objects.Entity).GetSigningBlob()
 }
 
-func getAccountParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string) string {
+func getAccountParam(ac *agentConn, c *cli.Context, param string) string {
 	if param == "" {
 		fmt.Printf("Account parameter missing\n")
 		os.Exit(1)
@@ -131,7 +137,7 @@ func getAccountParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string) stri
 		return "0x" + hparam
 	}
 	//Then try it as an alias
-	res, zero, err := bwcl.ResolveLongAlias(param)
+	res, zero, err := ac.resolveLongAlias(param)
 	if err != nil {
 		fmt.Printf("Could not resolve alias '%s': %s\n", param, err.Error())
 		os.Exit(1)
@@ -149,14 +155,14 @@ func getAccountParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string) stri
 	return "0x" + hex.EncodeToString(res[:20])
 }
 
-func getEntityParamVK(bwcl *bw2bind.BW2Client, c *cli.Context, param string) (string, bool) {
-	i, ok := getEntityParam(bwcl, c, param, false)
+func getEntityParamVK(ac *agentConn, c *cli.Context, param string) (string, bool) {
+	i, ok := getEntityParam(ac, c, param, false)
 	if ok {
 		return i.(string), true
 	}
 	return "", false
 }
-func getDotParamHash(bwcl *bw2bind.BW2Client, c *cli.Context, param string) (string, bool) {
+func getDotParamHash(ac *agentConn, c *cli.Context, param string) (string, bool) {
 	contents, err := ioutil.ReadFile(param)
 	if err != nil && !os.IsNotExist(err) {
 		//If file exists but cannot be read, then error out
@@ -164,7 +170,12 @@ func getDotParamHash(bwcl *bw2bind.BW2Client, c *cli.Context, param string) (str
 		os.Exit(1)
 	}
 	if contents != nil {
-		doti, err := objects.NewDOT(int(contents[0]), contents[1:])
+		kf, err := decodeKeyFile(contents)
+		if err != nil {
+			fmt.Println("Could not decode file:", param, ":", err.Error())
+			os.Exit(1)
+		}
+		doti, err := objects.NewDOT(kf.RONum, kf.Content)
 		if err != nil {
 			fmt.Println("Could not decode file:", param, ":", err.Error())
 			os.Exit(1)
@@ -178,7 +189,7 @@ func getDotParamHash(bwcl *bw2bind.BW2Client, c *cli.Context, param string) (str
 	}
 
 	//Only option is an alias
-	ro, _, err := bwcl.ResolveRegistry(param)
+	ro, _, err := ac.resolveRegistry(param)
 	if err != nil {
 		fmt.Printf("Could not resolve '%s' in registry: %v\n", param, err)
 		os.Exit(1)
@@ -191,7 +202,7 @@ func getDotParamHash(bwcl *bw2bind.BW2Client, c *cli.Context, param string) (str
 	return crypto.FmtKey(dot.GetHash()), true
 
 }
-func getEntityParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string, asSK bool) (interface{}, bool) {
+func getEntityParam(ac *agentConn, c *cli.Context, param string, asSK bool) (interface{}, bool) {
 	//First thing we do is check if there is a local file by that name
 	contents, err := ioutil.ReadFile(param)
 	if err != nil && !os.IsNotExist(err) {
@@ -200,11 +211,16 @@ func getEntityParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string, asSK
 		os.Exit(1)
 	}
 	if contents != nil {
-		if asSK && contents[0] != objects.ROEntityWKey {
+		kf, err := decodeKeyFile(contents)
+		if err != nil {
+			fmt.Println("Could not decode file:", param, ":", err.Error())
+			os.Exit(1)
+		}
+		if asSK && kf.RONum != objects.ROEntityWKey {
 			fmt.Println("Need signing entity:", param)
 			os.Exit(1)
 		}
-		enti, err := objects.NewEntity(int(contents[0]), contents[1:])
+		enti, err := objects.NewEntity(kf.RONum, kf.Content)
 		if err != nil {
 			fmt.Println("Could not decode file:", param, ":", err.Error())
 			os.Exit(1)
@@ -240,7 +256,7 @@ func getEntityParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string, asSK
 		}
 
 		//Only option is an alias
-		ro, _, err := bwcl.ResolveRegistry(param)
+		ro, _, err := ac.resolveRegistry(param)
 		if err != nil {
 			fmt.Printf("Could not resolve '%s' in registry: %v\n", param, err)
 			os.Exit(1)
@@ -257,8 +273,8 @@ func getEntityParam(bwcl *bw2bind.BW2Client, c *cli.Context, param string, asSK
 }
 func actionColdStore(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	cscode := ""
 	for _, v := range c.Args() {
 		cscode += v
@@ -273,21 +289,24 @@ func actionColdStore(c *cli.Context) error {
 		os.Exit(1)
 	}
 	ent := coldstore.DecodeColdStore(bin)
-	cl.SetEntityOrExit(ent.GetSigningBlob())
-	accbal, err := cl.EntityBalances()
-	bal := accbal[0]
+	ac.setEntityOrExit(ent.GetSigningBlob())
+	accbal, err := ac.entityBalances()
+	if err == nil && len(accbal) == 0 {
+		err = fmt.Errorf("the agent did not return a balance")
+	}
 	if err != nil {
 		fmt.Println("Balance:" + ansi.ColorCode("red+b") + " ERROR: " + err.Error())
-	} else {
-		fmt.Println("Balance: ")
-		f := big.NewFloat(0)
-		f.SetInt(bal.Int)
-		f = f.Quo(f, big.NewFloat(1000000000000000000.0))
-		fmt.Println(fmt.Sprintf(" (%s) %.6f \u039e", bal.Addr, f))
+		os.Exit(1)
 	}
+	bal := accbal[0]
+	fmt.Println("Balance: ")
+	f := big.NewFloat(0)
+	f.SetInt(bal.Int)
+	f = f.Quo(f, big.NewFloat(1000000000000000000.0))
+	fmt.Println(fmt.Sprintf(" (%s) %.6f \u039e", bal.Addr, f))
 
 	if c.String("to") != "" {
-		toacc := getAccountParam(cl, c, c.String("to"))
+		toacc := getAccountParam(ac, c, c.String("to"))
 		amt := bal.Int
 		amt = amt.Sub(amt, big.NewInt(1000000000000000000)) //1 ether
 		if amt.Sign() <= 0 {
@@ -296,15 +315,14 @@ func actionColdStore(c *cli.Context) error {
 		}
 		dchan := make(chan string, 1)
 		go func() {
-			//err := cl.Transfer(toacc, 1*bw2bind.Ether)
-			err := cl.TransferWei(0, toacc, amt)
+			_, err := ac.transferWei(0, toacc, amt)
 			if err == nil {
 				dchan <- "Transfer completed and confirmed"
 			} else {
-				dchan <- "Transfer error: " + err.Error()
+				dchan <- "Transfer error: " + chainErrString(err)
 			}
 		}()
-		doChainOp(cl, dchan)
+		doChainOp(ac, dchan)
 	} else {
 		fmt.Println("no 'to' account specified, not transferring")
 	}
@@ -312,14 +330,14 @@ func actionColdStore(c *cli.Context) error {
 }
 func actionMkDRO(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	nsp := c.String("ns")
 	if nsp == "" {
 		fmt.Println("'ns' parameter required")
 		os.Exit(1)
 	}
-	ns, ok := getEntityParamVK(cl, c, nsp)
+	ns, ok := getEntityParamVK(ac, c, nsp)
 	if !ok {
 		fmt.Println("Could not resolve ns param")
 		os.Exit(1)
@@ -331,33 +349,32 @@ func actionMkDRO(c *cli.Context) error {
 	}
 	//If a bankroll is specified, we will use that to pay
 	if c.String("bankroll") != "" {
-		br := getBankroll(c, cl)
-		cl.SetEntity(br)
+		ac.setEntityOrExit(getBankroll(c))
 	} else {
-		cl.SetEntity(dr.GetSigningBlob())
+		ac.setEntityOrExit(dr.GetSigningBlob())
 	}
 	dchan := make(chan string, 1)
 	go func() {
-		err := cl.NewDesignatedRouterOffer(0, ns, dr)
+		err := ac.newDesignatedRouterOffer(0, ns, dr)
 		if err == nil {
 			dchan <- "Designated router offer created and confirmed"
 		} else {
-			dchan <- "DRO error: " + err.Error()
+			dchan <- "DRO error: " + chainErrString(err)
 		}
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 func actionRDRO(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	nsp := c.String("ns")
 	if nsp == "" {
 		fmt.Println("'ns' parameter required")
 		os.Exit(1)
 	}
-	ns, ok := getEntityParamVK(cl, c, nsp)
+	ns, ok := getEntityParamVK(ac, c, nsp)
 	if !ok {
 		fmt.Println("Could not resolve ns param")
 		os.Exit(1)
@@ -369,33 +386,32 @@ func actionRDRO(c *cli.Context) error {
 	}
 	//If a bankroll is specified, we will use that to pay
 	if c.String("bankroll") != "" {
-		br := getBankroll(c, cl)
-		cl.SetEntity(br)
+		ac.setEntityOrExit(getBankroll(c))
 	} else {
-		cl.SetEntity(dr.GetSigningBlob())
+		ac.setEntityOrExit(dr.GetSigningBlob())
 	}
 	dchan := make(chan string, 1)
 	go func() {
-		err := cl.RevokeDesignatedRouterOffer(0, ns, dr)
+		err := ac.revokeDesignatedRouterOffer(0, ns, dr)
 		if err == nil {
 			dchan <- "Designated router offer revoked and confirmed"
 		} else {
-			dchan <- "Error revoking routing offer: " + err.Error()
+			dchan <- "Error revoking routing offer: " + chainErrString(err)
 		}
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 func actionRADRO(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	drp := c.String("dr")
 	if drp == "" {
 		fmt.Println("'dr' parameter required")
 		os.Exit(1)
 	}
-	dr, ok := getEntityParamVK(cl, c, drp)
+	dr, ok := getEntityParamVK(ac, c, drp)
 	if !ok {
 		fmt.Println("Could not resolve dr param")
 		os.Exit(1)
@@ -407,38 +423,37 @@ func actionRADRO(c *cli.Context) error {
 	}
 	//If a bankroll is specified, we will use that to pay
 	if c.String("bankroll") != "" {
-		br := getBankroll(c, cl)
-		cl.SetEntity(br)
+		ac.setEntityOrExit(getBankroll(c))
 	} else {
-		cl.SetEntity(ns.GetSigningBlob())
+		ac.setEntityOrExit(ns.GetSigningBlob())
 	}
 	dchan := make(chan string, 1)
 	go func() {
-		err := cl.RevokeAcceptanceOfDesignatedRouterOffer(0, dr, ns)
+		err := ac.revokeAcceptanceOfDesignatedRouterOffer(0, dr, ns)
 		if err == nil {
 			dchan <- "Designated router offer acceptance revoked and confirmed"
 		} else {
-			dchan <- "Error revoking accepted routing offer: " + err.Error()
+			dchan <- "Error revoking accepted routing offer: " + chainErrString(err)
 		}
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 func actionLsDRO(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	nsp := c.String("ns")
 	if nsp == "" {
 		fmt.Println("'ns' parameter required")
 		os.Exit(1)
 	}
-	ns, ok := getEntityParamVK(cl, c, nsp)
+	ns, ok := getEntityParamVK(ac, c, nsp)
 	if !ok {
 		fmt.Println("Could not resolve ns param")
 		os.Exit(1)
 	}
-	active, srv, all, err := cl.GetDesignatedRouterOffers(ns)
+	active, srv, all, err := ac.designatedRouterOffers(ns)
 	if err != nil {
 		fmt.Println("Search failed:", err.Error())
 		os.Exit(1)
@@ -460,14 +475,14 @@ func actionLsDRO(c *cli.Context) error {
 }
 func actionADRO(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	drp := c.String("dr")
 	if drp == "" {
 		fmt.Println("'dr' parameter required")
 		os.Exit(1)
 	}
-	dr, ok := getEntityParamVK(cl, c, drp)
+	dr, ok := getEntityParamVK(ac, c, drp)
 	if !ok {
 		fmt.Println("Could not resolve dr param")
 		os.Exit(1)
@@ -479,27 +494,99 @@ func actionADRO(c *cli.Context) error {
 	}
 	//If a bankroll is specified, we will use that to pay
 	if c.String("bankroll") != "" {
-		br := getBankroll(c, cl)
-		cl.SetEntity(br)
+		ac.setEntityOrExit(getBankroll(c))
 	} else {
-		cl.SetEntity(ns.GetSigningBlob())
+		ac.setEntityOrExit(ns.GetSigningBlob())
 	}
 	dchan := make(chan string, 1)
 	go func() {
-		err := cl.AcceptDesignatedRouterOffer(0, dr, ns)
+		err := ac.acceptDesignatedRouterOffer(0, dr, ns)
 		if err == nil {
 			dchan <- "Designated router offer accepted and confirmed"
 		} else {
-			dchan <- "Error accepting routing offer: " + err.Error()
+			dchan <- "Error accepting routing offer: " + chainErrString(err)
+		}
+	}()
+	doChainOp(ac, dchan)
+	return nil
+}
+func actionRotateDR(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	srv := c.String("srv")
+	if srv == "" {
+		fmt.Println("'srv' parameter required")
+		os.Exit(1)
+	}
+	if c.String("dr") == "" || c.String("newdr") == "" {
+		fmt.Println("'dr' and 'newdr' parameters required")
+		os.Exit(1)
+	}
+	old := getAvailableEntity(c, c.String("dr"))
+	if old == nil {
+		fmt.Println("Could not load the old designated router")
+		os.Exit(1)
+	}
+	nw := getAvailableEntity(c, c.String("newdr"))
+	if nw == nil {
+		fmt.Println("Could not load the new designated router")
+		os.Exit(1)
+	}
+	var nss []*objects.Entity
+	for _, n := range c.StringSlice("ns") {
+		ns := getAvailableEntity(c, n)
+		if ns == nil {
+			fmt.Printf("Could not load namespace '%s'\n", n)
+			os.Exit(1)
+		}
+		nss = append(nss, ns)
+	}
+	if len(nss) == 0 {
+		fmt.Println("'ns' parameter required")
+		os.Exit(1)
+	}
+	wait := ""
+	if c.String("wait") != "" {
+		dur, err := util.ParseDuration(c.String("wait"))
+		if err != nil {
+			fmt.Println("Could not parse wait:", c.String("wait"))
+			os.Exit(1)
+		}
+		wait = dur.String()
+	}
+	//If a bankroll is specified, we will use that to pay
+	if c.String("bankroll") != "" {
+		ac.setEntityOrExit(getBankroll(c))
+	} else {
+		ac.setEntityOrExit(old.GetSigningBlob())
+	}
+	fmt.Printf("Moving %d namespaces to %s, which must be serving at %s\n", len(nss), crypto.FmtKey(nw.GetVK()), srv)
+	dchan := make(chan string, 1)
+	go func() {
+		moved, retracted, err := ac.rotateDR(0, old, nw, nss, srv, wait, c.Bool("keepold"))
+		if err != nil {
+			dchan <- "Rotation failed: " + chainErrString(err)
+			return
+		}
+		m := "Rotation finished"
+		for _, ns := range moved {
+			m += "\n moved " + ns
+		}
+		if len(retracted) != 0 {
+			m += fmt.Sprintf("\nThe old router no longer offers to route %d namespaces and can be shut down", len(retracted))
+		} else {
+			m += "\nThe old router's offers were kept"
 		}
+		dchan <- m
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 func actionUSRV(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	srv := c.String("srv")
 	if srv == "" {
 		fmt.Println("'srv' parameter required")
@@ -513,39 +600,466 @@ func actionUSRV(c *cli.Context) error {
 
 	//If a bankroll is specified, we will use that to pay
 	if c.String("bankroll") != "" {
-		br := getBankroll(c, cl)
-		cl.SetEntity(br)
+		ac.setEntityOrExit(getBankroll(c))
 	} else {
-		cl.SetEntity(dr.GetSigningBlob())
+		ac.setEntityOrExit(dr.GetSigningBlob())
 	}
 	dchan := make(chan string, 1)
 	go func() {
-		err := cl.SetDesignatedRouterSRVRecord(0, srv, dr)
+		err := ac.setDesignatedRouterSRVRecord(0, srv, dr)
 		if err == nil {
 			dchan <- "Designated router SRV record updated and confirmed"
 		} else {
-			dchan <- "Error updating SRV record: " + err.Error()
+			dchan <- "Error updating SRV record: " + chainErrString(err)
 		}
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 
-func actionMkAlias(c *cli.Context) error {
-	//check usage
-	if c.Bool("short") && c.String("long") != "" {
-		fmt.Println("You can specify --short or --long, not both")
+func actionDRStatus(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	h, err := ac.drHealth(c.Bool("check"))
+	if err != nil {
+		fmt.Println("Could not get DR status:", err)
 		os.Exit(1)
 	}
-	if !c.Bool("short") && c.String("long") == "" {
-		fmt.Println("You need to specify --short or --long")
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(h, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Println("Designated router status:")
+		fmt.Printf("        Router: %s\n", h.VK)
+		if h.Monitor {
+			fmt.Println("       Monitor: on")
+		} else {
+			fmt.Println("       Monitor: off (set [dr] CheckInterval to enable)")
+		}
+		fmt.Printf("  Last checked: %s\n", h.Checked)
+		fmt.Printf("    SRV record: %s\n", h.SRV)
+		fmt.Printf("     Public IP: %s\n", h.PublicIP)
+		if h.Reachable {
+			fmt.Printf("     Reachable: yes (%s)\n", h.Latency)
+		} else {
+			fmt.Printf("     Reachable: %sno%s\n", ansi.ColorCode("red+b"), ansi.ColorCode("reset"))
+		}
+		if h.UpdatedSRV != "" {
+			switch {
+			case h.UpdatePending:
+				fmt.Printf("    SRV update: %s (pending)\n", h.UpdatedSRV)
+			case h.UpdateErr != "":
+				fmt.Printf("    SRV update: %s failed at %s: %s\n", h.UpdatedSRV, h.Updated, h.UpdateErr)
+			default:
+				fmt.Printf("    SRV update: %s at %s\n", h.UpdatedSRV, h.Updated)
+			}
+		}
+		for _, p := range h.Problems {
+			fmt.Printf("%s  problem: %s%s\n", ansi.ColorCode("red+b"), p, ansi.ColorCode("reset"))
+		}
+	}
+	if len(h.Problems) != 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionListClients(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	clients, err := ac.listClients()
+	if err != nil {
+		fmt.Println("Could not list clients:", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(clients, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	for _, cl := range clients {
+		vk := cl.VK
+		if vk == "" {
+			vk = "(no entity)"
+		}
+		fmt.Printf("%4s %-44s %s\n", cl.ID, vk, cl.Name)
+		fmt.Printf("     since %s, %s subscriptions, %s published, %s cached chains\n",
+			cl.Connected, cl.Subscriptions, cl.Published, cl.Chains)
+	}
+	return nil
+}
+
+func actionRouterSubs(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	subs, err := ac.listSubscriptions(c.String("ns"))
+	if err != nil {
+		fmt.Println("Could not list subscriptions:", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(subs, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	now := time.Now()
+	for _, s := range subs {
+		vk := s.VK
+		if vk == "" {
+			vk = "(unknown entity)"
+		}
+		age := s.Created
+		if t, err := time.Parse(time.RFC3339, s.Created); err == nil {
+			age = (now.Sub(t) / time.Second * time.Second).String()
+		}
+		kind := "subscription"
+		if s.Tap {
+			kind = "tap"
+		}
+		fmt.Println(s.URI)
+		fmt.Printf("     %s by %s for %s, %s messages, client %s\n", kind, vk, age, s.Messages, s.Client)
+	}
+	return nil
+}
+
+//healthColors are the ansi colors services are printed in by health
+var healthColors = map[string]string{
+	api.HealthAlive: "green+b",
+	api.HealthStale: "yellow+b",
+	api.HealthGone:  "red+b",
+}
+
+func printServiceInventory(inv *api.ServiceInventory) {
+	taken := time.Unix(0, inv.Taken)
+	for _, s := range inv.Services {
+		seen := "never alive"
+		if s.LastAlive != 0 {
+			age := taken.Sub(time.Unix(0, s.LastAlive)) / time.Second * time.Second
+			seen = "alive " + age.String() + " ago"
+		}
+		fmt.Printf("%s%-5s%s %s (%d interfaces, %s)\n", ansi.ColorCode(healthColors[s.Health]), s.Health,
+			ansi.ColorCode("reset"), s.URI, len(s.Interfaces), seen)
+	}
+	names := make([]string, 0, len(inv.Counts))
+	for name := range inv.Counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ct := inv.Counts[name]
+		fmt.Printf("%s: %d alive, %d stale, %d gone\n", name, ct.Alive, ct.Stale, ct.Gone)
+	}
+}
+
+func actionServices(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		fmt.Println("Usage: bw2 services [--watch] <ns>...")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	if !c.Bool("watch") {
+		inv, err := ac.listServices(c.Args(), c.Duration("staleafter"), c.Duration("goneafter"))
+		if err != nil {
+			fmt.Println("Could not list services:", err)
+			os.Exit(1)
+		}
+		if c.Bool("json") {
+			out, _ := json.MarshalIndent(inv, "", "  ")
+			fmt.Println(string(out))
+			return nil
+		}
+		printServiceInventory(inv)
+		return nil
+	}
+	err := ac.watchServices(c.Args(), c.Duration("staleafter"), c.Duration("goneafter"),
+		func(changes []api.ServiceChange, inv *api.ServiceInventory) {
+			if c.Bool("json") {
+				out, _ := json.Marshal(map[string]interface{}{"changes": changes, "inventory": inv})
+				fmt.Println(string(out))
+				return
+			}
+			if len(changes) == 0 {
+				printServiceInventory(inv)
+				return
+			}
+			now := time.Unix(0, inv.Taken).Format("2006-01-02 15:04:05")
+			for _, ch := range changes {
+				from, to := ch.Old, ch.New
+				if from == "" {
+					from = "new"
+				}
+				if to == "" {
+					to = "removed"
+				}
+				fmt.Printf("%s %s%s -> %s%s %s\n", now, ansi.ColorCode(healthColors[ch.New]), from, to,
+					ansi.ColorCode("reset"), ch.URI)
+			}
+		})
+	fmt.Println("Stopped watching services:", err)
+	os.Exit(1)
+	return nil
+}
+
+//call --request '{"k":"v"}' <iface-uri> <slot>
+func actionCall(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		fmt.Println("Usage: bw2 call -e entity [--request json] <iface-uri> <slot>")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	checkURIOrExit(c.Args()[0])
+	var request []byte
+	if c.String("request") != "" {
+		if !strings.HasPrefix(strings.TrimSpace(c.String("request")), "{") {
+			fmt.Println("--request must be a JSON object")
+			os.Exit(1)
+		}
+		var err error
+		if request, err = jsonToMsgPack(c.String("request")); err != nil {
+			fmt.Println("bad --request JSON:", err)
+			os.Exit(1)
+		}
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	r, err := ac.call(c.Args()[0], c.Args()[1], c.String("reply"), request, c.Duration("timeout"), c.Int("retries"))
+	if err != nil {
+		fmt.Println("Call failed:", err)
+		os.Exit(1)
+	}
+	p := &messagePrinter{
+		ac:      ac,
+		json:    c.Bool("json"),
+		aliases: make(map[string]string),
+		chunks:  objects.NewReassembler(chunkReassemblyLimit, chunkReassemblyTimeout),
+	}
+	p.print(r)
+	return nil
+}
+
+func actionDiscoverNamespace(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 dns <domain>")
 		os.Exit(1)
 	}
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
-	b := getBankroll(c, cl)
-	cl.SetEntityOrExit(b)
+	ac := connectAgentOrExit(c)
+	ns, err := ac.discoverNamespace(c.Args()[0])
+	if err != nil {
+		fmt.Println("Could not discover namespace:", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(ns, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	srv := ns.SRV
+	if srv == "" {
+		srv = "(none, the chain's is used)"
+	}
+	verified := ansi.ColorCode("green+b") + "matches the chain" + ansi.ColorCode("reset")
+	if !ns.Verified {
+		verified = ansi.ColorCode("yellow+b") + "not verified, the chain has not synced" + ansi.ColorCode("reset")
+	}
+	fmt.Printf("Namespace: %s\n", ns.NSVK)
+	fmt.Printf("DR:        %s\n", ns.DRVK)
+	fmt.Printf("SRV:       %s\n", srv)
+	fmt.Printf("Affinity:  %s\n", verified)
+	return nil
+}
+
+func actionDiscover(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	rs, err := api.DiscoverLocalRouters(c.Duration("wait"))
+	if err != nil {
+		fmt.Println("Could not query the local network:", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(rs, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	if len(rs) == 0 {
+		fmt.Println("No routers found on the local network")
+		return nil
+	}
+	for _, r := range rs {
+		fmt.Printf("%s %-21s %-8s %s\n", crypto.FmtKey(r.VK), r.Addr, r.Latency-r.Latency%time.Millisecond, r.Instance)
+	}
+	return nil
+}
+
+func actionDrain(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	if err := ac.drain(); err != nil {
+		fmt.Println("Could not drain the router:", err)
+		os.Exit(1)
+	}
+	fmt.Println("The router is draining. Stop it with SIGTERM once its clients have moved")
+	return nil
+}
+
+func actionStandbyStatus(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	st, err := ac.standbyStatus()
+	if err != nil {
+		fmt.Println("Could not get standby status:", err)
+		os.Exit(1)
+	}
+	if c.Bool("json") {
+		out, _ := json.MarshalIndent(st, "", "  ")
+		fmt.Println(string(out))
+		return nil
+	}
+	if st.Primary == "" {
+		fmt.Println("The router is not a standby")
+	} else if st.Promoted != "" {
+		fmt.Printf("Promoted at %s, was following %s\n", st.Promoted, st.Primary)
+	} else {
+		state := ansi.ColorCode("red+b") + "disconnected" + ansi.ColorCode("reset")
+		if st.Synced {
+			state = ansi.ColorCode("green+b") + "in sync" + ansi.ColorCode("reset")
+		} else if st.Connected {
+			state = ansi.ColorCode("yellow+b") + "copying the store" + ansi.ColorCode("reset")
+		}
+		fmt.Printf("Primary:  %s (%s)\n", st.Primary, state)
+		fmt.Printf("Applied:  %s writes\n", st.Applied)
+		if st.LastApplied != "" {
+			fmt.Printf("Last:     %s\n", st.LastApplied)
+		}
+		if st.LastError != "" {
+			fmt.Printf("Error:    %s\n", st.LastError)
+		}
+	}
+	fmt.Printf("Standbys following this router: %s\n", st.Followers)
+	return nil
+}
+
+func actionPromote(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	srv, err := ac.promote(c.String("srv"))
+	if err != nil {
+		fmt.Println("Could not promote the standby:", err)
+		os.Exit(1)
+	}
+	fmt.Println("The standby has been promoted and no longer follows its primary")
+	if srv != "" {
+		fmt.Println("Updating the SRV record to", srv)
+	}
+	return nil
+}
+
+func actionDropPeer(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 droppeer -e <entity> <client id>")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	if err := ac.dropPeer(c.Args()[0]); err != nil {
+		fmt.Println("Could not drop peer:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Dropped peer", c.Args()[0])
+	return nil
+}
+
+func actionListReplicas(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 replicas <nsvk>")
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	drs, err := ac.listDesignatedRouters(c.Args()[0])
+	if err != nil {
+		fmt.Println("Could not get designated routers:", err)
+		os.Exit(1)
+	}
+	for i, dr := range drs {
+		role := "replica"
+		if i == 0 {
+			role = "primary"
+		}
+		srv := dr.SRV
+		if srv == "" {
+			srv = ansi.ColorCode("red+b") + "no SRV record" + ansi.ColorCode("reset")
+		}
+		fmt.Printf("%-8s %s %s\n", role, dr.VK, srv)
+	}
+	return nil
+}
+
+//getAliasValue reads an alias value given as --hex, --text or --b64
+func getAliasValue(c *cli.Context) []byte {
 	binval := make([]byte, 32)
 	set := false
 	if c.String("hex") != "" {
@@ -588,47 +1102,255 @@ func actionMkAlias(c *cli.Context) error {
 			fmt.Println("Alias value cannot be greater than 32 bytes")
 			os.Exit(1)
 		}
-		copy(binval, rv)
-		set = true
+		copy(binval, rv)
+		set = true
+	}
+	if !set {
+		fmt.Println("You need to specify a value")
+		os.Exit(1)
+	}
+	return binval
+}
+func actionMkAlias(c *cli.Context) error {
+	//check usage
+	if c.Bool("short") && c.String("long") != "" {
+		fmt.Println("You can specify --short or --long, not both")
+		os.Exit(1)
+	}
+	if !c.Bool("short") && c.String("long") == "" {
+		fmt.Println("You need to specify --short or --long")
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	ac.setEntityOrExit(getBankroll(c))
+	binval := getAliasValue(c)
+	isShort := c.Bool("short")
+	var key []byte
+	if !isShort {
+		key = []byte(c.String("long"))
+		if len(key) > 32 {
+			fmt.Println("Alias key cannot be longer than 32 bytes")
+			os.Exit(1)
+		}
+	}
+	dchan := make(chan string, 1)
+	go func() {
+		if isShort {
+			hexres, err := ac.createShortAlias(0, binval)
+			if err != nil {
+				dchan <- "Error creating alias: " + chainErrString(err)
+			} else {
+				dchan <- fmt.Sprintf("Short alias created and confirmed: @%s]", hexres)
+			}
+		} else {
+			err := ac.createLongAlias(0, key, binval)
+			if err != nil {
+				dchan <- "Error creating alias: " + chainErrString(err)
+			} else {
+				dchan <- "Alias record updated and confirmed"
+			}
+		}
+	}()
+	doChainOp(ac, dchan)
+	return nil
+}
+
+//getAliasKey gets the existing alias from --long or --short (in hex)
+func getAliasKey(c *cli.Context) (string, bool) {
+	long, short := c.String("long"), c.String("short")
+	if (long == "") == (short == "") {
+		fmt.Println("You need to specify --long or --short, but not both")
+		os.Exit(1)
+	}
+	if long != "" {
+		if len(long) > 32 {
+			fmt.Println("Alias key cannot be longer than 32 bytes")
+			os.Exit(1)
+		}
+		return long, false
+	}
+	short = strings.TrimSuffix(strings.TrimPrefix(short, "@"), "]")
+	if _, err := strconv.ParseUint(short, 16, 64); err != nil {
+		fmt.Println("--short must be the short alias in hex")
+		os.Exit(1)
+	}
+	return short, true
+}
+
+//aliasOp runs an alias management operation as the bankroll entity
+func aliasOp(c *cli.Context, failed string, done string, op func(ac *agentConn) error) {
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	ac.setEntityOrExit(getBankroll(c))
+	dchan := make(chan string, 1)
+	go func() {
+		if err := op(ac); err != nil {
+			dchan <- failed + chainErrString(err)
+		} else {
+			dchan <- done
+		}
+	}()
+	doChainOp(ac, dchan)
+}
+
+func actionUpdateAlias(c *cli.Context) error {
+	key, short := getAliasKey(c)
+	binval := getAliasValue(c)
+	aliasOp(c, "Error updating alias: ", "Alias updated and confirmed", func(ac *agentConn) error {
+		return ac.updateAlias(0, key, short, binval)
+	})
+	return nil
+}
+
+func actionTransferAlias(c *cli.Context) error {
+	key, short := getAliasKey(c)
+	to := strings.TrimPrefix(c.String("to"), "0x")
+	if len(to) != 40 {
+		fmt.Println("You need to specify --to, the address (40 characters of hex) to give the alias to")
+		os.Exit(1)
+	}
+	aliasOp(c, "Error transferring alias: ", "Alias transferred and confirmed", func(ac *agentConn) error {
+		return ac.transferAlias(0, key, short, to)
+	})
+	return nil
+}
+
+func actionRmAlias(c *cli.Context) error {
+	key, short := getAliasKey(c)
+	aliasOp(c, "Error deleting alias: ", "Alias deleted and confirmed", func(ac *agentConn) error {
+		return ac.deleteAlias(0, key, short)
+	})
+	return nil
+}
+
+func fmtAliasValue(val []byte) string {
+	trimmed := bytes.TrimRight(val, "\x00")
+	if len(trimmed) < len(val) && utf8.Valid(trimmed) {
+		return fmt.Sprintf("%q", string(trimmed))
+	}
+	return crypto.FmtHash(val)
+}
+
+//aliasRefRegex matches a whole-string alias: @hex] for a short alias or
+//@key[ for a long one
+var aliasRefRegex = regexp.MustCompile(`^@([0-9a-zA-Z]*)(\]|\[)$`)
+
+func actionLsAlias(c *cli.Context) error {
+	var value []byte
+	if c.String("hex") != "" || c.String("b64") != "" || c.String("text") != "" {
+		value = getAliasValue(c)
+		if len(c.StringSlice("address")) != 0 {
+			fmt.Println("You can list aliases by value or by --address, not both")
+			os.Exit(1)
+		}
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	if value == nil && len(c.StringSlice("address")) == 0 {
+		if c.String("bankroll") == "" {
+			fmt.Println("Specify a value, --address or --bankroll")
+			os.Exit(1)
+		}
+		ac.setEntityOrExit(getBankroll(c))
+	}
+	recs, err := ac.listAliases(value, c.StringSlice("address"))
+	if err != nil {
+		fmt.Println("Could not list aliases:", err)
+		os.Exit(1)
+	}
+	if len(recs) == 0 {
+		fmt.Println("No aliases found")
+		return nil
+	}
+	for _, r := range recs {
+		fmt.Printf("%s -> %s\n  block %s tx %s", bc.FmtAliasKey(bc.SliceToBytes32(r.Key)), fmtAliasValue(r.Value), r.BlockNumber, r.TxHash)
+		if r.Creator != "" {
+			fmt.Printf(" by %s", r.Creator)
+		}
+		if r.Owner != "" {
+			fmt.Printf(" owned by %s", r.Owner)
+		}
+		fmt.Println()
 	}
-	if !set {
-		fmt.Println("You need to specify a value")
+	return nil
+}
+func actionFind(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 find [--regex] [--type entity|dot] <pattern>")
 		os.Exit(1)
 	}
-	isShort := c.Bool("short")
-	var key []byte
-	if !isShort {
-		key = []byte(c.String("long"))
-		if len(key) > 32 {
-			fmt.Println("Alias key cannot be longer than 32 bytes")
-			os.Exit(1)
-		}
+	typ := c.String("type")
+	if typ != "" && typ != "entity" && typ != "dot" {
+		fmt.Println("--type must be entity or dot")
+		os.Exit(1)
 	}
-	dchan := make(chan string, 1)
-	go func() {
-		if isShort {
-			hexres, err := cl.CreateShortAlias(0, binval)
-			if err != nil {
-				dchan <- "Error creating alias: " + err.Error()
-			} else {
-				dchan <- fmt.Sprintf("Short alias created and confirmed: @%s>\n", hexres)
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	res, err := ac.searchRegistry(c.Args()[0], c.Bool("regex"), typ)
+	if err != nil {
+		fmt.Println("Search failed:", err)
+		os.Exit(1)
+	}
+	shown := 0
+	for _, m := range res {
+		if c.Bool("valid") && m.State != "Valid" {
+			continue
+		}
+		shown++
+		state := m.State
+		if state != "Valid" {
+			state = ansi.ColorCode("red+b") + state + ansi.ColorCode("reset")
+		}
+		switch ro := m.RO.(type) {
+		case *objects.Entity:
+			fmt.Printf("Entity %s [%s]\n", crypto.FmtKey(ro.GetVK()), state)
+			if ro.GetContact() != "" {
+				fmt.Println("  Contact: " + ro.GetContact())
 			}
-		} else {
-			err := cl.CreateLongAlias(0, key, binval)
-			if err != nil {
-				dchan <- "Error creating alias: " + err.Error()
-			} else {
-				dchan <- "Alias record updated and confirmed"
+			if ro.GetComment() != "" {
+				fmt.Println("  Comment: " + ro.GetComment())
+			}
+		case *objects.DOT:
+			fmt.Printf("DOT %s [%s]\n", crypto.FmtHash(ro.GetHash()), state)
+			fmt.Printf("  %s -> %s\n", crypto.FmtKey(ro.GetGiverVK()), crypto.FmtKey(ro.GetReceiverVK()))
+			if ro.IsAccess() {
+				fmt.Printf("  %s on %s/%s\n", ro.GetPermString(), crypto.FmtKey(ro.GetAccessURIMVK()), ro.GetAccessURISuffix())
+			}
+			if ro.GetContact() != "" {
+				fmt.Println("  Contact: " + ro.GetContact())
+			}
+			if ro.GetComment() != "" {
+				fmt.Println("  Comment: " + ro.GetComment())
 			}
 		}
-	}()
-	doChainOp(cl, dchan)
+	}
+	if shown == 0 {
+		fmt.Println("No matches")
+	}
 	return nil
 }
+//checkURIOrExit exits, showing where the problem is, if uri is not a valid
+//namespace/suffix URI
+func checkURIOrExit(uri string) {
+	err := util.ValidateURI(uri)
+	if err == nil {
+		return
+	}
+	fmt.Println(err)
+	if ue, ok := err.(*util.URIError); ok {
+		fmt.Println(ue.Pointer())
+	}
+	os.Exit(1)
+}
+
 func actionMkDOT(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	checkURIOrExit(c.String("uri"))
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	if !c.Bool("nopublish") {
 		if c.String("bankroll") == "" {
 			fmt.Println("Need bankroll to publish (or use --nopublish)")
@@ -636,14 +1358,19 @@ func actionMkDOT(c *cli.Context) error {
 		}
 	}
 
-	cl.SetEntityFileOrExit(c.String("from"))
+	from := getAvailableEntity(c, c.String("from"))
+	if from == nil {
+		fmt.Println("Could not load the from entity")
+		os.Exit(1)
+	}
+	ac.setEntityOrExit(from.GetSigningBlob())
 	dur, err := util.ParseDuration(c.String("expiry"))
 	if err != nil {
 		fmt.Println("Could not parse expiry:", c.String("expiry"))
 		os.Exit(1)
 	}
 
-	toVK, toOk := getEntityParamVK(cl, c, c.String("to"))
+	toVK, toOk := getEntityParamVK(ac, c, c.String("to"))
 	if !toOk {
 		fmt.Println("Could not parse 'to' parameter")
 		os.Exit(1)
@@ -652,29 +1379,39 @@ func actionMkDOT(c *cli.Context) error {
 	revokers := make([]string, len(c.StringSlice("revoker")))
 	for idx, sr := range c.StringSlice("revoker") {
 		var ok bool
-		revokers[idx], ok = getEntityParamVK(cl, c, sr)
+		revokers[idx], ok = getEntityParamVK(ac, c, sr)
 		if !ok {
 			fmt.Println("Could not parse revoker parameter")
 			os.Exit(1)
 		}
 	}
 
-	_, blob, err := cl.CreateDOT(&bw2bind.CreateDOTParams{
-		IsPermission:      false,
-		To:                toVK,
-		TTL:               uint8(c.Int("ttl")),
-		ExpiryDelta:       dur,
-		Contact:           c.String("contact"),
-		Comment:           c.String("comment"),
-		Revokers:          revokers,
-		OmitCreationDate:  c.Bool("omitcreationdate"),
-		URI:               c.String("uri"),
-		AccessPermissions: c.String("permissions"),
+	if c.String("no-delegate") != "" {
+		fmt.Println("Routers from before delegation flags will not enforce --no-delegate")
+	}
+	blob, err := ac.makeDOT(&mkdotParams{
+		uri:          c.String("uri"),
+		to:           toVK,
+		ttl:          c.Int("ttl"),
+		expiry:       dur,
+		contact:      c.String("contact"),
+		comment:      c.String("comment"),
+		revokers:     revokers,
+		omitCreation: c.Bool("omitcreationdate"),
+		perms:        c.String("permissions"),
+		noDelegate:   c.String("no-delegate"),
 	})
 	if err != nil {
 		fmt.Println("could not create dot:", err.Error())
 		os.Exit(1)
 	}
+	saveAndPublishDOT(blob, ac, c)
+	return nil
+}
+
+//saveAndPublishDOT writes a new access DOT to --outfile and publishes it
+//unless --nopublish is given
+func saveAndPublishDOT(blob []byte, ac *agentConn, c *cli.Context) {
 	doti, err := objects.NewDOT(objects.ROAccessDOT, blob)
 	dot, ok := doti.(*objects.DOT)
 	if err != nil || !ok {
@@ -699,14 +1436,62 @@ func actionMkDOT(c *cli.Context) error {
 	fmt.Println("Wrote dot to file: ", fname)
 
 	if !c.Bool("nopublish") {
-		pubObj(dot, cl, c)
+		pubObj(dot, ac, c)
+	}
+}
+
+func actionMkPublic(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 mkpublic -f entity <uri>")
+		os.Exit(1)
+	}
+	uri := c.Args()[0]
+	parts := strings.SplitN(uri, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		fmt.Println("URI should be namespace/suffix")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	if !c.Bool("nopublish") {
+		if c.String("bankroll") == "" {
+			fmt.Println("Need bankroll to publish (or use --nopublish)")
+			os.Exit(1)
+		}
 	}
+	from := getAvailableEntity(c, c.String("from"))
+	if from == nil {
+		fmt.Println("Could not load the from entity")
+		os.Exit(1)
+	}
+	ac.setEntityOrExit(from.GetSigningBlob())
+	dur, err := util.ParseDuration(c.String("expiry"))
+	if err != nil {
+		fmt.Println("Could not parse expiry:", c.String("expiry"))
+		os.Exit(1)
+	}
+	perms := api.PublicPermissions(parts[1], c.Bool("tap"))
+	blob, err := ac.makeDOT(&mkdotParams{
+		uri:     uri,
+		to:      util.EverybodyVK,
+		expiry:  dur,
+		contact: c.String("contact"),
+		comment: c.String("comment"),
+		perms:   perms,
+	})
+	if err != nil {
+		fmt.Println("could not create dot:", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Everybody may now use %s on %s\n", perms, uri)
+	saveAndPublishDOT(blob, ac, c)
 	return nil
 }
 func actionRevoke(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	if !c.Bool("nopublish") {
 		if c.String("bankroll") == "" {
 			fmt.Println("Need bankroll to publish (or use --nopublish)")
@@ -722,7 +1507,7 @@ func actionRevoke(c *cli.Context) error {
 		fmt.Println("Could not load the 'from' entity")
 		os.Exit(1)
 	}
-	cl.SetEntity(e.GetSigningBlob())
+	ac.setEntityOrExit(e.GetSigningBlob())
 	if c.String("vk") != "" && c.String("dot") != "" {
 		fmt.Println("You can only specify --vk or --dot, not both")
 		os.Exit(1)
@@ -735,19 +1520,19 @@ func actionRevoke(c *cli.Context) error {
 	var blob []byte
 	var err error
 	if c.String("vk") != "" {
-		target, ok := getEntityParamVK(cl, c, c.String("vk"))
+		target, ok := getEntityParamVK(ac, c, c.String("vk"))
 		if !ok {
 			fmt.Println("Could not decode --vk param")
 			os.Exit(1)
 		}
-		hash, blob, err = cl.RevokeEntity(target, c.String("comment"))
+		hash, blob, err = ac.makeRevocation("entity", target, c.String("comment"))
 	} else {
-		target, ok := getDotParamHash(cl, c, c.String("dot"))
+		target, ok := getDotParamHash(ac, c, c.String("dot"))
 		if !ok {
 			fmt.Println("Could not decode --dot param")
 			os.Exit(1)
 		}
-		hash, blob, err = cl.RevokeDOT(target, c.String("comment"))
+		hash, blob, err = ac.makeRevocation("dot", target, c.String("comment"))
 	}
 	if err != nil {
 		fmt.Println("Revocation failed: ", err)
@@ -775,20 +1560,171 @@ func actionRevoke(c *cli.Context) error {
 		os.Exit(1)
 	}
 	if !c.Bool("nopublish") {
-		pubObj(rvk, cl, c)
+		pubObj(rvk, ac, c)
+	}
+	return nil
+}
+//rotate-entity -e old [-g granter]...
+//Has the agent replace the entity, then saves the new entity (and, with
+//--nopublish, the objects to publish) and prints the report
+func actionRotateEntity(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	if !c.Bool("nopublish") && c.String("bankroll") == "" {
+		fmt.Println("Need bankroll to publish (or use --nopublish)")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the --entity to rotate")
+		os.Exit(1)
+	}
+	p := &rotateParams{
+		old:     getAvailableEntity(c, c.String("entity")),
+		keepOld: c.Bool("keepold"),
+		noPub:   c.Bool("nopublish"),
+	}
+	if p.old == nil {
+		fmt.Println("Could not load the entity to rotate")
+		os.Exit(1)
+	}
+	for _, g := range c.StringSlice("granter") {
+		ge := getAvailableEntity(c, g)
+		if ge == nil {
+			fmt.Printf("Could not load granter '%s'\n", g)
+			os.Exit(1)
+		}
+		p.granters = append(p.granters, ge)
+	}
+	if c.IsSet("contact") {
+		v := c.String("contact")
+		p.contact = &v
+	}
+	if c.IsSet("comment") {
+		v := c.String("comment")
+		p.comment = &v
+	}
+	for _, sr := range c.StringSlice("revoker") {
+		vk, ok := getEntityParamVK(ac, c, sr)
+		if !ok {
+			fmt.Println("Could not parse revoker parameter")
+			os.Exit(1)
+		}
+		p.revokers = append(p.revokers, vk)
+	}
+	if c.String("expiry") != "" {
+		dur, err := util.ParseDuration(c.String("expiry"))
+		if err != nil {
+			fmt.Println("Could not parse expiry:", c.String("expiry"))
+			os.Exit(1)
+		}
+		p.expiry = dur.String()
+	}
+
+	if !p.noPub {
+		ac.setEntityOrExit(getBankroll(c))
+	}
+	dmsg := make(chan string, 1)
+	var rot *rotation
+	go func() {
+		var err error
+		rot, err = ac.rotateEntity(p)
+		if err != nil {
+			dmsg <- "Rotation failed: " + chainErrString(err)
+		} else {
+			dmsg <- "Rotation finished"
+		}
+	}()
+	if p.noPub {
+		fmt.Println(<-dmsg)
+	} else {
+		doChainOp(ac, dmsg)
+	}
+	if rot == nil {
+		os.Exit(1)
+	}
+	writeEntityKeyFile(rot.entity, c.String("outfile"))
+	if p.noPub {
+		for _, d := range rot.dots {
+			writeROFile("."+crypto.FmtHash(d.GetHash())+".dot", objects.ROAccessDOT, d.GetContent())
+		}
+		if rot.rvk != nil {
+			writeROFile("."+crypto.FmtHash(rot.rvk.GetHash())+".rvk", objects.RORevocation, rot.rvk.GetContent())
+		}
+	}
+
+	fmt.Println("Old VK:", rot.OldVK)
+	fmt.Println("New VK:", rot.NewVK)
+	for _, d := range rot.DOTs {
+		how := "granted by the old entity"
+		if d.Held {
+			how = "held by the old entity"
+		}
+		if d.New != "" {
+			fmt.Printf("  DOT %s (%s) -> %s\n", d.Old, how, d.New)
+		}
+		if d.Error != "" {
+			fmt.Printf("  DOT %s (%s): %s\n", d.Old, how, d.Error)
+		}
+	}
+	switch {
+	case p.noPub:
+		fmt.Println("Nothing was published. Publish the new entity, then the DOTs, then the revocation")
+	case rot.Revoked:
+		fmt.Println("The old entity has been revoked by", rot.Revocation)
+	case rot.Published:
+		fmt.Println("The old entity was kept")
+	}
+	if rot.Error != "" {
+		fmt.Println("Rotation incomplete:", rot.Error)
+	}
+	if fname := c.String("report"); fname != "" {
+		blob, _ := json.MarshalIndent(rot, "", "  ")
+		if err := ioutil.WriteFile(fname, blob, 0666); err != nil {
+			fmt.Println("could not write report to", fname, ":", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Wrote report to file:", fname)
+	}
+	if rot.Error != "" {
+		os.Exit(1)
 	}
 	return nil
 }
+
+//writeROFile saves an object in the v1 file format
+func writeROFile(fname string, ronum int, content []byte) {
+	wrapped := make([]byte, len(content)+1)
+	copy(wrapped[1:], content)
+	wrapped[0] = byte(ronum)
+	if err := ioutil.WriteFile(fname, wrapped, 0666); err != nil {
+		fmt.Println("could not write", fname, ":", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("Wrote file:", fname)
+}
+
 func actionMkEntity(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
 	if !c.Bool("nopublish") {
 		if c.String("bankroll") == "" {
 			fmt.Println("Need bankroll to publish (or use --nopublish)")
 			os.Exit(1)
 		}
 	}
+	alias := c.String("alias")
+	if alias != "" {
+		if c.Bool("nopublish") {
+			fmt.Println("The alias can only be created if the entity is published")
+			os.Exit(1)
+		}
+		if err := api.CheckLongAliasKey(alias); err != nil {
+			fmt.Println("Bad alias:", err)
+			os.Exit(1)
+		}
+	}
 	dur, err := util.ParseDuration(c.String("expiry"))
 	if err != nil {
 		fmt.Println("Could not parse expiry:", c.String("expiry"))
@@ -797,53 +1733,79 @@ func actionMkEntity(c *cli.Context) error {
 	revokers := make([]string, len(c.StringSlice("revoker")))
 	for idx, sr := range c.StringSlice("revoker") {
 		var ok bool
-		revokers[idx], ok = getEntityParamVK(cl, c, sr)
+		revokers[idx], ok = getEntityParamVK(ac, c, sr)
 		if !ok {
 			fmt.Println("Could not parse revoker parameter")
 			os.Exit(1)
 		}
 	}
-	_, blob, err := cl.CreateEntity(&bw2bind.CreateEntityParams{
+	revokervks := make([][]byte, len(revokers))
+	for idx, r := range revokers {
+		revokervks[idx], _ = crypto.UnFmtKey(r)
+	}
+	p := &api.CreateEntityParams{
 		ExpiryDelta:      dur,
 		Contact:          c.String("contact"),
 		Comment:          c.String("comment"),
-		Revokers:         revokers,
+		Revokers:         revokervks,
 		OmitCreationDate: c.Bool("omitcreationdate"),
-	})
+		Alias:            alias,
+	}
+	path := ""
+	if c.String("mnemonic") != "" {
+		//Derived locally, so the mnemonic never leaves this process
+		path = mnemonicPath(c, c.Int("index"))
+		p.SK, p.VK = deriveKeypairOrExit(mnemonicSeed(c), path)
+	}
+	ent, err := api.CreateEntity(p)
 	if err != nil {
 		fmt.Println("Could not create entity:", err.Error())
 		os.Exit(1)
 	}
-	enti, err := objects.NewEntity(objects.ROEntityWKey, blob)
-	if err != nil {
-		panic(err)
+	if path != "" {
+		fmt.Println("Derived entity at", path)
 	}
-	ent := enti.(*objects.Entity)
 
 	fmt.Println("Entity created")
 	fmt.Println("Public VK:", crypto.FmtKey(ent.GetVK()))
 	//	fmt.Println("Private SK: ", crypto.FmtKey(ent.GetSK()))
 
-	fname := c.String("outfile")
-	if len(fname) == 0 {
-		fname = "." + crypto.FmtKey(ent.GetVK()) + ".key"
-	}
-	wrapped := make([]byte, len(ent.GetSigningBlob())+1)
-	copy(wrapped[1:], ent.GetSigningBlob())
-	wrapped[0] = objects.ROEntityWKey
-	err = ioutil.WriteFile(fname, wrapped, 0600)
-	if err != nil {
-		fmt.Println("could not write entity to", fname, ":", err.Error())
-		os.Exit(1)
-	}
-	fmt.Println("wrote key to file", fname)
+	writeEntityKeyFile(ent, c.String("outfile"))
 	if !c.Bool("nopublish") {
-		pubObj(ent, cl, c)
+		if alias == "" {
+			pubObj(ent, ac, c)
+		} else {
+			ac.setEntityOrExit(getBankroll(c))
+			publishEntityWithAlias(ac, ent, alias)
+		}
 	}
 	return nil
 }
 
-func inspectInterface(ro objects.RoutingObject, cl *bw2bind.BW2Client) {
+//publishEntityWithAlias publishes the entity and then points the long alias
+//at its VK, so that the alias is never made for an entity that is not in
+//the registry
+func publishEntityWithAlias(ac *agentConn, ent *objects.Entity, alias string) {
+	dchan := make(chan string, 1)
+	go func() {
+		res, err := ac.publish(ent)
+		if err != nil {
+			dchan <- "Failed to publish entity, the alias was not created: " + chainErrString(err)
+			return
+		}
+		fmt.Printf("\rSuccessfully published Entity %s\n", res)
+		vk := crypto.FmtKey(ent.GetVK())
+		if err := ac.createLongAlias(0, []byte(alias), ent.GetVK()); err != nil {
+			dchan <- fmt.Sprintf("Error creating alias: %s\nThe entity is published, retry with bw2 mkalias --long %s --b64 %s",
+				chainErrString(err), alias, vk)
+			return
+		}
+		dchan <- fmt.Sprintf("Alias %s -> %s created and confirmed", alias, vk)
+	}()
+	doChainOp(ac, dchan)
+}
+
+func inspectInterface(ro objects.RoutingObject, ac *agentConn) {
 	switch ro.GetRONum() {
 	case objects.ROEntity:
 		e := ro.(*objects.Entity)
@@ -852,39 +1814,46 @@ func inspectInterface(ro objects.RoutingObject, cl *bw2bind.BW2Client) {
 		} else {
 			fmt.Println("\u2533 Type: Entity key file")
 		}
-		doentityfile(ro.(*objects.Entity), cl)
+		doentityfile(ro.(*objects.Entity), ac)
 	case objects.ROAccessDOT:
 		fmt.Println("\u2533 Type: Access DOT")
-		dodotfile(ro.(*objects.DOT), cl)
+		dodotfile(ro.(*objects.DOT), ac)
 	case objects.ROPermissionDOT:
 		fmt.Println("\u2533 Type: Application permission DOT")
-		dodotfile(ro.(*objects.DOT), cl)
+		dodotfile(ro.(*objects.DOT), ac)
 	case objects.ROPermissionDChain:
 		fmt.Println("\u2533 Type: Permission DCHain")
-		dochainfile(ro.(*objects.DChain), cl, true)
+		dochainfile(ro.(*objects.DChain), ac, true)
 	case objects.ROPermissionDChainHash:
 		fmt.Println("\u2533 Type: Permission DChain hash")
-		dochainfile(ro.(*objects.DChain), cl, true)
+		dochainfile(ro.(*objects.DChain), ac, true)
 	case objects.ROAccessDChain:
 		fmt.Println("\u250f Type: Access DChain")
-		dochainfile(ro.(*objects.DChain), cl, true)
+		dochainfile(ro.(*objects.DChain), ac, true)
 	case objects.ROAccessDChainHash:
 		fmt.Println("\u2533 Type: Access DChain hash")
-		dochainfile(ro.(*objects.DChain), cl, true)
+		dochainfile(ro.(*objects.DChain), ac, true)
 	case objects.RORevocation:
 		fmt.Println("\u2533 Type: Revocation")
-		dorevocationfile(ro.(*objects.Revocation), cl)
+		dorevocationfile(ro.(*objects.Revocation), ac)
 	default:
 		fmt.Println("ERR: not a Routing Object file")
 	}
 	resetTerm()
 }
 
-func pubObj(topub objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Context) {
-	pubObjs([]objects.RoutingObject{topub}, cl, c)
+func pubObj(topub objects.RoutingObject, ac *agentConn, c *cli.Context) {
+	pubObjs([]objects.RoutingObject{topub}, ac, c)
 }
-func pubObjs(topubz []objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Context) {
-	cl.SetEntity(getBankroll(c, cl))
+
+//pubObjs publishes the objects as the bankroll entity
+func pubObjs(topubz []objects.RoutingObject, ac *agentConn, c *cli.Context) {
+	ac.setEntityOrExit(getBankroll(c))
+	pubObjsWith(ac, topubz)
+}
+
+//pubObjsWith is pubObjs on an agent connection that has the bankroll set
+func pubObjsWith(ac *agentConn, topubz []objects.RoutingObject) {
 	dmsg := make(chan string, 1)
 	wg := sync.WaitGroup{}
 	wg.Add(len(topubz))
@@ -902,34 +1871,30 @@ func pubObjs(topubz []objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Conte
 	for _, vv := range topubz {
 		go func(topub objects.RoutingObject) {
 			var desc string
-			var err error
-			switch t := topub.(type) {
+			res, err := ac.publish(topub)
+			switch topub.(type) {
 			case *objects.Entity:
-				desc, err = cl.PublishEntity(t.GetContent())
-				desc = "Entity " + desc
+				desc = "Entity "
 			case *objects.DOT:
-				desc, err = cl.PublishDOT(t.GetContent())
-				desc = "DOT " + desc
+				desc = "DOT "
 			case *objects.DChain:
-				desc, err = cl.PublishChain(t.GetContent())
-				desc = "DChain " + desc
+				desc = "DChain "
 			case *objects.Revocation:
-				desc, err = cl.PublishRevocation(0, t.GetContent())
-				desc = "Revocation " + desc
+				desc = "Revocation "
 			}
 			if err == nil {
-				fmt.Printf("\rSuccessfully published %s\n", desc)
+				fmt.Printf("\rSuccessfully published %s%s\n", desc, res)
 			} else {
 				problem = true
-				fmt.Printf("\rFailed to publish object: %s\n", err.Error())
+				fmt.Printf("\rFailed to publish object: %s\n", chainErrString(err))
 			}
 			wg.Done()
 		}(vv)
 	}
-	doChainOp(cl, dmsg)
+	doChainOp(ac, dmsg)
 }
-func doChainOp(cl *bw2bind.BW2Client, done chan string) {
-	cip, err := cl.GetBCInteractionParams()
+func doChainOp(ac *agentConn, done chan string) {
+	cip, err := ac.bcip()
 	if err != nil {
 		fmt.Printf("Could not get BCIP: %s\n", err)
 		os.Exit(1)
@@ -945,9 +1910,12 @@ func doChainOp(cl *bw2bind.BW2Client, done chan string) {
 	}
 	sblock := cip.CurrentBlock
 	fmt.Printf("Current BCIP set to %d confirmation blocks or %d block timeout\n", cip.Confirmations, cip.Timeout)
+	if ac.params.confirmations != "" || ac.params.timeout != "" || ac.params.maxgasprice != "" || ac.params.attempts != "" {
+		fmt.Printf("Overridden for this operation: %s\n", ac.params)
+	}
 	printChain := func() {
 		fmt.Print("\rconfirming:")
-		ncip, err := cl.GetBCInteractionParams()
+		ncip, err := ac.bcip()
 		if err != nil {
 			fmt.Printf("Could not get BCIP: %s\n", err)
 			os.Exit(1)
@@ -976,8 +1944,10 @@ type qrdata struct {
 
 func actionInspect(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	if !c.Bool("json") {
+		ac.statLine()
+	}
 	pub := c.Bool("publish")
 	qr := c.Bool("qrcode")
 	if pub {
@@ -988,24 +1958,33 @@ func actionInspect(c *cli.Context) error {
 	}
 	topub := make([]objects.RoutingObject, 0)
 	toqrg := make([]qrdata, 0)
-	//TODO list:
-	//if param is a file
-	//	- recursively inspect every aspect of the object
-	//if param is a 44 char b64 encoding, look it up as an object in the registry
-	//with resx
-	//if param contains a "@" expand it as embedded alias
-	//expand it as a long alias
+	jsonOut := c.Bool("json")
+	insp := newInspector(ac)
+	nodes := []*inspectNode{}
+	//Files and registry objects are expanded recursively, resolving every
+	//DOT, entity and revoker they refer to. Otherwise the param is tried as
+	//an address, an embedded alias and finally a long alias
 	for _, par := range c.Args() {
 		//Try it as a file
 		contents, err := ioutil.ReadFile(par)
 		if err == nil {
 			//We are a file
-			roi, err := objects.LoadRoutingObject(int(contents[0]), contents[1:])
+			var roi objects.RoutingObject
+			kf, err := decodeKeyFile(contents)
+			if err == nil {
+				roi, err = kf.RoutingObject()
+			}
 			if err != nil {
-				fmt.Printf("'%s' exists as a file, but cannot be decoded: %s\n", par, err.Error())
+				nodes = append(nodes, paramNode("file", par, "", "cannot be decoded: "+err.Error()))
+				if !jsonOut {
+					fmt.Printf("'%s' exists as a file, but cannot be decoded: %s\n", par, err.Error())
+				}
 				goto nextparam
 			}
-			inspectInterface(roi, cl)
+			nodes = append(nodes, insp.inspect(roi))
+			if !jsonOut {
+				inspectInterface(roi, ac)
+			}
 			if pub {
 				topub = append(topub, roi)
 			}
@@ -1016,14 +1995,17 @@ func actionInspect(c *cli.Context) error {
 		}
 		//Look it up in the registry
 		{
-			roi, _, _ := cl.ResolveRegistry(par)
+			roi, _, _ := ac.resolveRegistry(par)
 			//if status == bw2bind.StateError {
 			//	fmt.Printf("'%s' does not exist as a file, trying the registry failed: %s\n", par, err.Error())
 			//	goto nextparam
 			//}
 			if roi != nil {
 				//fmt.Println("Match in registry:")
-				inspectInterface(roi, cl)
+				nodes = append(nodes, insp.inspect(roi))
+				if !jsonOut {
+					inspectInterface(roi, ac)
+				}
 				if qr {
 					toqrg = append(toqrg, qrdata{ro: roi, name: par})
 				}
@@ -1038,14 +2020,19 @@ func actionInspect(c *cli.Context) error {
 			}
 			hv, err := hex.DecodeString(hpar)
 			if err == nil && len(hv) == 20 {
-				bal, err := cl.AddressBalance(hpar)
+				bal, err := ac.addressBalance(hpar)
 				if err != nil {
-					fmt.Println("Could not get balance:", err.Error())
+					if !jsonOut {
+						fmt.Println("Could not get balance:", err.Error())
+					}
 				} else {
-					f := big.NewFloat(0)
-					f.SetInt(bal.Int)
-					f = f.Quo(f, big.NewFloat(1000000000000000000.0))
-					fmt.Printf("acc: 0x%040x balance %.6f \u039e\n", hv[:20], f)
+					nodes = append(nodes, paramNode("account", fmt.Sprintf("0x%040x", hv[:20]), bal.Text(10), ""))
+					if !jsonOut {
+						f := big.NewFloat(0)
+						f.SetInt(bal)
+						f = f.Quo(f, big.NewFloat(1000000000000000000.0))
+						fmt.Printf("acc: 0x%040x balance %.6f \u039e\n", hv[:20], f)
+					}
 					goto nextparam
 				}
 			}
@@ -1054,10 +2041,17 @@ func actionInspect(c *cli.Context) error {
 
 		//We do not actually error out if it is not in the registry. Try resolve
 		//it as some kind of alias
-		if strings.Contains(par, "@") {
-			res, err := cl.ResolveEmbeddedAlias(par)
+		if strings.Contains(par, "@") && !aliasRefRegex.MatchString(par) {
+			res, err := ac.resolveEmbeddedAlias(par)
 			if err != nil {
-				fmt.Printf("'%s' seemed like an embedded alias, but failed to resolve: %s\n", par, err.Error())
+				nodes = append(nodes, paramNode("alias", par, "", "failed to resolve: "+err.Error()))
+				if !jsonOut {
+					fmt.Printf("'%s' seemed like an embedded alias, but failed to resolve: %s\n", par, err.Error())
+				}
+				goto nextparam
+			}
+			nodes = append(nodes, paramNode("alias", par, res, ""))
+			if jsonOut {
 				goto nextparam
 			}
 			dstr := res
@@ -1067,20 +2061,51 @@ func actionInspect(c *cli.Context) error {
 			fmt.Printf("Embedded alias '%s' resolves to:\nhex: %032x\nstr: %s\nb64: %s\n", par, []byte(res), dstr, crypto.FmtHash([]byte(res)))
 			goto nextparam
 		} else {
-			data, zero, err := cl.ResolveLongAlias(par)
-			if err != nil {
-				fmt.Printf("'%s' is not an existing file, published RO or long alias: %s\n", par, err.Error())
-				goto nextparam
+			var data []byte
+			var zero bool
+			var err error
+			kind := "Alias"
+			if m := aliasRefRegex.FindStringSubmatch(par); m != nil && m[2] == "]" {
+				kind = "Short alias"
+				data, err = ac.resolveShortAlias(m[1])
+				if err != nil {
+					nodes = append(nodes, paramNode("alias", par, "", "failed to resolve: "+err.Error()))
+					if !jsonOut {
+						fmt.Printf("Could not resolve short alias '%s': %s\n", par, err.Error())
+					}
+					goto nextparam
+				}
+			} else {
+				if m != nil {
+					kind = "Long alias"
+					data, zero, err = ac.resolveLongAlias(m[1])
+				} else {
+					data, zero, err = ac.resolveLongAlias(par)
+				}
+				if err != nil {
+					nodes = append(nodes, paramNode("unknown", par, "", "not a file, published RO or alias: "+err.Error()))
+					if !jsonOut {
+						fmt.Printf("'%s' is not an existing file, published RO or long alias: %s\n", par, err.Error())
+					}
+					goto nextparam
+				}
+				if zero {
+					nodes = append(nodes, paramNode("unknown", par, "", "not a file, published RO or alias"))
+					if !jsonOut {
+						fmt.Printf("Could not resolve '%s' as file or alias\n", par)
+					}
+					goto nextparam
+				}
 			}
-			if zero {
-				fmt.Printf("Could not resolve '%s' as file or alias\n", par)
+			nodes = append(nodes, paramNode("alias", par, crypto.FmtHash(data), ""))
+			if jsonOut {
 				goto nextparam
 			}
 			dstr := string(data)
 			if !utf8.Valid(data) {
 				dstr = "invalid (not UTF8)"
 			}
-			fmt.Printf("Alias '%s' resolves to:\nhex: %032x\nstr: %s\nb64: %s\n", par, data, dstr, crypto.FmtHash(data))
+			fmt.Printf("%s '%s' resolves to:\nhex: %032x\nstr: %s\nb64: %s\n", kind, par, data, dstr, crypto.FmtHash(data))
 			nz := false
 			for i := 20; i < 32; i++ {
 				if []byte(data)[i] != 0 {
@@ -1089,12 +2114,12 @@ func actionInspect(c *cli.Context) error {
 				}
 			}
 			if !nz {
-				bal, err := cl.AddressBalance(fmt.Sprintf("%x", data[:20]))
+				bal, err := ac.addressBalance(fmt.Sprintf("%x", data[:20]))
 				if err != nil {
 					fmt.Println("Could not get balance:", err.Error())
 				} else {
 					f := big.NewFloat(0)
-					f.SetInt(bal.Int)
+					f.SetInt(bal)
 					f = f.Quo(f, big.NewFloat(1000000000000000000.0))
 					fmt.Printf("acc: 0x%040x balance %.6f \u039e\n", data[:20], f)
 				}
@@ -1106,9 +2131,23 @@ func actionInspect(c *cli.Context) error {
 
 	nextparam:
 	}
-	//We need to re-set our entity because pprint modifies it to get balances
+	invalid := countInvalid(nodes)
+	if jsonOut {
+		out, err := json.MarshalIndent(struct {
+			Valid   bool           `json:"valid"`
+			Objects []*inspectNode `json:"objects"`
+		}{invalid == 0, nodes}, "", "  ")
+		if err != nil {
+			fmt.Println("Could not encode JSON:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	} else if len(nodes) != 0 {
+		printInspectSummary(nodes)
+	}
+	//pubObjs re-sets our entity, which pprint modifies to get balances
 	if pub {
-		pubObjs(topub, cl, c)
+		pubObjs(topub, ac, c)
 	}
 	if qr {
 		// Generate a QR code for each entity with an available signing key
@@ -1129,20 +2168,32 @@ func actionInspect(c *cli.Context) error {
 			}
 		}
 	}
+	if invalid != 0 {
+		os.Exit(1)
+	}
 	return nil
 }
 func actionBuildChain(c *cli.Context) error {
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	var maxCost *big.Int
 	if c.Bool("publish") {
 		if c.String("bankroll") == "" {
 			fmt.Println("Need bankroll to publish")
 			os.Exit(1)
 		}
+		if mc := c.String("maxcost"); mc != "" {
+			ether, _, err := big.ParseFloat(mc, 10, 256, big.ToNearestEven)
+			if err != nil || ether.Sign() < 0 {
+				fmt.Println("--maxcost must be a number of ether")
+				os.Exit(1)
+			}
+			maxCost, _ = new(big.Float).Mul(ether, big.NewFloat(1e18)).Int(nil)
+		}
 	}
 
-	toVK, toOk := getEntityParamVK(cl, c, c.String("to"))
+	toVK, toOk := getEntityParamVK(ac, c, c.String("to"))
 	if !toOk {
 		fmt.Println("Could not parse 'to' parameter")
 		os.Exit(1)
@@ -1162,48 +2213,77 @@ func actionBuildChain(c *cli.Context) error {
 
 	verbose := c.Bool("verbose")
 
-	ch, err := cl.BuildChain(uri, perms, toVK)
+	chains, err := ac.buildChain(uri, perms, toVK)
 	if err != nil {
 		fmt.Println("DOT Chain build failed: ", err)
 		os.Exit(1)
 	}
-	got := false
 	topub := []objects.RoutingObject{}
-	for res := range ch {
-		got = true
-		roi, err := objects.LoadRoutingObject(objects.ROAccessDChain, res.Content)
-		if err != nil {
-			panic(err)
-		}
-		dc := roi.(*objects.DChain)
-		topub = append(topub, roi)
-		dochainfile(dc, cl, verbose)
+	for _, dc := range chains {
+		topub = append(topub, dc)
+		dochainfile(dc, ac, verbose)
 		resetTerm()
 	}
-	if !got {
+	if len(topub) == 0 {
 		fmt.Println("No chains found")
 		os.Exit(1)
 	}
 	if c.Bool("publish") {
-		pubObjs(topub, cl, c)
+		ac.setEntityOrExit(getBankroll(c))
+		topub = estimateChainsOrExit(ac, topub, maxCost)
+		if len(topub) == 0 {
+			fmt.Println("All chains are in the registry already")
+			return nil
+		}
+		pubObjsWith(ac, topub)
 	}
 	return nil
 }
+
+//estimateChainsOrExit prints what publishing each chain would cost and
+//returns those not in the registry already. It exits if together they
+//could cost more than maxCost wei
+func estimateChainsOrExit(ac *agentConn, chains []objects.RoutingObject, maxCost *big.Int) []objects.RoutingObject {
+	rv := []objects.RoutingObject{}
+	total := new(big.Int)
+	for _, ro := range chains {
+		est, err := ac.estimateChain(ro.(*objects.DChain), 0)
+		if err != nil {
+			fmt.Printf("Could not estimate the cost of publishing: %s\n", chainErrString(err))
+			os.Exit(1)
+		}
+		if est.Existing {
+			fmt.Printf("DChain %s is in the registry already\n", est.Hash)
+			continue
+		}
+		fmt.Printf("DChain %s: up to %s \u039e (%s gas at %s wei)\n", est.Hash, weiToEther(est.Cost), est.Gas, est.GasPrice)
+		total.Add(total, est.Cost)
+		rv = append(rv, ro)
+	}
+	if len(rv) > 1 {
+		fmt.Printf("Publishing %d chains could cost up to %s \u039e\n", len(rv), weiToEther(total))
+	}
+	if maxCost != nil && total.Cmp(maxCost) > 0 {
+		fmt.Printf("Not publishing: that is more than --maxcost %s \u039e\n", weiToEther(maxCost))
+		os.Exit(1)
+	}
+	return rv
+}
 func actionXfer(c *cli.Context) error {
 	if c.String("bankroll") == "" {
 		fmt.Println("Need bankroll to transfer from")
 		os.Exit(1)
 	}
 	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
-	cl.SetEntity(getBankroll(c, cl))
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	ac.setEntityOrExit(getBankroll(c))
 	eth := c.String("ether")
 	milli := c.String("milli")
 	micro := c.String("micro")
 	total := big.NewFloat(0)
 	total = total.SetPrec(256)
-	toacc := getAccountParam(cl, c, c.String("to"))
+	toacc := getAccountParam(ac, c, c.String("to"))
 	if eth != "" {
 		incr, _, err := big.ParseFloat(eth, 10, 256, big.ToNearestEven)
 		if err != nil {
@@ -1241,14 +2321,14 @@ func actionXfer(c *cli.Context) error {
 	dchan := make(chan string, 1)
 	fmt.Printf("Transferring %.6f \u039ether\n  to: %s\n wei: %d\n", asEth, toacc, wei)
 	go func() {
-		err := cl.TransferWei(c.Int("accountnum"), toacc, wei)
+		res, err := ac.transferWei(c.Int("accountnum"), toacc, wei)
 		if err == nil {
-			dchan <- "Transfer completed successfully"
+			dchan <- "Transfer completed successfully\n  " + res.String()
 		} else {
-			dchan <- fmt.Sprintf("Transfer failed: %s", err)
+			dchan <- "Transfer failed: " + chainErrString(err)
 		}
 	}()
-	doChainOp(cl, dchan)
+	doChainOp(ac, dchan)
 	return nil
 }
 func actionStatus(c *cli.Context) error {
@@ -1300,10 +2380,11 @@ func actionSubscribe(c *cli.Context) error {
 	}
 }
 
-func actionQuery(c *cli.Context) error {
-	bw2bind.SilenceLog()
-	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
-	cl.StatLine()
+func actionDelete(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		fmt.Println("Usage: bw2 del -e entity <uri>...")
+		os.Exit(1)
+	}
 	if c.String("entity") == "" {
 		fmt.Println("You need to specify an entity to be (-e)")
 		os.Exit(1)
@@ -1313,24 +2394,20 @@ func actionQuery(c *cli.Context) error {
 		fmt.Println("Could not load entity")
 		os.Exit(1)
 	}
-	cl.SetEntity(e.GetSigningBlob())
-	wg := sync.WaitGroup{}
-	wg.Add(len(c.Args()))
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	failed := false
 	for _, uri := range c.Args() {
-		ch := cl.QueryOrExit(&bw2bind.QueryParams{
-			URI:       uri,
-			AutoChain: true,
-		})
-		go func() {
-			for m := range ch {
-				if m != nil {
-					m.Dump()
-				}
-			}
-			wg.Done()
-		}()
+		if err := ac.deleteURI(uri); err != nil {
+			fmt.Printf("Could not delete %s: %v\n", uri, err)
+			failed = true
+			continue
+		}
+		fmt.Println("Deleted", uri)
+	}
+	if failed {
+		os.Exit(1)
 	}
-	wg.Wait()
 	return nil
 }
 
@@ -1351,6 +2428,16 @@ func actionMset(c *cli.Context) error {
 	uri := c.String("uri")
 	key := c.String("key")
 	val := c.String("val")
+	args := c.Args()
+	if uri == "" && len(args) > 0 {
+		uri, args = args[0], args[1:]
+	}
+	if key == "" && len(args) > 0 {
+		key, args = args[0], args[1:]
+	}
+	if val == "" && len(args) > 0 {
+		val = args[0]
+	}
 	if key == "" || val == "" || uri == "" {
 		fmt.Println("You must specify the uri, key and value")
 		os.Exit(1)
@@ -1383,12 +2470,16 @@ func actionMget(c *cli.Context) error {
 	uri := c.String("uri")
 	key := c.String("key")
 	verb := c.Bool("verbose")
+	args := c.Args()
 	if uri == "" {
-		if len(c.Args()) == 0 {
+		if len(args) == 0 {
 			fmt.Println("You must specify the uri")
 			os.Exit(1)
 		}
-		uri = c.Args()[0]
+		uri, args = args[0], args[1:]
+	}
+	if key == "" && len(args) > 0 {
+		key = args[0]
 	}
 	if key == "" {
 		//All
@@ -1451,6 +2542,13 @@ func actionMdel(c *cli.Context) error {
 	cl.SetEntity(e.GetSigningBlob())
 	uri := c.String("uri")
 	key := c.String("key")
+	args := c.Args()
+	if uri == "" && len(args) > 0 {
+		uri, args = args[0], args[1:]
+	}
+	if key == "" && len(args) > 0 {
+		key = args[0]
+	}
 	if key == "" || uri == "" {
 		fmt.Println("You must specify the uri and the key")
 		os.Exit(1)
@@ -1460,7 +2558,7 @@ func actionMdel(c *cli.Context) error {
 		fmt.Println("Encountered error: ", err)
 		os.Exit(1)
 	} else {
-		fmt.Println("Set OK")
+		fmt.Println("Delete OK")
 		os.Exit(0)
 	}
 	return nil
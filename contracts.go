@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+//contracts
+func actionContracts(c *cli.Context) error {
+	ac := connectAgentOrExit(c)
+	chainid, contracts, err := ac.contracts()
+	if err != nil {
+		fmt.Println("Could not get the contracts:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Chain ID %s\n", chainid)
+	bad := false
+	for _, ct := range contracts {
+		fmt.Printf("%-9s %s\n", ct.Name, ct.Address)
+		fmt.Printf("          code hash %s\n", ct.CodeHash)
+		if ct.Err != "" {
+			fmt.Printf("          ERROR: %s\n", ct.Err)
+			bad = true
+		} else {
+			fmt.Printf("          ok\n")
+		}
+	}
+	if bad {
+		fmt.Printf("To use contracts at other addresses, add a [contracts \"%s\"] section to bw2.ini\n", chainid)
+		os.Exit(1)
+	}
+	return nil
+}
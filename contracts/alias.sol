@@ -18,9 +18,19 @@ contract Alias {
   /* The top of the range reserved for short aliases */
   uint256 public AliasMin;
 
+  /* The account that may update, transfer or delete each alias. New
+     members go after the old ones so the storage layout is unchanged */
+  mapping (uint256 => address) public Owner;
+
   /* Alias creation event */
   event AliasCreated(uint256 indexed key, bytes32 indexed value);
 
+  /* Alias management events. AliasTransferred is also raised when an
+     alias is created, so the logs say who owns what */
+  event AliasUpdated(uint256 indexed key, bytes32 indexed value);
+  event AliasTransferred(uint256 indexed key, address indexed owner);
+  event AliasDeleted(uint256 indexed key, bytes32 indexed value);
+
   function Alias() {
     LastShort = 0x100;
     LongAliasPrice = 5000000;
@@ -49,7 +59,9 @@ contract Alias {
       AliasFor[v] = k;
     }
     DB[k] = v;
+    Owner[k] = msg.sender;
     AliasCreated(k, v);
+    AliasTransferred(k, msg.sender);
   }
 
   function CreateShortAlias(bytes32 v)
@@ -63,7 +75,67 @@ contract Alias {
     if (AliasFor[v] == 0x0) {
       AliasFor[v] = LastShort;
     }
+    Owner[LastShort] = msg.sender;
     AliasCreated(LastShort, v);
+    AliasTransferred(LastShort, msg.sender);
+  }
+
+  function UpdateAlias(uint256 k, bytes32 v)
+  {
+    /* Only the owner can point an alias somewhere else */
+    if (DB[k] == 0x0 || Owner[k] != msg.sender || v == 0x0) {
+      throw;
+    }
+    if (AliasFor[DB[k]] == k) {
+      AliasFor[DB[k]] = 0x0;
+    }
+    if (AliasFor[v] == 0x0) {
+      AliasFor[v] = k;
+    }
+    DB[k] = v;
+    AliasUpdated(k, v);
+  }
+
+  function TransferAlias(uint256 k, address to)
+  {
+    if (DB[k] == 0x0 || Owner[k] != msg.sender || to == 0x0) {
+      throw;
+    }
+    Owner[k] = to;
+    AliasTransferred(k, to);
+  }
+
+  function DeleteAlias(uint256 k)
+  {
+    if (DB[k] == 0x0 || Owner[k] != msg.sender) {
+      throw;
+    }
+    bytes32 v = DB[k];
+    if (AliasFor[v] == k) {
+      AliasFor[v] = 0x0;
+    }
+    DB[k] = 0x0;
+    Owner[k] = 0x0;
+    AliasDeleted(k, v);
+  }
+
+  /* Copies an alias from the previous alias contract, which had no
+     owners. Only the admin can import, and only into free keys */
+  function ImportAlias(uint256 k, bytes32 v, address owner)
+  {
+    if (msg.sender != Admin || DB[k] != 0x0 || v == 0x0) {
+      throw;
+    }
+    if (AliasFor[v] == 0x0) {
+      AliasFor[v] = k;
+    }
+    DB[k] = v;
+    Owner[k] = owner;
+    if (k <= AliasMin && k > LastShort) {
+      LastShort = k;
+    }
+    AliasCreated(k, v);
+    AliasTransferred(k, owner);
   }
 
 }
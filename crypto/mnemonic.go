@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//EntityPathPurpose is the first (hardened) index of the derivation paths
+//BOSSWAVE uses for entities. It is arbitrary, but changing it would change
+//every entity derived from a mnemonic
+const EntityPathPurpose = 8802
+
+//hardened is added to an index in a derivation path to mark it hardened.
+//Ed25519 only supports hardened derivation, so every index is hardened
+const hardened = 0x80000000
+
+var wordIndex map[string]int
+
+func init() {
+	wordIndex = make(map[string]int, len(bip39English))
+	for i, w := range bip39English {
+		wordIndex[w] = i
+	}
+}
+
+//NewMnemonic returns a new random BIP39 mnemonic of the given strength in
+//bits, which must be a multiple of 32 between 128 (12 words) and 256 (24
+//words)
+func NewMnemonic(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", errors.New("mnemonic strength must be a multiple of 32 between 128 and 256")
+	}
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return entropyToMnemonic(entropy), nil
+}
+
+func entropyToMnemonic(entropy []byte) string {
+	csbits := uint(len(entropy) * 8 / 32)
+	sum := sha256.Sum256(entropy)
+	//The entropy followed by the checksum bits, read 11 bits at a time
+	v := new(big.Int).SetBytes(entropy)
+	v.Lsh(v, csbits)
+	v.Or(v, big.NewInt(int64(sum[0]>>(8-csbits))))
+	nwords := (len(entropy)*8 + int(csbits)) / 11
+	words := make([]string, nwords)
+	mask := big.NewInt(2047)
+	for i := nwords - 1; i >= 0; i-- {
+		words[i] = bip39English[new(big.Int).And(v, mask).Int64()]
+		v.Rsh(v, 11)
+	}
+	return strings.Join(words, " ")
+}
+
+//CheckMnemonic returns an error if the mnemonic has words that are not in
+//the English BIP39 wordlist, the wrong number of words, or a bad checksum
+func CheckMnemonic(mnemonic string) error {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return errors.New("a mnemonic has 12, 15, 18, 21 or 24 words")
+	}
+	v := new(big.Int)
+	for _, w := range words {
+		idx, ok := wordIndex[w]
+		if !ok {
+			return fmt.Errorf("%q is not a mnemonic word", w)
+		}
+		v.Lsh(v, 11)
+		v.Or(v, big.NewInt(int64(idx)))
+	}
+	csbits := uint(len(words) * 11 / 33)
+	cs := new(big.Int).And(v, big.NewInt(int64(1<<csbits-1))).Int64()
+	v.Rsh(v, csbits)
+	entropy := make([]byte, len(words)*11/33*4)
+	b := v.Bytes()
+	copy(entropy[len(entropy)-len(b):], b)
+	sum := sha256.Sum256(entropy)
+	if int64(sum[0]>>(8-csbits)) != cs {
+		return errors.New("the mnemonic checksum is wrong, check the words")
+	}
+	return nil
+}
+
+//MnemonicToSeed checks the mnemonic and returns the BIP39 seed for it and
+//the (optional) passphrase
+func MnemonicToSeed(mnemonic string, passphrase string) ([]byte, error) {
+	if err := CheckMnemonic(mnemonic); err != nil {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), 2048, 64, sha512.New), nil
+}
+
+//EntityPath returns the derivation path of the entity with the given index
+func EntityPath(index uint32) string {
+	return fmt.Sprintf("m/%d'/%d'", EntityPathPurpose, index)
+}
+
+//ParseDerivationPath parses a path like m/8802'/0'. As only hardened
+//derivation is possible, indices without a trailing ' are also taken as
+//hardened
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimSpace(path), "/")
+	if parts[0] != "m" {
+		return nil, errors.New("a derivation path starts with m")
+	}
+	rv := make([]uint32, 0, len(parts)-1)
+	for _, p := range parts[1:] {
+		p = strings.TrimRight(p, "'hH")
+		idx, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || idx >= hardened {
+			return nil, fmt.Errorf("bad index %q in derivation path", p)
+		}
+		rv = append(rv, uint32(idx))
+	}
+	return rv, nil
+}
+
+//DeriveKey returns the Ed25519 secret key at a path below the seed, using
+//SLIP-0010 derivation
+func DeriveKey(seed []byte, path string) ([]byte, error) {
+	indices, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+	key, chain := I[:32], I[32:]
+	for _, idx := range indices {
+		data := make([]byte, 37)
+		copy(data[1:], key)
+		binary.BigEndian.PutUint32(data[33:], idx+hardened)
+		mac = hmac.New(sha512.New, chain)
+		mac.Write(data)
+		I = mac.Sum(nil)
+		key, chain = I[:32], I[32:]
+	}
+	return key, nil
+}
+
+//DeriveKeypair returns the entity keypair at a path below the seed. A VK
+//whose text form starts with '-' cannot be given on the command line, so
+//like GenerateKeypair this skips such keys, by deriving the first child
+//path (path/0', path/1' ...) that has a usable VK
+func DeriveKeypair(seed []byte, path string) (sk []byte, vk []byte, err error) {
+	sk, err = DeriveKey(seed, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	vk = VKforSK(sk)
+	for i := 0; FmtKey(vk)[0] == '-'; i++ {
+		sk, err = DeriveKey(seed, fmt.Sprintf("%s/%d'", path, i))
+		if err != nil {
+			return nil, nil, err
+		}
+		vk = VKforSK(sk)
+	}
+	return sk, vk, nil
+}
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+//From the BIP39 test vectors, which all use the passphrase TREZOR
+func TestMnemonicToSeed(t *testing.T) {
+	vectors := []struct {
+		entropy  string
+		mnemonic string
+		seed     string
+	}{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank year wave sausage worth useful legal winner thank year wave sausage worth title",
+			"bc09fca1804f7e69da93c2f2028eb238c227f2e9dda30cd63699232578480a4021b146ad717fbb7e451ce9eb835f43620bf5c514db0f8add49f5d121449d3e87",
+		},
+	}
+	for _, v := range vectors {
+		entropy, _ := hex.DecodeString(v.entropy)
+		if m := entropyToMnemonic(entropy); m != v.mnemonic {
+			t.Errorf("got mnemonic %q, expected %q", m, v.mnemonic)
+		}
+		seed, err := MnemonicToSeed(v.mnemonic, "TREZOR")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(seed) != v.seed {
+			t.Errorf("wrong seed for %q", v.mnemonic)
+		}
+	}
+}
+
+func TestCheckMnemonic(t *testing.T) {
+	for _, bits := range []int{128, 160, 192, 224, 256} {
+		m, err := NewMnemonic(bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckMnemonic(m); err != nil {
+			t.Errorf("new mnemonic %q failed the check: %v", m, err)
+		}
+	}
+	bad := []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon bosswave",
+	}
+	for _, m := range bad {
+		if CheckMnemonic(m) == nil {
+			t.Errorf("bad mnemonic %q passed the check", m)
+		}
+	}
+}
+
+//From the SLIP-0010 ed25519 test vector 1
+func TestDeriveKey(t *testing.T) {
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	vectors := map[string]string{
+		"m":       "2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7",
+		"m/0'":    "68e0fe46dfb67e368c75379acec591dad19df3cde26e63b93a8e704f1dade7a3",
+		"m/0'/1'": "b1d0bad404bf35da785a64ca1ac54b2617211d2777696fbffaf208f746ae84f2",
+	}
+	for path, expected := range vectors {
+		key, err := DeriveKey(seed, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key) != expected {
+			t.Errorf("wrong key at %s", path)
+		}
+	}
+}
+
+func TestDeriveKeypair(t *testing.T) {
+	seed, _ := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	sk, vk, err := DeriveKeypair(seed, EntityPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckKeypair(sk, vk) {
+		t.Fatal("derived keypair does not sign")
+	}
+	sk2, vk2, _ := DeriveKeypair(seed, EntityPath(0))
+	if !bytes.Equal(sk, sk2) || !bytes.Equal(vk, vk2) {
+		t.Fatal("derivation is not deterministic")
+	}
+	_, vk3, _ := DeriveKeypair(seed, EntityPath(1))
+	if bytes.Equal(vk, vk3) {
+		t.Fatal("different indices gave the same entity")
+	}
+}
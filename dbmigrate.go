@@ -0,0 +1,77 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/urfave/cli"
+)
+
+func actionMigrateDB(c *cli.Context) error {
+	from := c.String("from")
+	fromBackend := c.String("from-backend")
+	if from == "" {
+		config := core.LoadConfig(c.String("conf"))
+		from = config.Router.DB
+		fromBackend = config.Router.DBBackend
+	}
+	to := c.String("to")
+	toBackend := c.String("to-backend")
+	if to == "" || toBackend == "" {
+		fmt.Println("Usage: bw2 migratedb [--from dir --from-backend name] --to dir --to-backend name")
+		fmt.Println("Backends:", strings.Join(store.Backends(), ", "))
+		os.Exit(1)
+	}
+	if fromBackend == "" {
+		fromBackend = store.DefaultBackend
+	}
+	afrom, _ := filepath.Abs(from)
+	ato, _ := filepath.Abs(to)
+	if afrom == ato {
+		fmt.Println("The new DB must be in a different directory")
+		os.Exit(1)
+	}
+	src, err := store.Open(fromBackend, from)
+	if err != nil {
+		fmt.Println("Could not open the DB to copy (is the router running?):", err)
+		os.Exit(1)
+	}
+	defer src.Close()
+	dst, err := store.Open(toBackend, to)
+	if err != nil {
+		fmt.Println("Could not open the new DB:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copying %s (%s) to %s (%s)\n", from, fromBackend, to, toBackend)
+	copied := store.Migrate(dst.DB(), src.DB(), func(n int) {
+		fmt.Printf("\r%d keys copied", n)
+	})
+	fmt.Println()
+	if err := dst.Close(); err != nil {
+		fmt.Println("Could not close the new DB:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Done, copied %d keys. Set DB=%s and DBBackend=%s in the config to use it\n", copied, to, toBackend)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+)
+
+//fund --from entity --to entity --amount ether
+func actionFund(c *cli.Context) error {
+	from := c.String("from")
+	if from == "" {
+		from = c.String("bankroll")
+	}
+	if from == "" {
+		fmt.Println("Need an entity to fund from (--from or --bankroll)")
+		os.Exit(1)
+	}
+	if c.String("to") == "" || c.String("amount") == "" {
+		fmt.Println("Usage: bw2 fund --from bankroll --to entity --amount ether")
+		os.Exit(1)
+	}
+	amount, _, err := big.ParseFloat(c.String("amount"), 10, 256, big.ToNearestEven)
+	if err != nil || amount.Sign() <= 0 {
+		fmt.Println("--amount must be a positive number of ether")
+		os.Exit(1)
+	}
+	wei, _ := new(big.Float).Mul(amount, big.NewFloat(1e18)).Int(nil)
+
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	ac.statLine()
+	fromEnt, ok := getEntityParam(ac, c, from, true)
+	if !ok {
+		fmt.Printf("Could not load entity '%s'\n", from)
+		os.Exit(1)
+	}
+	ac.setEntityOrExit(fromEnt.(*objects.Entity).GetSigningBlob())
+	toacc := getAccountParam(ac, c, c.String("to"))
+
+	accnum := c.Int("accountnum")
+	accbal, err := ac.entityBalances()
+	if err != nil {
+		fmt.Println("Could not get balances:", err)
+		os.Exit(1)
+	}
+	if accnum < 0 || accnum >= len(accbal) {
+		fmt.Printf("There is no account %d\n", accnum)
+		os.Exit(1)
+	}
+	fmt.Printf("Funding %s \u039e\n from: %s (account %d, holds %s \u039e)\n   to: %s\n", amount.Text('f', 6),
+		accbal[accnum].Addr, accnum, weiToEther(accbal[accnum].Int), toacc)
+
+	dchan := make(chan string, 1)
+	go func() {
+		res, err := ac.transferWei(accnum, toacc, wei)
+		if err != nil {
+			dchan <- "Funding failed: " + chainErrString(err)
+			return
+		}
+		msg := "Funding completed and confirmed\n  " + res.String()
+		if bal, err := ac.addressBalance(toacc); err == nil {
+			msg += fmt.Sprintf("\n%s now holds %s \u039e", toacc, weiToEther(bal))
+		}
+		dchan <- msg
+	}()
+	doChainOp(ac, dchan)
+	return nil
+}
+
+func weiToEther(wei *big.Int) string {
+	f := new(big.Float).SetInt(wei)
+	f.Quo(f, big.NewFloat(1e18))
+	return f.Text('f', 6)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+)
+
+//mkgenesis --chainid n [--fund account=ether]... [-o file]
+func actionMkGenesis(c *cli.Context) error {
+	if c.Int("chainid") <= 0 {
+		fmt.Println("You need to specify a positive --chainid")
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+
+	//The builtin contracts are copied from wherever they are on the chain
+	//the agent is on, to their default addresses
+	_, agentContracts, err := ac.contracts()
+	if err != nil {
+		fmt.Println("Could not get the contracts:", err)
+		os.Exit(1)
+	}
+	defaults := bc.DefaultContracts()
+	contracts := make(map[bc.Address][]byte)
+	for _, ct := range agentContracts {
+		code, err := ac.contractCode(ct.Address)
+		if err != nil {
+			fmt.Printf("Could not get the code of the %s contract: %v\n", ct.Name, err)
+			os.Exit(1)
+		}
+		if len(code) == 0 {
+			fmt.Printf("There is no %s contract at %s. The agent must be a full node synced with a chain that has the BOSSWAVE contracts\n", ct.Name, ct.Address)
+			os.Exit(1)
+		}
+		contracts[defaults.Addresses[ct.Name]] = code
+	}
+
+	funds := make(map[bc.Address]*big.Int)
+	for _, f := range c.StringSlice("fund") {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			fmt.Printf("Bad --fund %q, expected account=ether\n", f)
+			os.Exit(1)
+		}
+		amount, _, err := big.ParseFloat(parts[1], 10, 256, big.ToNearestEven)
+		if err != nil || amount.Sign() <= 0 {
+			fmt.Printf("Bad --fund %q, the amount must be a positive number of ether\n", f)
+			os.Exit(1)
+		}
+		wei, _ := new(big.Float).Mul(amount, big.NewFloat(1e18)).Int(nil)
+		addr := bc.HexToAddress(getAccountParam(ac, c, parts[0]))
+		if prev, ok := funds[addr]; ok {
+			wei.Add(wei, prev)
+		}
+		funds[addr] = wei
+	}
+
+	genesis, err := bc.MakePrivateGenesis(uint64(c.Int("chainid")), contracts, funds)
+	if err != nil {
+		fmt.Println("Could not make the genesis:", err)
+		os.Exit(1)
+	}
+	outfile := c.String("outfile")
+	if outfile == "" {
+		outfile = "genesis.json"
+	}
+	if err := ioutil.WriteFile(outfile, genesis, 0644); err != nil {
+		fmt.Println("Could not write the genesis:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote the genesis for chain %d to %s\n", c.Int("chainid"), outfile)
+	fmt.Println("Set [privatechain] Genesis to it in the bw2.ini of every node on the chain")
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/urfave/cli"
+)
+
+//genIface is an interface of the generated service, with the slots it
+//handles and the signals it publishes
+type genIface struct {
+	Name    string
+	Ident   string
+	Var     string
+	Slots   []genEndpoint
+	Signals []genEndpoint
+}
+
+//genEndpoint is a slot or signal, with the Go identifier for its handler
+//or publisher
+type genEndpoint struct {
+	Name  string
+	Ident string
+}
+
+type genParams struct {
+	Service   string
+	Prefix    string
+	BaseURI   string
+	Heartbeat string
+	Ifaces    []genIface
+}
+
+//goIdent turns a URI element like i.example or temp_setpoint into an
+//exported Go identifier like Example or TempSetpoint
+func goIdent(name string) string {
+	if strings.HasPrefix(name, "i.") || strings.HasPrefix(name, "s.") {
+		name = name[2:]
+	}
+	rv := ""
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		rv += string(r)
+	}
+	if rv == "" || unicode.IsDigit([]rune(rv)[0]) {
+		rv = "X" + rv
+	}
+	return rv
+}
+
+//checkElement makes sure name can be a single URI element
+func checkElement(kind, name string) error {
+	if name == "" || strings.ContainsAny(name, "/+*! \t\n\"") {
+		return fmt.Errorf("bad %s name %q", kind, name)
+	}
+	return nil
+}
+
+//gen-service --svc s.name --iface i.name [--slot x] [--signal y] [-o file]
+func actionGenService(c *cli.Context) error {
+	p := genParams{
+		Service: c.String("svc"),
+		Prefix:  c.String("prefix"),
+		BaseURI: c.String("baseuri"),
+	}
+	fail := func(err error) error {
+		fmt.Println("could not generate the service:", err)
+		os.Exit(1)
+		return nil
+	}
+	if !strings.HasPrefix(p.Service, "s.") || checkElement("service", p.Service) != nil {
+		return fail(fmt.Errorf("--svc must be a name like s.mydevice"))
+	}
+	if err := checkElement("prefix", p.Prefix); err != nil {
+		return fail(err)
+	}
+	hb := c.Duration("heartbeat")
+	if hb < time.Second || hb%time.Second != 0 {
+		return fail(fmt.Errorf("--heartbeat must be a whole number of seconds"))
+	}
+	p.Heartbeat = fmt.Sprintf("%d * time.Second", hb/time.Second)
+	endpoints := func(kind string) ([]genEndpoint, error) {
+		var rv []genEndpoint
+		seen := make(map[string]bool)
+		for _, s := range c.StringSlice(kind) {
+			if err := checkElement(kind, s); err != nil {
+				return nil, err
+			}
+			if seen[goIdent(s)] {
+				return nil, fmt.Errorf("%s %q has the same Go name as another", kind, s)
+			}
+			seen[goIdent(s)] = true
+			rv = append(rv, genEndpoint{Name: s, Ident: goIdent(s)})
+		}
+		return rv, nil
+	}
+	slots, err := endpoints("slot")
+	if err != nil {
+		return fail(err)
+	}
+	signals, err := endpoints("signal")
+	if err != nil {
+		return fail(err)
+	}
+	if len(c.StringSlice("iface")) == 0 {
+		return fail(fmt.Errorf("at least one --iface is required"))
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.StringSlice("iface") {
+		if !strings.HasPrefix(name, "i.") || checkElement("interface", name) != nil {
+			return fail(fmt.Errorf("--iface must be a name like i.example"))
+		}
+		id := goIdent(name)
+		if seen[id] {
+			return fail(fmt.Errorf("interface %q has the same Go name as another", name))
+		}
+		seen[id] = true
+		p.Ifaces = append(p.Ifaces, genIface{Name: name, Ident: id, Var: strings.ToLower(id[:1]) + id[1:],
+			Slots: slots, Signals: signals})
+	}
+	src, err := generateService(&p)
+	if err != nil {
+		return fail(err)
+	}
+	out := c.String("outfile")
+	if out == "" || out == "-" {
+		os.Stdout.Write(src)
+		return nil
+	}
+	if err := ioutil.WriteFile(out, src, 0644); err != nil {
+		return fail(err)
+	}
+	fmt.Printf("wrote %s\n", out)
+	return nil
+}
+
+//generateService renders and formats the scaffolding for p
+func generateService(p *genParams) ([]byte, error) {
+	tmp, err := template.New("svc").Parse(serviceTemplate)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err := tmp.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+//serviceTemplate is a bw2bind service. Each interface lives at
+//base/s.svc/prefix/i.iface, takes commands on slot/x and publishes on
+//signal/y, and its lastalive metadata is kept fresh so that views list it
+const serviceTemplate = `//Code generated by bw2 gen-service. Fill in the TODOs.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/immesys/bw2bind"
+)
+
+//HeartbeatInterval is how often lastalive is republished. Views only list
+//interfaces that have it
+const HeartbeatInterval = {{.Heartbeat}}
+{{range .Ifaces}}{{$iface := .}}
+//{{.Ident}} is {{.Name}}
+type {{.Ident}} struct {
+	iface *bw2bind.Interface
+}
+{{range .Slots}}
+//on{{.Ident}} handles messages on slot/{{.Name}}
+func (i *{{$iface.Ident}}) on{{.Ident}}(msg *bw2bind.SimpleMessage) {
+	//TODO act on the message
+	msg.Dump()
+}
+{{end}}{{range .Signals}}
+//Publish{{.Ident}} publishes v as msgpack on signal/{{.Name}}
+func (i *{{$iface.Ident}}) Publish{{.Ident}}(v interface{}) error {
+	po, err := bw2bind.CreateMsgPackPayloadObject(bw2bind.PONumGenericMsgPack, v)
+	if err != nil {
+		return err
+	}
+	return i.iface.PublishSignal({{printf "%q" .Name}}, po)
+}
+{{end}}
+//register{{.Ident}} registers {{.Name}} on svc and subscribes to its slots
+func register{{.Ident}}(svc *bw2bind.Service) (*{{.Ident}}, error) {
+	rv := &{{.Ident}}{iface: svc.RegisterInterface({{printf "%q" $.Prefix}}, {{printf "%q" .Name}})}
+{{- range .Slots}}
+	if err := rv.iface.SubscribeSlot({{printf "%q" .Name}}, rv.on{{.Ident}}); err != nil {
+		return nil, err
+	}
+{{- end}}
+	return rv, nil
+}
+{{end}}
+//heartbeat sets lastalive on the service and its interfaces every
+//HeartbeatInterval until stop is closed
+func heartbeat(cl *bw2bind.BW2Client, uris []string, stop chan struct{}) {
+	for {
+		now := time.Now().Format(time.RFC3339Nano)
+		for _, uri := range uris {
+			if err := cl.SetMetadata(uri, "lastalive", now); err != nil {
+				fmt.Printf("could not set lastalive on %s: %v\n", uri, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(HeartbeatInterval):
+		}
+	}
+}
+
+func main() {
+	baseuri := os.Getenv("BW2_BASEURI")
+	if baseuri == "" {
+		baseuri = {{printf "%q" .BaseURI}}
+	}
+	if baseuri == "" {
+		fmt.Println("set BW2_BASEURI to the URI to register the service under")
+		os.Exit(1)
+	}
+	cl := bw2bind.ConnectOrExit("")
+	cl.SetEntityFromEnvironOrExit()
+	cl.OverrideAutoChainTo(true)
+	svc := cl.RegisterService(baseuri, {{printf "%q" .Service}})
+	uris := []string{svc.FullURI()}
+{{- range .Ifaces}}
+	{{.Var}}, err := register{{.Ident}}(svc)
+	if err != nil {
+		fmt.Println("could not register", {{printf "%q" .Name}}, err)
+		os.Exit(1)
+	}
+	uris = append(uris, {{.Var}}.iface.FullURI())
+	//TODO publish on the signals of {{.Var}}
+{{- end}}
+	heartbeat(cl, uris, make(chan struct{}))
+}
+`
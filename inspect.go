@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/mgutz/ansi"
+)
+
+//inspectNode is one element of an inspected object, with the elements it
+//refers to (DOTs in a chain, entities in a DOT, revokers...) as children.
+//This is what `bw2 inspect --json` prints
+type inspectNode struct {
+	Type string `json:"type"`
+	//How the parent refers to this element, e.g. "from" or "dot[2]"
+	Role string `json:"role,omitempty"`
+	ID   string `json:"id"`
+	//The registry state, as reported by the agent
+	Registry string `json:"registry,omitempty"`
+	Valid    bool   `json:"valid"`
+	//Why the element is not valid
+	Problems    []string       `json:"problems,omitempty"`
+	Alias       string         `json:"alias,omitempty"`
+	Contact     string         `json:"contact,omitempty"`
+	Comment     string         `json:"comment,omitempty"`
+	Created     string         `json:"created,omitempty"`
+	Expires     string         `json:"expires,omitempty"`
+	URI         string         `json:"uri,omitempty"`
+	Permissions string         `json:"permissions,omitempty"`
+	NoDelegate  string         `json:"nodelegate,omitempty"`
+	TTL         *int           `json:"ttl,omitempty"`
+	Value       string         `json:"value,omitempty"`
+	Children    []*inspectNode `json:"children,omitempty"`
+}
+
+func (n *inspectNode) problem(p string) {
+	n.Problems = append(n.Problems, p)
+	n.Valid = false
+}
+
+//walk calls cb on n and every element below it, with the roles leading
+//there
+func (n *inspectNode) walk(path []string, cb func(path []string, n *inspectNode)) {
+	if n.Role != "" {
+		path = append(path, n.Role)
+	}
+	cb(path, n)
+	for _, ch := range n.Children {
+		ch.walk(path, cb)
+	}
+}
+
+type inspectResolved struct {
+	ro      objects.RoutingObject
+	regnote string
+}
+
+//inspector expands routing objects into inspectNode trees, resolving
+//the elements they refer to from the registry
+type inspector struct {
+	ac *agentConn
+	//The same entity tends to appear many times in a chain
+	cache map[string]*inspectResolved
+	//IDs being expanded, to stop on revoker cycles
+	expanding map[string]bool
+}
+
+func newInspector(ac *agentConn) *inspector {
+	return &inspector{
+		ac:        ac,
+		cache:     make(map[string]*inspectResolved),
+		expanding: make(map[string]bool),
+	}
+}
+
+func (in *inspector) resolve(id []byte) *inspectResolved {
+	key := crypto.FmtKey(id)
+	if r, ok := in.cache[key]; ok {
+		return r
+	}
+	ro, validity, err := in.ac.resolveRegistry(key)
+	r := &inspectResolved{ro: ro, regnote: validityNote(validity, err)}
+	in.cache[key] = r
+	return r
+}
+
+//inspect expands an object that was given directly (e.g. as a file), so
+//it is fine for it not to be in the registry
+func (in *inspector) inspect(ro objects.RoutingObject) *inspectNode {
+	var id []byte
+	switch t := ro.(type) {
+	case *objects.Entity:
+		id = t.GetVK()
+	case *objects.DOT:
+		id = t.GetHash()
+	case *objects.DChain:
+		id = t.GetChainHash()
+	case *objects.Revocation:
+		id = t.GetHash()
+	}
+	r := in.resolve(id)
+	return in.node(ro, "", r.regnote, r.ro != nil)
+}
+
+//ref expands an element referred to by another one, which must be in the
+//registry
+func (in *inspector) ref(id []byte, role string, typ string) *inspectNode {
+	r := in.resolve(id)
+	if r.ro == nil {
+		n := &inspectNode{Type: typ, Role: role, ID: crypto.FmtKey(id), Registry: r.regnote}
+		n.problem("not found in registry")
+		return n
+	}
+	return in.node(r.ro, role, r.regnote, true)
+}
+
+func (in *inspector) node(ro objects.RoutingObject, role string, regnote string, inRegistry bool) *inspectNode {
+	n := &inspectNode{Role: role, Registry: regnote, Valid: true}
+	if inRegistry && regnote != "valid" {
+		n.problem(regnote)
+	}
+	switch t := ro.(type) {
+	case *objects.Entity:
+		in.entity(n, t)
+	case *objects.DOT:
+		in.dot(n, t)
+	case *objects.DChain:
+		in.chain(n, t)
+	case *objects.Revocation:
+		in.revocation(n, t)
+	default:
+		n.Type = "unknown"
+		n.problem("not a routing object")
+	}
+	return n
+}
+
+func fmtTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+//describe fills in the fields every routing object has, and notes if it
+//has expired and has no worse problem
+func describe(n *inspectNode, ro objects.DescribedObject) {
+	if ro.IsExpired() && len(n.Problems) == 0 {
+		n.problem("expired")
+	}
+	n.Contact = ro.GetContact()
+	n.Comment = ro.GetComment()
+	n.Created = fmtTime(ro.GetCreated())
+	n.Expires = fmtTime(ro.GetExpiry())
+}
+
+func (in *inspector) entity(n *inspectNode, e *objects.Entity) {
+	n.Type = "entity"
+	n.ID = crypto.FmtKey(e.GetVK())
+	if !e.SigValid() {
+		n.problem("signature invalid")
+	}
+	describe(n, e)
+	n.Alias, _ = in.ac.unresolveAlias(e.GetVK())
+	if in.expanding[n.ID] {
+		return
+	}
+	in.expanding[n.ID] = true
+	defer delete(in.expanding, n.ID)
+	for idx, rvk := range e.GetRevokers() {
+		n.Children = append(n.Children, in.ref(rvk, fmt.Sprintf("revoker[%d]", idx), "entity"))
+	}
+}
+
+func (in *inspector) dot(n *inspectNode, d *objects.DOT) {
+	n.Type = "dot"
+	n.ID = crypto.FmtHash(d.GetHash())
+	if !d.SigValid() {
+		n.problem("signature invalid")
+	}
+	describe(n, d)
+	n.Alias, _ = in.ac.unresolveAlias(d.GetHash())
+	if d.IsAccess() {
+		n.URI = crypto.FmtKey(d.GetAccessURIMVK()) + "/" + d.GetAccessURISuffix()
+		n.Permissions = d.GetPermString()
+		if nd := d.GetNoDelegate(); nd != nil {
+			n.NoDelegate = nd.GetPermString()
+		}
+	}
+	ttl := d.GetTTL()
+	n.TTL = &ttl
+	n.Children = append(n.Children,
+		in.ref(d.GetGiverVK(), "from", "entity"),
+		in.ref(d.GetReceiverVK(), "to", "entity"))
+	for idx, rvk := range d.GetRevokers() {
+		n.Children = append(n.Children, in.ref(rvk, fmt.Sprintf("revoker[%d]", idx), "entity"))
+	}
+}
+
+func (in *inspector) chain(n *inspectNode, dc *objects.DChain) {
+	n.Type = "dchain"
+	n.ID = crypto.FmtHash(dc.GetChainHash())
+	if !dc.IsElaborated() {
+		//The registry has the elaborated form of published chains
+		r := in.resolve(dc.GetChainHash())
+		if rdc, ok := r.ro.(*objects.DChain); ok && rdc.IsElaborated() {
+			dc = rdc
+		} else {
+			n.problem("not elaborated and not in registry")
+			return
+		}
+	}
+	haveall := true
+	for i := 0; i < dc.NumHashes(); i++ {
+		dh := dc.GetDotHash(i)
+		ch := in.ref(dh, fmt.Sprintf("dot[%d]", i), "dot")
+		n.Children = append(n.Children, ch)
+		if d, ok := in.resolve(dh).ro.(*objects.DOT); ok {
+			dc.SetDOT(i, d)
+		} else {
+			haveall = false
+		}
+	}
+	if !haveall {
+		n.problem("missing DOTs")
+		return
+	}
+	describe(n, dc)
+	n.Permissions = dc.GetAccessURIPermString()
+	if suffix, err := dc.GetAccessURISuffix(); err == nil {
+		n.URI = crypto.FmtKey(dc.GetMVK()) + "/" + suffix
+	} else {
+		n.problem("DOTs do not grant on a common URI")
+	}
+	ttl := dc.GetTTL()
+	n.TTL = &ttl
+}
+
+func (in *inspector) revocation(n *inspectNode, r *objects.Revocation) {
+	n.Type = "revocation"
+	n.ID = crypto.FmtKey(r.GetHash())
+	if !r.SigValid() {
+		n.problem("signature invalid")
+	}
+	describe(n, r)
+	target := in.resolve(r.GetTarget())
+	if target.ro == nil {
+		n.problem("target not found in registry")
+		return
+	}
+	if !r.IsValidFor(target.ro) {
+		n.problem("not valid for its target")
+	}
+	//The target is expected to be revoked, so its registry state is not a
+	//problem
+	n.Children = append(n.Children, in.node(target.ro, "target", target.regnote, false))
+}
+
+//paramNode records an inspect parameter that is not a routing object
+func paramNode(typ string, id string, value string, problem string) *inspectNode {
+	n := &inspectNode{Type: typ, ID: id, Value: value, Valid: true}
+	if problem != "" {
+		n.problem(problem)
+	}
+	return n
+}
+
+func countInvalid(nodes []*inspectNode) int {
+	rv := 0
+	for _, root := range nodes {
+		root.walk(nil, func(path []string, n *inspectNode) {
+			if !n.Valid {
+				rv++
+			}
+		})
+	}
+	return rv
+}
+
+//printInspectSummary prints the elements that are not valid and returns
+//how many there were
+func printInspectSummary(nodes []*inspectNode) int {
+	total := 0
+	bad := []string{}
+	for _, root := range nodes {
+		root.walk(nil, func(path []string, n *inspectNode) {
+			total++
+			if n.Valid {
+				return
+			}
+			where := n.Type
+			if len(path) != 0 {
+				where = strings.Join(path, ".") + " (" + n.Type + ")"
+			}
+			bad = append(bad, fmt.Sprintf("  %s %s: %s", where, n.ID, strings.Join(n.Problems, ", ")))
+		})
+	}
+	if len(bad) == 0 {
+		fmt.Printf("Summary: %d elements, all valid\n", total)
+		return 0
+	}
+	fmt.Printf("%sSummary: %d elements, %d invalid:\n", ansi.ColorCode("red+b"), total, len(bad))
+	for _, b := range bad {
+		fmt.Println(b)
+	}
+	resetTerm()
+	return len(bad)
+}
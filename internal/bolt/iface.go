@@ -0,0 +1,200 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package bolt
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	boltdb "github.com/boltdb/bolt"
+	"github.com/immesys/bw2/internal/db"
+)
+
+const (
+	CFDot    = 1
+	CFDChain = 2
+	CFMsg    = 3
+	CFMsgI   = 4
+	CFEntity = 5
+)
+
+//ErrObjNotFound is returned from GetObject if the object cannot be found
+var ErrObjNotFound = db.ErrObjNotFound
+
+//How many keys an iterator reads per transaction
+const iteratorBatch = 256
+
+//DB is a BoltDB file with a bucket per CF
+type DB struct {
+	h *boltdb.DB
+}
+
+func bucket(cf int) []byte {
+	return []byte(strconv.Itoa(cf))
+}
+
+//Open opens (or creates) the database file under dbname
+func Open(dbname string) (*DB, error) {
+	if err := os.MkdirAll(dbname, 0755); err != nil {
+		return nil, err
+	}
+	h, err := boltdb.Open(path.Join(dbname, "bolt.db"), 0600, &boltdb.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = h.Update(func(tx *boltdb.Tx) error {
+		for cf := CFDot; cf <= CFEntity; cf++ {
+			if _, err := tx.CreateBucketIfNotExists(bucket(cf)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return &DB{h: h}, nil
+}
+
+func (d *DB) PutObject(cf int, key []byte, val []byte) {
+	err := d.h.Update(func(tx *boltdb.Tx) error {
+		return tx.Bucket(bucket(cf)).Put(key, val)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (d *DB) GetObject(cf int, key []byte) ([]byte, error) {
+	var rv []byte
+	err := d.h.View(func(tx *boltdb.Tx) error {
+		//Values are only valid during the transaction
+		v := tx.Bucket(bucket(cf)).Get(key)
+		if v != nil {
+			rv = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rv == nil {
+		return nil, ErrObjNotFound
+	}
+	return rv, nil
+}
+
+func (d *DB) DeleteObject(cf int, key []byte) {
+	d.h.Update(func(tx *boltdb.Tx) error {
+		return tx.Bucket(bucket(cf)).Delete(key)
+	})
+}
+
+func (d *DB) Exists(cf int, key []byte) bool {
+	rv := false
+	err := d.h.View(func(tx *boltdb.Tx) error {
+		rv = tx.Bucket(bucket(cf)).Get(key) != nil
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return rv
+}
+
+func (d *DB) Close() error {
+	return d.h.Close()
+}
+
+//Iterator reads keys in batches, each in its own read transaction. Holding
+//a read transaction open for as long as the caller iterates would block
+//writers that need to grow the file
+type Iterator struct {
+	d      *DB
+	cf     int
+	prefix []byte
+	keys   [][]byte
+	values [][]byte
+	idx    int
+	//the last key read, the next batch starts after it
+	last []byte
+	done bool
+}
+
+func (d *DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	rv := &Iterator{d: d, cf: cf, prefix: prefix}
+	rv.fill()
+	return rv
+}
+
+func (i *Iterator) fill() {
+	i.keys = i.keys[:0]
+	i.values = i.values[:0]
+	i.idx = 0
+	err := i.d.h.View(func(tx *boltdb.Tx) error {
+		c := tx.Bucket(bucket(i.cf)).Cursor()
+		var k, v []byte
+		if i.last == nil {
+			k, v = c.Seek(i.prefix)
+		} else {
+			k, v = c.Seek(i.last)
+			if k != nil && bytes.Equal(k, i.last) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && bytes.HasPrefix(k, i.prefix); k, v = c.Next() {
+			if len(i.keys) == iteratorBatch {
+				return nil
+			}
+			i.keys = append(i.keys, append([]byte{}, k...))
+			i.values = append(i.values, append([]byte{}, v...))
+		}
+		i.done = true
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if len(i.keys) != 0 {
+		i.last = i.keys[len(i.keys)-1]
+	}
+}
+
+func (i *Iterator) Next() {
+	i.idx++
+	if i.idx == len(i.keys) && !i.done {
+		i.fill()
+	}
+}
+func (i *Iterator) OK() bool {
+	return i.idx < len(i.keys)
+}
+func (i *Iterator) Key() []byte {
+	return i.keys[i.idx]
+}
+func (i *Iterator) Value() []byte {
+	return i.values[i.idx]
+}
+func (i *Iterator) Release() {
+	i.keys = nil
+	i.values = nil
+}
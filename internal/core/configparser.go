@@ -18,6 +18,7 @@
 package core
 
 import (
+	"fmt"
 	"os"
 
 	log "github.com/cihub/seelog"
@@ -32,9 +33,53 @@ type BWConfig struct {
 		Version int
 	}
 	Router struct {
-		Entity  string
-		DB      string
-		LogPath string
+		Entity    string
+		DB        string
+		DBBackend string
+		LogPath   string
+		//off, flag or reject
+		ValidatePayloads string
+		//Seconds between persisting the router's state under $router,
+		//zero for the default and negative to disable
+		InfoInterval int
+		//How many chain builds requested under $chainbuild may run at
+		//once, zero for the default and negative to disable the service
+		ChainBuildWorkers int
+		//Seconds between verifying the chains of active subscriptions again,
+		//zero for the default and negative to only check on revocations
+		SubscriptionRecheck int
+		//Seconds that DOTs, entities and messages stay valid after they
+		//expire, to allow for clocks that disagree
+		ClockSkew int
+		//Add a timestamp signed by the router to every message its clients
+		//publish, so that routers whose clocks are wrong can tell
+		TimestampMessages bool
+		//Publish new blocks and contract events under $chain in the
+		//namespaces this router is the designated router for
+		ChainEvents bool
+		//The largest message in bytes the router accepts, zero for the
+		//default of 16MB
+		MaxMessageSize int
+		//Only parse the ROs of messages from peers that routing needs,
+		//leaving the rest until something looks at them
+		LazyRoutingObjects bool
+		//How many publishes to a peer may await their acks at once, zero
+		//for the default of 64
+		PublishWindow int
+		//Seconds a peer router may take to answer before it is warned
+		//about, zero for the default of 10 and negative to not check.
+		//DropSlowPeers also closes the connection to it
+		SlowPeerAck   int
+		DropSlowPeers bool
+		//full (the default) runs a chain node. thin runs without one,
+		//resolving through the router in [thin]
+		Profile string
+		//Answer the registry queries of thin routers that peer with this one
+		ServeRegistry bool
+		//Seconds that a publish or persist with an idempotency key is
+		//remembered, so that a retry with the same key is not delivered
+		//again. Zero for the default of 600 and negative to disable
+		IdempotencyWindow int
 	}
 	Native struct {
 		ListenOn string
@@ -52,33 +97,213 @@ type BWConfig struct {
 		PermittedNetworks string
 		ExternalIP        string
 		Port              int
+		//Seconds without a new block before the chain peers are rotated,
+		//zero for the default of 300 and negative to not watch the chain
+		SyncStallTimeout int
 	}
 	Mining struct {
 		Threads     int
 		Benificiary string
 	}
+	//A chain other than the public BOSSWAVE chain, used if Genesis is set.
+	//ChainID overrides the genesis chain ID, NetworkID defaults to the
+	//chain ID and BootNodes is a comma separated list of enode URLs
+	PrivateChain struct {
+		Genesis   string
+		ChainID   int
+		NetworkID int
+		BootNodes string
+		DevMiner  bool
+	}
+	//Where the builtin contracts are deployed, by chain ID, for chains
+	//where they are not at their default addresses. The code hashes are
+	//the keccak256 of the expected runtime code, and are optional
+	Contracts map[string]*struct {
+		Registry         string
+		Alias            string
+		Affinity         string
+		RegistryCodeHash string
+		AliasCodeHash    string
+		AffinityCodeHash string
+	}
+	DR struct {
+		CheckInterval   int
+		AutoUpdateSRV   bool
+		Account         int
+		PublicIPService string
+		AdvertisePort   int
+		ReplicaMode     string
+		GossipInterval  int
+	}
+	Stats struct {
+		URI       []string
+		Intervals string
+		History   int
+	}
+	//The messages per second and burst allowed for each origin VK. Zero
+	//means the default and a negative PerVK means no limit
+	RateLimit struct {
+		PerVK float64
+		Burst int
+	}
+	//Quotas for each client of the agent, such as each OOB connection.
+	//Zero means no limit. Admins is a comma separated list of the VKs,
+	//besides the router's, that may list the connected clients
+	Clients struct {
+		MaxSubscriptions  int
+		MaxCachedChains   int
+		MessagesPerSecond float64
+		Burst             int
+		Admins            string
+		//Hours before a DOT in a chain in use expires that the chain is
+		//rebuilt. Zero for the default, negative to never rebuild
+		ChainRefresh int
+	}
+	//Which messages that fail verification are recorded. One in every
+	//Sample is recorded, up to MaxPerMinute (zero for the default and
+	//negative for no cap). Persist also persists them under ns/!audit
+	Audit struct {
+		Sample       int
+		MaxPerMinute int
+		Persist      bool
+	}
+	//Relaxations of the checks on messages' chains, such as AuditOnly to
+	//deliver messages that fail them while they are being fixed. Messages
+	//let through are audited like denied ones
+	Verify VerifyPolicy
+	//Subtrees mounted under another URI prefix. Messages published under
+	//From are republished under To, so the router entity needs C* on From
+	//and P on To
+	Mount map[string]*struct {
+		From string
+		To   string
+	}
+	//Transformations of the messages on topics matching Pattern, a URI
+	//whose namespace may be an alias, for subscribers whose chain does not
+	//grant Unless, e.g. T. Each Apply is a transform such as
+	//strip:64.0.0.0/8, downsample:10 or redact:location, run in turn. The
+	//router signs the messages it transforms, so it needs P on Pattern
+	Transform map[string]*struct {
+		Pattern string
+		Unless  string
+		Apply   []string
+	}
+	//Services run inside the router, of a Kind registered with
+	//api.RegisterService. Entity is the key file of the entity their
+	//client uses, the router's if empty, and each Param is key=value
+	Driver map[string]*struct {
+		Kind   string
+		Entity string
+		Param  []string
+	}
+	//Limits on what may be published on a namespace this router is the
+	//designated router for, per hour and persisted at once. Namespace may
+	//be an alias, and zero means no limit
+	Quota map[string]*struct {
+		Namespace         string
+		MessagesPerHour   int
+		BytesPerHour      int
+		MaxPersistedBytes int
+	}
+	//The maximum number of entries in each resolution cache. Zero means
+	//the default and a negative number means no limit
+	Cache struct {
+		MaxEntities int
+		MaxDOTs     int
+		MaxChains   int
+	}
+	//Namespaces whose designated routers are discovered through DNS
+	//before the chain has synced. Domains is comma separated and
+	//CacheTime is in seconds, zero for an hour
+	DNS struct {
+		Domains   string
+		CacheTime int
+	}
+	//Advertise the router on the local network with mDNS, and look for
+	//other routers there every DiscoverInterval seconds (zero disables)
+	MDNS struct {
+		Advertise        bool
+		DiscoverInterval int
+	}
+	//Which peers the native listener serves. AllowVK and DenyVK apply to
+	//the origin VK of messages. Each Namespace is a VK optionally followed
+	//by the networks that may send messages on it
+	Peering struct {
+		AllowVK       []string
+		DenyVK        []string
+		Namespace     []string
+		MaxConnsPerIP int
+	}
+	//Hot standby of the persisted store. A primary streams its writes to
+	//the Allow VKs. A standby follows Primary, which must prove it holds
+	//PrimaryVK, until it is promoted
+	Standby struct {
+		Allow      []string
+		Primary    string
+		PrimaryVK  string
+		BufferSize int
+	}
+	//The full router a thin router resolves through. Registry is its
+	//native host:port and it must prove it holds RegistryVK. HeadInterval
+	//is how often, in seconds, its head block is fetched (zero for 15).
+	//Unless TrustRegistry is set its answers must carry proofs against a
+	//block header whose proof of work is checked
+	Thin struct {
+		Registry      string
+		RegistryVK    string
+		HeadInterval  int
+		TrustRegistry bool
+	}
+}
+
+//Router profiles
+const (
+	ProfileFull = "full"
+	ProfileThin = "thin"
+)
+
+//IsThin is true if the router runs without a chain node
+func (c *BWConfig) IsThin() bool {
+	return c.Router.Profile == ProfileThin
 }
 
 // LoadConfig will load and return a configuration. If "" is specified for the filename,
-// it will default to "bw2.ini" in the current directory
+// it will default to "bw2.ini" in the current directory. It exits the process
+// if the configuration cannot be loaded
 func LoadConfig(filename string) *BWConfig {
+	rv, err := ReadConfig(filename)
+	if err != nil {
+		log.Criticalf("%v", err)
+		os.Exit(1)
+	}
+	return rv
+}
+
+// ReadConfig is like LoadConfig but returns an error instead of exiting
+func ReadConfig(filename string) (*BWConfig, error) {
 	rv := &BWConfig{}
 	if filename != "" {
 		err := gcfg.ReadFileInto(rv, filename)
 		if err != nil {
-			log.Criticalf("Could not load specified config file: %v", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("Could not load specified config file: %v", err)
 		}
 	} else {
 		err := gcfg.ReadFileInto(rv, "bw2.ini")
 		if err != nil {
-			log.Criticalf("Could not load default config file: %v", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("Could not load default config file: %v", err)
 		}
 	}
 	if rv.Config.Version != cfgversion {
-		log.Criticalf("Your config file version is out of date. Run bw2 makeconf to get a new format config file\n")
-		os.Exit(1)
+		return nil, fmt.Errorf("Your config file version is out of date. Run bw2 makeconf to get a new format config file")
 	}
-	return rv
+	switch rv.Router.Profile {
+	case "", ProfileFull:
+	case ProfileThin:
+		if rv.Thin.Registry == "" || rv.Thin.RegistryVK == "" {
+			return nil, fmt.Errorf("The thin profile needs [thin] Registry and RegistryVK")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown [router] Profile %q, expected full or thin", rv.Router.Profile)
+	}
+	return rv, nil
 }
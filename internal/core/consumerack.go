@@ -0,0 +1,91 @@
+package core
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//pendingAck is a consumer limited message that its consumers may NACK
+type pendingAck struct {
+	m       *Message
+	timeout time.Duration
+	//when it was delivered to each subscription
+	delivered map[UniqueMessageID]time.Time
+	nacked    map[UniqueMessageID]bool
+	timer     *time.Timer
+}
+
+func (tm *Terminus) addPendingAck(m *Message, subids []UniqueMessageID, timeout time.Duration) {
+	if len(subids) == 0 || timeout <= 0 {
+		return
+	}
+	now := time.Now()
+	p := &pendingAck{
+		m:         m,
+		timeout:   timeout,
+		delivered: make(map[UniqueMessageID]time.Time),
+		nacked:    make(map[UniqueMessageID]bool),
+	}
+	for _, id := range subids {
+		p.delivered[id] = now
+	}
+	tm.ackmu.Lock()
+	defer tm.ackmu.Unlock()
+	if old, ok := tm.acks[m.UMid]; ok {
+		old.timer.Stop()
+	}
+	p.timer = time.AfterFunc(timeout, func() {
+		tm.ackmu.Lock()
+		if tm.acks[m.UMid] == p {
+			delete(tm.acks, m.UMid)
+		}
+		tm.ackmu.Unlock()
+	})
+	tm.acks[m.UMid] = p
+}
+
+//Nack tells the terminus that the subscription subid could not process
+//the message msgid. If the NACK is within the timeout of the message's
+//consumer ack RO, the message is delivered to a matching subscription that
+//has not had it yet. It returns false if there is no such subscription
+func (cl *Client) Nack(msgid UniqueMessageID, subid UniqueMessageID) (bool, error) {
+	tm := cl.tm
+	tm.ackmu.Lock()
+	defer tm.ackmu.Unlock()
+	p, ok := tm.acks[msgid]
+	if !ok {
+		return false, bwe.M(bwe.BadOperation, "the message is not awaiting acknowledgement")
+	}
+	at, ok := p.delivered[subid]
+	if !ok {
+		return false, bwe.M(bwe.BadOperation, "the message was not delivered to that subscription")
+	}
+	if p.nacked[subid] || time.Now().Sub(at) > p.timeout {
+		return false, bwe.M(bwe.BadOperation, "the message can no longer be NACKed")
+	}
+	p.nacked[subid] = true
+	var candidates []*subscription
+	tm.RMatchSubs(p.m.Topic, func(s *subscription) {
+		if s.filter != nil && !FilterAccepts(s.filter, p.m) {
+			return
+		}
+		if _, had := p.delivered[s.subid]; !had && !s.tap && s.ctx.Err() == nil {
+			candidates = append(candidates, s)
+		}
+	})
+	for len(candidates) > 0 {
+		i := rand.Intn(len(candidates))
+		sub := candidates[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		select {
+		case sub.mqueue <- p.m:
+			p.delivered[sub.subid] = time.Now()
+			p.timer.Reset(p.timeout)
+			return true, nil
+		default:
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/immesys/bw2/objects"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//SubscriptionFilter returns the filter RO of a subscribe or tap message,
+//if it has one
+func (m *Message) SubscriptionFilter() (*objects.SubscriptionFilter, bool) {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() != objects.ROSubscriptionFilter {
+			continue
+		}
+		ro, _ = objects.ParseRoutingObject(ro)
+		if sf, ok := ro.(*objects.SubscriptionFilter); ok {
+			return sf, true
+		}
+	}
+	return nil, false
+}
+
+//FilterAccepts is true if the message passes the subscription filter
+func FilterAccepts(f *objects.SubscriptionFilter, m *Message) bool {
+	size := 0
+	for _, po := range m.PayloadObjects {
+		size += len(po.GetContent())
+	}
+	min, max := f.GetSizeBounds()
+	if size < min || (max != 0 && size > max) {
+		return false
+	}
+	for _, po := range m.PayloadObjects {
+		if poAccepted(f, po) {
+			return true
+		}
+	}
+	return false
+}
+
+func poAccepted(f *objects.SubscriptionFilter, po objects.PayloadObject) bool {
+	if pms := f.GetPONums(); len(pms) != 0 {
+		matched := false
+		for _, pm := range pms {
+			if pm.Matches(po.GetPONum()) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	fields := f.GetFields()
+	if len(fields) == 0 {
+		return true
+	}
+	var doc interface{}
+	if msgpack.Unmarshal(po.GetContent(), &doc) != nil {
+		return false
+	}
+	for _, fm := range fields {
+		var want interface{}
+		if msgpack.Unmarshal(fm.Value, &want) != nil {
+			return false
+		}
+		have, ok := lookupField(doc, fm.Field)
+		if !ok || !msgpackEqual(have, want) {
+			return false
+		}
+	}
+	return true
+}
+
+//lookupField follows a dotted path through nested msgpack maps
+func lookupField(doc interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch m := doc.(type) {
+		case map[interface{}]interface{}:
+			v, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case map[string]interface{}:
+			v, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+//msgpackEqual compares decoded msgpack values. Numbers are compared by
+//value whatever their encoding, and str and bin are the same
+func msgpackEqual(a, b interface{}) bool {
+	if fa, ok := msgpackNumber(a); ok {
+		fb, ok := msgpackNumber(b)
+		return ok && fa == fb
+	}
+	if ba, ok := a.([]byte); ok {
+		a = string(ba)
+	}
+	if bb, ok := b.([]byte); ok {
+		b = string(bb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func msgpackNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
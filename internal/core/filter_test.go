@@ -0,0 +1,51 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	want, _ := msgpack.Marshal(float64(3))
+	sf, err := objects.CreateSubscriptionFilter(
+		[]objects.PONumMatch{{PONum: objects.PONumMsgPack, Mask: 8}}, 0, 64,
+		[]objects.FieldMatch{{Field: "a.b", Value: want}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, vk := crypto.GenerateKeypair()
+	sub := &Message{Type: TypeSubscribe, MVK: vk, TopicSuffix: "a/b",
+		RoutingObjects: []objects.RoutingObject{sf}}
+	sub.Encode(sk, vk)
+	l, err := LoadMessage(sub.Encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsf, ok := l.SubscriptionFilter()
+	if !ok {
+		t.Fatalf("filter did not round trip")
+	}
+	msg := func(ponum int, v interface{}) *Message {
+		content, _ := msgpack.Marshal(v)
+		po, _ := objects.CreateOpaquePayloadObject(ponum, content)
+		return &Message{PayloadObjects: []objects.PayloadObject{po}}
+	}
+	match := map[string]interface{}{"a": map[string]interface{}{"b": 3}}
+	other := map[string]interface{}{"a": map[string]interface{}{"b": 4}}
+	big := map[string]interface{}{"a": map[string]interface{}{"b": 3}, "pad": string(make([]byte, 64))}
+	if !FilterAccepts(lsf, msg(objects.PONumMsgPack, match)) {
+		t.Fatalf("matching message was filtered out")
+	}
+	if FilterAccepts(lsf, msg(objects.PONumMsgPack, other)) {
+		t.Fatalf("message with another field value passed")
+	}
+	if FilterAccepts(lsf, msg(objects.PONumBlob, match)) {
+		t.Fatalf("message with another PO number passed")
+	}
+	if FilterAccepts(lsf, msg(objects.PONumMsgPack, big)) {
+		t.Fatalf("message over the size bound passed")
+	}
+}
@@ -0,0 +1,26 @@
+// +build gofuzz
+
+package core
+
+//FuzzLoadMessage is a go-fuzz entry point for LoadMessage, which decodes
+//every message a router receives from clients and peers. See
+//fuzz/README.md for how to run it
+func FuzzLoadMessage(data []byte) int {
+	m, err := LoadMessage(data)
+	if err != nil {
+		if m != nil {
+			panic("message returned with an error")
+		}
+		return 0
+	}
+	if m.SigCoverEnd+64 > len(data) {
+		panic("signature runs past the message")
+	}
+	for _, ro := range m.RoutingObjects {
+		ro.GetContent()
+	}
+	if m.PrimaryAccessChain != nil {
+		m.PrimaryAccessChain.GetChainHash()
+	}
+	return 1
+}
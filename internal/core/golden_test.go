@@ -0,0 +1,74 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/testvec"
+	"github.com/immesys/bw2/objects"
+)
+
+//goldenMessages are messages of each layout, built deterministically for
+//the vectors in testdata/vectors. See package testvec
+func goldenMessages(t *testing.T) map[string]*Message {
+	nsSK, nsVK := testvec.Keypair("ns")
+	_, aliceVK := testvec.Keypair("alice")
+	d, err := objects.NewAccessDOTBuilder(nsVK, aliceVK).
+		URI(nsVK, "a/*").
+		Permissions("C*P").
+		Created(testvec.Epoch).
+		Build(nsSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, _ := objects.CreateDChain(true, d)
+	hc, _ := dc.ConvertToDChainHash()
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumString, []byte("hello"))
+	ros := func() []objects.RoutingObject {
+		return []objects.RoutingObject{
+			hc,
+			objects.CreateOriginVK(aliceVK),
+			objects.CreateNewExpiry(testvec.Epoch.Add(time.Hour)),
+		}
+	}
+	return map[string]*Message{
+		"publish": {
+			Type: TypePublish, MessageID: 1, MVK: nsVK, TopicSuffix: "a/b", Consumers: 2,
+			RoutingObjects: ros(), PayloadObjects: []objects.PayloadObject{po},
+		},
+		"subscribe": {
+			Type: TypeSubscribe, MessageID: 2, MVK: nsVK, TopicSuffix: "a/*",
+			RoutingObjects: ros(),
+		},
+		"unsubscribe": {
+			Type: TypeUnsubscribe, MessageID: 3, MVK: nsVK, TopicSuffix: "a/*",
+			UnsubUMid: UniqueMessageID{Mid: 2, Sig: 0x0123456789abcdef},
+		},
+	}
+}
+
+func TestGoldenMessages(t *testing.T) {
+	sk, vk := testvec.Keypair("alice")
+	for name, m := range goldenMessages(t) {
+		m.Encode(sk, vk)
+		testvec.Check(t, "message_"+name, name+" message", m.Encoded)
+		l, err := LoadMessage(testvec.Load(t, "message_"+name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if l.Type != m.Type || l.MessageID != m.MessageID || l.TopicSuffix != m.TopicSuffix ||
+			l.UnsubUMid != m.UnsubUMid || len(l.RoutingObjects) != len(m.RoutingObjects) ||
+			len(l.PayloadObjects) != len(m.PayloadObjects) {
+			t.Fatalf("%s: the vector did not parse to the message", name)
+		}
+		if !crypto.VerifyBlob(vk, l.Signature, l.Encoded[:l.SigCoverEnd]) {
+			t.Fatalf("%s: the vector's signature does not verify", name)
+		}
+		l.Encode(sk, vk)
+		if !bytes.Equal(l.Encoded, m.Encoded) {
+			t.Fatalf("%s: the parsed message encodes differently", name)
+		}
+	}
+}
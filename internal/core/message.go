@@ -22,7 +22,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"runtime"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -41,6 +41,9 @@ const (
 	TypeTapQuery    = 0x06
 	TypeLS          = 0x07
 	TypeUnsubscribe = 0x08
+	//TypeDelete removes the message persisted on a URI. It needs both P
+	//and L on the URI
+	TypeDelete = 0x09
 )
 
 // This is used for verifying messages
@@ -53,6 +56,33 @@ type Resolver interface {
 	//GetEntityState(e *objects.Entity) error
 }
 
+//FreePathResolver is implemented by resolvers that know who may write to
+//the free paths of a namespace
+type FreePathResolver interface {
+	CanWriteFreePath(mvk []byte, vk []byte) bool
+}
+
+//VerifyPolicy relaxes the checks Verify makes on a message's chain, for
+//deployments that cannot enforce all of them yet, such as during a
+//migration. The zero policy enforces everything. A failure the policy lets
+//through is kept in the message's Waived field so it can be audited
+type VerifyPolicy struct {
+	//Accept DOTs that have expired
+	SkipExpiry bool
+	//Accept DOTs whose state cannot be resolved, if the message carries
+	//them. The chain is still checked with the carried DOTs, only their
+	//revocation and expiry in the registry are not
+	AllowUnresolvable bool
+	//Deliver messages whose chain does not authorise them. The message
+	//signature is still checked
+	AuditOnly bool
+}
+
+//PolicyResolver is implemented by resolvers that relax verification
+type PolicyResolver interface {
+	VerifyPolicy() VerifyPolicy
+}
+
 // Message is the primary Bosswave message type that is passed all the way through
 type Message struct {
 
@@ -80,93 +110,177 @@ type Message struct {
 	PrimaryAccessChain *objects.DChain
 	checked            bool
 	VerifyResult       error
+	//Set by Verify if the message failed a chain check that the
+	//resolver's VerifyPolicy let through
+	Waived error
 	//status             StatusMessage
 	MergedTopic *string
 	UMid        UniqueMessageID
+	//The sequence number the designated router gave the message on its
+	//topic when it persisted it. Zero if it was not persisted or the
+	//number is not known
+	PersistSeq uint64
+}
+
+//roContents holds the RO contents of a message between sizing it and
+//writing it, so that each RO's content is fetched once. They are pooled
+//as Encode is on the router hot path
+var roContents = sync.Pool{
+	New: func() interface{} {
+		rv := make([][]byte, 0, 16)
+		return &rv
+	},
+}
+
+//encodedHeaderLen returns the length of the fixed header and the topic
+//suffix of the encoded message
+func (m *Message) encodedHeaderLen() int {
+	n := 9 + len(m.MVK) + 2 + len(m.TopicSuffix)
+	switch m.Type {
+	case TypePublish, TypePersist:
+		n++
+	case TypeUnsubscribe:
+		n += 16
+	}
+	return n
 }
 
 //Encode generates the encoded array with signature.
 //it assumes that everything is properly set up by the message factory
-//that created this message object.
+//that created this message object. The size of the message is worked out
+//first so that it is built and signed in a single allocation
 func (m *Message) Encode(sk []byte, vk []byte) {
-	//Try cut down on alloc by assuming < 4k
-	b := make([]byte, 9, 4096)
-	tmp := make([]byte, 8)
+	cp := roContents.Get().(*[][]byte)
+	contents := (*cp)[:0]
+	n := m.encodedHeaderLen()
+	for _, ro := range m.RoutingObjects {
+		content := ro.GetContent()
+		contents = append(contents, content)
+		n += 3 + len(content)
+	}
+	n++
+	for _, po := range m.PayloadObjects {
+		n += 8 + len(po.GetContent())
+	}
+	n += 4
+
+	b := make([]byte, n+64)
 	b[0] = byte(m.Type)
 	binary.LittleEndian.PutUint64(b[1:], m.MessageID)
-	b = append(b, m.MVK...)
-	binary.LittleEndian.PutUint16(tmp, uint16(len(m.TopicSuffix)))
-	b = append(b, tmp[:2]...)
-	b = append(b, []byte(m.TopicSuffix)...)
+	i := 9
+	i += copy(b[i:], m.MVK)
+	binary.LittleEndian.PutUint16(b[i:], uint16(len(m.TopicSuffix)))
+	i += 2
+	i += copy(b[i:], m.TopicSuffix)
 	switch m.Type {
 	case TypePublish, TypePersist:
-		b = append(b, byte(m.Consumers))
+		b[i] = byte(m.Consumers)
+		i++
 	case TypeUnsubscribe:
-		binary.LittleEndian.PutUint64(tmp, m.UnsubUMid.Mid)
-		b = append(b, tmp...)
-		binary.LittleEndian.PutUint64(tmp, m.UnsubUMid.Sig)
-		b = append(b, tmp...)
+		binary.LittleEndian.PutUint64(b[i:], m.UnsubUMid.Mid)
+		binary.LittleEndian.PutUint64(b[i+8:], m.UnsubUMid.Sig)
+		i += 16
 	}
-	for _, ro := range m.RoutingObjects {
-		b = append(b, byte(ro.GetRONum()))
-		content := ro.GetContent()
-		binary.LittleEndian.PutUint16(tmp, uint16(len(content)))
-		b = append(b, tmp[:2]...)
-		b = append(b, ro.GetContent()...)
+	for idx, ro := range m.RoutingObjects {
+		b[i] = byte(ro.GetRONum())
+		binary.LittleEndian.PutUint16(b[i+1:], uint16(len(contents[idx])))
+		i += 3
+		i += copy(b[i:], contents[idx])
 	}
-	b = append(b, 0)
+	//b[i] is already the RO terminator
+	i++
 	for _, po := range m.PayloadObjects {
-		binary.LittleEndian.PutUint32(tmp, uint32(po.GetPONum()))
-		b = append(b, tmp[:4]...)
 		content := po.GetContent()
-		binary.LittleEndian.PutUint32(tmp, uint32(len(content)))
-		b = append(b, tmp[:4]...)
-		b = append(b, content...)
-	}
-	b = append(b, 0, 0, 0, 0)
-	sig := make([]byte, 64)
-	m.Signature = sig
-	//fmt.Printf("\nSigning message blob len %d\n", len(b))
-	//fmt.Println("SK: ", crypto.FmtKey(sk))
-	//fmt.Println("VK: ", crypto.FmtKey(vk))
-	crypto.SignBlob(sk, vk, sig, b)
-	//fmt.Println("Signature: ", crypto.FmtSig(m.Signature))
-	m.SigCoverEnd = len(b)
-	b = append(b, sig...)
+		binary.LittleEndian.PutUint32(b[i:], uint32(po.GetPONum()))
+		binary.LittleEndian.PutUint32(b[i+4:], uint32(len(content)))
+		i += 8
+		i += copy(b[i:], content)
+	}
+	//as is the PO terminator
+
+	//Don't keep the contents alive through the pool
+	for idx := range contents {
+		contents[idx] = nil
+	}
+	*cp = contents[:0]
+	roContents.Put(cp)
+
+	m.SigCoverEnd = n
+	m.Signature = b[n:]
+	crypto.SignBlob(sk, vk, m.Signature, b[:n])
 	m.Encoded = b
 }
 
-func LoadMessage(b []byte) (m *Message, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			fbuf := make([]byte, 8000)
-			nm := runtime.Stack(fbuf, false)
-			fmt.Println("Bad message: ", r)
-			fmt.Println(string(fbuf[:nm]))
-			m.Valid = false
-			err = r.(error)
-		}
-	}()
-	m = &Message{Encoded: b}
+//routingRO is true for the ROs that LoadMessage picks out of the message
+func routingRO(ronum int) bool {
+	switch ronum {
+	case objects.ROAccessDChain, objects.ROAccessDChainHash, objects.ROOriginVK, objects.ROExpiry:
+		return true
+	}
+	return false
+}
+
+//topicOf returns the full topic of a namespace and suffix, built in one
+//allocation
+func topicOf(mvk []byte, suffix []byte) string {
+	enc := base64.URLEncoding.EncodedLen(len(mvk))
+	rv := make([]byte, enc+1+len(suffix))
+	base64.URLEncoding.Encode(rv, mvk)
+	rv[enc] = '/'
+	copy(rv[enc+1:], suffix)
+	return string(rv)
+}
+
+//LoadMessage decodes a message off the wire. The bytes are untrusted, so
+//a truncated or malformed message is an error, never a panic
+func LoadMessage(b []byte) (*Message, error) {
+	return loadMessage(b, false)
+}
+
+//LoadMessageLazy is like LoadMessage, but only parses the ROs that routing
+//the message needs: the access chain, the origin VK and the expiry. The
+//others are left as LazyRoutingObjects over the message's bytes, and a
+//malformed one is only found when it is parsed, instead of being dropped
+func LoadMessageLazy(b []byte) (*Message, error) {
+	return loadMessage(b, true)
+}
+
+func loadMessage(b []byte, lazy bool) (*Message, error) {
+	truncated := func(what string) error {
+		return bwe.M(bwe.MalformedMessage, "Message is truncated in the "+what)
+	}
+	m := &Message{Encoded: b}
 	//Common header
 	idx := 0
+	if len(b) < 9+32+2 {
+		return nil, truncated("header")
+	}
 	m.Type = b[idx]
 	m.MessageID = binary.LittleEndian.Uint64(b[idx+1:])
 	idx += 9
 	m.MVK = b[idx : idx+32]
 	idx += 32
-	suffixlen := binary.LittleEndian.Uint16(b[idx:])
-	m.TopicSuffix = string(b[idx+2 : idx+2+int(suffixlen)])
-	idx += int(suffixlen) + 2
-	m.Topic = base64.URLEncoding.EncodeToString(m.MVK) + "/" + m.TopicSuffix
+	suffixlen := int(binary.LittleEndian.Uint16(b[idx:]))
+	if idx+2+suffixlen > len(b) {
+		return nil, truncated("topic")
+	}
+	m.TopicSuffix = string(b[idx+2 : idx+2+suffixlen])
+	idx += suffixlen + 2
+	m.Topic = topicOf(m.MVK, b[idx-suffixlen:idx])
 
 	//Read type specific block
 	switch m.Type {
 	case TypePublish, TypePersist:
 		//One additional byte denoting consumer limit
+		if idx+1 > len(b) {
+			return nil, truncated("header")
+		}
 		m.Consumers = int(b[idx])
 		idx++
 	case TypeUnsubscribe:
+		if idx+16 > len(b) {
+			return nil, truncated("header")
+		}
 		m.UnsubUMid.Mid = binary.LittleEndian.Uint64(b[idx:])
 		idx += 8
 		m.UnsubUMid.Sig = binary.LittleEndian.Uint64(b[idx:])
@@ -177,10 +291,27 @@ func LoadMessage(b []byte) (m *Message, err error) {
 	foundorigin := false
 	foundexpiry := false
 	//Read routing objects
-	for b[idx] != 0 {
+	for {
+		if idx+1 > len(b) {
+			return nil, truncated("routing objects")
+		}
+		if b[idx] == 0 {
+			break
+		}
+		if idx+3 > len(b) {
+			return nil, truncated("routing objects")
+		}
 		RONum := int(b[idx])
 		ln := int(binary.LittleEndian.Uint16(b[idx+1:]))
 		idx += 3
+		if idx+ln > len(b) {
+			return nil, truncated("routing objects")
+		}
+		if lazy && !routingRO(RONum) {
+			m.RoutingObjects = append(m.RoutingObjects, objects.NewLazyRoutingObject(RONum, b[idx:idx+ln]))
+			idx += ln
+			continue
+		}
 		ro, err := objects.LoadRoutingObject(RONum, b[idx:idx+ln])
 		if err != nil {
 			log.Errorf("Got bad routing object: 0x%02x, error: %s", RONum, err)
@@ -214,13 +345,22 @@ func LoadMessage(b []byte) (m *Message, err error) {
 
 	//Read payload objects
 	for {
+		if idx+4 > len(b) {
+			return nil, truncated("payload objects")
+		}
 		PONum := int(binary.LittleEndian.Uint32(b[idx:]))
 		idx += 4
 		if PONum == 0 {
 			break
 		}
+		if idx+4 > len(b) {
+			return nil, truncated("payload objects")
+		}
 		ln := int(binary.LittleEndian.Uint32(b[idx:]))
 		idx += 4
+		if ln < 0 || ln > len(b)-idx {
+			return nil, truncated("payload objects")
+		}
 		po, err := objects.LoadPayloadObject(PONum, b[idx:idx+ln])
 		if err != nil {
 			log.Errorf("Got bad payload object: %s, error: %s", objects.PONumDotForm(PONum), err)
@@ -232,6 +372,9 @@ func LoadMessage(b []byte) (m *Message, err error) {
 
 	//This is where the signature stops
 	m.SigCoverEnd = idx
+	if idx+64 > len(b) {
+		return nil, truncated("signature")
+	}
 	m.Signature = b[idx : idx+64]
 
 	m.UMid.Mid = m.MessageID
@@ -252,29 +395,35 @@ func ElaborateDChain(dc *objects.DChain, res Resolver) *objects.DChain {
 	return dc
 }
 
-//
-// func ResolveDotsInDChain(dc *objects.DChain, cache []objects.RoutingObject, res Resolver) bool {
-// 	if !dc.IsElaborated() {
-// 		return false
-// 	}
-// 	//Augment the primary dchain by the ro's we got given
-// 	for _, ro := range cache {
-// 		if ro.GetRONum() == objects.ROAccessDOT {
-// 			dc.AugmentBy(ro.(*objects.DOT))
-// 		}
-// 	}
-// 	//Next, resolve any dots that did not exist in the chain
-// 	for i := 0; i < dc.NumHashes(); i++ {
-// 		if dc.GetDOT(i) == nil {
-// 			dot, _, err := res.ResolveDOT(dc.GetDotHash(i))
-// 			if err != nil {
-// 				return false
-// 			}
-// 			dc.SetDOT(i, dot)
-// 		}
-// 	}
-// 	return true
-// }
+//ResolveDotsInDChain elaborates dc and fills in its DOTs from the access
+//DOTs carried in cache, which are usually the message's routing objects. A
+//carried DOT is only used where its hash, computed from its content, is the
+//one in the chain, and a hash-only chain is only elaborated from carried
+//DOTs if they hash to the chain hash. What is missing is left for the
+//resolver: the chain is elaborated by it if need be, and DOTs that were not
+//carried are left nil
+func ResolveDotsInDChain(dc *objects.DChain, cache []objects.RoutingObject, res Resolver) *objects.DChain {
+	dots := []*objects.DOT{}
+	for _, ro := range cache {
+		if ro.GetRONum() == objects.ROAccessDOT {
+			dots = append(dots, ro.(*objects.DOT))
+		}
+	}
+	if !dc.IsElaborated() && len(dots) != 0 {
+		if nchain, err := objects.CreateDChain(true, dots...); err == nil &&
+			bytes.Equal(nchain.GetChainHash(), dc.GetChainHash()) {
+			return nchain
+		}
+	}
+	dc = ElaborateDChain(dc, res)
+	if dc == nil {
+		return nil
+	}
+	for _, d := range dots {
+		dc.AugmentBy(d)
+	}
+	return dc
+}
 
 //AnalyzeAccessDotChain does what it says.
 func AnalyzeAccessDOTChain(mtype int, targetURI string, dc *objects.DChain) (err error,
@@ -301,6 +450,9 @@ func AnalyzeAccessDOTChain(mtype int, targetURI string, dc *objects.DChain) (err
 	}
 	mvk = firstdot.GetAccessURIMVK()
 	ps = firstdot.GetPermissionSet()
+	//What the DOTs so far forbid their receivers to delegate
+	nodel := &objects.AccessDOTPermissionSet{}
+	nodel.Union(firstdot.GetNoDelegate())
 	if !bytes.Equal(head, mvk) {
 		err = bwe.M(bwe.ChainOriginNotMVK, fmt.Sprintf("Chain doesn't start at namespace %v != %v", crypto.FmtKey(head), crypto.FmtKey(mvk)))
 		return
@@ -312,7 +464,9 @@ func AnalyzeAccessDOTChain(mtype int, targetURI string, dc *objects.DChain) (err
 			return
 		}
 		ttl--
+		ps.Without(nodel)
 		ps.ReduceBy(d.GetPermissionSet())
+		nodel.Union(d.GetNoDelegate())
 		if d.GetTTL() < ttl {
 			ttl = d.GetTTL()
 		}
@@ -362,6 +516,11 @@ func AnalyzeAccessDOTChain(mtype int, targetURI string, dc *objects.DChain) (err
 			err = bwe.M(bwe.BadPermissions, "require L")
 			return
 		}
+	case TypeDelete:
+		if !ps.CanPublish || !ps.CanList {
+			err = bwe.M(bwe.BadPermissions, "require PL")
+			return
+		}
 	default:
 		err = bwe.M(bwe.BadOperation, "invalid message type code")
 		return
@@ -379,6 +538,56 @@ const (
 	StateError
 )
 
+//verifyFreePath checks a message on a free path. Anyone may read a free
+//path, so no access chain is needed, but only the resolver's chosen VKs
+//(the designated routers of the namespace) may write to it. The exceptions
+//are publishing a request for the chain build service and persisting or
+//deleting a DOT request (see MayWriteDOTRequest)
+func (m *Message) verifyFreePath(res Resolver) error {
+	star, plus, _, uerr := util.AnalyzeSuffixDetailed(m.TopicSuffix)
+	if uerr != nil {
+		return bwe.WrapC(bwe.BadURI, uerr)
+	}
+	switch m.Type {
+	case TypePublish, TypePersist:
+		if star || plus {
+			return bwe.M(bwe.BadOperation, "you cannot publish, delete or list a URI with a wildcard")
+		}
+		if m.Type == TypePublish && m.OriginVK != nil && util.IsChainBuildRequest(m.TopicSuffix) {
+			return nil
+		}
+		if m.Type == TypePersist && m.OriginVK != nil && MayWriteDOTRequest(m.TopicSuffix, *m.OriginVK, false) {
+			return nil
+		}
+		fpr, ok := res.(FreePathResolver)
+		if !ok || m.OriginVK == nil || !fpr.CanWriteFreePath(m.MVK, *m.OriginVK) {
+			return bwe.M(bwe.BadPermissions, "free paths are read-only")
+		}
+	case TypeDelete:
+		if m.OriginVK != nil && MayWriteDOTRequest(m.TopicSuffix, *m.OriginVK, true) {
+			return nil
+		}
+		return bwe.M(bwe.BadOperation, "free paths are read-only")
+	case TypeLS:
+		if star || plus {
+			return bwe.M(bwe.BadOperation, "you cannot publish, delete or list a URI with a wildcard")
+		}
+	}
+	return nil
+}
+
+//MayWriteDOTRequest is true if vk may persist on the DOT request path
+//suffix, as its requester, or with del may delete it, as its granter or
+//requester
+func MayWriteDOTRequest(suffix string, vk []byte, del bool) bool {
+	granter, requester, ok := util.DOTRequestPath(suffix)
+	if !ok {
+		return false
+	}
+	fvk := crypto.FmtKey(vk)
+	return fvk == requester || (del && fvk == granter)
+}
+
 func (m *Message) Verify(res Resolver) error {
 
 	doret := func(err error) error {
@@ -387,8 +596,12 @@ func (m *Message) Verify(res Resolver) error {
 		return err
 	}
 
-	// Check that the message itself is not expired
-	if m.ExpireTime.Before(time.Now()) {
+	// Check that the message itself is not expired, allowing for clocks
+	// that disagree by objects.ClockSkew
+	if m.ExpireTime.Add(objects.ClockSkew).Before(time.Now()) {
+		if err := m.checkSkew(m.ExpireTime, "message"); err != nil {
+			return doret(err)
+		}
 		return doret(bwe.M(bwe.ExpiredMessage, "message is expired: "+m.ExpireTime.String()))
 	}
 
@@ -397,97 +610,251 @@ func (m *Message) Verify(res Resolver) error {
 		return m.VerifyResult
 	}
 
-	if m.Type != TypeUnsubscribe {
-		pac := m.PrimaryAccessChain
-		//First thing: check the uri for validity
-		urivalid, star, plus, _ := util.AnalyzeSuffix(m.TopicSuffix)
-		//Can't publish to wildcards
-		if (star || plus) && (m.Type == TypePublish || m.Type == TypePersist || m.Type == TypeLS) {
-			return doret(bwe.M(bwe.BadOperation, "you cannot publish or list a URI with a wildcard"))
+	return doret(m.verifyAuthorization(res))
+}
+
+//Expiry returns the time in the message's expiry RO, if it has one. Unlike
+//ExpireTime it is also set on messages that were built rather than loaded
+func (m *Message) Expiry() (time.Time, bool) {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() != objects.ROExpiry {
+			continue
 		}
-		if !urivalid {
-			return doret(bwe.M(bwe.BadURI, "URI is invalid"))
+		ro, _ = objects.ParseRoutingObject(ro)
+		if exp, ok := ro.(*objects.Expiry); ok {
+			return exp.GetExpiry(), true
 		}
+	}
+	return time.Time{}, false
+}
 
-		// Remove to simplify
-		// fromMVK := false
-		// //If message is from MVK it can do whatever it wants
-		// if m.OriginVK != nil && bytes.Equal(*m.OriginVK, m.MVK) {
-		// 	fromMVK = true
-		// 	goto endperm
-		// }
+//Timestamp returns the first timestamp RO in the message with a valid
+//signature. Anyone can sign a timestamp, so it is only used to explain
+//why something expired, never to accept it
+func (m *Message) Timestamp() (*objects.Timestamp, bool) {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() != objects.ROTimestamp {
+			continue
+		}
+		ro, _ = objects.ParseRoutingObject(ro)
+		if ts, ok := ro.(*objects.Timestamp); ok && ts.SigValid() {
+			return ts, true
+		}
+	}
+	return nil, false
+}
 
-		//These will be populated by the permissions search process
-		//only use them if you don't jump to endperm
+//checkSkew is called when something that expired at expiry has expired
+//by this router's clock. If the message's timestamp says the clock is
+//ahead by more than objects.ClockSkew, and the thing had not expired at the
+//time of the timestamp, it returns ClockSkewSuspected
+func (m *Message) checkSkew(expiry time.Time, what string) error {
+	ts, ok := m.Timestamp()
+	if !ok {
+		return nil
+	}
+	ahead := time.Now().Sub(ts.GetTime())
+	if ahead <= objects.ClockSkew || !expiry.After(ts.GetTime()) {
+		return nil
+	}
+	return bwe.M(bwe.ClockSkewSuspected, fmt.Sprintf("%s expired by our clock, but our clock is %s ahead of router %s",
+		what, ahead-ahead%time.Second, crypto.FmtKey(ts.GetVK())))
+}
 
-		//Can't get permissions if there is no access chain
-		if pac == nil {
-			return doret(bwe.M(bwe.BadPermissions, "missing PAC"))
+//ConsumerAckTimeout returns the timeout in the message's consumer ack RO,
+//if it has one
+func (m *Message) ConsumerAckTimeout() (time.Duration, bool) {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() != objects.ROConsumerAck {
+			continue
 		}
+		ro, _ = objects.ParseRoutingObject(ro)
+		if ca, ok := ro.(*objects.ConsumerAck); ok {
+			return ca.GetTimeout(), true
+		}
+	}
+	return 0, false
+}
 
-		pac = ElaborateDChain(pac, res)
-		if pac == nil {
-			return doret(bwe.M(bwe.Unresolvable, "could not elaborate the PAC hash"))
+//IdempotencyKey returns the key in the message's idempotency key RO, if
+//it has one
+func (m *Message) IdempotencyKey() (string, bool) {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() != objects.ROIdempotencyKey {
+			continue
 		}
+		ro, _ = objects.ParseRoutingObject(ro)
+		if ik, ok := ro.(*objects.IdempotencyKey); ok {
+			return ik.GetKey(), true
+		}
+	}
+	return "", false
+}
 
-		// not needed because we call getdot on each hash below
-		// resolved_ok := ResolveDotsInDChain(pac, m.RoutingObjects, res)
-		// 	if !ok {
-		// 		rverr = bwe.M(bwe.Unresolvable, "could not elaborate all DOTs in the PAC")
-		// 		goto endperm
-		// 	}
+//Verified is true if Verify has been called on the message and it passed
+func (m *Message) Verified() bool {
+	return m.checked && m.VerifyResult == nil
+}
 
-		for i := 0; i < pac.NumHashes(); i++ {
-			di, state, err := res.ResolveDOT(pac.GetDotHash(i))
-			if err != nil {
-				return doret(bwe.WrapM(bwe.BadPermissions, "Could not verify DOT", err))
-			}
-			if state != StateValid {
-				return doret(bwe.M(bwe.BadPermissions, fmt.Sprintf("PAC DOT %d invalid: %s", i, res.StateToString(state))))
-			}
-			pac.SetDOT(i, di)
-		}
+//Reverify checks the message's chain and signature again, ignoring the
+//cached result of Verify and the expiry of the message itself. It is used
+//to check that a long lived operation such as a subscription is still
+//authorized after the DOTs it relies on change
+func (m *Message) Reverify(res Resolver) error {
+	return m.verifyAuthorization(res)
+}
 
-		//Check the signature of all the dots. This also checks that their topics are
-		//well formed
-		if !pac.CheckAllSigs() {
-			return doret(bwe.M(bwe.InvalidSig, "PAC contained invalid DOTs (sig)"))
+func (m *Message) verifyAuthorization(res Resolver) error {
+	m.Waived = nil
+	if m.Type != TypeUnsubscribe && util.IsFreePath(m.TopicSuffix) {
+		if err := m.verifyFreePath(res); err != nil {
+			return err
 		}
-
-		//Next check the chain is connected end to end, check the TTL and construct
-		//the merged topic
-		azErr, azMVK, azURI, _, _, _, azOVK := AnalyzeAccessDOTChain(int(m.Type), m.TopicSuffix, pac)
-		if azErr != nil {
-			return doret(azErr)
+	} else if m.Type != TypeUnsubscribe {
+		var pol VerifyPolicy
+		if pr, ok := res.(PolicyResolver); ok {
+			pol = pr.VerifyPolicy()
 		}
-		m.MergedTopic = azURI
-
-		//Check if this is an ALL grant and we don't have an origin VK
-		if bytes.Equal(azOVK, util.EverybodySlice) {
-			if m.OriginVK == nil {
-				return doret(bwe.M(bwe.NoOrigin, "allgrant with no OVK ro"))
-			}
-		} else {
-			if m.OriginVK == nil {
-				m.OriginVK = &azOVK
+		if err := m.verifyChain(res, pol); err != nil {
+			if !pol.AuditOnly || bwe.ClassOf(bwe.AsBW(err).Code) != bwe.ClassAuthorization {
+				//Nothing was waived if the message is rejected anyway
+				m.Waived = nil
+				return err
 			}
+			m.Waived = err
 		}
-		//Also check chain MVK matches message
-		if !bytes.Equal(m.MVK, azMVK) {
-			return doret(bwe.M(bwe.MVKMismatch, "chain namespace doesn't match message"))
-		}
-
-	} //end unsub
+	}
 
 	//I don't think this can happen
 	if m.OriginVK == nil {
-		return doret(bwe.M(bwe.NoOrigin, "missing origin VK on message"))
+		return bwe.M(bwe.NoOrigin, "missing origin VK on message")
 	}
 
 	//Now check if the signature is correct
 	if !crypto.VerifyBlob(*m.OriginVK, m.Signature, m.Encoded[:m.SigCoverEnd]) {
-		return doret(bwe.M(bwe.InvalidSig, "message signature invalid"))
+		return bwe.M(bwe.InvalidSig, "message signature invalid")
+	}
+
+	return nil
+}
+
+//SigValid is true if the message is signed by its origin. Unlike Verify it
+//does not check the chain or the expiry
+func (m *Message) SigValid() bool {
+	ovk := m.originVK()
+	return ovk != nil && crypto.VerifyBlob(ovk, m.Signature, m.Encoded[:m.SigCoverEnd])
+}
+
+//originVK is the VK of the entity that sent the message: the origin VK RO
+//if there is one, otherwise the receiver of an elaborated chain. It is nil
+//for messages that have neither
+func (m *Message) originVK() []byte {
+	if m == nil {
+		return nil
+	}
+	if m.OriginVK != nil {
+		return *m.OriginVK
+	}
+	if pac := m.PrimaryAccessChain; pac != nil && pac.IsElaborated() {
+		return pac.GetReceiverVK()
+	}
+	return nil
+}
+
+//verifyChain checks that the message's primary access chain authorises
+//it, with the relaxations in pol
+func (m *Message) verifyChain(res Resolver, pol VerifyPolicy) error {
+	pac := m.PrimaryAccessChain
+	//First thing: check the uri for validity
+	star, plus, _, uerr := util.AnalyzeSuffixDetailed(m.TopicSuffix)
+	if uerr != nil {
+		return bwe.WrapC(bwe.BadURI, uerr)
+	}
+	//Can't publish to wildcards
+	if (star || plus) && (m.Type == TypePublish || m.Type == TypePersist || m.Type == TypeLS || m.Type == TypeDelete) {
+		return bwe.M(bwe.BadOperation, "you cannot publish, delete or list a URI with a wildcard")
 	}
 
-	return doret(nil)
+	// Remove to simplify
+	// fromMVK := false
+	// //If message is from MVK it can do whatever it wants
+	// if m.OriginVK != nil && bytes.Equal(*m.OriginVK, m.MVK) {
+	// 	fromMVK = true
+	// 	goto endperm
+	// }
+
+	//These will be populated by the permissions search process
+	//only use them if you don't jump to endperm
+
+	//Can't get permissions if there is no access chain
+	if pac == nil {
+		return bwe.M(bwe.BadPermissions, "missing PAC")
+	}
+
+	//A sender that elaborated its chain fully carries the DOTs, which
+	//saves resolving the chain hash. The state of each DOT still comes
+	//from the resolver below, as it is not carried
+	pac = ResolveDotsInDChain(pac, m.RoutingObjects, res)
+	if pac == nil {
+		return bwe.M(bwe.Unresolvable, "could not elaborate the PAC hash")
+	}
+
+	for i := 0; i < pac.NumHashes(); i++ {
+		di, state, err := res.ResolveDOT(pac.GetDotHash(i))
+		if err != nil {
+			return bwe.WrapM(bwe.BadPermissions, "Could not verify DOT", err)
+		}
+		switch {
+		case state == StateExpired && di != nil && pol.SkipExpiry:
+			m.Waived = bwe.M(bwe.ExpiredDOT, fmt.Sprintf("PAC DOT %d expired", i))
+		case state == StateUnknown && pol.AllowUnresolvable:
+			//Without the DOT there is nothing to analyse, so only its state
+			//can be waived, never the DOT itself
+			if di == nil {
+				di = pac.GetDOT(i)
+			}
+			if di == nil {
+				return bwe.M(bwe.Unresolvable, fmt.Sprintf("PAC DOT %d unresolvable and not carried", i))
+			}
+			m.Waived = bwe.M(bwe.Unresolvable, fmt.Sprintf("PAC DOT %d unresolvable", i))
+		case state == StateExpired && di != nil && di.IsExpired():
+			if err := m.checkSkew(*di.GetExpiry(), fmt.Sprintf("PAC DOT %d", i)); err != nil {
+				return err
+			}
+			fallthrough
+		case state != StateValid:
+			return bwe.M(bwe.BadPermissions, fmt.Sprintf("PAC DOT %d invalid: %s", i, res.StateToString(state)))
+		}
+		pac.SetDOT(i, di)
+	}
+
+	//Check the signature of all the dots. This also checks that their topics are
+	//well formed
+	if !pac.CheckAllSigs() {
+		return bwe.M(bwe.InvalidSig, "PAC contained invalid DOTs (sig)")
+	}
+
+	//Next check the chain is connected end to end, check the TTL and construct
+	//the merged topic
+	azErr, azMVK, azURI, _, _, _, azOVK := AnalyzeAccessDOTChain(int(m.Type), m.TopicSuffix, pac)
+	if azErr != nil {
+		return azErr
+	}
+	m.MergedTopic = azURI
+
+	//Check if this is an ALL grant and we don't have an origin VK
+	if bytes.Equal(azOVK, util.EverybodySlice) {
+		if m.OriginVK == nil {
+			return bwe.M(bwe.NoOrigin, "allgrant with no OVK ro")
+		}
+	} else {
+		if m.OriginVK == nil {
+			m.OriginVK = &azOVK
+		}
+	}
+	//Also check chain MVK matches message
+	if !bytes.Equal(m.MVK, azMVK) {
+		return bwe.M(bwe.MVKMismatch, "chain namespace doesn't match message")
+	}
+	return nil
 }
@@ -27,6 +27,7 @@ package core
 
 import (
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"strings"
 	"sync"
@@ -37,6 +38,7 @@ import (
 
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util/bwe"
 )
 
@@ -74,12 +76,16 @@ func NewSnode() *subTreeNode {
 
 //This identifies an individual client subscription
 type subscription struct {
+	//Messages handled, first for 64 bit alignment
+	delivered uint64
 	subid     UniqueMessageID
 	handler   func(m *Message)
 	client    *Client
 	tap       bool
 	uri       string
 	created   time.Time
+	msg       *Message //checked again by RecheckSubscriptions
+	filter    *objects.SubscriptionFilter
 	mqueue    chan *Message
 	ctx       context.Context
 	ctxcancel func()
@@ -100,6 +106,26 @@ type Terminus struct {
 	//map a subscription ID onto the snode that contains it
 	rstree_lock sync.RWMutex
 	rstree      map[UniqueMessageID]*subTreeNode
+
+	//consumer limited messages that may still be NACKed, by message ID
+	ackmu sync.Mutex
+	acks  map[UniqueMessageID]*pendingAck
+
+	//what has been published and persisted on each namespace
+	usage usageTable
+
+	//Persist holds the lock its topic hashes to from numbering the message
+	//until it is queued to the subscribers
+	persistmu [persistLocks]sync.Mutex
+}
+
+//persistLocks is how many locks the topics are spread over
+const persistLocks = 64
+
+func (tm *Terminus) persistLock(topic string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return &tm.persistmu[h.Sum32()%persistLocks]
 }
 
 //For a node in the tree, match the given subscription string and call visitor
@@ -200,6 +226,7 @@ func CreateTerminus() *Terminus {
 	rv.cmap = make(map[clientid]*Client)
 	rv.stree = NewSnode()
 	rv.rstree = make(map[UniqueMessageID]*subTreeNode)
+	rv.acks = make(map[UniqueMessageID]*pendingAck)
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
@@ -231,6 +258,79 @@ func CreateTerminus() *Terminus {
 	return rv
 }
 
+//SubscriptionInfo describes a subscription in the terminus
+type SubscriptionInfo struct {
+	ID      UniqueMessageID
+	Client  string
+	URI     string
+	Tap     bool
+	Created time.Time
+	//The entity that subscribed, nil if it is not known
+	OriginVK []byte
+	//How many messages have been delivered on it
+	Messages uint64
+}
+
+//Clients returns the names of the connected clients
+func (tm *Terminus) Clients() []string {
+	tm.c_maplock.RLock()
+	defer tm.c_maplock.RUnlock()
+	rv := make([]string, 0, len(tm.cmap))
+	for _, c := range tm.cmap {
+		rv = append(rv, c.name)
+	}
+	return rv
+}
+
+//Subscriptions returns the active subscriptions and taps
+func (tm *Terminus) Subscriptions() []SubscriptionInfo {
+	tm.rstree_lock.RLock()
+	defer tm.rstree_lock.RUnlock()
+	rv := make([]SubscriptionInfo, 0, len(tm.rstree))
+	for mid, stn := range tm.rstree {
+		sub := stn.subForId(mid)
+		if sub == nil {
+			continue
+		}
+		rv = append(rv, SubscriptionInfo{
+			ID:       mid,
+			Client:   sub.client.name,
+			URI:      sub.uri,
+			Tap:      sub.tap,
+			Created:  sub.created,
+			OriginVK: sub.msg.originVK(),
+			Messages: atomic.LoadUint64(&sub.delivered),
+		})
+	}
+	return rv
+}
+
+//RecheckSubscriptions calls check with the subscribe message of every
+//active subscription and tap, and ends those for which it returns an error.
+//It returns the number of subscriptions ended
+func (tm *Terminus) RecheckSubscriptions(check func(m *Message) error) int {
+	tm.rstree_lock.RLock()
+	subs := make([]*subscription, 0, len(tm.rstree))
+	for mid, stn := range tm.rstree {
+		if sub := stn.subForId(mid); sub != nil {
+			subs = append(subs, sub)
+		}
+	}
+	tm.rstree_lock.RUnlock()
+	ended := 0
+	for _, sub := range subs {
+		if sub.msg == nil || sub.ctx.Err() != nil {
+			continue
+		}
+		if err := check(sub.msg); err != nil {
+			fmt.Printf("UNSUBSCRIBING %v::%s NO LONGER AUTHORIZED: %v\n", sub.client.name, sub.uri, err)
+			sub.ctxcancel()
+			ended++
+		}
+	}
+	return ended
+}
+
 func (tm *Terminus) CreateClient(ctx context.Context, name string) *Client {
 	cid := clientid(atomic.AddUint32(&tm.cid_head, 1))
 	c := Client{cid: cid, tm: tm, name: name, ctx: ctx}
@@ -262,7 +362,9 @@ func (tm *Terminus) CreateClient(ctx context.Context, name string) *Client {
 	return &c
 }
 
-func (cl *Client) Publish(m *Message) {
+//Publish delivers the message to the matching subscriptions, and returns
+//how many consumers it was delivered to. Taps are not counted
+func (cl *Client) Publish(m *Message) int {
 	var clientlist []*subscription
 	cl.tm.RMatchSubs(m.Topic, func(s *subscription) {
 		//fmt.Printf("sub match\n")
@@ -278,19 +380,33 @@ func (cl *Client) Publish(m *Message) {
 			clientlist[i], clientlist[j] = clientlist[j], clientlist[i]
 		}
 	}
-	count := 0 //how many we delivered it to
+	cl.tm.usage.published(m.Topic, len(m.Encoded))
+	count := 0 //how many consumers we delivered it to, taps are not counted
+	delivered := []UniqueMessageID{}
 	for _, sub := range clientlist {
 		if !sub.tap && m.Consumers != 0 && count >= m.Consumers {
 			continue //We hit limit
 		}
+		if sub.filter != nil && !FilterAccepts(sub.filter, m) {
+			continue
+		}
 		select {
 		case sub.mqueue <- m:
+			if !sub.tap {
+				count++
+				delivered = append(delivered, sub.subid)
+			}
 		default:
 			fmt.Printf("UNSUBSCRIBING %v::%s QUEUE FULL\n", sub.client.name, sub.uri)
 			sub.ctxcancel()
 		}
-		count++
 	}
+	if m.Consumers != 0 {
+		if timeout, ok := m.ConsumerAckTimeout(); ok {
+			cl.tm.addPendingAck(m, delivered, timeout)
+		}
+	}
+	return count
 }
 
 //Subscribe should bind the given handler with the given topic
@@ -305,12 +421,25 @@ func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)
 		mqueue:    make(chan *Message, 4096),
 		created:   time.Now(),
 		uri:       m.Topic,
+		msg:       m,
 		ctx:       cctx,
 		ctxcancel: cancel}
+	if f, ok := m.SubscriptionFilter(); ok {
+		newsub.filter = f
+	}
 
 	go func() {
+		//The subscription ends when its expiry RO says it does
+		var expired <-chan time.Time
+		if exp, ok := m.Expiry(); ok {
+			t := time.NewTimer(exp.Sub(time.Now()))
+			defer t.Stop()
+			expired = t.C
+		}
 		for {
 			select {
+			case <-expired:
+				newsub.ctxcancel()
 			case <-newsub.ctx.Done():
 				newsub.client.Unsubscribe(newsub.subid)
 				newsub.handler(nil)
@@ -321,6 +450,7 @@ func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)
 					newsub.handler(nil)
 					return
 				}
+				atomic.AddUint64(&newsub.delivered, 1)
 				newsub.handler(mm)
 			}
 		}
@@ -333,9 +463,50 @@ func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)
 	return subid
 }
 
-func (cl *Client) Persist(m *Message) {
-	store.PutMessage(m.Topic, m.Encoded)
-	cl.Publish(m)
+//Persist stores the message as the one on its topic, numbering it, and
+//then delivers it like Publish. Concurrent persists on a topic are
+//delivered in the order they are numbered. A message that already has a
+//PersistSeq, such as one replicated from another designated router, keeps
+//it as Restore does
+func (cl *Client) Persist(m *Message) int {
+	mu := cl.tm.persistLock(m.Topic)
+	mu.Lock()
+	defer mu.Unlock()
+	old, _ := store.GetExactMessage(m.Topic)
+	if m.PersistSeq != 0 {
+		store.PutNumberedMessage(m.Topic, m.Encoded, m.PersistSeq)
+		//It is left without a number if the topic is already past it
+		m.PersistSeq, _ = store.GetSequence(m.Topic, m.Encoded)
+	} else {
+		m.PersistSeq = store.PutSequencedMessage(m.Topic, m.Encoded)
+	}
+	cl.tm.usage.persisted(m.Topic, len(m.Encoded)-len(old))
+	return cl.Publish(m)
+}
+
+//Restore persists a message from a backup without delivering it to the
+//subscribers on its topic. If the message has a PersistSeq it keeps it,
+//and numbering on the topic goes on from there
+func (tm *Terminus) Restore(m *Message) {
+	old, _ := store.GetExactMessage(m.Topic)
+	if m.PersistSeq != 0 {
+		store.PutNumberedMessage(m.Topic, m.Encoded, m.PersistSeq)
+	} else {
+		store.PutMessage(m.Topic, m.Encoded)
+	}
+	tm.usage.persisted(m.Topic, len(m.Encoded)-len(old))
+}
+
+//Delete replaces the message persisted on the topic with a tombstone,
+//which is the delete message itself. It is ordered with the persists on
+//the topic like they are with each other
+func (cl *Client) Delete(m *Message) {
+	mu := cl.tm.persistLock(m.Topic)
+	mu.Lock()
+	defer mu.Unlock()
+	old, _ := store.GetExactMessage(m.Topic)
+	store.DeleteMessage(m.Topic, m.Encoded)
+	cl.tm.usage.persisted(m.Topic, -len(old))
 }
 
 func (cl *Client) Query(m *Message, cb func(m *Message)) {
@@ -349,6 +520,7 @@ func (cl *Client) Query(m *Message, cb func(m *Message)) {
 		if err != nil {
 			panic("Not expecting error from unpersist: " + err.Error())
 		}
+		m.PersistSeq, _ = store.GetSequence(m.Topic, sm.Body)
 		if !m.ExpireTime.Before(time.Now()) {
 			cb(m)
 		}
@@ -372,6 +544,61 @@ func (cl *Client) List(m *Message, cb func(s string, ok bool)) {
 	}
 }
 
+//ListTree lists the nodes below the topic down to the given depth (zero
+//is unlimited). cb is called with nil at the end
+func (cl *Client) ListTree(m *Message, depth int, cb func(e *store.ListEntry)) {
+	rc := make(chan store.ListEntry, 3)
+	go store.ListTree(m.Topic, depth, rc)
+	for e := range rc {
+		e := e
+		cb(&e)
+	}
+	cb(nil)
+}
+
+//QueryPage is Query for up to limit results, in URI order, starting after
+//the cursor. It returns the cursor for the next page, or "" if there are
+//no more results. Expired messages are skipped, so a page may be short
+func (cl *Client) QueryPage(m *Message, cursor string, limit int, cb func(m *Message)) (string, error) {
+	after, err := store.DecodeCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	sms, more := store.GetMatchingPage(m.Topic, after, limit)
+	for _, sm := range sms {
+		m, err := LoadMessage(sm.Body)
+		if err != nil {
+			panic("Not expecting error from unpersist: " + err.Error())
+		}
+		m.PersistSeq, _ = store.GetSequence(m.Topic, sm.Body)
+		if !m.ExpireTime.Before(time.Now()) {
+			cb(m)
+		}
+	}
+	if !more {
+		return "", nil
+	}
+	return store.EncodeCursor(sms[len(sms)-1].URI), nil
+}
+
+//ListPage is List for up to limit children, in order, starting after the
+//cursor. It returns the cursor for the next page, or "" if there are no
+//more children
+func (cl *Client) ListPage(m *Message, cursor string, limit int, cb func(s string)) (string, error) {
+	after, err := store.DecodeCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	children, more := store.ListChildrenPage(m.Topic, after, limit)
+	for _, c := range children {
+		cb(c)
+	}
+	if !more {
+		return "", nil
+	}
+	return store.EncodeCursor(children[len(children)-1]), nil
+}
+
 //func (cl *Client) Destroy() {
 //delete all subscriptions
 // cl.tm.rstree_lock.Lock()
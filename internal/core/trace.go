@@ -0,0 +1,102 @@
+package core
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+)
+
+//vk, timestamp, queue latency and signature
+const traceHopLen = 32 + 8 + 8 + 64
+
+//TraceHop records a router handling a traced message. Hops are appended
+//after the message signature, so they are not covered by it. Instead each
+//hop is signed by its router over the message signature and the hop
+type TraceHop struct {
+	RouterVK []byte
+	Time     time.Time
+	//How long the message waited in the router before this hop
+	Queued    time.Duration
+	Signature []byte
+}
+
+//IsTraced is true if the publisher included a trace RO
+func (m *Message) IsTraced() bool {
+	for _, ro := range m.RoutingObjects {
+		if ro.GetRONum() == objects.ROTrace {
+			return true
+		}
+	}
+	return false
+}
+
+//TraceHops returns the hops appended to the message, in order
+func (m *Message) TraceHops() []TraceHop {
+	rv := []TraceHop{}
+	start := m.SigCoverEnd + 64
+	if start <= 0 || len(m.Encoded) < start {
+		return rv
+	}
+	b := m.Encoded[start:]
+	for len(b) >= traceHopLen {
+		rv = append(rv, TraceHop{
+			RouterVK:  b[:32],
+			Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(b[32:]))),
+			Queued:    time.Duration(binary.LittleEndian.Uint64(b[40:])),
+			Signature: b[48:traceHopLen],
+		})
+		b = b[traceHopLen:]
+	}
+	return rv
+}
+
+//Valid checks the hop's signature
+func (h *TraceHop) Valid(m *Message) bool {
+	blob := make([]byte, 0, 64+48)
+	blob = append(blob, m.Signature...)
+	blob = append(blob, h.encodeUnsigned()...)
+	return crypto.VerifyBlob(h.RouterVK, h.Signature, blob)
+}
+
+func (h *TraceHop) encodeUnsigned() []byte {
+	b := make([]byte, 48)
+	copy(b, h.RouterVK)
+	binary.LittleEndian.PutUint64(b[32:], uint64(h.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(b[40:], uint64(h.Queued))
+	return b
+}
+
+//WithTraceHop returns a copy of the message with a hop for the router with
+//the given keys appended. Messages without a trace RO are returned as is
+func (m *Message) WithTraceHop(sk []byte, vk []byte, queued time.Duration) *Message {
+	if !m.IsTraced() {
+		return m
+	}
+	h := TraceHop{RouterVK: vk, Time: time.Now(), Queued: queued}
+	hb := h.encodeUnsigned()
+	blob := make([]byte, 0, 64+48)
+	blob = append(blob, m.Signature...)
+	blob = append(blob, hb...)
+	sig := make([]byte, 64)
+	crypto.SignBlob(sk, vk, sig, blob)
+	nm := *m
+	nm.Encoded = make([]byte, 0, len(m.Encoded)+traceHopLen)
+	nm.Encoded = append(nm.Encoded, m.Encoded...)
+	nm.Encoded = append(nm.Encoded, hb...)
+	nm.Encoded = append(nm.Encoded, sig...)
+	return &nm
+}
+
+//LastTraceHopBy returns when the router last appended a hop, or the zero
+//time if it has not
+func (m *Message) LastTraceHopBy(vk []byte) time.Time {
+	hops := m.TraceHops()
+	for i := len(hops) - 1; i >= 0; i-- {
+		if string(hops[i].RouterVK) == string(vk) {
+			return hops[i].Time
+		}
+	}
+	return time.Time{}
+}
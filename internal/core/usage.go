@@ -0,0 +1,198 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/internal/store"
+)
+
+//UsageWindow is the period the windowed counters of NamespaceUsage cover,
+//which quotas on the rate of publishing are checked against
+const UsageWindow = time.Hour
+
+//NamespaceUsage is what the terminus has handled on a namespace
+type NamespaceUsage struct {
+	//The namespace, as it appears in topics
+	Namespace string
+	//Messages published or persisted, and their encoded bytes, since the
+	//router started
+	Messages uint64
+	Bytes    uint64
+	//The same, in the current window
+	WindowStart    time.Time
+	WindowMessages uint64
+	WindowBytes    uint64
+	//The bytes of the messages persisted on the namespace now. It is
+	//approximate until ScanPersisted has finished
+	Persisted int64
+}
+
+//maxTrackedTopics is how many topics TopicUsage is kept for. Beyond it,
+//the topic with the fewest messages is forgotten to make room
+const maxTrackedTopics = 4096
+
+//TopicUsage is what the terminus has handled on a topic since the router
+//started, or since the topic was last forgotten
+type TopicUsage struct {
+	Topic    string
+	Messages uint64
+	Bytes    uint64
+}
+
+type usageTable struct {
+	mu     sync.Mutex
+	ns     map[string]*NamespaceUsage
+	topics map[string]*TopicUsage
+}
+
+//namespaceOf is the namespace part of a topic
+func namespaceOf(topic string) string {
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		return topic[:i]
+	}
+	return topic
+}
+
+//get returns the usage of ns, creating it. Lock must be held
+func (u *usageTable) get(ns string) *NamespaceUsage {
+	if u.ns == nil {
+		u.ns = make(map[string]*NamespaceUsage)
+	}
+	nu, ok := u.ns[ns]
+	if !ok {
+		nu = &NamespaceUsage{Namespace: ns}
+		u.ns[ns] = nu
+	}
+	return nu
+}
+
+//roll starts a new window if the current one is over. Lock must be held
+func (nu *NamespaceUsage) roll(now time.Time) {
+	if now.Sub(nu.WindowStart) >= UsageWindow {
+		nu.WindowStart = now.Truncate(UsageWindow)
+		nu.WindowMessages = 0
+		nu.WindowBytes = 0
+	}
+}
+
+func (u *usageTable) published(topic string, size int) {
+	u.mu.Lock()
+	nu := u.get(namespaceOf(topic))
+	nu.roll(time.Now())
+	nu.Messages++
+	nu.Bytes += uint64(size)
+	nu.WindowMessages++
+	nu.WindowBytes += uint64(size)
+	tu := u.topic(topic)
+	tu.Messages++
+	tu.Bytes += uint64(size)
+	u.mu.Unlock()
+}
+
+//topic returns the usage of a topic, creating it. Lock must be held
+func (u *usageTable) topic(topic string) *TopicUsage {
+	if u.topics == nil {
+		u.topics = make(map[string]*TopicUsage)
+	}
+	tu, ok := u.topics[topic]
+	if ok {
+		return tu
+	}
+	if len(u.topics) >= maxTrackedTopics {
+		var least *TopicUsage
+		for _, t := range u.topics {
+			if least == nil || t.Messages < least.Messages {
+				least = t
+			}
+		}
+		delete(u.topics, least.Topic)
+	}
+	tu = &TopicUsage{Topic: topic}
+	u.topics[topic] = tu
+	return tu
+}
+
+func (u *usageTable) persisted(topic string, delta int) {
+	u.mu.Lock()
+	u.get(namespaceOf(topic)).Persisted += int64(delta)
+	u.mu.Unlock()
+}
+
+//Usage returns what has been handled on the namespace, as it appears in
+//topics (the base64 VK)
+func (tm *Terminus) Usage(ns string) NamespaceUsage {
+	tm.usage.mu.Lock()
+	defer tm.usage.mu.Unlock()
+	nu := tm.usage.get(ns)
+	nu.roll(time.Now())
+	return *nu
+}
+
+//AllUsage returns the usage of every namespace the terminus has handled
+//messages on, ordered by namespace
+func (tm *Terminus) AllUsage() []NamespaceUsage {
+	tm.usage.mu.Lock()
+	now := time.Now()
+	rv := make([]NamespaceUsage, 0, len(tm.usage.ns))
+	for _, nu := range tm.usage.ns {
+		nu.roll(now)
+		rv = append(rv, *nu)
+	}
+	tm.usage.mu.Unlock()
+	sort.Sort(usageByNamespace(rv))
+	return rv
+}
+
+//TopUsage returns the n topics with the most messages, most first
+func (tm *Terminus) TopUsage(n int) []TopicUsage {
+	tm.usage.mu.Lock()
+	rv := make([]TopicUsage, 0, len(tm.usage.topics))
+	for _, tu := range tm.usage.topics {
+		rv = append(rv, *tu)
+	}
+	tm.usage.mu.Unlock()
+	sort.Sort(usageByMessages(rv))
+	if len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+type usageByNamespace []NamespaceUsage
+
+func (s usageByNamespace) Len() int           { return len(s) }
+func (s usageByNamespace) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s usageByNamespace) Less(i, j int) bool { return s[i].Namespace < s[j].Namespace }
+
+//ScanPersisted adds up the messages already in the store, so the
+//persisted usage includes those from before the router started. Messages
+//persisted while it runs may be counted twice or not at all
+func (tm *Terminus) ScanPersisted() {
+	sizes := make(map[string]int64)
+	rc := make(chan store.Record, 100)
+	go store.Walk(rc)
+	for r := range rc {
+		if !r.Deleted {
+			sizes[namespaceOf(r.Topic)] += int64(len(r.Value))
+		}
+	}
+	tm.usage.mu.Lock()
+	for ns, size := range sizes {
+		tm.usage.get(ns).Persisted += size
+	}
+	tm.usage.mu.Unlock()
+}
+
+type usageByMessages []TopicUsage
+
+func (s usageByMessages) Len() int      { return len(s) }
+func (s usageByMessages) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s usageByMessages) Less(i, j int) bool {
+	if s[i].Messages != s[j].Messages {
+		return s[i].Messages > s[j].Messages
+	}
+	return s[i].Topic < s[j].Topic
+}
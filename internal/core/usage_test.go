@@ -0,0 +1,54 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNamespaceUsage(t *testing.T) {
+	tm := &Terminus{}
+	tm.usage.published("ns1/a/b", 10)
+	tm.usage.published("ns1/c", 5)
+	tm.usage.published("ns2/a", 1)
+	tm.usage.persisted("ns1/a/b", 10)
+	tm.usage.persisted("ns1/a/b", -4)
+	u := tm.Usage("ns1")
+	if u.Messages != 2 || u.Bytes != 15 || u.WindowMessages != 2 || u.WindowBytes != 15 || u.Persisted != 6 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	all := tm.AllUsage()
+	if len(all) != 2 || all[0].Namespace != "ns1" || all[1].Namespace != "ns2" {
+		t.Fatalf("unexpected namespaces %+v", all)
+	}
+
+	//A new window resets the windowed counters only
+	tm.usage.ns["ns1"].roll(time.Now().Add(UsageWindow))
+	u = tm.Usage("ns1")
+	if u.Messages != 2 || u.WindowMessages != 0 || u.WindowBytes != 0 || u.Persisted != 6 {
+		t.Fatalf("window did not roll: %+v", u)
+	}
+}
+
+func TestTopUsage(t *testing.T) {
+	tm := &Terminus{}
+	tm.usage.published("ns1/a", 1)
+	tm.usage.published("ns1/b", 2)
+	tm.usage.published("ns1/b", 2)
+	tm.usage.published("ns2/c", 3)
+	top := tm.TopUsage(2)
+	if len(top) != 2 || top[0].Topic != "ns1/b" || top[0].Messages != 2 || top[0].Bytes != 4 || top[1].Topic != "ns1/a" {
+		t.Fatalf("unexpected top topics %+v", top)
+	}
+
+	//Past the limit, the quietest topic makes room
+	for i := 0; i < maxTrackedTopics; i++ {
+		tm.usage.published(fmt.Sprintf("ns3/%d", i), 1)
+	}
+	if len(tm.usage.topics) != maxTrackedTopics {
+		t.Fatalf("tracking %d topics", len(tm.usage.topics))
+	}
+	if _, ok := tm.usage.topics["ns1/b"]; !ok {
+		t.Fatalf("busiest topic was forgotten")
+	}
+}
@@ -17,6 +17,8 @@
 
 package db
 
+import "errors"
+
 const (
 	CFDot    = 1
 	CFDChain = 2
@@ -25,16 +27,21 @@ const (
 	CFEntity = 5
 )
 
-/*
+//ErrObjNotFound is returned from GetObject if the object cannot be found
+var ErrObjNotFound = errors.New("Object Not Found")
+
+//BWDB is a key value store with one keyspace per CF. Each storage backend
+//implements it
 type BWDB interface {
-	Initialize(dbname string)
 	PutObject(cf int, key []byte, val []byte)
 	GetObject(cf int, key []byte) ([]byte, error)
 	DeleteObject(cf int, key []byte)
 	Exists(cf int, key []byte) bool
+	//CreateIterator iterates over the keys in the CF that start with prefix,
+	//in key order. An empty prefix iterates over the whole CF
 	CreateIterator(cf int, prefix []byte) BWDBIterator
+	Close() error
 }
-*/
 
 type BWDBIterator interface {
 	Next()
@@ -18,36 +18,16 @@
 package level
 
 import (
-	"errors"
-	"fmt"
 	"os"
 	"path"
 	"strconv"
 
+	"github.com/immesys/bw2/internal/db"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-var doneInit bool
-var dbh []*leveldb.DB
-
-func RawInitialize(dbname string) {
-	if doneInit {
-		return
-	}
-	os.MkdirAll(dbname, 0755)
-	for i := 0; i < CFEntity; i++ {
-		db, err := leveldb.OpenFile(path.Join(dbname, strconv.Itoa(i)), nil)
-		if err != nil {
-			fmt.Println("DB error: ", err)
-			os.Exit(1)
-		}
-		dbh = append(dbh, db)
-	}
-	doneInit = true
-}
-
 const (
 	CFDot    = 1
 	CFDChain = 2
@@ -57,17 +37,39 @@ const (
 )
 
 //ErrObjNotFound is returned from GetObject if the object cannot be found
-var ErrObjNotFound = errors.New("Object Not Found")
+var ErrObjNotFound = db.ErrObjNotFound
+
+//DB is a set of LevelDB databases, one per CF, in numbered directories
+type DB struct {
+	dbh []*leveldb.DB
+}
 
-func PutObject(cf int, key []byte, val []byte) {
-	err := dbh[cf-1].Put(key, val, nil)
+//Open opens (or creates) the databases under dbname
+func Open(dbname string) (*DB, error) {
+	if err := os.MkdirAll(dbname, 0755); err != nil {
+		return nil, err
+	}
+	rv := &DB{}
+	for i := 0; i < CFEntity; i++ {
+		ldb, err := leveldb.OpenFile(path.Join(dbname, strconv.Itoa(i)), nil)
+		if err != nil {
+			rv.Close()
+			return nil, err
+		}
+		rv.dbh = append(rv.dbh, ldb)
+	}
+	return rv, nil
+}
+
+func (d *DB) PutObject(cf int, key []byte, val []byte) {
+	err := d.dbh[cf-1].Put(key, val, nil)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func GetObject(cf int, key []byte) ([]byte, error) {
-	rv, err := dbh[cf-1].Get(key, nil)
+func (d *DB) GetObject(cf int, key []byte) ([]byte, error) {
+	rv, err := d.dbh[cf-1].Get(key, nil)
 	if err == leveldb.ErrNotFound {
 		return nil, ErrObjNotFound
 	}
@@ -77,25 +79,35 @@ func GetObject(cf int, key []byte) ([]byte, error) {
 	return rv, nil
 }
 
-func DeleteObject(cf int, key []byte) {
-	dbh[cf-1].Delete(key, nil)
+func (d *DB) DeleteObject(cf int, key []byte) {
+	d.dbh[cf-1].Delete(key, nil)
 }
 
-func Exists(cf int, key []byte) bool {
-	rv, err := dbh[cf-1].Has(key, nil)
+func (d *DB) Exists(cf int, key []byte) bool {
+	rv, err := d.dbh[cf-1].Has(key, nil)
 	if err != nil {
 		panic(err)
 	}
 	return rv
 }
 
+func (d *DB) Close() error {
+	var rerr error
+	for _, ldb := range d.dbh {
+		if err := ldb.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
 type Iterator struct {
 	prefix []byte
 	state  iterator.Iterator
 }
 
-func CreateIterator(cf int, prefix []byte) *Iterator {
-	it := dbh[cf-1].NewIterator(util.BytesPrefix(prefix), nil)
+func (d *DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	it := d.dbh[cf-1].NewIterator(util.BytesPrefix(prefix), nil)
 	it.Next()
 	return &Iterator{prefix: prefix, state: it}
 }
@@ -0,0 +1,446 @@
+//Package mdns is a minimal multicast DNS (RFC 6762) responder and querier
+//for advertising and finding DNS-SD services on the local network. It only
+//answers PTR queries for the services it advertises, and only queries for
+//service instances, which is all that is needed to find nearby routers
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The mDNS group and port
+var groupAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN = 1
+	//In questions, asks for a unicast response. In answers, tells caches
+	//to replace what they have
+	classTopBit = 0x8000
+
+	flagResponse = 0x8400
+
+	//How long others may cache our records
+	recordTTL = 120
+)
+
+var errMalformed = errors.New("malformed mDNS packet")
+
+//Service is a service instance to advertise, like
+//<Instance>._bw2._tcp.local.
+type Service struct {
+	Instance string
+	//The service type, like _bw2._tcp
+	Service string
+	Port    uint16
+	TXT     []string
+	//Defaults to the hostname
+	Host string
+}
+
+//Entry is a service instance that answered a query
+type Entry struct {
+	Instance string
+	//The address that answered with the port in the SRV record
+	Addr string
+	TXT  []string
+}
+
+//TXTValue returns the value of key=value in the entry's TXT record
+func (e *Entry) TXTValue(key string) (string, bool) {
+	for _, t := range e.TXT {
+		if strings.HasPrefix(t, key+"=") {
+			return t[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+type record struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+	//Decoded from data for PTR and SRV
+	target string
+	port   uint16
+}
+
+type message struct {
+	id        uint16
+	flags     uint16
+	questions []question
+	answers   []record
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if l == "" {
+			continue
+		}
+		if len(l) > 63 {
+			l = l[:63]
+		}
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		b = appendUint16(b, q.qtype)
+		b = appendUint16(b, q.class)
+	}
+	for _, r := range m.answers {
+		b = appendName(b, r.name)
+		b = appendUint16(b, r.rtype)
+		b = appendUint16(b, r.class)
+		b = append(b, byte(r.ttl>>24), byte(r.ttl>>16), byte(r.ttl>>8), byte(r.ttl))
+		b = appendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+//readName reads a possibly compressed name at off, and returns it with the
+//offset after it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	//Bound the number of pointers followed so loops end
+	for jumps := 0; jumps < 32; {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		case l&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errMalformed
+}
+
+func decode(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(b[0:]),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	//Authority and additional records are answers as far as we care
+	rrs := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+4 > len(b) {
+			return nil, errMalformed
+		}
+		m.questions = append(m.questions, question{
+			name:  name,
+			qtype: binary.BigEndian.Uint16(b[n:]),
+			class: binary.BigEndian.Uint16(b[n+2:]),
+		})
+		off = n + 4
+	}
+	for i := 0; i < rrs; i++ {
+		name, n, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+10 > len(b) {
+			return nil, errMalformed
+		}
+		r := record{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(b[n:]),
+			class: binary.BigEndian.Uint16(b[n+2:]),
+			ttl:   binary.BigEndian.Uint32(b[n+4:]),
+		}
+		ln := int(binary.BigEndian.Uint16(b[n+8:]))
+		start := n + 10
+		if start+ln > len(b) {
+			return nil, errMalformed
+		}
+		r.data = b[start : start+ln]
+		switch r.rtype {
+		case typePTR:
+			if r.target, _, err = readName(b, start); err != nil {
+				return nil, err
+			}
+		case typeSRV:
+			if ln < 7 {
+				return nil, errMalformed
+			}
+			r.port = binary.BigEndian.Uint16(b[start+4:])
+			if r.target, _, err = readName(b, start+6); err != nil {
+				return nil, err
+			}
+		}
+		m.answers = append(m.answers, r)
+		off = start + ln
+	}
+	return m, nil
+}
+
+func txtData(txt []string) []byte {
+	var b []byte
+	for _, t := range txt {
+		if len(t) > 255 {
+			t = t[:255]
+		}
+		b = append(b, byte(len(t)))
+		b = append(b, t...)
+	}
+	if len(b) == 0 {
+		//A TXT record must have at least one string
+		b = []byte{0}
+	}
+	return b
+}
+
+func parseTXT(data []byte) []string {
+	var rv []string
+	for len(data) > 0 {
+		l := int(data[0])
+		if 1+l > len(data) {
+			break
+		}
+		if l > 0 {
+			rv = append(rv, string(data[1:1+l]))
+		}
+		data = data[1+l:]
+	}
+	return rv
+}
+
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + ".local."
+}
+
+//localIPv4s are the addresses given in A records for the host
+func localIPv4s() []net.IP {
+	var rv []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipn.IP.To4(); ip4 != nil {
+			rv = append(rv, ip4)
+		}
+	}
+	return rv
+}
+
+//response is the answer to a query for the service
+func (s *Service) response(id uint16) *message {
+	svc := fqdn(s.Service)
+	inst := s.Instance + "." + svc
+	host := fqdn(s.Host)
+	srv := []byte{0, 0, 0, 0, byte(s.Port >> 8), byte(s.Port)}
+	m := &message{id: id, flags: flagResponse, answers: []record{
+		{name: svc, rtype: typePTR, class: classIN, ttl: recordTTL, data: appendName(nil, inst)},
+		{name: inst, rtype: typeSRV, class: classIN | classTopBit, ttl: recordTTL, data: appendName(srv, host)},
+		{name: inst, rtype: typeTXT, class: classIN | classTopBit, ttl: recordTTL, data: txtData(s.TXT)},
+	}}
+	for _, ip := range localIPv4s() {
+		m.answers = append(m.answers, record{name: host, rtype: typeA, class: classIN | classTopBit, ttl: recordTTL, data: []byte(ip)})
+	}
+	return m
+}
+
+//Server answers queries for an advertised service until it is closed
+type Server struct {
+	s    *Service
+	conn *net.UDPConn
+	once sync.Once
+}
+
+//Advertise answers mDNS queries for the service on the local network
+func Advertise(s *Service) (*Server, error) {
+	if s.Host == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		//Names under .local have a single label
+		s.Host = strings.SplitN(h, ".", 2)[0]
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{s: s, conn: conn}
+	go srv.serve()
+	//Announce ourselves so that browsers see us without asking
+	srv.conn.WriteToUDP(s.response(0).encode(), groupAddr)
+	return srv, nil
+}
+
+//Close stops answering queries
+func (srv *Server) Close() error {
+	var err error
+	srv.once.Do(func() {
+		err = srv.conn.Close()
+	})
+	return err
+}
+
+func (srv *Server) serve() {
+	buf := make([]byte, 9000)
+	svc := fqdn(srv.s.Service)
+	for {
+		n, from, err := srv.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := decode(buf[:n])
+		if err != nil || m.flags&0x8000 != 0 {
+			continue
+		}
+		for _, q := range m.questions {
+			if (q.qtype != typePTR && q.qtype != typeANY) || !strings.EqualFold(q.name, svc) {
+				continue
+			}
+			//Queries from other ports are one-shot queriers that want a
+			//unicast reply with their ID (RFC 6762 6.7)
+			if q.class&classTopBit != 0 || from.Port != groupAddr.Port {
+				srv.conn.WriteToUDP(srv.s.response(m.id).encode(), from)
+			} else {
+				srv.conn.WriteToUDP(srv.s.response(0).encode(), groupAddr)
+			}
+			break
+		}
+	}
+}
+
+//Query asks the local network for instances of the service, such as
+//_bw2._tcp, and returns those that answer within the timeout
+func Query(service string, timeout time.Duration) ([]*Entry, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	svc := fqdn(service)
+	q := &message{questions: []question{{name: svc, qtype: typePTR, class: classIN | classTopBit}}}
+	if _, err := conn.WriteToUDP(q.encode(), groupAddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	found := make(map[string]*Entry)
+	order := []string{}
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			//The deadline ends the query
+			break
+		}
+		m, err := decode(buf[:n])
+		if err != nil || m.flags&0x8000 == 0 {
+			continue
+		}
+		for _, e := range entries(m, svc, from.IP) {
+			k := e.Instance + "/" + e.Addr
+			if _, ok := found[k]; !ok {
+				order = append(order, k)
+			}
+			found[k] = e
+		}
+	}
+	rv := make([]*Entry, 0, len(order))
+	for _, k := range order {
+		rv = append(rv, found[k])
+	}
+	return rv, nil
+}
+
+//entries gets the service instances in a response sent from ip
+func entries(m *message, svc string, ip net.IP) []*Entry {
+	var rv []*Entry
+	for _, p := range m.answers {
+		if p.rtype != typePTR || !strings.EqualFold(p.name, svc) {
+			continue
+		}
+		e := &Entry{Instance: strings.TrimSuffix(p.target, "."+svc)}
+		port := -1
+		for _, r := range m.answers {
+			if !strings.EqualFold(r.name, p.target) {
+				continue
+			}
+			switch r.rtype {
+			case typeSRV:
+				port = int(r.port)
+			case typeTXT:
+				e.TXT = parseTXT(r.data)
+			}
+		}
+		if port < 0 {
+			continue
+		}
+		e.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		rv = append(rv, e)
+	}
+	return rv
+}
@@ -0,0 +1,44 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResponseEntries(t *testing.T) {
+	s := &Service{Instance: "gateway", Service: "_bw2._tcp", Port: 28590, TXT: []string{"vk=abc"}, Host: "gw"}
+	m, err := decode(s.response(7).encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.id != 7 || m.flags&0x8000 == 0 {
+		t.Fatalf("bad header %d %x", m.id, m.flags)
+	}
+	es := entries(m, fqdn("_bw2._tcp"), net.IPv4(10, 0, 0, 2))
+	if len(es) != 1 {
+		t.Fatalf("expected one entry, got %d", len(es))
+	}
+	if es[0].Instance != "gateway" || es[0].Addr != "10.0.0.2:28590" {
+		t.Fatalf("bad entry %+v", es[0])
+	}
+	if vk, ok := es[0].TXTValue("vk"); !ok || vk != "abc" {
+		t.Fatalf("bad TXT %v", es[0].TXT)
+	}
+}
+
+func TestReadNameCompressed(t *testing.T) {
+	//_bw2._tcp.local. at 12, then gw pointing back at it, then a loop
+	b := make([]byte, 12)
+	b = appendName(b, "_bw2._tcp.local.")
+	ptr := len(b)
+	b = append(b, 2, 'g', 'w', 0xC0, 12)
+	loop := len(b)
+	b = append(b, 0xC0, byte(loop))
+	name, end, err := readName(b, ptr)
+	if err != nil || name != "gw._bw2._tcp.local." || end != loop {
+		t.Fatalf("got %q %d %v", name, end, err)
+	}
+	if _, _, err := readName(b, loop); err == nil {
+		t.Fatalf("pointer loop was not rejected")
+	}
+}
@@ -0,0 +1,55 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package rocks
+
+import "github.com/immesys/bw2/internal/db"
+
+//DB is the RocksDB database. The C side keeps a single database per
+//process, so only the first Open call chooses the directory
+type DB struct{}
+
+//Open opens (or creates) the database under dbname
+func Open(dbname string) (*DB, error) {
+	RawInitialize(dbname)
+	return &DB{}, nil
+}
+
+func (d *DB) PutObject(cf int, key []byte, val []byte) {
+	PutObject(cf, key, val)
+}
+
+func (d *DB) GetObject(cf int, key []byte) ([]byte, error) {
+	return GetObject(cf, key)
+}
+
+func (d *DB) DeleteObject(cf int, key []byte) {
+	DeleteObject(cf, key)
+}
+
+func (d *DB) Exists(cf int, key []byte) bool {
+	return Exists(cf, key)
+}
+
+func (d *DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	return CreateIterator(cf, prefix)
+}
+
+//Close does nothing, the database stays open until the process exits
+func (d *DB) Close() error {
+	return nil
+}
@@ -23,9 +23,10 @@ package rocks
 import "C"
 import (
 	"bytes"
-	"errors"
 	"runtime"
 	"unsafe"
+
+	"github.com/immesys/bw2/internal/db"
 )
 
 var doneInit bool
@@ -49,7 +50,7 @@ const (
 )
 
 //ErrObjNotFound is returned from GetObject if the object cannot be found
-var ErrObjNotFound = errors.New("Object Not Found")
+var ErrObjNotFound = db.ErrObjNotFound
 
 func PutObject(cf int, key []byte, val []byte) {
 	C.put_object(C.int(cf), (*C.char)(unsafe.Pointer(&key[0])),
@@ -100,7 +101,12 @@ func CreateIterator(cf int, prefix []byte) *Iterator {
 	var kl C.size_t
 	var v *C.char
 	var vl C.size_t
-	C.iterator_create(C.int(cf), (*C.char)(unsafe.Pointer(&prefix[0])),
+	//An empty prefix seeks to the start of the CF
+	var pfx *C.char
+	if len(prefix) != 0 {
+		pfx = (*C.char)(unsafe.Pointer(&prefix[0]))
+	}
+	C.iterator_create(C.int(cf), pfx,
 		(C.size_t)(len(prefix)),
 		&rv.state, &k, &kl, &v, &vl)
 	runtime.SetFinalizer(&rv, func(it *Iterator) {
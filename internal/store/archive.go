@@ -0,0 +1,97 @@
+package store
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//ArchiveSuffix ends the name of each message in an archive. The rest of
+//the name is the message's topic, so an archive can also be unpacked and
+//browsed as a tree
+const ArchiveSuffix = ".bw2msg"
+
+//MaxArchiveMessage is the largest message an archive may hold
+const MaxArchiveMessage = 64 << 20
+
+//archiveSeqRecord is the PAX record holding the sequence number of a
+//numbered message
+const archiveSeqRecord = "BW2.persistseq"
+
+//ArchiveWriter writes persisted messages to a tar archive, to back up a
+//subtree or move it to another router
+type ArchiveWriter struct {
+	tw *tar.Writer
+}
+
+//NewArchiveWriter starts an archive on w
+func NewArchiveWriter(w io.Writer) *ArchiveWriter {
+	return &ArchiveWriter{tw: tar.NewWriter(w)}
+}
+
+//Add writes the encoded message persisted on topic, with its sequence
+//number if seq is not zero
+func (a *ArchiveWriter) Add(topic string, body []byte, seq uint64) error {
+	hdr := &tar.Header{
+		Name:     topic + ArchiveSuffix,
+		Mode:     0644,
+		Size:     int64(len(body)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if seq != 0 {
+		hdr.Format = tar.FormatPAX
+		hdr.PAXRecords = map[string]string{archiveSeqRecord: strconv.FormatUint(seq, 10)}
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(body)
+	return err
+}
+
+//Close finishes the archive, but does not close the underlying writer
+func (a *ArchiveWriter) Close() error {
+	return a.tw.Close()
+}
+
+//ReadArchive calls fn with each message in an archive written by
+//ArchiveWriter and its sequence number (zero if it has none), stopping at
+//the first error fn returns. Other files in the archive are ignored
+func ReadArchive(r io.Reader, fn func(topic string, body []byte, seq uint64) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return bwe.WrapM(bwe.BadOperation, "could not read archive", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(hdr.Name, ArchiveSuffix) {
+			continue
+		}
+		if hdr.Size > MaxArchiveMessage {
+			return bwe.M(bwe.BadOperation, "oversize message in archive: "+hdr.Name)
+		}
+		var seq uint64
+		if s, ok := hdr.PAXRecords[archiveSeqRecord]; ok {
+			seq, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return bwe.M(bwe.BadOperation, "bad sequence number in archive: "+hdr.Name)
+			}
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return bwe.WrapM(bwe.BadOperation, "could not read archive", err)
+		}
+		if err := fn(strings.TrimSuffix(hdr.Name, ArchiveSuffix), body, seq); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"encoding/base64"
+	"sort"
+
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//A cursor is the URI of the last result of a page, so the next page starts
+//after it even if the tree has changed in between. It is encoded so that
+//clients treat it as opaque
+
+//EncodeCursor returns the cursor for the page after the given URI
+func EncodeCursor(uri string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(uri))
+}
+
+//DecodeCursor returns the URI a cursor resumes after. The empty cursor is
+//the start of the results
+func DecodeCursor(cursor string) (string, error) {
+	rv, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", bwe.WrapM(bwe.BadOperation, "bad cursor", err)
+	}
+	return string(rv), nil
+}
+
+type smByURI []SM
+
+func (s smByURI) Len() int           { return len(s) }
+func (s smByURI) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s smByURI) Less(i, j int) bool { return s[i].URI < s[j].URI }
+
+//MatchingPage returns, in URI order, up to limit of the messages matching
+//the (possibly wildcard) uri whose URIs sort after the one given, and
+//whether there are more. Every match is read, but only about twice the
+//page is held at once
+func MatchingPage(s Storage, uri string, after string, limit int) ([]SM, bool) {
+	rc := make(chan SM, 10)
+	go s.GetMatchingMessage(uri, rc)
+	keep := limit + 1
+	rv := []SM{}
+	for sm := range rc {
+		if sm.URI <= after {
+			continue
+		}
+		rv = append(rv, sm)
+		if len(rv) >= 2*keep {
+			sort.Sort(smByURI(rv))
+			rv = rv[:keep]
+		}
+	}
+	sort.Sort(smByURI(rv))
+	if len(rv) > limit {
+		return rv[:limit], true
+	}
+	return rv, false
+}
+
+//ChildrenPage is MatchingPage for the immediate children of uri that
+//ListChildren would return
+func ChildrenPage(s Storage, uri string, after string, limit int) ([]string, bool) {
+	rc := make(chan string, 10)
+	go s.ListChildren(uri, rc)
+	rv := []string{}
+	for c := range rc {
+		if c > after {
+			rv = append(rv, c)
+		}
+	}
+	sort.Strings(rv)
+	if len(rv) > limit {
+		return rv[:limit], true
+	}
+	return rv, false
+}
+
+//GetMatchingPage is MatchingPage on the default storage
+func GetMatchingPage(uri string, after string, limit int) ([]SM, bool) {
+	return MatchingPage(defaultStorage, uri, after, limit)
+}
+
+//ListChildrenPage is ChildrenPage on the default storage
+func ListChildrenPage(uri string, after string, limit int) ([]string, bool) {
+	return ChildrenPage(defaultStorage, uri, after, limit)
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/immesys/bw2/internal/db"
+)
+
+//The messages persisted on a topic with PutSequencedMessage are numbered
+//from 1 in the order they are persisted, so that consumers can order them
+//and notice any they missed. The last number is kept in CFMsg under the
+//topic with a depth of zero, which no message key has, so queries and Walk
+//do not find it. It is kept with the hash of the message it was given to,
+//and is not removed when the message is deleted, so that numbering goes on
+//from where it was
+const seqValueLen = 8 + sha256.Size
+
+func seqkey(topic string) []byte {
+	key := make([]byte, len(topic)+1)
+	copy(key[1:], topic)
+	return key
+}
+
+func isSeqKey(key []byte) bool {
+	return len(key) != 0 && key[0] == 0
+}
+
+//lastSequence returns the last sequence number on the topic and the hash
+//of the message it was given to
+func (s *kvStore) lastSequence(topic string) (uint64, []byte) {
+	value, err := s.db.GetObject(db.CFMsg, seqkey(topic))
+	if err != nil || len(value) != seqValueLen {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(value), value[8:]
+}
+
+//PutSequencedMessage is PutMessage that also gives the message the next
+//sequence number on its topic, which it returns
+func (s *kvStore) PutSequencedMessage(topic string, payload []byte) uint64 {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	seq, _ := s.lastSequence(topic)
+	seq++
+	s.putValue(topic, payload)
+	s.putSequence(topic, payload, seq)
+	return seq
+}
+
+//putSequence records seq as the last sequence number on the topic, given
+//to payload
+func (s *kvStore) putSequence(topic string, payload []byte, seq uint64) {
+	hash := sha256.Sum256(payload)
+	value := make([]byte, seqValueLen)
+	binary.LittleEndian.PutUint64(value, seq)
+	copy(value[8:], hash[:])
+	s.db.PutObject(db.CFMsg, seqkey(topic), value)
+}
+
+//PutNumberedMessage is PutMessage for a copy of a message that was given
+//seq by PutSequencedMessage on another store, e.g. a primary's or one that
+//was backed up. Numbering on the topic goes on from seq, unless it is
+//already past it, when the message is left without a number
+func (s *kvStore) PutNumberedMessage(topic string, payload []byte, seq uint64) {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	s.putValue(topic, payload)
+	if last, _ := s.lastSequence(topic); last > seq {
+		return
+	}
+	s.putSequence(topic, payload, seq)
+}
+
+//GetSequence returns the sequence number of payload, if it is the message
+//last persisted on the topic with PutSequencedMessage
+func (s *kvStore) GetSequence(topic string, payload []byte) (uint64, bool) {
+	seq, hash := s.lastSequence(topic)
+	if seq == 0 {
+		return 0, false
+	}
+	phash := sha256.Sum256(payload)
+	if string(hash) != string(phash[:]) {
+		return 0, false
+	}
+	return seq, true
+}
+
+//PutSequencedMessage inserts a message into the default storage with the
+//next sequence number on its topic, which it returns
+func PutSequencedMessage(topic string, payload []byte) uint64 {
+	seq := defaultStorage.PutSequencedMessage(topic, payload)
+	notify(Record{Topic: topic, Value: payload, Seq: seq})
+	return seq
+}
+
+//PutNumberedMessage inserts a copy of a message numbered seq on another
+//store into the default storage, keeping its number
+func PutNumberedMessage(topic string, payload []byte, seq uint64) {
+	defaultStorage.PutNumberedMessage(topic, payload, seq)
+	notify(Record{Topic: topic, Value: payload, Seq: seq})
+}
+
+//GetSequence returns the sequence number given to payload by
+//PutSequencedMessage, if it is still the message on the topic
+func GetSequence(topic string, payload []byte) (uint64, bool) {
+	return defaultStorage.GetSequence(topic, payload)
+}
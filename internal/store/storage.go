@@ -0,0 +1,246 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/immesys/bw2/internal/bolt"
+	"github.com/immesys/bw2/internal/db"
+	"github.com/immesys/bw2/internal/level"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//Storage persists messages. The messages are kept in a BWDB, which is
+//provided by one of the backends
+type Storage interface {
+	//PutMessage inserts a message into the database. Note that the topic must
+	//be well formed and complete (no wildcards etc)
+	PutMessage(topic string, payload []byte)
+	//PutSequencedMessage is PutMessage that also gives the message the
+	//next sequence number on its topic, which it returns
+	PutSequencedMessage(topic string, payload []byte) uint64
+	//PutNumberedMessage is PutMessage for a copy of a message that was
+	//given seq by PutSequencedMessage on another store
+	PutNumberedMessage(topic string, payload []byte, seq uint64)
+	//GetSequence returns the sequence number of payload, if it is the
+	//message last persisted on the topic with PutSequencedMessage
+	GetSequence(topic string, payload []byte) (uint64, bool)
+	GetExactMessage(topic string) ([]byte, bool)
+	//GetMatchingMessage sends every message matching the (possibly wildcard)
+	//uri to handle, and then closes it
+	GetMatchingMessage(uri string, handle chan SM)
+	//ListChildren sends the immediate children of uri to handle, and then
+	//closes it
+	ListChildren(uri string, handle chan string)
+	//ListTree sends the nodes below uri to handle, down to depth levels
+	//below it (zero is unlimited), each before its children. Then it closes
+	//handle
+	ListTree(uri string, depth int, handle chan ListEntry)
+	//DeleteMessage replaces the message on a topic with a tombstone, which
+	//is hidden from GetExactMessage, GetMatchingMessage and ListChildren
+	DeleteMessage(topic string, tombstone []byte)
+	GetTombstone(topic string) ([]byte, bool)
+	//Walk sends every persisted message and tombstone to handle, with the
+	//sequence numbers of the messages that have them, and then closes it
+	Walk(handle chan Record)
+	//DB is the underlying key value store
+	DB() db.BWDB
+	Close() error
+}
+
+type kvStore struct {
+	db db.BWDB
+	//held while a sequence number is given out
+	seqMu sync.Mutex
+}
+
+func (s *kvStore) DB() db.BWDB {
+	return s.db
+}
+
+func (s *kvStore) Close() error {
+	return s.db.Close()
+}
+
+//NewStorage stores messages in the given key value store
+func NewStorage(kv db.BWDB) Storage {
+	return &kvStore{db: kv}
+}
+
+//A backend opens a BWDB in the given directory
+type backend func(dbname string) (db.BWDB, error)
+
+var backends = map[string]backend{
+	"leveldb": func(dbname string) (db.BWDB, error) {
+		return level.Open(dbname)
+	},
+	"boltdb": func(dbname string) (db.BWDB, error) {
+		return bolt.Open(dbname)
+	},
+}
+
+//Backends returns the names of the storage backends in this build
+func Backends() []string {
+	rv := []string{}
+	for name := range backends {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+//Open opens storage in dbname with the named backend. An empty name is the
+//DefaultBackend
+func Open(backendName string, dbname string) (Storage, error) {
+	if backendName == "" {
+		backendName = DefaultBackend
+	}
+	be, ok := backends[backendName]
+	if !ok {
+		return nil, bwe.M(bwe.BadOperation, fmt.Sprintf("unknown storage backend %q, this build has %v", backendName, Backends()))
+	}
+	kv, err := be(dbname)
+	if err != nil {
+		return nil, err
+	}
+	return NewStorage(kv), nil
+}
+
+var initLock sync.Mutex
+var defaultStorage Storage
+
+//Initialize opens the storage used by the package level functions with
+//the DefaultBackend
+func Initialize(dbname string) {
+	InitializeBackend(DefaultBackend, dbname)
+}
+
+//InitializeBackend opens the storage used by the package level functions.
+//Only the first call has an effect
+func InitializeBackend(backendName string, dbname string) {
+	initLock.Lock()
+	defer initLock.Unlock()
+	if defaultStorage != nil {
+		return
+	}
+	s, err := Open(backendName, dbname)
+	if err != nil {
+		fmt.Println("DB error: ", err)
+		os.Exit(1)
+	}
+	defaultStorage = s
+}
+
+//Default returns the storage opened by Initialize
+func Default() Storage {
+	return defaultStorage
+}
+
+//A Watcher is called after each message or tombstone is written through
+//the package level functions. It must not block
+type Watcher func(r Record)
+
+var watchLock sync.RWMutex
+var watchers = map[int]Watcher{}
+var nextWatcher int
+
+//Watch calls w for every write to the default storage until the returned
+//function is called
+func Watch(w Watcher) func() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	id := nextWatcher
+	nextWatcher++
+	watchers[id] = w
+	return func() {
+		watchLock.Lock()
+		delete(watchers, id)
+		watchLock.Unlock()
+	}
+}
+
+func notify(r Record) {
+	watchLock.RLock()
+	defer watchLock.RUnlock()
+	for _, w := range watchers {
+		w(r)
+	}
+}
+
+//PutMessage inserts a message into the default storage. Note that the
+//topic must be well formed and complete (no wildcards etc)
+func PutMessage(topic string, payload []byte) {
+	defaultStorage.PutMessage(topic, payload)
+	notify(Record{Topic: topic, Value: payload})
+}
+
+func GetExactMessage(topic string) ([]byte, bool) {
+	return defaultStorage.GetExactMessage(topic)
+}
+
+func GetMatchingMessage(uri string, handle chan SM) {
+	defaultStorage.GetMatchingMessage(uri, handle)
+}
+
+func ListChildren(uri string, handle chan string) {
+	defaultStorage.ListChildren(uri, handle)
+}
+
+func ListTree(uri string, depth int, handle chan ListEntry) {
+	defaultStorage.ListTree(uri, depth, handle)
+}
+
+func DeleteMessage(topic string, tombstone []byte) {
+	defaultStorage.DeleteMessage(topic, tombstone)
+	notify(Record{Topic: topic, Value: tombstone, Deleted: true})
+}
+
+func GetTombstone(topic string) ([]byte, bool) {
+	return defaultStorage.GetTombstone(topic)
+}
+
+func Walk(handle chan Record) {
+	defaultStorage.Walk(handle)
+}
+
+//Migrate copies every key in every CF from src to dst, calling progress
+//(if not nil) with the running total every so often. It returns the
+//number of keys copied
+func Migrate(dst db.BWDB, src db.BWDB, progress func(copied int)) int {
+	copied := 0
+	for cf := db.CFDot; cf <= db.CFEntity; cf++ {
+		it := src.CreateIterator(cf, nil)
+		for it.OK() {
+			dst.PutObject(cf, it.Key(), it.Value())
+			copied++
+			if progress != nil && copied%10000 == 0 {
+				progress(copied)
+			}
+			it.Next()
+		}
+		it.Release()
+	}
+	if progress != nil {
+		progress(copied)
+	}
+	return copied
+}
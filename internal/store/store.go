@@ -41,9 +41,6 @@ const (
 	markEEntity = 6
 )
 
-func Initialize(dbname string) {
-	dbi_RawInitialize(dbname)
-}
 
 /*
 //StoreDOT puts a DOT into the DB
@@ -196,7 +193,13 @@ func AdvancedUnInterlaceURI(rv []string, frontD []string, backD []string) []stri
 // a/d/b/c
 //PutMessage inserts a message into the database. Note that the topic must be
 //well formed and complete (no wildcards etc)
-func PutMessage(topic string, payload []byte) {
+func (s *kvStore) PutMessage(topic string, payload []byte) {
+	s.putValue(topic, payload)
+}
+
+//putValue stores the value on the topic, creating placeholders for any
+//parents that do not exist yet
+func (s *kvStore) putValue(topic string, payload []byte) {
 	ts := strings.Split(topic, "/")
 	tb := make([]byte, len(topic)+1)
 	copy(tb[1:], []byte(topic))
@@ -206,8 +209,8 @@ func PutMessage(topic string, payload []byte) {
 	smrg := make([]byte, len(smrgs)+1)
 	copy(smrg[1:], []byte(smrgs))
 	smrg[0] = byte(len(mrg))
-	dbi_PutObject(db.CFMsgI, smrg, payload)
-	dbi_PutObject(db.CFMsg, tb, payload)
+	s.db.PutObject(db.CFMsgI, smrg, payload)
+	s.db.PutObject(db.CFMsg, tb, payload)
 
 	//Put parents
 	for i := len(ts) - 1; i > 0; i-- {
@@ -215,8 +218,8 @@ func PutMessage(topic string, payload []byte) {
 		pstr := make([]byte, len(pstrs)+1)
 		pstr[0] = byte(i)
 		copy(pstr[1:], pstrs)
-		if !dbi_Exists(db.CFMsg, pstr) {
-			dbi_PutObject(db.CFMsg, pstr, []byte{0})
+		if !s.db.Exists(db.CFMsg, pstr) {
+			s.db.PutObject(db.CFMsg, pstr, []byte{0})
 		} else {
 			//We assume that if a path exists, all its parents exist
 			break
@@ -227,8 +230,8 @@ func PutMessage(topic string, payload []byte) {
 		pstr := make([]byte, len(pstrs)+1)
 		pstr[0] = byte(i)
 		copy(pstr[1:], pstrs)
-		if !dbi_Exists(db.CFMsgI, pstr) {
-			dbi_PutObject(db.CFMsgI, pstr, []byte{0})
+		if !s.db.Exists(db.CFMsgI, pstr) {
+			s.db.PutObject(db.CFMsgI, pstr, []byte{0})
 		} else {
 			//We assume that if a path exists, all its parents exist
 			break
@@ -236,21 +239,43 @@ func PutMessage(topic string, payload []byte) {
 	}
 }
 
-func GetExactMessage(topic string) ([]byte, bool) {
+func (s *kvStore) GetExactMessage(topic string) ([]byte, bool) {
 	ts := strings.Split(topic, "/")
 	key := make([]byte, len(topic)+1)
 	copy(key[1:], []byte(topic))
 	key[0] = byte(len(ts))
-	value, err := dbi_GetObject(db.CFMsg, key)
-	if err != nil || IsDummy(value) {
+	value, err := s.db.GetObject(db.CFMsg, key)
+	if err != nil || !isMessage(value) {
 		return nil, false
 	}
 	return value, true
 }
 
+//DeleteMessage replaces the message persisted on a topic with a tombstone.
+//The tombstone is kept (rather than removing the key) so that a copy of the
+//message from elsewhere is not taken as newer, and so that any children
+//can still be found. It is stored even if there is no message yet
+func (s *kvStore) DeleteMessage(topic string, tombstone []byte) {
+	value := make([]byte, len(tombstone)+1)
+	copy(value[1:], tombstone)
+	s.putValue(topic, value)
+}
+
+//GetTombstone returns the tombstone left on a topic by DeleteMessage
+func (s *kvStore) GetTombstone(topic string) ([]byte, bool) {
+	value, err := s.db.GetObject(db.CFMsg, mkkey(strings.Split(topic, "/")))
+	if err != nil || !IsTombstone(value) {
+		return nil, false
+	}
+	return value[1:], true
+}
+
 type SM struct {
 	URI  string
 	Body []byte
+	//The sequence number of the message, where the caller has looked it up
+	//with GetSequence
+	Seq uint64
 }
 
 func MakeSMFromParts(uriparts []string, body []byte) SM {
@@ -283,6 +308,15 @@ func IsDummy(value []byte) bool {
 	return len(value) == 1 && value[0] == 0
 }
 
+//IsTombstone returns true if the value is a tombstone. Like placeholders
+//they start with a zero, which no message type does
+func IsTombstone(value []byte) bool {
+	return len(value) > 1 && value[0] == 0
+}
+func isMessage(value []byte) bool {
+	return len(value) != 0 && value[0] != 0
+}
+
 //The logic here is a bit fucking over the top, so let me clarify for future me.
 //We are handling two cases: interlaced and non-interlaced. For non interlaced everything
 //should be simple. frontD should be emtpy and backD can have some stuffs. if interlaced,
@@ -293,7 +327,7 @@ func IsDummy(value []byte) bool {
 //evey second level can be skipped and populated by a *D element.
 //if the length of the uri is even, it is a frontD element, else a backD
 //frontD is in left to right order, backD is in right to left order
-func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []string, backD []string,
+func (s *kvStore) getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []string, backD []string,
 	skipbase bool, handle chan SM, wg *sync.WaitGroup) {
 	//Make CF
 	cf := db.CFMsg
@@ -309,8 +343,8 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 		if len(backD) != 0 || len(frontD) != 0 {
 			panic("invariant failure")
 		}
-		value, err := dbi_GetObject(cf, mkkey(uri))
-		if err == nil && !IsDummy(value) {
+		value, err := s.db.GetObject(cf, mkkey(uri))
+		if err == nil && isMessage(value) {
 			var newUri []string
 			if interlaced {
 				newUri = UnInterlaceURI(uri)
@@ -341,8 +375,8 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 				idx++
 			}
 		}
-		value, err := dbi_GetObject(db.CFMsg, mkkey(directUri))
-		if err == nil && !IsDummy(value) {
+		value, err := s.db.GetObject(db.CFMsg, mkkey(directUri))
+		if err == nil && isMessage(value) {
 			handle <- MakeSMFromParts(directUri, value)
 		}
 	}
@@ -362,7 +396,7 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 			newUri[nprefix] = frontD[0]
 			newUri[nprefix+1] = "*"
 			//Don't increment nprefix because frontD[0] may have been a +
-			getMatchingMessage(interlaced, newUri, nprefix, frontD[1:], backD, true, handle, wg)
+			s.getMatchingMessage(interlaced, newUri, nprefix, frontD[1:], backD, true, handle, wg)
 			return //Don't need to wg because we invoke a function that will decrement
 		} else if interlaced && nprefix%2 == 1 && len(backD) != 0 { //odd == back
 			//Skip scan we can populate from backD
@@ -371,14 +405,14 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 			newUri[nprefix] = backD[0] //backD is in reverse order so this is correct
 			newUri[nprefix+1] = "*"
 			//Don't increment nprefix because frontD[0] may have been a +
-			getMatchingMessage(interlaced, newUri, nprefix, frontD, backD[1:], true, handle, wg)
+			s.getMatchingMessage(interlaced, newUri, nprefix, frontD, backD[1:], true, handle, wg)
 			return
 		}
 	}
 	//If we got here, we could not skip the scan by using *D
 	if uri[nprefix] == "+" || uri[nprefix] == "*" {
 		pfx := mkchildkey(uri[:nprefix])
-		it := dbi_CreateIterator(cf, pfx)
+		it := s.db.CreateIterator(cf, pfx)
 		for it.OK() {
 			k := it.Key()
 			actualkey := unmakekey(k)
@@ -395,7 +429,7 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 			}
 			wg.Add(1)
 			//TODO we can reduce the total threadcount by not 'go'ing here
-			go getMatchingMessage(interlaced, newUri, nprefix, frontD, backD, false, handle, wg)
+			go s.getMatchingMessage(interlaced, newUri, nprefix, frontD, backD, false, handle, wg)
 			it.Next()
 		}
 		it.Release()
@@ -403,19 +437,103 @@ func getMatchingMessage(interlaced bool, uri []string, prefix int, frontD []stri
 		return
 	}
 }
-func ListChildren(uri string, handle chan string) {
+func (s *kvStore) ListChildren(uri string, handle chan string) {
 	parts := strings.Split(uri, "/")
 	ckey := mkchildkey(parts)
-	it := dbi_CreateIterator(db.CFMsg, ckey)
+	it := s.db.CreateIterator(db.CFMsg, ckey)
+	for it.OK() {
+		k := it.Key()
+		//Deleted messages are not listed unless they have children
+		if !IsTombstone(it.Value()) || s.hasChildren(unmakekey(k)) {
+			handle <- string(k[1:])
+		}
+		it.Next()
+	}
+	it.Release()
+	close(handle)
+}
+
+//ListEntry is a node found by ListTree
+type ListEntry struct {
+	URI string
+	//How far below the listed URI the node is, starting at 1
+	Depth int
+	//The number of children the node has
+	Children int
+	//Whether there is a message persisted on the node
+	HasData bool
+}
+
+//children returns the immediate children of a node that ListChildren would
+//return
+func (s *kvStore) children(parts []string) []ListEntry {
+	rv := []ListEntry{}
+	it := s.db.CreateIterator(db.CFMsg, mkchildkey(parts))
 	for it.OK() {
 		k := it.Key()
-		handle <- string(k[1:])
+		v := it.Value()
+		if !IsTombstone(v) || s.hasChildren(unmakekey(k)) {
+			rv = append(rv, ListEntry{URI: string(k[1:]), HasData: isMessage(v)})
+		}
+		it.Next()
+	}
+	it.Release()
+	return rv
+}
+
+func (s *kvStore) ListTree(uri string, depth int, handle chan ListEntry) {
+	var walk func(entries []ListEntry, d int)
+	walk = func(entries []ListEntry, d int) {
+		for _, e := range entries {
+			kids := s.children(strings.Split(e.URI, "/"))
+			e.Depth = d
+			e.Children = len(kids)
+			handle <- e
+			if depth == 0 || d < depth {
+				walk(kids, d+1)
+			}
+		}
+	}
+	walk(s.children(strings.Split(uri, "/")), 1)
+	close(handle)
+}
+
+//Record is a persisted message, or the tombstone left by deleting one
+type Record struct {
+	Topic   string
+	Value   []byte
+	Deleted bool
+	//The sequence number of the message, if it is the one last numbered on
+	//its topic, and zero otherwise
+	Seq uint64
+}
+
+func (s *kvStore) Walk(handle chan Record) {
+	it := s.db.CreateIterator(db.CFMsg, nil)
+	for it.OK() {
+		v := it.Value()
+		if !isSeqKey(it.Key()) && (isMessage(v) || IsTombstone(v)) {
+			r := Record{Topic: string(it.Key()[1:]), Value: append([]byte{}, v...)}
+			if IsTombstone(v) {
+				r.Value = r.Value[1:]
+				r.Deleted = true
+			} else {
+				r.Seq, _ = s.GetSequence(r.Topic, r.Value)
+			}
+			handle <- r
+		}
 		it.Next()
 	}
 	it.Release()
 	close(handle)
 }
-func GetMatchingMessage(uri string, handle chan SM) {
+
+func (s *kvStore) hasChildren(parts []string) bool {
+	it := s.db.CreateIterator(db.CFMsg, mkchildkey(parts))
+	defer it.Release()
+	return it.OK()
+}
+func (s *kvStore) GetMatchingMessage(uri string, handle chan SM) {
 	parts := strings.Split(uri, "/")
 	staridx := -1
 	pluscount := 0
@@ -428,7 +546,7 @@ func GetMatchingMessage(uri string, handle chan SM) {
 		}
 	}
 	if pluscount == 0 && staridx == -1 {
-		m, ok := GetExactMessage(uri)
+		m, ok := s.GetExactMessage(uri)
 		if ok {
 			handle <- MakeSMFromParts(parts, m)
 		}
@@ -439,7 +557,7 @@ func GetMatchingMessage(uri string, handle chan SM) {
 	if staridx == -1 {
 		wg := &sync.WaitGroup{}
 		wg.Add(1)
-		getMatchingMessage(false, parts, 0, nil, nil, false, handle, wg)
+		s.getMatchingMessage(false, parts, 0, nil, nil, false, handle, wg)
 		wg.Wait()
 		close(handle)
 		return
@@ -456,7 +574,7 @@ func GetMatchingMessage(uri string, handle chan SM) {
 		}
 		wg := &sync.WaitGroup{}
 		wg.Add(1)
-		getMatchingMessage(false, uri, 0, frontD, backD, false, handle, wg)
+		s.getMatchingMessage(false, uri, 0, frontD, backD, false, handle, wg)
 		wg.Wait()
 		close(handle)
 	} else {
@@ -478,7 +596,7 @@ func GetMatchingMessage(uri string, handle chan SM) {
 		}
 		wg := &sync.WaitGroup{}
 		wg.Add(1)
-		getMatchingMessage(true, uri, 0, frontD, backD, false, handle, wg)
+		s.getMatchingMessage(true, uri, 0, frontD, backD, false, handle, wg)
 		wg.Wait()
 		close(handle)
 	}
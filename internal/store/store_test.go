@@ -1,14 +1,28 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 )
 
-func init() {
-	Initialize("foobar")
+//TestMain opens the package's store in a temporary directory, so that
+//the tests leave nothing behind
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bw2store")
+	if err != nil {
+		fmt.Println("could not make a temporary directory:", err)
+		os.Exit(1)
+	}
+	Initialize(filepath.Join(dir, "db"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 func PrintSync(ch chan SM) {
 	for {
@@ -298,3 +312,315 @@ func TestIcle(t *testing.T) {
 	fmt.Println("Done")
 
 }
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := Open("boltdb", filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	src.PutMessage("mig/a/b", []byte("1"))
+	src.PutMessage("mig/a/c", []byte("2"))
+	src.PutMessage("mig/x/c", []byte("4"))
+	src.PutMessage("mig/x/d", []byte("8"))
+	src.DeleteMessage("mig/x/d", []byte("del"))
+	dst, err := Open("leveldb", filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if Migrate(dst.DB(), src.DB(), nil) == 0 {
+		t.Fatal("nothing copied")
+	}
+	for _, s := range []Storage{src, dst} {
+		rc := make(chan SM, 3)
+		go s.GetMatchingMessage("mig/+/c", rc)
+		if got := SumSync(rc); got != 2+4 {
+			t.Fatalf("expected 6, got %d", got)
+		}
+		rc = make(chan SM, 3)
+		go s.GetMatchingMessage("mig/*", rc)
+		if got := SumSync(rc); got != 1+2+4 {
+			t.Fatalf("expected 7, got %d", got)
+		}
+		cc := make(chan string, 3)
+		go s.ListChildren("mig/x", cc)
+		if got := CountSync(cc); got != 1 {
+			t.Fatalf("expected 1 child, got %d", got)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.PutMessage("tdel/a", []byte("1"))
+	s.PutMessage("tdel/b", []byte("2"))
+	s.PutMessage("tdel/b/c", []byte("4"))
+	s.DeleteMessage("tdel/a", []byte("del a"))
+	s.DeleteMessage("tdel/b", []byte("del b"))
+	if _, ok := s.GetExactMessage("tdel/a"); ok {
+		t.Fatal("deleted message found")
+	}
+	if ts, ok := s.GetTombstone("tdel/a"); !ok || string(ts) != "del a" {
+		t.Fatalf("bad tombstone %q", ts)
+	}
+	rc := make(chan SM, 3)
+	go s.GetMatchingMessage("tdel/*", rc)
+	if got := SumSync(rc); got != 4 {
+		t.Fatalf("expected 4, got %d", got)
+	}
+	//b is still listed because it has children
+	cc := make(chan string, 3)
+	go s.ListChildren("tdel", cc)
+	if got := CountSync(cc); got != 1 {
+		t.Fatalf("expected 1 child, got %d", got)
+	}
+	s.PutMessage("tdel/a", []byte("8"))
+	if _, ok := s.GetTombstone("tdel/a"); ok {
+		t.Fatal("tombstone not replaced")
+	}
+	if m, ok := s.GetExactMessage("tdel/a"); !ok || string(m) != "8" {
+		t.Fatal("message not persisted after delete")
+	}
+}
+
+func TestListTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.PutMessage("tree/a", []byte("1"))
+	s.PutMessage("tree/a/b/c", []byte("2"))
+	s.PutMessage("tree/a/d", []byte("4"))
+	s.PutMessage("tree/e", []byte("8"))
+	s.DeleteMessage("tree/e", []byte("del"))
+	testvector := []struct {
+		Depth    int
+		Expected []ListEntry
+	}{
+		{1, []ListEntry{{"tree/a", 1, 2, true}}},
+		{2, []ListEntry{{"tree/a", 1, 2, true}, {"tree/a/b", 2, 1, false}, {"tree/a/d", 2, 0, true}}},
+		{0, []ListEntry{{"tree/a", 1, 2, true}, {"tree/a/b", 2, 1, false},
+			{"tree/a/b/c", 3, 0, true}, {"tree/a/d", 2, 0, true}}},
+	}
+	for i, v := range testvector {
+		rc := make(chan ListEntry, 3)
+		go s.ListTree("tree", v.Depth, rc)
+		got := []ListEntry{}
+		for e := range rc {
+			got = append(got, e)
+		}
+		if len(got) != len(v.Expected) {
+			t.Fatalf("For test vector %d expected %v, got %v", i, v.Expected, got)
+		}
+		for j := range got {
+			if got[j] != v.Expected[j] {
+				t.Fatalf("For test vector %d expected %v, got %v", i, v.Expected, got)
+			}
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.PutMessage("twalk/a", []byte("1"))
+	s.PutMessage("twalk/b/c", []byte("2"))
+	s.DeleteMessage("twalk/d", []byte("del d"))
+	rc := make(chan Record, 10)
+	go s.Walk(rc)
+	got := map[string]Record{}
+	for r := range rc {
+		got[r.Topic] = r
+	}
+	//twalk and twalk/b are placeholders
+	if len(got) != 3 {
+		t.Fatalf("expected 3 records, got %v", got)
+	}
+	if r := got["twalk/b/c"]; r.Deleted || string(r.Value) != "2" {
+		t.Fatalf("bad message %+v", r)
+	}
+	if r := got["twalk/d"]; !r.Deleted || string(r.Value) != "del d" {
+		t.Fatalf("bad tombstone %+v", r)
+	}
+}
+
+func TestPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 25; i++ {
+		s.PutMessage(fmt.Sprintf("tpage/%02d/x", i), []byte(strconv.Itoa(i)))
+	}
+	s.DeleteMessage("tpage/07/x", []byte("del"))
+	got := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("paging did not end")
+		}
+		after, err := DecodeCursor(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sms, more := MatchingPage(s, "tpage/*", after, 4)
+		if len(sms) > 4 {
+			t.Fatalf("page of %d", len(sms))
+		}
+		for _, sm := range sms {
+			got = append(got, sm.URI)
+		}
+		if !more {
+			break
+		}
+		cursor = EncodeCursor(sms[len(sms)-1].URI)
+	}
+	if len(got) != 24 || got[0] != "tpage/00/x" || got[7] != "tpage/08/x" || got[23] != "tpage/24/x" {
+		t.Fatalf("unexpected query pages %v", got)
+	}
+	children, more := ChildrenPage(s, "tpage", "tpage/20", 10)
+	if more || len(children) != 4 || children[0] != "tpage/21" {
+		t.Fatalf("unexpected list page %v %v", children, more)
+	}
+	if _, err := DecodeCursor("!"); err == nil {
+		t.Fatal("bad cursor accepted")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewArchiveWriter(&buf)
+	want := map[string]string{"ns/a": "1", "ns/a/b": "2", "ns/c": "3"}
+	for i, topic := range []string{"ns/a", "ns/a/b", "ns/c"} {
+		if err := aw.Add(topic, []byte(want[topic]), uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	err := ReadArchive(&buf, func(topic string, body []byte, seq uint64) error {
+		if seq != uint64(body[0]-'1') {
+			t.Fatalf("sequence of %s did not round trip: %d", topic, seq)
+		}
+		got[topic] = string(body)
+		return nil
+	})
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("archive did not round trip: %v %v", got, err)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("archive did not round trip: %v", got)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open("leveldb", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seq := s.PutSequencedMessage("tseq/a", []byte("1")); seq != 1 {
+		t.Fatalf("first sequence number is %d", seq)
+	}
+	if seq := s.PutSequencedMessage("tseq/a", []byte("2")); seq != 2 {
+		t.Fatalf("second sequence number is %d", seq)
+	}
+	if seq := s.PutSequencedMessage("tseq/b", []byte("4")); seq != 1 {
+		t.Fatalf("sequence numbers are not per topic, got %d", seq)
+	}
+	if seq, ok := s.GetSequence("tseq/a", []byte("2")); !ok || seq != 2 {
+		t.Fatalf("bad sequence %d %v", seq, ok)
+	}
+	if _, ok := s.GetSequence("tseq/a", []byte("1")); ok {
+		t.Fatal("replaced message has a sequence number")
+	}
+	//Numbering goes on after a delete, and unsequenced puts have none
+	s.DeleteMessage("tseq/a", []byte("del"))
+	if seq := s.PutSequencedMessage("tseq/a", []byte("8")); seq != 3 {
+		t.Fatalf("sequence after delete is %d", seq)
+	}
+	s.PutMessage("tseq/a", []byte("16"))
+	if _, ok := s.GetSequence("tseq/a", []byte("16")); ok {
+		t.Fatal("unsequenced message has a sequence number")
+	}
+	//The sequence records are not messages
+	rc := make(chan SM, 3)
+	go s.GetMatchingMessage("tseq/*", rc)
+	if got := SumSync(rc); got != 0x16+4 {
+		t.Fatalf("expected %d, got %d", 0x16+4, got)
+	}
+	wc := make(chan Record, 10)
+	go s.Walk(wc)
+	n := 0
+	for r := range wc {
+		if r.Topic != "tseq/a" && r.Topic != "tseq/b" {
+			t.Fatalf("unexpected record %+v", r)
+		}
+		if r.Topic == "tseq/b" && r.Seq != 1 || r.Topic == "tseq/a" && r.Seq != 0 {
+			t.Fatalf("bad sequence in record %+v", r)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 records, got %d", n)
+	}
+	//Copies keep their numbers, and numbering goes on from them
+	s.PutNumberedMessage("tseq/c", []byte("32"), 7)
+	if seq, ok := s.GetSequence("tseq/c", []byte("32")); !ok || seq != 7 {
+		t.Fatalf("bad copied sequence %d %v", seq, ok)
+	}
+	if seq := s.PutSequencedMessage("tseq/c", []byte("64")); seq != 8 {
+		t.Fatalf("sequence after copy is %d", seq)
+	}
+	s.PutNumberedMessage("tseq/c", []byte("128"), 5)
+	if _, ok := s.GetSequence("tseq/c", []byte("128")); ok {
+		t.Fatal("stale copy has a sequence number")
+	}
+	if seq := s.PutSequencedMessage("tseq/c", []byte("256")); seq != 9 {
+		t.Fatalf("sequence after stale copy is %d", seq)
+	}
+}
@@ -0,0 +1,98 @@
+//Package testvec checks encodings against golden test vectors kept in a
+//package's testdata directory. The vectors are the bytes deployed routers
+//sign and verify, so a change to an Encode method that alters them breaks
+//signature compatibility, and must be deliberate: run the tests with
+//-update-vectors to rewrite them, and say so in the commit.
+//
+//Everything that goes into a vector must be deterministic, so vectors use
+//the keys from Keypair and the time Epoch. Ed25519 signatures are
+//deterministic already
+package testvec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+)
+
+var update = flag.Bool("update-vectors", false, "rewrite the golden test vectors in testdata")
+
+//Epoch is the creation time of everything in the vectors
+var Epoch = time.Unix(1500000000, 0)
+
+//Keypair derives a keypair from a name, so the same name gives the same
+//keys in every vector and every version
+func Keypair(name string) (sk []byte, vk []byte) {
+	seed := sha256.Sum256([]byte("bw2 test vector " + name))
+	sk = seed[:]
+	return sk, crypto.VKforSK(sk)
+}
+
+func path(name string) string {
+	return filepath.Join("testdata", "vectors", name+".hex")
+}
+
+//Load returns the golden vector with the given name
+func Load(t *testing.T, name string) []byte {
+	raw, err := ioutil.ReadFile(path(name))
+	if err != nil {
+		t.Fatalf("vector %s: %v (run with -update-vectors to create it)", name, err)
+	}
+	var h []byte
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		h = append(h, line...)
+	}
+	rv, err := hex.DecodeString(string(h))
+	if err != nil {
+		t.Fatalf("vector %s: %v", name, err)
+	}
+	return rv
+}
+
+//Check compares an encoding with the golden vector, or rewrites the vector
+//with -update-vectors. The description is kept in the file as a comment
+func Check(t *testing.T, name string, description string, got []byte) {
+	if *update {
+		if err := save(name, description, got); err != nil {
+			t.Fatalf("vector %s: %v", name, err)
+		}
+		return
+	}
+	want := Load(t, name)
+	if bytes.Equal(got, want) {
+		return
+	}
+	i := 0
+	for i < len(got) && i < len(want) && got[i] == want[i] {
+		i++
+	}
+	t.Errorf("vector %s: the encoding changed at byte %d (%d bytes, was %d). Deployed routers "+
+		"will not verify it; if that is intended, run with -update-vectors", name, i, len(got), len(want))
+}
+
+func save(name string, description string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path(name)), 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# " + description + "\n")
+	h := hex.EncodeToString(b)
+	for len(h) > 64 {
+		buf.WriteString(h[:64] + "\n")
+		h = h[64:]
+	}
+	buf.WriteString(h + "\n")
+	return ioutil.WriteFile(path(name), buf.Bytes(), 0644)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+//decodeKeyFile decodes v1 and v2 entity, DOT and chain files
+func decodeKeyFile(contents []byte) (*objects.KeyFile, error) {
+	kf, err := objects.DecodeKeyFile(contents, []byte(os.Getenv(objects.KeyFilePassphraseEnv)))
+	if err == objects.ErrKeyFileEncrypted {
+		return nil, fmt.Errorf("%v (set %s)", err, objects.KeyFilePassphraseEnv)
+	}
+	return kf, err
+}
+
+//convert [--v1] [--encrypt] [--comment c] [--alias a] [-o out] file
+//Rewrites a key file in the v2 format, or back to v1 for tools that do not
+//read v2 yet
+func actionConvert(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 convert [options] <file>")
+		os.Exit(1)
+	}
+	in := c.Args()[0]
+	contents, err := ioutil.ReadFile(in)
+	if err != nil {
+		fmt.Println("Could not read file:", err)
+		os.Exit(1)
+	}
+	kf, err := decodeKeyFile(contents)
+	if err != nil {
+		fmt.Println("Could not decode file:", err)
+		os.Exit(1)
+	}
+	if _, err := kf.RoutingObject(); err != nil {
+		fmt.Println("The file does not hold a valid object:", err)
+		os.Exit(1)
+	}
+	if c.IsSet("comment") {
+		kf.Comment = c.String("comment")
+	}
+	if c.IsSet("alias") {
+		kf.Alias = c.String("alias")
+	}
+	var out []byte
+	if c.Bool("v1") {
+		if c.Bool("encrypt") {
+			fmt.Println("v1 files cannot be encrypted")
+			os.Exit(1)
+		}
+		out = append([]byte{byte(kf.RONum)}, kf.Content...)
+	} else {
+		var passphrase []byte
+		if c.Bool("encrypt") {
+			passphrase = []byte(c.String("passphrase"))
+			if len(passphrase) == 0 {
+				passphrase = []byte(os.Getenv(objects.KeyFilePassphraseEnv))
+			}
+			if len(passphrase) == 0 {
+				fmt.Printf("Encrypting needs --passphrase or %s\n", objects.KeyFilePassphraseEnv)
+				os.Exit(1)
+			}
+		}
+		out, err = objects.EncodeKeyFile(kf, passphrase)
+		if err != nil {
+			fmt.Println("Could not encode file:", err)
+			os.Exit(1)
+		}
+	}
+	outfile := c.String("outfile")
+	if outfile == "" {
+		outfile = in
+	}
+	if err := ioutil.WriteFile(outfile, out, 0600); err != nil {
+		fmt.Println("Could not write file:", err)
+		os.Exit(1)
+	}
+	version := "v2"
+	if c.Bool("v1") {
+		version = "v1"
+	}
+	fmt.Printf("Converted %s (v%d) to %s (%s)\n", in, kf.Version, outfile, version)
+	return nil
+}
@@ -42,6 +42,9 @@ type configparams struct {
 	ListenPort    int
 	MaxPeers      int
 	MaxLightPeers int
+	Profile       string
+	Registry      string
+	RegistryVK    string
 }
 
 const configTemplate = `# Generated for {{.BW2Version}}
@@ -50,10 +53,81 @@ const configTemplate = `# Generated for {{.BW2Version}}
 Version=2
 
 [router]
-# this entity is used only if you are a DR
+# this entity is used only if you are a DR. If it has been
+# encrypted with bw2 convert, the passphrase is read from the
+# BW2_KEYFILE_PASSPHRASE environment variable
 Entity={{.Entfile}}
 DB={{.DBPath}}
+# the storage backend for the DB: leveldb, boltdb or rocksdb
+# (if built with it). Leave it empty for the default. Use
+# bw2 migratedb to move an existing DB to another backend
+DBBackend=
 LogPath={{.Lpath}}
+# check the payloads of messages published to namespaces
+# this router is the DR for. off, flag (log malformed
+# payloads) or reject (refuse the message)
+ValidatePayloads=off
+# how often (in seconds) to persist this router's peers,
+# subscriptions, cache stats and chain height under the
+# read-only free path ns/$router/ of each namespace it is
+# the DR for. 0 uses the default (60) and -1 disables it
+InfoInterval=60
+# how many chain builds may run at once for clients that
+# publish requests on ns/$chainbuild/<id>/request of each
+# namespace this router is the DR for. 0 uses the default (4)
+# and -1 disables the service
+ChainBuildWorkers=0
+# how often (in seconds) to check that the chains of active
+# subscriptions are still valid. They are also checked when
+# a DOT or entity is revoked or expires. 0 uses the default
+# (300) and -1 leaves only the checks on revocation
+SubscriptionRecheck=300
+# how many seconds DOTs, entities and messages stay valid after
+# they expire, to allow for clocks that disagree. If a message
+# carries a timestamp signed by a router whose clock is behind
+# ours by more than this, expiry errors say clock skew is
+# suspected rather than that the message or DOT expired
+ClockSkew=0
+# add a timestamp signed by this router to every message its
+# clients publish (clients can also ask for one per message)
+TimestampMessages=false
+# publish each new block and each registry, alias and affinity
+# contract event under the read-only free path ns/$chain/<kind>
+# of each namespace this router is the DR for
+ChainEvents=false
+# the largest message in bytes this router accepts from clients
+# and peers. Larger payloads can be split into chunk POs with
+# bw2 pub --chunksize. 0 uses the default of 16MB
+MaxMessageSize=0
+# only parse the routing objects of messages from peers that
+# are needed to route them (the access chain, origin VK and
+# expiry). This saves CPU on routers that mostly forward
+LazyRoutingObjects=false
+# how many publishes to another router may be in flight at once.
+# Publishers block once that many await their acks, which are
+# reported in the order the messages were sent. 0 uses the
+# default of 64
+PublishWindow=0
+# warn when another router takes longer than SlowPeerAck seconds
+# to answer, on average or for a request still waiting, and with
+# DropSlowPeers also reconnect to it (or use another designated
+# router). 0 uses the default of 10 and -1 disables the check
+SlowPeerAck=0
+DropSlowPeers=false
+# full runs a chain node. thin runs without one, for gateways
+# with little memory (e.g. a Raspberry Pi), resolving entities,
+# DOTs, chains, aliases and designated routers through the
+# full router in [thin]. A thin router cannot send transactions
+Profile={{.Profile}}
+# answer the registry queries of thin routers that connect to
+# the native listener. Only a full router can serve the registry
+ServeRegistry=false
+# how long (in seconds) to remember the idempotency keys of
+# publishes and persists to namespaces this router is the DR
+# for. A retry with the same key on the same URI in that time
+# is acknowledged but not delivered or persisted again. 0 uses
+# the default of 600 and -1 disables it
+IdempotencyWindow=0
 
 [native]
 # this is for DR peering. You can set this to an
@@ -93,6 +167,11 @@ ExternalIP={{.ExternalIP}}
 # make sure to forward both of them. Also make sure you
 # forward the same port, don't remap
 Port={{.ListenPort}}
+# If no new block arrives for this many seconds, disconnect the
+# chain peers (banning those that claim blocks they do not send),
+# dial the boot nodes again and publish a syncstall chain event.
+# 0 uses the default of 300 and -1 disables the watchdog
+SyncStallTimeout=0
 
 [mining]
 # A nonzero value implies we will CPU mine
@@ -103,6 +182,247 @@ Threads={{.MinerThreads}}
 # paper experiments. You can check its balance
 # with bw2 i reservebank
 Benificiary={{.Benificiary}}
+
+[privatechain]
+# Set Genesis to run on a private chain instead of the public
+# BOSSWAVE chain, e.g. for a lab without real Ether. Make the
+# genesis file with bw2 mkgenesis and give every node on the
+# chain the same one. The private chain is kept separately in
+# the DB, so the public chain is untouched
+Genesis=
+# A nonzero ChainID overrides the one in the genesis. The
+# NetworkID defaults to the chain ID
+ChainID=0
+NetworkID=0
+# Comma separated enode URLs of other nodes on the chain
+BootNodes=
+# Mine from startup (on at least one thread) so transactions
+# are confirmed without any other miners
+DevMiner=false
+
+# If the registry, alias or affinity contracts are not at their
+# default addresses on a chain (e.g. they were upgraded), say
+# where they are in a section for the chain ID. Contracts left
+# out keep their default address. The optional code hashes are
+# the keccak256 of the expected code, checked at startup and by
+# bw2 contracts, which also shows the chain ID. Updating,
+# transferring and deleting aliases need the alias contract
+# with owners (contracts/alias.sol), whose admin copies the
+# old contract's aliases over with ImportAlias
+# [contracts "28589"]
+# Registry=0x0a7196b519defa5d03ec134c23b8b3bdb622e972
+# Alias=0xcc74681c3e3b7bcccf7a05524b75ba8feccc7418
+# Affinity=0x61a21a55aa92a72434f6e5b93cd22b3a5eaccc06
+# RegistryCodeHash=
+# AliasCodeHash=
+# AffinityCodeHash=
+
+[dr]
+# If this router is a designated router, check every
+# this many seconds that its SRV record reaches it.
+# Zero disables the checks. See bw2 drstatus
+CheckInterval=0
+# Publish a new SRV record if the public IP changes
+# (e.g. a dynamic IP). This only happens if the current
+# record is empty or an IP address, not a hostname
+AutoUpdateSRV=false
+# The router entity account that pays for SRV updates
+Account=0
+# This must return the public IP as plain text
+PublicIPService=https://api.ipify.org
+# The port to advertise, if port forwarding maps a
+# different one to the native ListenOn port
+AdvertisePort=0
+# If a namespace has replica designated routers (DRs granted
+# P on ns/$/dr/replica by the namespace), fanout sends every
+# message to all of them, standby only copies persisted
+# messages so they can take over from the primary
+ReplicaMode=fanout
+# Send persisted messages to the other replicas every this
+# many seconds, so that they catch up after being down.
+# Zero disables this
+GossipInterval=0
+
+[stats]
+# Subscribe (as the router entity) to each URI and persist the
+# min, max and mean of their numeric payloads for every interval
+# under ns/!stats/<interval>/<uri suffix>. Repeat the URI line
+# for more URIs. The router entity needs C on the URIs and P on
+# ns/!stats/*
+# URI=mynamespace/building/+/temperature
+Intervals=1m,1h
+# How many intervals each summary keeps
+History=60
+
+[ratelimit]
+# the messages per second each origin VK may publish or
+# persist through this router, and how many it may send
+# at once. 0 uses the defaults (100 and 200) and a PerVK of
+# -1 disables the limit. DOTs with a TxLimit are limited
+# to that many messages per second as well
+PerVK=100
+Burst=200
+
+[clients]
+# quotas for each client of the agent, so that clients with
+# different entities can share it without one starving the
+# others: how many subscriptions it may hold, how many of the
+# cached chains may be its own, and how many messages per
+# second it may publish (with Burst at once). 0 means no limit.
+# Admins is a comma separated list of VKs, besides the router's,
+# that may list the connected clients with bw2 clients.
+# Chains in use by a client's publishes and subscriptions are
+# rebuilt ChainRefresh hours before one of their DOTs expires
+# (0 uses the default of 6, -1 never rebuilds them)
+MaxSubscriptions=0
+MaxCachedChains=0
+MessagesPerSecond=0
+Burst=0
+Admins=
+ChainRefresh=0
+
+[audit]
+# messages from peers that fail verification are logged. Log
+# one in every Sample of them, and at most MaxPerMinute (0
+# uses the default of 600, -1 means no cap). With Persist,
+# the last denial of each origin VK is also persisted at
+# ns/!audit/<hex vk>, which needs the router entity to have
+# P on ns/!audit/*
+Sample=1
+MaxPerMinute=600
+Persist=false
+
+[verify]
+# relax the checks on the access chains of messages from peers,
+# for example during a migration. SkipExpiry accepts expired
+# DOTs, AllowUnresolvable accepts DOTs whose state cannot be
+# resolved if the message carries them (the chain is still
+# checked), and AuditOnly delivers messages whose chain does
+# not authorise them. Each message let through is audited as
+# in [audit]
+SkipExpiry=false
+AllowUnresolvable=false
+AuditOnly=false
+
+[cache]
+# The maximum number of entities, DOTs and built chains the
+# router keeps resolved. The least recently used are evicted
+# first. 0 uses the default and -1 means no limit
+MaxEntities=10000
+MaxDOTs=50000
+MaxChains=10000
+
+[dns]
+# find the designated routers of namespaces in DNS, so that
+# clients on a fresh machine can connect before the chain has
+# synced. A domain publishes "bw2 ns=<nsvk> dr=<drvk>" in a
+# TXT record at _bw2.<domain> and the router's host and port
+# in an SRV record at _bw2._tcp.<domain>, and can then be used
+# in place of the namespace in URIs. The Domains here (comma
+# separated) are looked up at startup. Until the chain has
+# synced the records are trusted as they are, after that they
+# are only used if the chain has the same designated router.
+# Records are kept for CacheTime seconds
+Domains=
+CacheTime=3600
+
+[mdns]
+# advertise this router on the local network with mDNS (as
+# _bw2._tcp with its VK in the TXT record) so that agents
+# nearby can find it with bw2 discover. With DiscoverInterval
+# set, look for other routers every this many seconds and use
+# their addresses if the chain has no SRV record for them.
+# Routers must prove their VK before they are used
+Advertise=false
+DiscoverInterval=0
+
+[peering]
+# which peers the native listener (ListenOn) serves. Peers do
+# not prove their own VK, so AllowVK and DenyVK (repeat the
+# line or separate VKs with commas) apply to the origin VK of
+# the messages they send. If AllowVK is given, only those
+# origins are accepted. If there are Namespace lines, only
+# messages on those namespaces are accepted, and a namespace
+# followed by networks only from peers in them, e.g.
+# Namespace=<nsvk> 10.0.0.0/8,192.168.0.0/16
+# MaxConnsPerIP limits the connections from one IP, 0 means
+# no limit. Keys must be VKs, not aliases. Drop a connected
+# peer with bw2 droppeer <client id from bw2 clients>
+MaxConnsPerIP=0
+
+[standby]
+# hot standby of persisted messages. On the primary, Allow lists
+# the router VKs that may follow it (repeat the line or separate
+# VKs with commas). On the standby, Primary is the host:port of
+# the primary's native listener and PrimaryVK its router VK. The
+# standby copies the whole store when it connects and then every
+# persist and delete as it happens. BufferSize is how many writes
+# may queue for a slow standby (0 for 10000) before it is made to
+# copy the store again. Once the primary is gone, run bw2 promote
+# on the standby. If the standby was given the primary's router
+# entity, that also points the SRV record at it
+# Allow=
+# Primary=
+# PrimaryVK=
+
+[thin]
+# with the thin profile, the host:port of the native listener
+# of a full router with ServeRegistry set, and its router VK,
+# which it must prove before it is trusted. The registry's head
+# block is fetched every HeadInterval seconds (0 for 15), and
+# its logs are used to flush the caches as usual
+Registry={{.Registry}}
+RegistryVK={{.RegistryVK}}
+HeadInterval=0
+# entities, DOTs, chains, aliases and designated routers are
+# checked against merkle proofs from the registry, in a block
+# whose proof of work is verified, so that the registry cannot
+# forge them. This needs an ethash cache of 16MB or more in
+# memory. Set this to skip the proofs and trust the registry
+TrustRegistry=false
+
+# Mount a subtree under another URI prefix. Messages published
+# under From are republished by the router under To, with the
+# topic rewritten, e.g. so devices can keep publishing in an old
+# namespace while clients move to a new one. The router entity
+# needs C* on From and P on To. Repeat the section with another
+# name for more mounts, and add the reverse mount to map both ways
+# [mount "legacy"]
+# From=oldnamespace/building
+# To=newnamespace/campus/building
+
+# Limits on a namespace this router is the designated router for. Messages
+# over them are refused with NamespaceQuotaExceeded. Zero means no limit,
+# and the usage is persisted at $router/usage in the namespace
+# [quota "tenant"]
+# Namespace=tenant.namespace
+# MessagesPerHour=100000
+# BytesPerHour=100000000
+# MaxPersistedBytes=1000000000
+
+# Transform the messages on a URI pattern before delivering them to
+# subscribers whose chain does not grant Unless (empty for everyone),
+# e.g. to share a sensor stream coarsely with those without T. Each
+# Apply runs in turn: strip:<ponum mask> removes payload objects,
+# downsample:<n> keeps one message in n per topic and redact:<field>
+# deletes a field from msgpack payloads. The router signs transformed
+# messages, so the router entity needs P on Pattern
+# [transform "occupancy"]
+# Pattern=building.namespace/floor4/+/occupancy
+# Unless=T
+# Apply=redact:badge_id
+# Apply=downsample:10
+
+# Run a service built into this router binary, such as a device driver,
+# inside the router. Kind is the name it registered with, Entity the key
+# file of the entity its client uses (the router's if empty) and each
+# Param is key=value. A service that crashes is started again, and the
+# state of each is persisted at $router/drivers
+# [driver "thermostat"]
+# Kind=modbus-thermostat
+# Entity=/etc/bw2/thermostat.ent
+# Param=address=192.168.1.20:502
+# Param=uri=building.namespace/floor4/thermostat
 `
 
 func makeConf(c *cli.Context) error {
@@ -151,6 +471,14 @@ func makeConf(c *cli.Context) error {
 	if c.Bool("listenglobal") {
 		listenon = "0.0.0.0:28589"
 	}
+	profile := "full"
+	if c.String("registry") != "" {
+		if c.String("registryvk") == "" {
+			fmt.Println("A thin router needs the --registryvk of its registry")
+			os.Exit(1)
+		}
+		profile = "thin"
+	}
 	tmp, err := template.New("root").Parse(configTemplate)
 	if err != nil {
 		panic(err)
@@ -168,6 +496,9 @@ func makeConf(c *cli.Context) error {
 		ListenPort:    c.Int("listenport"),
 		MaxPeers:      c.Int("maxpeers"),
 		MaxLightPeers: c.Int("maxlightpeers"),
+		Profile:       profile,
+		Registry:      c.String("registry"),
+		RegistryVK:    c.String("registryvk"),
 	}
 	err = tmp.ExecuteTemplate(conf, "root", params)
 	if err != nil {
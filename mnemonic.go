@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+)
+
+//mkmnemonic [--words n]
+func actionMkMnemonic(c *cli.Context) error {
+	words := c.Int("words")
+	if words%3 != 0 {
+		fmt.Println("--words must be 12, 15, 18, 21 or 24")
+		os.Exit(1)
+	}
+	mnemonic, err := crypto.NewMnemonic(words / 3 * 32)
+	if err != nil {
+		fmt.Println("--words must be 12, 15, 18, 21 or 24")
+		os.Exit(1)
+	}
+	fmt.Println(mnemonic)
+	fmt.Fprintln(os.Stderr, "Write this down and keep it safe. Anyone with it can recreate every entity derived from it")
+	return nil
+}
+
+//mnemonicSeed returns the seed for --mnemonic and --passphrase. A mnemonic
+//of - is read from stdin, to keep it out of the shell history
+func mnemonicSeed(c *cli.Context) []byte {
+	mnemonic := c.String("mnemonic")
+	if mnemonic == "-" {
+		fmt.Fprint(os.Stderr, "Mnemonic: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			fmt.Println("Could not read the mnemonic:", err)
+			os.Exit(1)
+		}
+		mnemonic = line
+	}
+	seed, err := crypto.MnemonicToSeed(strings.ToLower(mnemonic), c.String("passphrase"))
+	if err != nil {
+		fmt.Println("Bad mnemonic:", err)
+		os.Exit(1)
+	}
+	return seed
+}
+
+//mnemonicPath returns --path, or the path of the entity at index
+func mnemonicPath(c *cli.Context, index int) string {
+	if c.String("path") != "" {
+		return c.String("path")
+	}
+	if index < 0 {
+		fmt.Println("The --index cannot be negative")
+		os.Exit(1)
+	}
+	return crypto.EntityPath(uint32(index))
+}
+
+func deriveKeypairOrExit(seed []byte, path string) ([]byte, []byte) {
+	sk, vk, err := crypto.DeriveKeypair(seed, path)
+	if err != nil {
+		fmt.Println("Could not derive the entity:", err)
+		os.Exit(1)
+	}
+	return sk, vk
+}
+
+func writeEntityKeyFile(ent *objects.Entity, fname string) {
+	if len(fname) == 0 {
+		fname = "." + crypto.FmtKey(ent.GetVK()) + ".key"
+	}
+	blob := ent.GetSigningBlob()
+	wrapped := make([]byte, len(blob)+1)
+	copy(wrapped[1:], blob)
+	wrapped[0] = objects.ROEntityWKey
+	err := ioutil.WriteFile(fname, wrapped, 0600)
+	if err != nil {
+		fmt.Println("could not write entity to", fname, ":", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("wrote key to file", fname)
+}
+
+//recoverentity --mnemonic m [--index i] [--count n] [--path p]
+//Recreates the key files of the entities derived from a mnemonic. The
+//entity objects are found in the registry, so only published entities can
+//be recovered this way. An unpublished one can be made again with mkentity
+//--mnemonic, which gives it the same VK
+func actionRecoverEntity(c *cli.Context) error {
+	bw2bind.SilenceLog()
+	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
+	cl.StatLine()
+	seed := mnemonicSeed(c)
+	count := c.Int("count")
+	if c.String("path") != "" {
+		count = 1
+	}
+	if count < 1 {
+		fmt.Println("The --count must be at least 1")
+		os.Exit(1)
+	}
+	found := 0
+	for i := c.Int("index"); i < c.Int("index")+count; i++ {
+		path := mnemonicPath(c, i)
+		sk, vk := deriveKeypairOrExit(seed, path)
+		ro, status, err := cl.ResolveRegistry(crypto.FmtKey(vk))
+		ent, ok := ro.(*objects.Entity)
+		if err != nil || !ok {
+			fmt.Printf("%s %s: not in the registry\n", path, crypto.FmtKey(vk))
+			continue
+		}
+		fmt.Printf("%s %s: %s\n", path, crypto.FmtKey(vk), cl.ValidityToString(status, err))
+		ent.SetSK(sk)
+		fname := c.String("outfile")
+		if count > 1 {
+			fname = ""
+		}
+		writeEntityKeyFile(ent, fname)
+		found++
+	}
+	fmt.Printf("Recovered %d of %d entities\n", found, count)
+	if found == 0 {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+)
+
+func actionNSExport(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 ns export [-o file] <nsvk>")
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	contents, err := ac.exportNamespace(c.Args()[0])
+	if err != nil {
+		fmt.Println("Export failed:", err)
+		os.Exit(1)
+	}
+	snap := &api.NamespaceSnapshot{}
+	if err := json.Unmarshal(contents, snap); err != nil {
+		fmt.Println("Agent returned a malformed snapshot:", err)
+		os.Exit(1)
+	}
+	outfile := c.String("outfile")
+	if outfile == "" {
+		outfile = crypto.FmtKey(snap.NSVK) + ".snap"
+	}
+	if err := ioutil.WriteFile(outfile, contents, 0644); err != nil {
+		fmt.Println("Could not write snapshot:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Snapshot of %s at block %d written to %s\n", crypto.FmtKey(snap.NSVK), snap.Block, outfile)
+	printNSSnapshot(snap)
+	return nil
+}
+
+func actionNSImport(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 ns import <file>")
+		os.Exit(1)
+	}
+	contents, err := ioutil.ReadFile(c.Args()[0])
+	if err != nil {
+		fmt.Println("Could not read snapshot:", err)
+		os.Exit(1)
+	}
+	snap := &api.NamespaceSnapshot{}
+	if err := json.Unmarshal(contents, snap); err != nil {
+		fmt.Println("Invalid snapshot:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Importing snapshot of %s from block %d\n", crypto.FmtKey(snap.NSVK), snap.Block)
+	printNSSnapshot(snap)
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	loaded, skipped, err := ac.importNamespace(contents)
+	if err != nil {
+		fmt.Println("Import failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Loaded %d objects", loaded)
+	if skipped != 0 {
+		fmt.Printf(", skipped %d invalid or expired", skipped)
+	}
+	fmt.Println()
+	return nil
+}
+
+func printNSSnapshot(snap *api.NamespaceSnapshot) {
+	fmt.Printf("  %d entities, %d DOTs, %d chains, %d aliases\n",
+		len(snap.Entities), len(snap.DOTs), len(snap.Chains), len(snap.Aliases))
+	if len(snap.DesignatedRouter) != 0 {
+		fmt.Printf("  Designated router %s (%s)\n", crypto.FmtKey(snap.DesignatedRouter), snap.SRV)
+	} else {
+		fmt.Println("  No designated router")
+	}
+}
@@ -0,0 +1,226 @@
+package advpo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/immesys/bw2/objects"
+)
+
+//A blob is a large binary artifact, e.g. a firmware image, persisted in
+//chunks so that devices can fetch it from the router when they are ready.
+//Publishing a blob on uri persists:
+//  uri/!blob/<n>        chunk n, a chunk PO (1.0.7.0) of the blob
+//  uri/!blob/manifest   the manifest, a msgpack PO (2.0.7.1)
+//The manifest holds the SHA-256 of every chunk, and the root of a hash
+//tree over them, so a chunk can be checked as soon as it arrives and the
+//whole blob can be identified by the root alone. The chunks are persisted
+//before the manifest, so a manifest never refers to missing chunks
+
+//PODFBlobManifest is the PO of a blob manifest
+const PODFBlobManifest = "2.0.7.1"
+
+//BlobManifestSuffix is the URI suffix, under the blob URI, of the manifest
+const BlobManifestSuffix = "!blob/manifest"
+
+//BlobChunkSuffix returns the URI suffix, under the blob URI, of chunk n
+func BlobChunkSuffix(n int) string {
+	return "!blob/" + strconv.Itoa(n)
+}
+
+//BlobManifest describes a published blob
+type BlobManifest struct {
+	Name      string `msgpack:"name"`
+	Size      int64  `msgpack:"size"`
+	ChunkSize int    `msgpack:"chunksize"`
+	//SHA-256 of the whole blob, as in the chunk POs
+	Hash []byte `msgpack:"hash"`
+	//SHA-256 of each chunk's data, prefixed with 0x00
+	Leaves [][]byte `msgpack:"leaves"`
+	Root   []byte   `msgpack:"root"`
+	//Unix nanoseconds
+	Created int64 `msgpack:"created"`
+}
+
+func blobLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+//BlobTreeRoot returns the root of the hash tree over the leaves. Each node
+//is the SHA-256 of 0x01 and its two children. An unpaired node is carried
+//up to the next level as is
+func BlobTreeRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return blobLeaf(nil)
+	}
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return append([]byte{}, level[0]...)
+}
+
+//CreateBlob splits the content into chunk POs and builds its manifest.
+//Chunk n is to be persisted on uri/BlobChunkSuffix(n)
+func CreateBlob(name string, content []byte, chunkSize int) (*BlobManifest, []objects.PayloadObject, error) {
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumBlob, content)
+	chunks, err := objects.CreateChunks(po, chunkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(content)
+	m := &BlobManifest{
+		Name:      name,
+		Size:      int64(len(content)),
+		ChunkSize: chunkSize,
+		Hash:      hash[:],
+		Leaves:    make([][]byte, len(chunks)),
+	}
+	for i, ch := range chunks {
+		c, _ := objects.LoadChunk(ch)
+		m.Leaves[i] = blobLeaf(c.Data)
+	}
+	m.Root = BlobTreeRoot(m.Leaves)
+	return m, chunks, nil
+}
+
+//CreateBlobManifestPayloadObject returns the manifest as a msgpack PO
+func CreateBlobManifestPayloadObject(m *BlobManifest) (*MsgPackPayloadObjectImpl, error) {
+	return CreateMsgPackPayloadObject(FromDotForm(PODFBlobManifest), m)
+}
+
+//LoadBlobManifest decodes a manifest PO and checks that it is consistent
+func LoadBlobManifest(po PayloadObject) (*BlobManifest, error) {
+	if !po.IsTypeDF(PODFBlobManifest) {
+		return nil, errors.New("not a blob manifest PO")
+	}
+	mp, ok := po.(MsgPackPayloadObject)
+	if !ok {
+		return nil, errors.New("blob manifest is not msgpack")
+	}
+	m := &BlobManifest{}
+	if err := mp.ValueInto(m); err != nil {
+		return nil, err
+	}
+	return m, m.Verify()
+}
+
+//Chunks returns the number of chunks in the blob
+func (m *BlobManifest) Chunks() int {
+	return len(m.Leaves)
+}
+
+//Verify checks that the manifest's fields agree with each other
+func (m *BlobManifest) Verify() error {
+	if m.ChunkSize <= 0 || m.Size < 0 || len(m.Hash) != sha256.Size {
+		return errors.New("malformed blob manifest")
+	}
+	count := (m.Size + int64(m.ChunkSize) - 1) / int64(m.ChunkSize)
+	if count == 0 {
+		count = 1
+	}
+	if int64(len(m.Leaves)) != count {
+		return errors.New("blob manifest has the wrong number of chunks")
+	}
+	if !bytes.Equal(BlobTreeRoot(m.Leaves), m.Root) {
+		return errors.New("blob manifest hash tree does not match its root")
+	}
+	return nil
+}
+
+//chunkLen returns the length of chunk n's data
+func (m *BlobManifest) chunkLen(n int) int64 {
+	ln := m.Size - int64(n)*int64(m.ChunkSize)
+	if ln > int64(m.ChunkSize) {
+		ln = int64(m.ChunkSize)
+	}
+	return ln
+}
+
+//CheckChunk returns the data of chunk PO n if it belongs to this blob
+func (m *BlobManifest) CheckChunk(n int, po objects.PayloadObject) ([]byte, error) {
+	if n < 0 || n >= len(m.Leaves) {
+		return nil, errors.New("chunk index out of range")
+	}
+	c, err := objects.LoadChunk(po)
+	if err != nil {
+		return nil, err
+	}
+	if c.Index != n || c.Count != len(m.Leaves) || !bytes.Equal(c.Hash[:], m.Hash) {
+		return nil, fmt.Errorf("chunk %d is from a different blob", n)
+	}
+	if int64(len(c.Data)) != m.chunkLen(n) || !bytes.Equal(blobLeaf(c.Data), m.Leaves[n]) {
+		return nil, fmt.Errorf("chunk %d does not match the manifest", n)
+	}
+	return c.Data, nil
+}
+
+//BlobFile is where a blob is downloaded to, usually an *os.File
+type BlobFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+//MissingChunks returns the chunks of the blob that are not yet in the
+//file, judged by their hashes, so an interrupted download can be resumed
+func (m *BlobManifest) MissingChunks(f BlobFile) []int {
+	rv := []int{}
+	buf := make([]byte, m.ChunkSize)
+	for n := range m.Leaves {
+		ln := m.chunkLen(n)
+		rn, _ := f.ReadAt(buf[:ln], int64(n)*int64(m.ChunkSize))
+		if int64(rn) != ln || !bytes.Equal(blobLeaf(buf[:ln]), m.Leaves[n]) {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+//FetchBlob downloads the chunks missing from the file with fetch, checks
+//each against the manifest and writes it in place. Chunks already in the
+//file are kept, so calling it again after an error resumes the download.
+//progress, if not nil, is called after each chunk with the number of
+//chunks still missing
+func (m *BlobManifest) FetchBlob(f BlobFile, fetch func(n int) (objects.PayloadObject, error), progress func(left int)) error {
+	if err := m.Verify(); err != nil {
+		return err
+	}
+	missing := m.MissingChunks(f)
+	for i, n := range missing {
+		po, err := fetch(n)
+		if err != nil {
+			return fmt.Errorf("could not fetch chunk %d: %v", n, err)
+		}
+		data, err := m.CheckChunk(n, po)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(data, int64(n)*int64(m.ChunkSize)); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(len(missing) - i - 1)
+		}
+	}
+	return f.Truncate(m.Size)
+}
@@ -25,11 +25,18 @@ func ToSimpleMessage(m *core.Message) *SimpleMessage {
 	for i, po := range m.PayloadObjects {
 		poz[i], poe[i] = LoadPayloadObject(po.GetPONum(), po.GetContent())
 	}
+	//Parse any lazy ROs, dropping malformed ones as LoadMessage does
+	roz := make([]objects.RoutingObject, 0, len(m.RoutingObjects))
+	for _, ro := range m.RoutingObjects {
+		if ro, err := objects.ParseRoutingObject(ro); err == nil {
+			roz = append(roz, ro)
+		}
+	}
 	return &SimpleMessage{
 		From:     crypto.FmtKey(*m.OriginVK),
 		URI:      m.Topic,
 		POs:      poz,
-		ROs:      m.RoutingObjects,
+		ROs:      roz,
 		POErrors: poe,
 	}
 }
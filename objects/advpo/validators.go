@@ -0,0 +1,156 @@
+package advpo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/immesys/bw2/internal/core"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"gopkg.in/yaml.v2"
+)
+
+//Validator checks the contents of a payload object, returning an error if
+//they are malformed
+type Validator func(ponum int, contents []byte) error
+
+type validatorEntry struct {
+	name  string
+	df    string
+	ponum int
+	mask  int
+	v     Validator
+}
+
+var validators = struct {
+	mu sync.RWMutex
+	l  []validatorEntry
+}{}
+
+func init() {
+	RegisterValidator("builtin.text", "64.0.0.0/4", validateText)
+	RegisterValidator("builtin.msgpack", "2.0.0.0/8", validateMsgPack)
+	RegisterValidator("builtin.yaml", "67.0.0.0/8", validateYAML)
+	RegisterValidator("builtin.metadata", "2.0.3.1/32", validateMetadata)
+}
+
+//parseMaskedDotForm parses a dot form with an optional /mask, which
+//defaults to 32
+func parseMaskedDotForm(df string) (int, int, error) {
+	parts := strings.SplitN(df, "/", 2)
+	mask := 32
+	if len(parts) == 2 {
+		var err error
+		mask, err = strconv.Atoi(parts[1])
+		if err != nil || mask < 0 || mask > 32 {
+			return 0, 0, fmt.Errorf("bad mask in %q", df)
+		}
+	}
+	ponum, err := PONumFromDotForm(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	return ponum, mask, nil
+}
+
+//RegisterValidator adds a validator for the payload objects matching a
+//dot form such as "2.0.0.0/8". A payload object is checked by every
+//validator that matches it. Registering a name again replaces the
+//validator
+func RegisterValidator(name, df string, v Validator) error {
+	ponum, mask, err := parseMaskedDotForm(df)
+	if err != nil {
+		return err
+	}
+	validators.mu.Lock()
+	defer validators.mu.Unlock()
+	e := validatorEntry{name: name, df: df, ponum: ponum, mask: mask, v: v}
+	for i := range validators.l {
+		if validators.l[i].name == name {
+			validators.l[i] = e
+			return nil
+		}
+	}
+	validators.l = append(validators.l, e)
+	return nil
+}
+
+//UnregisterValidator removes a validator, including a builtin one
+func UnregisterValidator(name string) {
+	validators.mu.Lock()
+	defer validators.mu.Unlock()
+	for i := range validators.l {
+		if validators.l[i].name == name {
+			validators.l = append(validators.l[:i], validators.l[i+1:]...)
+			return
+		}
+	}
+}
+
+//Validators returns the registered validator names and their dot forms
+func Validators() map[string]string {
+	validators.mu.RLock()
+	defer validators.mu.RUnlock()
+	rv := make(map[string]string, len(validators.l))
+	for _, e := range validators.l {
+		rv[e.name] = e.df
+	}
+	return rv
+}
+
+//ValidatePayloadObject runs the validators matching the payload object.
+//Payload objects with no matching validator are valid
+func ValidatePayloadObject(ponum int, contents []byte) error {
+	validators.mu.RLock()
+	l := validators.l
+	validators.mu.RUnlock()
+	for _, e := range l {
+		if ponum>>uint(32-e.mask) != e.ponum>>uint(32-e.mask) {
+			continue
+		}
+		if err := e.v(ponum, contents); err != nil {
+			return fmt.Errorf("PO %s failed %s: %v", PONumDotForm(ponum), e.name, err)
+		}
+	}
+	return nil
+}
+
+//ValidateMessage validates every payload object in the message
+func ValidateMessage(m *core.Message) error {
+	for _, po := range m.PayloadObjects {
+		if err := ValidatePayloadObject(po.GetPONum(), po.GetContent()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateText(ponum int, contents []byte) error {
+	if !utf8.Valid(contents) {
+		return fmt.Errorf("not valid UTF-8")
+	}
+	return nil
+}
+
+func validateMsgPack(ponum int, contents []byte) error {
+	var v interface{}
+	return msgpack.Unmarshal(contents, &v)
+}
+
+func validateYAML(ponum int, contents []byte) error {
+	var v interface{}
+	return yaml.Unmarshal(contents, &v)
+}
+
+func validateMetadata(ponum int, contents []byte) error {
+	mt := MetadataTuple{}
+	if err := msgpack.Unmarshal(contents, &mt); err != nil {
+		return err
+	}
+	if mt.Timestamp <= 0 {
+		return fmt.Errorf("no timestamp")
+	}
+	return nil
+}
@@ -30,4 +30,9 @@ const (
 	ROExpiry               = 0x40
 	RORevocation           = 0x50
 	RODesignatedRouterVK   = 0x33
+	ROTrace                = 0x60
+	ROConsumerAck          = 0x61
+	ROTimestamp            = 0x62
+	ROSubscriptionFilter   = 0x63
+	ROIdempotencyKey       = 0x64
 )
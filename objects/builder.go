@@ -0,0 +1,374 @@
+package objects
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//MaxDOTTTL is the largest TTL a DOT can carry
+const MaxDOTTTL = 255
+
+//maxStringField is the longest contact or comment an RO can carry
+const maxStringField = 255
+
+//DOTBuilder makes a DOT. The setters on DOT panic when they are misused,
+//which suits the router but not programs built on this package. A builder
+//instead remembers the first mistake, ignores everything after it, and
+//Build returns it. Build also checks the DOT as a whole before signing it
+type DOTBuilder struct {
+	d   *DOT
+	err error
+}
+
+//NewAccessDOTBuilder starts an access DOT from giver to receiver
+func NewAccessDOTBuilder(giverVK, receiverVK []byte) *DOTBuilder {
+	return &DOTBuilder{d: CreateDOT(true, giverVK, receiverVK)}
+}
+
+//NewPermissionDOTBuilder starts a permission DOT from giver to receiver
+func NewPermissionDOTBuilder(giverVK, receiverVK []byte) *DOTBuilder {
+	return &DOTBuilder{d: CreateDOT(false, giverVK, receiverVK)}
+}
+
+func (b *DOTBuilder) fail(code int, msg string) *DOTBuilder {
+	if b.err == nil {
+		b.err = bwe.M(code, msg)
+	}
+	return b
+}
+
+func (b *DOTBuilder) needAccess(what string) bool {
+	if !b.d.isAccess {
+		b.fail(bwe.InvalidDOT, what+" is only for access DOTs")
+		return false
+	}
+	return true
+}
+
+//URI sets the namespace and URI suffix an access DOT grants on
+func (b *DOTBuilder) URI(mvk []byte, suffix string) *DOTBuilder {
+	if b.err != nil || !b.needAccess("a URI") {
+		return b
+	}
+	if len(mvk) != 32 {
+		return b.fail(bwe.InvalidDOT, "the namespace must be a 32 byte VK")
+	}
+	if err := util.ValidateSuffix(suffix); err != nil {
+		b.err = bwe.WrapC(bwe.BadURI, err)
+		return b
+	}
+	b.d.SetAccessURI(mvk, suffix)
+	return b
+}
+
+//Permissions sets what an access DOT grants, as a string like "C*TP"
+func (b *DOTBuilder) Permissions(perms string) *DOTBuilder {
+	if b.err != nil || !b.needAccess("a permission string") {
+		return b
+	}
+	if GetADPSFromPermString(perms) == nil {
+		return b.fail(bwe.BadPermissions, fmt.Sprintf("%q is not a permission string", perms))
+	}
+	b.d.SetPermString(perms)
+	return b
+}
+
+//NoDelegate sets the permissions, as a string like "P", that the receiver
+//of an access DOT may not delegate further. Routers that predate this
+//option skip it, so they accept the DOT but do not enforce it
+func (b *DOTBuilder) NoDelegate(perms string) *DOTBuilder {
+	if b.err != nil || !b.needAccess("delegation flags") {
+		return b
+	}
+	ps := GetADPSFromPermString(perms)
+	if ps == nil {
+		return b.fail(bwe.BadPermissions, fmt.Sprintf("%q is not a permission string", perms))
+	}
+	b.d.SetNoDelegate(ps)
+	return b
+}
+
+//Permission sets a key in a permission DOT's table
+func (b *DOTBuilder) Permission(key, value string) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	switch {
+	case b.d.isAccess:
+		return b.fail(bwe.InvalidDOT, "permission keys are only for permission DOTs")
+	case key == "":
+		return b.fail(bwe.InvalidDOT, "a permission key cannot be empty")
+	case len(key) > 255:
+		return b.fail(bwe.InvalidDOT, "a permission key can be at most 255 bytes")
+	case len(value) > 65535:
+		return b.fail(bwe.InvalidDOT, "a permission value can be at most 65535 bytes")
+	}
+	b.d.kv[key] = value
+	return b
+}
+
+//TTL sets how many times the DOT may be delegated, up to MaxDOTTTL
+func (b *DOTBuilder) TTL(ttl int) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if ttl < 0 || ttl > MaxDOTTTL {
+		return b.fail(bwe.InvalidDOT, fmt.Sprintf("the TTL must be between 0 and %d, not %d", MaxDOTTTL, ttl))
+	}
+	b.d.ttl = ttl
+	return b
+}
+
+//PublishLimits sets the limits on messages authorised by an access DOT
+func (b *DOTBuilder) PublishLimits(l PublishLimits) *DOTBuilder {
+	if b.err != nil || !b.needAccess("publish limits") {
+		return b
+	}
+	if l.TxLimit < 0 || l.StoreLimit < 0 || l.Retain < 0 || l.Retain > 255 {
+		return b.fail(bwe.InvalidDOT, "publish limits must not be negative, and Retain is at most 255")
+	}
+	b.d.pubLim = &l
+	return b
+}
+
+//Created sets when the DOT was made. Build uses the current time if it is
+//not set
+func (b *DOTBuilder) Created(t time.Time) *DOTBuilder {
+	if b.err == nil {
+		b.d.SetCreation(t)
+	}
+	return b
+}
+
+//Expiry sets when the DOT expires
+func (b *DOTBuilder) Expiry(t time.Time) *DOTBuilder {
+	if b.err == nil {
+		b.d.SetExpiry(t)
+	}
+	return b
+}
+
+//ExpiryFromNow sets the DOT to expire the given time after it is built
+func (b *DOTBuilder) ExpiryFromNow(d time.Duration) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if d <= 0 {
+		return b.fail(bwe.InvalidDOT, "the DOT would have expired already")
+	}
+	b.d.SetExpireFromNow(d)
+	return b
+}
+
+//Contact sets the contact, at most 255 bytes
+func (b *DOTBuilder) Contact(v string) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(v) > maxStringField {
+		return b.fail(bwe.InvalidDOT, "the contact can be at most 255 bytes")
+	}
+	b.d.contact = v
+	return b
+}
+
+//Comment sets the comment, at most 255 bytes
+func (b *DOTBuilder) Comment(v string) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(v) > maxStringField {
+		return b.fail(bwe.InvalidDOT, "the comment can be at most 255 bytes")
+	}
+	b.d.comment = v
+	return b
+}
+
+//Revoker adds an entity that may revoke the DOT
+func (b *DOTBuilder) Revoker(vk []byte) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(vk) != 32 {
+		return b.fail(bwe.InvalidDOT, "a revoker must be a 32 byte VK")
+	}
+	b.d.revokers = append(b.d.revokers, vk)
+	return b
+}
+
+//Algorithm sets the signature scheme of the giver, ed25519 by default
+func (b *DOTBuilder) Algorithm(alg SigAlgorithm) *DOTBuilder {
+	if b.err != nil {
+		return b
+	}
+	if _, ok := GetSignatureProvider(alg); !ok {
+		return b.fail(bwe.InvalidDOT, fmt.Sprintf("signature algorithm %d is not registered", alg))
+	}
+	b.d.alg = alg
+	return b
+}
+
+//Build checks the DOT and signs it with the giver's SK. The DOT is only
+//returned if nothing was wrong
+func (b *DOTBuilder) Build(giverSK []byte) (*DOT, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	d := b.d
+	switch {
+	case len(d.giverVK) != 32 || len(d.receiverVK) != 32:
+		return nil, bwe.M(bwe.InvalidDOT, "the giver and receiver must be 32 byte VKs")
+	case !checkKeypair(mustSignatureProvider(d.alg), giverSK, d.giverVK):
+		return nil, bwe.M(bwe.InvalidDOT, "the SK is not the giver's")
+	case d.isAccess && len(d.mVK) == 0:
+		return nil, bwe.M(bwe.InvalidDOT, "an access DOT needs a URI")
+	case d.isAccess && d.GetPermString() == "":
+		return nil, bwe.M(bwe.BadPermissions, "an access DOT must grant some permission")
+	}
+	if d.created == nil {
+		d.SetCreationToNow()
+	}
+	if d.expires != nil && !d.expires.After(*d.created) {
+		return nil, bwe.M(bwe.InvalidDOT, "the DOT expires before it was created")
+	}
+	d.Encode(giverSK)
+	return d, nil
+}
+
+//EntityBuilder makes an entity, returning an error from Build where the
+//setters on Entity panic
+type EntityBuilder struct {
+	e   *Entity
+	err error
+}
+
+//NewEntityBuilder starts an entity with a new keypair
+func NewEntityBuilder() *EntityBuilder {
+	sk, vk := GenerateKeypair()
+	return &EntityBuilder{e: &Entity{sk: sk, vk: vk, revokers: make([][]byte, 0)}}
+}
+
+//NewEntityBuilderWithKeypair starts an entity with an existing keypair,
+//such as one derived from a mnemonic. Build checks that they match
+func NewEntityBuilderWithKeypair(sk, vk []byte) *EntityBuilder {
+	return &EntityBuilder{e: &Entity{sk: sk, vk: vk, revokers: make([][]byte, 0)}}
+}
+
+//NewEntityBuilderWithAlgorithm starts an entity with a new keypair for a
+//registered signature scheme
+func NewEntityBuilderWithAlgorithm(alg SigAlgorithm) *EntityBuilder {
+	p, ok := GetSignatureProvider(alg)
+	if !ok {
+		b := &EntityBuilder{e: &Entity{}}
+		return b.fail(fmt.Sprintf("signature algorithm %d is not registered", alg))
+	}
+	sk, vk := p.GenerateKeypair()
+	return &EntityBuilder{e: &Entity{sk: sk, vk: vk, alg: alg, revokers: make([][]byte, 0)}}
+}
+
+func (b *EntityBuilder) fail(msg string) *EntityBuilder {
+	if b.err == nil {
+		b.err = bwe.M(bwe.InvalidEntity, msg)
+	}
+	return b
+}
+
+//Contact sets the contact, at most 255 bytes
+func (b *EntityBuilder) Contact(v string) *EntityBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(v) > maxStringField {
+		return b.fail("the contact can be at most 255 bytes")
+	}
+	b.e.contact = v
+	return b
+}
+
+//Comment sets the comment, at most 255 bytes
+func (b *EntityBuilder) Comment(v string) *EntityBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(v) > maxStringField {
+		return b.fail("the comment can be at most 255 bytes")
+	}
+	b.e.comment = v
+	return b
+}
+
+//Revoker adds an entity that may revoke this one
+func (b *EntityBuilder) Revoker(vk []byte) *EntityBuilder {
+	if b.err != nil {
+		return b
+	}
+	if len(vk) != 32 {
+		return b.fail("a revoker must be a 32 byte VK")
+	}
+	b.e.revokers = append(b.e.revokers, vk)
+	return b
+}
+
+//Created sets when the entity was made. Build uses the current time if it
+//is not set
+func (b *EntityBuilder) Created(t time.Time) *EntityBuilder {
+	if b.err == nil {
+		b.e.created = &t
+	}
+	return b
+}
+
+//Expiry sets when the entity expires
+func (b *EntityBuilder) Expiry(t time.Time) *EntityBuilder {
+	if b.err == nil {
+		b.e.SetExpiry(t)
+	}
+	return b
+}
+
+//ExpiryFromNow sets the entity to expire the given time after it is built
+func (b *EntityBuilder) ExpiryFromNow(d time.Duration) *EntityBuilder {
+	if b.err != nil {
+		return b
+	}
+	if d <= 0 {
+		return b.fail("the entity would have expired already")
+	}
+	b.e.SetCreationToNow()
+	b.e.SetExpiry(b.e.created.Add(d))
+	return b
+}
+
+//Build checks the entity and signs it. The entity is only returned if
+//nothing was wrong
+func (b *EntityBuilder) Build() (*Entity, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	e := b.e
+	if len(e.vk) != 32 || !checkKeypair(mustSignatureProvider(e.alg), e.sk, e.vk) {
+		return nil, bwe.M(bwe.InvalidEntity, "the SK and VK are not a keypair")
+	}
+	if e.created == nil {
+		e.SetCreationToNow()
+	}
+	if e.expires != nil && !e.expires.After(*e.created) {
+		return nil, bwe.M(bwe.InvalidEntity, "the entity expires before it was created")
+	}
+	e.Encode()
+	return e, nil
+}
+
+//checkKeypair is true if sk signs for vk with the scheme of p
+func checkKeypair(p SignatureProvider, sk, vk []byte) bool {
+	if len(sk) != 32 || len(vk) != 32 {
+		return false
+	}
+	blob := []byte("keypair check")
+	sig := make([]byte, p.SigSize())
+	p.Sign(sk, vk, sig, blob)
+	return p.Verify(vk, sig, blob)
+}
@@ -0,0 +1,209 @@
+package objects
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+//Chunk (1.0.7.0/32): Chunk of a large payload
+//A payload object too large for one message is split into chunks, each
+//published in its own message. The content is a 64 byte little endian
+//header: stream ID (16 bytes), PO number of the whole payload (4), chunk
+//index (4), chunk count (4), total length (4), SHA-256 of the whole
+//payload (32), followed by the chunk's data
+const PONumChunk = 16779008
+const PODFMaskChunk = `1.0.7.0/32`
+const PODFChunk = `1.0.7.0`
+const POMaskChunk = 32
+
+const chunkHeaderLen = 64
+
+//DefaultChunkSize leaves room for the rest of a message within the
+//default router message size
+const DefaultChunkSize = 1024 * 1024
+
+//Chunk is a decoded chunk PO
+type Chunk struct {
+	StreamID [16]byte
+	//The PO number of the reassembled payload
+	PONum int
+	Index int
+	Count int
+	Total int
+	Hash  [32]byte
+	Data  []byte
+}
+
+//CreateChunks splits a payload object into chunk POs of at most chunkSize
+//bytes of data each. They can be published in any order
+func CreateChunks(po PayloadObject, chunkSize int) ([]PayloadObject, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	content := po.GetContent()
+	count := (len(content) + chunkSize - 1) / chunkSize
+	if count == 0 {
+		count = 1
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(content)
+	rv := make([]PayloadObject, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		data := content[i*chunkSize : end]
+		blob := make([]byte, chunkHeaderLen+len(data))
+		copy(blob, id[:])
+		binary.LittleEndian.PutUint32(blob[16:], uint32(po.GetPONum()))
+		binary.LittleEndian.PutUint32(blob[20:], uint32(i))
+		binary.LittleEndian.PutUint32(blob[24:], uint32(count))
+		binary.LittleEndian.PutUint32(blob[28:], uint32(len(content)))
+		copy(blob[32:], hash[:])
+		copy(blob[chunkHeaderLen:], data)
+		cpo, err := CreateOpaquePayloadObject(PONumChunk, blob)
+		if err != nil {
+			return nil, err
+		}
+		rv[i] = cpo
+	}
+	return rv, nil
+}
+
+//LoadChunk decodes a chunk PO
+func LoadChunk(po PayloadObject) (*Chunk, error) {
+	if po.GetPONum() != PONumChunk {
+		return nil, errors.New("not a chunk PO")
+	}
+	blob := po.GetContent()
+	if len(blob) < chunkHeaderLen {
+		return nil, errors.New("chunk PO is too short")
+	}
+	c := &Chunk{
+		PONum: int(binary.LittleEndian.Uint32(blob[16:])),
+		Index: int(binary.LittleEndian.Uint32(blob[20:])),
+		Count: int(binary.LittleEndian.Uint32(blob[24:])),
+		Total: int(binary.LittleEndian.Uint32(blob[28:])),
+		Data:  blob[chunkHeaderLen:],
+	}
+	copy(c.StreamID[:], blob)
+	copy(c.Hash[:], blob[32:])
+	if c.Count == 0 || c.Index >= c.Count {
+		return nil, errors.New("bad chunk index")
+	}
+	return c, nil
+}
+
+type chunkStream struct {
+	first  *Chunk
+	chunks [][]byte
+	have   int
+	size   int
+	seen   time.Time
+}
+
+//Reassembler collects chunk POs into the payloads they were split from.
+//Streams that are not completed within the timeout are dropped, as are
+//the oldest streams when the chunks held total more than the memory limit
+type Reassembler struct {
+	mu       sync.Mutex
+	streams  map[[16]byte]*chunkStream
+	held     int
+	maxBytes int
+	timeout  time.Duration
+}
+
+//NewReassembler returns a Reassembler holding at most maxBytes of
+//incomplete payloads, each for at most timeout
+func NewReassembler(maxBytes int, timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		streams:  make(map[[16]byte]*chunkStream),
+		maxBytes: maxBytes,
+		timeout:  timeout,
+	}
+}
+
+//Add adds a chunk PO. When it is the last missing chunk of its payload,
+//the reassembled payload object is returned, otherwise nil. Duplicate
+//chunks are ignored
+func (r *Reassembler) Add(po PayloadObject) (PayloadObject, error) {
+	c, err := LoadChunk(po)
+	if err != nil {
+		return nil, err
+	}
+	if c.Total > r.maxBytes {
+		return nil, errors.New("chunked payload is larger than the reassembly limit")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.expire(now)
+	s, ok := r.streams[c.StreamID]
+	if !ok {
+		s = &chunkStream{first: c, chunks: make([][]byte, c.Count)}
+		r.streams[c.StreamID] = s
+	} else if c.Count != s.first.Count || c.Total != s.first.Total || c.Hash != s.first.Hash {
+		return nil, errors.New("chunk does not match its stream")
+	}
+	s.seen = now
+	if s.chunks[c.Index] != nil {
+		return nil, nil
+	}
+	s.chunks[c.Index] = append([]byte{}, c.Data...)
+	s.have++
+	s.size += len(c.Data)
+	r.held += len(c.Data)
+	if s.have < c.Count {
+		r.evict(c.StreamID)
+		return nil, nil
+	}
+	r.drop(c.StreamID)
+	whole := bytes.Join(s.chunks, nil)
+	if len(whole) != c.Total || sha256.Sum256(whole) != c.Hash {
+		return nil, errors.New("reassembled payload does not match its hash")
+	}
+	return CreateOpaquePayloadObject(c.PONum, whole)
+}
+
+func (r *Reassembler) drop(id [16]byte) {
+	if s, ok := r.streams[id]; ok {
+		r.held -= s.size
+		delete(r.streams, id)
+	}
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for id, s := range r.streams {
+		if now.Sub(s.seen) > r.timeout {
+			r.drop(id)
+		}
+	}
+}
+
+//evict drops the least recently added to streams, other than keep, until
+//the held chunks are within the limit
+func (r *Reassembler) evict(keep [16]byte) {
+	for r.held > r.maxBytes {
+		var oldest [16]byte
+		var oldestSeen time.Time
+		found := false
+		for id, s := range r.streams {
+			if id != keep && (!found || s.seen.Before(oldestSeen)) {
+				oldest, oldestSeen, found = id, s.seen, true
+			}
+		}
+		if !found {
+			return
+		}
+		r.drop(oldest)
+	}
+}
@@ -0,0 +1,85 @@
+package objects
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	po, _ := CreateOpaquePayloadObject(PONumBlob, content)
+	chunks, err := CreateChunks(po, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+	r := NewReassembler(1<<20, time.Minute)
+	//Out of order, with a duplicate
+	for _, i := range []int{3, 1, 1, 0} {
+		whole, err := r.Add(chunks[i])
+		if err != nil || whole != nil {
+			t.Fatalf("early result %v %v", whole, err)
+		}
+	}
+	whole, err := r.Add(chunks[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whole == nil || whole.GetPONum() != PONumBlob || !bytes.Equal(whole.GetContent(), content) {
+		t.Fatal("reassembled payload mismatch")
+	}
+	if len(r.streams) != 0 || r.held != 0 {
+		t.Fatal("stream not released")
+	}
+}
+
+func TestChunkCorrupt(t *testing.T) {
+	po, _ := CreateOpaquePayloadObject(PONumString, []byte("hello chunked world"))
+	chunks, err := CreateChunks(po, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks[0].GetContent()[chunkHeaderLen] ^= 1
+	r := NewReassembler(1<<20, time.Minute)
+	for i, ch := range chunks {
+		_, err = r.Add(ch)
+		if i < len(chunks)-1 && err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err == nil {
+		t.Fatal("corrupt payload was not caught")
+	}
+}
+
+func TestChunkLimit(t *testing.T) {
+	po, _ := CreateOpaquePayloadObject(PONumBlob, make([]byte, 100))
+	r := NewReassembler(150, time.Minute)
+	a, _ := CreateChunks(po, 60)
+	b, _ := CreateChunks(po, 60)
+	if _, err := r.Add(a[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(b[0]); err != nil {
+		t.Fatal(err)
+	}
+	//The third partial chunk evicts the oldest stream
+	c, _ := CreateChunks(po, 60)
+	if _, err := r.Add(c[0]); err != nil {
+		t.Fatal(err)
+	}
+	if r.held > 150 || len(r.streams) != 2 {
+		t.Fatalf("limit not kept: %d bytes in %d streams", r.held, len(r.streams))
+	}
+	big, _ := CreateOpaquePayloadObject(PONumBlob, make([]byte, 200))
+	bc, _ := CreateChunks(big, 60)
+	if _, err := r.Add(bc[0]); err == nil {
+		t.Fatal("payload larger than the limit accepted")
+	}
+}
@@ -49,6 +49,25 @@ func (oe ObjectError) Error() string {
 	return oe.Message
 }
 
+//hasBytes reports whether content has n bytes from idx on. The decoders
+//parse bytes off the network, so they check before every read and return
+//an error for a truncated object rather than panicking
+func hasBytes(content []byte, idx int, n int) bool {
+	return idx >= 0 && n >= 0 && idx+n <= len(content)
+}
+
+//hasHeader reports whether content has a whole option header (type,
+//length and value) or the zero end marker at idx
+func hasHeader(content []byte, idx int) bool {
+	if !hasBytes(content, idx, 1) {
+		return false
+	}
+	if content[idx] == 0x00 {
+		return true
+	}
+	return hasBytes(content, idx, 2) && hasBytes(content, idx+2, int(content[idx+1]))
+}
+
 //PayloadObject is the interface that is common among all objects that
 //appear in the payload block
 type PayloadObject interface {
@@ -0,0 +1,105 @@
+package objects
+
+//noDelegateOption is the option type in access DOTs that holds the
+//permissions the receiver may not delegate further, as two bytes in the
+//layout of the DOT's own permissions. Routers from before it skip an
+//unknown option as the type, the length and then length-1 more bytes, so
+//its length is 3 rather than 2. That way they step over it to the next
+//field, and accept the DOT without enforcing it
+const noDelegateOption = 0x07
+
+//noDelegateLen is the length byte of the option, which counts the length
+//byte itself for the sake of old routers
+const noDelegateLen = 3
+
+//permBits packs a permission set in the layout of an access DOT. Unlike
+//the DOT's own permissions each flag is kept on its own, so that, say, C*
+//alone can be singled out
+func permBits(ps *AccessDOTPermissionSet) uint16 {
+	rv := uint16(0)
+	for i, f := range []bool{ps.CanConsume, ps.CanConsumePlus, ps.CanConsumeStar,
+		ps.CanTap, ps.CanTapPlus, ps.CanTapStar, ps.CanPublish, ps.CanList} {
+		if f {
+			rv |= 1 << uint(i)
+		}
+	}
+	return rv
+}
+
+func permSetFromBits(b uint16) *AccessDOTPermissionSet {
+	return &AccessDOTPermissionSet{
+		CanConsume:     b&0x0001 != 0,
+		CanConsumePlus: b&0x0002 != 0,
+		CanConsumeStar: b&0x0004 != 0,
+		CanTap:         b&0x0008 != 0,
+		CanTapPlus:     b&0x0010 != 0,
+		CanTapStar:     b&0x0020 != 0,
+		CanPublish:     b&0x0040 != 0,
+		CanList:        b&0x0080 != 0,
+	}
+}
+
+//GetNoDelegate returns the permissions the receiver of an access DOT may
+//not delegate, or nil if it may delegate everything the DOT grants
+func (ro *DOT) GetNoDelegate() *AccessDOTPermissionSet {
+	if ro.noDelegate == nil {
+		return nil
+	}
+	rv := *ro.noDelegate
+	return &rv
+}
+
+//SetNoDelegate sets the permissions the receiver of an access DOT may not
+//delegate, nil or empty for none. A chain that continues past the receiver
+//does not get them, whatever the TTL. It panics if this is a permission DOT
+func (ro *DOT) SetNoDelegate(ps *AccessDOTPermissionSet) {
+	if !ro.isAccess {
+		panic("Not an access DOT")
+	}
+	if ps == nil || permBits(ps) == 0 {
+		ro.noDelegate = nil
+		return
+	}
+	nd := *ps
+	ro.noDelegate = &nd
+}
+
+//Without removes the permissions in rhs from ps. Removing C also removes
+//C+ and C*, and likewise for T
+func (ps *AccessDOTPermissionSet) Without(rhs *AccessDOTPermissionSet) {
+	if rhs == nil {
+		return
+	}
+	ps.CanPublish = ps.CanPublish && !rhs.CanPublish
+	ps.CanConsume = ps.CanConsume && !rhs.CanConsume
+	ps.CanConsumePlus = ps.CanConsumePlus && !rhs.CanConsumePlus && ps.CanConsume
+	ps.CanConsumeStar = ps.CanConsumeStar && !rhs.CanConsumeStar && ps.CanConsumePlus
+	ps.CanTap = ps.CanTap && !rhs.CanTap
+	ps.CanTapPlus = ps.CanTapPlus && !rhs.CanTapPlus && ps.CanTap
+	ps.CanTapStar = ps.CanTapStar && !rhs.CanTapStar && ps.CanTapPlus
+	ps.CanList = ps.CanList && !rhs.CanList
+}
+
+//Union adds the permissions in rhs, which may be nil, to ps
+func (ps *AccessDOTPermissionSet) Union(rhs *AccessDOTPermissionSet) {
+	if rhs == nil {
+		return
+	}
+	*ps = *permSetFromBits(permBits(ps) | permBits(rhs))
+}
+
+//ChainPermissionSet returns what a chain of access DOTs grants the last
+//receiver: what every DOT grants, less anything a DOT before the last
+//forbids its receiver to delegate
+func ChainPermissionSet(dots []*DOT) *AccessDOTPermissionSet {
+	ps := dots[0].GetPermissionSet()
+	nodel := &AccessDOTPermissionSet{}
+	for i, d := range dots {
+		if i > 0 {
+			ps.Without(nodel)
+			ps.ReduceBy(d.GetPermissionSet())
+		}
+		nodel.Union(d.GetNoDelegate())
+	}
+	return ps
+}
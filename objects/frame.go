@@ -67,12 +67,54 @@ const (
 	CmdSubscribeView         = "vsub"
 	CmdPublishView           = "vpub"
 	CmdListView              = "vlst"
+	CmdViewJournal           = "vjnl"
+	CmdBindView              = "vbnd"
+	CmdTearDownView          = "vtdn"
+	CmdViewInfo              = "vinf"
 	CmdUnsubscribe           = "usub"
 	CmdRevokeDROffer         = "rdro"
 	CmdRevokeDRAccept        = "rdra"
 	CmdRevokeRO              = "revk"
 	CmdPutRevocation         = "prvk"
 	CmdFindDots              = "fdot"
+	CmdTxParams              = "txpa"
+	CmdSendRawTx             = "srtx"
+	CmdListAliases           = "lsal"
+	CmdUpdateAlias           = "upal"
+	CmdTransferAlias         = "xfal"
+	CmdDeleteAlias           = "dlal"
+	CmdSearchRegistry        = "sreg"
+	CmdExportNamespace       = "nsex"
+	CmdImportNamespace       = "nsim"
+	CmdDRHealth              = "drhs"
+	CmdListDesignatedRouters = "lsdr"
+	CmdResolutionCache       = "rcch"
+	CmdNack                  = "nack"
+	CmdDelete                = "dele"
+	CmdContractCode          = "code"
+	CmdContracts             = "ctrs"
+	CmdListClients           = "lscl"
+	CmdListSubscriptions     = "lssb"
+	CmdDiscoverNamespace     = "dnsn"
+	CmdDropPeer              = "drpr"
+	CmdDrain                 = "drin"
+	CmdStandbyStatus         = "stby"
+	CmdPromote               = "prom"
+	CmdRotateEntity          = "rote"
+	CmdRotateDR              = "rodr"
+	CmdListServices          = "svcs"
+	CmdCall                  = "call"
+	CmdStoreExport           = "stex"
+	CmdStoreImport           = "stim"
+	CmdRequestDOT            = "rqdt"
+	CmdListDOTRequests       = "lsrq"
+	CmdApproveDOTRequest     = "aprq"
+	CmdRejectDOTRequest      = "rjrq"
+	CmdMintTempCredential    = "mktp"
+	CmdAddSchedule           = "adsc"
+	CmdListSchedules         = "lssc"
+	CmdCancelSchedule        = "rmsc"
+	CmdRouterStats           = "rsts"
 
 	CmdResponse = "resp"
 	CmdResult   = "rslt"
@@ -102,6 +144,10 @@ type Frame struct {
 	ROs     []ROEntry
 	POs     []POEntry
 	Length  int
+	//Set if the frame's objects were larger than the limit it was read
+	//with. They were skipped, so the frame has none of its ROs or POs
+	Oversize bool
+	objsize  int
 }
 
 func CreateFrame(cmd string, seqno int) *Frame {
@@ -235,6 +281,22 @@ func (f *Frame) WriteToStream(s *bufio.Writer) {
 	s.Flush()
 }
 
+//skipOversize adds an object's length to the frame's total and, once the
+//total is over the limit, skips the object and its newline
+func (f *Frame) skipOversize(s *bufio.Reader, length int, limit int) (bool, error) {
+	f.objsize += length
+	if limit <= 0 || f.objsize <= limit {
+		return false, nil
+	}
+	f.Oversize = true
+	f.ROs = nil
+	f.POs = nil
+	if _, err := s.Discard(length + 1); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func ReadExactly(s *bufio.Reader, to []byte) error {
 	n := 0
 	for n < len(to) {
@@ -247,14 +309,13 @@ func ReadExactly(s *bufio.Reader, to []byte) error {
 	return nil
 }
 func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
-	defer func() {
-		if r := recover(); r != nil {
-			f = nil
-			fmt.Println(r)
-			e = errors.New("Malformed frame")
-			return
-		}
-	}()
+	return LoadFrameFromStreamLimit(s, 0)
+}
+
+//LoadFrameFromStreamLimit is like LoadFrameFromStream, but if the ROs and
+//POs of the frame total more than limit bytes they are skipped instead of
+//buffered, and the frame is marked Oversize. A limit of zero means none
+func LoadFrameFromStreamLimit(s *bufio.Reader, limit int) (*Frame, error) {
 	hdr := make([]byte, 27)
 	if e := ReadExactly(s, hdr); e != nil {
 		return nil, e
@@ -262,7 +323,7 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 	//Remember header is
 	//    4          15         26
 	//CMMD 10DIGITLEN 10DIGITSEQ\n
-	f = &Frame{}
+	f := &Frame{}
 	f.Cmd = string(hdr[0:4])
 	cx, err := strconv.ParseUint(string(hdr[5:15]), 10, 32)
 	if err != nil {
@@ -297,6 +358,9 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 				return nil, err
 			}
 			h.ILength = int(cx)
+			if h.ILength > SaneObjectSize {
+				return nil, bwe.M(bwe.MalformedOOBCommand, "Header is too large")
+			}
 			body := make([]byte, h.ILength)
 			if e := ReadExactly(s, body); e != nil {
 				return nil, e
@@ -318,6 +382,11 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 				return nil, err
 			}
 			length := int(cx)
+			if skip, err := f.skipOversize(s, length, limit); err != nil {
+				return nil, err
+			} else if skip {
+				continue
+			}
 			body := make([]byte, length)
 			if e := ReadExactly(s, body); e != nil {
 				return nil, e
@@ -328,11 +397,14 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 			}
 			ro, err := LoadRoutingObject(ronum, body)
 			if err != nil {
-				return nil, e
+				return nil, err
 			}
 			f.ROs = append(f.ROs, ROEntry{ro, strconv.Itoa(ronum), strconv.Itoa(length)})
 		case "po":
 			ponums := strings.Split(tok[1], ":")
+			if len(ponums) != 2 {
+				return nil, bwe.M(bwe.MalformedOOBCommand, "Bad PO number")
+			}
 			var dponum int
 			var iponum int
 			var ponum int
@@ -368,6 +440,11 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 				return nil, err
 			}
 			length := int(cx)
+			if skip, err := f.skipOversize(s, length, limit); err != nil {
+				return nil, err
+			} else if skip {
+				continue
+			}
 			body := make([]byte, length)
 			if e := ReadExactly(s, body); e != nil {
 				return nil, e
@@ -0,0 +1,73 @@
+// +build gofuzz
+
+package objects
+
+//Entry points for go-fuzz (or libFuzzer, with go-fuzz-build -libfuzzer).
+//The first byte of the input is the RONum, the rest is the content. See
+//fuzz/README.md for how to run them
+
+func fuzzRO(data []byte, load func(int, []byte) (RoutingObject, error)) int {
+	if len(data) == 0 {
+		return -1
+	}
+	ro, err := load(int(data[0]), data[1:])
+	if err != nil {
+		if ro != nil {
+			panic("routing object returned with an error")
+		}
+		return 0
+	}
+	//The router reads these off every object it loads
+	ro.GetRONum()
+	ro.GetContent()
+	return 1
+}
+
+//FuzzDOT fuzzes NewDOT
+func FuzzDOT(data []byte) int {
+	return fuzzRO(data, func(ronum int, content []byte) (RoutingObject, error) {
+		ro, err := NewDOT(ronum, content)
+		if err == nil {
+			d := ro.(*DOT)
+			d.GetHash()
+			d.SigValid()
+			d.IsExpired()
+			if d.IsAccess() {
+				d.GetAccessURISuffix()
+				d.GetPermString()
+			}
+		}
+		return ro, err
+	})
+}
+
+//FuzzDChain fuzzes NewDChain
+func FuzzDChain(data []byte) int {
+	return fuzzRO(data, func(ronum int, content []byte) (RoutingObject, error) {
+		ro, err := NewDChain(ronum, content)
+		if err == nil {
+			dc := ro.(*DChain)
+			dc.GetChainHash()
+			if dc.IsElaborated() {
+				for i := 0; i < dc.NumHashes(); i++ {
+					dc.GetDotHash(i)
+				}
+			}
+		}
+		return ro, err
+	})
+}
+
+//FuzzEntity fuzzes NewEntity
+func FuzzEntity(data []byte) int {
+	return fuzzRO(data, func(ronum int, content []byte) (RoutingObject, error) {
+		ro, err := NewEntity(ronum, content)
+		if err == nil {
+			e := ro.(*Entity)
+			e.SigValid()
+			e.IsExpired()
+			e.GetRevokers()
+		}
+		return ro, err
+	})
+}
@@ -0,0 +1,137 @@
+package objects
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/testvec"
+)
+
+/*
+The encodings of entities, DOTs and chains are signed and hashed, and
+deployed routers and the registry hold them, so they must not change by
+accident. These tests build each object deterministically and compare it
+with its vector in testdata/vectors, then parse the vector, check its
+signature and encode it again. See package testvec for updating them.
+*/
+
+func goldenEntity(t *testing.T) *Entity {
+	sk, vk := testvec.Keypair("entity")
+	_, rvk := testvec.Keypair("revoker")
+	e, err := NewEntityBuilderWithKeypair(sk, vk).
+		Contact("Test Entity <test@example.com>").
+		Comment("golden").
+		Revoker(rvk).
+		Created(testvec.Epoch).
+		Expiry(testvec.Epoch.Add(365 * 24 * time.Hour)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func goldenAccessDOT(t *testing.T, from, to, suffix string) *DOT {
+	fromSK, fromVK := testvec.Keypair(from)
+	_, toVK := testvec.Keypair(to)
+	_, nsVK := testvec.Keypair("ns")
+	_, rvk := testvec.Keypair("revoker")
+	d, err := NewAccessDOTBuilder(fromVK, toVK).
+		URI(nsVK, suffix).
+		Permissions("C*TP").
+		TTL(3).
+		PublishLimits(PublishLimits{TxLimit: 10, StoreLimit: 1000, Retain: 2}).
+		Created(testvec.Epoch).
+		Expiry(testvec.Epoch.Add(30 * 24 * time.Hour)).
+		Revoker(rvk).
+		Contact("Test <test@example.com>").
+		Comment(from + " to " + to).
+		Build(fromSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestGoldenEntity(t *testing.T) {
+	e := goldenEntity(t)
+	testvec.Check(t, "entity", "entity with every option", e.GetContent())
+	ro, err := NewEntity(ROEntity, testvec.Load(t, "entity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ne := ro.(*Entity)
+	if !ne.SigValid() || !bytes.Equal(ne.GetVK(), e.GetVK()) || ne.GetContact() != e.GetContact() ||
+		!ne.GetExpiry().Equal(*e.GetExpiry()) || len(ne.GetRevokers()) != 1 {
+		t.Fatal("the entity vector did not parse to the entity")
+	}
+	ne.SetSK(e.GetSK())
+	ne.Encode()
+	testvec.Check(t, "entity", "entity with every option", ne.GetContent())
+}
+
+func TestGoldenEntityAlgorithm(t *testing.T) {
+	registerTagged(t)
+	sk, vk := testvec.Keypair("entity")
+	created := testvec.Epoch
+	e := &Entity{sk: sk, vk: vk, created: &created, alg: testSigAlgorithm}
+	e.Encode()
+	testvec.Check(t, "entity_sigalg", "entity with a signature algorithm option", e.GetContent())
+	ro, err := NewEntity(ROEntity, testvec.Load(t, "entity_sigalg"))
+	if err != nil || !ro.(*Entity).SigValid() || ro.(*Entity).GetSigAlgorithm() != testSigAlgorithm {
+		t.Fatalf("the entity vector did not parse: %v", err)
+	}
+}
+
+func TestGoldenDOT(t *testing.T) {
+	d := goldenAccessDOT(t, "ns", "alice", "a/b/*")
+	testvec.Check(t, "accessdot", "access DOT with every option", d.GetContent())
+	ro, err := NewDOT(ROAccessDOT, testvec.Load(t, "accessdot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := ro.(*DOT)
+	if !nd.SigValid() || !bytes.Equal(nd.GetHash(), d.GetHash()) || nd.GetPermString() != "C*TP" ||
+		nd.GetAccessURISuffix() != "a/b/*" || *nd.GetPublishLimits() != *d.GetPublishLimits() {
+		t.Fatal("the access DOT vector did not parse to the DOT")
+	}
+	sk, _ := testvec.Keypair("ns")
+	nd.Encode(sk)
+	testvec.Check(t, "accessdot", "access DOT with every option", nd.GetContent())
+
+	//A permission DOT's table is encoded in map order, so the vector has a
+	//single key
+	fromSK, fromVK := testvec.Keypair("ns")
+	_, toVK := testvec.Keypair("alice")
+	pd, err := NewPermissionDOTBuilder(fromVK, toVK).Permission("key", "value").Created(testvec.Epoch).Build(fromSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testvec.Check(t, "permissiondot", "permission DOT with one key", pd.GetContent())
+	ro, err = NewDOT(ROPermissionDOT, testvec.Load(t, "permissiondot"))
+	if err != nil || !ro.(*DOT).SigValid() || ro.(*DOT).kv["key"] != "value" {
+		t.Fatalf("the permission DOT vector did not parse: %v", err)
+	}
+}
+
+func TestGoldenChain(t *testing.T) {
+	d1 := goldenAccessDOT(t, "ns", "alice", "a/b/*")
+	d2 := goldenAccessDOT(t, "alice", "bob", "a/b/c")
+	dc, err := CreateDChain(true, d1, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testvec.Check(t, "chain", "access chain of two DOTs, as DOT hashes", dc.GetContent())
+	hc, _ := dc.ConvertToDChainHash()
+	testvec.Check(t, "chainhash", "hash of the access chain", hc.GetContent())
+	ro, err := NewDChain(ROAccessDChain, testvec.Load(t, "chain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ndc := ro.(*DChain)
+	if ndc.NumHashes() != 2 || !bytes.Equal(ndc.GetChainHash(), testvec.Load(t, "chainhash")) ||
+		!bytes.Equal(ndc.GetDotHash(1), d2.GetHash()) {
+		t.Fatal("the chain vector did not parse to the chain")
+	}
+}
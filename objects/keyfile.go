@@ -0,0 +1,229 @@
+package objects
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+//A v1 key file is the RO number followed by the object. A v2 key file is:
+//  magic "BW2KEY", version (1 byte), flags (1 byte), RO number (1 byte),
+//  comment length (2 bytes LE), comment, alias length (2 bytes LE), alias,
+//  if encrypted: scrypt log2(N) (1 byte), salt (16 bytes), nonce (12 bytes),
+//  object length (4 bytes LE), object (AES-256-GCM sealed if encrypted),
+//  SHA-256 of everything before it (32 bytes)
+//No RO number is 'B', so the magic tells the versions apart
+
+//KeyFileMagic starts every v2 key file
+var KeyFileMagic = []byte("BW2KEY")
+
+//KeyFilePassphraseEnv is the environment variable holding the passphrase
+//of encrypted key files, for the bw2 tool and the router's own entity
+const KeyFilePassphraseEnv = "BW2_KEYFILE_PASSPHRASE"
+
+//KeyFileVersion is the version of the key files EncodeKeyFile writes
+const KeyFileVersion = 2
+
+const (
+	keyFileFlagEncrypted = 1
+	keyFileScryptLogN    = 15
+	keyFileSaltLen       = 16
+	keyFileNonceLen      = 12
+)
+
+//ErrKeyFileEncrypted is returned when decoding an encrypted key file
+//without a passphrase
+var ErrKeyFileEncrypted = errors.New("the key file is encrypted, a passphrase is needed")
+
+//ErrKeyFileCorrupt is returned when a key file fails its integrity check
+var ErrKeyFileCorrupt = errors.New("the key file is corrupt (bad checksum)")
+
+//KeyFile is the decoded contents of an entity, DOT or chain file
+type KeyFile struct {
+	//1 for files without the v2 container
+	Version int
+	RONum   int
+	//The object as LoadRoutingObject takes it
+	Content []byte
+	//Hints for people. They are not signed, and not part of the object
+	Comment   string
+	Alias     string
+	Encrypted bool
+}
+
+//RoutingObject decodes the object in the key file
+func (kf *KeyFile) RoutingObject() (RoutingObject, error) {
+	return LoadRoutingObject(kf.RONum, kf.Content)
+}
+
+//IsKeyFileV2 returns true if the contents have the v2 container
+func IsKeyFileV2(contents []byte) bool {
+	return bytes.HasPrefix(contents, KeyFileMagic)
+}
+
+//EncodeKeyFile returns a v2 key file. If the passphrase is not empty, the
+//object is encrypted with it
+func EncodeKeyFile(kf *KeyFile, passphrase []byte) ([]byte, error) {
+	if kf.RONum < 0 || kf.RONum > 255 {
+		return nil, NewObjectError(kf.RONum, "Bad RONum for key file")
+	}
+	if len(kf.Comment) > 65535 || len(kf.Alias) > 65535 {
+		return nil, errors.New("key file comment or alias too long")
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(KeyFileMagic)
+	flags := byte(0)
+	if len(passphrase) != 0 {
+		flags |= keyFileFlagEncrypted
+	}
+	buf.Write([]byte{KeyFileVersion, flags, byte(kf.RONum)})
+	writeString16(buf, kf.Comment)
+	writeString16(buf, kf.Alias)
+	body := kf.Content
+	if len(passphrase) != 0 {
+		salt := make([]byte, keyFileSaltLen)
+		nonce := make([]byte, keyFileNonceLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		aead, err := keyFileCipher(passphrase, salt, keyFileScryptLogN)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(keyFileScryptLogN)
+		buf.Write(salt)
+		buf.Write(nonce)
+		//The header is authenticated too, so the hints cannot be swapped
+		body = aead.Seal(nil, nonce, kf.Content, buf.Bytes())
+	}
+	ln := make([]byte, 4)
+	binary.LittleEndian.PutUint32(ln, uint32(len(body)))
+	buf.Write(ln)
+	buf.Write(body)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes(), nil
+}
+
+//DecodeKeyFile decodes a v1 or v2 key file. The passphrase is only needed
+//for encrypted files, without it they return ErrKeyFileEncrypted
+func DecodeKeyFile(contents []byte, passphrase []byte) (*KeyFile, error) {
+	if !IsKeyFileV2(contents) {
+		if len(contents) < 2 {
+			return nil, errors.New("the key file is empty")
+		}
+		return &KeyFile{Version: 1, RONum: int(contents[0]), Content: contents[1:]}, nil
+	}
+	if len(contents) < len(KeyFileMagic)+3+sha256.Size {
+		return nil, ErrKeyFileCorrupt
+	}
+	sum := sha256.Sum256(contents[:len(contents)-sha256.Size])
+	if !bytes.Equal(sum[:], contents[len(contents)-sha256.Size:]) {
+		return nil, ErrKeyFileCorrupt
+	}
+	r := &keyFileReader{b: contents[:len(contents)-sha256.Size], idx: len(KeyFileMagic)}
+	hdr := r.next(3)
+	if hdr == nil {
+		return nil, ErrKeyFileCorrupt
+	}
+	if hdr[0] != KeyFileVersion {
+		return nil, errors.New("unsupported key file version, a newer bw2 is needed")
+	}
+	kf := &KeyFile{
+		Version:   int(hdr[0]),
+		RONum:     int(hdr[2]),
+		Encrypted: hdr[1]&keyFileFlagEncrypted != 0,
+	}
+	kf.Comment = string(r.next16())
+	kf.Alias = string(r.next16())
+	var logN, salt, nonce []byte
+	if kf.Encrypted {
+		logN = r.next(1)
+		salt = r.next(keyFileSaltLen)
+		nonce = r.next(keyFileNonceLen)
+	}
+	if r.idx < 0 {
+		return nil, ErrKeyFileCorrupt
+	}
+	header := contents[:r.idx]
+	ln := r.next(4)
+	if ln == nil {
+		return nil, ErrKeyFileCorrupt
+	}
+	body := r.next(int(binary.LittleEndian.Uint32(ln)))
+	if body == nil || r.idx != len(r.b) {
+		return nil, ErrKeyFileCorrupt
+	}
+	if !kf.Encrypted {
+		kf.Content = body
+		return kf, nil
+	}
+	if len(passphrase) == 0 {
+		return kf, ErrKeyFileEncrypted
+	}
+	aead, err := keyFileCipher(passphrase, salt, logN[0])
+	if err != nil {
+		return nil, err
+	}
+	kf.Content, err = aead.Open(nil, nonce, body, header)
+	if err != nil {
+		return kf, errors.New("could not decrypt the key file, wrong passphrase?")
+	}
+	return kf, nil
+}
+
+func keyFileCipher(passphrase []byte, salt []byte, logN byte) (cipher.AEAD, error) {
+	if logN < 10 || logN > 24 {
+		return nil, errors.New("bad key file encryption parameters")
+	}
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeString16(buf *bytes.Buffer, s string) {
+	ln := make([]byte, 2)
+	binary.LittleEndian.PutUint16(ln, uint16(len(s)))
+	buf.Write(ln)
+	buf.WriteString(s)
+}
+
+//keyFileReader reads the fields of a v2 key file. Once a read runs past
+//the end, every later read returns nil
+type keyFileReader struct {
+	b   []byte
+	idx int
+}
+
+func (r *keyFileReader) next(n int) []byte {
+	if r.idx < 0 || n < 0 || r.idx+n > len(r.b) {
+		r.idx = -1
+		return nil
+	}
+	rv := r.b[r.idx : r.idx+n]
+	r.idx += n
+	return rv
+}
+
+func (r *keyFileReader) next16() []byte {
+	ln := r.next(2)
+	if ln == nil {
+		return nil
+	}
+	return r.next(int(binary.LittleEndian.Uint16(ln)))
+}
@@ -0,0 +1,66 @@
+package objects
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyFileV1(t *testing.T) {
+	v1 := []byte{ROEntityWKey, 1, 2, 3}
+	kf, err := DecodeKeyFile(v1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kf.Version != 1 || kf.RONum != ROEntityWKey || !bytes.Equal(kf.Content, v1[1:]) {
+		t.Fatalf("bad v1 decode %+v", kf)
+	}
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	kf := &KeyFile{RONum: ROEntityWKey, Content: []byte("not really an entity"), Comment: "router", Alias: "myrouter"}
+	for _, pass := range [][]byte{nil, []byte("hunter2")} {
+		blob, err := EncodeKeyFile(kf, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsKeyFileV2(blob) {
+			t.Fatal("no magic")
+		}
+		rkf, err := DecodeKeyFile(blob, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rkf.RONum != kf.RONum || !bytes.Equal(rkf.Content, kf.Content) ||
+			rkf.Comment != kf.Comment || rkf.Alias != kf.Alias || rkf.Encrypted != (pass != nil) {
+			t.Fatalf("round trip mismatch %+v", rkf)
+		}
+		//Every flipped byte must be caught
+		for i := range blob {
+			bad := append([]byte{}, blob...)
+			bad[i] ^= 0x40
+			if rkf, err := DecodeKeyFile(bad, pass); err == nil && rkf.Version == 2 {
+				t.Fatalf("corruption at %d not detected", i)
+			}
+		}
+		if _, err := DecodeKeyFile(blob[:len(blob)-1], pass); err == nil {
+			t.Fatal("truncation not detected")
+		}
+	}
+}
+
+func TestKeyFileEncrypted(t *testing.T) {
+	kf := &KeyFile{RONum: ROEntityWKey, Content: []byte("secret")}
+	blob, err := EncodeKeyFile(kf, []byte("right"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blob, kf.Content) {
+		t.Fatal("content is not encrypted")
+	}
+	if _, err := DecodeKeyFile(blob, nil); err != ErrKeyFileEncrypted {
+		t.Fatalf("expected ErrKeyFileEncrypted, got %v", err)
+	}
+	if _, err := DecodeKeyFile(blob, []byte("wrong")); err == nil {
+		t.Fatal("wrong passphrase accepted")
+	}
+}
@@ -0,0 +1,79 @@
+package objects
+
+import (
+	"io"
+	"sync"
+)
+
+//LazyRoutingObject is a routing object that has not been parsed yet. It
+//keeps the RO's bytes, usually a slice of the message it arrived in, and
+//parses them the first time the RO itself is needed. A router that only
+//forwards a message never needs to look inside most of its ROs
+type LazyRoutingObject struct {
+	ronum   int
+	content []byte
+	once    sync.Once
+	ro      RoutingObject
+	err     error
+}
+
+//NewLazyRoutingObject wraps the content of an RO without parsing it. The
+//content is not copied
+func NewLazyRoutingObject(ronum int, content []byte) *LazyRoutingObject {
+	return &LazyRoutingObject{ronum: ronum, content: content}
+}
+
+func (ro *LazyRoutingObject) GetRONum() int {
+	return ro.ronum
+}
+
+func (ro *LazyRoutingObject) GetContent() []byte {
+	return ro.content
+}
+
+func (ro *LazyRoutingObject) IsPayloadObject() bool {
+	return false
+}
+
+//WriteToStream writes the RO's bytes as they arrived, without parsing it
+func (ro *LazyRoutingObject) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	var err error
+	if fullObjNum {
+		//Little endian
+		_, err = s.Write([]byte{byte(ro.ronum), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+	} else {
+		_, err = s.Write([]byte{byte(ro.ronum),
+			byte(ln),
+			byte(ln >> 8),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(ro.content)
+	return err
+}
+
+//Parse parses the RO the first time it is called and returns the same
+//result after that. It is safe to call from several goroutines
+func (ro *LazyRoutingObject) Parse() (RoutingObject, error) {
+	ro.once.Do(func() {
+		ro.ro, ro.err = LoadRoutingObject(ro.ronum, ro.content)
+	})
+	return ro.ro, ro.err
+}
+
+//ParseRoutingObject returns the parsed RO if ro is lazy, and ro itself
+//otherwise
+func ParseRoutingObject(ro RoutingObject) (RoutingObject, error) {
+	if lro, ok := ro.(*LazyRoutingObject); ok {
+		return lro.Parse()
+	}
+	return ro, nil
+}
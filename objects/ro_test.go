@@ -1,7 +1,9 @@
 package objects
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"reflect"
 	"testing"
@@ -182,7 +184,9 @@ func TestMakePermissionDOT(t *testing.T) {
 }
 
 func TestMakeEntity(t *testing.T) {
-	e := CreateNewEntity("contact", "comment", [][]byte{}, 1*time.Minute)
+	e := CreateNewEntity("contact", "comment", [][]byte{})
+	//As it will be parsed, without a monotonic clock reading
+	e.SetExpiry(time.Unix(0, time.Now().Add(time.Minute).UnixNano()))
 	e.Encode()
 	cnt := e.GetContent()
 
@@ -200,6 +204,227 @@ func TestMakeEntity(t *testing.T) {
 	}
 }
 
+func TestDOTBuilder(t *testing.T) {
+	fromSK, fromVK := crypto.GenerateKeypair()
+	_, toVK := crypto.GenerateKeypair()
+	d, err := NewAccessDOTBuilder(fromVK, toVK).
+		URI(fromVK, "foo/*").
+		Permissions("C*P").
+		TTL(3).
+		ExpiryFromNow(time.Minute).
+		Build(fromSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newd, err := NewDOT(ROAccessDOT, d.GetContent())
+	if err != nil || !newd.(*DOT).SigValid() || newd.(*DOT).GetPermString() != "C*P" {
+		t.Fatalf("the built DOT did not decode: %v", err)
+	}
+	_, otherVK := crypto.GenerateKeypair()
+	bad := map[string]*DOTBuilder{
+		"permission key on access DOT": NewAccessDOTBuilder(fromVK, toVK).Permission("a", "b"),
+		"TTL out of range":             NewPermissionDOTBuilder(fromVK, toVK).TTL(256),
+		"bad URI":                      NewAccessDOTBuilder(fromVK, toVK).URI(fromVK, "a//b"),
+		"no URI":                       NewAccessDOTBuilder(fromVK, toVK).Permissions("C"),
+		"no permissions":               NewAccessDOTBuilder(fromVK, toVK).URI(fromVK, "a"),
+		"wrong SK":                     NewAccessDOTBuilder(otherVK, toVK).URI(fromVK, "a").Permissions("C"),
+	}
+	for name, b := range bad {
+		if _, err := b.Build(fromSK); err == nil {
+			t.Errorf("%s: built a bad DOT", name)
+		}
+	}
+}
+
+func TestNoDelegate(t *testing.T) {
+	nsSK, nsVK := crypto.GenerateKeypair()
+	aSK, aVK := crypto.GenerateKeypair()
+	_, bVK := crypto.GenerateKeypair()
+	d1, err := NewAccessDOTBuilder(nsVK, aVK).URI(nsVK, "foo/*").Permissions("C*P").TTL(3).NoDelegate("P").Build(nsSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewAccessDOTBuilder(aVK, bVK).URI(nsVK, "foo/*").Permissions("C*P").Build(aSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := NewDOT(ROAccessDOT, d1.GetContent())
+	if err != nil || !ro.(*DOT).SigValid() {
+		t.Fatalf("the DOT did not decode: %v", err)
+	}
+	nd := ro.(*DOT).GetNoDelegate()
+	if nd == nil || nd.GetPermString() != "P" {
+		t.Fatalf("delegation flags lost: %+v", nd)
+	}
+	if d2.GetNoDelegate() != nil {
+		t.Error("DOT without delegation flags has some")
+	}
+	if ps := ChainPermissionSet([]*DOT{d1}).GetPermString(); ps != "C*P" {
+		t.Errorf("receiver of the DOT should have C*P, not %s", ps)
+	}
+	if ps := ChainPermissionSet([]*DOT{d1, d2}).GetPermString(); ps != "C*" {
+		t.Errorf("P was delegated: %s", ps)
+	}
+	if _, err := NewAccessDOTBuilder(nsVK, aVK).URI(nsVK, "foo").Permissions("C").NoDelegate("X").Build(nsSK); err == nil {
+		t.Error("built a DOT with bad delegation flags")
+	}
+}
+
+//legacyAccessFields reads the permissions, namespace and URI suffix of an
+//access DOT the way routers from before the delegation option do, which
+//skip an unknown option as the type, the length and length-1 more bytes
+func legacyAccessFields(content []byte) (uint16, []byte, string, bool) {
+	idx := 66
+	for {
+		if idx+1 >= len(content) {
+			return 0, nil, "", false
+		}
+		switch content[idx] {
+		case 0x01, 0x02, 0x03, 0x04, 0x05, 0x06:
+			idx += 2 + int(content[idx+1])
+		case 0x00:
+			idx++
+			if idx+36 > len(content) {
+				return 0, nil, "", false
+			}
+			perm := binary.LittleEndian.Uint16(content[idx:])
+			mvk := content[idx+2 : idx+34]
+			ln := int(binary.LittleEndian.Uint16(content[idx+34:]))
+			if idx+36+ln > len(content) {
+				return 0, nil, "", false
+			}
+			return perm, mvk, string(content[idx+36 : idx+36+ln]), true
+		default:
+			idx += int(content[idx+1]) + 1
+		}
+	}
+}
+
+func TestNoDelegateLegacySkip(t *testing.T) {
+	nsSK, nsVK := crypto.GenerateKeypair()
+	_, aVK := crypto.GenerateKeypair()
+	d, err := NewAccessDOTBuilder(nsVK, aVK).URI(nsVK, "foo/*").Permissions("C*P").
+		Contact("contact").NoDelegate("C*P").Build(nsSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perm, mvk, suffix, ok := legacyAccessFields(d.GetContent())
+	if !ok {
+		t.Fatal("an old router could not find the end of the options")
+	}
+	if perm != 0x0047 || !bytes.Equal(mvk, nsVK) || suffix != "foo/*" {
+		t.Fatalf("an old router misread the DOT: %x %x %q", perm, mvk, suffix)
+	}
+}
+
+func TestEntityBuilder(t *testing.T) {
+	e, err := NewEntityBuilder().Contact("contact").ExpiryFromNow(time.Minute).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEntity(ROEntity, e.GetContent()); err != nil {
+		t.Fatalf("the built entity did not decode: %v", err)
+	}
+	sk, _ := crypto.GenerateKeypair()
+	_, vk := crypto.GenerateKeypair()
+	if _, err := NewEntityBuilderWithKeypair(sk, vk).Build(); err == nil {
+		t.Error("built an entity from a mismatched keypair")
+	}
+	if _, err := NewEntityBuilder().Revoker([]byte{1}).Build(); err == nil {
+		t.Error("built an entity with a bad revoker")
+	}
+}
+
+//taggedProvider is ed25519 with a tag after the signature, to test a
+//scheme with a different signature size
+type taggedProvider struct{}
+
+const testSigAlgorithm SigAlgorithm = 200
+
+func (taggedProvider) Algorithm() SigAlgorithm { return testSigAlgorithm }
+func (taggedProvider) Name() string            { return "tagged" }
+func (taggedProvider) SigSize() int            { return 72 }
+func (taggedProvider) GenerateKeypair() ([]byte, []byte) {
+	return GenerateKeypair()
+}
+func (taggedProvider) Sign(sk []byte, vk []byte, into []byte, blob []byte) {
+	SignBlob(sk, vk, into[:64], blob)
+	copy(into[64:], "tagged!!")
+}
+func (taggedProvider) Verify(vk []byte, sig []byte, blob []byte) bool {
+	return string(sig[64:]) == "tagged!!" && VerifyBlob(vk, sig[:64], blob)
+}
+
+func registerTagged(t *testing.T) {
+	if _, ok := GetSignatureProvider(testSigAlgorithm); !ok {
+		if err := RegisterSignatureProvider(taggedProvider{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSigAlgorithm(t *testing.T) {
+	registerTagged(t)
+	if RegisterSignatureProvider(ed25519Provider{}) == nil {
+		t.Fatal("registered ed25519 twice")
+	}
+	e, err := NewEntityBuilderWithAlgorithm(testSigAlgorithm).Contact("contact").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ne, err := NewEntity(ROEntity, e.GetContent())
+	if err != nil || !ne.(*Entity).SigValid() || ne.(*Entity).GetSigAlgorithm() != testSigAlgorithm {
+		t.Fatalf("the entity did not decode: %v", err)
+	}
+	_, toVK := crypto.GenerateKeypair()
+	d, err := NewAccessDOTBuilder(e.GetVK(), toVK).URI(e.GetVK(), "a/*").Permissions("C").
+		Algorithm(testSigAlgorithm).Build(e.GetSK())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := NewDOT(ROAccessDOT, d.GetContent())
+	if err != nil || !nd.(*DOT).SigValid() || len(nd.(*DOT).signature) != 72 {
+		t.Fatalf("the DOT did not decode: %v", err)
+	}
+	//ed25519 objects have no algorithm option, so they encode as before:
+	//the VK, the creation date and contact options, the end and the
+	//signature
+	ed, _ := NewEntityBuilder().Contact("contact").Build()
+	if len(ed.GetContent()) != 32+10+2+len("contact")+1+64 {
+		t.Fatalf("an ed25519 entity is %d bytes", len(ed.GetContent()))
+	}
+	//An unknown algorithm cannot be parsed, as its signature size is unknown
+	cnt := append([]byte{}, e.GetContent()...)
+	cnt[bytes.Index(cnt, []byte{sigAlgOption, 1, byte(testSigAlgorithm)})+2] = 201
+	if _, err := NewEntity(ROEntity, cnt); err == nil {
+		t.Fatal("parsed an entity with an unknown algorithm")
+	}
+}
+
+func TestDescribedObjects(t *testing.T) {
+	sk, vk := crypto.GenerateKeypair()
+	soon := time.Now().Add(time.Minute)
+	d1, err := NewAccessDOTBuilder(vk, vk).URI(vk, "a/*").Permissions("C").Expiry(soon).Build(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewAccessDOTBuilder(vk, vk).URI(vk, "a/b").Permissions("C").Expiry(soon.Add(time.Hour)).Build(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := CreateDChain(true, d1, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs := []DescribedObject{d1, dc, CreateRevocation(vk, d1.GetHash(), "")}
+	if !objs[1].GetExpiry().Equal(soon) || objs[1].IsExpired() {
+		t.Errorf("the chain should expire with its first DOT, got %v", objs[1].GetExpiry())
+	}
+	if objs[2].GetExpiry() != nil || objs[2].IsExpired() {
+		t.Error("a revocation should not expire")
+	}
+}
+
 // func TestMakeDOT(t *testing.T) {
 //   d := DOT{}
 // 	bw := OpenBWContext(nil)
@@ -217,3 +442,43 @@ func TestMakeEntity(t *testing.T) {
 // 	client1.Publish(MakeMsg("/a/b/b/b", "foo"))
 // 	//client.Publish("/a/b/c", "foo")
 // }
+
+func TestTimestamp(t *testing.T) {
+	e := CreateNewEntity("", "", [][]byte{})
+	now := time.Now()
+	ts := CreateTimestamp(now, e.GetSK(), e.GetVK())
+	ro, err := NewTimestamp(ROTimestamp, ts.GetContent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nts := ro.(*Timestamp)
+	if !nts.GetTime().Equal(now) || !reflect.DeepEqual(nts.GetVK(), e.GetVK()) || !nts.SigValid() {
+		t.Fatalf("bad timestamp %v", nts.GetTime())
+	}
+	content := append([]byte{}, ts.GetContent()...)
+	content[0] ^= 1
+	ro, _ = NewTimestamp(ROTimestamp, content)
+	if ro.(*Timestamp).SigValid() {
+		t.Fatal("altered timestamp has a valid signature")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ik, err := CreateIdempotencyKey("gw1-000042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := NewIdempotencyKey(ROIdempotencyKey, ik.GetContent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ro.(*IdempotencyKey).GetKey() != "gw1-000042" {
+		t.Fatalf("bad key %q", ro.(*IdempotencyKey).GetKey())
+	}
+	if _, err := CreateIdempotencyKey(""); err == nil {
+		t.Fatal("expected an error for an empty key")
+	}
+	if _, err := NewIdempotencyKey(ROIdempotencyKey, make([]byte, MaxIdempotencyKey+1)); err == nil {
+		t.Fatal("expected an error for a long key")
+	}
+}
@@ -27,7 +27,6 @@ import (
 	"fmt"
 	"io"
 	//	"math/big"
-	"runtime/debug"
 	"strconv"
 	"time"
 
@@ -49,6 +48,20 @@ type RoutingObject interface {
 	IsPayloadObject() bool
 }
 
+//DescribedObject is a routing object with the descriptive fields that
+//DOTs and entities carry. Chains and revocations implement it too, so that
+//caches and tools can treat them all alike: a field an object does not
+//have reads as nil or empty, and an object without an expiry never expires
+type DescribedObject interface {
+	RoutingObject
+	GetExpiry() *time.Time
+	IsExpired() bool
+	GetCreated() *time.Time
+	GetRevokers() [][]byte
+	GetContact() string
+	GetComment() string
+}
+
 type sigState int8
 
 const (
@@ -70,6 +83,11 @@ var RoutingObjectConstructor = map[int]func(ronum int, content []byte) (RoutingO
 	ROEntityWKey:           NewEntity,
 	ROOriginVK:             NewOriginVK,
 	ROExpiry:               NewExpiry,
+	ROTrace:                NewTrace,
+	ROConsumerAck:          NewConsumerAck,
+	ROTimestamp:            NewTimestamp,
+	ROSubscriptionFilter:   NewSubscriptionFilter,
+	ROIdempotencyKey:       NewIdempotencyKey,
 	RORevocation:           NewRevocation,
 }
 
@@ -121,13 +139,7 @@ type DChain struct {
 }
 
 //NewDChain deserialises a DChain from a byte array
-func NewDChain(ronum int, content []byte) (rv RoutingObject, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = NewObjectError(ronum, "Bad DChain")
-			rv = nil
-		}
-	}()
+func NewDChain(ronum int, content []byte) (RoutingObject, error) {
 	ro := DChain{ronum: ronum}
 	switch ronum {
 	case ROAccessDChain, ROPermissionDChain:
@@ -151,7 +163,7 @@ func NewDChain(ronum int, content []byte) (rv RoutingObject, err error) {
 		ro.isAccess = ronum == 0x01
 		return &ro, nil
 	default:
-		panic("Should not have reached here")
+		return nil, NewObjectError(ronum, "Unknown RONum")
 	}
 }
 
@@ -209,11 +221,7 @@ func (ro *DChain) GetAccessURISuffix() (string, error) {
 	return u, nil
 }
 func (ro *DChain) GetAccessURIPermString() string {
-	adps := ro.dots[0].GetPermissionSet()
-	for _, d := range ro.dots[1:] {
-		adps.ReduceBy(d.GetPermissionSet())
-	}
-	return adps.GetPermString()
+	return ChainPermissionSet(ro.dots).GetPermString()
 }
 func (ro *DChain) IsAccess() bool {
 	return ro.GetRONum() == ROAccessDChain ||
@@ -381,9 +389,7 @@ func (ro *DChain) CheckAccessGrants(curTime *time.Time,
 	}
 	//fmt.Println("ATAG 26")
 	// Calc ADPS
-	for i := 0; i < ro.NumHashes(); i++ {
-		ADPS.ReduceBy(ro.GetDOT(i).GetPermissionSet())
-	}
+	ADPS.ReduceBy(ChainPermissionSet(ro.dots))
 
 	nosuffix := suffix == ""
 	if nosuffix {
@@ -445,6 +451,55 @@ func (ro *DChain) GetTTL() int {
 	return ttl
 }
 
+//GetExpiry returns when the first of the chain's DOTs expires, or nil if
+//none do or the chain does not have its DOTs
+func (ro *DChain) GetExpiry() *time.Time {
+	var rv *time.Time
+	for _, d := range ro.dots {
+		if d != nil && d.expires != nil && (rv == nil || d.expires.Before(*rv)) {
+			rv = d.expires
+		}
+	}
+	return rv
+}
+
+//IsExpired is true if any of the chain's DOTs has expired
+func (ro *DChain) IsExpired() bool {
+	for _, d := range ro.dots {
+		if d != nil && d.IsExpired() {
+			return true
+		}
+	}
+	return false
+}
+
+//GetCreated returns when the newest of the chain's DOTs was created, as the
+//chain can be no older, or nil if the chain does not have its DOTs
+func (ro *DChain) GetCreated() *time.Time {
+	var rv *time.Time
+	for _, d := range ro.dots {
+		if d != nil && d.created != nil && (rv == nil || d.created.After(*rv)) {
+			rv = d.created
+		}
+	}
+	return rv
+}
+
+//GetRevokers returns nil. A chain is revoked through its DOTs
+func (ro *DChain) GetRevokers() [][]byte {
+	return nil
+}
+
+//GetContact returns "", chains have no contact
+func (ro *DChain) GetContact() string {
+	return ""
+}
+
+//GetComment returns "", chains have no comment
+func (ro *DChain) GetComment() string {
+	return ""
+}
+
 func (ro *DChain) GetMVK() []byte {
 	return ro.dots[0].GetAccessURIMVK()
 }
@@ -577,15 +632,19 @@ func (ro *DChain) ConvertToDChainHash() (*DChain, error) {
 //PublishLimits is an option found in an AccessDOT that governs
 //the resources that may be used by messages authorised via the DOT
 type PublishLimits struct {
+	//The number of messages per second, zero for no limit
 	TxLimit    int64
 	StoreLimit int64
-	Retain     int
+	//If non zero, the designated router keeps the last message published
+	//on each URI as if it were persisted, when every DOT in the chain
+	//allows it
+	Retain int
 }
 
 func (p *PublishLimits) toBytes() []byte {
 	rv := make([]byte, 17)
 	binary.LittleEndian.PutUint64(rv, uint64(p.TxLimit))
-	binary.LittleEndian.PutUint64(rv, uint64(p.StoreLimit))
+	binary.LittleEndian.PutUint64(rv[8:], uint64(p.StoreLimit))
 	rv[16] = byte(p.Retain)
 	return rv
 }
@@ -606,12 +665,14 @@ type DOT struct {
 	isAccess   bool
 	ttl        int
 	sigok      sigState
+	alg        SigAlgorithm
 
 	//Only for ACCESS dot
 	mVK            []byte
 	uriSuffix      string
 	uri            string
 	pubLim         *PublishLimits
+	noDelegate     *AccessDOTPermissionSet
 	canPublish     bool
 	canConsume     bool
 	canConsumePlus bool
@@ -780,16 +841,13 @@ func (ps *AccessDOTPermissionSet) GetPermString() string {
 }
 
 //NewDOT constructs a DOT from its packed form
-func NewDOT(ronum int, content []byte) (rv RoutingObject, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println(r)
-			debug.PrintStack()
-			err = NewObjectError(ronum, "Bad DoT")
-			rv = nil
-		}
-	}()
-
+func NewDOT(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROAccessDOT && ronum != ROPermissionDOT {
+		return nil, NewObjectError(ronum, "Unknown RONum")
+	}
+	if !hasBytes(content, 0, 66) {
+		return nil, NewObjectError(ronum, "DoT is truncated")
+	}
 	idx := 0
 	ro := DOT{
 		giverVK:    content[0:32],
@@ -809,6 +867,9 @@ func NewDOT(ronum int, content []byte) (rv RoutingObject, err error) {
 
 	idx = 66
 	for {
+		if !hasHeader(content, idx) {
+			return nil, NewObjectError(ronum, "DoT header is truncated")
+		}
 		switch content[idx] {
 		case 0x01: //Publish limits
 			if content[idx+1] != 17 {
@@ -852,17 +913,33 @@ func NewDOT(ronum int, content []byte) (rv RoutingObject, err error) {
 			ln := int(content[idx+1])
 			ro.comment = string(content[idx+2 : idx+2+ln])
 			idx += 2 + ln
+		case noDelegateOption:
+			if content[idx+1] != noDelegateLen {
+				return nil, NewObjectError(ronum, "Invalid delegation option in DoT")
+			}
+			ro.noDelegate = permSetFromBits(binary.LittleEndian.Uint16(content[idx+2:]))
+			idx += 4
+		case sigAlgOption:
+			p, err := parseSigAlgOption(ronum, content, idx)
+			if err != nil {
+				return nil, err
+			}
+			ro.alg = p.Algorithm()
+			idx += 3
 		case 0x00: //End
 			idx++
 			goto done
 		default: //Skip unknown header
 			fmt.Println("Unknown DoT header type: ", content[idx])
-			idx += int(content[idx+1]) + 1
+			idx += int(content[idx+1]) + 2
 
 		}
 	}
 done:
 	if ronum == ROAccessDOT {
+		if !hasBytes(content, idx, 2+32+2) {
+			return nil, NewObjectError(ronum, "DoT URI is truncated")
+		}
 		ro.isAccess = true
 		perm := binary.LittleEndian.Uint16(content[idx:])
 		idx += 2
@@ -901,30 +978,44 @@ done:
 		idx += 32
 		ln := int(binary.LittleEndian.Uint16(content[idx:]))
 		idx += 2
+		if !hasBytes(content, idx, ln) {
+			return nil, NewObjectError(ronum, "DoT URI is truncated")
+		}
 		ro.uriSuffix = string(content[idx : idx+ln])
 		ro.uri = base64.URLEncoding.EncodeToString(ro.mVK) + "/" + ro.uriSuffix
 		idx += ln
 	} else if ronum == ROPermissionDOT {
 		//Parse Key value
 		for {
+			if !hasBytes(content, idx, 1) {
+				return nil, NewObjectError(ronum, "DoT permissions are truncated")
+			}
 			keylen := int(content[idx])
 			if keylen == 0 {
 				idx++
 				break
 			}
+			if !hasBytes(content, idx+1, keylen+2) {
+				return nil, NewObjectError(ronum, "DoT permissions are truncated")
+			}
 			key := string(content[idx+1 : idx+1+keylen])
 			idx += 1 + keylen
 			valLen := int(binary.LittleEndian.Uint16(content[idx:]))
+			if !hasBytes(content, idx+2, valLen) {
+				return nil, NewObjectError(ronum, "DoT permissions are truncated")
+			}
 			val := string(content[idx+2 : idx+2+valLen])
 			idx += 2 + valLen
 			ro.kv[key] = val
 		}
-	} else {
-		return nil, NewObjectError(ronum, "Unknown RONum")
+	}
+	sigsize := mustSignatureProvider(ro.alg).SigSize()
+	if !hasBytes(content, idx, sigsize) {
+		return nil, NewObjectError(ronum, "DoT signature is truncated")
 	}
 	hash := sha256.Sum256(content[0:idx])
 	ro.hash = hash[:]
-	ro.signature = content[idx : idx+64]
+	ro.signature = content[idx : idx+sigsize]
 	return &ro, nil
 }
 
@@ -957,9 +1048,13 @@ func (ro *DOT) WriteToStream(s io.Writer, fullObjNum bool) error {
 	return err
 }
 
+//ClockSkew is how long after it expires a DOT, entity or message is still
+//taken as valid, to allow for clocks that disagree
+var ClockSkew time.Duration
+
 func (ro *DOT) IsExpired() bool {
 	if ro.expires != nil {
-		return ro.expires.Before(time.Now())
+		return ro.expires.Add(ClockSkew).Before(time.Now())
 	}
 	return false
 }
@@ -983,6 +1078,16 @@ func (ro *DOT) GetExpiry() *time.Time {
 	return ro.expires
 }
 
+//GetPublishLimits returns the DOT's publish limits, or nil if it has none
+func (ro *DOT) GetPublishLimits() *PublishLimits {
+	return ro.pubLim
+}
+
+//SetPublishLimits sets the DOT's publish limits, nil for none
+func (ro *DOT) SetPublishLimits(l *PublishLimits) {
+	ro.pubLim = l
+}
+
 func (ro *DOT) GetCreated() *time.Time {
 	return ro.created
 }
@@ -1023,22 +1128,22 @@ func (ro *DOT) AddRevoker(rvk []byte) {
 //SigValid returns if the DOT's signature is valid. This only checks
 //the signature on the first call, so the content must not change
 //after encoding for this to be valid. As a plus it also verifies that
-//the topic is sane
+//the topic of an access DOT is sane
 func (ro *DOT) SigValid() bool {
 	if ro.sigok == sigValid {
 		return true
 	} else if ro.sigok == sigInvalid {
 		return false
 	}
-	uriSane, _, _, _ := util.AnalyzeSuffix(ro.uriSuffix)
-	if !uriSane {
+	if uriSane, _, _, _ := util.AnalyzeSuffix(ro.uriSuffix); ro.isAccess && !uriSane {
 		ro.sigok = sigInvalid
 		return false
 	}
-	if len(ro.signature) != 64 || len(ro.content) == 0 {
+	p := mustSignatureProvider(ro.alg)
+	if len(ro.signature) != p.SigSize() || len(ro.content) == 0 {
 		panic("DOT in invalid state")
 	}
-	ok := VerifyBlob(ro.giverVK, ro.signature, ro.content[:len(ro.content)-64])
+	ok := p.Verify(ro.giverVK, ro.signature, ro.content[:len(ro.content)-len(ro.signature)])
 	if ok {
 		ro.sigok = sigValid
 		return true
@@ -1053,7 +1158,10 @@ func (ro *DOT) OverrideSetSignatureValid() {
 	ro.sigok = sigValid
 }
 
-//SetCanConsume sets the consume privileges on an access dot
+//SetCanConsume sets the consume privileges on an access dot. It panics if
+//this is a permission DOT.
+//
+//Deprecated: use DOTBuilder.Permissions, which returns an error instead
 func (ro *DOT) SetCanConsume(normal bool, plus bool, star bool) {
 	if !ro.isAccess {
 		panic("Not an access DOT")
@@ -1095,7 +1203,10 @@ func (ro *DOT) SetExpireFromNow(delta time.Duration) {
 	ro.expires = &e
 }
 
-//SetCanTap sets the tap capability on an access dot
+//SetCanTap sets the tap capability on an access dot. It panics if this is
+//a permission DOT.
+//
+//Deprecated: use DOTBuilder.Permissions, which returns an error instead
 func (ro *DOT) SetCanTap(normal bool, plus bool, star bool) {
 	if !ro.isAccess {
 		panic("Not an access DOT")
@@ -1107,7 +1218,10 @@ func (ro *DOT) SetCanTap(normal bool, plus bool, star bool) {
 	ro.canTapStar = star
 }
 
-//SetCanPublish sets the publish capability on an access DOT
+//SetCanPublish sets the publish capability on an access DOT. It panics if
+//this is a permission DOT.
+//
+//Deprecated: use DOTBuilder.Permissions, which returns an error instead
 func (ro *DOT) SetCanPublish(value bool) {
 	if !ro.isAccess {
 		panic("Not an access DOT")
@@ -1115,7 +1229,10 @@ func (ro *DOT) SetCanPublish(value bool) {
 	ro.canPublish = value
 }
 
-//SetCanList sets the list capability on an access DOT
+//SetCanList sets the list capability on an access DOT. It panics if this
+//is a permission DOT.
+//
+//Deprecated: use DOTBuilder.Permissions, which returns an error instead
 func (ro *DOT) SetCanList(value bool) {
 	if !ro.isAccess {
 		panic("Not an access DOT")
@@ -1150,7 +1267,10 @@ func (ro *DOT) GetContent() []byte {
 	return ro.content
 }
 
-//SetAccessURI sets the URI of an Access DOT
+//SetAccessURI sets the URI of an Access DOT. It panics if this is a
+//permission DOT, and does not check the suffix.
+//
+//Deprecated: use DOTBuilder.URI, which returns an error instead
 func (ro *DOT) SetAccessURI(mvk []byte, suffix string) {
 	if !ro.isAccess {
 		panic("Should be an access DOT")
@@ -1176,7 +1296,10 @@ func (ro *DOT) GetAccessURIMVK() []byte {
 	return ro.mVK
 }
 
-//SetPermission sets the given key in a Permission DOT's table
+//SetPermission sets the given key in a Permission DOT's table. It panics
+//if this is an access DOT or the key or value is too long.
+//
+//Deprecated: use DOTBuilder.Permission, which returns an error instead
 func (ro *DOT) SetPermission(key string, value string) {
 	if ro.isAccess {
 		panic("Should be a permission DOT")
@@ -1192,7 +1315,9 @@ func (ro *DOT) GetTTL() int {
 	return ro.ttl
 }
 
-//SetTTL sets the TTL of a dot
+//SetTTL sets the TTL of a dot. It panics if the TTL is out of range.
+//
+//Deprecated: use DOTBuilder.TTL, which returns an error instead
 func (ro *DOT) SetTTL(v int) {
 	if v < 0 || v > 255 {
 		panic("Bad TTL")
@@ -1362,6 +1487,13 @@ func (ro *DOT) Encode(sk []byte) {
 		buf = append(buf, 0x06, byte(len(ro.comment)))
 		buf = append(buf, []byte(ro.comment)...)
 	}
+	if ro.noDelegate != nil {
+		buf = append(buf, noDelegateOption, noDelegateLen, 0, 0)
+		binary.LittleEndian.PutUint16(buf[len(buf)-2:], permBits(ro.noDelegate))
+	}
+	if ro.alg != SigEd25519 {
+		buf = append(buf, sigAlgOption, 1, byte(ro.alg))
+	}
 	buf = append(buf, 0x00)
 	if ro.isAccess {
 		perm := 0
@@ -1408,8 +1540,9 @@ func (ro *DOT) Encode(sk []byte) {
 	}
 	hash := sha256.Sum256(buf)
 	ro.hash = hash[:]
-	sig := make([]byte, 64)
-	SignBlob(sk, ro.giverVK, sig, buf)
+	p := mustSignatureProvider(ro.alg)
+	sig := make([]byte, p.SigSize())
+	p.Sign(sk, ro.giverVK, sig, buf)
 	buf = append(buf, sig...)
 	ro.content = buf
 	ro.signature = sig
@@ -1426,6 +1559,18 @@ func (ro *DOT) GetReceiverVK() []byte {
 	return ro.receiverVK
 }
 
+//GetSigAlgorithm returns the signature scheme of the giver, which the DOT
+//is signed with
+func (ro *DOT) GetSigAlgorithm() SigAlgorithm {
+	return ro.alg
+}
+
+//SetSigAlgorithm sets the signature scheme Encode signs with. It must be
+//the giver's
+func (ro *DOT) SetSigAlgorithm(alg SigAlgorithm) {
+	ro.alg = alg
+}
+
 type Entity struct {
 	content   []byte
 	signature []byte
@@ -1437,6 +1582,7 @@ type Entity struct {
 	contact   string
 	comment   string
 	sigok     sigState
+	alg       SigAlgorithm
 }
 
 func CreateLightEntity(vk, sk []byte) *Entity {
@@ -1446,6 +1592,16 @@ func CreateLightEntity(vk, sk []byte) *Entity {
 	return &Entity{vk: vk, sk: sk}
 }
 func CreateNewEntity(contact, comment string, revokers [][]byte) *Entity {
+	sk, vk := GenerateKeypair()
+	return CreateNewEntityWithKeypair(contact, comment, revokers, sk, vk)
+}
+
+//CreateNewEntityWithKeypair is like CreateNewEntity, but for an existing
+//keypair, such as one derived from a mnemonic
+func CreateNewEntityWithKeypair(contact, comment string, revokers [][]byte, sk, vk []byte) *Entity {
+	if len(vk) != 32 || len(sk) != 32 {
+		panic("Bad keypairs")
+	}
 	if revokers == nil {
 		revokers = make([][]byte, 0)
 	}
@@ -1454,16 +1610,18 @@ func CreateNewEntity(contact, comment string, revokers [][]byte) *Entity {
 			panic("I told you we need to check this...")
 		}
 	}
-	rv := &Entity{contact: contact, comment: comment, revokers: revokers}
-	rv.sk, rv.vk = GenerateKeypair()
-	return rv
+	return &Entity{contact: contact, comment: comment, revokers: revokers, sk: sk, vk: vk}
 }
 func (ro *Entity) IsExpired() bool {
 	if ro.expires != nil {
-		return ro.expires.Before(time.Now())
+		return ro.expires.Add(ClockSkew).Before(time.Now())
 	}
 	return false
 }
+//AddRevoker adds an entity that may revoke this one. It panics if rvk is
+//not a VK.
+//
+//Deprecated: use EntityBuilder.Revoker, which returns an error instead
 func (ro *Entity) AddRevoker(rvk []byte) {
 	if len(rvk) != 32 {
 		panic("What kind of VK is this?")
@@ -1530,6 +1688,11 @@ func (ro *Entity) GetRevokers() [][]byte {
 	return ro.revokers
 }
 
+//GetSigAlgorithm returns the signature scheme of the entity's keys
+func (ro *Entity) GetSigAlgorithm() SigAlgorithm {
+	return ro.alg
+}
+
 //SigValid returns if the Entity's signature is valid. This only checks
 //the signature on the first call, so the content must not change
 //after encoding for this to be valid
@@ -1539,10 +1702,11 @@ func (ro *Entity) SigValid() bool {
 	} else if ro.sigok == sigInvalid {
 		return false
 	}
-	if len(ro.signature) != 64 || len(ro.content) == 0 {
+	p := mustSignatureProvider(ro.alg)
+	if len(ro.signature) != p.SigSize() || len(ro.content) == 0 {
 		panic("Entity in invalid state")
 	}
-	ok := VerifyBlob(ro.vk, ro.signature, ro.content[:len(ro.content)-64])
+	ok := p.Verify(ro.vk, ro.signature, ro.content[:len(ro.content)-len(ro.signature)])
 	if ok {
 		ro.sigok = sigValid
 		return true
@@ -1587,29 +1751,33 @@ func (ro *Entity) Encode() {
 		buf = append(buf, 0x06, byte(len(ro.comment)))
 		buf = append(buf, []byte(ro.comment)...)
 	}
+	if ro.alg != SigEd25519 {
+		buf = append(buf, sigAlgOption, 1, byte(ro.alg))
+	}
 	buf = append(buf, 0)
-	sig := make([]byte, 64)
-	SignBlob(ro.sk, ro.vk, sig, buf)
+	p := mustSignatureProvider(ro.alg)
+	sig := make([]byte, p.SigSize())
+	p.Sign(ro.sk, ro.vk, sig, buf)
 	buf = append(buf, sig...)
 	ro.content = buf
 	ro.signature = sig
 }
 
-func NewEntity(ronum int, content []byte) (rv RoutingObject, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = NewObjectError(ronum, "Bad Entity")
-			rv = nil
-		}
-	}()
+func NewEntity(ronum int, content []byte) (RoutingObject, error) {
 	var sk []byte
 	if ronum == ROEntityWKey {
+		if !hasBytes(content, 0, 32) {
+			return nil, NewObjectError(ronum, "Entity key is truncated")
+		}
 		sk = content[:32]
 		content = content[32:]
 		ronum = ROEntity
 	}
 	if ronum != ROEntity {
-		panic("Bad RONUM: " + strconv.Itoa(ronum))
+		return nil, NewObjectError(ronum, "Bad RONUM: "+strconv.Itoa(ronum))
+	}
+	if !hasBytes(content, 0, 32) {
+		return nil, NewObjectError(ronum, "Entity is truncated")
 	}
 	e := &Entity{
 		content:  content,
@@ -1618,6 +1786,9 @@ func NewEntity(ronum int, content []byte) (rv RoutingObject, err error) {
 	}
 	idx := 32
 	for {
+		if !hasHeader(content, idx) {
+			return nil, NewObjectError(ROEntity, "Entity header is truncated")
+		}
 		switch content[idx] {
 		case 0x02: //Creation date
 			if content[idx+1] != 8 {
@@ -1650,16 +1821,27 @@ func NewEntity(ronum int, content []byte) (rv RoutingObject, err error) {
 			ln := int(content[idx+1])
 			e.comment = string(content[idx+2 : idx+2+ln])
 			idx += 2 + ln
+		case sigAlgOption:
+			p, err := parseSigAlgOption(ROEntity, content, idx)
+			if err != nil {
+				return nil, err
+			}
+			e.alg = p.Algorithm()
+			idx += 3
 		case 0x00: //End
 			idx++
 			goto done
 		default: //Skip unknown header
 			fmt.Println("Unknown Entity option type: ", content[idx])
-			idx += int(content[idx+1]) + 1
+			idx += int(content[idx+1]) + 2
 		}
 	}
 done:
-	e.signature = content[idx : idx+64]
+	sigsize := mustSignatureProvider(e.alg).SigSize()
+	if !hasBytes(content, idx, sigsize) {
+		return nil, NewObjectError(ROEntity, "Entity signature is truncated")
+	}
+	e.signature = content[idx : idx+sigsize]
 	if sk != nil {
 		e.SetSK(sk)
 	}
@@ -1750,24 +1932,15 @@ func CreateNewExpiry(expiry time.Time) *Expiry {
 	binary.LittleEndian.PutUint64(rv.content, uint64(expiry.UnixNano()))
 	return &rv
 }
-func NewExpiry(ronum int, content []byte) (rv RoutingObject, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println(r)
-			debug.PrintStack()
-			err = NewObjectError(ronum, "Bad Expiry")
-			rv = nil
-		}
-	}()
+func NewExpiry(ronum int, content []byte) (RoutingObject, error) {
 	if ronum != ROExpiry {
-		panic("Bad ronum")
+		return nil, NewObjectError(ronum, "Bad ronum")
 	}
 	if len(content) != 8 {
 		return nil, NewObjectError(ronum, "Content is the wrong size")
 	}
 	t := time.Unix(0, int64(binary.LittleEndian.Uint64(content[:8])))
-	rv = &Expiry{time: t, content: content}
-	return rv, nil
+	return &Expiry{time: t, content: content}, nil
 }
 func (ro *Expiry) GetRONum() int {
 	return ROExpiry
@@ -1810,6 +1983,68 @@ func (ro *Expiry) GetExpiry() time.Time {
 	return ro.time
 }
 
+//Trace asks the routers that handle a message to append a signed hop
+//record after the message signature, so the path can be seen on delivery
+type Trace struct {
+	created time.Time
+	content []byte
+}
+
+func CreateTrace() *Trace {
+	now := time.Now()
+	rv := Trace{created: now, content: make([]byte, 8)}
+	binary.LittleEndian.PutUint64(rv.content, uint64(now.UnixNano()))
+	return &rv
+}
+func NewTrace(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROTrace {
+		return nil, NewObjectError(ronum, "Bad ronum")
+	}
+	if len(content) != 8 {
+		return nil, NewObjectError(ronum, "Content is the wrong size")
+	}
+	t := time.Unix(0, int64(binary.LittleEndian.Uint64(content)))
+	return &Trace{created: t, content: content}, nil
+}
+func (ro *Trace) GetRONum() int {
+	return ROTrace
+}
+func (ro *Trace) GetContent() []byte {
+	return ro.content
+}
+func (ro *Trace) IsPayloadObject() bool {
+	return false
+}
+func (ro *Trace) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	if fullObjNum {
+		_, err := s.Write([]byte{byte(ro.GetRONum()), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.Write([]byte{byte(ro.GetRONum()),
+			byte(ln),
+			byte(ln >> 8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Write(ro.content)
+	return err
+}
+
+//GetCreated is when the publisher created the message
+func (ro *Trace) GetCreated() time.Time {
+	return ro.created
+}
+
 type OriginVK struct {
 	vk []byte
 }
@@ -1819,7 +2054,7 @@ func CreateOriginVK(vk []byte) *OriginVK {
 }
 func NewOriginVK(ronum int, content []byte) (RoutingObject, error) {
 	if ronum != ROOriginVK {
-		panic("Bad ronum")
+		return nil, NewObjectError(ronum, "Bad ronum")
 	}
 	if len(content) != 32 {
 		return nil, NewObjectError(ronum, "Content is the wrong size")
@@ -1909,6 +2144,26 @@ func (ro *Revocation) GetRONum() int {
 func (ro *Revocation) GetCreated() *time.Time {
 	return ro.created
 }
+//GetExpiry returns nil, revocations do not expire
+func (ro *Revocation) GetExpiry() *time.Time {
+	return nil
+}
+
+//IsExpired is always false
+func (ro *Revocation) IsExpired() bool {
+	return false
+}
+
+//GetRevokers returns nil, a revocation cannot be revoked
+func (ro *Revocation) GetRevokers() [][]byte {
+	return nil
+}
+
+//GetContact returns "", revocations have no contact
+func (ro *Revocation) GetContact() string {
+	return ""
+}
+
 func (ro *Revocation) GetComment() string {
 	return ro.comment
 }
@@ -1965,17 +2220,12 @@ func (ro *Revocation) GetContent() []byte {
 func (ro *Revocation) IsPayloadObject() bool {
 	return false
 }
-func NewRevocation(ronum int, content []byte) (rv RoutingObject, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println(r)
-			debug.PrintStack()
-			err = NewObjectError(ronum, "Bad Revocation")
-			rv = nil
-		}
-	}()
+func NewRevocation(ronum int, content []byte) (RoutingObject, error) {
 	if ronum != RORevocation {
-		panic("Bad RONUM: " + strconv.Itoa(ronum))
+		return nil, NewObjectError(ronum, "Bad RONUM: "+strconv.Itoa(ronum))
+	}
+	if !hasBytes(content, 0, 64) {
+		return nil, NewObjectError(ronum, "Revocation is truncated")
 	}
 	hasharr := sha256.Sum256(content)
 	rk := &Revocation{
@@ -1986,6 +2236,9 @@ func NewRevocation(ronum int, content []byte) (rv RoutingObject, err error) {
 	}
 	idx := 64
 	for {
+		if !hasHeader(content, idx) {
+			return nil, NewObjectError(RORevocation, "Revocation header is truncated")
+		}
 		switch content[idx] {
 		case 0x02: //Creation date
 			if content[idx+1] != 8 {
@@ -2008,6 +2261,9 @@ func NewRevocation(ronum int, content []byte) (rv RoutingObject, err error) {
 		}
 	}
 done:
+	if !hasBytes(content, idx, 64) {
+		return nil, NewObjectError(RORevocation, "Revocation signature is truncated")
+	}
 	rk.signature = content[idx : idx+64]
 	return rk, nil
 }
@@ -2085,3 +2341,204 @@ func (ro *Revocation) SigValid() bool {
 	ro.sigok = sigInvalid
 	return false
 }
+
+//ConsumerAck asks the designated router to keep a message published for a
+//limited number of consumers for the timeout, so that a consumer that NACKs
+//it in that time has it delivered to another consumer instead
+type ConsumerAck struct {
+	timeout time.Duration
+	content []byte
+}
+
+func CreateConsumerAck(timeout time.Duration) *ConsumerAck {
+	rv := ConsumerAck{timeout: timeout, content: make([]byte, 4)}
+	binary.LittleEndian.PutUint32(rv.content, uint32(timeout/time.Millisecond))
+	return &rv
+}
+func NewConsumerAck(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROConsumerAck {
+		return nil, NewObjectError(ronum, "Bad ronum")
+	}
+	if len(content) != 4 {
+		return nil, NewObjectError(ronum, "Content is the wrong size")
+	}
+	d := time.Duration(binary.LittleEndian.Uint32(content)) * time.Millisecond
+	return &ConsumerAck{timeout: d, content: content}, nil
+}
+func (ro *ConsumerAck) GetRONum() int {
+	return ROConsumerAck
+}
+func (ro *ConsumerAck) GetContent() []byte {
+	return ro.content
+}
+func (ro *ConsumerAck) IsPayloadObject() bool {
+	return false
+}
+func (ro *ConsumerAck) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	if fullObjNum {
+		_, err := s.Write([]byte{byte(ro.GetRONum()), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.Write([]byte{byte(ro.GetRONum()),
+			byte(ln),
+			byte(ln >> 8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Write(ro.content)
+	return err
+}
+
+//GetTimeout is how long after delivery a consumer may NACK the message
+func (ro *ConsumerAck) GetTimeout() time.Duration {
+	return ro.timeout
+}
+
+//Timestamp is the time by a router's clock, signed by the router. A
+//message carrying one lets those that verify it tell an expired message
+//or DOT from a clock that is wrong
+type Timestamp struct {
+	time      time.Time
+	vk        []byte
+	signature []byte
+	content   []byte
+}
+
+//CreateTimestamp signs the time with a router's keys
+func CreateTimestamp(t time.Time, sk []byte, vk []byte) *Timestamp {
+	content := make([]byte, 8+32+64)
+	binary.LittleEndian.PutUint64(content, uint64(t.UnixNano()))
+	copy(content[8:], vk)
+	SignBlob(sk, vk, content[40:], content[:40])
+	return &Timestamp{time: time.Unix(0, t.UnixNano()), vk: content[8:40], signature: content[40:], content: content}
+}
+func NewTimestamp(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROTimestamp {
+		return nil, NewObjectError(ronum, "Bad ronum")
+	}
+	if len(content) != 8+32+64 {
+		return nil, NewObjectError(ronum, "Content is the wrong size")
+	}
+	t := time.Unix(0, int64(binary.LittleEndian.Uint64(content)))
+	return &Timestamp{time: t, vk: content[8:40], signature: content[40:], content: content}, nil
+}
+func (ro *Timestamp) GetRONum() int {
+	return ROTimestamp
+}
+func (ro *Timestamp) GetContent() []byte {
+	return ro.content
+}
+func (ro *Timestamp) IsPayloadObject() bool {
+	return false
+}
+func (ro *Timestamp) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	if fullObjNum {
+		_, err := s.Write([]byte{byte(ro.GetRONum()), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.Write([]byte{byte(ro.GetRONum()),
+			byte(ln),
+			byte(ln >> 8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Write(ro.content)
+	return err
+}
+
+//GetTime is the time the router signed
+func (ro *Timestamp) GetTime() time.Time {
+	return ro.time
+}
+
+//GetVK is the VK of the router that signed the time
+func (ro *Timestamp) GetVK() []byte {
+	return ro.vk
+}
+func (ro *Timestamp) SigValid() bool {
+	return VerifyBlob(ro.vk, ro.signature, ro.content[:40])
+}
+
+//MaxIdempotencyKey is the longest idempotency key, in bytes
+const MaxIdempotencyKey = 64
+
+//IdempotencyKey names a publish or persist, so that the designated router
+//delivers it once however many times it is retried with the same key on
+//the same URI within the router's IdempotencyWindow
+type IdempotencyKey struct {
+	content []byte
+}
+
+func CreateIdempotencyKey(key string) (*IdempotencyKey, error) {
+	if len(key) == 0 || len(key) > MaxIdempotencyKey {
+		return nil, NewObjectError(ROIdempotencyKey, "Key must be 1 to 64 bytes")
+	}
+	return &IdempotencyKey{content: []byte(key)}, nil
+}
+func NewIdempotencyKey(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROIdempotencyKey {
+		return nil, NewObjectError(ronum, "Bad ronum")
+	}
+	if len(content) == 0 || len(content) > MaxIdempotencyKey {
+		return nil, NewObjectError(ronum, "Content is the wrong size")
+	}
+	return &IdempotencyKey{content: content}, nil
+}
+func (ro *IdempotencyKey) GetRONum() int {
+	return ROIdempotencyKey
+}
+func (ro *IdempotencyKey) GetContent() []byte {
+	return ro.content
+}
+func (ro *IdempotencyKey) IsPayloadObject() bool {
+	return false
+}
+func (ro *IdempotencyKey) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	if fullObjNum {
+		_, err := s.Write([]byte{byte(ro.GetRONum()), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.Write([]byte{byte(ro.GetRONum()),
+			byte(ln),
+			byte(ln >> 8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Write(ro.content)
+	return err
+}
+
+//GetKey is the key the publisher chose
+func (ro *IdempotencyKey) GetKey() string {
+	return string(ro.content)
+}
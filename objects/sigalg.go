@@ -0,0 +1,113 @@
+package objects
+
+import (
+	"fmt"
+	"sync"
+)
+
+//SigAlgorithm identifies the signature scheme of an entity, and of the
+//DOTs it gives
+type SigAlgorithm uint8
+
+//SigEd25519 is the original scheme. Entities and DOTs without an algorithm
+//option use it, so objects made before there was a choice parse unchanged
+const SigEd25519 SigAlgorithm = 0
+
+//sigAlgOption is the option type in entities and DOTs that holds the
+//algorithm, as one byte. It is only written for other algorithms, so ed25519
+//objects encode, and hash, as they always have
+const sigAlgOption = 0x08
+
+//SignatureProvider implements a signature scheme for entities and DOTs.
+//Keys are 32 bytes, as that is part of the layout of both, but a
+//signature may be any fixed size. The registry contract only checks
+//ed25519 signatures, so objects using other schemes can be used on routers
+//that have the provider but not published
+type SignatureProvider interface {
+	Algorithm() SigAlgorithm
+	Name() string
+	SigSize() int
+	GenerateKeypair() (sk []byte, vk []byte)
+	//Sign writes the signature of blob into into, which is SigSize bytes
+	Sign(sk []byte, vk []byte, into []byte, blob []byte)
+	Verify(vk []byte, sig []byte, blob []byte) bool
+}
+
+type ed25519Provider struct{}
+
+func (ed25519Provider) Algorithm() SigAlgorithm {
+	return SigEd25519
+}
+func (ed25519Provider) Name() string {
+	return "ed25519"
+}
+func (ed25519Provider) SigSize() int {
+	return 64
+}
+func (ed25519Provider) GenerateKeypair() ([]byte, []byte) {
+	return GenerateKeypair()
+}
+func (ed25519Provider) Sign(sk []byte, vk []byte, into []byte, blob []byte) {
+	SignBlob(sk, vk, into, blob)
+}
+func (ed25519Provider) Verify(vk []byte, sig []byte, blob []byte) bool {
+	return VerifyBlob(vk, sig, blob)
+}
+
+var sigProvidersMu sync.RWMutex
+var sigProviders = map[SigAlgorithm]SignatureProvider{
+	SigEd25519: ed25519Provider{},
+}
+
+//RegisterSignatureProvider adds a signature scheme. Entities and DOTs with
+//its algorithm do not parse until it is registered, so do it in init
+func RegisterSignatureProvider(p SignatureProvider) error {
+	sigProvidersMu.Lock()
+	defer sigProvidersMu.Unlock()
+	if old, ok := sigProviders[p.Algorithm()]; ok {
+		return fmt.Errorf("signature algorithm %d is already %s", p.Algorithm(), old.Name())
+	}
+	if p.SigSize() <= 0 {
+		return fmt.Errorf("signature algorithm %s has no signature size", p.Name())
+	}
+	sigProviders[p.Algorithm()] = p
+	return nil
+}
+
+//GetSignatureProvider returns the provider for an algorithm, if it is
+//registered
+func GetSignatureProvider(alg SigAlgorithm) (SignatureProvider, bool) {
+	sigProvidersMu.RLock()
+	defer sigProvidersMu.RUnlock()
+	p, ok := sigProviders[alg]
+	return p, ok
+}
+
+func (alg SigAlgorithm) String() string {
+	if p, ok := GetSignatureProvider(alg); ok {
+		return p.Name()
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(alg))
+}
+
+//mustSignatureProvider is for encoding, which panics on other misuse too
+func mustSignatureProvider(alg SigAlgorithm) SignatureProvider {
+	p, ok := GetSignatureProvider(alg)
+	if !ok {
+		panic(fmt.Sprintf("no provider for signature algorithm %d", alg))
+	}
+	return p
+}
+
+//parseSigAlgOption reads the value of an algorithm option at idx, which
+//must be for a registered algorithm as the signature size depends on it
+func parseSigAlgOption(ronum int, content []byte, idx int) (SignatureProvider, error) {
+	if content[idx+1] != 1 {
+		return nil, NewObjectError(ronum, "Invalid signature algorithm option")
+	}
+	p, ok := GetSignatureProvider(SigAlgorithm(content[idx+2]))
+	if !ok {
+		return nil, NewObjectError(ronum, fmt.Sprintf("Unknown signature algorithm %d", content[idx+2]))
+	}
+	return p, nil
+}
@@ -0,0 +1,207 @@
+package objects
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//PONumMatch matches the payload object numbers whose top Mask bits are
+//those of PONum, as in the dot form 2.0.0.0/8
+type PONumMatch struct {
+	PONum int
+	Mask  int
+}
+
+//ParsePONumMatch parses a dot form with an optional /mask, which is 32 if
+//it is left out
+func ParsePONumMatch(df string) (PONumMatch, error) {
+	parts := strings.SplitN(df, "/", 2)
+	rv := PONumMatch{Mask: 32}
+	if len(parts) == 2 {
+		var err error
+		rv.Mask, err = strconv.Atoi(parts[1])
+		if err != nil || rv.Mask < 0 || rv.Mask > 32 {
+			return rv, fmt.Errorf("bad mask in %q", df)
+		}
+	}
+	ponum, err := PONumFromDotForm(parts[0])
+	if err != nil {
+		return rv, fmt.Errorf("bad dot form %q", df)
+	}
+	rv.PONum = ponum
+	return rv, nil
+}
+
+func (pm PONumMatch) Matches(ponum int) bool {
+	return ponum>>uint(32-pm.Mask) == pm.PONum>>uint(32-pm.Mask)
+}
+
+func (pm PONumMatch) String() string {
+	return fmt.Sprintf("%s/%d", PONumDotForm(pm.PONum), pm.Mask)
+}
+
+//FieldMatch matches a msgpack payload object that is a map with Field equal
+//to Value, which is msgpack encoded. Field may be a dotted path into
+//nested maps
+type FieldMatch struct {
+	Field string
+	Value []byte
+}
+
+//SubscriptionFilter asks the designated router to only deliver the
+//messages on a subscription that pass it, so that a client interested in
+//a few of the messages on a busy URI does not receive them all. A message
+//passes if its payload size is within the bounds, and one of its payload
+//objects matches one of the PO numbers (any does if there are none) and
+//every field match
+type SubscriptionFilter struct {
+	ponums  []PONumMatch
+	minSize int
+	maxSize int
+	fields  []FieldMatch
+	content []byte
+}
+
+//CreateSubscriptionFilter encodes a filter. A maxSize of zero means there
+//is no upper bound
+func CreateSubscriptionFilter(ponums []PONumMatch, minSize int, maxSize int, fields []FieldMatch) (*SubscriptionFilter, error) {
+	if len(ponums) > 255 || len(fields) > 255 {
+		return nil, fmt.Errorf("too many PO numbers or fields in the filter")
+	}
+	if minSize < 0 || maxSize < 0 || (maxSize != 0 && maxSize < minSize) {
+		return nil, fmt.Errorf("bad payload size bounds")
+	}
+	content := []byte{byte(len(ponums))}
+	for _, pm := range ponums {
+		if pm.Mask < 0 || pm.Mask > 32 {
+			return nil, fmt.Errorf("bad mask in the filter")
+		}
+		content = append(content, 0, 0, 0, 0, byte(pm.Mask))
+		binary.LittleEndian.PutUint32(content[len(content)-5:], uint32(pm.PONum))
+	}
+	content = append(content, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(content[len(content)-8:], uint32(minSize))
+	binary.LittleEndian.PutUint32(content[len(content)-4:], uint32(maxSize))
+	content = append(content, byte(len(fields)))
+	for _, fm := range fields {
+		if len(fm.Field) > 0xFFFF || len(fm.Value) > 0xFFFF {
+			return nil, fmt.Errorf("field match too long")
+		}
+		content = append(content, byte(len(fm.Field)), byte(len(fm.Field)>>8))
+		content = append(content, fm.Field...)
+		content = append(content, byte(len(fm.Value)), byte(len(fm.Value)>>8))
+		content = append(content, fm.Value...)
+	}
+	return &SubscriptionFilter{ponums: ponums, minSize: minSize, maxSize: maxSize, fields: fields, content: content}, nil
+}
+
+func NewSubscriptionFilter(ronum int, content []byte) (RoutingObject, error) {
+	if ronum != ROSubscriptionFilter {
+		return nil, NewObjectError(ronum, "Bad ronum")
+	}
+	bad := NewObjectError(ronum, "Content is malformed")
+	rv := &SubscriptionFilter{content: content}
+	idx := 0
+	if len(content) < 1 {
+		return nil, bad
+	}
+	n := int(content[idx])
+	idx++
+	for i := 0; i < n; i++ {
+		if len(content) < idx+5 || content[idx+4] > 32 {
+			return nil, bad
+		}
+		rv.ponums = append(rv.ponums, PONumMatch{
+			PONum: int(binary.LittleEndian.Uint32(content[idx:])),
+			Mask:  int(content[idx+4]),
+		})
+		idx += 5
+	}
+	if len(content) < idx+9 {
+		return nil, bad
+	}
+	rv.minSize = int(binary.LittleEndian.Uint32(content[idx:]))
+	rv.maxSize = int(binary.LittleEndian.Uint32(content[idx+4:]))
+	n = int(content[idx+8])
+	idx += 9
+	field := func() ([]byte, bool) {
+		if len(content) < idx+2 {
+			return nil, false
+		}
+		ln := int(binary.LittleEndian.Uint16(content[idx:]))
+		idx += 2
+		if len(content) < idx+ln {
+			return nil, false
+		}
+		idx += ln
+		return content[idx-ln : idx], true
+	}
+	for i := 0; i < n; i++ {
+		name, ok := field()
+		if !ok {
+			return nil, bad
+		}
+		value, ok := field()
+		if !ok {
+			return nil, bad
+		}
+		rv.fields = append(rv.fields, FieldMatch{Field: string(name), Value: value})
+	}
+	if idx != len(content) {
+		return nil, bad
+	}
+	return rv, nil
+}
+func (ro *SubscriptionFilter) GetRONum() int {
+	return ROSubscriptionFilter
+}
+func (ro *SubscriptionFilter) GetContent() []byte {
+	return ro.content
+}
+func (ro *SubscriptionFilter) IsPayloadObject() bool {
+	return false
+}
+func (ro *SubscriptionFilter) WriteToStream(s io.Writer, fullObjNum bool) error {
+	ln := len(ro.content)
+	if fullObjNum {
+		_, err := s.Write([]byte{byte(ro.GetRONum()), 0, 0, 0,
+			byte(ln),
+			byte(ln >> 8),
+			byte(ln >> 16),
+			byte(ln >> 24),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := s.Write([]byte{byte(ro.GetRONum()),
+			byte(ln),
+			byte(ln >> 8),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Write(ro.content)
+	return err
+}
+
+//GetPONums are the PO numbers a payload object must match, any matches if
+//there are none
+func (ro *SubscriptionFilter) GetPONums() []PONumMatch {
+	return ro.ponums
+}
+
+//GetSizeBounds are the bounds on the total size of a message's payload
+//objects. There is no upper bound if max is zero
+func (ro *SubscriptionFilter) GetSizeBounds() (min int, max int) {
+	return ro.minSize, ro.maxSize
+}
+
+//GetFields are the fields a msgpack payload object must have
+func (ro *SubscriptionFilter) GetFields() []FieldMatch {
+	return ro.fields
+}
@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"math/big"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/objects"
-	"github.com/immesys/bw2bind"
 	"github.com/mgutz/ansi"
 )
 
@@ -48,13 +48,28 @@ func ifstring(level int) string {
 func resetTerm() {
 	fmt.Print(ansi.ColorCode("reset"))
 }
-func doentityfile(e *objects.Entity, cl *bw2bind.BW2Client) {
+//validityNote describes a registry lookup. Anything but "valid" is shown
+//as a problem
+func validityNote(validity string, err error) string {
+	if err != nil {
+		return "ERROR: " + err.Error()
+	}
+	switch validity {
+	case "valid":
+		return "valid"
+	case "expired", "revoked":
+		return strings.ToUpper(validity)
+	default:
+		return "UNKNOWN"
+	}
+}
+func doentityfile(e *objects.Entity, ac *agentConn) {
 	//Do this so you can get registry messages even for files
-	_, status, xerr := cl.ResolveRegistry(crypto.FmtKey(e.GetVK()))
-	regnote := cl.ValidityToString(status, xerr)
-	doentityobj(e, 2, regnote, cl)
+	_, validity, xerr := ac.resolveRegistry(crypto.FmtKey(e.GetVK()))
+	regnote := validityNote(validity, xerr)
+	doentityobj(e, 2, regnote, ac)
 }
-func dorevocationfile(e *objects.Revocation, cl *bw2bind.BW2Client) {
+func dorevocationfile(e *objects.Revocation, ac *agentConn) {
 	fmt.Println(ifstring(2) + " Revocation Hash: " + crypto.FmtKey(e.GetHash()))
 	if e.SigValid() {
 		fmt.Println(istring(2) + " Signature: valid")
@@ -62,7 +77,7 @@ func dorevocationfile(e *objects.Revocation, cl *bw2bind.BW2Client) {
 		fmt.Println(istring(2) + ansi.ColorCode("red+b") + " SIGNATURE INVALID")
 	}
 
-	ro, _, err := cl.ResolveRegistry(crypto.FmtKey(e.GetTarget()))
+	ro, _, err := ac.resolveRegistry(crypto.FmtKey(e.GetTarget()))
 	if err != nil {
 		fmt.Println(istring(2) + " Validity : " + ansi.ColorCode("red+b") + "ERR " + err.Error())
 	} else {
@@ -83,7 +98,7 @@ func dorevocationfile(e *objects.Revocation, cl *bw2bind.BW2Client) {
 		fmt.Println(istring(2) + " Comment: " + e.GetComment())
 	}
 }
-func doentityobj(e *objects.Entity, indent int, regnote string, cl *bw2bind.BW2Client) {
+func doentityobj(e *objects.Entity, indent int, regnote string, ac *agentConn) {
 	//TODO clean this func up a little to be not copypasta
 	fmt.Println(ifstring(indent) + " Entity VK: " + crypto.FmtKey(e.GetVK()))
 	if e.SigValid() {
@@ -95,7 +110,7 @@ func doentityobj(e *objects.Entity, indent int, regnote string, cl *bw2bind.BW2C
 		regnote = ansi.ColorCode("red+b") + regnote
 	}
 	fmt.Println(istring(indent) + " Registry: " + regnote)
-	s, err := cl.UnresolveAlias(e.GetVK())
+	s, err := ac.unresolveAlias(e.GetVK())
 	if err != nil {
 		fmt.Println(istring(indent) + " Alias: err: " + err.Error())
 	} else {
@@ -109,8 +124,8 @@ func doentityobj(e *objects.Entity, indent int, regnote string, cl *bw2bind.BW2C
 		} else {
 			fmt.Println(istring(indent) + ansi.ColorCode("red+b") + " KEYPAIR INCONSISTENT")
 		}
-		cl.SetEntity(e.GetSigningBlob())
-		accbal, err := cl.EntityBalances()
+		ac.setEntity(e.GetSigningBlob())
+		accbal, err := ac.entityBalances()
 		if err != nil {
 			fmt.Println(istring(indent) + " Balances:" + ansi.ColorCode("red+b") + " ERROR: " + err.Error())
 		} else {
@@ -141,12 +156,12 @@ func doentityobj(e *objects.Entity, indent int, regnote string, cl *bw2bind.BW2C
 	}
 	for idx, rvk := range e.GetRevokers() {
 		fmt.Println(istring(indent) + fmt.Sprintf(" Revoker[%d]:", idx))
-		doentity(rvk, indent+1, cl)
+		doentity(rvk, indent+1, ac)
 	}
 }
-func doentity(vk []byte, indent int, cl *bw2bind.BW2Client) {
-	ei, status, xerr := cl.ResolveRegistry(crypto.FmtKey(vk))
-	regnote := cl.ValidityToString(status, xerr)
+func doentity(vk []byte, indent int, ac *agentConn) {
+	ei, validity, xerr := ac.resolveRegistry(crypto.FmtKey(vk))
+	regnote := validityNote(validity, xerr)
 	if ei == nil {
 		fmt.Println(ifstring(indent) + " UNKNOWN ENTITY, VK=" + crypto.FmtKey(vk))
 		return
@@ -156,17 +171,17 @@ func doentity(vk []byte, indent int, cl *bw2bind.BW2Client) {
 		fmt.Println(ifstring(indent) + ansi.ColorCode("red+b") + fmt.Sprintf(" RO TYPE MISMATCH, EXPECT ENTITY GOT %+v\n", ei))
 		return
 	}
-	doentityobj(e, indent, regnote, cl)
+	doentityobj(e, indent, regnote, ac)
 }
-func dodotfile(d *objects.DOT, cl *bw2bind.BW2Client) {
+func dodotfile(d *objects.DOT, ac *agentConn) {
 	//Do this so you can get registry messages even for files
-	_, status, xerr := cl.ResolveRegistry(crypto.FmtKey(d.GetHash()))
-	regnote := cl.ValidityToString(status, xerr)
-	dodotobj(d, 2, regnote, cl)
+	_, validity, xerr := ac.resolveRegistry(crypto.FmtKey(d.GetHash()))
+	regnote := validityNote(validity, xerr)
+	dodotobj(d, 2, regnote, ac)
 }
-func dodot(hash []byte, indent int, cl *bw2bind.BW2Client) {
-	di, status, xerr := cl.ResolveRegistry(crypto.FmtKey(hash))
-	regnote := cl.ValidityToString(status, xerr)
+func dodot(hash []byte, indent int, ac *agentConn) {
+	di, validity, xerr := ac.resolveRegistry(crypto.FmtKey(hash))
+	regnote := validityNote(validity, xerr)
 	if di == nil {
 		fmt.Println(ifstring(indent) + " UNKNOWN DOT, HASH=" + crypto.FmtKey(hash))
 		return
@@ -176,9 +191,9 @@ func dodot(hash []byte, indent int, cl *bw2bind.BW2Client) {
 		fmt.Println(ifstring(indent) + ansi.ColorCode("red+b") + fmt.Sprintf(" RO TYPE MISMATCH, EXPECT DOT GOT %+v\n", di))
 		return
 	}
-	dodotobj(d, indent, regnote, cl)
+	dodotobj(d, indent, regnote, ac)
 }
-func dodotobj(d *objects.DOT, indent int, regnote string, cl *bw2bind.BW2Client) {
+func dodotobj(d *objects.DOT, indent int, regnote string, ac *agentConn) {
 	fmt.Println(ifstring(indent) + " DOT " + crypto.FmtHash(d.GetHash()))
 	if d.SigValid() {
 		fmt.Println(istring(indent) + " Signature: valid")
@@ -190,13 +205,18 @@ func dodotobj(d *objects.DOT, indent int, regnote string, cl *bw2bind.BW2Client)
 	}
 	fmt.Println(istring(indent) + " Registry: " + regnote)
 	fmt.Println(istring(indent) + " From: ")
-	doentity(d.GetGiverVK(), indent+1, cl)
+	doentity(d.GetGiverVK(), indent+1, ac)
 	fmt.Println(istring(indent) + " To: ")
-	doentity(d.GetReceiverVK(), indent+1, cl)
-	//TODO reverse alias lookup
+	doentity(d.GetReceiverVK(), indent+1, ac)
+	if s, err := ac.unresolveAlias(d.GetHash()); err == nil && s != "" {
+		fmt.Println(istring(indent)+" Alias:", s)
+	}
 	if d.IsAccess() {
 		fmt.Println(istring(indent) + " URI: " + crypto.FmtKey(d.GetAccessURIMVK()) + "/" + d.GetAccessURISuffix())
 		fmt.Println(istring(indent) + " Permissions: " + d.GetPermString())
+		if nd := d.GetNoDelegate(); nd != nil {
+			fmt.Println(istring(indent) + " Not delegable: " + nd.GetPermString())
+		}
 	}
 	if len(d.GetContact()) != 0 {
 		fmt.Println(istring(indent) + " Contact: " + d.GetContact())
@@ -213,12 +233,12 @@ func dodotobj(d *objects.DOT, indent int, regnote string, cl *bw2bind.BW2Client)
 	fmt.Println(istring(indent) + fmt.Sprintf(" TTL: %d", d.GetTTL()))
 	for idx, rvk := range d.GetRevokers() {
 		fmt.Println(istring(indent) + fmt.Sprintf(" Revoker[%d]:", idx))
-		doentity(rvk, indent+1, cl)
+		doentity(rvk, indent+1, ac)
 	}
 }
-func dochain(hash []byte, indent int, verbose bool, cl *bw2bind.BW2Client) {
-	ci, status, xerr := cl.ResolveRegistry(crypto.FmtKey(hash))
-	regnote := cl.ValidityToString(status, xerr)
+func dochain(hash []byte, indent int, verbose bool, ac *agentConn) {
+	ci, validity, xerr := ac.resolveRegistry(crypto.FmtKey(hash))
+	regnote := validityNote(validity, xerr)
 	if ci == nil {
 		fmt.Println(ifstring(indent) + " UNKNOWN CHAIN, HASH=" + crypto.FmtKey(hash))
 		return
@@ -228,15 +248,19 @@ func dochain(hash []byte, indent int, verbose bool, cl *bw2bind.BW2Client) {
 		fmt.Println(ifstring(indent) + ansi.ColorCode("red+b") + fmt.Sprintf(" RO TYPE MISMATCH, EXPECT DCHAIN GOT %+v\n", ci))
 		return
 	}
-	dochainobj(c, indent, verbose, regnote, cl)
+	dochainobj(c, indent, verbose, regnote, ac)
 }
-func dochainfile(dc *objects.DChain, cl *bw2bind.BW2Client, verbose bool) {
+func dochainfile(dc *objects.DChain, ac *agentConn, verbose bool) {
 	//Do this so you can get registry messages even for files
-	_, status, xerr := cl.ResolveRegistry(crypto.FmtKey(dc.GetChainHash()))
-	regnote := cl.ValidityToString(status, xerr)
-	dochainobj(dc, 2, verbose, regnote, cl)
+	ci, validity, xerr := ac.resolveRegistry(crypto.FmtKey(dc.GetChainHash()))
+	regnote := validityNote(validity, xerr)
+	//A chain hash can be expanded if the chain was published
+	if rdc, ok := ci.(*objects.DChain); ok && !dc.IsElaborated() && rdc.IsElaborated() {
+		dc = rdc
+	}
+	dochainobj(dc, 2, verbose, regnote, ac)
 }
-func dochainobj(dc *objects.DChain, indent int, verbose bool, regnote string, cl *bw2bind.BW2Client) {
+func dochainobj(dc *objects.DChain, indent int, verbose bool, regnote string, ac *agentConn) {
 	fmt.Println(ifstring(indent)+" DChain hash=", crypto.FmtHash(dc.GetChainHash()))
 	if regnote != "valid" {
 		regnote = ansi.ColorCode("red+b") + regnote
@@ -249,10 +273,10 @@ func dochainobj(dc *objects.DChain, indent int, verbose bool, regnote string, cl
 		haveall := true
 		for i := 0; i < dc.NumHashes(); i++ {
 			dh := dc.GetDotHash(i)
-			di, _, _ := cl.ResolveRegistry(crypto.FmtKey(dh))
+			di, _, _ := ac.resolveRegistry(crypto.FmtKey(dh))
 			if verbose {
 				fmt.Printf(istring(indent)+" DOT[%d]:\n", i)
-				dodot(dh, indent+1, cl)
+				dodot(dh, indent+1, ac)
 			}
 			if di != nil {
 				d, ok := di.(*objects.DOT)
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//fromJSONNumbers turns the json.Numbers from a decoder with UseNumber into
+//int64 where they are integers, so that they are not packed as floats
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fromJSONNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fromJSONNumbers(e)
+		}
+	}
+	return v
+}
+
+//jsonToMsgPack encodes a JSON document as msgpack
+func jsonToMsgPack(doc string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewBufferString(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(fromJSONNumbers(v))
+}
+
+//payloadFromFlags builds the payload objects given by --text, --file and
+//--msgpack. --ponum replaces the default PO number of each
+func payloadFromFlags(c *cli.Context) ([]objects.PayloadObject, error) {
+	override := -1
+	if c.String("ponum") != "" {
+		ponum, err := objects.PONumFromDotForm(c.String("ponum"))
+		if err != nil {
+			return nil, fmt.Errorf("bad --ponum: %v", err)
+		}
+		override = ponum
+	}
+	mkpo := func(ponum int, content []byte) objects.PayloadObject {
+		if override >= 0 {
+			ponum = override
+		}
+		po, _ := objects.CreateOpaquePayloadObject(ponum, content)
+		return po
+	}
+	rv := []objects.PayloadObject{}
+	if c.IsSet("text") {
+		rv = append(rv, mkpo(objects.PONumString, []byte(c.String("text"))))
+	}
+	if c.String("file") != "" {
+		var content []byte
+		var err error
+		if c.String("file") == "-" {
+			content, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			content, err = ioutil.ReadFile(c.String("file"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, mkpo(objects.PONumBlob, content))
+	}
+	if c.String("msgpack") != "" {
+		content, err := jsonToMsgPack(c.String("msgpack"))
+		if err != nil {
+			return nil, fmt.Errorf("bad --msgpack JSON: %v", err)
+		}
+		rv = append(rv, mkpo(objects.PONumMsgPack, content))
+	}
+	return rv, nil
+}
+
+//publishChunked publishes the payload objects larger than chunkSize as
+//chunk POs, one message per chunk, and the rest in one message
+func publishChunked(ac *agentConn, uri string, pos []objects.PayloadObject, chunkSize int) error {
+	small := []objects.PayloadObject{}
+	for _, po := range pos {
+		if len(po.GetContent()) <= chunkSize {
+			small = append(small, po)
+			continue
+		}
+		chunks, err := objects.CreateChunks(po, chunkSize)
+		if err != nil {
+			return err
+		}
+		for _, ch := range chunks {
+			if err := ac.publishMessage(uri, false, []objects.PayloadObject{ch}); err != nil {
+				return err
+			}
+		}
+	}
+	if len(small) == 0 {
+		return nil
+	}
+	return ac.publishMessage(uri, false, small)
+}
+
+//pub -e entity [--text t] [--file f] [--msgpack json] [--ponum df] [--persist] [--chunksize n] uri
+func actionPub(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 pub -e entity [--text t | --file f | --msgpack json] <uri>")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	checkURIOrExit(c.Args()[0])
+	pos, err := payloadFromFlags(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(pos) == 0 {
+		fmt.Println("You need to specify a payload (--text, --file or --msgpack)")
+		os.Exit(1)
+	}
+	chunkSize := c.Int("chunksize")
+	if chunkSize < 0 {
+		fmt.Println("--chunksize must be positive")
+		os.Exit(1)
+	}
+	//A persisted message would only keep the last chunk
+	if chunkSize > 0 && c.Bool("persist") {
+		fmt.Println("Chunked payloads cannot be persisted")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	uri := c.Args()[0]
+	if chunkSize > 0 {
+		err = publishChunked(ac, uri, pos, chunkSize)
+	} else {
+		err = ac.publishMessage(uri, c.Bool("persist"), pos)
+	}
+	if err != nil {
+		fmt.Printf("Could not publish to %s: %v\n", uri, err)
+		os.Exit(1)
+	}
+	return nil
+}
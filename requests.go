@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/urfave/cli"
+)
+
+//connectRequestEntity connects to the agent as the -e entity, which makes
+//or receives the DOT requests
+func connectRequestEntity(c *cli.Context) *agentConn {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the entity (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	return ac
+}
+
+//requestExpiry parses the --expiry flag, empty if it is not given
+func requestExpiry(c *cli.Context) string {
+	if c.String("expiry") == "" {
+		return ""
+	}
+	dur, err := util.ParseDuration(c.String("expiry"))
+	if err != nil {
+		fmt.Println("Could not parse expiry:", c.String("expiry"))
+		os.Exit(1)
+	}
+	return dur.String()
+}
+
+func actionRequestsSend(c *cli.Context) error {
+	if len(c.Args()) != 1 || c.String("granter") == "" {
+		fmt.Println("Usage: bw2 requests send -e <entity> --granter <vk> [-x <perms>] <uri>")
+		os.Exit(1)
+	}
+	expiry := requestExpiry(c)
+	ac := connectRequestEntity(c)
+	err := ac.requestDOT(c.Args()[0], c.String("granter"), c.String("permissions"), c.Int("ttl"), expiry, c.String("comment"))
+	if err != nil {
+		fmt.Println("Request failed:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Requested a DOT from", c.String("granter"))
+	return nil
+}
+
+func actionRequestsList(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 requests list -e <entity> <namespace>")
+		os.Exit(1)
+	}
+	ac := connectRequestEntity(c)
+	reqs, err := ac.listDOTRequests(c.Args()[0])
+	if err != nil {
+		fmt.Println("Could not list requests:", err)
+		os.Exit(1)
+	}
+	if len(reqs) == 0 {
+		fmt.Println("No pending requests")
+		return nil
+	}
+	for _, r := range reqs {
+		fmt.Printf("%s asks for %s on %s (TTL %s)\n", r.Requester, r.Perms, r.URI, r.TTL)
+		if r.Expiry != "" {
+			fmt.Println("  expiring", r.Expiry)
+		}
+		if r.Comment != "" {
+			fmt.Println("  comment:", r.Comment)
+		}
+		fmt.Println("  requested", r.Created)
+	}
+	return nil
+}
+
+func actionRequestsApprove(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		fmt.Println("Usage: bw2 requests approve -e <entity> <namespace> <requester>")
+		os.Exit(1)
+	}
+	p := &approveParams{
+		perms:    c.String("permissions"),
+		expiry:   requestExpiry(c),
+		comment:  c.String("comment"),
+		contact:  c.String("contact"),
+		revokers: c.StringSlice("revoker"),
+	}
+	if c.IsSet("ttl") {
+		ttl := c.Int("ttl")
+		p.ttl = &ttl
+	}
+	ac := connectRequestEntity(c)
+	dmsg := make(chan string, 1)
+	var dot *objects.DOT
+	go func() {
+		var err error
+		dot, err = ac.approveDOTRequest(c.Args()[0], c.Args()[1], p)
+		if err != nil {
+			dmsg <- "Approval failed: " + chainErrString(err)
+			return
+		}
+		dmsg <- "Granted and published DOT " + crypto.FmtHash(dot.GetHash())
+	}()
+	doChainOp(ac, dmsg)
+	if dot == nil {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func actionRequestsReject(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		fmt.Println("Usage: bw2 requests reject -e <entity> <namespace> <requester>")
+		os.Exit(1)
+	}
+	ac := connectRequestEntity(c)
+	if err := ac.rejectDOTRequest(c.Args()[0], c.Args()[1]); err != nil {
+		fmt.Println("Could not reject the request:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Rejected the request from", c.Args()[1])
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/immesys/bw2/util"
+	"github.com/urfave/cli"
+)
+
+func actionScheduleAdd(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		fmt.Println("Usage: bw2 schedule add -e <entity> [-t <template>] <uri> <cron>")
+		os.Exit(1)
+	}
+	if _, err := util.ParseCron(c.Args()[1]); err != nil {
+		fmt.Println("Bad schedule:", err)
+		os.Exit(1)
+	}
+	ac := connectRequestEntity(c)
+	s, err := ac.addSchedule(c.Args()[0], c.Args()[1], c.String("ponum"), c.String("template"), c.Bool("persist"))
+	if err != nil {
+		fmt.Println("Could not add schedule:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Added schedule %s, first publishing at %s\n", s.ID, s.Next)
+	return nil
+}
+
+func actionScheduleList(c *cli.Context) error {
+	ac := connectRequestEntity(c)
+	scheds, err := ac.listSchedules()
+	if err != nil {
+		fmt.Println("Could not list schedules:", err)
+		os.Exit(1)
+	}
+	if len(scheds) == 0 {
+		fmt.Println("No scheduled publishes")
+		return nil
+	}
+	for _, s := range scheds {
+		fmt.Printf("%s %q on %s (PO %s)\n", s.ID, s.Cron, s.URI, s.PONum)
+		fmt.Printf("  next %s, published %s times\n", s.Next, s.Runs)
+		if s.LastError != "" {
+			fmt.Println("  last error:", s.LastError)
+		}
+	}
+	return nil
+}
+
+func actionScheduleCancel(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 schedule cancel -e <entity> <id>")
+		os.Exit(1)
+	}
+	ac := connectRequestEntity(c)
+	if err := ac.cancelSchedule(c.Args()[0]); err != nil {
+		fmt.Println("Could not cancel schedule:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Cancelled schedule", c.Args()[0])
+	return nil
+}
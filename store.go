@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/immesys/bw2/internal/store"
+	"github.com/klauspost/compress/zstd"
+	"github.com/urfave/cli"
+)
+
+//storePageSize is how many messages are moved in each frame to or from
+//the agent
+const storePageSize = 100
+
+//connectStoreAdmin connects to the agent as the -e entity, which must be
+//allowed to export and import persisted messages
+func connectStoreAdmin(c *cli.Context) *agentConn {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	return ac
+}
+
+func actionStoreExport(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		fmt.Println("Usage: bw2 store export -e <entity> <uri> <file.tar.zst>")
+		os.Exit(1)
+	}
+	uri, fname := c.Args()[0], c.Args()[1]
+	ac := connectStoreAdmin(c)
+	f, err := os.Create(fname)
+	if err != nil {
+		fmt.Println("Could not create archive:", err)
+		os.Exit(1)
+	}
+	var w io.Writer = f
+	var zw *zstd.Encoder
+	if strings.HasSuffix(fname, ".zst") {
+		zw, err = zstd.NewWriter(f)
+		if err != nil {
+			fmt.Println("Could not compress archive:", err)
+			os.Exit(1)
+		}
+		w = zw
+	}
+	aw := store.NewArchiveWriter(w)
+	count := 0
+	cursor := ""
+	for {
+		topics, bodies, seqs, next, err := ac.exportStore(uri, cursor)
+		if err != nil {
+			fmt.Println("Export failed:", err)
+			os.Exit(1)
+		}
+		for i := range topics {
+			if err := aw.Add(topics[i], bodies[i], seqs[i]); err != nil {
+				fmt.Println("Could not write archive:", err)
+				os.Exit(1)
+			}
+		}
+		count += len(topics)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	err = aw.Close()
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		fmt.Println("Could not write archive:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d messages to %s\n", count, fname)
+	return nil
+}
+
+func actionStoreImport(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 store import -e <entity> <file.tar.zst>")
+		os.Exit(1)
+	}
+	fname := c.Args()[0]
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Println("Could not open archive:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(fname, ".zst") {
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			fmt.Println("Could not decompress archive:", err)
+			os.Exit(1)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	ac := connectStoreAdmin(c)
+	verifyChain := c.Bool("verify-chain")
+	loaded := 0
+	skipped := []string{}
+	batch := [][]byte{}
+	seqs := []uint64{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		l, s, err := ac.importStore(batch, seqs, verifyChain)
+		if err != nil {
+			return err
+		}
+		loaded += l
+		skipped = append(skipped, s...)
+		batch = batch[:0]
+		seqs = seqs[:0]
+		return nil
+	}
+	err = store.ReadArchive(r, func(topic string, body []byte, seq uint64) error {
+		batch = append(batch, body)
+		seqs = append(seqs, seq)
+		if len(batch) < storePageSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		fmt.Println("Import failed:", err)
+		fmt.Printf("Imported %d messages before the failure\n", loaded)
+		os.Exit(1)
+	}
+	for _, s := range skipped {
+		fmt.Println("skipped", s)
+	}
+	fmt.Printf("Imported %d messages", loaded)
+	if len(skipped) != 0 {
+		fmt.Printf(", skipped %d", len(skipped))
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"github.com/urfave/cli"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//Longer binary payloads are truncated when printed as text
+const maxHexBytes = 64
+
+//poFilter is a --podf dot form with an optional /mask
+type poFilter struct {
+	ponum int
+	mask  int
+}
+
+func parsePOFilters(dfs []string) ([]poFilter, error) {
+	rv := []poFilter{}
+	for _, df := range dfs {
+		parts := strings.SplitN(df, "/", 2)
+		f := poFilter{mask: 32}
+		if len(parts) == 2 {
+			var err error
+			f.mask, err = strconv.Atoi(parts[1])
+			if err != nil || f.mask < 0 || f.mask > 32 {
+				return nil, fmt.Errorf("bad mask in %q", df)
+			}
+		}
+		ponum, err := advpo.PONumFromDotForm(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad dot form %q", df)
+		}
+		f.ponum = ponum
+		rv = append(rv, f)
+	}
+	return rv, nil
+}
+
+func (f poFilter) matches(ponum int) bool {
+	return ponum>>uint(32-f.mask) == f.ponum>>uint(32-f.mask)
+}
+
+//decodedPO is a payload object decoded as far as its type allows
+type decodedPO struct {
+	PONum string      `json:"ponum"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+//decodedMessage is what tail and query print for a message
+type decodedMessage struct {
+	Received  time.Time   `json:"received"`
+	URI       string      `json:"uri"`
+	From      string      `json:"from"`
+	FromAlias string      `json:"fromalias,omitempty"`
+	POs       []decodedPO `json:"pos"`
+}
+
+//jsonable converts the maps made by the msgpack decoder, which JSON cannot
+//encode
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		rv := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			rv[fmt.Sprint(k)] = jsonable(e)
+		}
+		return rv
+	case map[string]interface{}:
+		rv := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			rv[k] = jsonable(e)
+		}
+		return rv
+	case []interface{}:
+		rv := make([]interface{}, len(v))
+		for i, e := range v {
+			rv[i] = jsonable(e)
+		}
+		return rv
+	}
+	return v
+}
+
+func decodePO(po objects.PayloadObject) decodedPO {
+	rv := decodedPO{PONum: advpo.PONumDotForm(po.GetPONum())}
+	apo, err := advpo.LoadPayloadObject(po.GetPONum(), po.GetContent())
+	if err != nil {
+		apo = advpo.CreateBasePayloadObject(po.GetPONum(), po.GetContent())
+	}
+	switch p := apo.(type) {
+	case *advpo.MetadataPayloadObjectImpl:
+		mt := advpo.MetadataTuple{}
+		if err := msgpack.Unmarshal(p.GetContent(), &mt); err == nil {
+			rv.Type = "metadata"
+			rv.Value = map[string]interface{}{
+				"value": mt.Value,
+				"time":  mt.Time().Format(time.RFC3339),
+			}
+			return rv
+		}
+	case *advpo.MsgPackPayloadObjectImpl:
+		var v interface{}
+		if err := msgpack.Unmarshal(p.GetContent(), &v); err == nil {
+			rv.Type = "msgpack"
+			rv.Value = jsonable(v)
+			return rv
+		}
+	case *advpo.YAMLPayloadObjectImpl:
+		rv.Type = "yaml"
+		rv.Value = p.Value()
+		return rv
+	case *advpo.TextPayloadObjectImpl:
+		rv.Type = "text"
+		rv.Value = p.Value()
+		return rv
+	}
+	rv.Type = "binary"
+	rv.Value = hex.EncodeToString(po.GetContent())
+	return rv
+}
+
+const chunkReassemblyLimit = 256 * 1024 * 1024
+const chunkReassemblyTimeout = 5 * time.Minute
+
+//messagePrinter decodes and prints messages, looking up the alias of each
+//sender once. The lookups use their own connection, as the results may be
+//queued behind messages on the subscription's connection
+type messagePrinter struct {
+	ac      *agentConn
+	filters []poFilter
+	json    bool
+	aliases map[string]string
+	//Reassembles payloads published as chunk POs
+	chunks *objects.Reassembler
+}
+
+func (p *messagePrinter) alias(vk string) string {
+	if a, ok := p.aliases[vk]; ok {
+		return a
+	}
+	a := ""
+	if rawvk, err := crypto.UnFmtKey(vk); err == nil {
+		a, _ = p.ac.unresolveAlias(rawvk)
+	}
+	p.aliases[vk] = a
+	return a
+}
+
+//print prints a result frame from an unpacked subscribe or query. It
+//returns false if no payload object passed the filters
+func (p *messagePrinter) print(r *objects.Frame) bool {
+	dm := decodedMessage{Received: time.Now(), POs: []decodedPO{}}
+	dm.URI, _ = r.GetFirstHeader("uri")
+	dm.From, _ = r.GetFirstHeader("from")
+	chunked := false
+	for _, po := range r.GetAllPOs() {
+		if po.GetPONum() == objects.PONumChunk {
+			chunked = true
+			whole, err := p.chunks.Add(po)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "dropped chunk:", err)
+			}
+			if whole == nil {
+				continue
+			}
+			po = whole
+		}
+		if len(p.filters) != 0 {
+			match := false
+			for _, f := range p.filters {
+				if f.matches(po.GetPONum()) {
+					match = true
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		dm.POs = append(dm.POs, decodePO(po))
+	}
+	if (len(p.filters) != 0 || chunked) && len(dm.POs) == 0 {
+		return false
+	}
+	if dm.From != "" {
+		dm.FromAlias = p.alias(dm.From)
+	}
+	if p.json {
+		b, err := json.Marshal(&dm)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not encode message:", err)
+			return true
+		}
+		fmt.Println(string(b))
+		return true
+	}
+	fmt.Printf("%s %s\n", dm.Received.Format("2006-01-02 15:04:05.000"), dm.URI)
+	if dm.FromAlias != "" {
+		fmt.Printf("  from %s (%s)\n", dm.From, dm.FromAlias)
+	} else {
+		fmt.Printf("  from %s\n", dm.From)
+	}
+	for _, po := range dm.POs {
+		var val string
+		switch po.Type {
+		case "text", "yaml":
+			val = strings.Replace(strings.TrimRight(po.Value.(string), "\n"), "\n", "\n    ", -1)
+		case "binary":
+			s := po.Value.(string)
+			val = fmt.Sprintf("%d bytes", len(s)/2)
+			if len(s) > 2*maxHexBytes {
+				s = s[:2*maxHexBytes] + "..."
+			}
+			if s != "" {
+				val += " " + s
+			}
+		default:
+			b, _ := json.Marshal(po.Value)
+			val = string(b)
+		}
+		fmt.Printf("  PO %s %s: %s\n", po.PONum, po.Type, val)
+	}
+	return true
+}
+
+//streamMessages subscribes to or queries the URIs given as arguments and
+//prints the messages. Subscriptions never end
+func streamMessages(c *cli.Context, cmd string) error {
+	if len(c.Args()) == 0 {
+		fmt.Printf("Usage: bw2 %s -e entity <uri>...\n", c.Command.Name)
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	for _, uri := range c.Args() {
+		checkURIOrExit(uri)
+	}
+	filters, err := parsePOFilters(c.StringSlice("podf"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	p := &messagePrinter{
+		ac:      connectAgentOrExit(c),
+		filters: filters,
+		json:    c.Bool("json"),
+		aliases: make(map[string]string),
+		chunks:  objects.NewReassembler(chunkReassemblyLimit, chunkReassemblyTimeout),
+	}
+	msgs := make(chan *objects.Frame, 16)
+	wg := sync.WaitGroup{}
+	for _, uri := range c.Args() {
+		f := ac.newFrame(cmd)
+		f.AddHeader("uri", uri)
+		f.AddHeader("autochain", "true")
+		f.AddHeader("unpack", "true")
+		if cmd == objects.CmdSubscribe || cmd == objects.CmdTapSubscribe {
+			addSubscriptionFilter(c, f)
+		}
+		results, err := ac.stream(f)
+		if err != nil {
+			fmt.Printf("Could not %s %s: %v\n", c.Command.Name, uri, err)
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func() {
+			for r := range results {
+				msgs <- r
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(msgs)
+	}()
+	count := 0
+	for r := range msgs {
+		if p.print(r) {
+			count++
+		}
+	}
+	if (cmd == objects.CmdQuery || cmd == objects.CmdTapQuery) && !p.json {
+		fmt.Printf("%d messages\n", count)
+	}
+	return nil
+}
+
+//tail -e entity [--podf df] [--json] [--tap] uri uri uri
+func actionTail(c *cli.Context) error {
+	if c.Bool("tap") {
+		return streamMessages(c, objects.CmdTapSubscribe)
+	}
+	return streamMessages(c, objects.CmdSubscribe)
+}
+
+func actionQuery(c *cli.Context) error {
+	if c.Bool("tap") {
+		return streamMessages(c, objects.CmdTapQuery)
+	}
+	return streamMessages(c, objects.CmdQuery)
+}
+
+//addSubscriptionFilter adds the filter kvs for tail's --only, --where and
+//--maxsize, which the router evaluates before delivering each message
+func addSubscriptionFilter(c *cli.Context, f *objects.Frame) {
+	for _, df := range c.StringSlice("only") {
+		f.AddHeader("filter_ponum", df)
+	}
+	for _, kv := range c.StringSlice("where") {
+		f.AddHeader("filter_field", kv)
+	}
+	if c.Int("maxsize") > 0 {
+		f.AddHeader("filter_maxsize", strconv.Itoa(c.Int("maxsize")))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+//mktemp -e <entity> [-x perms] [--life 1h] [--revoke-after d|never] <uri>
+//Mints a temporary credential and writes its key and chain to files, to be
+//handed to an ephemeral workload
+func actionMkTemp(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 mktemp -e <entity> [-x <perms>] [--life <duration>] <uri>")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the entity to grant from (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	dmsg := make(chan string, 1)
+	var tc *tempCredential
+	go func() {
+		var err error
+		tc, err = ac.mintTempCredential(c.Args()[0], c.String("permissions"), c.String("life"),
+			c.String("revoke-after"), c.String("comment"))
+		if err != nil {
+			dmsg <- "Could not mint the credential: " + chainErrString(err)
+			return
+		}
+		dmsg <- "Published entity " + crypto.FmtKey(tc.entity.GetVK()) + " and DOT " + crypto.FmtHash(tc.dot.GetHash())
+	}()
+	doChainOp(ac, dmsg)
+	if tc == nil {
+		os.Exit(1)
+	}
+	writeEntityKeyFile(tc.entity, c.String("outfile"))
+	fname := c.String("chainfile")
+	if fname == "" {
+		fname = "." + crypto.FmtKey(tc.entity.GetVK()) + ".chain"
+	}
+	wrapped := make([]byte, len(tc.chain.GetContent())+1)
+	copy(wrapped[1:], tc.chain.GetContent())
+	wrapped[0] = objects.ROAccessDChain
+	if err := ioutil.WriteFile(fname, wrapped, 0666); err != nil {
+		fmt.Println("could not write chain to", fname, ":", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("wrote chain to file", fname)
+	fmt.Println("Expires:", tc.expires)
+	if tc.revokeAt != "" {
+		fmt.Println("Revoked by the router at:", tc.revokeAt)
+	} else {
+		fmt.Println("Not revoked, it will expire")
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/immesys/bw2/api"
+	"github.com/mgutz/ansi"
+	"github.com/urfave/cli"
+)
+
+//How many topics to ask the router for, so that the busiest right now are
+//among them even if others have more messages in total
+const topTopicPool = 200
+
+//topRate is the traffic on a namespace or topic between two snapshots
+type topRate struct {
+	uri      string
+	messages float64
+	bytes    float64
+}
+
+//trafficRates returns the rates of the traffic in cur since prev, busiest
+//first. Namespaces or topics that are new in cur are counted from zero
+func trafficRates(prev, cur []api.RouterTrafficInfo, secs float64) []topRate {
+	before := make(map[string]api.RouterTrafficInfo, len(prev))
+	for _, t := range prev {
+		before[t.URI] = t
+	}
+	rv := make([]topRate, 0, len(cur))
+	for _, t := range cur {
+		b := before[t.URI]
+		if t.Messages < b.Messages {
+			//It was forgotten and counted again
+			b = api.RouterTrafficInfo{}
+		}
+		rv = append(rv, topRate{
+			uri:      t.URI,
+			messages: float64(t.Messages-b.Messages) / secs,
+			bytes:    float64(t.Bytes-b.Bytes) / secs,
+		})
+	}
+	sort.Sort(ratesByMessages(rv))
+	return rv
+}
+
+type ratesByMessages []topRate
+
+func (s ratesByMessages) Len() int      { return len(s) }
+func (s ratesByMessages) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ratesByMessages) Less(i, j int) bool {
+	if s[i].messages != s[j].messages {
+		return s[i].messages > s[j].messages
+	}
+	return s[i].uri < s[j].uri
+}
+
+//fmtBytes formats a byte count with a binary unit
+func fmtBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", b, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", b, units[i])
+}
+
+//renderTop draws one screen of bw2 top. prev is nil for the first
+func renderTop(prev, cur *api.RouterStats, rows int) string {
+	heading := ansi.ColorFunc("white+b")
+	var b bytes.Buffer
+	secs := 1.0
+	if prev != nil {
+		secs = float64(cur.Time-prev.Time) / float64(time.Second)
+		if secs <= 0 {
+			secs = 1
+		}
+	} else {
+		//Rates are shown from the second snapshot
+		prev = cur
+	}
+	fmt.Fprintf(&b, "%s %s %s\n", heading("bw2 top"), cur.Info.VK, time.Unix(0, cur.Time).Format("15:04:05"))
+	fmt.Fprintf(&b, "version %s, %d clients, %d subscriptions, %d peers connected\n",
+		cur.Info.Version, cur.Clients, cur.Subscriptions, len(cur.Peers))
+	behind := ""
+	if cur.Chain.Highest > cur.Chain.Height {
+		behind = fmt.Sprintf(" (%d behind)", cur.Chain.Highest-cur.Chain.Height)
+	}
+	fmt.Fprintf(&b, "chain height %d of %d%s, %d chain peers\n\n", cur.Chain.Height, cur.Chain.Highest, behind, cur.Chain.Peers)
+
+	fmt.Fprintln(&b, heading(fmt.Sprintf("%-44s %10s %12s", "NAMESPACE", "MSG/S", "BYTES/S")))
+	for i, r := range trafficRates(prev.Namespaces, cur.Namespaces, secs) {
+		if i == rows {
+			break
+		}
+		fmt.Fprintf(&b, "%-44s %10.1f %12s\n", r.uri, r.messages, fmtBytes(r.bytes)+"/s")
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, heading(fmt.Sprintf("%-60s %10s %12s", "URI", "MSG/S", "BYTES/S")))
+	for i, r := range trafficRates(prev.Topics, cur.Topics, secs) {
+		if i == rows {
+			break
+		}
+		uri := r.uri
+		if len(uri) > 60 {
+			uri = "..." + uri[len(uri)-57:]
+		}
+		fmt.Fprintf(&b, "%-60s %10.1f %12s\n", uri, r.messages, fmtBytes(r.bytes)+"/s")
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, heading(fmt.Sprintf("%-30s %-5s %10s %12s %12s %6s", "PEER LINK", "UP", "RTT", "IN/S", "OUT/S", "QUEUE")))
+	prevLinks := make(map[string]api.RouterPeerLinkInfo)
+	for _, l := range prev.PeerLinks {
+		prevLinks[l.Address] = l
+	}
+	for _, l := range cur.PeerLinks {
+		p, ok := prevLinks[l.Address]
+		if !ok || l.BytesIn < p.BytesIn || l.BytesOut < p.BytesOut {
+			p = l
+		}
+		up := "no"
+		if l.Connected {
+			up = "yes"
+		}
+		fmt.Fprintf(&b, "%-30s %-5s %10s %12s %12s %6d\n", l.Address, up,
+			time.Duration(l.RTT)/time.Millisecond*time.Millisecond,
+			fmtBytes(float64(l.BytesIn-p.BytesIn)/secs)+"/s",
+			fmtBytes(float64(l.BytesOut-p.BytesOut)/secs)+"/s",
+			l.Outstanding)
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, heading(fmt.Sprintf("%-8s %12s %10s %10s", "CACHE", "SIZE", "HIT RATE", "NOW")))
+	names := make([]string, 0, len(cur.Caches))
+	for name := range cur.Caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, p := cur.Caches[name], prev.Caches[name]
+		now := "-"
+		if lookups := (c.Hits - p.Hits) + (c.Misses - p.Misses); lookups > 0 && c.Hits >= p.Hits && c.Misses >= p.Misses {
+			now = fmt.Sprintf("%.1f%%", 100*float64(c.Hits-p.Hits)/float64(lookups))
+		}
+		total := "-"
+		if c.Hits+c.Misses > 0 {
+			total = fmt.Sprintf("%.1f%%", 100*float64(c.Hits)/float64(c.Hits+c.Misses))
+		}
+		fmt.Fprintf(&b, "%-8s %12s %10s %10s\n", name, fmt.Sprintf("%d/%d", c.Size, c.Max), total, now)
+	}
+	return b.String()
+}
+
+func actionTop(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify the router entity or a client admin (-e)")
+		os.Exit(1)
+	}
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	interval := c.Duration("interval")
+	if interval <= 0 {
+		fmt.Println("The interval must be positive")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+	var prev *api.RouterStats
+	for {
+		cur, err := ac.routerStats(topTopicPool)
+		if err != nil {
+			fmt.Println("Could not get router stats:", err)
+			os.Exit(1)
+		}
+		//Clear the screen and draw from the top left
+		fmt.Print("\033[H\033[2J" + renderTop(prev, cur, c.Int("rows")))
+		prev = cur
+		time.Sleep(interval)
+	}
+}
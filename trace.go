@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+//traceHop is a kv(trace_hop) from an unpacked result
+type traceHop struct {
+	vk     string
+	time   time.Time
+	queued time.Duration
+}
+
+func parseTraceHop(s string) (traceHop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return traceHop{}, fmt.Errorf("bad trace hop %q", s)
+	}
+	t, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return traceHop{}, fmt.Errorf("bad trace hop %q", s)
+	}
+	q, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return traceHop{}, fmt.Errorf("bad trace hop %q", s)
+	}
+	return traceHop{vk: parts[0], time: time.Unix(0, t), queued: time.Duration(q)}, nil
+}
+
+//trace -e entity [--wait d] uri
+func actionTrace(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 trace -e entity <uri>")
+		os.Exit(1)
+	}
+	if c.String("entity") == "" {
+		fmt.Println("You need to specify an entity to be (-e)")
+		os.Exit(1)
+	}
+	uri := c.Args()[0]
+	e := getAvailableEntity(c, c.String("entity"))
+	if e == nil {
+		fmt.Println("Could not load entity")
+		os.Exit(1)
+	}
+	ac := connectAgentOrExit(c)
+	ac.setEntityOrExit(e.GetSigningBlob())
+
+	//The probe carries a nonce so that it can be told apart from other
+	//messages on the URI
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	probe := "bw2 trace " + hex.EncodeToString(nonce)
+
+	f := ac.newFrame(objects.CmdSubscribe)
+	f.AddHeader("uri", uri)
+	f.AddHeader("autochain", "true")
+	f.AddHeader("unpack", "true")
+	results, err := ac.stream(f)
+	if err != nil {
+		fmt.Printf("Could not subscribe to %s: %v\n", uri, err)
+		os.Exit(1)
+	}
+
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumString, []byte(probe))
+	f = ac.newFrame(objects.CmdPublish)
+	f.AddHeader("uri", uri)
+	f.AddHeader("autochain", "true")
+	f.AddHeader("trace", "true")
+	f.AddPayloadObject(po)
+	sent := time.Now()
+	if _, err := ac.transact(f); err != nil {
+		fmt.Printf("Could not publish the probe: %v\n", err)
+		os.Exit(1)
+	}
+
+	timeout := time.After(c.Duration("wait"))
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				fmt.Println("The subscription ended before the probe arrived")
+				os.Exit(1)
+			}
+			match := false
+			for _, po := range r.GetAllPOs() {
+				if po.GetPONum() == objects.PONumString && string(po.GetContent()) == probe {
+					match = true
+				}
+			}
+			if !match {
+				continue
+			}
+			recvd := time.Now()
+			//The alias lookups use their own connection, as the subscription is
+			//no longer being read
+			printTrace(connectAgentOrExit(c), r, sent, recvd)
+			return nil
+		case <-timeout:
+			fmt.Printf("The probe did not arrive within %s\n", c.Duration("wait"))
+			os.Exit(1)
+		}
+	}
+}
+
+func printTrace(ac *agentConn, r *objects.Frame, sent time.Time, recvd time.Time) {
+	hops := []traceHop{}
+	for _, h := range r.GetAllHeaders("trace_hop") {
+		th, err := parseTraceHop(h)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		hops = append(hops, th)
+	}
+	if len(hops) == 0 {
+		fmt.Println("The probe arrived with no hops. The routers may not support tracing")
+	}
+	for i, h := range hops {
+		name := h.vk
+		if rawvk, err := crypto.UnFmtKey(h.vk); err == nil {
+			if alias, _ := ac.unresolveAlias(rawvk); alias != "" {
+				name += " (" + alias + ")"
+			}
+		}
+		fmt.Printf("%2d  %s\n", i+1, name)
+		fmt.Printf("    +%-12s queued %s\n", h.time.Sub(sent), h.queued)
+	}
+	fmt.Printf("Round trip %s\n", recvd.Sub(sent))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+)
+
+//getTxSigner loads the signing entity that pays for a transaction. This
+//must work without an agent
+func getTxSigner(c *cli.Context) *objects.Entity {
+	if c.String("bankroll") == "" {
+		fmt.Println("No bankroll entity specified")
+		os.Exit(1)
+	}
+	enti, ok := getEntityParam(nil, c, c.String("bankroll"), true)
+	if !ok {
+		fmt.Printf("Could not load bankroll entity '%s'\n", c.String("bankroll"))
+		os.Exit(1)
+	}
+	return enti.(*objects.Entity)
+}
+
+func parseBigFlag(c *cli.Context, name string) *big.Int {
+	if c.String(name) == "" {
+		return nil
+	}
+	rv, ok := new(big.Int).SetString(c.String(name), 10)
+	if !ok || rv.Sign() < 0 {
+		fmt.Printf("Invalid --%s: %s\n", name, c.String(name))
+		os.Exit(1)
+	}
+	return rv
+}
+
+func actionTxParams(c *cli.Context) error {
+	signer := getTxSigner(c)
+	addr, err := bc.EntityAccountAddress(signer, c.Int("accountnum"))
+	if err != nil {
+		fmt.Println("Could not get account address:", err)
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	nsvk := ""
+	if c.String("ns") != "" {
+		nsvk, _ = getEntityParamVK(ac, c, c.String("ns"))
+	}
+	otx, nsnonce, err := ac.txParams(addr.Hex(), nsvk)
+	if err != nil {
+		fmt.Println("Could not get transaction params:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Params for account %d (%s):\n", c.Int("accountnum"), addr.Hex())
+	fmt.Printf("  --nonce %d --gasprice %s", otx.Nonce, otx.GasPrice.Text(10))
+	if otx.ChainID != nil {
+		fmt.Printf(" --chainid %s", otx.ChainID.Text(10))
+	}
+	if nsnonce != nil {
+		fmt.Printf(" --nsnonce %s", nsnonce.Text(10))
+	}
+	fmt.Println()
+	return nil
+}
+
+func actionTxSign(c *cli.Context) error {
+	outfile := c.String("outfile")
+	if outfile == "" {
+		fmt.Println("You need to specify an --outfile for the signed transaction")
+		os.Exit(1)
+	}
+	signer := getTxSigner(c)
+	acc := c.Int("accountnum")
+	addr, err := bc.EntityAccountAddress(signer, acc)
+	if err != nil {
+		fmt.Println("Could not get account address:", err)
+		os.Exit(1)
+	}
+
+	ops := 0
+	for _, op := range []string{"entity", "dot", "long", "dr"} {
+		if c.String(op) != "" {
+			ops++
+		}
+	}
+	if ops != 1 {
+		fmt.Println("You need to specify exactly one of --entity, --dot, --long or --dr")
+		os.Exit(1)
+	}
+
+	//The namespace accepting a DR offer must be available locally, as it
+	//signs the acceptance
+	var ns *objects.Entity
+	var drvk []byte
+	if c.String("dr") != "" {
+		ns = getAvailableEntity(c, c.String("ns"))
+		if ns == nil {
+			fmt.Println("Could not load 'ns' entity")
+			os.Exit(1)
+		}
+		drvk, err = crypto.UnFmtKey(c.String("dr"))
+		if err != nil {
+			fmt.Println("--dr must be a VK:", err)
+			os.Exit(1)
+		}
+	}
+
+	otx := &bc.OfflineTx{}
+	var nsnonce *big.Int
+	if !c.Bool("offline") {
+		bw2bind.SilenceLog()
+		ac := connectAgentOrExit(c)
+		nsvk := ""
+		if ns != nil {
+			nsvk = crypto.FmtKey(ns.GetVK())
+		}
+		otx, nsnonce, err = ac.txParams(addr.Hex(), nsvk)
+		if err != nil {
+			fmt.Println("Could not get transaction params:", err)
+			os.Exit(1)
+		}
+	}
+	if c.String("nonce") != "" {
+		otx.Nonce, err = strconv.ParseUint(c.String("nonce"), 10, 64)
+		if err != nil {
+			fmt.Println("Invalid --nonce:", err)
+			os.Exit(1)
+		}
+	} else if c.Bool("offline") {
+		fmt.Println("Offline signing needs --nonce (see 'bw2 tx params')")
+		os.Exit(1)
+	}
+	if v := parseBigFlag(c, "gasprice"); v != nil {
+		otx.GasPrice = v
+	} else if c.Bool("offline") {
+		fmt.Println("Offline signing needs --gasprice (see 'bw2 tx params')")
+		os.Exit(1)
+	}
+	if v := parseBigFlag(c, "chainid"); v != nil {
+		otx.ChainID = v
+	}
+	otx.Gas = parseBigFlag(c, "gas")
+	if v := parseBigFlag(c, "nsnonce"); v != nil {
+		nsnonce = v
+	} else if ns != nil && nsnonce == nil {
+		fmt.Println("Offline DR acceptance needs --nsnonce (see 'bw2 tx params --ns')")
+		os.Exit(1)
+	}
+
+	var call *bc.OfflineCall
+	var desc string
+	switch {
+	case c.String("entity") != "":
+		contents, err := ioutil.ReadFile(c.String("entity"))
+		if err != nil {
+			fmt.Println("Could not read entity:", err)
+			os.Exit(1)
+		}
+		kf, err := decodeKeyFile(contents)
+		if err != nil {
+			fmt.Println("Could not decode entity:", err)
+			os.Exit(1)
+		}
+		enti, err := objects.NewEntity(kf.RONum, kf.Content)
+		if err != nil {
+			fmt.Println("Could not decode entity:", err)
+			os.Exit(1)
+		}
+		ent := enti.(*objects.Entity)
+		call = bc.PublishEntityCall(ent)
+		desc = "publish entity " + crypto.FmtKey(ent.GetVK())
+	case c.String("dot") != "":
+		contents, err := ioutil.ReadFile(c.String("dot"))
+		if err != nil {
+			fmt.Println("Could not read DOT:", err)
+			os.Exit(1)
+		}
+		kf, err := decodeKeyFile(contents)
+		if err != nil {
+			fmt.Println("Could not decode DOT:", err)
+			os.Exit(1)
+		}
+		doti, err := objects.NewDOT(kf.RONum, kf.Content)
+		if err != nil {
+			fmt.Println("Could not decode DOT:", err)
+			os.Exit(1)
+		}
+		dot := doti.(*objects.DOT)
+		call = bc.PublishDOTCall(dot)
+		desc = "publish DOT " + crypto.FmtHash(dot.GetHash())
+	case c.String("long") != "":
+		key := []byte(c.String("long"))
+		if len(key) > 32 {
+			fmt.Println("Alias key cannot be longer than 32 bytes")
+			os.Exit(1)
+		}
+		if strings.Contains(string(key), "@") {
+			fmt.Println("Alias key cannot contain '@'")
+			os.Exit(1)
+		}
+		call = bc.SetAliasCall(bc.SliceToBytes32(key), bc.SliceToBytes32(getAliasValue(c)), otx.GasPrice)
+		desc = "create alias " + c.String("long")
+	case c.String("dr") != "":
+		call = bc.AcceptRoutingOfferCall(ns, drvk, nsnonce)
+		desc = "accept DR offer from " + c.String("dr")
+	}
+
+	raw, txhash, err := bc.SignOffline(signer, acc, call, otx)
+	if err != nil {
+		fmt.Println("Could not sign transaction:", err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(outfile, []byte(hex.EncodeToString(raw)+"\n"), 0600)
+	if err != nil {
+		fmt.Println("Could not write transaction:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signed transaction to %s\n  from: %s (account %d)\n nonce: %d\n    tx: %s\nwritten to %s\n",
+		desc, addr.Hex(), acc, otx.Nonce, txhash.Hex(), outfile)
+	return nil
+}
+
+func actionTxSend(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("Usage: bw2 tx send <file>")
+		os.Exit(1)
+	}
+	contents, err := ioutil.ReadFile(c.Args()[0])
+	if err != nil {
+		fmt.Println("Could not read transaction:", err)
+		os.Exit(1)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		fmt.Println("Could not decode transaction:", err)
+		os.Exit(1)
+	}
+	tx, err := bc.DecodeRawTransaction(raw)
+	if err != nil {
+		fmt.Println("Invalid transaction:", err)
+		os.Exit(1)
+	}
+	bw2bind.SilenceLog()
+	ac := connectAgentOrExit(c)
+	fmt.Printf("Broadcasting transaction %s (nonce %d)\n", tx.Hash().Hex(), tx.Nonce())
+	dchan := make(chan string, 1)
+	go func() {
+		res, err := ac.sendRawTx(raw)
+		if err == nil {
+			dchan <- "Transaction confirmed: " + res.String()
+		} else {
+			dchan <- "Transaction failed: " + chainErrString(err)
+		}
+	}()
+	doChainOp(ac, dchan)
+	return nil
+}
@@ -0,0 +1,201 @@
+package bwe
+
+import "fmt"
+
+//Code is a status code as an error value, for use as a sentinel:
+//errors.Is(err, bwe.Code(bwe.BadURI)) is true if err is, or wraps, a
+//status with that code
+type Code int
+
+func (c Code) Error() string {
+	return fmt.Sprintf("[%03d] %s", int(c), Name(int(c)))
+}
+
+//Class is what kind of failure a status code is. Like Code it is an
+//error, so errors.Is(err, bwe.ClassChain) is true for any chain
+//interaction failure
+type Class int
+
+const (
+	//Okay codes, and codes not in the table
+	ClassNone Class = iota
+	//The chain, or something in it, does not authorise the operation
+	ClassAuthorization
+	//The request itself is bad, and sending it again will not help
+	ClassRequest
+	//A peer, view or chain build failed underneath the operation
+	ClassPeer
+	//A limit was hit, or the router is going away. Later may work
+	ClassLimit
+	//The 500 series, interacting with the block chain
+	ClassChain
+)
+
+var classNames = []string{"none", "authorization", "request", "peer", "limit", "chain"}
+
+func (c Class) String() string {
+	if c < 0 || int(c) >= len(classNames) {
+		return "none"
+	}
+	return classNames[c]
+}
+
+func (c Class) Error() string {
+	return c.String() + " error"
+}
+
+//CodeInfo describes a status code
+type CodeInfo struct {
+	Name  string
+	Class Class
+	//What the code means to a user, or what they can do about it. Empty
+	//if the message says it all
+	Hint string
+}
+
+//Codes is every status code. The codes are sent as they are on the wire,
+//kv(code) in an OOB response with status "error", and the OOB adapter sends
+//the class name alongside as kv(class)
+var Codes = map[int]CodeInfo{
+	Unchecked:      {"Unchecked", ClassNone, ""},
+	Okay:           {"Okay", ClassNone, ""},
+	OkayAsResolved: {"OkayAsResolved", ClassNone, ""},
+
+	Unresolvable:       {"Unresolvable", ClassAuthorization, "a DOT or entity in the chain is not in the registry"},
+	InvalidDOT:         {"InvalidDOT", ClassAuthorization, "a DOT in the chain is malformed or badly signed"},
+	InvalidSig:         {"InvalidSig", ClassAuthorization, "a signature does not verify"},
+	TTLExpired:         {"TTLExpired", ClassAuthorization, "the chain is longer than the TTL of one of its DOTs allows"},
+	BadPermissions:     {"BadPermissions", ClassAuthorization, "the chain does not grant the permissions the operation needs"},
+	OriginVKMismatch:   {"OriginVKMismatch", ClassAuthorization, "the message did not come from the entity it names"},
+	NoOrigin:           {"NoOrigin", ClassAuthorization, "the message has no origin VK"},
+	MVKMismatch:        {"MVKMismatch", ClassAuthorization, "the chain is for a different namespace"},
+	ExpiredDOT:         {"ExpiredDOT", ClassAuthorization, "a DOT in the chain has expired, so a new chain is needed"},
+	ExpiredEntity:      {"ExpiredEntity", ClassAuthorization, "an entity in the chain has expired"},
+	RevokedDOT:         {"RevokedDOT", ClassAuthorization, "a DOT in the chain has been revoked, so a new chain is needed"},
+	RevokedEntity:      {"RevokedEntity", ClassAuthorization, "an entity in the chain has been revoked"},
+	ChainOriginNotMVK:  {"ChainOriginNotMVK", ClassAuthorization, "the chain does not start at the namespace"},
+	InvalidEntity:      {"InvalidEntity", ClassAuthorization, "an entity is malformed or badly signed"},
+	NotAccessRO:        {"NotAccessRO", ClassAuthorization, "a permission DOT was used where an access DOT is needed"},
+	BadLink:            {"BadLink", ClassAuthorization, "a DOT in the chain is not from the entity the previous one is to"},
+	OverconstrainedURI: {"OverconstrainedURI", ClassAuthorization, "the DOTs in the chain do not grant on a common URI"},
+	ExpiredMessage:     {"ExpiredMessage", ClassAuthorization, "the message expired before it was delivered"},
+	InvalidRevocation:  {"InvalidRevocation", ClassAuthorization, "the revocation is not from an authority for its target"},
+	ClockSkewSuspected: {"ClockSkewSuspected", ClassAuthorization, "this router's clock may be ahead, check it"},
+
+	BadURI:              {"BadURI", ClassRequest, ""},
+	BadOperation:        {"BadOperation", ClassRequest, ""},
+	MalformedMessage:    {"MalformedMessage", ClassRequest, ""},
+	NoEntity:            {"NoEntity", ClassRequest, "set an entity first"},
+	InvalidOOBCommand:   {"InvalidOOBCommand", ClassRequest, ""},
+	MalformedOOBCommand: {"MalformedOOBCommand", ClassRequest, ""},
+	InvalidCoding:       {"InvalidCoding", ClassRequest, ""},
+	BadChainBuildParams: {"BadChainBuildParams", ClassRequest, ""},
+	InvalidSlice:        {"InvalidSlice", ClassRequest, ""},
+	BadView:             {"BadView", ClassRequest, ""},
+	InvalidPayload:      {"InvalidPayload", ClassRequest, ""},
+	MessageTooLarge:     {"MessageTooLarge", ClassRequest, "large payloads must be sent in chunks"},
+
+	AffinityMismatch: {"AffinityMismatch", ClassPeer, "the router is not the designated router for the namespace"},
+	PeerError:        {"PeerError", ClassPeer, ""},
+	ChainBuildFailed: {"ChainBuildFailed", ClassPeer, "no chain grants the permissions, check the DOTs with bw2 inspect"},
+	ResolutionFailed: {"ResolutionFailed", ClassPeer, ""},
+	ViewError:        {"ViewError", ClassPeer, ""},
+	UnsubscribeError: {"UnsubscribeError", ClassPeer, ""},
+
+	RateLimited:   {"RateLimited", ClassLimit, "slow down, or use a DOT with a higher limit"},
+	QuotaExceeded: {"QuotaExceeded", ClassLimit, ""},
+	ShuttingDown:  {"ShuttingDown", ClassLimit, "try again on another router or once it has restarted"},
+	CallTimeout:   {"CallTimeout", ClassLimit, "the service may be down"},
+
+	NamespaceQuotaExceeded: {"NamespaceQuotaExceeded", ClassLimit, "the router's [quota] for the namespace is used up"},
+
+	RegistryEntityResolutionFailed: {"RegistryEntityResolutionFailed", ClassChain, ""},
+	RegistryDOTResolutionFailed:    {"RegistryDOTResolutionFailed", ClassChain, ""},
+	RegistryChainResolutionFailed:  {"RegistryChainResolutionFailed", ClassChain, ""},
+	RegistryEntityInvalid:          {"RegistryEntityInvalid", ClassChain, ""},
+	RegistryDOTInvalid:             {"RegistryDOTInvalid", ClassChain, ""},
+	RegistryChainInvalid:           {"RegistryChainInvalid", ClassChain, "the chain's DOTs must be published first"},
+	BlockChainGenericError:         {"BlockChainGenericError", ClassChain, ""},
+	UFIInvocationError:             {"UFIInvocationError", ClassChain, ""},
+	InvalidUFI:                     {"InvalidUFI", ClassChain, ""},
+	InvalidAccountNumber:           {"InvalidAccountNumber", ClassChain, ""},
+	TransactionTimeout:             {"TransactionTimeout", ClassChain, "the transaction may still be mined, try a larger --timeout"},
+	TransactionConfirmationTimeout: {"TransactionConfirmationTimeout", ClassChain, "the transaction was mined but not confirmed in time"},
+	ChainStale:                     {"ChainStale", ClassChain, "the agent is still syncing the chain"},
+	UnresolvedAlias:                {"UnresolvedAlias", ClassChain, ""},
+	AliasExists:                    {"AliasExists", ClassChain, ""},
+	AliasError:                     {"AliasError", ClassChain, ""},
+	NotRevokable:                   {"NotRevokable", ClassChain, "only published objects can be revoked"},
+	GasPriceTooHigh:                {"GasPriceTooHigh", ClassChain, "raise --maxgasprice to allow it"},
+	TransactionNonceTooLow:         {"TransactionNonceTooLow", ClassChain, "another transaction from this account is pending, try again shortly"},
+	TransactionUnderpriced:         {"TransactionUnderpriced", ClassChain, "the gas price was too low, try a higher --maxgasprice"},
+	InsufficientFunds:              {"InsufficientFunds", ClassChain, ""},
+	RegistryProofInvalid:           {"RegistryProofInvalid", ClassChain, "the node that answered may be lying, try another"},
+}
+
+//Name is the name of a status code, or "Unknown"
+func Name(code int) string {
+	if ci, ok := Codes[code]; ok {
+		return ci.Name
+	}
+	return "Unknown"
+}
+
+//ClassOf is the class of a status code. Unknown codes in the 500 series
+//are chain errors, as that series is reserved for them
+func ClassOf(code int) Class {
+	if ci, ok := Codes[code]; ok {
+		return ci.Class
+	}
+	if code >= 500 && code < 600 {
+		return ClassChain
+	}
+	return ClassNone
+}
+
+//Is makes a status match its Code and its Class with errors.Is, and
+//another status with the same code
+func (s *BWStatus) Is(target error) bool {
+	switch t := target.(type) {
+	case Code:
+		return int(t) == s.Code
+	case Class:
+		return t != ClassNone && t == ClassOf(s.Code)
+	case *BWStatus:
+		return t.Code == s.Code
+	}
+	return false
+}
+
+//Find returns the first status in err's chain of wrapped errors, or nil.
+//It is errors.As for statuses, and works with any error that has an
+//Unwrap method
+func Find(err error) *BWStatus {
+	for err != nil {
+		if bws, ok := err.(*BWStatus); ok {
+			return bws
+		}
+		u, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return nil
+		}
+		err = u.Unwrap()
+	}
+	return nil
+}
+
+//Explain says what went wrong for a user: the status's message, followed
+//by the hint for its code, such as which part of a chain failed analysis
+//and what to do about it. Errors without a status are just their message
+func Explain(err error) string {
+	bws := Find(err)
+	if bws == nil {
+		return err.Error()
+	}
+	if hint := Codes[bws.Code].Hint; hint != "" {
+		return bws.Msg + " (" + hint + ")"
+	}
+	return bws.Msg
+}
@@ -0,0 +1,43 @@
+package bwe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	err := fmt.Errorf("building: %w", WrapM(ChainBuildFailed, "no chain", M(ExpiredDOT, "dot expired")))
+	for _, target := range []error{Code(ChainBuildFailed), Code(ExpiredDOT), ClassPeer, ClassAuthorization, C(ExpiredDOT)} {
+		if !errors.Is(err, target) {
+			t.Errorf("%v should match %v", err, target)
+		}
+	}
+	for _, target := range []error{Code(BadURI), ClassChain, ClassNone} {
+		if errors.Is(err, target) {
+			t.Errorf("%v should not match %v", err, target)
+		}
+	}
+	var bws *BWStatus
+	if !errors.As(err, &bws) || bws.Code != ChainBuildFailed || AsBW(err) != bws {
+		t.Errorf("As found %v", bws)
+	}
+	if !errors.Is(WrapC(PeerError, io.EOF), io.EOF) {
+		t.Error("the cause of a wrapped status was lost")
+	}
+}
+
+func TestCodesTable(t *testing.T) {
+	for code, ci := range Codes {
+		if (code >= 500) != (ci.Class == ClassChain) {
+			t.Errorf("%d %s is in class %v", code, ci.Name, ci.Class)
+		}
+	}
+	if ClassOf(599) != ClassChain || Name(599) != "Unknown" {
+		t.Error("unknown 500 series codes should be chain errors")
+	}
+	if got := Explain(M(RevokedDOT, "DOT revoked")); got != "DOT revoked (a DOT in the chain has been revoked, so a new chain is needed)" {
+		t.Errorf("got %q", got)
+	}
+}
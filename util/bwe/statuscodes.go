@@ -14,12 +14,20 @@ import "fmt"
 type BWStatus struct {
 	Code int
 	Msg  string
+	//The error this one wraps, if it was made by WrapC or WrapM
+	cause error
 }
 
 func (s *BWStatus) Error() string {
 	return fmt.Sprintf("[%03d] %s", s.Code, s.Msg)
 }
 
+//Unwrap returns the wrapped error, so that errors.Is and errors.As look
+//through a status to what caused it
+func (s *BWStatus) Unwrap() error {
+	return s.cause
+}
+
 func C(code int) *BWStatus {
 	return &BWStatus{Code: code, Msg: "See code"}
 }
@@ -28,24 +36,25 @@ func M(code int, msg string) *BWStatus {
 }
 
 //This is basically an assert to catch places where we are not
-//properly annotating underlying errors
+//properly annotating underlying errors. A status wrapped by another error
+//that has an Unwrap method is found
 func AsBW(err error) *BWStatus {
-	bwerr, ok := err.(*BWStatus)
-	if !ok {
+	bwerr := Find(err)
+	if bwerr == nil {
 		panic(err)
 	}
 	return bwerr
 }
 
 func WrapC(code int, err error) *BWStatus {
-	return &BWStatus{Code: code, Msg: err.Error()}
+	return &BWStatus{Code: code, Msg: err.Error(), cause: err}
 }
 func WrapM(code int, msg string, err error) *BWStatus {
 	errst := "nil"
 	if err != nil {
 		errst = err.Error()
 	}
-	return &BWStatus{Code: code, Msg: msg + ": " + errst}
+	return &BWStatus{Code: code, Msg: msg + ": " + errst, cause: err}
 }
 
 const (
@@ -109,6 +118,31 @@ const (
 	//The revocation is not an authority for its target
 	InvalidRevocation = 435
 
+	//A payload object failed validation
+	InvalidPayload = 436
+
+	//The origin VK or a DOT in the chain has sent too many messages
+	RateLimited = 437
+
+	//The message is larger than the router's MaxMessageSize
+	MessageTooLarge = 438
+
+	//The client has used up one of its quotas on the agent
+	QuotaExceeded = 439
+
+	//The router is draining or shutting down and takes no new work
+	ShuttingDown = 440
+
+	//Something expired by this router's clock, but a signed timestamp in
+	//the message says the clock is ahead, so it may not have
+	ClockSkewSuspected = 441
+
+	//A call to a slot got no reply with its correlation ID in time
+	CallTimeout = 442
+
+	//The namespace has used up one of its quotas on the designated router
+	NamespaceQuotaExceeded = 443
+
 	//The 500 series are chain interaction errors
 	RegistryEntityResolutionFailed = 500
 	RegistryDOTResolutionFailed    = 501
@@ -137,4 +171,18 @@ const (
 
 	// Returned when you try revoke an unpublished object
 	NotRevokable = 516
+
+	// Returned when a transaction would pay more than the permitted gas price
+	GasPriceTooHigh = 517
+
+	// Returned when a transaction's nonce has already been used, usually
+	// because another transaction from the same account is in flight
+	TransactionNonceTooLow = 518
+	// Returned when the chain rejects a transaction's gas price as too low
+	TransactionUnderpriced = 519
+	// Returned when an account does not hold enough to make a transfer
+	InsufficientFunds = 520
+	// Returned when a registry answer's proof does not check out against
+	// the block header it is for
+	RegistryProofInvalid = 521
 )
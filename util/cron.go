@@ -0,0 +1,143 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//CronSchedule is when a cron expression fires
+type CronSchedule struct {
+	//Bit n is set if the field may be n
+	minute, hour, dom, month, dow uint64
+	//Cron fires on a day that matches either the day of the month or the
+	//day of the week, unless one of them is *
+	domStar, dowStar bool
+	//For @every, the period instead of the fields
+	every time.Duration
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//ParseCron parses a five field cron expression (minute, hour, day of the
+//month, month and day of the week, each of which can be *, a number, a
+//range a-b or a list of them, with an optional /step), one of the macros
+//such as @hourly, or @every followed by a duration such as @every 30s
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || d == nil || *d < time.Second {
+			return nil, fmt.Errorf("@every needs a duration of at least a second")
+		}
+		return &CronSchedule{every: *d}, nil
+	}
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("a cron expression has five fields, not %d", len(fields))
+	}
+	rv := &CronSchedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	dst := [5]*uint64{&rv.minute, &rv.hour, &rv.dom, &rv.month, &rv.dow}
+	names := [5]string{"minute", "hour", "day of the month", "month", "day of the week"}
+	for i, f := range fields {
+		bits, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %v", names[i], f, err)
+		}
+		*dst[i] = bits
+	}
+	//Sunday is 0 or 7
+	if rv.dow&(1<<7) != 0 {
+		rv.dow |= 1
+	}
+	return rv, nil
+}
+
+func parseCronField(f string, min int, max int) (uint64, error) {
+	var rv uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("bad step")
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("%q is not a number", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("%q is not a number", bounds[1])
+				}
+			} else if step != 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			rv |= 1 << uint(v)
+		}
+	}
+	return rv, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+//Next returns the first time after t that the schedule fires, or the zero
+//time if it never does, e.g. for the 31st of February
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every).Truncate(time.Second)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	//Every combination of fields recurs within a few years
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 2, 28, 10, 7, 30, 0, time.UTC)
+	TV := []struct {
+		Expr string
+		Next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 2, 28, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 2, 28, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 2, 28, 11, 0, 0, 0, time.UTC)},
+		{"30 9 * * *", time.Date(2024, 2, 29, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 8-10/2,22 * * 1-5", time.Date(2024, 2, 28, 22, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, 2, 28, 10, 9, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, v := range TV {
+		s, err := ParseCron(v.Expr)
+		if err != nil {
+			t.Fatalf("%q: %v", v.Expr, err)
+		}
+		if n := s.Next(from); !n.Equal(v.Next) {
+			t.Fatalf("%q: next is %v, expected %v", v.Expr, n, v.Next)
+		}
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every 10ms", "@often"} {
+		if _, err := ParseCron(bad); err == nil {
+			t.Fatalf("%q was accepted", bad)
+		}
+	}
+}
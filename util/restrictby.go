@@ -0,0 +1,159 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+//The semantics of RestrictBy. A pattern is a URI suffix in which "+"
+//matches exactly one element and "*" matches zero or more, and which has at
+//most one "*". For patterns from and by, RestrictBy(from, by) returns r,
+//true where:
+// - every URI that r matches is matched by both from and by, so restricting
+//   a permission never grants more than either
+// - it returns false only if no URI is matched by both
+// - RestrictBy(from, by) == RestrictBy(by, from)
+// - RestrictBy(p, p) == p, and RestrictBy(r, from) == r
+// - if at most one of from and by has a "*", r matches every URI both do.
+//   If both have one, matching everything may take two stars, as for a/*
+//   and */b/*/c, and r is the part of that one pattern can express
+//restrictby_test.go checks these against a slow reference matcher
+
+// RestrictBy takes a topic, and a permission, and returns the intersection
+// that represents the from topic restricted by the permission. It took a
+// looong time to work out this logic...
+func RestrictBy(from string, by string) (string, bool) {
+	fp := strings.Split(from, "/")
+	bp := strings.Split(by, "/")
+	fout := make([]string, 0, len(fp)+len(bp))
+	bout := make([]string, 0, len(fp)+len(bp))
+	var fsx, bsx int
+	for fsx = 0; fsx < len(fp) && fp[fsx] != "*"; fsx++ {
+	}
+	for bsx = 0; bsx < len(bp) && bp[bsx] != "*"; bsx++ {
+	}
+	fi, bi := 0, 0
+	fni, bni := len(fp)-1, len(bp)-1
+	emit := func() (string, bool) {
+		for i := 0; i < len(bout); i++ {
+			fout = append(fout, bout[len(bout)-i-1])
+		}
+		return strings.Join(fout, "/"), true
+	}
+	//phase 1
+	//emit matching prefix
+	for ; fi < len(fp) && bi < len(bp); fi, bi = fi+1, bi+1 {
+		if fp[fi] != "*" && (fp[fi] == bp[bi] || (bp[bi] == "+" && fp[fi] != "*")) {
+			fout = append(fout, fp[fi])
+		} else if fp[fi] == "+" && bp[bi] != "*" {
+			fout = append(fout, bp[bi])
+		} else {
+			break
+		}
+	}
+	//phase 2
+	//emit matching suffix
+	for ; fni >= fi && bni >= bi; fni, bni = fni-1, bni-1 {
+		if bp[bni] != "*" && (fp[fni] == bp[bni] || (bp[bni] == "+" && fp[fni] != "*")) {
+			bout = append(bout, fp[fni])
+		} else if fp[fni] == "+" && bp[bni] != "*" {
+			bout = append(bout, bp[bni])
+		} else {
+			break
+		}
+	}
+	//phase 3
+	//emit front
+	if fi < len(fp) && fp[fi] == "*" {
+		for ; bi < len(bp) && bp[bi] != "*" && bi <= bni; bi++ {
+			fout = append(fout, bp[bi])
+		}
+	} else if bi < len(bp) && bp[bi] == "*" {
+		for ; fi < len(fp) && fp[fi] != "*" && fi <= fni; fi++ {
+			fout = append(fout, fp[fi])
+		}
+	}
+	//phase 4
+	//emit back
+	if fni >= 0 && fp[fni] == "*" {
+		for ; bni >= 0 && bp[bni] != "*" && bni >= bi; bni-- {
+			bout = append(bout, bp[bni])
+		}
+	} else if bni >= 0 && bp[bni] == "*" {
+		for ; fni >= 0 && fp[fni] != "*" && fni >= fi; fni-- {
+			bout = append(bout, fp[fni])
+		}
+	}
+	//phase 5
+	//emit star if they both have it
+	if fi == fni && fp[fi] == "*" && bi == bni && bp[bi] == "*" {
+		fout = append(fout, "*")
+		return emit()
+	}
+	//Remove any stars
+	if fi < len(fp) && fp[fi] == "*" {
+		fi++
+	}
+	if bi < len(bp) && bp[bi] == "*" {
+		bi++
+	}
+	if (fi == fni+1 || fi == len(fp)) && (bi == bni+1 || bi == len(bp)) {
+		return emit()
+	}
+	return "", false
+}
+
+//ExplainRestrictBy says why no URI matches both from and by, so that
+//RestrictBy(from, by) is false, or returns "" if some URI does. Elements
+//are numbered from zero
+func ExplainRestrictBy(from string, by string) string {
+	fp := strings.Split(from, "/")
+	bp := strings.Split(by, "/")
+	//The elements before and after the star, or all of them if there is none
+	front := func(p []string) []string {
+		for i, e := range p {
+			if e == "*" {
+				return p[:i]
+			}
+		}
+		return p
+	}
+	back := func(p []string) []string {
+		for i := len(p) - 1; i >= 0; i-- {
+			if p[i] == "*" {
+				return p[i+1:]
+			}
+		}
+		return p
+	}
+	compatible := func(a, b string) bool {
+		return a == b || a == "+" || b == "+"
+	}
+	mismatch := func(fi, bi int) string {
+		return fmt.Sprintf("element %d of %q (%s) does not match element %d of %q (%s)",
+			fi, from, fp[fi], bi, by, bp[bi])
+	}
+	ff, bf := front(fp), front(bp)
+	for i := 0; i < len(ff) && i < len(bf); i++ {
+		if !compatible(ff[i], bf[i]) {
+			return mismatch(i, i)
+		}
+	}
+	fstar, bstar := len(ff) != len(fp), len(bf) != len(bp)
+	switch {
+	case !fstar && !bstar && len(fp) != len(bp):
+		return fmt.Sprintf("%q has %d elements but %q has %d", from, len(fp), by, len(bp))
+	case fstar && !bstar && len(bp) < len(fp)-1:
+		return fmt.Sprintf("%q needs at least %d elements but %q has %d", from, len(fp)-1, by, len(bp))
+	case bstar && !fstar && len(fp) < len(bp)-1:
+		return fmt.Sprintf("%q needs at least %d elements but %q has %d", by, len(bp)-1, from, len(fp))
+	}
+	//Without a star the fronts were the whole patterns
+	fb, bb := back(fp), back(bp)
+	for i := 1; i <= len(fb) && i <= len(bb); i++ {
+		if !compatible(fb[len(fb)-i], bb[len(bb)-i]) {
+			return mismatch(len(fp)-i, len(bp)-i)
+		}
+	}
+	return ""
+}
@@ -2,6 +2,8 @@ package util
 
 import (
 	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -86,3 +88,151 @@ func TestRestrictOrig(t *testing.T) {
 		}
 	}
 }
+
+//refMatch is the reference for what a pattern means: does pattern p match
+//the concrete URI c
+func refMatch(p, c []string) bool {
+	if len(p) == 0 {
+		return len(c) == 0
+	}
+	switch p[0] {
+	case "*":
+		for i := 0; i <= len(c); i++ {
+			if refMatch(p[1:], c[i:]) {
+				return true
+			}
+		}
+		return false
+	case "+":
+		return len(c) > 0 && refMatch(p[1:], c[1:])
+	}
+	return len(c) > 0 && c[0] == p[0] && refMatch(p[1:], c[1:])
+}
+
+//refURIs are all the URIs of up to six elements from a, b and c. Patterns
+//of up to four elements over a and b that intersect have a URI in common
+//among them
+func refURIs() [][]string {
+	var rv [][]string
+	var gen func(pre []string)
+	gen = func(pre []string) {
+		if len(pre) > 0 {
+			rv = append(rv, append([]string{}, pre...))
+		}
+		if len(pre) == 6 {
+			return
+		}
+		for _, e := range []string{"a", "b", "c"} {
+			gen(append(pre, e))
+		}
+	}
+	gen(nil)
+	return rv
+}
+
+func randPattern(r *rand.Rand) string {
+	parts := make([]string, 1+r.Intn(4))
+	star := false
+	for i := range parts {
+		parts[i] = []string{"a", "b", "+", "*"}[r.Intn(4)]
+		if parts[i] == "*" {
+			if star {
+				parts[i] = "+"
+			}
+			star = true
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+//checkRestrictBy checks the properties documented on RestrictBy for one
+//pair of patterns
+func checkRestrictBy(t *testing.T, uris [][]string, from, by string) {
+	rv, ok := RestrictBy(from, by)
+	fp, bp := strings.Split(from, "/"), strings.Split(by, "/")
+	exact := !strings.Contains(from, "*") || !strings.Contains(by, "*")
+	common := false
+	for _, c := range uris {
+		both := refMatch(fp, c) && refMatch(bp, c)
+		inrv := ok && refMatch(strings.Split(rv, "/"), c)
+		common = common || both
+		if inrv && !both {
+			t.Fatalf("RestrictBy(%q, %q) = %q matches %q, which they do not both match", from, by, rv, strings.Join(c, "/"))
+		}
+		if both && !inrv && exact {
+			t.Fatalf("RestrictBy(%q, %q) = %q, %v misses %q", from, by, rv, ok, strings.Join(c, "/"))
+		}
+	}
+	if ok != common {
+		t.Fatalf("RestrictBy(%q, %q) is %v but a common URI exists is %v", from, by, ok, common)
+	}
+	if why := ExplainRestrictBy(from, by); (why == "") != ok {
+		t.Fatalf("ExplainRestrictBy(%q, %q) = %q but RestrictBy is %v", from, by, why, ok)
+	}
+	if rv2, ok2 := RestrictBy(by, from); rv2 != rv || ok2 != ok {
+		t.Fatalf("RestrictBy(%q, %q) = %q, %v but swapped it is %q, %v", from, by, rv, ok, rv2, ok2)
+	}
+	if !ok {
+		return
+	}
+	if valid, _, _, _ := AnalyzeSuffix(rv); !valid {
+		t.Fatalf("RestrictBy(%q, %q) = %q is not a valid URI", from, by, rv)
+	}
+	for _, p := range []string{rv, from, by} {
+		if rv2, ok2 := RestrictBy(rv, p); rv2 != rv || !ok2 {
+			t.Fatalf("RestrictBy(%q, %q) = %q, %v but it should be unchanged", rv, p, rv2, ok2)
+		}
+	}
+}
+
+func TestRestrictByProperties(t *testing.T) {
+	uris := refURIs()
+	r := rand.New(rand.NewSource(4878))
+	n := 3000
+	if testing.Short() {
+		n = 300
+	}
+	for i := 0; i < n; i++ {
+		checkRestrictBy(t, uris, randPattern(r), randPattern(r))
+	}
+}
+
+func TestRestrictByAdversarial(t *testing.T) {
+	uris := refURIs()
+	for _, v := range [][2]string{
+		{"*", "*"},
+		{"*", "+"},
+		{"+", "a/*"},
+		{"*/a", "a/*"},
+		{"*/a/b", "a/b/*"},
+		{"a/*/a", "a"},
+		{"a/*/a", "a/a"},
+		{"+/*/+", "a"},
+		{"+/*/+", "*/b/a"},
+		{"a/*/b", "*/b/a"},
+		{"*/b/a", "a/b/*"},
+		{"+/+/+", "*/a/+"},
+		{"a/+/*", "*/a/+/+"},
+		{"*/+/b", "a/a/*/b"},
+		{"a/b/+/*", "*/c/a"},
+	} {
+		checkRestrictBy(t, uris, v[0], v[1])
+	}
+}
+
+func TestExplainRestrictBy(t *testing.T) {
+	TV := []struct {
+		From, By, Why string
+	}{
+		{"a/b/c", "a/+/c", ""},
+		{"a/b/c", "a/c/c", `element 1 of "a/b/c" (b) does not match element 1 of "a/c/c" (c)`},
+		{"a/*/c", "+/b/d", `element 2 of "a/*/c" (c) does not match element 2 of "+/b/d" (d)`},
+		{"a/b", "a/b/c", `"a/b" has 2 elements but "a/b/c" has 3`},
+		{"a/*/b/c", "a/c", `"a/*/b/c" needs at least 3 elements but "a/c" has 2`},
+	}
+	for _, v := range TV {
+		if why := ExplainRestrictBy(v.From, v.By); why != v.Why {
+			t.Errorf("ExplainRestrictBy(%q, %q) = %q, expected %q", v.From, v.By, why, v.Why)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package util
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+//URIReason is why a URI is invalid
+type URIReason int
+
+const (
+	URIEmptyElement URIReason = iota + 1
+	//More than one "*". RestrictBy could not always express what two
+	//patterns with two stars each have in common, so a URI has only one
+	URIDoubleStar
+	//A "*" or "+" in an element with other characters
+	URIMisplacedWildcard
+	URIBadCharacter
+	//A "!" that is not the first character of its element, or a "!" alone
+	URIMisplacedBang
+	URIDoubleBang
+	URIBadNamespace
+	URINoSuffix
+	URIBadTemplate
+)
+
+//URIError says what is wrong with a URI and where. Pos is the byte offset
+//in URI of the bad character or element
+type URIError struct {
+	URI    string
+	Pos    int
+	Reason URIReason
+	Msg    string
+}
+
+func (e *URIError) Error() string {
+	return fmt.Sprintf("bad URI %q at %d: %s", e.URI, e.Pos, e.Msg)
+}
+
+//Pointer is the URI with a caret under the problem, for showing to users
+func (e *URIError) Pointer() string {
+	return e.URI + "\n" + strings.Repeat(" ", e.Pos) + "^"
+}
+
+//isCellChar is true for the characters allowed in a URI element, other
+//than a leading "!"
+func isCellChar(k byte) bool {
+	return '0' <= k && k <= '9' ||
+		'a' <= k && k <= 'z' ||
+		'A' <= k && k <= 'Z' ||
+		k == '-' || k == '_' ||
+		k == ',' || k == '(' ||
+		k == ')' || k == '.' ||
+		k == '$'
+}
+
+//ValidateSuffix checks a URI suffix with the same rules as AnalyzeSuffix,
+//but says what is wrong with it. The error is a *URIError
+func ValidateSuffix(suffix string) error {
+	fail := func(pos int, reason URIReason, msg string) error {
+		return &URIError{URI: suffix, Pos: pos, Reason: reason, Msg: msg}
+	}
+	star, bang := false, false
+	pos := 0
+	for _, c := range strings.Split(suffix, "/") {
+		switch c {
+		case "":
+			return fail(pos, URIEmptyElement, "empty element")
+		case "*":
+			if star {
+				return fail(pos, URIDoubleStar, "more than one * element")
+			}
+			star = true
+		case "+":
+		case "!":
+			return fail(pos, URIMisplacedBang, "! must be followed by a name")
+		default:
+			i := 0
+			if c[0] == '!' {
+				if bang {
+					return fail(pos, URIDoubleBang, "more than one ! element")
+				}
+				bang = true
+				i = 1
+			}
+			for ; i < len(c); i++ {
+				switch k := c[i]; {
+				case isCellChar(k):
+				case k == '*' || k == '+':
+					return fail(pos+i, URIMisplacedWildcard, fmt.Sprintf("%c must be a whole element", k))
+				case k == '!':
+					return fail(pos+i, URIMisplacedBang, "! may only start an element")
+				default:
+					return fail(pos+i, URIBadCharacter, fmt.Sprintf("%q is not allowed in a URI", k))
+				}
+			}
+		}
+		pos += len(c) + 1
+	}
+	return nil
+}
+
+//ValidateURI checks a full URI, namespace/suffix. The namespace may be an
+//alias or a VK, so only the suffix is checked in detail
+func ValidateURI(uri string) error {
+	_, _, err := SplitURI(uri)
+	return err
+}
+
+//SplitURI splits a full URI into its namespace and a valid suffix. The
+//error is a *URIError with a position in uri
+func SplitURI(uri string) (ns string, suffix string, err error) {
+	idx := strings.Index(uri, "/")
+	switch {
+	case idx < 0:
+		return "", "", &URIError{URI: uri, Pos: len(uri), Reason: URINoSuffix, Msg: "URI should be namespace/suffix"}
+	case idx == 0:
+		return "", "", &URIError{URI: uri, Pos: 0, Reason: URIBadNamespace, Msg: "no namespace"}
+	}
+	ns, suffix = uri[:idx], uri[idx+1:]
+	if err := ValidateSuffix(suffix); err != nil {
+		ue := err.(*URIError)
+		return "", "", &URIError{URI: uri, Pos: idx + 1 + ue.Pos, Reason: ue.Reason, Msg: ue.Msg}
+	}
+	return ns, suffix, nil
+}
+
+//SplitSuffix splits a valid suffix into its elements. A "!" or "$" stays
+//on the start of its element
+func SplitSuffix(suffix string) ([]string, error) {
+	if err := ValidateSuffix(suffix); err != nil {
+		return nil, err
+	}
+	return strings.Split(suffix, "/"), nil
+}
+
+//JoinSuffix joins elements into a suffix. An element may itself hold
+//several, and slashes at its ends are dropped, so "a/" and "/b" join to
+//"a/b". The result must be valid, so only one of the elements may have a
+//"!" element in it however they are split up
+func JoinSuffix(elements ...string) (string, error) {
+	parts := make([]string, 0, len(elements))
+	for _, e := range elements {
+		e = strings.Trim(e, "/")
+		if e != "" {
+			parts = append(parts, e)
+		}
+	}
+	rv := strings.Join(parts, "/")
+	if err := ValidateSuffix(rv); err != nil {
+		return "", err
+	}
+	return rv, nil
+}
+
+//JoinURI is like JoinSuffix, but puts the namespace in front
+func JoinURI(ns string, elements ...string) (string, error) {
+	if ns == "" || strings.Contains(ns, "/") {
+		return "", &URIError{URI: ns, Pos: 0, Reason: URIBadNamespace, Msg: "bad namespace"}
+	}
+	suffix, err := JoinSuffix(elements...)
+	if err != nil {
+		ue := err.(*URIError)
+		return "", &URIError{URI: ns + "/" + ue.URI, Pos: len(ns) + 1 + ue.Pos, Reason: ue.Reason, Msg: ue.Msg}
+	}
+	return ns + "/" + suffix, nil
+}
+
+//FullURI is the URI with the namespace as the formatted MVK, which is how
+//routers name topics. The MVK is formatted as crypto.FmtKey does
+func FullURI(mvk []byte, suffix string) string {
+	return base64.URLEncoding.EncodeToString(mvk) + "/" + suffix
+}
+
+//ParseFullURI is the inverse of FullURI. The namespace must be a VK, not
+//an alias
+func ParseFullURI(uri string) (mvk []byte, suffix string, err error) {
+	ns, suffix, err := SplitURI(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	mvk, err = base64.URLEncoding.DecodeString(ns)
+	if err != nil || !VerifyMVK(mvk) {
+		return nil, "", &URIError{URI: uri, Pos: 0, Reason: URIBadNamespace, Msg: "the namespace is not a VK"}
+	}
+	return mvk, suffix, nil
+}
+
+//ExpandURITemplate replaces each {name} in tmpl with vars[name], as in
+//{ns}/s.{svc}/{inst}/i.{iface}, and checks the result is a valid URI.
+//Values may not contain a "/", so each stays within its element
+func ExpandURITemplate(tmpl string, vars map[string]string) (string, error) {
+	rv := make([]byte, 0, len(tmpl))
+	for i := 0; i < len(tmpl); i++ {
+		switch tmpl[i] {
+		case '{':
+			end := strings.IndexByte(tmpl[i:], '}')
+			if end < 0 {
+				return "", &URIError{URI: tmpl, Pos: i, Reason: URIBadTemplate, Msg: "unclosed {"}
+			}
+			name := tmpl[i+1 : i+end]
+			val, ok := vars[name]
+			if !ok {
+				return "", &URIError{URI: tmpl, Pos: i, Reason: URIBadTemplate, Msg: fmt.Sprintf("no value for {%s}", name)}
+			}
+			if val == "" || strings.Contains(val, "/") {
+				return "", &URIError{URI: tmpl, Pos: i, Reason: URIBadTemplate, Msg: fmt.Sprintf("the value of {%s} must be part of one element", name)}
+			}
+			rv = append(rv, val...)
+			i += end
+		case '}':
+			return "", &URIError{URI: tmpl, Pos: i, Reason: URIBadTemplate, Msg: "} without {"}
+		default:
+			rv = append(rv, tmpl[i])
+		}
+	}
+	if err := ValidateURI(string(rv)); err != nil {
+		return "", err
+	}
+	return string(rv), nil
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidateSuffix(t *testing.T) {
+	TV := []struct {
+		S   string
+		Pos int
+	}{
+		{"a/b/c", -1},
+		{"a/*/!meta/+", -1},
+		{"$chainbuild/x/request", -1},
+		{"a//b", 2},
+		{"a/b/", 4},
+		{"*/a/*", 4},
+		{"a/!x/!y", 5},
+		{"a/!", 2},
+		{"a/b!c", 3},
+		{"a/b*", 3},
+		{"a/b c", 3},
+	}
+	for _, v := range TV {
+		err := ValidateSuffix(v.S)
+		valid, _, _, _ := AnalyzeSuffix(v.S)
+		if valid != (err == nil) {
+			t.Fatalf("%q: AnalyzeSuffix says %v but ValidateSuffix says %v", v.S, valid, err)
+		}
+		if v.Pos < 0 {
+			if err != nil {
+				t.Fatalf("%q: unexpected error %v", v.S, err)
+			}
+			continue
+		}
+		ue, ok := err.(*URIError)
+		if !ok || ue.Pos != v.Pos {
+			t.Fatalf("%q: expected an error at %d, got %v", v.S, v.Pos, err)
+		}
+	}
+}
+
+func TestSplitJoinURI(t *testing.T) {
+	ns, suffix, err := SplitURI("ns.bw/a/b")
+	if err != nil || ns != "ns.bw" || suffix != "a/b" {
+		t.Fatalf("got %q %q %v", ns, suffix, err)
+	}
+	if _, _, err := SplitURI("ns.bw/a//b"); err == nil || err.(*URIError).Pos != 8 {
+		t.Fatalf("expected an error at 8, got %v", err)
+	}
+	uri, err := JoinURI("ns.bw", "a/", "/!meta", "b")
+	if err != nil || uri != "ns.bw/a/!meta/b" {
+		t.Fatalf("got %q %v", uri, err)
+	}
+	if _, err := JoinURI("ns.bw", "!meta", "a/!other"); err == nil {
+		t.Fatal("joined a URI with two ! elements")
+	}
+	mvk := bytes.Repeat([]byte{7}, 32)
+	rmvk, suffix, err := ParseFullURI(FullURI(mvk, "a/b"))
+	if err != nil || !bytes.Equal(rmvk, mvk) || suffix != "a/b" {
+		t.Fatalf("got %x %q %v", rmvk, suffix, err)
+	}
+	if _, _, err := ParseFullURI("ns.bw/a/b"); err == nil {
+		t.Fatal("parsed an alias as a full URI")
+	}
+}
+
+func TestExpandURITemplate(t *testing.T) {
+	vars := map[string]string{"ns": "ns.bw", "svc": "hvac", "inst": "t1", "iface": "thermostat"}
+	uri, err := ExpandURITemplate("{ns}/s.{svc}/{inst}/i.{iface}", vars)
+	if err != nil || uri != "ns.bw/s.hvac/t1/i.thermostat" {
+		t.Fatalf("got %q %v", uri, err)
+	}
+	for tmpl, pos := range map[string]int{
+		"{ns}/s.{svc}/{nope}": 13,
+		"{ns}/s.{svc":         7,
+		"{ns}/a}":             6,
+	} {
+		if _, err := ExpandURITemplate(tmpl, vars); err == nil || err.(*URIError).Pos != pos {
+			t.Fatalf("%q: expected an error at %d, got %v", tmpl, pos, err)
+		}
+	}
+	vars["inst"] = "a/b"
+	if _, err := ExpandURITemplate("{ns}/{inst}", vars); err == nil {
+		t.Fatal("expanded a value with a slash")
+	}
+}
+
+func TestAnalyzeSuffixDetailed(t *testing.T) {
+	TV := []struct {
+		S      string
+		Reason URIReason
+	}{
+		{"a/*/b/*", URIDoubleStar},
+		{"a/b*/c", URIMisplacedWildcard},
+		{"a/b!", URIMisplacedBang},
+		{"!a/!b", URIDoubleBang},
+		{"a/b%", URIBadCharacter},
+		{"a//b", URIEmptyElement},
+	}
+	for _, v := range TV {
+		_, _, _, err := AnalyzeSuffixDetailed(v.S)
+		if err == nil || err.Reason != v.Reason {
+			t.Errorf("%q: expected reason %d, got %v", v.S, v.Reason, err)
+		}
+	}
+	star, plus, bang, err := AnalyzeSuffixDetailed("a/+/!b/*")
+	if err != nil || !star || !plus || !bang {
+		t.Errorf("got %v %v %v %v", star, plus, bang, err)
+	}
+}
@@ -70,14 +70,7 @@ func AnalyzeSuffix(uri string) (valid, hasStar, hasPlus, hasBang bool) {
 			case "!":
 				return
 			default:
-				k := c[0]
-				if !('0' <= k && k <= '9' ||
-					'a' <= k && k <= 'z' ||
-					'A' <= k && k <= 'Z' ||
-					k == '-' || k == '_' ||
-					k == ',' || k == '(' ||
-					k == ')' || k == '.' ||
-					k == '$') {
+				if !isCellChar(c[0]) {
 					return
 				}
 			}
@@ -90,14 +83,7 @@ func AnalyzeSuffix(uri string) (valid, hasStar, hasPlus, hasBang bool) {
 				c = c[1:]
 			}
 			for i := 0; i < len(c); i++ {
-				k := c[i]
-				if !('0' <= k && k <= '9' ||
-					'a' <= k && k <= 'z' ||
-					'A' <= k && k <= 'Z' ||
-					k == '-' || k == '_' ||
-					k == ',' || k == '(' ||
-					k == ')' || k == '.' ||
-					k == '$') {
+				if !isCellChar(c[i]) {
 					return
 				}
 			}
@@ -107,92 +93,59 @@ func AnalyzeSuffix(uri string) (valid, hasStar, hasPlus, hasBang bool) {
 	return
 }
 
-func VerifyMVK(mvk []byte) bool {
-	return len(mvk) == 32
+//AnalyzeSuffixDetailed is like AnalyzeSuffix, but says why an invalid URI
+//is invalid. The flags are only set if err is nil
+func AnalyzeSuffixDetailed(uri string) (hasStar, hasPlus, hasBang bool, err *URIError) {
+	if verr := ValidateSuffix(uri); verr != nil {
+		return false, false, false, verr.(*URIError)
+	}
+	_, hasStar, hasPlus, hasBang = AnalyzeSuffix(uri)
+	return hasStar, hasPlus, hasBang, nil
 }
 
-// RestrictBy takes a topic, and a permission, and returns the intersection
-// that represents the from topic restricted by the permission. It took a
-// looong time to work out this logic...
-func RestrictBy(from string, by string) (string, bool) {
-	fp := strings.Split(from, "/")
-	bp := strings.Split(by, "/")
-	fout := make([]string, 0, len(fp)+len(bp))
-	bout := make([]string, 0, len(fp)+len(bp))
-	var fsx, bsx int
-	for fsx = 0; fsx < len(fp) && fp[fsx] != "*"; fsx++ {
-	}
-	for bsx = 0; bsx < len(bp) && bp[bsx] != "*"; bsx++ {
-	}
-	fi, bi := 0, 0
-	fni, bni := len(fp)-1, len(bp)-1
-	emit := func() (string, bool) {
-		for i := 0; i < len(bout); i++ {
-			fout = append(fout, bout[len(bout)-i-1])
-		}
-		return strings.Join(fout, "/"), true
-	}
-	//phase 1
-	//emit matching prefix
-	for ; fi < len(fp) && bi < len(bp); fi, bi = fi+1, bi+1 {
-		if fp[fi] != "*" && (fp[fi] == bp[bi] || (bp[bi] == "+" && fp[fi] != "*")) {
-			fout = append(fout, fp[fi])
-		} else if fp[fi] == "+" && bp[bi] != "*" {
-			fout = append(fout, bp[bi])
-		} else {
-			break
-		}
-	}
-	//phase 2
-	//emit matching suffix
-	for ; fni >= fi && bni >= bi; fni, bni = fni-1, bni-1 {
-		if bp[bni] != "*" && (fp[fni] == bp[bni] || (bp[bni] == "+" && fp[fni] != "*")) {
-			bout = append(bout, fp[fni])
-		} else if fp[fni] == "+" && bp[bni] != "*" {
-			bout = append(bout, bp[bni])
-		} else {
-			break
-		}
-	}
-	//phase 3
-	//emit front
-	if fi < len(fp) && fp[fi] == "*" {
-		for ; bi < len(bp) && bp[bi] != "*" && bi <= bni; bi++ {
-			fout = append(fout, bp[bi])
-		}
-	} else if bi < len(bp) && bp[bi] == "*" {
-		for ; fi < len(fp) && fp[fi] != "*" && fi <= fni; fi++ {
-			fout = append(fout, fp[fi])
-		}
-	}
-	//phase 4
-	//emit back
-	if fni >= 0 && fp[fni] == "*" {
-		for ; bni >= 0 && bp[bni] != "*" && bni >= bi; bni-- {
-			bout = append(bout, bp[bni])
+//IsFreePath returns true if the URI has a cell starting with "$", so the
+//URI is in a read-only free-path. A URI with wildcards is only a free-path
+//if everything it matches is
+func IsFreePath(uri string) bool {
+	for _, c := range strings.Split(uri, "/") {
+		if len(c) > 0 && c[0] == '$' {
+			return true
 		}
-	} else if bni >= 0 && bp[bni] == "*" {
-		for ; fni >= 0 && fp[fni] != "*" && fni >= fi; fni-- {
-			bout = append(bout, fp[fni])
-		}
-	}
-	//phase 5
-	//emit star if they both have it
-	if fi == fni && fp[fi] == "*" && bi == bni && bp[bi] == "*" {
-		fout = append(fout, "*")
-		return emit()
-	}
-	//Remove any stars
-	if fi < len(fp) && fp[fi] == "*" {
-		fi++
-	}
-	if bi < len(bp) && bp[bi] == "*" {
-		bi++
 	}
-	if (fi == fni+1 || fi == len(fp)) && (bi == bni+1 || bi == len(bp)) {
-		return emit()
+	return false
+}
+
+//ChainBuildURIPrefix is the free path a namespace's designated router
+//offers chain building on
+const ChainBuildURIPrefix = "$chainbuild"
+
+//IsChainBuildRequest returns true if the URI suffix is
+//$chainbuild/<id>/request, the one free path that anyone may publish (but
+//not persist) on
+func IsChainBuildRequest(suffix string) bool {
+	parts := strings.Split(suffix, "/")
+	return len(parts) == 3 && parts[0] == ChainBuildURIPrefix &&
+		parts[2] == "request" && parts[1] != "" &&
+		parts[1] != "*" && parts[1] != "+" && parts[1][0] != '$'
+}
+
+//DOTRequestURIPrefix is the free path requests for DOTs are persisted on,
+//in the namespace of the URI the DOT would grant
+const DOTRequestURIPrefix = "$dotrequest"
+
+//DOTRequestPath splits a URI suffix of the form
+//$dotrequest/<granter VK>/<requester VK> into the two VKs. The requester
+//may persist on it, and the granter or the requester may delete it
+func DOTRequestPath(suffix string) (granter string, requester string, ok bool) {
+	parts := strings.Split(suffix, "/")
+	if len(parts) != 3 || parts[0] != DOTRequestURIPrefix || len(parts[1]) != 44 || len(parts[2]) != 44 {
+		return "", "", false
 	}
-	return "", false
+	return parts[1], parts[2], true
+}
+
+func VerifyMVK(mvk []byte) bool {
+	return len(mvk) == 32
 }
 
 //ParseDuration is a little like the existing time.ParseDuration
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestIsFreePath(t *testing.T) {
+	TV := []struct {
+		URI  string
+		Free bool
+	}{
+		{"a/b/c", false},
+		{"a/$router/peers", true},
+		{"$/dr/replica", true},
+		{"*/$router/+", true},
+		{"a/b$/c", false},
+		{"a/*", false},
+	}
+	for _, v := range TV {
+		if IsFreePath(v.URI) != v.Free {
+			t.Errorf("IsFreePath(%q) should be %v", v.URI, v.Free)
+		}
+	}
+}
+
+func TestIsChainBuildRequest(t *testing.T) {
+	TV := []struct {
+		URI     string
+		Request bool
+	}{
+		{"$chainbuild/abc/request", true},
+		{"$chainbuild/abc/result", false},
+		{"$chainbuild/+/request", false},
+		{"$chainbuild/$x/request", false},
+		{"a/$chainbuild/abc/request", false},
+		{"$chainbuild//request", false},
+	}
+	for _, v := range TV {
+		if IsChainBuildRequest(v.URI) != v.Request {
+			t.Errorf("IsChainBuildRequest(%q) should be %v", v.URI, v.Request)
+		}
+	}
+}
+
+func TestDOTRequestPath(t *testing.T) {
+	g := "KCJhPrJKS4pN2VBkGsr5XApsECObD1oPVtO4yngA1fs="
+	r := "LU7FsXAgzWkzRuXkzb2nkGHNxGBm6_JTVqgIz3Nc5Tw="
+	TV := []struct {
+		URI string
+		OK  bool
+	}{
+		{"$dotrequest/" + g + "/" + r, true},
+		{"$dotrequest/" + g, false},
+		{"$dotrequest/" + g + "/" + r + "/x", false},
+		{"$dotrequest/" + g + "/+", false},
+		{"$chainbuild/" + g + "/" + r, false},
+	}
+	for _, v := range TV {
+		gs, rs, ok := DOTRequestPath(v.URI)
+		if ok != v.OK {
+			t.Errorf("DOTRequestPath(%q) should be %v", v.URI, v.OK)
+		}
+		if ok && (gs != g || rs != r) {
+			t.Errorf("DOTRequestPath(%q) split wrongly: %s %s", v.URI, gs, rs)
+		}
+	}
+}